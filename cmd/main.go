@@ -4,18 +4,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 
 	"github.com/bagaking/memorianexus/src/gw"
 
-	"github.com/adjust/redismq"
 	"github.com/bagaking/memorianexus/src/model"
+	"github.com/google/uuid"
 	"github.com/khgame/ranger_iam/pkg/authcli"
+	"github.com/redis/go-redis/v9"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 	"gorm.io/driver/mysql"
@@ -28,6 +34,9 @@ import (
 
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/internal/utils/cache"
+	"github.com/bagaking/memorianexus/pkg/blobstore"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/pkg/tags"
 )
 
 const APIGroup = "/api/v1"
@@ -60,7 +69,11 @@ func dsn() string {
 	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=%s&parseTime=True&loc=%s", username, password, host, port, dbname, charset, loc)
 }
 
+// redisHost 可以通过 MEMORIA_NEXUS_REDIS_HOST 覆盖，否则按运行环境选择
 func redisHost() string {
+	if host := os.Getenv("MEMORIA_NEXUS_REDIS_HOST"); host != "" {
+		return host
+	}
 	host := "localhost"
 	switch utils.Env() {
 	case utils.RuntimeENVDev:
@@ -76,18 +89,67 @@ func redisHost() string {
 	return host
 }
 
+// redisPort 可以通过 MEMORIA_NEXUS_REDIS_PORT 覆盖，默认 6379
+func redisPort() string {
+	if port := os.Getenv("MEMORIA_NEXUS_REDIS_PORT"); port != "" {
+		return port
+	}
+	return "6379"
+}
+
 func redisDSN() string {
-	port := "6379"
-	return redisHost() + ":" + port
+	return net.JoinHostPort(redisHost(), redisPort())
+}
+
+// mediaDir 用户上传的媒体文件存放目录，不能放在静态文件目录下
+func mediaDir() string {
+	if dir := os.Getenv("MEMORIA_NEXUS_MEDIA_DIR"); dir != "" {
+		return dir
+	}
+	return "./data/media"
+}
+
+func mustInitMediaStore() blobstore.Store {
+	store, err := blobstore.NewLocalFS(mediaDir())
+	if err != nil {
+		wlog.Common("memorial_nexus", "mustInitMediaStore").Fatal("failed to init media store:", err)
+	}
+	return store
 }
 
-// 初始化 RedisMQ
-func mustInitRedisMQ(redisAddr string) *redismq.Queue {
-	queue := redismq.CreateQueue(redisAddr, "6379", "", 0, "memnexus")
-	if queue == nil {
-		wlog.Common("memorial_nexus", "mustInitRedisMQ").Fatal("failed to create RedisMQ queue")
+// tagQueueBackend 标签缓存失效消息使用的队列，可以通过 MEMORIA_NEXUS_TAG_QUEUE 设置为
+// redis (Redis Streams，默认，多实例部署时使用) 或 memory (进程内队列，仅适用于单实例部署)
+func tagQueueBackend() string {
+	if backend := os.Getenv("MEMORIA_NEXUS_TAG_QUEUE"); backend != "" {
+		return backend
+	}
+	return "redis"
+}
+
+// 初始化标签更新队列，以及处理失败的消息使用的死信存储
+func mustInitTagQueue(ctx context.Context) (tags.Producer, tags.Consumer, tags.UpdateOption) {
+	log := wlog.Common("memorial_nexus", "mustInitTagQueue")
+	switch backend := tagQueueBackend(); backend {
+	case "memory":
+		queue := tags.NewChanQueue(4096, tags.DefaultAckTimeout)
+		return queue, queue, tags.WithDeadLetters(tags.NewMemoryDeadLetters(1000))
+	case "redis":
+		// 不复用 cache.Client()，它的 key 前缀 hook 不能正确处理 stream 命令的参数
+		cli := redis.NewClient(&redis.Options{Addr: redisDSN()})
+		// 同一消费组中以实例区分 consumer，实例崩溃后遗留的消息会被其他实例认领
+		consumerName := "memnexus-" + uuid.NewString()
+		if hostname, err := os.Hostname(); err == nil && hostname != "" {
+			consumerName = hostname
+		}
+		queue, err := tags.NewRedisStreamQueue(ctx, cli, "mem_nexus:tag_updates", "tag_consumer", consumerName)
+		if err != nil {
+			log.Fatal("failed to create redis stream queue:", err)
+		}
+		return queue, queue, tags.WithDeadLetters(tags.NewRedisDeadLetters(cli, "mem_nexus:tag_updates:dead_letters"))
+	default:
+		log.Fatalf("unknown tag queue backend %q", backend)
+		return nil, nil, nil
 	}
-	return queue
 }
 
 func main() {
@@ -114,7 +176,7 @@ func main() {
 
 	// 初始化缓存
 	cache.Init(redisDSN())
-	redisMQInst := mustInitRedisMQ(redisHost())
+	tagProducer, tagConsumer, tagDeadLetters := mustInitTagQueue(context.TODO())
 
 	// 初始化HTTP路由
 	router := gin.Default()
@@ -126,20 +188,37 @@ func main() {
 	// todo: 这些值应该从配置中安全获取，现在 MVP 一下
 	iamCli := authcli.New("my_secret_key", "http://0.0.0.0:8090/")
 
-	model.MustInit(context.TODO(), db, redisMQInst)
+	model.MustInit(context.TODO(), db, tagProducer, tagConsumer, tagDeadLetters)
 
 	// todo: 挪到单独的服务里 ?
-	gw.RegRouter(router, db, iamCli, APIGroup, "/var/static/memnexus")
+	gw.RegRouter(router, db, iamCli, APIGroup, "/var/static/memnexus", mustInitMediaStore())
 
 	startLogger.Trace("memnexus initialed")
 	startLogger.Debug("memnexus initialed")
 	startLogger.Info("memnexus initialed")
 	// startLogger.Error("memnexus initialed")
 
-	// 开启HTTP服务
-	if err := router.Run(":8080"); err != nil {
-		startLogger.WithError(err).Infof("gin exit")
+	// 开启HTTP服务，收到退出信号后停止接收请求，并等待标签更新队列中正在处理的消息完成
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	model.StartStreakRolloverJob(ctx, db, time.Hour)
+	model.StartEventDispatcher(ctx, eventbus.DefaultPollInterval)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			startLogger.WithError(err).Infof("gin exit")
+		}
+		stop()
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		startLogger.WithError(err).Warnf("http server shutdown failed")
 	}
+	model.TagModel().UpdateMgr.Stop(shutdownCtx)
+	startLogger.Info("memnexus exited")
 }
 
 func mustInitDB() *gorm.DB {
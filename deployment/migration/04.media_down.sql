@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `item_media`;
+DROP TABLE IF EXISTS `media`;
@@ -0,0 +1,26 @@
+-- 用户上传的媒体文件，内容按 hash 存放在 blob store 中，同一内容只存一份
+CREATE TABLE `media` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `hash` CHAR(64) NOT NULL COMMENT "sha256 of the content, hex encoded",
+
+    `kind` VARCHAR(16) NOT NULL COMMENT "image or audio",
+    `mime_type` VARCHAR(128) NOT NULL,
+    `size` BIGINT NOT NULL COMMENT "bytes, counted in user's quota",
+    `file_name` VARCHAR(255),
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`user_id`, `hash`),
+    INDEX `idx_hash` (`hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `item_media` (
+    `item_id` BIGINT UNSIGNED NOT NULL,
+    `hash` CHAR(64) NOT NULL,
+    `position` INT NOT NULL DEFAULT 0 COMMENT "display order in the item",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`item_id`, `hash`),
+    INDEX `idx_hash` (`hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,4 @@
+ALTER TABLE `tags`
+    DROP PRIMARY KEY,
+    ADD PRIMARY KEY (`user_id`, `tag`(32), `entity_id`),
+    MODIFY `tag` VARCHAR(2048) NOT NULL;
@@ -0,0 +1,6 @@
+-- 层级标签 (如 lang/ja/kanji) 的路径很容易超过 32 个字符，原有的前缀主键会导致冲突
+-- 标签长度收紧到 512，主键使用完整的 tag，前缀查询 (tag LIKE 'lang/ja/%') 可以走主键的范围扫描
+ALTER TABLE `tags`
+    MODIFY `tag` VARCHAR(512) NOT NULL,
+    DROP PRIMARY KEY,
+    ADD PRIMARY KEY (`user_id`, `tag`, `entity_id`);
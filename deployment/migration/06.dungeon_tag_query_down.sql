@@ -0,0 +1,2 @@
+ALTER TABLE `dungeons`
+    DROP COLUMN `tag_query`;
@@ -0,0 +1,3 @@
+-- 复习计划可以用标签表达式 (如 `(grammar OR vocab) AND NOT hard`) 作为 items 的来源
+ALTER TABLE `dungeons`
+    ADD COLUMN `tag_query` VARCHAR(1024) NOT NULL DEFAULT '' COMMENT "tag expression selecting items, empty means not used" AFTER `description`;
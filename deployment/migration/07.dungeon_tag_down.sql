@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS `dungeon_tags`;
+CREATE TABLE `dungeon_tags` (
+    `dungeon_id` BIGINT UNSIGNED NOT NULL,
+    `tag_id` BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`dungeon_id`, `tag_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,8 @@
+-- 复习计划的标签来源改为直接保存标签字符串 (标签按 (user_id, tag, entity_id) 存储，没有数字 id)
+DROP TABLE IF EXISTS `dungeon_tags`;
+CREATE TABLE `dungeon_tags` (
+    `dungeon_id` BIGINT UNSIGNED NOT NULL,
+    `tag` VARCHAR(512) NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`dungeon_id`, `tag`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
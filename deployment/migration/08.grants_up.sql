@@ -0,0 +1,14 @@
+-- 资源所有者授予其他用户的权限，action: 1 读, 2 写, 3 管理 (删除等)，高级权限包含低级权限
+CREATE TABLE `grants` (
+    `resource` VARCHAR(32) NOT NULL COMMENT "item, book or dungeon",
+    `resource_id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL COMMENT "the grantee",
+    `action` TINYINT UNSIGNED NOT NULL,
+    `granted_by` BIGINT UNSIGNED NOT NULL,
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`resource`, `resource_id`, `user_id`),
+    INDEX `idx_grant_user` (`user_id`, `resource`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
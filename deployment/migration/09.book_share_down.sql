@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS `book_subscriptions`;
+
+ALTER TABLE `books`
+    DROP INDEX `uk_share_code`,
+    DROP COLUMN `share_code`,
+    DROP COLUMN `visibility`;
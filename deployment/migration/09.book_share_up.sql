@@ -0,0 +1,16 @@
+-- 册子可以分享: private 仅自己可见, unlisted 持有分享链接可见, public 出现在公开目录中
+ALTER TABLE `books`
+    ADD COLUMN `visibility` TINYINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "0 private, 1 unlisted, 2 public" AFTER `description`,
+    ADD COLUMN `share_code` VARCHAR(16) DEFAULT NULL COMMENT "random code in share link, generated on first share" AFTER `visibility`,
+    ADD UNIQUE INDEX `uk_share_code` (`share_code`);
+
+-- 用户订阅的其他用户的册子，订阅后只读地出现在书库中
+CREATE TABLE `book_subscriptions` (
+    `book_id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL COMMENT "the subscriber",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`book_id`, `user_id`),
+    INDEX `idx_subscription_user` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS `item_forks`;
+DROP TABLE IF EXISTS `book_forks`;
+
+ALTER TABLE `items`
+    DROP COLUMN `revision`;
@@ -0,0 +1,36 @@
+-- 学习材料的修订号，每次修改内容时递增，fork 记录复制或同步时的修订号
+ALTER TABLE `items`
+    ADD COLUMN `revision` INT UNSIGNED NOT NULL DEFAULT 1 COMMENT "incremented on every content update" AFTER `importance`;
+
+-- fork 出的册子的来源
+CREATE TABLE `book_forks` (
+    `book_id` BIGINT UNSIGNED NOT NULL COMMENT "the fork",
+    `source_book_id` BIGINT UNSIGNED NOT NULL COMMENT "the upstream book",
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `pulled_at` DATETIME DEFAULT NULL COMMENT "last time upstream changes were pulled",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`book_id`),
+    INDEX `idx_fork_source` (`source_book_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- fork 出的学习材料的来源，base_* 为上次同步时上游的内容，用于三方比对
+CREATE TABLE `item_forks` (
+    `item_id` BIGINT UNSIGNED NOT NULL COMMENT "the copied item",
+    `book_id` BIGINT UNSIGNED NOT NULL COMMENT "the fork it belongs to",
+    `source_item_id` BIGINT UNSIGNED NOT NULL COMMENT "the upstream item",
+    `base_revision` INT UNSIGNED NOT NULL COMMENT "revision of the upstream item at last sync",
+
+    `base_type` VARCHAR(50),
+    `base_content` TEXT,
+    `base_difficulty` TINYINT UNSIGNED,
+    `base_importance` TINYINT UNSIGNED,
+    `base_tags` TEXT COMMENT "sorted tags in json",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`item_id`),
+    INDEX `idx_item_fork_book` (`book_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,14 @@
+-- 册子的成员保存在 grants 中 (viewer 读, editor 写, owner 管理)，这里只记录成员对册子和其中学习材料的修改
+CREATE TABLE `book_activities` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `book_id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL COMMENT "who made the change",
+    `type` VARCHAR(32) NOT NULL COMMENT "e.g. item.added, item.updated, member.set",
+    `target_id` BIGINT UNSIGNED DEFAULT NULL COMMENT "the item or member affected",
+    `detail` VARCHAR(255) DEFAULT NULL,
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_activity_book` (`book_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
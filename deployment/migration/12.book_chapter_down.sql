@@ -0,0 +1,9 @@
+ALTER TABLE `dungeon_monsters`
+    DROP COLUMN `position`;
+
+ALTER TABLE `book_items`
+    DROP INDEX `idx_book_item_order`,
+    DROP COLUMN `rank`,
+    DROP COLUMN `chapter_id`;
+
+DROP TABLE IF EXISTS `book_chapters`;
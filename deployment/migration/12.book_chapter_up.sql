@@ -0,0 +1,24 @@
+-- 册子中的章节，可以嵌套；同一父章节下按 rank 排序，rank 是分数式的 key (见 pkg/rank)，按字节序比较
+CREATE TABLE `book_chapters` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `book_id` BIGINT UNSIGNED NOT NULL,
+    `parent_id` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "0 for top level chapters",
+    `title` VARCHAR(255) NOT NULL,
+    `rank` VARCHAR(64) CHARACTER SET ascii COLLATE ascii_bin NOT NULL COMMENT "position among sibling chapters",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_chapter_book` (`book_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 学习材料在册子中的位置，已有的数据 rank 为空，第一次移动时所在的列表会被重新分布
+ALTER TABLE `book_items`
+    ADD COLUMN `chapter_id` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "0 if not in any chapter",
+    ADD COLUMN `rank` VARCHAR(64) CHARACTER SET ascii COLLATE ascii_bin NOT NULL DEFAULT '' COMMENT "position in the chapter",
+    ADD INDEX `idx_book_item_order` (`book_id`, `chapter_id`, `rank`);
+
+-- campaign 按册子中的顺序引入新的学习材料
+ALTER TABLE `dungeon_monsters`
+    ADD COLUMN `position` INT UNSIGNED NOT NULL DEFAULT 0 COMMENT "order in the source book, starting from 1" AFTER `source_id`;
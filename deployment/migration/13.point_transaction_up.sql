@@ -0,0 +1,30 @@
+-- 积分流水，profile_points 中的余额只通过流水修改，余额总是等于流水中 delta 的和
+CREATE TABLE `point_transactions` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `currency` VARCHAR(16) NOT NULL COMMENT "cash, gem or vip_score",
+    `delta` BIGINT NOT NULL,
+    `balance` BIGINT UNSIGNED NOT NULL COMMENT "balance after the change",
+    `reason` VARCHAR(32) NOT NULL COMMENT "e.g. campaign.submit",
+    `ref_id` BIGINT UNSIGNED DEFAULT NULL COMMENT "the related entity, e.g. the dungeon",
+    `idempotency_key` VARCHAR(128) NOT NULL COMMENT "a change with the same key is applied only once",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_point_tx_user` (`user_id`, `currency`),
+    UNIQUE INDEX `idx_point_tx_idempotency` (`idempotency_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 已有的余额记为期初流水，使对账从一开始就成立
+INSERT INTO `point_transactions` (`id`, `user_id`, `currency`, `delta`, `balance`, `reason`, `idempotency_key`)
+SELECT UUID_SHORT(), `id`, 'cash', `cash`, `cash`, 'opening_balance', CONCAT('opening:', `id`, ':cash')
+FROM `profile_points` WHERE `cash` > 0 AND `deleted_at` IS NULL;
+
+INSERT INTO `point_transactions` (`id`, `user_id`, `currency`, `delta`, `balance`, `reason`, `idempotency_key`)
+SELECT UUID_SHORT(), `id`, 'gem', `gem`, `gem`, 'opening_balance', CONCAT('opening:', `id`, ':gem')
+FROM `profile_points` WHERE `gem` > 0 AND `deleted_at` IS NULL;
+
+INSERT INTO `point_transactions` (`id`, `user_id`, `currency`, `delta`, `balance`, `reason`, `idempotency_key`)
+SELECT UUID_SHORT(), `id`, 'vip_score', `vip_score`, `vip_score`, 'opening_balance', CONCAT('opening:', `id`, ':vip_score')
+FROM `profile_points` WHERE `vip_score` > 0 AND `deleted_at` IS NULL;
@@ -0,0 +1,13 @@
+-- 已处理的复习提交，客户端重试时按 attempt_id 返回第一次处理时的响应
+CREATE TABLE `practice_attempts` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `attempt_id` VARCHAR(64) NOT NULL COMMENT "generated by the client, unchanged on retry",
+    `dungeon_id` BIGINT UNSIGNED NOT NULL,
+    `item_id` BIGINT UNSIGNED NOT NULL,
+    `result` VARCHAR(16) NOT NULL COMMENT "e.g. kill, hit, miss",
+    `response` TEXT COMMENT "the response data of the first submission",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`user_id`, `attempt_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `practice_sessions`;
+DROP TABLE IF EXISTS `review_logs`;
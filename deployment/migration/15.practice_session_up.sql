@@ -0,0 +1,39 @@
+-- 复习记录，每次作答生效时记录一条 (submit、离线同步和复习会话)
+CREATE TABLE `review_logs` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `dungeon_id` BIGINT UNSIGNED NOT NULL,
+    `item_id` BIGINT UNSIGNED NOT NULL,
+    `session_id` BIGINT UNSIGNED DEFAULT NULL COMMENT "set when answered in a practice session",
+    `result` VARCHAR(16) NOT NULL COMMENT "e.g. kill, hit, miss",
+    `familiarity_before` TINYINT UNSIGNED DEFAULT 0,
+    `familiarity_after` TINYINT UNSIGNED DEFAULT 0,
+    `response_ms` BIGINT DEFAULT 0 COMMENT "tracked by the server in a session, 0 if unknown",
+    `practiced_at` DATETIME NOT NULL,
+    `next_practice_at` DATETIME DEFAULT NULL,
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_review_log_user` (`user_id`, `practiced_at`),
+    INDEX `idx_review_log_item` (`item_id`),
+    INDEX `idx_review_log_session` (`session_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 复习会话的汇总，会话开始时创建，结束时写入统计
+CREATE TABLE `practice_sessions` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `dungeon_id` BIGINT UNSIGNED NOT NULL,
+    `end_reason` VARCHAR(16) DEFAULT NULL COMMENT "completed, finished, timeout, disconnected or error; empty while active",
+    `answered` INT UNSIGNED DEFAULT 0,
+    `failed` INT UNSIGNED DEFAULT 0,
+    `cash` BIGINT UNSIGNED DEFAULT 0 COMMENT "points earned in the session",
+    `familiarity_gain` BIGINT DEFAULT 0,
+    `response_ms` BIGINT DEFAULT 0 COMMENT "sum of response times",
+    `started_at` DATETIME NOT NULL,
+    `ended_at` DATETIME DEFAULT NULL,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_practice_session_user` (`user_id`, `dungeon_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `daily_activities`;
+DROP TABLE IF EXISTS `user_streaks`;
@@ -0,0 +1,30 @@
+-- 连续打卡，每个用户一行，日期按用户的时区计算
+CREATE TABLE `user_streaks` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `timezone` VARCHAR(64) NOT NULL DEFAULT 'UTC' COMMENT "IANA timezone, e.g. Asia/Shanghai",
+    `goal_type` VARCHAR(16) NOT NULL DEFAULT 'reviews' COMMENT "reviews or points",
+    `goal_target` INT UNSIGNED NOT NULL DEFAULT 1,
+    `current_streak` INT UNSIGNED DEFAULT 0,
+    `longest_streak` INT UNSIGNED DEFAULT 0,
+    `last_goal_date` VARCHAR(10) DEFAULT NULL COMMENT "YYYY-MM-DD, the last day counted in the streak",
+    `freezes` INT UNSIGNED DEFAULT 0 COMMENT "streak freezes held by the user",
+
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`user_id`),
+    INDEX `idx_user_streak_current` (`current_streak`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 每天的复习统计
+CREATE TABLE `daily_activities` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `date` VARCHAR(10) NOT NULL COMMENT "YYYY-MM-DD in the timezone of the user",
+    `reviews` INT UNSIGNED DEFAULT 0,
+    `points` BIGINT UNSIGNED DEFAULT 0,
+    `goal_met` TINYINT(1) DEFAULT 0,
+    `frozen` TINYINT(1) DEFAULT 0 COMMENT "goal missed, a streak freeze was used",
+
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`user_id`, `date`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `achievement_event_keys`;
+DROP TABLE IF EXISTS `user_achievements`;
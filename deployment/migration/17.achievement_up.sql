@@ -0,0 +1,21 @@
+-- 成就进度，成就的定义见 src/model/achievements.yaml
+CREATE TABLE `user_achievements` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `achievement_id` BIGINT UNSIGNED NOT NULL,
+    `progress` BIGINT UNSIGNED DEFAULT 0,
+    `unlocked_at` DATETIME DEFAULT NULL COMMENT "set once the threshold is reached, the reward is granted in the same transaction",
+
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`user_id`, `achievement_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 已经计入成就的事件，同一个 key 的事件只计入一次 (如同一个册子多次公开)
+CREATE TABLE `achievement_event_keys` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `event_key` VARCHAR(128) NOT NULL COMMENT "e.g. book.published:{book_id}",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`user_id`, `event_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,15 @@
+-- 领域事件的 outbox，和业务写入在同一个事务中写入，提交后投递给异步订阅者 (见 pkg/eventbus)
+CREATE TABLE `event_outbox` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `name` VARCHAR(64) NOT NULL COMMENT "e.g. item.created",
+    `payload` TEXT NOT NULL COMMENT "json of the event",
+    `attempts` INT NOT NULL DEFAULT 0 COMMENT "failed deliveries",
+    `next_attempt_at` DATETIME NOT NULL,
+    `dead` TINYINT(1) NOT NULL DEFAULT 0 COMMENT "no more retries, kept for inspection",
+    `last_error` VARCHAR(512) DEFAULT NULL,
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_event_outbox_pending` (`dead`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
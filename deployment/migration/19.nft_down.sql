@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS `nft_draws`;
+DROP TABLE IF EXISTS `nft_pity_counters`;
+DROP TABLE IF EXISTS `nft_draw_seeds`;
+DROP TABLE IF EXISTS `nfts`;
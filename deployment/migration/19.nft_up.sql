@@ -0,0 +1,63 @@
+-- 用户持有的 NFT，模板和卡池的定义见 src/model/nfts.yaml
+CREATE TABLE `nfts` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `owner_id` BIGINT UNSIGNED NOT NULL,
+    `template_id` BIGINT UNSIGNED NOT NULL,
+    `rarity` VARCHAR(16) NOT NULL COMMENT "common, rare, epic or legendary",
+    `source` VARCHAR(16) NOT NULL COMMENT "e.g. draw",
+    `chain_token_id` VARCHAR(128) NOT NULL DEFAULT '' COMMENT "empty if the nft is only off-chain",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_nft_owner` (`owner_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 抽卡使用的服务端种子，使用中的种子只公开哈希，更换后公开种子本身
+CREATE TABLE `nft_draw_seeds` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `active_user_id` BIGINT UNSIGNED DEFAULT NULL COMMENT "equals user_id while the seed is in use, null once revealed",
+    `server_seed` VARCHAR(64) NOT NULL,
+    `server_seed_hash` VARCHAR(64) NOT NULL COMMENT "sha256 of server_seed",
+    `nonce` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "nonce of the last draw",
+    `revealed_at` DATETIME DEFAULT NULL,
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    UNIQUE INDEX `idx_nft_seed_active` (`active_user_id`),
+    INDEX `idx_nft_seed_user` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 保底计数: 距离上一次抽到 rarity 或更高稀有度的次数
+CREATE TABLE `nft_pity_counters` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `pool_id` BIGINT UNSIGNED NOT NULL,
+    `rarity` VARCHAR(16) NOT NULL,
+    `count` INT UNSIGNED NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (`user_id`, `pool_id`, `rarity`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 抽卡记录，由种子、client_seed 和 nonce 可以复算 rarity 和 template_id
+CREATE TABLE `nft_draws` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `pool_id` BIGINT UNSIGNED NOT NULL,
+    `seed_id` BIGINT UNSIGNED NOT NULL,
+    `client_seed` VARCHAR(64) NOT NULL DEFAULT '',
+    `nonce` BIGINT UNSIGNED NOT NULL,
+    `rarity` VARCHAR(16) NOT NULL,
+    `pity` TINYINT(1) NOT NULL DEFAULT 0 COMMENT "the rarity is decided by the pity rule",
+    `template_id` BIGINT UNSIGNED NOT NULL,
+    `nft_id` BIGINT UNSIGNED NOT NULL,
+    `payment_id` BIGINT UNSIGNED NOT NULL COMMENT "the point transaction paying the draw",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_nft_draw_user` (`user_id`, `created_at`),
+    INDEX `idx_nft_draw_payment` (`payment_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
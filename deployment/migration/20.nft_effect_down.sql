@@ -0,0 +1,5 @@
+ALTER TABLE `profile_points`
+    DROP COLUMN `draw_ticket`;
+
+ALTER TABLE `nfts`
+    DROP COLUMN `equipped_at`;
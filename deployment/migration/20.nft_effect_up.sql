@@ -0,0 +1,7 @@
+-- 装备中的 NFT 的追加类和通道类特效才会生效，每个用户最多同时装备 3 个
+ALTER TABLE `nfts`
+    ADD COLUMN `equipped_at` DATETIME DEFAULT NULL COMMENT "null if not equipped" AFTER `chain_token_id`;
+
+-- 抽卡券，作答时由 extra_draw 特效发放，可以代替积分在支持的卡池中抽卡
+ALTER TABLE `profile_points`
+    ADD COLUMN `draw_ticket` BIGINT UNSIGNED DEFAULT 0 AFTER `vip_score`;
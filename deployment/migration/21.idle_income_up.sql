@@ -0,0 +1,14 @@
+-- 挂机收益，每个用户一行。收益按 rate 从 settled_at 开始累积，最多累积到 claimed_at 之后 24 小时
+CREATE TABLE `idle_incomes` (
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `nft_rate` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "cash per hour from owned idle_income nfts",
+    `monster_rate` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "cash per hour from mastered monsters",
+    `rate` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "cash per hour, capped",
+    `accrued` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "accrued until settled_at, in 1/3600 cash",
+    `settled_at` DATETIME NOT NULL,
+    `claimed_at` DATETIME NOT NULL COMMENT "the accrual window starts here",
+
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
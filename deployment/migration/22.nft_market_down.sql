@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS `nft_shop_orders`;
+DROP TABLE IF EXISTS `nft_shop_stocks`;
+DROP TABLE IF EXISTS `nft_trades`;
+
+ALTER TABLE `nfts`
+    DROP COLUMN `version`;
@@ -0,0 +1,53 @@
+-- 乐观锁: 转移 NFT 时按 version 条件更新，并发的转移只有一个成功
+ALTER TABLE `nfts`
+    ADD COLUMN `version` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "bumped on every owner change" AFTER `owner_id`;
+
+-- 市场中的挂单，挂单中的 NFT 由市场托管 (nfts.owner_id 为 0)
+CREATE TABLE `nft_trades` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `seller_id` BIGINT UNSIGNED NOT NULL,
+    `buyer_id` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "0 until sold",
+    `nft_id` BIGINT UNSIGNED NOT NULL,
+    `template_id` BIGINT UNSIGNED NOT NULL,
+    `rarity` VARCHAR(16) NOT NULL,
+    `currency` VARCHAR(16) NOT NULL COMMENT "cash or gem",
+    `price` BIGINT UNSIGNED NOT NULL,
+    `status` VARCHAR(16) NOT NULL COMMENT "open, sold or cancelled",
+    `version` BIGINT UNSIGNED NOT NULL DEFAULT 0 COMMENT "bumped on every status change",
+    `closed_at` DATETIME DEFAULT NULL,
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_nft_trade_seller` (`seller_id`),
+    INDEX `idx_nft_trade_nft` (`nft_id`),
+    INDEX `idx_nft_trade_status` (`status`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 商店中商品已经售出的数量，商店和商品的定义见 src/model/nfts.yaml
+CREATE TABLE `nft_shop_stocks` (
+    `item_id` BIGINT UNSIGNED NOT NULL,
+    `sold` BIGINT UNSIGNED NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (`item_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 在商店购买的记录
+CREATE TABLE `nft_shop_orders` (
+    `id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `shop_id` BIGINT UNSIGNED NOT NULL,
+    `item_id` BIGINT UNSIGNED NOT NULL,
+    `template_id` BIGINT UNSIGNED NOT NULL,
+    `nft_id` BIGINT UNSIGNED NOT NULL,
+    `currency` VARCHAR(16) NOT NULL,
+    `price` BIGINT UNSIGNED NOT NULL,
+    `payment_id` BIGINT UNSIGNED NOT NULL COMMENT "the point transaction paying the order",
+
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (`id`),
+    INDEX `idx_nft_shop_order_user` (`user_id`),
+    UNIQUE INDEX `idx_nft_shop_order_payment` (`payment_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,3 @@
+DELETE FROM `dungeon_monsters` WHERE `deleted_at` IS NOT NULL;
+ALTER TABLE `dungeon_monsters`
+    DROP COLUMN `deleted_at`;
@@ -0,0 +1,3 @@
+-- 来自标签来源的 monster 不再匹配时软删除，重新匹配时恢复复习进度
+ALTER TABLE `dungeon_monsters`
+    ADD COLUMN `deleted_at` DATETIME DEFAULT NULL AFTER `created_at`;
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+	MaxIdempotencyKeyLen     = 64
+)
+
+// GinIdempotencyKey 由 Idempotency-Key 头生成积分流水的幂等键 (reason:user_id:key)，没有提供时生成一个不会重复的。
+// 失败时已经返回了错误，调用方直接返回
+func GinIdempotencyKey(c *gin.Context, log logrus.FieldLogger, reason string, userID UInt64) (string, bool) {
+	key := c.GetHeader(HeaderIdempotencyKey)
+	if len(key) > MaxIdempotencyKeyLen {
+		GinHandleError(c, log, http.StatusBadRequest, irr.Error("idempotency key is longer than %d", MaxIdempotencyKeyLen), "Invalid idempotency key")
+		return "", false
+	}
+	if key == "" {
+		id, err := GenIDU64(c)
+		if err != nil {
+			GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to generate idempotency key")
+			return "", false
+		}
+		key = fmt.Sprintf("%d", id)
+	}
+	return fmt.Sprintf("%s:%d:%s", reason, userID, key), true
+}
+
+// GinMarkReplayed 标记响应为幂等重放的结果
+func GinMarkReplayed(c *gin.Context) {
+	c.Header(HeaderIdempotentReplayed, "true")
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -9,6 +11,7 @@ import (
 	"github.com/bagaking/goulp/wlog"
 	"github.com/gin-gonic/gin"
 	"github.com/khicago/irr"
+	"gorm.io/gorm"
 )
 
 func GinMWParseID() gin.HandlerFunc {
@@ -26,10 +29,39 @@ func GinMWParseID() gin.HandlerFunc {
 	}
 }
 
-func GinMWParseTAG() gin.HandlerFunc {
+// GinMWParseTAG 解析路径中的 tag，可以传入 normalize 对 tag 进行校验和规范化
+// 层级标签中的 / 需要编码为 %2F，如 /tags/lang%2Fja/items
+func GinMWParseTAG(normalize ...func(string) (string, error)) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		idStr := c.Param("tag")
-		c.Set("__parsed_tag", idStr)
+		tag := c.Param("tag")
+		for _, fn := range normalize {
+			var err error
+			if tag, err = fn(tag); err != nil {
+				GinHandleError(c, wlog.ByCtx(c, "gin_parse_tag"), http.StatusBadRequest, err, "Invalid tag")
+				c.Abort()
+				return
+			}
+		}
+		c.Set("__parsed_tag", tag)
+		c.Next()
+	}
+}
+
+// GinMWAuthorize 校验当前用户对路径中 :id 指向的资源的权限，需要在 GinMWParseID 之后使用
+// authorize 返回 gorm.ErrRecordNotFound 表示资源不存在或没有权限，两者都返回 404，不向其他用户暴露资源是否存在
+func GinMWAuthorize(authorize func(ctx context.Context, userID, id UInt64) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, id := GinMustGetUserID(c), GinMustGetID(c)
+		log := wlog.ByCtx(c, "gin_authorize").WithField("user_id", userID).WithField("id", id)
+		if err := authorize(c, userID, id); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				GinHandleError(c, log, http.StatusNotFound, err, "Resource not found")
+			} else {
+				GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to authorize")
+			}
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
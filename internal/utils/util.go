@@ -3,12 +3,18 @@
 // This file was generated by setup_project.sh script.
 package utils
 
-import "os"
+import (
+	"os"
+	"strings"
+)
 
 // TODO: Implement utility functions for internal use.
 
 const ENVKey = "MEMORIA_NEXUS_ENV"
 
+// OperatorsENVKey 运维人员的用户 id 列表，用逗号分隔，只有运维人员可以访问系统运维接口
+const OperatorsENVKey = "MEMORIA_NEXUS_OPERATORS"
+
 const (
 	RuntimeENVDev     = "dev"
 	RuntimeENVLocal   = "local"
@@ -19,3 +25,13 @@ const (
 func Env() string {
 	return os.Getenv(ENVKey)
 }
+
+// IsOperator 判断用户是否是运维人员 (见 OperatorsENVKey)
+func IsOperator(userID UInt64) bool {
+	for _, str := range strings.Split(os.Getenv(OperatorsENVKey), ",") {
+		if id, err := ParseIDFromString(strings.TrimSpace(str)); err == nil && id == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/khicago/irr"
+)
+
+// LocalFS 基于本地文件系统的 Store 实现
+// 文件按 key 的前两级前缀分目录存放，如 ab/cd/abcdef...，避免单目录文件过多
+type LocalFS struct {
+	root string
+}
+
+var _ Store = (*LocalFS)(nil)
+
+// NewLocalFS creates a LocalFS rooted at dir, the dir will be created if not exist
+func NewLocalFS(dir string) (*LocalFS, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, irr.Wrap(err, "resolve blob root failed, dir= %s", dir)
+	}
+	if err = os.MkdirAll(root, 0o750); err != nil {
+		return nil, irr.Wrap(err, "create blob root failed, dir= %s", root)
+	}
+	return &LocalFS{root: root}, nil
+}
+
+func (s *LocalFS) path(key string) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.root, key[:2], key[2:4], key), nil
+}
+
+// Put 先写入同目录下的临时文件，再 rename 到目标位置，保证读到的一定是完整的文件
+func (s *LocalFS) Put(ctx context.Context, key string, r io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if err = os.MkdirAll(dir, 0o750); err != nil {
+		return irr.Wrap(err, "create blob dir failed")
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return irr.Wrap(err, "create temp file failed")
+	}
+	defer os.Remove(tmp.Name()) // rename 成功后 remove 会失败，忽略即可
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return irr.Wrap(err, "write blob failed, key= %s", key)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return irr.Wrap(err, "sync blob failed, key= %s", key)
+	}
+	if err = tmp.Close(); err != nil {
+		return irr.Wrap(err, "close blob failed, key= %s", key)
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return irr.Wrap(err, "commit blob failed, key= %s", key)
+	}
+	return nil
+}
+
+func (s *LocalFS) Open(ctx context.Context, key string) (Blob, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, irr.Wrap(err, "open blob failed, key= %s", key)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, irr.Wrap(err, "stat blob failed, key= %s", key)
+	}
+	return &localBlob{File: f, info: Info{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}}, nil
+}
+
+func (s *LocalFS) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err = os.Stat(p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, irr.Wrap(err, "stat blob failed, key= %s", key)
+	}
+	return true, nil
+}
+
+func (s *LocalFS) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return irr.Wrap(err, "delete blob failed, key= %s", key)
+	}
+	return nil
+}
+
+type localBlob struct {
+	*os.File
+	info Info
+}
+
+func (b *localBlob) Info() Info {
+	return b.info
+}
@@ -0,0 +1,68 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hashOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLocalFS(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	content := "hello memorianexus"
+	key := hashOf(content)
+
+	exist, err := store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, exist)
+
+	_, err = store.Open(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, store.Put(ctx, key, strings.NewReader(content)))
+	exist, err = store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, exist)
+
+	blob, err := store.Open(ctx, key)
+	require.NoError(t, err)
+	data, err := io.ReadAll(blob)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	assert.Equal(t, int64(len(content)), blob.Info().Size)
+	require.NoError(t, blob.Close())
+
+	// 重复写入同一个 key 是幂等的
+	require.NoError(t, store.Put(ctx, key, strings.NewReader(content)))
+
+	require.NoError(t, store.Delete(ctx, key))
+	exist, err = store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, exist)
+	assert.NoError(t, store.Delete(ctx, key), "delete a missing blob should not fail")
+}
+
+func TestLocalFS_InvalidKey(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	for _, key := range []string{"", "../../etc/passwd", strings.Repeat("g", 64), strings.Repeat("A", 64), "abcd"} {
+		assert.ErrorIs(t, store.Put(ctx, key, strings.NewReader("x")), ErrInvalidKey, key)
+		_, err = store.Open(ctx, key)
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+	}
+}
@@ -0,0 +1,52 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound 对应 key 的 blob 不存在
+	ErrNotFound = errors.New("blob not found")
+	// ErrInvalidKey key 不合法（只允许小写十六进制的内容哈希）
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+type (
+	// Store defines the interface for a content addressed blob store.
+	// key 为内容的哈希值，实现方不负责计算哈希，但需要保证写入是原子的
+	Store interface {
+		Put(ctx context.Context, key string, r io.Reader) error
+		Open(ctx context.Context, key string) (Blob, error)
+		Exists(ctx context.Context, key string) (bool, error)
+		Delete(ctx context.Context, key string) error
+	}
+
+	// Blob is a readable handle of a stored blob
+	Blob interface {
+		io.ReadSeekCloser
+		Info() Info
+	}
+
+	// Info 描述了 blob 的元信息
+	Info struct {
+		Key     string
+		Size    int64
+		ModTime time.Time
+	}
+)
+
+// ValidKey 检查 key 是否为合法的十六进制哈希串 (长度 32 ~ 128)
+func ValidKey(key string) bool {
+	if len(key) < 32 || len(key) > 128 {
+		return false
+	}
+	for _, ch := range key {
+		if !(ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f') {
+			return false
+		}
+	}
+	return true
+}
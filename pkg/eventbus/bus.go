@@ -0,0 +1,205 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+)
+
+type (
+	syncSubscriber[Tx any] struct {
+		name   string
+		handle func(ctx context.Context, tx Tx, e Event) error
+	}
+
+	asyncSubscriber struct {
+		name   string
+		handle func(ctx context.Context, payload []byte) error
+	}
+
+	// Bus 领域事件总线，订阅需要在开始发布事件之前完成
+	Bus[Tx any] struct {
+		outbox Outbox[Tx]
+		retry  RetryPolicy
+
+		mu     sync.RWMutex
+		syncs  map[string][]syncSubscriber[Tx]
+		asyncs map[string][]asyncSubscriber
+
+		wake chan struct{}
+	}
+)
+
+// New 创建事件总线，事件写入 outbox 后由 Run 投递给异步订阅者
+func New[Tx any](outbox Outbox[Tx], retry RetryPolicy) *Bus[Tx] {
+	return &Bus[Tx]{
+		outbox: outbox,
+		retry:  retry,
+		syncs:  make(map[string][]syncSubscriber[Tx]),
+		asyncs: make(map[string][]asyncSubscriber),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// eventName E 的零值的事件名，E 应该是值类型 (方法定义在值上)
+func eventName[E Event]() string {
+	var zero E
+	return zero.EventName()
+}
+
+// SubscribeSync 订阅事件，handler 在发布事件的事务中被调用。handler 返回错误时发布失败，调用方应该回滚事务
+func SubscribeSync[E Event, Tx any](b *Bus[Tx], subscriber string, handler func(ctx context.Context, tx Tx, e E) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	name := eventName[E]()
+	b.syncs[name] = append(b.syncs[name], syncSubscriber[Tx]{
+		name: subscriber,
+		handle: func(ctx context.Context, tx Tx, e Event) error {
+			return handler(ctx, tx, e.(E))
+		},
+	})
+}
+
+// SubscribeAsync 订阅事件，handler 在事务提交后由 Run 调用。
+// 投递是至少一次的: 同一个事件的任意一个异步订阅者失败时，所有的异步订阅者都会被重新调用，handler 需要是幂等的
+func SubscribeAsync[E Event, Tx any](b *Bus[Tx], subscriber string, handler func(ctx context.Context, e E) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	name := eventName[E]()
+	b.asyncs[name] = append(b.asyncs[name], asyncSubscriber{
+		name: subscriber,
+		handle: func(ctx context.Context, payload []byte) error {
+			var e E
+			if err := json.Unmarshal(payload, &e); err != nil {
+				return irr.Wrap(err, "decode event %s failed", name)
+			}
+			return handler(ctx, e)
+		},
+	})
+}
+
+// Publish 在事务 tx 中发布事件: 依次调用同步订阅者，然后把事件写入 outbox。事件只有在 tx 提交后才会投递给异步订阅者
+func (b *Bus[Tx]) Publish(ctx context.Context, tx Tx, events ...Event) error {
+	records := make([]*Record, 0, len(events))
+	for _, e := range events {
+		name := e.EventName()
+		b.mu.RLock()
+		subscribers := b.syncs[name]
+		b.mu.RUnlock()
+		for _, s := range subscribers {
+			if err := s.handle(ctx, tx, e); err != nil {
+				return irr.Wrap(err, "handle event %s by %s failed", name, s.name)
+			}
+		}
+
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return irr.Wrap(err, "encode event %s failed", name)
+		}
+		records = append(records, &Record{Name: name, Payload: payload, CreatedAt: time.Now()})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := b.outbox.Append(ctx, tx, records...); err != nil {
+		return irr.Wrap(err, "append events to outbox failed")
+	}
+	// 此时事务可能还没有提交，提前唤醒的 Dispatch 取不到的事件在下一次轮询时投递
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Dispatch 投递一批 outbox 中的事件，返回这一批的数量和投递成功的数量
+func (b *Bus[Tx]) Dispatch(ctx context.Context) (fetched, delivered int, err error) {
+	log := wlog.ByCtx(ctx, "eventbus.Dispatch")
+	records, err := b.outbox.Pending(ctx, dispatchBatchSize)
+	if err != nil {
+		return 0, 0, irr.Wrap(err, "get pending events failed")
+	}
+	for _, r := range records {
+		if cause := b.deliver(ctx, r); cause != nil {
+			r.Attempts++
+			var retryAt time.Time
+			if r.Attempts < b.retry.MaxAttempts {
+				retryAt = time.Now().Add(b.retry.Backoff(r.Attempts))
+			}
+			log.WithError(cause).Warnf("deliver event %d (%s) failed, attempts= %d, retry_at= %v", r.ID, r.Name, r.Attempts, retryAt)
+			if err = b.outbox.Retry(ctx, r.ID, cause, retryAt); err != nil {
+				return len(records), delivered, irr.Wrap(err, "mark event %d for retry failed", r.ID)
+			}
+			continue
+		}
+		if err = b.outbox.Done(ctx, r.ID); err != nil {
+			return len(records), delivered, irr.Wrap(err, "mark event %d done failed", r.ID)
+		}
+		delivered++
+	}
+	return len(records), delivered, nil
+}
+
+// deliver 把事件交给所有的异步订阅者，返回所有订阅者的错误
+func (b *Bus[Tx]) deliver(ctx context.Context, r *Record) error {
+	b.mu.RLock()
+	subscribers := b.asyncs[r.Name]
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, s := range subscribers {
+		if e := safeHandle(ctx, s, r.Payload); e != nil {
+			errs = append(errs, irr.Wrap(e, "subscriber %s", s.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func safeHandle(ctx context.Context, s asyncSubscriber, payload []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = irr.Error("panic: %s", fmt.Sprint(r))
+		}
+	}()
+	return s.handle(ctx, payload)
+}
+
+// Run 持续投递 outbox 中的事件直到 ctx 结束，每 interval 检查一次，发布事件时提前检查。
+// lock 不为空时每一轮投递在 lock 中执行，多实例部署时用于避免同时投递
+func (b *Bus[Tx]) Run(ctx context.Context, interval time.Duration, lock func(ctx context.Context, task func() error) error) {
+	log := wlog.ByCtx(ctx, "eventbus.Run")
+	round := func() error {
+		for {
+			fetched, _, err := b.Dispatch(ctx)
+			if err != nil || fetched < dispatchBatchSize {
+				return err
+			}
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		var err error
+		if lock != nil {
+			err = lock(ctx, round)
+		} else {
+			err = round()
+		}
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Warn("dispatch events failed")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package eventbus_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khicago/irr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+)
+
+type (
+	itemCreated struct {
+		ItemID uint64 `json:"item_id"`
+	}
+
+	// memTx 内存中的事务，提交后写入的事件才对 outbox 可见
+	memTx struct {
+		records []*eventbus.Record
+	}
+
+	memOutbox struct {
+		mu      sync.Mutex
+		nextID  uint64
+		records []*eventbus.Record
+		retryAt map[uint64]time.Time
+		dead    map[uint64]bool
+	}
+)
+
+func (itemCreated) EventName() string { return "item.created" }
+
+func newMemOutbox() *memOutbox {
+	return &memOutbox{retryAt: map[uint64]time.Time{}, dead: map[uint64]bool{}}
+}
+
+func (o *memOutbox) Append(ctx context.Context, tx *memTx, records ...*eventbus.Record) error {
+	tx.records = append(tx.records, records...)
+	return nil
+}
+
+func (o *memOutbox) commit(tx *memTx) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, r := range tx.records {
+		o.nextID++
+		r.ID = o.nextID
+		o.records = append(o.records, r)
+	}
+}
+
+func (o *memOutbox) Pending(ctx context.Context, limit int) ([]*eventbus.Record, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var ret []*eventbus.Record
+	for _, r := range o.records {
+		if len(ret) < limit && !o.dead[r.ID] && !o.retryAt[r.ID].After(time.Now()) {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+func (o *memOutbox) Done(ctx context.Context, id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, r := range o.records {
+		if r.ID == id {
+			o.records = append(o.records[:i], o.records[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (o *memOutbox) Retry(ctx context.Context, id uint64, cause error, retryAt time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if retryAt.IsZero() {
+		o.dead[id] = true
+	}
+	o.retryAt[id] = retryAt
+	return nil
+}
+
+func (o *memOutbox) size() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.records)
+}
+
+var fastRetry = eventbus.RetryPolicy{MaxAttempts: 2, BaseDelay: 0, MaxDelay: 0}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := eventbus.RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 4*time.Second, policy.Backoff(3))
+	assert.Equal(t, 30*time.Second, policy.Backoff(6))
+	assert.Equal(t, 30*time.Second, policy.Backoff(100))
+}
+
+// 同步订阅者在事务中立即被调用，异步订阅者只在事务提交后收到事件
+func TestBus_AsyncOnlyAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	outbox := newMemOutbox()
+	bus := eventbus.New[*memTx](outbox, fastRetry)
+
+	var syncSeen []uint64
+	eventbus.SubscribeSync(bus, "sync", func(ctx context.Context, tx *memTx, e itemCreated) error {
+		require.NotNil(t, tx)
+		syncSeen = append(syncSeen, e.ItemID)
+		return nil
+	})
+	var asyncSeen []uint64
+	eventbus.SubscribeAsync(bus, "async", func(ctx context.Context, e itemCreated) error {
+		asyncSeen = append(asyncSeen, e.ItemID)
+		return nil
+	})
+
+	committed, rolledBack := &memTx{}, &memTx{}
+	require.NoError(t, bus.Publish(ctx, committed, itemCreated{ItemID: 1}))
+	require.NoError(t, bus.Publish(ctx, rolledBack, itemCreated{ItemID: 2}))
+	assert.Equal(t, []uint64{1, 2}, syncSeen)
+
+	_, delivered, err := bus.Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, delivered, "nothing is committed yet")
+
+	outbox.commit(committed)
+	_, delivered, err = bus.Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, []uint64{1}, asyncSeen)
+	assert.Zero(t, outbox.size())
+}
+
+// 同步订阅者失败时发布失败，事件不会写入 outbox
+func TestBus_SyncFailureAbortsPublish(t *testing.T) {
+	ctx := context.Background()
+	outbox := newMemOutbox()
+	bus := eventbus.New[*memTx](outbox, fastRetry)
+	eventbus.SubscribeSync(bus, "sync", func(ctx context.Context, tx *memTx, e itemCreated) error {
+		return irr.Error("boom")
+	})
+
+	tx := &memTx{}
+	assert.Error(t, bus.Publish(ctx, tx, itemCreated{ItemID: 1}))
+	assert.Empty(t, tx.records)
+}
+
+// 异步订阅者失败时重试，次数耗尽后不再投递；panic 也视为失败
+func TestBus_AsyncRetryAndDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	outbox := newMemOutbox()
+	bus := eventbus.New[*memTx](outbox, fastRetry)
+
+	calls := 0
+	eventbus.SubscribeAsync(bus, "flaky", func(ctx context.Context, e itemCreated) error {
+		calls++
+		if e.ItemID == 2 {
+			panic("bad item")
+		}
+		if calls == 1 {
+			return irr.Error("temporary")
+		}
+		return nil
+	})
+
+	tx := &memTx{}
+	require.NoError(t, bus.Publish(ctx, tx, itemCreated{ItemID: 1}, itemCreated{ItemID: 2}))
+	outbox.commit(tx)
+
+	fetched, delivered, err := bus.Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetched)
+	assert.Zero(t, delivered)
+
+	_, delivered, err = bus.Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered, "item 1 succeeds on retry, item 2 is dead after 2 attempts")
+
+	fetched, _, err = bus.Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, fetched)
+	assert.Equal(t, 1, outbox.size())
+}
+
+// Run 持续投递已经提交的事件
+func TestBus_RunDeliversCommittedEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outbox := newMemOutbox()
+	bus := eventbus.New[*memTx](outbox, fastRetry)
+
+	received := make(chan uint64, 1)
+	eventbus.SubscribeAsync(bus, "async", func(ctx context.Context, e itemCreated) error {
+		received <- e.ItemID
+		return nil
+	})
+	go bus.Run(ctx, 10*time.Millisecond, nil)
+
+	tx := &memTx{}
+	require.NoError(t, bus.Publish(ctx, tx, itemCreated{ItemID: 7}))
+	outbox.commit(tx)
+
+	select {
+	case id := <-received:
+		assert.Equal(t, uint64(7), id)
+	case <-time.After(time.Second):
+		t.Fatal("event is not delivered")
+	}
+}
@@ -0,0 +1,69 @@
+// Package eventbus 进程内的领域事件总线。
+//
+// 同步订阅者在发布事件的事务中被调用，和业务写入一起提交或回滚；
+// 事件同时写入同一个事务中的 outbox，事务提交后由 Dispatcher 投递给异步订阅者 (至少一次)。
+// Tx 是事务的类型 (如 *gorm.DB)，eventbus 本身不依赖具体的存储
+package eventbus
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	// Event 领域事件，EventName 在所有事件中唯一，用于订阅和在 outbox 中序列化
+	Event interface {
+		EventName() string
+	}
+
+	// Record outbox 中的一条事件
+	Record struct {
+		ID        uint64
+		Name      string
+		Payload   []byte // JSON
+		Attempts  int    // 已经投递失败的次数
+		CreatedAt time.Time
+	}
+
+	// Outbox 事件的持久化。Append 必须使用调用方的事务，事务回滚时事件不会被投递
+	Outbox[Tx any] interface {
+		// Append 在事务中写入事件，record.ID 为空时由 Outbox 分配
+		Append(ctx context.Context, tx Tx, records ...*Record) error
+		// Pending 按写入顺序获取最多 limit 条已经提交、到了投递时间的事件
+		Pending(ctx context.Context, limit int) ([]*Record, error)
+		// Done 事件已经投递给所有的异步订阅者
+		Done(ctx context.Context, id uint64) error
+		// Retry 投递失败，retryAt 之后重新投递；retryAt 为零值时不再投递 (死信)
+		Retry(ctx context.Context, id uint64, cause error, retryAt time.Time) error
+	}
+
+	// RetryPolicy 异步投递失败后的重试策略，重试间隔按指数退避
+	RetryPolicy struct {
+		MaxAttempts int
+		BaseDelay   time.Duration
+		MaxDelay    time.Duration
+	}
+)
+
+const (
+	// DefaultMaxAttempts 异步投递最多尝试的次数
+	DefaultMaxAttempts = 8
+	// DefaultPollInterval Dispatcher 检查 outbox 的间隔，发布事件时会提前唤醒
+	DefaultPollInterval = time.Second
+
+	dispatchBatchSize = 100
+)
+
+// DefaultRetryPolicy 默认的重试策略
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: DefaultMaxAttempts, BaseDelay: time.Second, MaxDelay: 10 * time.Minute}
+}
+
+// Backoff 第 attempts 次失败后到下一次投递的等待时间
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
@@ -0,0 +1,158 @@
+// Package gacha 可审计的抽卡。
+//
+// 每次抽卡的随机数由 HMAC-SHA256(serverSeed, clientSeed:nonce) 生成。服务端在抽卡前只公开 serverSeed 的哈希 (承诺)，
+// 更换种子后公开原来的 serverSeed，用户可以用 HashSeed 校验承诺，并用 NewRand 和 Table.Draw 复算每一次抽卡的结果。
+// nonce 每次抽卡递增，同一个种子下的每一次抽卡都使用不同的随机数。
+//
+// 稀有度的权重和保底规则由 Table 描述，保底计数 (距离上一次抽到某个稀有度以来的次数) 由调用方保存。
+package gacha
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type (
+	// Tier 稀有度和它的权重，Table 中的 Tiers 从低到高排列
+	Tier struct {
+		Name   string
+		Weight uint64
+	}
+
+	// PityRule 保底规则: 连续 After-1 次没有抽到 Tier 或更高的稀有度时，第 After 次至少是 Tier
+	PityRule struct {
+		Tier  string
+		After uint32
+	}
+
+	// Table 一个卡池的稀有度权重和保底规则
+	Table struct {
+		Tiers []Tier
+		Pity  []PityRule
+	}
+
+	// Rand 一次抽卡的随机数，TierRoll 用于选择稀有度，PickRoll 用于在稀有度中选择具体的卡
+	Rand struct {
+		TierRoll uint64
+		PickRoll uint64
+	}
+
+	// Result 一次抽卡的稀有度，Pity 表示由保底决定
+	Result struct {
+		Tier string
+		Pity bool
+	}
+)
+
+var ErrInvalidTable = errors.New("invalid gacha table")
+
+// NewSeed 生成一个新的服务端种子和它的哈希
+func NewSeed() (seed, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("generate seed: %w", err)
+	}
+	seed = hex.EncodeToString(buf)
+	return seed, HashSeed(seed), nil
+}
+
+// HashSeed 种子的承诺，公开的是这个值
+func HashSeed(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewRand 由种子和 nonce 确定地生成一次抽卡的随机数
+func NewRand(serverSeed, clientSeed string, nonce uint64) Rand {
+	mac := hmac.New(sha256.New, []byte(serverSeed))
+	mac.Write([]byte(clientSeed + ":" + strconv.FormatUint(nonce, 10)))
+	sum := mac.Sum(nil)
+	return Rand{
+		TierRoll: binary.BigEndian.Uint64(sum[0:8]),
+		PickRoll: binary.BigEndian.Uint64(sum[8:16]),
+	}
+}
+
+// Validate 检查稀有度不重复、总权重大于 0，保底规则引用的稀有度存在并且 After 大于 0
+func (t *Table) Validate() error {
+	var total uint64
+	for i, tier := range t.Tiers {
+		if tier.Name == "" {
+			return fmt.Errorf("%w: tier %d has no name", ErrInvalidTable, i)
+		}
+		if t.rank(tier.Name) != i {
+			return fmt.Errorf("%w: duplicated tier %q", ErrInvalidTable, tier.Name)
+		}
+		total += tier.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("%w: total weight is 0", ErrInvalidTable)
+	}
+	for _, rule := range t.Pity {
+		if t.rank(rule.Tier) < 0 {
+			return fmt.Errorf("%w: pity of unknown tier %q", ErrInvalidTable, rule.Tier)
+		}
+		if rule.After == 0 {
+			return fmt.Errorf("%w: pity of tier %q should be after at least 1 draw", ErrInvalidTable, rule.Tier)
+		}
+	}
+	return nil
+}
+
+// rank 稀有度在 Tiers 中的位置，不存在时返回 -1
+func (t *Table) rank(tier string) int {
+	for i := range t.Tiers {
+		if t.Tiers[i].Name == tier {
+			return i
+		}
+	}
+	return -1
+}
+
+// Draw 按权重和保底规则决定一次抽卡的稀有度，并更新 counters (保底规则的稀有度 -> 距离上一次抽到它或更高稀有度的次数)。
+// counters 为 nil 时不使用保底
+func (t *Table) Draw(r Rand, counters map[string]uint32) Result {
+	var total uint64
+	for _, tier := range t.Tiers {
+		total += tier.Weight
+	}
+	picked, roll := 0, r.TierRoll%total
+	for i, tier := range t.Tiers {
+		if roll < tier.Weight {
+			picked = i
+			break
+		}
+		roll -= tier.Weight
+	}
+
+	pity := false
+	if counters != nil {
+		for _, rule := range t.Pity {
+			if rank := t.rank(rule.Tier); rank > picked && counters[rule.Tier]+1 >= rule.After {
+				picked, pity = rank, true
+			}
+		}
+		for _, rule := range t.Pity {
+			if picked >= t.rank(rule.Tier) {
+				counters[rule.Tier] = 0
+			} else {
+				counters[rule.Tier]++
+			}
+		}
+	}
+	return Result{Tier: t.Tiers[picked].Name, Pity: pity}
+}
+
+// Pick 在 n 个候选中选择一个
+func (r Rand) Pick(n int) int {
+	if n <= 0 {
+		return -1
+	}
+	return int(r.PickRoll % uint64(n))
+}
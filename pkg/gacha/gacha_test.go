@@ -0,0 +1,91 @@
+package gacha_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/pkg/gacha"
+)
+
+func testTable() *gacha.Table {
+	return &gacha.Table{
+		Tiers: []gacha.Tier{{Name: "common", Weight: 90}, {Name: "rare", Weight: 9}, {Name: "epic", Weight: 1}},
+		Pity:  []gacha.PityRule{{Tier: "rare", After: 5}, {Tier: "epic", After: 20}},
+	}
+}
+
+func TestSeed_Commitment(t *testing.T) {
+	seed, hash, err := gacha.NewSeed()
+	require.NoError(t, err)
+	assert.Len(t, seed, 64)
+	assert.Equal(t, hash, gacha.HashSeed(seed))
+	assert.NotEqual(t, seed, hash)
+
+	other, _, err := gacha.NewSeed()
+	require.NoError(t, err)
+	assert.NotEqual(t, seed, other)
+}
+
+func TestNewRand_Deterministic(t *testing.T) {
+	r := gacha.NewRand("server", "client", 1)
+	assert.Equal(t, r, gacha.NewRand("server", "client", 1))
+	assert.NotEqual(t, r, gacha.NewRand("server", "client", 2))
+	assert.NotEqual(t, r, gacha.NewRand("server", "other", 1))
+	assert.NotEqual(t, r, gacha.NewRand("other", "client", 1))
+}
+
+func TestTable_Validate(t *testing.T) {
+	require.NoError(t, testTable().Validate())
+
+	invalid := []*gacha.Table{
+		{},
+		{Tiers: []gacha.Tier{{Name: "common"}}},
+		{Tiers: []gacha.Tier{{Name: "common", Weight: 1}, {Name: "common", Weight: 1}}},
+		{Tiers: []gacha.Tier{{Name: "common", Weight: 1}}, Pity: []gacha.PityRule{{Tier: "rare", After: 1}}},
+		{Tiers: []gacha.Tier{{Name: "common", Weight: 1}}, Pity: []gacha.PityRule{{Tier: "common", After: 0}}},
+	}
+	for i, table := range invalid {
+		assert.ErrorIs(t, table.Validate(), gacha.ErrInvalidTable, "table %d", i)
+	}
+}
+
+func TestTable_DrawFollowsWeights(t *testing.T) {
+	table := testTable()
+	counts := map[string]int{}
+	for nonce := uint64(0); nonce < 10000; nonce++ {
+		counts[table.Draw(gacha.NewRand("seed", "", nonce), nil).Tier]++
+	}
+	assert.InDelta(t, 9000, counts["common"], 300)
+	assert.InDelta(t, 900, counts["rare"], 150)
+	assert.InDelta(t, 100, counts["epic"], 50)
+}
+
+// 保底: 每 5 次至少一个 rare，每 20 次至少一个 epic，抽到更高的稀有度时低的保底计数也会重置
+func TestTable_DrawPity(t *testing.T) {
+	table := &gacha.Table{
+		Tiers: []gacha.Tier{{Name: "common", Weight: 1}, {Name: "rare", Weight: 0}, {Name: "epic", Weight: 0}},
+		Pity:  []gacha.PityRule{{Tier: "rare", After: 5}, {Tier: "epic", After: 12}},
+	}
+	counters := map[string]uint32{}
+	var tiers []string
+	for nonce := uint64(1); nonce <= 12; nonce++ {
+		result := table.Draw(gacha.NewRand("seed", "", nonce), counters)
+		assert.Equal(t, result.Tier != "common", result.Pity)
+		tiers = append(tiers, result.Tier)
+	}
+	assert.Equal(t, []string{
+		"common", "common", "common", "common", "rare",
+		"common", "common", "common", "common", "rare",
+		"common", "epic",
+	}, tiers)
+	assert.Equal(t, map[string]uint32{"rare": 0, "epic": 0}, counters)
+}
+
+func TestRand_Pick(t *testing.T) {
+	r := gacha.Rand{PickRoll: 7}
+	assert.Equal(t, 1, r.Pick(3))
+	assert.Equal(t, 0, r.Pick(1))
+	assert.Equal(t, -1, r.Pick(0))
+}
@@ -0,0 +1,169 @@
+// Package rank 生成用于排序的分数式 (fractional) 字符串 key。
+//
+// 任意两个 key 之间总能再插入一个新的 key，因此移动一个元素只需要修改它自己的 key，
+// 不需要重新编号其他元素。key 只包含数字和小写字母，按字节序比较即为排列顺序，
+// 可以直接存在数据库中用 ORDER BY 排序 (需要使用二进制或大小写敏感的排序规则)。
+//
+// key 不以最小的字符 '0' 结尾，这保证了在任意 key 之前也总能插入新的 key。
+// 在同一位置反复插入会让 key 变长，超过 MaxLen 时可以用 Spread 重新均匀分布整个列表。
+package rank
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Digits key 使用的字符，按字节序升序排列
+const Digits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// MaxLen 建议的 key 最大长度，超过时应该用 Spread 重新分布
+const MaxLen = 48
+
+const base = len(Digits)
+
+var ErrInvalidKey = errors.New("invalid rank key")
+
+// Validate 校验 key 只包含 Digits 中的字符、不为空并且不以 '0' 结尾
+func Validate(key string) error {
+	if key == "" || key[len(key)-1] == Digits[0] {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	for i := 0; i < len(key); i++ {
+		if strings.IndexByte(Digits, key[i]) < 0 {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// Between 返回严格位于 a 和 b 之间的 key。a 为空表示列表开头，b 为空表示列表末尾，
+// 因此 Between("", "") 返回列表中第一个元素的 key
+func Between(a, b string) (string, error) {
+	if a != "" {
+		if err := Validate(a); err != nil {
+			return "", err
+		}
+	}
+	if b != "" {
+		if err := Validate(b); err != nil {
+			return "", err
+		}
+		if a >= b {
+			return "", fmt.Errorf("%w: %q is not before %q", ErrInvalidKey, a, b)
+		}
+	}
+	if b == "" {
+		return increment(a), nil
+	}
+	return midpoint(a, b), nil
+}
+
+// midpoint a < b，b 为空表示无穷大；a 在比较时视为在末尾补足了 '0'
+func midpoint(a, b string) string {
+	if b != "" {
+		// 跳过公共前缀
+		n := 0
+		for n < len(b) && digitAt(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(a) {
+				rest = a[n:]
+			}
+			return b[:n] + midpoint(rest, b[n:])
+		}
+	}
+
+	digitA := 0
+	if a != "" {
+		digitA = strings.IndexByte(Digits, a[0])
+	}
+	digitB := base
+	if b != "" {
+		digitB = strings.IndexByte(Digits, b[0])
+	}
+	if digitB-digitA > 1 {
+		return string(Digits[(digitA+digitB+1)/2])
+	}
+	// 首位相邻，b 更长时取 b 的首位即可，否则在 a 的首位之后继续找
+	if len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if len(a) > 1 {
+		rest = a[1:]
+	}
+	return string(Digits[digitA]) + midpoint(rest, "")
+}
+
+// increment 返回大于 a 的最短的 key: 把第一个不是最大字符的位加一并截断，
+// 这样在末尾追加时 key 大约每 35 次才增长一个字符，而不是每次对半分
+func increment(a string) string {
+	for i := 0; i < len(a); i++ {
+		if d := strings.IndexByte(Digits, a[i]); d < base-1 {
+			return a[:i] + string(Digits[d+1])
+		}
+	}
+	return a + string(Digits[1])
+}
+
+func digitAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return Digits[0]
+}
+
+// BetweenN 返回 n 个严格位于 a 和 b 之间的升序 key，用于一次移动多个元素
+func BetweenN(a, b string, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	mid, err := Between(a, b)
+	if err != nil {
+		return nil, err
+	}
+	left, err := BetweenN(a, mid, n/2)
+	if err != nil {
+		return nil, err
+	}
+	right, err := BetweenN(mid, b, n-n/2-1)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, n)
+	keys = append(keys, left...)
+	keys = append(keys, mid)
+	return append(keys, right...), nil
+}
+
+// Spread 返回 n 个均匀分布的升序 key，用于初始化或重新分布整个列表
+func Spread(n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	// 选择足够的位数，使相邻 key 之间至少留出一个空位
+	width, capacity := 1, base
+	for capacity <= 2*(n+1) {
+		width++
+		capacity *= base
+	}
+	keys := make([]string, n)
+	step := capacity / (n + 1)
+	for i := range keys {
+		keys[i] = encode((i+1)*step, width)
+	}
+	return keys
+}
+
+// encode 把 v 编码为 width 位的 key 并去掉末尾的 '0'
+func encode(v, width int) string {
+	buf := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		buf[i] = Digits[v%base]
+		v /= base
+	}
+	return strings.TrimRight(string(buf), Digits[:1])
+}
@@ -0,0 +1,99 @@
+package rank
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBetween(t *testing.T) {
+	testCases := []struct {
+		a, b string
+	}{
+		{"", ""},
+		{"", "1"},
+		{"", "01"},
+		{"1", ""},
+		{"z", ""},
+		{"zz", ""},
+		{"a", "b"},
+		{"a", "a1"},
+		{"a", "a01"},
+		{"a1", "a2"},
+		{"az", "b"},
+		{"0z", "1"},
+		{"h", "hh"},
+	}
+	for _, tc := range testCases {
+		key, err := Between(tc.a, tc.b)
+		require.NoError(t, err, "%q %q", tc.a, tc.b)
+		assert.NoError(t, Validate(key))
+		if tc.a != "" {
+			assert.Less(t, tc.a, key, "%q %q", tc.a, tc.b)
+		}
+		if tc.b != "" {
+			assert.Less(t, key, tc.b, "%q %q", tc.a, tc.b)
+		}
+	}
+}
+
+func TestBetween_Invalid(t *testing.T) {
+	for _, tc := range [][2]string{{"b", "a"}, {"a", "a"}, {"a0", ""}, {"", "A"}, {"a-", ""}} {
+		_, err := Between(tc[0], tc[1])
+		assert.ErrorIs(t, err, ErrInvalidKey, "%q %q", tc[0], tc[1])
+	}
+}
+
+// 反复在开头或末尾插入，key 保持有序并且增长缓慢
+func TestBetween_RepeatedInsert(t *testing.T) {
+	hi := ""
+	for i := 0; i < 100; i++ { // 总是插在最前面
+		key, err := Between("", hi)
+		require.NoError(t, err)
+		if hi != "" {
+			require.Less(t, key, hi)
+		}
+		hi = key
+	}
+	assert.Less(t, len(hi), MaxLen)
+
+	lo := ""
+	for i := 0; i < 1000; i++ { // 总是追加在末尾
+		key, err := Between(lo, "")
+		require.NoError(t, err)
+		require.Less(t, lo, key)
+		lo = key
+	}
+	assert.LessOrEqual(t, len(lo), 1000/(base-1)+1)
+}
+
+func TestBetweenN(t *testing.T) {
+	keys, err := BetweenN("a", "b", 50)
+	require.NoError(t, err)
+	require.Len(t, keys, 50)
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Less(t, "a", keys[0])
+	assert.Less(t, keys[49], "b")
+	for i := 1; i < len(keys); i++ {
+		assert.NotEqual(t, keys[i-1], keys[i])
+	}
+}
+
+func TestSpread(t *testing.T) {
+	for _, n := range []int{1, 2, 17, 35, 36, 1000} {
+		keys := Spread(n)
+		require.Len(t, keys, n)
+		assert.True(t, sort.StringsAreSorted(keys), "n=%d", n)
+		for i, key := range keys {
+			require.NoError(t, Validate(key))
+			if i > 0 {
+				// 相邻 key 之间还能插入
+				mid, err := Between(keys[i-1], key)
+				require.NoError(t, err)
+				assert.Less(t, keys[i-1], mid)
+			}
+		}
+	}
+}
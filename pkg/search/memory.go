@@ -0,0 +1,322 @@
+package search
+
+import (
+	"context"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BM25 参数
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// snippetRadius 摘要在首个命中位置前后保留的字符数
+	snippetRadius = 40
+)
+
+type (
+	// MemoryIndex 内存中的倒排索引，进程启动时需要从数据源重建
+	MemoryIndex struct {
+		mu     sync.RWMutex
+		shards map[uint64]*shard
+		owners map[uint64]uint64 // doc id -> owner
+		// tombstones 记录被删除文档的删除时间，防止重建索引时旧数据被写回
+		tombstones map[uint64]time.Time
+	}
+
+	shard struct {
+		docs     map[uint64]*docEntry
+		postings map[string]map[uint64]int // term -> doc id -> term frequency
+		totalLen int
+	}
+
+	docEntry struct {
+		*Document
+		length int
+		terms  map[string]int
+	}
+)
+
+var (
+	_ Index           = (*MemoryIndex)(nil)
+	_ TombstonePruner = (*MemoryIndex)(nil)
+)
+
+// NewMemoryIndex creates an empty MemoryIndex
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{
+		shards:     make(map[uint64]*shard),
+		owners:     make(map[uint64]uint64),
+		tombstones: make(map[uint64]time.Time),
+	}
+}
+
+func (idx *MemoryIndex) Upsert(ctx context.Context, docs ...*Document) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		if deletedAt, ok := idx.tombstones[doc.ID]; ok {
+			if !doc.UpdatedAt.After(deletedAt) {
+				continue
+			}
+			delete(idx.tombstones, doc.ID)
+		}
+		if owner, ok := idx.owners[doc.ID]; ok {
+			s := idx.shards[owner]
+			if exist := s.docs[doc.ID]; exist != nil && exist.UpdatedAt.After(doc.UpdatedAt) {
+				continue
+			}
+			s.remove(doc.ID)
+		}
+		s, ok := idx.shards[doc.Owner]
+		if !ok {
+			s = &shard{docs: make(map[uint64]*docEntry), postings: make(map[string]map[uint64]int)}
+			idx.shards[doc.Owner] = s
+		}
+		s.add(doc)
+		idx.owners[doc.ID] = doc.Owner
+	}
+	return nil
+}
+
+func (idx *MemoryIndex) Delete(ctx context.Context, ids ...uint64) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	now := time.Now()
+	for _, id := range ids {
+		idx.tombstones[id] = now
+		owner, ok := idx.owners[id]
+		if !ok {
+			continue
+		}
+		idx.shards[owner].remove(id)
+		delete(idx.owners, id)
+	}
+	return nil
+}
+
+// PruneTombstones 清理 before 之前的删除标记，返回清理的数量。
+// 在重建完成后以重建的开始时间调用，重建期间的删除标记会被保留
+func (idx *MemoryIndex) PruneTombstones(before time.Time) int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	pruned := 0
+	for id, deletedAt := range idx.tombstones {
+		if deletedAt.Before(before) {
+			delete(idx.tombstones, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+func (idx *MemoryIndex) Search(ctx context.Context, q *Query) (*Result, error) {
+	terms := Terms(q.Text, ModeQuery)
+	result := &Result{Hits: make([]*Hit, 0)}
+	if len(terms) == 0 {
+		return result, nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	s, ok := idx.shards[q.Owner]
+	if !ok {
+		return result, nil
+	}
+
+	// 从最短的倒排链开始求交集
+	lists := make([]map[uint64]int, 0, len(terms))
+	for _, term := range terms {
+		list, ok := s.postings[term]
+		if !ok {
+			return result, nil
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	avgLen := float64(s.totalLen) / float64(len(s.docs))
+	hits := make([]*Hit, 0, len(lists[0]))
+	for id := range lists[0] {
+		entry := s.docs[id]
+		if !matchAll(id, lists[1:]) || !q.accept(entry.Document) {
+			continue
+		}
+		score := 0.0
+		for _, term := range terms {
+			tf := float64(entry.terms[term])
+			df := float64(len(s.postings[term]))
+			idf := math.Log(1 + (float64(len(s.docs))-df+0.5)/(df+0.5))
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(entry.length)/avgLen))
+		}
+		hits = append(hits, &Hit{ID: id, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID > hits[j].ID
+	})
+
+	result.Total = len(hits)
+	from, to := pageRange(len(hits), q.Offset, q.Limit)
+	result.Hits = hits[from:to]
+
+	// 只为当前页生成高亮
+	termSet := make(map[string]struct{}, len(terms))
+	for _, term := range terms {
+		termSet[term] = struct{}{}
+	}
+	for _, hit := range result.Hits {
+		text := s.docs[hit.ID].Text
+		hit.Highlights = highlightSpans(text, termSet)
+		hit.Snippet = snippet(text, hit.Highlights)
+	}
+	return result, nil
+}
+
+func (s *shard) add(doc *Document) {
+	tokens := Tokenize(doc.Text, ModeIndex)
+	entry := &docEntry{Document: doc, length: len(tokens), terms: make(map[string]int)}
+	for _, t := range tokens {
+		entry.terms[t.Term]++
+	}
+	for term, tf := range entry.terms {
+		list, ok := s.postings[term]
+		if !ok {
+			list = make(map[uint64]int)
+			s.postings[term] = list
+		}
+		list[doc.ID] = tf
+	}
+	s.docs[doc.ID] = entry
+	s.totalLen += entry.length
+}
+
+func (s *shard) remove(id uint64) {
+	entry, ok := s.docs[id]
+	if !ok {
+		return
+	}
+	for term := range entry.terms {
+		list := s.postings[term]
+		delete(list, id)
+		if len(list) == 0 {
+			delete(s.postings, term)
+		}
+	}
+	s.totalLen -= entry.length
+	delete(s.docs, id)
+}
+
+func (q *Query) accept(doc *Document) bool {
+	if q.Candidates != nil {
+		if _, ok := q.Candidates[doc.ID]; !ok {
+			return false
+		}
+	}
+	for key, values := range q.Attrs {
+		if len(values) == 0 {
+			continue
+		}
+		v, ok := doc.Attrs[key]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, want := range values {
+			if v == want {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAll(id uint64, lists []map[uint64]int) bool {
+	for _, list := range lists {
+		if _, ok := list[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func pageRange(total, offset, limit int) (from, to int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	to = total
+	if limit > 0 && offset+limit < total {
+		to = offset + limit
+	}
+	return offset, to
+}
+
+// highlightSpans 找出原文中命中查询词的区间，单字和二元组的命中会被合并成连续的区间
+func highlightSpans(text string, terms map[string]struct{}) []Span {
+	spans := make([]Span, 0)
+	for _, t := range Tokenize(text, ModeIndex) {
+		if _, ok := terms[t.Term]; !ok {
+			continue
+		}
+		if n := len(spans); n > 0 && t.Start <= spans[n-1].End {
+			if t.End > spans[n-1].End {
+				spans[n-1].End = t.End
+			}
+			continue
+		}
+		spans = append(spans, Span{Start: t.Start, End: t.End})
+	}
+	return spans
+}
+
+func snippet(text string, spans []Span) string {
+	runes := []rune(text)
+	if len(spans) == 0 {
+		return html.EscapeString(string(runes[:min(len(runes), snippetRadius*2)]))
+	}
+	from := max(0, spans[0].Start-snippetRadius)
+	to := min(len(runes), spans[0].End+snippetRadius)
+
+	sb := strings.Builder{}
+	if from > 0 {
+		sb.WriteString("…")
+	}
+	cursor := from
+	for _, span := range spans {
+		if span.Start >= to {
+			break
+		}
+		end := min(span.End, to)
+		sb.WriteString(html.EscapeString(string(runes[cursor:span.Start])))
+		sb.WriteString("<em>")
+		sb.WriteString(html.EscapeString(string(runes[span.Start:end])))
+		sb.WriteString("</em>")
+		cursor = end
+	}
+	sb.WriteString(html.EscapeString(string(runes[cursor:to])))
+	if to < len(runes) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
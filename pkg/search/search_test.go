@@ -0,0 +1,115 @@
+package search
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func terms(tokens []Token) []string {
+	ret := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		ret = append(ret, t.Term)
+	}
+	return ret
+}
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world", "42"}, terms(Tokenize("Hello, World! 42", ModeQuery)))
+	assert.Equal(t, []string{"记忆", "忆曲", "曲线"}, terms(Tokenize("记忆曲线", ModeQuery)))
+	assert.Equal(t, []string{"记", "记忆", "忆"}, terms(Tokenize("记忆", ModeIndex)))
+	assert.Equal(t, []string{"学", "go", "语言"}, terms(Tokenize("学Go语言", ModeQuery)))
+
+	tokens := Tokenize("复习 SRS", ModeQuery)
+	require.Len(t, tokens, 2)
+	assert.Equal(t, Token{Term: "srs", Start: 3, End: 6}, tokens[1])
+}
+
+func TestMemoryIndex_Search(t *testing.T) {
+	ctx := context.Background()
+	idx := NewMemoryIndex()
+	now := time.Now()
+
+	require.NoError(t, idx.Upsert(ctx,
+		&Document{ID: 1, Owner: 100, Text: "艾宾浩斯遗忘曲线描述了记忆随时间衰减", Attrs: map[string]string{"type": "flash_card"}, UpdatedAt: now},
+		&Document{ID: 2, Owner: 100, Text: "记忆宫殿是一种记忆方法，记忆效果很好", Attrs: map[string]string{"type": "completion"}, UpdatedAt: now},
+		&Document{ID: 3, Owner: 100, Text: "Spaced repetition improves memory", Attrs: map[string]string{"type": "flash_card"}, UpdatedAt: now},
+		&Document{ID: 4, Owner: 200, Text: "记忆", UpdatedAt: now},
+	))
+
+	res, err := idx.Search(ctx, &Query{Owner: 100, Text: "记忆"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Total)
+	require.Len(t, res.Hits, 2)
+	assert.Equal(t, uint64(2), res.Hits[0].ID, "higher term frequency ranks first")
+	assert.Contains(t, res.Hits[0].Snippet, "<em>记忆</em>")
+
+	// 过滤
+	res, err = idx.Search(ctx, &Query{Owner: 100, Text: "记忆", Attrs: map[string][]string{"type": {"flash_card"}}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Total)
+	assert.Equal(t, uint64(1), res.Hits[0].ID)
+
+	res, err = idx.Search(ctx, &Query{Owner: 100, Text: "记忆", Candidates: map[uint64]struct{}{1: {}}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Total)
+
+	// 分页不影响 total
+	res, err = idx.Search(ctx, &Query{Owner: 100, Text: "记忆", Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Total)
+	require.Len(t, res.Hits, 1)
+	assert.Equal(t, uint64(1), res.Hits[0].ID)
+
+	// 高亮区间
+	res, err = idx.Search(ctx, &Query{Owner: 100, Text: "遗忘曲线"})
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Total)
+	assert.Equal(t, []Span{{Start: 4, End: 8}}, res.Hits[0].Highlights)
+
+	res, err = idx.Search(ctx, &Query{Owner: 100, Text: "MEMORY"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Total)
+
+	// 更新与删除
+	require.NoError(t, idx.Upsert(ctx, &Document{ID: 2, Owner: 100, Text: "没有关键词了", UpdatedAt: now.Add(time.Second)}))
+	require.NoError(t, idx.Upsert(ctx, &Document{ID: 2, Owner: 100, Text: "旧版本的记忆", UpdatedAt: now}))
+	res, err = idx.Search(ctx, &Query{Owner: 100, Text: "记忆"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Total, "stale version should be ignored")
+
+	require.NoError(t, idx.Delete(ctx, 1))
+	require.NoError(t, idx.Upsert(ctx, &Document{ID: 1, Owner: 100, Text: "记忆", UpdatedAt: now}))
+	res, err = idx.Search(ctx, &Query{Owner: 100, Text: "记忆"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Total, "deleted doc should not be written back by a stale upsert")
+}
+
+func TestMemoryIndex_PruneTombstones(t *testing.T) {
+	ctx := context.Background()
+	idx := NewMemoryIndex()
+	now := time.Now()
+
+	require.NoError(t, idx.Delete(ctx, 1, 2))
+	time.Sleep(time.Millisecond)
+	rebuildStart := time.Now()
+	time.Sleep(time.Millisecond)
+	require.NoError(t, idx.Delete(ctx, 3))
+
+	// 重建开始前的删除标记被清理，重建期间的删除标记被保留
+	assert.Equal(t, 2, idx.PruneTombstones(rebuildStart))
+	assert.Len(t, idx.tombstones, 1)
+	assert.Zero(t, idx.PruneTombstones(rebuildStart))
+
+	require.NoError(t, idx.Upsert(ctx,
+		&Document{ID: 1, Owner: 100, Text: "记忆", UpdatedAt: now},
+		&Document{ID: 3, Owner: 100, Text: "记忆", UpdatedAt: now},
+	))
+	res, err := idx.Search(ctx, &Query{Owner: 100, Text: "记忆"})
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Total, "tombstones during the rebuild still block stale upserts")
+	assert.Equal(t, uint64(1), res.Hits[0].ID)
+}
@@ -0,0 +1,95 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+type (
+	// Token 分词结果，Start/End 为在原文中的 rune 下标 (左闭右开)
+	Token struct {
+		Term  string
+		Start int
+		End   int
+	}
+
+	// TokenizeMode 分词模式
+	TokenizeMode uint8
+)
+
+const (
+	// ModeIndex 建索引时使用，CJK 文本同时产出单字与二元组，保证单字查询也能命中
+	ModeIndex TokenizeMode = iota
+	// ModeQuery 查询时使用，CJK 文本只在单字时产出单字，否则产出二元组
+	ModeQuery
+)
+
+// IsCJK 判断字符是否为中日韩文字，这些文字之间没有空格分隔，需要按字切分
+func IsCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
+
+// Tokenize 对文本进行分词
+// - 拉丁字母、数字等按单词切分，统一转为小写
+// - CJK 文本按 bigram 切分 (我们的内容以中文为主，bigram 在没有词典的情况下召回和精度都比较均衡)
+// - 其余字符 (标点、空白等) 视为分隔符
+func Tokenize(text string, mode TokenizeMode) []Token {
+	runes := []rune(text)
+	tokens := make([]Token, 0, len(runes)/2+1)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case IsCJK(r):
+			j := i
+			for j < len(runes) && IsCJK(runes[j]) {
+				j++
+			}
+			tokens = appendCJKRun(tokens, runes, i, j, mode)
+			i = j
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && !IsCJK(runes[j]) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || unicode.Is(unicode.Mn, runes[j])) {
+				j++
+			}
+			tokens = append(tokens, Token{Term: strings.ToLower(string(runes[i:j])), Start: i, End: j})
+			i = j
+		default:
+			i++
+		}
+	}
+	return tokens
+}
+
+func appendCJKRun(tokens []Token, runes []rune, from, to int, mode TokenizeMode) []Token {
+	if to-from == 1 {
+		return append(tokens, Token{Term: string(runes[from]), Start: from, End: to})
+	}
+	for k := from; k < to; k++ {
+		if mode == ModeIndex {
+			tokens = append(tokens, Token{Term: string(runes[k]), Start: k, End: k + 1})
+		}
+		if k+1 < to {
+			tokens = append(tokens, Token{Term: string(runes[k : k+2]), Start: k, End: k + 2})
+		}
+	}
+	return tokens
+}
+
+// Terms 返回去重后的词项
+func Terms(text string, mode TokenizeMode) []string {
+	tokens := Tokenize(text, mode)
+	seen := make(map[string]struct{}, len(tokens))
+	terms := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		if _, ok := seen[t.Term]; ok {
+			continue
+		}
+		seen[t.Term] = struct{}{}
+		terms = append(terms, t.Term)
+	}
+	return terms
+}
@@ -0,0 +1,68 @@
+package search
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	// Index defines the interface of a full-text index.
+	// 索引按 Owner 隔离，查询只会命中同一 Owner 的文档，词频统计也只在 Owner 内部进行
+	Index interface {
+		Upsert(ctx context.Context, docs ...*Document) error
+		Delete(ctx context.Context, ids ...uint64) error
+		Search(ctx context.Context, q *Query) (*Result, error)
+	}
+
+	// TombstonePruner 记录删除标记的索引。从数据源重建完成后，重建开始前的删除已经反映在数据源中，对应的删除标记可以清理
+	TombstonePruner interface {
+		PruneTombstones(before time.Time) int
+	}
+
+	// Document 被索引的文档
+	Document struct {
+		ID    uint64
+		Owner uint64
+		Text  string
+		// Attrs 用于过滤的属性，如 type、difficulty
+		Attrs map[string]string
+		// UpdatedAt 用于丢弃过期的写入，旧版本不会覆盖新版本
+		UpdatedAt time.Time
+	}
+
+	// Query 查询条件
+	Query struct {
+		Owner uint64
+		Text  string
+		// Attrs 同一个 key 内为或，不同 key 之间为且
+		Attrs map[string][]string
+		// Candidates 不为 nil 时，只返回在其中的文档 (用于 tag、book 等外部过滤)
+		Candidates map[uint64]struct{}
+
+		Offset int
+		Limit  int
+	}
+
+	// Result 查询结果
+	Result struct {
+		// Total 为满足条件的全部文档数，不受分页影响
+		Total int
+		Hits  []*Hit
+	}
+
+	// Hit 命中的文档
+	Hit struct {
+		ID    uint64
+		Score float64
+		// Highlights 命中片段在原文中的 rune 下标 (左闭右开)，已合并重叠区间
+		Highlights []Span
+		// Snippet 命中位置附近的摘要，已做 html 转义，命中部分用 <em></em> 包裹
+		Snippet string
+	}
+
+	// Span 文本区间
+	Span struct {
+		Start int `json:"start"`
+		End   int `json:"end"`
+	}
+)
@@ -3,36 +3,138 @@ package tags
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/khicago/got/util/procast"
 
-	"github.com/adjust/redismq"
 	"github.com/bagaking/goulp/wlog"
 	"github.com/khicago/irr"
 )
 
+const (
+	// DefaultMaxAttempts 消息最多被处理的次数，超过后进入死信
+	DefaultMaxAttempts = 5
+	// DefaultRetryBaseDelay 第一次重试前的等待时间，之后每次翻倍
+	DefaultRetryBaseDelay = time.Second
+	// DefaultRetryMaxDelay 重试等待时间的上限
+	DefaultRetryMaxDelay = 30 * time.Second
+
+	// fetchBatchSize 每次从队列中获取的消息数
+	fetchBatchSize = 10
+	// idleInterval 队列为空时的轮询间隔
+	idleInterval = time.Second
+)
+
+type (
+	// RetryPolicy 消息处理失败后的重试策略，重试间隔按指数退避
+	RetryPolicy struct {
+		MaxAttempts int
+		BaseDelay   time.Duration
+		MaxDelay    time.Duration
+	}
+
+	// UpdateOptions TagUpdateManager 的可选配置
+	UpdateOptions struct {
+		Retry       RetryPolicy
+		DeadLetters DeadLetterQueue
+	}
+
+	// UpdateOption 修改 UpdateOptions 的函数
+	UpdateOption func(*UpdateOptions)
+
+	// TagUpdateStats TagUpdateManager 的运行状态和计数，计数从进程启动开始累计
+	TagUpdateStats struct {
+		Status       string `json:"status"`
+		Processed    int64  `json:"processed"`     // 处理成功的消息数
+		Failed       int64  `json:"failed"`        // 处理失败的次数，包括之后重试成功的
+		Retried      int64  `json:"retried"`       // 重新入队等待重试的次数
+		DeadLettered int64  `json:"dead_lettered"` // 进入死信的消息数
+		InFlight     int64  `json:"in_flight"`     // 正在处理的消息数
+		Delayed      int64  `json:"delayed"`       // 已取出但还没到重试时间的消息数
+		Lag          int64  `json:"lag"`           // 队列中积压的消息数，即 Undelivered + Pending
+		Undelivered  int64  `json:"undelivered"`   // 队列中还没有投递的消息数
+		Pending      int64  `json:"pending"`       // 队列中已投递但还没有确认的消息数，所有消费者合计
+	}
+
+	updateCounters struct {
+		processed, failed, retried, deadLettered, inFlight atomic.Int64
+	}
+)
+
+// DefaultRetryPolicy 默认的重试策略
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: DefaultMaxAttempts, BaseDelay: DefaultRetryBaseDelay, MaxDelay: DefaultRetryMaxDelay}
+}
+
+// Backoff 第 attempts 次失败后到下一次重试的等待时间
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// WithRetryPolicy 设置重试策略
+func WithRetryPolicy(policy RetryPolicy) UpdateOption {
+	return func(o *UpdateOptions) {
+		o.Retry = policy
+	}
+}
+
+// WithDeadLetters 设置死信存储，默认使用进程内存储
+func WithDeadLetters(deadLetters DeadLetterQueue) UpdateOption {
+	return func(o *UpdateOptions) {
+		o.DeadLetters = deadLetters
+	}
+}
+
 // TagUpdateManager manages the state and timing of tag updates.
 type TagUpdateManager[EntityType any] struct {
 	mu      sync.Mutex
 	running bool
 	status  string
+	done    chan struct{}
 
-	producer Producer
-	consumer Consumer[*redismq.Package]
+	producer    Producer
+	consumer    Consumer
+	retry       RetryPolicy
+	deadLetters DeadLetterQueue
 
 	runningCtx context.Context
 	cancel     context.CancelFunc
 
+	// delayed 已取出但还没到重试时间的消息，保持未确认状态直到处理或停止
+	delayedMu sync.Mutex
+	delayed   []delayedMessage
+
+	counters updateCounters
+
 	fnHandleTagUpdate func(ctx context.Context, message TagUpdateMessage[EntityType]) error
 }
 
+type delayedMessage struct {
+	msg     *Message
+	retryAt time.Time
+}
+
 // NewTagUpdateManager creates a new TagUpdateManager.
 func NewTagUpdateManager[EntityType any](
-	producer Producer, consumer Consumer[*redismq.Package],
+	producer Producer, consumer Consumer,
 	fnHandleTagUpdate func(ctx context.Context, message TagUpdateMessage[EntityType]) error,
+	opts ...UpdateOption,
 ) *TagUpdateManager[EntityType] {
 	if producer == nil {
 		panic("producer cannot be nil")
@@ -44,9 +146,22 @@ func NewTagUpdateManager[EntityType any](
 		panic("fnHandleTagUpdate cannot be nil")
 	}
 
+	options := &UpdateOptions{Retry: DefaultRetryPolicy()}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Retry.MaxAttempts < 1 {
+		options.Retry.MaxAttempts = 1
+	}
+	if options.DeadLetters == nil {
+		options.DeadLetters = NewMemoryDeadLetters(1000)
+	}
+
 	return &TagUpdateManager[EntityType]{
 		producer:          producer,
 		consumer:          consumer,
+		retry:             options.Retry,
+		deadLetters:       options.DeadLetters,
 		fnHandleTagUpdate: fnHandleTagUpdate,
 	}
 }
@@ -62,29 +177,42 @@ func (m *TagUpdateManager[EntityType]) Start(ctx context.Context) *TagUpdateMana
 	m.running = true
 	m.runningCtx, m.cancel = context.WithCancel(ctx)
 	m.status = "running"
+	m.done = make(chan struct{})
 
-	go m.run(m.runningCtx)
+	go m.run(m.runningCtx, m.done)
 	log.Infof("Manager started")
 	return m
 }
 
+// Stop 停止获取新消息，并等待正在处理的消息处理完成，ctx 结束时不再等待
+// 已取出但还没到重试时间的消息会被放回队列
 func (m *TagUpdateManager[EntityType]) Stop(ctx context.Context) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	log := wlog.ByCtx(ctx, "TagUpdateManager")
 	if !m.running {
+		m.mu.Unlock()
 		log.Warnf("Manager is not running, do nothing")
 		return
 	}
+	m.cancel()
+	m.running = false
+	m.status = "stopping"
+	m.runningCtx = nil
+	done := m.done
+	m.mu.Unlock()
+
+	select {
+	case <-done:
+		log.Infof("Manager stopped")
+	case <-ctx.Done():
+		log.Warnf("Manager stopped before draining, err= %v", ctx.Err())
+	}
 
-	if m.runningCtx != nil {
-		m.cancel()
-		m.running = false
+	m.mu.Lock()
+	if m.done == done {
 		m.status = "stopped"
-
-		log.Infof("Manager stopped")
-		m.runningCtx = nil
 	}
+	m.mu.Unlock()
 }
 
 func (m *TagUpdateManager[EntityType]) IsRunning() bool {
@@ -99,6 +227,29 @@ func (m *TagUpdateManager[EntityType]) GetStatus() string {
 	return m.status
 }
 
+// Stats 获取运行状态和计数，以及队列的积压
+func (m *TagUpdateManager[EntityType]) Stats(ctx context.Context) (TagUpdateStats, error) {
+	backlog, err := m.consumer.Backlog(ctx)
+	if err != nil {
+		return TagUpdateStats{}, irr.Wrap(err, "failed to get backlog of tag update queue")
+	}
+	m.delayedMu.Lock()
+	delayed := int64(len(m.delayed))
+	m.delayedMu.Unlock()
+	return TagUpdateStats{
+		Status:       m.GetStatus(),
+		Processed:    m.counters.processed.Load(),
+		Failed:       m.counters.failed.Load(),
+		Retried:      m.counters.retried.Load(),
+		DeadLettered: m.counters.deadLettered.Load(),
+		InFlight:     m.counters.inFlight.Load(),
+		Delayed:      delayed,
+		Lag:          backlog.Undelivered + backlog.Pending,
+		Undelivered:  backlog.Undelivered,
+		Pending:      backlog.Pending,
+	}, nil
+}
+
 func (m *TagUpdateManager[EntityType]) Put(ctx context.Context, message TagUpdateMessage[EntityType]) error {
 	log := wlog.ByCtx(ctx, "TagUpdateManager.Put")
 	data, err := json.Marshal(message)
@@ -115,154 +266,327 @@ func (m *TagUpdateManager[EntityType]) Put(ctx context.Context, message TagUpdat
 }
 
 // run starts the tag update worker to process messages from the queue.
-func (m *TagUpdateManager[EntityType]) run(ctx context.Context) {
+func (m *TagUpdateManager[EntityType]) run(ctx context.Context, done chan struct{}) {
 	log, ctx := wlog.ByCtxAndCache(ctx, "TagUpdateWorker", uuid.NewString())
+	// 处理消息使用不会被取消的 ctx，Stop 时正在处理的消息可以正常完成
+	handleCtx := context.WithoutCancel(ctx)
+	defer func() {
+		m.requeueDelayed(handleCtx)
+		m.mu.Lock()
+		if m.done == done && m.running { // 外部 ctx 结束导致的退出
+			m.running = false
+			m.status = "stopped"
+		}
+		m.mu.Unlock()
+		close(done)
+	}()
 	defer procast.Recover(func(err error) {
 		log.Errorf("recovered from panic: %v", err)
 	})
 
 	var (
-		packages []*redismq.Package
+		messages []*Message
 		err      error
 		retries  int
 
 		unackedRetryInterval = time.Second
 	)
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infof("Shutting down tag update worker")
-			m.Stop(ctx)
-			return
-		default:
-			// 处理所有未确认的包
-			hasUnacked := true
-			for hasUnacked {
-				var err error
-				hasUnacked, err = m.handleUnackedPackages(ctx)
-				if err != nil {
-					log.Errorf("处理未确认的包时出错: %v", err)
-					time.Sleep(unackedRetryInterval)
-				}
-			}
+	for ctx.Err() == nil {
+		// 处理到了重试时间的消息，并刷新其余暂存消息的确认超时，避免被当作未确认的消息重新取回
+		m.handleDueMessages(handleCtx)
+		m.touchDelayed(handleCtx)
 
-			// Fetch a batch of messages from the queue
-			packages, err = m.consumer.MGet(ctx, 10) // 获取最多10个消息
+		// 处理所有未确认的消息
+		hasUnacked := true
+		for hasUnacked && ctx.Err() == nil {
+			var err error
+			hasUnacked, err = m.handleUnackedMessages(handleCtx)
 			if err != nil {
-				retries++
-				if retries > MaxRetryAttempts {
-					log.Errorf("Failed to get messages from queue，已达到最大重试次数: %v", err)
-					time.Sleep(time.Second * 5)
-					retries = 0
-				} else {
-					log.Warnf("Failed to get messages from queue，正在重试 (%d/%d): %v", retries, MaxRetryAttempts, err)
-					time.Sleep(time.Second)
-				}
-				continue
+				log.Errorf("处理未确认的消息时出错: %v", err)
+				sleepCtx(ctx, unackedRetryInterval)
 			}
-			retries = 0
+		}
+		if ctx.Err() != nil {
+			break
+		}
 
-			// 如果没有获取到消息，等待一段时间后继续
-			if len(packages) == 0 {
-				time.Sleep(time.Second)
-				continue
+		// Fetch a batch of messages from the queue
+		messages, err = m.consumer.MGet(ctx, fetchBatchSize)
+		if err != nil {
+			retries++
+			if retries > MaxRetryAttempts {
+				log.Errorf("Failed to get messages from queue，已达到最大重试次数: %v", err)
+				sleepCtx(ctx, time.Second*5)
+				retries = 0
+			} else {
+				log.Warnf("Failed to get messages from queue，正在重试 (%d/%d): %v", retries, MaxRetryAttempts, err)
+				sleepCtx(ctx, time.Second)
 			}
+			continue
+		}
+		retries = 0
+
+		// 如果没有获取到消息，等待一段时间或者到下一条消息的重试时间后继续
+		if len(messages) == 0 {
+			sleepCtx(ctx, m.nextDelay(idleInterval))
+			continue
+		}
 
-			// 处理获取到的所有消息
-			for _, pkg := range packages {
-				if err = m.HandlePackage(ctx, m.consumer, pkg); err != nil {
-					log.Errorf("Handle message failed: %v", err)
-				}
+		// 处理获取到的所有消息
+		for _, msg := range messages {
+			if err = m.HandleMessage(handleCtx, m.consumer, msg); err != nil {
+				log.Errorf("Handle message failed: %v", err)
 			}
 		}
 	}
+	log.Infof("Shutting down tag update worker")
 }
 
-func (m *TagUpdateManager[EntityType]) handleUnackedPackages(ctx context.Context) (bool, error) {
-	log := wlog.ByCtx(ctx, "handleUnackedPackages")
+func (m *TagUpdateManager[EntityType]) handleUnackedMessages(ctx context.Context) (bool, error) {
+	log := wlog.ByCtx(ctx, "handleUnackedMessages")
 
-	// 获取未确认的包
-	unackedPackage, err := m.consumer.GetUnacked(ctx)
+	// 获取未确认的消息
+	unacked, err := m.consumer.GetUnacked(ctx)
 	if err != nil {
-		// 如果是因为没有未确认的包而返回错误，我们不认为这是一个真正的错误
-		if err.Error() == "no unacked Packages found" {
-			return false, nil
-		}
-		return false, irr.Wrap(err, "获取未确认的包失败").LogError(log)
+		return false, irr.Wrap(err, "获取未确认的消息失败").LogError(log)
 	}
 
-	// 如果没有未确认的包，直接返回
-	if unackedPackage == nil {
+	// 如果没有未确认的消息，直接返回
+	if unacked == nil {
 		return false, nil
 	}
+	// 暂存中的消息由到期后的重试处理，不重复处理
+	if m.isDelayed(unacked.ID) {
+		return true, nil
+	}
 
-	// 处理未确认的包
-	if err := m.HandlePackage(ctx, m.consumer, unackedPackage); err != nil {
-		log.Errorf("处理未确认的包失败: %v", err)
-		// 考虑是否需要重新入队或标记为失败
-		if m.shouldRetry(err) {
-			if err := m.consumer.Requeue(ctx, unackedPackage); err != nil {
-				log.Errorf("重新入队未确认的包失败: %v", err)
-			}
-		} else {
-			if err := m.consumer.Fail(ctx, unackedPackage); err != nil {
-				log.Errorf("标记未确认的包为失败状态时出错: %v", err)
-			}
-		}
+	// 处理未确认的消息，HandleMessage 内部会根据结果确认、重试或转入死信
+	if err = m.HandleMessage(ctx, m.consumer, unacked); err != nil {
+		log.Errorf("处理未确认的消息失败: %v", err)
 		return true, err
 	}
 
 	return true, nil
 }
 
-func (m *TagUpdateManager[EntityType]) HandlePackage(ctx context.Context, consumer Consumer[*redismq.Package], pkg *redismq.Package) error {
-	log := wlog.ByCtx(ctx, "HandlePackage")
+// HandleMessage 处理一条消息:
+// 成功时确认消息；失败时按 RetryPolicy 重新入队并在 attempts 中记录失败次数，次数耗尽或消息无法解析时转入死信;
+// 还没到重试时间的消息会暂存在内存中，到时间后再处理
+func (m *TagUpdateManager[EntityType]) HandleMessage(ctx context.Context, consumer Consumer, msg *Message) error {
+	log := wlog.ByCtx(ctx, "HandleMessage")
 
 	// 添加空值检查
 	if consumer == nil {
 		return irr.Error("consumer is nil").LogError(log)
 	}
-	if pkg == nil {
-		return irr.Error("package is nil").LogError(log)
+	if msg == nil {
+		return irr.Error("message is nil").LogError(log)
 	}
 
 	var message TagUpdateMessage[EntityType]
-	if err := json.Unmarshal([]byte(pkg.Payload), &message); err != nil {
-		if err = consumer.Fail(ctx, pkg); err != nil {
-			return irr.Wrap(err, "failed to acknowledge message failed").LogError(log)
+	if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+		m.counters.failed.Add(1)
+		if errDead := m.deadLetter(ctx, consumer, msg, 0, err); errDead != nil {
+			return errDead
 		}
 		return irr.Wrap(err, "failed to unmarshal message")
 	}
 
+	if message.RetryAt > 0 {
+		if retryAt := time.UnixMilli(message.RetryAt); time.Now().Before(retryAt) {
+			m.delay(msg, retryAt)
+			return nil
+		}
+	}
+
 	// Process the message
-	if err := m.fnHandleTagUpdate(ctx, message); err != nil {
-		log.Errorf("Failed to handle message: %v", err)
-		// 根据错误类型决定是否重试或标记为失败
-		if m.shouldRetry(err) {
-			log.Warnf("Requeuing message due to error: %v", err)
-			if err = consumer.Requeue(ctx, pkg); err != nil {
-				return irr.Wrap(err, "failed to requeue message").LogError(log)
-			}
-		} else {
-			if err = consumer.Fail(ctx, pkg); err != nil {
-				return irr.Wrap(err, "failed to acknowledge message failed").LogError(log)
-			}
-			return irr.Wrap(err, "failed to handle message")
+	m.counters.inFlight.Add(1)
+	err := m.fnHandleTagUpdate(ctx, message)
+	m.counters.inFlight.Add(-1)
+
+	if err == nil {
+		m.counters.processed.Add(1)
+		// Acknowledge the message
+		if err = consumer.Ack(ctx, msg); err != nil {
+			return irr.Wrap(err, "failed to acknowledge message").LogError(log)
 		}
+		return nil
+	}
+
+	m.counters.failed.Add(1)
+	message.Attempts++
+	log.Errorf("Failed to handle message (attempt %d/%d): %v", message.Attempts, m.retry.MaxAttempts, err)
+	// 根据错误类型和已失败的次数决定是否重试或转入死信
+	if !m.shouldRetry(err) || message.Attempts >= m.retry.MaxAttempts {
+		if errDead := m.deadLetter(ctx, consumer, msg, message.Attempts, err); errDead != nil {
+			return errDead
+		}
+		return irr.Wrap(err, "failed to handle message, moved to dead letters")
+	}
+
+	backoff := m.retry.Backoff(message.Attempts)
+	message.RetryAt = time.Now().Add(backoff).UnixMilli()
+	log.Warnf("Retrying message in %v", backoff)
+	data, errMarshal := json.Marshal(message)
+	if errMarshal != nil {
+		return irr.Wrap(errMarshal, "failed to marshal retry message").LogError(log)
+	}
+	// 先入队新消息再确认旧消息，入队失败时旧消息会在确认超时后被重新取回
+	if err = m.producer.Put(ctx, string(data)); err != nil {
+		return irr.Wrap(err, "failed to requeue message").LogError(log)
+	}
+	m.counters.retried.Add(1)
+	if err = consumer.Ack(ctx, msg); err != nil {
+		return irr.Wrap(err, "failed to acknowledge retried message").LogError(log)
 	}
+	return nil
+}
 
-	// Acknowledge the message
-	if err := consumer.Ack(ctx, pkg); err != nil {
-		return irr.Wrap(err, "failed to acknowledge message").LogError(log)
+// deadLetter 把消息转入死信并确认
+func (m *TagUpdateManager[EntityType]) deadLetter(ctx context.Context, consumer Consumer, msg *Message, attempts int, cause error) error {
+	log := wlog.ByCtx(ctx, "deadLetter")
+	letter := &DeadLetter{
+		ID:       uuid.NewString(),
+		Payload:  msg.Payload,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	}
+	if err := m.deadLetters.Push(ctx, letter); err != nil {
+		return irr.Wrap(err, "failed to push dead letter").LogError(log)
 	}
+	m.counters.deadLettered.Add(1)
+	if err := consumer.Ack(ctx, msg); err != nil {
+		return irr.Wrap(err, "failed to acknowledge dead letter").LogError(log)
+	}
+	log.Warnf("message %s moved to dead letters as %s", msg.ID, letter.ID)
 	return nil
 }
 
+// ListDeadLetters 按失败时间分页列出死信
+func (m *TagUpdateManager[EntityType]) ListDeadLetters(ctx context.Context, offset, limit int) ([]*DeadLetter, int64, error) {
+	return m.deadLetters.List(ctx, offset, limit)
+}
+
+// ReplayDeadLetter 清零失败次数后重新入队死信，并从死信中移除
+func (m *TagUpdateManager[EntityType]) ReplayDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	letter, err := m.deadLetters.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var message TagUpdateMessage[EntityType]
+	if err = json.Unmarshal([]byte(letter.Payload), &message); err != nil {
+		return nil, irr.Wrap(ErrInvalidDeadLetter, "dead letter %s cannot be replayed, err= %v", id, err)
+	}
+	message.Attempts, message.RetryAt = 0, 0
+	if err = m.Put(ctx, message); err != nil {
+		return nil, err
+	}
+	if err = m.deadLetters.Remove(ctx, id); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// delay 暂存消息直到 retryAt，同一条消息只暂存一次
+func (m *TagUpdateManager[EntityType]) delay(msg *Message, retryAt time.Time) {
+	m.delayedMu.Lock()
+	defer m.delayedMu.Unlock()
+	m.delayed = slices.DeleteFunc(m.delayed, func(d delayedMessage) bool {
+		return d.msg.ID == msg.ID
+	})
+	m.delayed = append(m.delayed, delayedMessage{msg: msg, retryAt: retryAt})
+	sort.SliceStable(m.delayed, func(i, j int) bool {
+		return m.delayed[i].retryAt.Before(m.delayed[j].retryAt)
+	})
+}
+
+func (m *TagUpdateManager[EntityType]) isDelayed(id string) bool {
+	m.delayedMu.Lock()
+	defer m.delayedMu.Unlock()
+	return slices.ContainsFunc(m.delayed, func(d delayedMessage) bool {
+		return d.msg.ID == id
+	})
+}
+
+// touchDelayed 刷新所有暂存消息的确认超时
+func (m *TagUpdateManager[EntityType]) touchDelayed(ctx context.Context) {
+	m.delayedMu.Lock()
+	messages := make([]*Message, 0, len(m.delayed))
+	for _, d := range m.delayed {
+		messages = append(messages, d.msg)
+	}
+	m.delayedMu.Unlock()
+	if err := m.consumer.Touch(ctx, messages...); err != nil {
+		wlog.ByCtx(ctx, "touchDelayed").Errorf("failed to touch delayed messages: %v", err)
+	}
+}
+
+// takeDueMessages 取出所有到了重试时间的消息
+func (m *TagUpdateManager[EntityType]) takeDueMessages() []*Message {
+	m.delayedMu.Lock()
+	defer m.delayedMu.Unlock()
+	now := time.Now()
+	n := sort.Search(len(m.delayed), func(i int) bool {
+		return m.delayed[i].retryAt.After(now)
+	})
+	due := make([]*Message, 0, n)
+	for _, d := range m.delayed[:n] {
+		due = append(due, d.msg)
+	}
+	m.delayed = m.delayed[n:]
+	return due
+}
+
+func (m *TagUpdateManager[EntityType]) handleDueMessages(ctx context.Context) {
+	log := wlog.ByCtx(ctx, "handleDueMessages")
+	for _, msg := range m.takeDueMessages() {
+		if err := m.HandleMessage(ctx, m.consumer, msg); err != nil {
+			log.Errorf("Handle delayed message failed: %v", err)
+		}
+	}
+}
+
+// nextDelay 到下一条暂存消息重试时间的等待时长，不超过 limit
+func (m *TagUpdateManager[EntityType]) nextDelay(limit time.Duration) time.Duration {
+	m.delayedMu.Lock()
+	defer m.delayedMu.Unlock()
+	if len(m.delayed) == 0 {
+		return limit
+	}
+	if d := time.Until(m.delayed[0].retryAt); d < limit {
+		return max(d, 0)
+	}
+	return limit
+}
+
+// requeueDelayed 停止时把暂存的消息放回队列
+func (m *TagUpdateManager[EntityType]) requeueDelayed(ctx context.Context) {
+	log := wlog.ByCtx(ctx, "requeueDelayed")
+	m.delayedMu.Lock()
+	delayed := m.delayed
+	m.delayed = nil
+	m.delayedMu.Unlock()
+	for _, d := range delayed {
+		if err := m.consumer.Requeue(ctx, d.msg); err != nil {
+			log.Errorf("failed to requeue delayed message %s: %v", d.msg.ID, err)
+		}
+	}
+}
+
 // shouldRetry 判断是否应该重试处理消息
 func (m *TagUpdateManager[EntityType]) shouldRetry(err error) bool {
-	// 根据错误类型或内容决定是���重试
-	// 这里可以根据具体需求进行实现
-	// 例如：如果错误是临时性的，可以返回 true；否则返回 false
-	return true // 示例：默认所有错误都重试
+	// 调用方主动取消或者超时的不再重试，其他错误都视为临时性的
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// sleepCtx 等待 d 或者 ctx 结束
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
 }
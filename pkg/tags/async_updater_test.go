@@ -0,0 +1,299 @@
+package tags_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/khicago/irr"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/pkg/tags"
+)
+
+var fastRetry = tags.RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond}
+
+func stats(t *testing.T, manager *tags.TagUpdateManager[EntityType]) tags.TagUpdateStats {
+	t.Helper()
+	stats, err := manager.Stats(context.TODO())
+	require.NoError(t, err)
+	return stats
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := tags.RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+	assert.Equal(t, time.Second, policy.Backoff(0))
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 16*time.Second, policy.Backoff(5))
+	assert.Equal(t, 30*time.Second, policy.Backoff(6))
+	assert.Equal(t, 30*time.Second, policy.Backoff(100))
+}
+
+// 处理失败的消息带着失败次数重新入队，成功后不再重试
+func TestTagUpdateManager_RetryWithBackoff(t *testing.T) {
+	ctx := context.TODO()
+	mq := newTestQueue(t)
+
+	var mu sync.Mutex
+	var attempts []int
+	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, message.Attempts)
+		if len(attempts) < 3 {
+			return irr.Error("temporary failure")
+		}
+		return nil
+	}, tags.WithRetryPolicy(fastRetry)).Start(ctx)
+	defer manager.Stop(ctx)
+
+	require.NoError(t, manager.Put(ctx, tags.TagUpdateMessage[EntityType]{Action: tags.EventInvalidUser, UserID: 12345}))
+	assert.Eventually(t, func() bool {
+		return stats(t, manager).Processed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, []int{0, 1, 2}, attempts)
+	mu.Unlock()
+	stats := stats(t, manager)
+	assert.EqualValues(t, 2, stats.Failed)
+	assert.EqualValues(t, 2, stats.Retried)
+	assert.Zero(t, stats.DeadLettered)
+	assert.Zero(t, stats.InFlight)
+
+	letters, total, err := manager.ListDeadLetters(ctx, 0, 10)
+	assert.NoError(t, err)
+	assert.Zero(t, total)
+	assert.Empty(t, letters)
+}
+
+// 重试次数耗尽后进入死信，重放后重新计算失败次数
+func TestTagUpdateManager_DeadLetterAndReplay(t *testing.T) {
+	ctx := context.TODO()
+	mq := newTestQueue(t)
+
+	var healthy atomic.Bool
+	var handled atomic.Int64
+	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
+		if !healthy.Load() {
+			return irr.Error("permanent failure")
+		}
+		handled.Add(1)
+		assert.Zero(t, message.Attempts)
+		return nil
+	}, tags.WithRetryPolicy(fastRetry)).Start(ctx)
+	defer manager.Stop(ctx)
+
+	require.NoError(t, manager.Put(ctx, tags.TagUpdateMessage[EntityType]{Action: tags.EventInvalidTag, Tag: "tag1"}))
+	assert.Eventually(t, func() bool {
+		return stats(t, manager).DeadLettered == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 3, stats(t, manager).Failed)
+
+	letters, total, err := manager.ListDeadLetters(ctx, 0, 10)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, total)
+	require.Len(t, letters, 1)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Contains(t, letters[0].Error, "permanent failure")
+
+	healthy.Store(true)
+	replayed, err := manager.ReplayDeadLetter(ctx, letters[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, letters[0].ID, replayed.ID)
+	assert.Eventually(t, func() bool {
+		return handled.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, total, err = manager.ListDeadLetters(ctx, 0, 10)
+	assert.NoError(t, err)
+	assert.Zero(t, total)
+	_, err = manager.ReplayDeadLetter(ctx, letters[0].ID)
+	assert.ErrorIs(t, err, tags.ErrDeadLetterNotFound)
+}
+
+// 无法解析的消息直接进入死信，并且不能重放
+func TestTagUpdateManager_InvalidPayload(t *testing.T) {
+	ctx := context.TODO()
+	mq := newTestQueue(t)
+	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
+		return nil
+	})
+
+	require.NoError(t, mq.Put(ctx, "not json"))
+	msg, err := mq.Get(ctx)
+	require.NoError(t, err)
+	assert.Error(t, manager.HandleMessage(ctx, mq, msg))
+	assert.Zero(t, mq.Len())
+
+	letters, _, err := manager.ListDeadLetters(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, "not json", letters[0].Payload)
+
+	_, err = manager.ReplayDeadLetter(ctx, letters[0].ID)
+	assert.ErrorIs(t, err, tags.ErrInvalidDeadLetter)
+}
+
+// 等待重试的时间超过确认超时，暂存的消息也不会被当作未确认的消息重复处理
+func TestTagUpdateManager_DelayedRedelivery(t *testing.T) {
+	backends := map[string]func(t *testing.T) queueUnderTest{
+		"chan": func(t *testing.T) queueUnderTest { return tags.NewChanQueue(16, 50*time.Millisecond) },
+		"redis_stream": func(t *testing.T) queueUnderTest {
+			redisServer.FlushAll()
+			q := newTestStreamQueue(t, "worker")
+			q.MinIdle = 50 * time.Millisecond
+			return q
+		},
+	}
+	// 重试间隔长于空闲轮询间隔，等待期间 worker 会检查未确认的消息
+	slowRetry := tags.RetryPolicy{MaxAttempts: 3, BaseDelay: 1500 * time.Millisecond, MaxDelay: 1500 * time.Millisecond}
+
+	for name, newQueue := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			mq := newQueue(t)
+
+			var mu sync.Mutex
+			var attempts []int
+			manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts = append(attempts, message.Attempts)
+				if message.Attempts == 0 {
+					return irr.Error("temporary failure")
+				}
+				return nil
+			}, tags.WithRetryPolicy(slowRetry)).Start(ctx)
+			defer manager.Stop(ctx)
+
+			require.NoError(t, manager.Put(ctx, tags.TagUpdateMessage[EntityType]{Action: tags.EventInvalidUser, UserID: 12345}))
+			assert.Eventually(t, func() bool {
+				return stats(t, manager).Delayed == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			delayed := stats(t, manager)
+			assert.EqualValues(t, 1, delayed.Pending)
+			assert.EqualValues(t, 1, delayed.Lag)
+
+			assert.Eventually(t, func() bool {
+				return stats(t, manager).Processed == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			// 留出时间让重复投递 (如果有) 发生
+			time.Sleep(200 * time.Millisecond)
+
+			mu.Lock()
+			assert.Equal(t, []int{0, 1}, attempts)
+			mu.Unlock()
+			done := stats(t, manager)
+			assert.EqualValues(t, 1, done.Processed)
+			assert.EqualValues(t, 1, done.Failed)
+			assert.Zero(t, done.Delayed)
+			assert.Zero(t, done.Lag)
+		})
+	}
+}
+
+// Stop 等待正在处理的消息完成
+func TestTagUpdateManager_GracefulDrain(t *testing.T) {
+	ctx := context.TODO()
+	mq := newTestQueue(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
+		close(started)
+		<-release
+		return ctx.Err()
+	}).Start(ctx)
+
+	require.NoError(t, manager.Put(ctx, tags.TagUpdateMessage[EntityType]{Action: tags.EventInvalidUser, UserID: 12345}))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not handled")
+	}
+	assert.EqualValues(t, 1, stats(t, manager).InFlight)
+
+	stopped := make(chan struct{})
+	go func() {
+		manager.Stop(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before in-flight message finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, "stopping", manager.GetStatus())
+
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop does not return after draining")
+	}
+	stats := stats(t, manager)
+	assert.Equal(t, "stopped", stats.Status)
+	assert.EqualValues(t, 1, stats.Processed)
+	assert.Zero(t, stats.InFlight)
+}
+
+// Stop 的 ctx 结束时不再等待
+func TestTagUpdateManager_StopTimeout(t *testing.T) {
+	mq := newTestQueue(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
+		close(started)
+		<-release
+		return nil
+	}).Start(context.TODO())
+
+	require.NoError(t, manager.Put(context.TODO(), tags.TagUpdateMessage[EntityType]{Action: tags.EventInvalidUser, UserID: 12345}))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	manager.Stop(ctx)
+	assert.Less(t, time.Since(begin), time.Second)
+	assert.False(t, manager.IsRunning())
+}
+
+func TestRedisDeadLetters(t *testing.T) {
+	ctx := context.TODO()
+	redisServer.FlushAll()
+	cli := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	defer cli.Close()
+	dlq := tags.NewRedisDeadLetters(cli, "test:dead_letters")
+
+	now := time.Now()
+	for i, id := range []string{"b", "a", "c"} {
+		require.NoError(t, dlq.Push(ctx, &tags.DeadLetter{ID: id, Payload: "p-" + id, Attempts: i, FailedAt: now.Add(time.Duration(i) * time.Second)}))
+	}
+
+	// 按失败时间排序分页
+	letters, total, err := dlq.List(ctx, 1, 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, total)
+	require.Len(t, letters, 2)
+	assert.Equal(t, "a", letters[0].ID)
+	assert.Equal(t, "c", letters[1].ID)
+
+	letter, err := dlq.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "p-a", letter.Payload)
+	assert.Equal(t, 1, letter.Attempts)
+
+	require.NoError(t, dlq.Remove(ctx, "a"))
+	_, err = dlq.Get(ctx, "a")
+	assert.ErrorIs(t, err, tags.ErrDeadLetterNotFound)
+	letters, total, err = dlq.List(ctx, 0, 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, total)
+	assert.Len(t, letters, 2)
+}
@@ -0,0 +1,189 @@
+package tags
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/khicago/irr"
+)
+
+// DefaultAckTimeout 消息投递后超过该时长未确认，会被 GetUnacked 重新取回
+const DefaultAckTimeout = time.Minute
+
+var (
+	_ Producer = &ChanQueue{}
+	_ Consumer = &ChanQueue{}
+
+	ErrQueueFull      = irr.Error("queue is full")
+	ErrUnknownMessage = irr.Error("unknown message")
+)
+
+type (
+	// ChanQueue 基于 channel 的进程内消息队列，同时实现了 Producer 和 Consumer
+	// 适用于单实例部署和测试，消息不会持久化，进程退出后未处理的消息会丢失
+	ChanQueue struct {
+		ch         chan *Message
+		ackTimeout time.Duration
+
+		mu       sync.Mutex
+		seq      uint64
+		inflight map[string]inflightMessage
+		failed   []*Message
+	}
+
+	inflightMessage struct {
+		msg         *Message
+		deliveredAt time.Time
+	}
+)
+
+// NewChanQueue 创建一个容量为 size 的进程内消息队列，ackTimeout <= 0 时使用 DefaultAckTimeout
+func NewChanQueue(size int, ackTimeout time.Duration) *ChanQueue {
+	if ackTimeout <= 0 {
+		ackTimeout = DefaultAckTimeout
+	}
+	return &ChanQueue{
+		ch:         make(chan *Message, size),
+		ackTimeout: ackTimeout,
+		inflight:   make(map[string]inflightMessage),
+	}
+}
+
+// Put 入队，队列已满时返回 ErrQueueFull 而不是阻塞调用方
+func (q *ChanQueue) Put(ctx context.Context, payload string) error {
+	q.mu.Lock()
+	q.seq++
+	msg := &Message{ID: strconv.FormatUint(q.seq, 10), Payload: payload}
+	q.mu.Unlock()
+	return q.push(ctx, msg)
+}
+
+func (q *ChanQueue) push(ctx context.Context, msg *Message) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case q.ch <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *ChanQueue) Get(ctx context.Context) (*Message, error) {
+	messages, err := q.MGet(ctx, 1)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+func (q *ChanQueue) MGet(ctx context.Context, count int) ([]*Message, error) {
+	messages := make([]*Message, 0, count)
+	for len(messages) < count {
+		select {
+		case <-ctx.Done():
+			return messages, ctx.Err()
+		case msg := <-q.ch:
+			q.deliver(msg)
+			messages = append(messages, msg)
+		default:
+			return messages, nil
+		}
+	}
+	return messages, nil
+}
+
+func (q *ChanQueue) GetUnacked(ctx context.Context) (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for id, m := range q.inflight {
+		if now.Sub(m.deliveredAt) < q.ackTimeout {
+			continue
+		}
+		q.inflight[id] = inflightMessage{msg: m.msg, deliveredAt: now}
+		return m.msg, nil
+	}
+	return nil, nil
+}
+
+func (q *ChanQueue) Ack(ctx context.Context, msg *Message) error {
+	_, err := q.settle(msg)
+	return err
+}
+
+func (q *ChanQueue) Fail(ctx context.Context, msg *Message) error {
+	m, err := q.settle(msg)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.failed = append(q.failed, m)
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *ChanQueue) Requeue(ctx context.Context, msg *Message) error {
+	m, err := q.settle(msg)
+	if err != nil {
+		return err
+	}
+	if err = q.push(ctx, m); err != nil {
+		q.deliver(m) // 放不回去时保留在 inflight 中，超时后由 GetUnacked 取回
+		return irr.Wrap(err, "failed to requeue message %s", m.ID)
+	}
+	return nil
+}
+
+// Touch 把消息的投递时间更新为当前时间，不在 inflight 中的消息会被忽略
+func (q *ChanQueue) Touch(ctx context.Context, messages ...*Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, msg := range messages {
+		if m, ok := q.inflight[msg.ID]; ok {
+			q.inflight[msg.ID] = inflightMessage{msg: m.msg, deliveredAt: now}
+		}
+	}
+	return nil
+}
+
+func (q *ChanQueue) Backlog(ctx context.Context) (Backlog, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Backlog{Undelivered: int64(len(q.ch)), Pending: int64(len(q.inflight))}, nil
+}
+
+// Len 返回待投递的消息数
+func (q *ChanQueue) Len() int {
+	return len(q.ch)
+}
+
+// Failed 返回被标记为失败的消息
+func (q *ChanQueue) Failed() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*Message(nil), q.failed...)
+}
+
+func (q *ChanQueue) deliver(msg *Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight[msg.ID] = inflightMessage{msg: msg, deliveredAt: time.Now()}
+}
+
+func (q *ChanQueue) settle(msg *Message) (*Message, error) {
+	if msg == nil {
+		return nil, irr.Error("message is nil")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, ok := q.inflight[msg.ID]
+	if !ok {
+		return nil, irr.Wrap(ErrUnknownMessage, "message %s is not inflight", msg.ID)
+	}
+	delete(q.inflight, msg.ID)
+	return m.msg, nil
+}
@@ -0,0 +1,196 @@
+package tags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/khicago/irr"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	_ DeadLetterQueue = &MemoryDeadLetters{}
+	_ DeadLetterQueue = &RedisDeadLetters{}
+
+	ErrDeadLetterNotFound = irr.Error("dead letter not found")
+	ErrInvalidDeadLetter  = irr.Error("invalid dead letter")
+)
+
+type (
+	// DeadLetter 重试次数耗尽或无法解析的消息
+	DeadLetter struct {
+		ID       string    `json:"id"`
+		Payload  string    `json:"payload"`
+		Error    string    `json:"error"`
+		Attempts int       `json:"attempts"`
+		FailedAt time.Time `json:"failed_at"`
+	}
+
+	// DeadLetterQueue 死信存储，用于排查和重放处理失败的消息
+	DeadLetterQueue interface {
+		Push(ctx context.Context, letter *DeadLetter) error
+		// List 按失败时间从早到晚分页列出死信，同时返回总数
+		List(ctx context.Context, offset, limit int) ([]*DeadLetter, int64, error)
+		// Get 获取死信，不存在时返回 ErrDeadLetterNotFound
+		Get(ctx context.Context, id string) (*DeadLetter, error)
+		Remove(ctx context.Context, id string) error
+	}
+
+	// MemoryDeadLetters 进程内的死信存储，超过容量时丢弃最早的死信
+	MemoryDeadLetters struct {
+		mu       sync.Mutex
+		capacity int
+		letters  []*DeadLetter
+	}
+
+	// RedisDeadLetters 基于 Redis 的死信存储，死信内容存放在 hash 中，按失败时间索引在 sorted set 中
+	RedisDeadLetters struct {
+		cli *redis.Client
+		key string
+	}
+)
+
+// NewMemoryDeadLetters 创建进程内死信存储，capacity <= 0 时不限制容量
+func NewMemoryDeadLetters(capacity int) *MemoryDeadLetters {
+	return &MemoryDeadLetters{capacity: capacity}
+}
+
+func (d *MemoryDeadLetters) Push(ctx context.Context, letter *DeadLetter) error {
+	if letter == nil {
+		return irr.Error("dead letter is nil")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.letters = append(d.letters, letter)
+	if d.capacity > 0 && len(d.letters) > d.capacity {
+		d.letters = d.letters[len(d.letters)-d.capacity:]
+	}
+	return nil
+}
+
+func (d *MemoryDeadLetters) List(ctx context.Context, offset, limit int) ([]*DeadLetter, int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	total := int64(len(d.letters))
+	if offset >= len(d.letters) {
+		return []*DeadLetter{}, total, nil
+	}
+	end := len(d.letters)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return append([]*DeadLetter(nil), d.letters[offset:end]...), total, nil
+}
+
+func (d *MemoryDeadLetters) Get(ctx context.Context, id string) (*DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, letter := range d.letters {
+		if letter.ID == id {
+			return letter, nil
+		}
+	}
+	return nil, ErrDeadLetterNotFound
+}
+
+func (d *MemoryDeadLetters) Remove(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, letter := range d.letters {
+		if letter.ID == id {
+			d.letters = append(d.letters[:i], d.letters[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// NewRedisDeadLetters 创建基于 Redis 的死信存储，key 为死信 hash 的 key，索引存放在 key + ":index" 中
+func NewRedisDeadLetters(cli *redis.Client, key string) *RedisDeadLetters {
+	return &RedisDeadLetters{cli: cli, key: key}
+}
+
+func (d *RedisDeadLetters) indexKey() string {
+	return d.key + ":index"
+}
+
+func (d *RedisDeadLetters) Push(ctx context.Context, letter *DeadLetter) error {
+	if letter == nil {
+		return irr.Error("dead letter is nil")
+	}
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return irr.Wrap(err, "failed to marshal dead letter")
+	}
+	if err = d.cli.HSet(ctx, d.key, letter.ID, string(data)).Err(); err != nil {
+		return irr.Wrap(err, "failed to save dead letter %s", letter.ID)
+	}
+	score := float64(letter.FailedAt.UnixMilli())
+	if err = d.cli.ZAdd(ctx, d.indexKey(), redis.Z{Score: score, Member: letter.ID}).Err(); err != nil {
+		return irr.Wrap(err, "failed to index dead letter %s", letter.ID)
+	}
+	return nil
+}
+
+func (d *RedisDeadLetters) List(ctx context.Context, offset, limit int) ([]*DeadLetter, int64, error) {
+	total, err := d.cli.ZCard(ctx, d.indexKey()).Result()
+	if err != nil {
+		return nil, 0, irr.Wrap(err, "failed to count dead letters")
+	}
+	stop := int64(-1)
+	if limit > 0 {
+		stop = int64(offset + limit - 1)
+	}
+	ids, err := d.cli.ZRange(ctx, d.indexKey(), int64(offset), stop).Result()
+	if err != nil {
+		return nil, 0, irr.Wrap(err, "failed to list dead letters")
+	}
+	if len(ids) == 0 {
+		return []*DeadLetter{}, total, nil
+	}
+	values, err := d.cli.HMGet(ctx, d.key, ids...).Result()
+	if err != nil {
+		return nil, 0, irr.Wrap(err, "failed to get dead letters")
+	}
+	letters := make([]*DeadLetter, 0, len(values))
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // 索引和内容不一致时以内容为准
+		}
+		letter := &DeadLetter{}
+		if err = json.Unmarshal([]byte(data), letter); err != nil {
+			return nil, 0, irr.Wrap(err, "failed to unmarshal dead letter %s", ids[i])
+		}
+		letters = append(letters, letter)
+	}
+	return letters, total, nil
+}
+
+func (d *RedisDeadLetters) Get(ctx context.Context, id string) (*DeadLetter, error) {
+	data, err := d.cli.HGet(ctx, d.key, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, irr.Wrap(err, "failed to get dead letter %s", id)
+	}
+	letter := &DeadLetter{}
+	if err = json.Unmarshal([]byte(data), letter); err != nil {
+		return nil, irr.Wrap(err, "failed to unmarshal dead letter %s", id)
+	}
+	return letter, nil
+}
+
+func (d *RedisDeadLetters) Remove(ctx context.Context, id string) error {
+	if err := d.cli.HDel(ctx, d.key, id).Err(); err != nil {
+		return irr.Wrap(err, "failed to remove dead letter %s", id)
+	}
+	if err := d.cli.ZRem(ctx, d.indexKey(), id).Err(); err != nil {
+		return irr.Wrap(err, "failed to remove dead letter %s from index", id)
+	}
+	return nil
+}
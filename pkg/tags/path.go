@@ -0,0 +1,96 @@
+package tags
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/khicago/irr"
+)
+
+const (
+	// PathSeparator 层级标签的分隔符，如 lang/ja/kanji
+	PathSeparator = "/"
+	// MaxTagLength 标签 (完整路径) 的最大长度，与 tags 表的字段长度保持一致
+	MaxTagLength = 512
+)
+
+var ErrInvalidTag = irr.Error("invalid tag")
+
+// NormalizeTag 规范化标签路径：去掉每一级首尾的空白，并忽略空的层级
+// 如 " lang / ja //kanji/ " => "lang/ja/kanji"
+func NormalizeTag(tag string) (string, error) {
+	segments := strings.Split(tag, PathSeparator)
+	parts := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		if seg = strings.TrimSpace(seg); seg != "" {
+			parts = append(parts, seg)
+		}
+	}
+	normalized := strings.Join(parts, PathSeparator)
+	if normalized == "" {
+		return "", irr.Wrap(ErrInvalidTag, "tag is empty, tag= %q", tag)
+	}
+	if len(normalized) > MaxTagLength {
+		return "", irr.Wrap(ErrInvalidTag, "tag is too long, len= %d", len(normalized))
+	}
+	return normalized, nil
+}
+
+// NormalizeTags 规范化一组标签并去重，保持原有顺序
+func NormalizeTags(tags []string) ([]string, error) {
+	ret := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		normalized, err := NormalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[normalized]; ok {
+			continue
+		}
+		seen[normalized] = struct{}{}
+		ret = append(ret, normalized)
+	}
+	return ret, nil
+}
+
+// InSubtree 判断 tag 是否为 root 本身或 root 的子孙
+func InSubtree(tag, root string) bool {
+	return tag == root || strings.HasPrefix(tag, root+PathSeparator)
+}
+
+// SubtreeOf 从 tags 中筛选出 root 子树中的标签，root 本身 (如果存在) 排在最前面，其余按字典序
+func SubtreeOf(tags []string, root string) []string {
+	ret := make([]string, 0)
+	for _, tag := range tags {
+		if InSubtree(tag, root) {
+			ret = append(ret, tag)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i] == root || ret[j] == root {
+			return ret[i] == root
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+// Ancestors 返回 tag 的所有祖先，由近及远，如 lang/ja/kanji => [lang/ja, lang]
+func Ancestors(tag string) []string {
+	ret := make([]string, 0)
+	for i := strings.LastIndex(tag, PathSeparator); i > 0; i = strings.LastIndex(tag, PathSeparator) {
+		tag = tag[:i]
+		ret = append(ret, tag)
+	}
+	return ret
+}
+
+// Rebase 将 root 子树中的 tag 移动到 newRoot 下，如 Rebase("lang/ja/kanji", "lang/ja", "jp") => "jp/kanji"
+// tag 不在 root 子树中时原样返回
+func Rebase(tag, root, newRoot string) string {
+	if !InSubtree(tag, root) {
+		return tag
+	}
+	return newRoot + tag[len(root):]
+}
@@ -0,0 +1,65 @@
+package tags_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tag, err := tags.NormalizeTag(" lang / ja //kanji/ ")
+	require.NoError(t, err)
+	assert.Equal(t, "lang/ja/kanji", tag)
+
+	_, err = tags.NormalizeTag(" / ")
+	assert.ErrorIs(t, err, tags.ErrInvalidTag)
+
+	normalized, err := tags.NormalizeTags([]string{"a/b", "a / b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/b", "c"}, normalized)
+}
+
+func TestTagPath(t *testing.T) {
+	assert.True(t, tags.InSubtree("lang/ja", "lang/ja"))
+	assert.True(t, tags.InSubtree("lang/ja/kanji", "lang/ja"))
+	assert.False(t, tags.InSubtree("lang/java", "lang/ja"))
+	assert.False(t, tags.InSubtree("lang", "lang/ja"))
+
+	assert.Equal(t, []string{"lang/ja", "lang/ja/kana", "lang/ja/kanji"},
+		tags.SubtreeOf([]string{"lang/ja/kanji", "lang/java", "lang/ja", "lang/ja/kana", "lang"}, "lang/ja"))
+	assert.Equal(t, []string{"lang/ja", "lang"}, tags.Ancestors("lang/ja/kanji"))
+	assert.Empty(t, tags.Ancestors("lang"))
+
+	assert.Equal(t, "jp/kanji", tags.Rebase("lang/ja/kanji", "lang/ja", "jp"))
+	assert.Equal(t, "jp", tags.Rebase("lang/ja", "lang/ja", "jp"))
+	assert.Equal(t, "lang/java", tags.Rebase("lang/java", "lang/ja", "jp"))
+}
+
+func TestBuildTagTree(t *testing.T) {
+	tree := tags.BuildTagTree(map[string][]utils.UInt64{
+		"lang/ja/kanji": {1, 2},
+		"lang/ja/kana":  {2, 3},
+		"lang/en":       {4},
+		"grammar":       {1},
+	})
+	require.Len(t, tree, 2)
+	assert.Equal(t, "grammar", tree[0].Name)
+	assert.Equal(t, 1, tree[0].Total)
+
+	lang := tree[1]
+	assert.Equal(t, "lang", lang.Path)
+	assert.Equal(t, 0, lang.Count, "intermediate node is not tagged directly")
+	assert.Equal(t, 4, lang.Total)
+	require.Len(t, lang.Children, 2)
+
+	ja := lang.Children[1]
+	assert.Equal(t, "lang/ja", ja.Path)
+	assert.Equal(t, 3, ja.Total, "entities tagged by several descendants are counted once")
+	require.Len(t, ja.Children, 2)
+	assert.Equal(t, "kana", ja.Children[0].Name)
+	assert.Equal(t, 2, ja.Children[0].Count)
+}
@@ -0,0 +1,510 @@
+package tags
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+// 标签表达式的限制
+const (
+	MaxQueryLength = 1024
+	MaxQueryTags   = 32
+	MaxQueryDepth  = 16
+)
+
+// ErrInvalidQuery 标签表达式不合法
+var ErrInvalidQuery = irr.Error("invalid tag query")
+
+type (
+	// Query 标签表达式，如 `(grammar OR vocab) AND NOT hard`
+	//
+	// 语法:
+	//
+	//	expr   := or
+	//	or     := and { "OR" and }
+	//	and    := unary { ["AND"] unary }   // 相邻的两项之间省略 AND 时视为 AND
+	//	unary  := "NOT" unary | "(" expr ")" | tag
+	//	tag    := 不含空白和括号的字符序列 | "带空白的标签"
+	//
+	// 关键字不区分大小写，也可以写成 `&&`、`||` 和 `!`；标签按层级匹配，见 TagService.GetEntities
+	Query interface {
+		// Tags 返回表达式中出现的所有标签 (去重，按出现顺序)
+		Tags() []string
+		// String 返回规范化后的表达式
+		String() string
+
+		eval(lookup func(tag string) (entitySet, error)) (set entitySet, negated bool, err error)
+		precedence() int
+	}
+
+	// entitySet entity id 的集合
+	entitySet map[utils.UInt64]struct{}
+
+	queryTag struct {
+		tag string
+	}
+
+	queryNot struct {
+		operand Query
+	}
+
+	queryBinary struct {
+		op          string // "AND" or "OR"
+		left, right Query
+	}
+)
+
+const (
+	opAnd = "AND"
+	opOr  = "OR"
+	opNot = "NOT"
+)
+
+// ParseQuery 解析标签表达式，表达式中的标签会被规范化 (见 NormalizeTag)
+func ParseQuery(q string) (Query, error) {
+	if len(q) > MaxQueryLength {
+		return nil, irr.Wrap(ErrInvalidQuery, "query is too long, len= %d, max= %d", len(q), MaxQueryLength)
+	}
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, irr.Wrap(ErrInvalidQuery, "query is empty")
+	}
+
+	p := &queryParser{tokens: tokens}
+	query, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %s", p.tokens[p.pos])
+	}
+	if n := len(query.Tags()); n > MaxQueryTags {
+		return nil, irr.Wrap(ErrInvalidQuery, "too many tags in query, count= %d, max= %d", n, MaxQueryTags)
+	}
+	return query, nil
+}
+
+// EvalQuery 计算表达式匹配的 entities，lookup 返回单个标签匹配的 entities，
+// all 返回 NOT 的全集 (只有整个表达式是取反的结果时才会被调用，如 `NOT hard`)
+// 返回的 entity id 按升序排列
+func EvalQuery(query Query, lookup func(tag string) ([]utils.UInt64, error), all func() ([]utils.UInt64, error)) ([]utils.UInt64, error) {
+	cache := make(map[string]entitySet)
+	set, negated, err := query.eval(func(tag string) (entitySet, error) {
+		if s, ok := cache[tag]; ok {
+			return s, nil
+		}
+		ids, err := lookup(tag)
+		if err != nil {
+			return nil, err
+		}
+		s := newEntitySet(ids)
+		cache[tag] = s
+		return s, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if negated {
+		ids, err := all()
+		if err != nil {
+			return nil, err
+		}
+		set = newEntitySet(ids).subtract(set)
+	}
+
+	ret := make([]utils.UInt64, 0, len(set))
+	for id := range set {
+		ret = append(ret, id)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+// QueryEntities 查询用户满足标签表达式的 entities，entityType 为空时查询所有类型
+// 整个表达式取反时 (如 `NOT hard`)，以用户所有打过标签的 entities 作为全集
+func (s *TagService[EntityType]) QueryEntities(ctx context.Context, userID utils.UInt64, query Query, entityType *EntityType) ([]utils.UInt64, error) {
+	lookup := func(tag string) ([]utils.UInt64, error) {
+		return s.GetEntities(ctx, userID, tag, entityType)
+	}
+	all := func() ([]utils.UInt64, error) {
+		userTags, err := s.GetTagsByUser(ctx, userID)
+		if err != nil {
+			return nil, irr.Wrap(err, "failed to get tags of user")
+		}
+		set := make(entitySet)
+		for _, tag := range userTags {
+			ids, err := lookup(tag)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				set[id] = struct{}{}
+			}
+		}
+		ret := make([]utils.UInt64, 0, len(set))
+		for id := range set {
+			ret = append(ret, id)
+		}
+		return ret, nil
+	}
+	return EvalQuery(query, lookup, all)
+}
+
+func newEntitySet(ids []utils.UInt64) entitySet {
+	set := make(entitySet, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func (s entitySet) intersect(other entitySet) entitySet {
+	if len(other) < len(s) {
+		s, other = other, s
+	}
+	ret := make(entitySet)
+	for id := range s {
+		if _, ok := other[id]; ok {
+			ret[id] = struct{}{}
+		}
+	}
+	return ret
+}
+
+func (s entitySet) union(other entitySet) entitySet {
+	ret := make(entitySet, len(s)+len(other))
+	for id := range s {
+		ret[id] = struct{}{}
+	}
+	for id := range other {
+		ret[id] = struct{}{}
+	}
+	return ret
+}
+
+func (s entitySet) subtract(other entitySet) entitySet {
+	ret := make(entitySet)
+	for id := range s {
+		if _, ok := other[id]; !ok {
+			ret[id] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// eval 返回的 negated 为 true 时，结果表示 set 的补集，这样 `a AND NOT b` 这类表达式不需要全集就能算出来
+
+func (q *queryTag) eval(lookup func(tag string) (entitySet, error)) (entitySet, bool, error) {
+	set, err := lookup(q.tag)
+	return set, false, err
+}
+
+func (q *queryNot) eval(lookup func(tag string) (entitySet, error)) (entitySet, bool, error) {
+	set, negated, err := q.operand.eval(lookup)
+	return set, !negated, err
+}
+
+func (q *queryBinary) eval(lookup func(tag string) (entitySet, error)) (entitySet, bool, error) {
+	l, ln, err := q.left.eval(lookup)
+	if err != nil {
+		return nil, false, err
+	}
+	r, rn, err := q.right.eval(lookup)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if q.op == opOr { // A | B = !(!A & !B)
+		set, negated := evalAnd(l, !ln, r, !rn)
+		return set, !negated, nil
+	}
+	set, negated := evalAnd(l, ln, r, rn)
+	return set, negated, nil
+}
+
+func evalAnd(l entitySet, ln bool, r entitySet, rn bool) (entitySet, bool) {
+	switch {
+	case !ln && !rn:
+		return l.intersect(r), false
+	case !ln && rn:
+		return l.subtract(r), false
+	case ln && !rn:
+		return r.subtract(l), false
+	default: // !A & !B = !(A | B)
+		return l.union(r), true
+	}
+}
+
+func (q *queryTag) Tags() []string {
+	return []string{q.tag}
+}
+
+func (q *queryNot) Tags() []string {
+	return q.operand.Tags()
+}
+
+func (q *queryBinary) Tags() []string {
+	ret := q.left.Tags()
+	for _, tag := range q.right.Tags() {
+		if !containsString(ret, tag) {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+func (q *queryTag) String() string {
+	if needsQuote(q.tag) {
+		return `"` + q.tag + `"`
+	}
+	return q.tag
+}
+
+func (q *queryNot) String() string {
+	if q.operand.precedence() < q.precedence() {
+		return opNot + " (" + q.operand.String() + ")"
+	}
+	return opNot + " " + q.operand.String()
+}
+
+func (q *queryBinary) String() string {
+	wrap := func(operand Query) string {
+		if operand.precedence() < q.precedence() {
+			return "(" + operand.String() + ")"
+		}
+		return operand.String()
+	}
+	return wrap(q.left) + " " + q.op + " " + wrap(q.right)
+}
+
+func (q *queryTag) precedence() int { return 4 }
+
+func (q *queryNot) precedence() int { return 3 }
+
+func (q *queryBinary) precedence() int {
+	if q.op == opAnd {
+		return 2
+	}
+	return 1
+}
+
+func containsString(lst []string, s string) bool {
+	for _, v := range lst {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func needsQuote(tag string) bool {
+	if isQueryKeyword(tag) {
+		return true
+	}
+	return strings.ContainsFunc(tag, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(`()"&|!`, r)
+	})
+}
+
+func isQueryKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case opAnd, opOr, opNot:
+		return true
+	}
+	return false
+}
+
+type (
+	queryTokenKind uint8
+
+	queryToken struct {
+		kind queryTokenKind
+		text string // 标签的内容或运算符
+		pos  int    // 在原始表达式中的位置 (byte offset)
+	}
+
+	queryParser struct {
+		tokens []queryToken
+		pos    int
+	}
+)
+
+const (
+	tokenTag queryTokenKind = iota + 1
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+)
+
+func (t queryToken) String() string {
+	if t.kind == tokenTag {
+		return "tag `" + t.text + "`"
+	}
+	return "`" + t.text + "`"
+}
+
+func lexQuery(q string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == '!':
+			tokens = append(tokens, queryToken{kind: tokenNot, text: "!", pos: i})
+			i++
+		case strings.HasPrefix(q[i:], "&&"):
+			tokens = append(tokens, queryToken{kind: tokenAnd, text: "&&", pos: i})
+			i += 2
+		case strings.HasPrefix(q[i:], "||"):
+			tokens = append(tokens, queryToken{kind: tokenOr, text: "||", pos: i})
+			i += 2
+		case c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, irr.Wrap(ErrInvalidQuery, "unterminated quote at %d", i)
+			}
+			tag, err := NormalizeTag(q[i+1 : i+1+end])
+			if err != nil {
+				return nil, irr.Wrap(ErrInvalidQuery, "invalid tag at %d", i)
+			}
+			tokens = append(tokens, queryToken{kind: tokenTag, text: tag, pos: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(q) && !strings.ContainsRune(" \t\n\r()\"!", rune(q[i])) &&
+				!strings.HasPrefix(q[i:], "&&") && !strings.HasPrefix(q[i:], "||") {
+				i++
+			}
+			word := q[start:i]
+			switch strings.ToUpper(word) {
+			case opAnd:
+				tokens = append(tokens, queryToken{kind: tokenAnd, text: word, pos: start})
+			case opOr:
+				tokens = append(tokens, queryToken{kind: tokenOr, text: word, pos: start})
+			case opNot:
+				tokens = append(tokens, queryToken{kind: tokenNot, text: word, pos: start})
+			default:
+				tag, err := NormalizeTag(word)
+				if err != nil {
+					return nil, irr.Wrap(ErrInvalidQuery, "invalid tag at %d", start)
+				}
+				tokens = append(tokens, queryToken{kind: tokenTag, text: tag, pos: start})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func (p *queryParser) errorf(format string, args ...any) error {
+	at := "end of query"
+	if p.pos < len(p.tokens) {
+		at = "position " + strconv.Itoa(p.tokens[p.pos].pos)
+	}
+	return irr.Wrap(ErrInvalidQuery, format+" at "+at, args...)
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) parseOr(depth int) (Query, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind != tokenOr {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &queryBinary{op: opOr, left: left, right: right}
+	}
+}
+
+func (p *queryParser) parseAnd(depth int) (Query, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok {
+			return left, nil
+		}
+		switch tok.kind {
+		case tokenAnd:
+			p.pos++
+		case tokenTag, tokenNot, tokenLParen: // 省略 AND
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &queryBinary{op: opAnd, left: left, right: right}
+	}
+}
+
+func (p *queryParser) parseUnary(depth int) (Query, error) {
+	if depth > MaxQueryDepth {
+		return nil, p.errorf("query is nested too deep")
+	}
+	tok, ok := p.peek()
+	if !ok {
+		return nil, p.errorf("missing tag")
+	}
+	switch tok.kind {
+	case tokenTag:
+		p.pos++
+		return &queryTag{tag: tok.text}, nil
+	case tokenNot:
+		p.pos++
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{operand: operand}, nil
+	case tokenLParen:
+		p.pos++
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if tok, ok = p.peek(); !ok || tok.kind != tokenRParen {
+			return nil, p.errorf("missing `)`")
+		}
+		p.pos++
+		return inner, nil
+	default:
+		return nil, p.errorf("unexpected %s", tok)
+	}
+}
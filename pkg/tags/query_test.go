@@ -0,0 +1,80 @@
+package tags_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+)
+
+func TestParseQuery(t *testing.T) {
+	cases := map[string]string{
+		"grammar":                              "grammar",
+		"(grammar OR vocab) AND NOT hard":      "(grammar OR vocab) AND NOT hard",
+		"grammar or vocab and not hard":        "grammar OR vocab AND NOT hard",
+		"grammar vocab":                        "grammar AND vocab",
+		"!(a || b) && c":                       "NOT (a OR b) AND c",
+		`"spoken english" OR lang/en//idioms/`: `"spoken english" OR lang/en/idioms`,
+		`"not"`:                                `"not"`,
+	}
+	for input, expected := range cases {
+		q, err := tags.ParseQuery(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, q.String(), input)
+
+		again, err := tags.ParseQuery(q.String())
+		require.NoError(t, err, "String() should be parsable, %s", q.String())
+		assert.Equal(t, q.String(), again.String())
+	}
+
+	q, err := tags.ParseQuery("(a OR b) AND NOT a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, q.Tags())
+
+	for _, input := range []string{"", "  ", "a AND", "(a OR b", "a)", "OR a", `"a`, "NOT", "a AND ()"} {
+		_, err = tags.ParseQuery(input)
+		assert.True(t, errors.Is(err, tags.ErrInvalidQuery), "%q should be invalid, got %v", input, err)
+	}
+}
+
+func TestEvalQuery(t *testing.T) {
+	index := map[string][]utils.UInt64{
+		"grammar": {1, 2, 3},
+		"vocab":   {3, 4},
+		"hard":    {2, 4, 5},
+	}
+	lookup := func(tag string) ([]utils.UInt64, error) { return index[tag], nil }
+	all := func() ([]utils.UInt64, error) { return []utils.UInt64{1, 2, 3, 4, 5, 6}, nil }
+
+	cases := map[string][]utils.UInt64{
+		"grammar":                         {1, 2, 3},
+		"grammar AND vocab":               {3},
+		"grammar OR vocab":                {1, 2, 3, 4},
+		"(grammar OR vocab) AND NOT hard": {1, 3},
+		"NOT hard":                        {1, 3, 6},
+		"NOT grammar OR hard":             {2, 4, 5, 6},
+		"NOT (grammar OR vocab)":          {5, 6},
+		"NOT grammar AND NOT vocab":       {5, 6},
+		"unknown":                         {},
+		"NOT NOT vocab":                   {3, 4},
+	}
+	for input, expected := range cases {
+		q, err := tags.ParseQuery(input)
+		require.NoError(t, err, input)
+		ids, err := tags.EvalQuery(q, lookup, all)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, ids, input)
+	}
+
+	q, err := tags.ParseQuery("grammar AND NOT hard")
+	require.NoError(t, err)
+	_, err = tags.EvalQuery(q, lookup, func() ([]utils.UInt64, error) {
+		t.Fatal("universe should not be needed")
+		return nil, nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,223 @@
+package tags_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/internal/utils/cache"
+	"github.com/bagaking/memorianexus/pkg/tags"
+)
+
+// queueUnderTest 同时实现 Producer 和 Consumer 的队列
+type queueUnderTest interface {
+	tags.Producer
+	tags.Consumer
+}
+
+func newTestStreamQueue(t *testing.T, consumer string) *tags.RedisStreamQueue {
+	t.Helper()
+	cli := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	t.Cleanup(func() { _ = cli.Close() })
+	q, err := tags.NewRedisStreamQueue(context.TODO(), cli, "test:tag_updates", "test_group", consumer)
+	require.NoError(t, err)
+	return q
+}
+
+// 两种队列实现需要满足相同的投递语义
+func TestQueue_Delivery(t *testing.T) {
+	backends := map[string]func(t *testing.T) queueUnderTest{
+		"chan": func(t *testing.T) queueUnderTest { return newTestQueue(t) },
+		"redis_stream": func(t *testing.T) queueUnderTest {
+			redisServer.FlushAll()
+			return newTestStreamQueue(t, "c1")
+		},
+	}
+
+	for name, newQueue := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			q := newQueue(t)
+
+			// 空队列
+			msg, err := q.Get(ctx)
+			assert.NoError(t, err)
+			assert.Nil(t, msg)
+			messages, err := q.MGet(ctx, 10)
+			assert.NoError(t, err)
+			assert.Empty(t, messages)
+
+			// 按顺序投递，每条消息只投递一次
+			for _, payload := range []string{"a", "b", "c"} {
+				require.NoError(t, q.Put(ctx, payload))
+			}
+			backlog, err := q.Backlog(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tags.Backlog{Undelivered: 3}, backlog)
+			messages, err = q.MGet(ctx, 2)
+			require.NoError(t, err)
+			require.Len(t, messages, 2)
+			assert.Equal(t, "a", messages[0].Payload)
+			assert.Equal(t, "b", messages[1].Payload)
+			assert.NotEqual(t, messages[0].ID, messages[1].ID)
+
+			msg, err = q.Get(ctx)
+			require.NoError(t, err)
+			require.NotNil(t, msg)
+			assert.Equal(t, "c", msg.Payload)
+			backlog, err = q.Backlog(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tags.Backlog{Pending: 3}, backlog)
+
+			// Requeue 的消息会被再次投递
+			require.NoError(t, q.Ack(ctx, messages[0]))
+			require.NoError(t, q.Fail(ctx, messages[1]))
+			require.NoError(t, q.Requeue(ctx, msg))
+			msg, err = q.Get(ctx)
+			require.NoError(t, err)
+			require.NotNil(t, msg)
+			assert.Equal(t, "c", msg.Payload)
+			require.NoError(t, q.Ack(ctx, msg))
+
+			// 全部确认后没有待处理的消息
+			msg, err = q.Get(ctx)
+			assert.NoError(t, err)
+			assert.Nil(t, msg)
+			msg, err = q.GetUnacked(ctx)
+			assert.NoError(t, err)
+			assert.Nil(t, msg)
+			backlog, err = q.Backlog(ctx)
+			require.NoError(t, err)
+			assert.Zero(t, backlog)
+		})
+	}
+}
+
+func TestChanQueue_GetUnacked(t *testing.T) {
+	ctx := context.TODO()
+	q := tags.NewChanQueue(4, 50*time.Millisecond)
+	require.NoError(t, q.Put(ctx, "stuck"))
+
+	msg, err := q.Get(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	// 未超时前不会被取回
+	unacked, err := q.GetUnacked(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, unacked)
+
+	time.Sleep(60 * time.Millisecond)
+	unacked, err = q.GetUnacked(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, unacked)
+	assert.Equal(t, msg.ID, unacked.ID)
+	assert.Equal(t, "stuck", unacked.Payload)
+
+	// 重新取回后计时重置
+	again, err := q.GetUnacked(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, again)
+
+	// Touch 同样重置计时
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, q.Touch(ctx, unacked))
+	again, err = q.GetUnacked(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, again)
+
+	require.NoError(t, q.Fail(ctx, unacked))
+	assert.Len(t, q.Failed(), 1)
+}
+
+func TestChanQueue_Full(t *testing.T) {
+	ctx := context.TODO()
+	q := tags.NewChanQueue(1, time.Minute)
+	require.NoError(t, q.Put(ctx, "a"))
+	assert.ErrorIs(t, q.Put(ctx, "b"), tags.ErrQueueFull)
+}
+
+// consumer 崩溃后，遗留的消息会被同组的其他 consumer 认领
+func TestRedisStreamQueue_ClaimStuckMessages(t *testing.T) {
+	ctx := context.TODO()
+	redisServer.FlushAll()
+	crashed := newTestStreamQueue(t, "crashed")
+	alive := newTestStreamQueue(t, "alive")
+	alive.MinIdle = 50 * time.Millisecond
+
+	require.NoError(t, crashed.Put(ctx, "stuck"))
+	msg, err := crashed.Get(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	// 已投递给 crashed 的消息不会再投递给 alive
+	got, err := alive.Get(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	// 空闲时间不足时不能认领
+	claimed, err := alive.GetUnacked(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, claimed)
+
+	// 持有者刷新后重新计算空闲时间
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, crashed.Touch(ctx, msg))
+	claimed, err = alive.GetUnacked(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, claimed)
+
+	time.Sleep(60 * time.Millisecond)
+	claimed, err = alive.GetUnacked(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, claimed)
+	assert.Equal(t, msg.ID, claimed.ID)
+	assert.Equal(t, "stuck", claimed.Payload)
+
+	require.NoError(t, alive.Fail(ctx, claimed))
+	failed, err := redis.NewClient(&redis.Options{Addr: redisServer.Addr()}).
+		XRange(ctx, alive.FailedStream(), "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "stuck", failed[0].Values["payload"])
+
+	claimed, err = alive.GetUnacked(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, claimed)
+}
+
+// 标签缓存失效消息经过 Redis Streams 队列后被 worker 处理
+func TestTagService_InvalidateThroughStreamQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	redisServer.FlushAll()
+	q := newTestStreamQueue(t, "worker")
+
+	repo := NewMockTagRepository()
+	service := tags.NewTagService(ctx, repo, []EntityType{EntityTypeBlock, EntityTypePost}, q, q)
+	defer service.UpdateMgr.Stop(ctx)
+
+	// 填充缓存
+	_, err := service.GetTagsByUser(ctx, 12345)
+	require.NoError(t, err)
+	users, err := service.GetUsersByTag(ctx, "tag1")
+	require.NoError(t, err)
+	assert.Equal(t, []utils.UInt64{12345}, users)
+
+	tagKey := service.Schemas.Tag2Users.MustBuild("tag1")
+	cached, err := cache.SET().GetAllUInt64s(ctx, tagKey)
+	require.NoError(t, err)
+	require.NotEmpty(t, cached)
+
+	// 用户缓存失效后，标签缓存的失效通过队列异步传播
+	require.NoError(t, service.InvalidateUserCache(ctx, 12345, true))
+	assert.Eventually(t, func() bool {
+		cached, err := cache.SET().GetAllUInt64s(ctx, tagKey)
+		return err == nil && len(cached) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,217 @@
+package tags
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/khicago/irr"
+	"github.com/redis/go-redis/v9"
+)
+
+// streamPayloadField 消息内容在 stream entry 中的字段名
+const streamPayloadField = "payload"
+
+var (
+	_ Producer = &RedisStreamQueue{}
+	_ Consumer = &RedisStreamQueue{}
+)
+
+type (
+	// RedisStreamQueue 基于 Redis Streams 的消息队列，同时实现了 Producer 和 Consumer
+	// 多个实例使用相同的 group 时共同消费同一个 stream，每条消息只会投递给其中一个 consumer;
+	// 投递后超过 MinIdle 未确认的消息 (比如 consumer 崩溃) 会被 GetUnacked 通过 XAUTOCLAIM 认领
+	RedisStreamQueue struct {
+		cli      *redis.Client
+		stream   string
+		group    string
+		consumer string
+
+		// MinIdle 消息投递后至少空闲多久才能被其他 consumer 认领
+		MinIdle time.Duration
+		// MaxLen stream 的近似最大长度，<= 0 时不裁剪
+		MaxLen int64
+	}
+)
+
+// NewRedisStreamQueue 创建 Redis Streams 消息队列，stream 和消费组不存在时会自动创建
+func NewRedisStreamQueue(ctx context.Context, cli *redis.Client, stream, group, consumer string) (*RedisStreamQueue, error) {
+	if cli == nil {
+		return nil, irr.Error("redis client cannot be nil")
+	}
+	if stream == "" || group == "" || consumer == "" {
+		return nil, irr.Error("stream, group and consumer cannot be empty")
+	}
+	q := &RedisStreamQueue{
+		cli:      cli,
+		stream:   stream,
+		group:    group,
+		consumer: consumer,
+		MinIdle:  DefaultAckTimeout,
+	}
+	if err := cli.XGroupCreateMkStream(ctx, stream, group, "0").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, irr.Wrap(err, "failed to create consumer group %s of stream %s", group, stream)
+	}
+	return q, nil
+}
+
+// FailedStream 处理失败的消息会被转存到该 stream 中，便于排查
+func (q *RedisStreamQueue) FailedStream() string {
+	return q.stream + ":failed"
+}
+
+func (q *RedisStreamQueue) Put(ctx context.Context, payload string) error {
+	return q.add(ctx, q.stream, payload)
+}
+
+func (q *RedisStreamQueue) add(ctx context.Context, stream, payload string) error {
+	args := &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]any{streamPayloadField: payload},
+	}
+	if q.MaxLen > 0 {
+		args.MaxLen, args.Approx = q.MaxLen, true
+	}
+	if err := q.cli.XAdd(ctx, args).Err(); err != nil {
+		return irr.Wrap(err, "failed to add message to stream %s", stream)
+	}
+	return nil
+}
+
+func (q *RedisStreamQueue) Get(ctx context.Context) (*Message, error) {
+	messages, err := q.MGet(ctx, 1)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+// MGet 读取尚未投递给本组任何 consumer 的消息，不阻塞
+func (q *RedisStreamQueue) MGet(ctx context.Context, count int) ([]*Message, error) {
+	streams, err := q.cli.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.group,
+		Consumer: q.consumer,
+		Streams:  []string{q.stream, ">"},
+		Count:    int64(count),
+		Block:    -1,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return []*Message{}, nil
+	}
+	if err != nil {
+		return nil, irr.Wrap(err, "failed to read stream %s", q.stream)
+	}
+	messages := make([]*Message, 0, count)
+	for _, s := range streams {
+		for _, entry := range s.Messages {
+			messages = append(messages, toMessage(entry))
+		}
+	}
+	return messages, nil
+}
+
+// GetUnacked 认领一条空闲超过 MinIdle 的待确认消息
+func (q *RedisStreamQueue) GetUnacked(ctx context.Context) (*Message, error) {
+	entries, _, err := q.cli.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   q.stream,
+		Group:    q.group,
+		Consumer: q.consumer,
+		MinIdle:  q.MinIdle,
+		Start:    "0-0",
+		Count:    1,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, irr.Wrap(err, "failed to claim pending messages of stream %s", q.stream)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return toMessage(entries[0]), nil
+}
+
+// Ack 确认消息并从 stream 中删除
+func (q *RedisStreamQueue) Ack(ctx context.Context, msg *Message) error {
+	if msg == nil {
+		return irr.Error("message is nil")
+	}
+	if err := q.cli.XAck(ctx, q.stream, q.group, msg.ID).Err(); err != nil {
+		return irr.Wrap(err, "failed to ack message %s", msg.ID)
+	}
+	// 已确认的消息不会再被投递，删除只是为了回收 stream 的空间
+	if err := q.cli.XDel(ctx, q.stream, msg.ID).Err(); err != nil {
+		return irr.Wrap(err, "failed to delete acked message %s", msg.ID)
+	}
+	return nil
+}
+
+// Fail 把消息转存到 FailedStream 后确认
+func (q *RedisStreamQueue) Fail(ctx context.Context, msg *Message) error {
+	if msg == nil {
+		return irr.Error("message is nil")
+	}
+	if err := q.add(ctx, q.FailedStream(), msg.Payload); err != nil {
+		return err
+	}
+	return q.Ack(ctx, msg)
+}
+
+// Requeue 把消息重新追加到 stream 末尾后确认，消息会获得新的 id
+func (q *RedisStreamQueue) Requeue(ctx context.Context, msg *Message) error {
+	if msg == nil {
+		return irr.Error("message is nil")
+	}
+	if err := q.Put(ctx, msg.Payload); err != nil {
+		return err
+	}
+	return q.Ack(ctx, msg)
+}
+
+// Touch 用 XCLAIM 把消息重新认领给自己，消息的空闲时间从零开始计算
+func (q *RedisStreamQueue) Touch(ctx context.Context, messages ...*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	err := q.cli.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   q.stream,
+		Group:    q.group,
+		Consumer: q.consumer,
+		Messages: ids,
+	}).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return irr.Wrap(err, "failed to touch messages of stream %s", q.stream)
+	}
+	return nil
+}
+
+// Backlog 通过 XPENDING 统计已投递未确认的消息数，其余的都是还没有投递的消息
+// 确认后的消息会被删除，stream 中只剩下这两类消息;
+// 删除过消息的 stream 在 XINFO GROUPS 中的 lag 无法计算，所以这里用 XLEN 减去 pending
+func (q *RedisStreamQueue) Backlog(ctx context.Context) (Backlog, error) {
+	pending, err := q.cli.XPending(ctx, q.stream, q.group).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return Backlog{}, irr.Wrap(err, "failed to get pending messages of stream %s", q.stream)
+	}
+	length, err := q.cli.XLen(ctx, q.stream).Result()
+	if err != nil {
+		return Backlog{}, irr.Wrap(err, "failed to get length of stream %s", q.stream)
+	}
+	backlog := Backlog{}
+	if pending != nil {
+		backlog.Pending = pending.Count
+	}
+	backlog.Undelivered = max(length-backlog.Pending, 0)
+	return backlog, nil
+}
+
+func toMessage(entry redis.XMessage) *Message {
+	payload, _ := entry.Values[streamPayloadField].(string)
+	return &Message{ID: entry.ID, Payload: payload}
+}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"time"
 
-	"github.com/adjust/redismq"
-
 	"github.com/bagaking/goulp/wlog"
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/internal/utils/cache"
@@ -72,7 +70,20 @@ type (
 		EntityID   utils.UInt64 `json:"eid"`
 		EntityType EntityType   `json:"entity_type"`
 		Tag        string       `json:"tags"`
+		TagList    []string     `json:"tag_list,omitempty"`
 		Propagate  bool         `json:"propagate"`
+
+		// 以下字段由 TagUpdateManager 维护
+		Attempts int   `json:"attempts,omitempty"` // 已经失败的处理次数
+		RetryAt  int64 `json:"retry_at,omitempty"` // 下一次重试的时间 (unix 毫秒)
+	}
+
+	// EntityTagChange 描述某个 entity 上发生变化的标签，用于精确地清理缓存
+	EntityTagChange[EntityType any] struct {
+		UserID     utils.UInt64
+		EntityID   utils.UInt64
+		EntityType EntityType
+		Tags       []string
 	}
 
 	TagSvr[EntityType any] interface {
@@ -82,6 +93,7 @@ type (
 		GetUsersByTag(ctx context.Context, tag string) ([]utils.UInt64, error)
 		GetEntities(ctx context.Context, userID utils.UInt64, tag string, entityType *EntityType) ([]utils.UInt64, error)
 		GetTagsOfEntity(ctx context.Context, entityID utils.UInt64) ([]string, error)
+		GetTagTree(ctx context.Context, userID utils.UInt64, entityType *EntityType) ([]*TagNode, error)
 
 		// -- 标脏接口
 
@@ -89,6 +101,8 @@ type (
 		InvalidateTagCache(ctx context.Context, tag string, propagate bool) error
 		InvalidateUserTagCache(ctx context.Context, userID utils.UInt64, tag string, propagate bool) error
 		InvalidateEntityCache(ctx context.Context, entityID utils.UInt64, propagate bool) error
+		InvalidateEntityTags(ctx context.Context, changes ...EntityTagChange[EntityType]) error
+		ClearEntityTags(ctx context.Context, changes ...EntityTagChange[EntityType]) error
 	}
 )
 
@@ -96,6 +110,8 @@ const (
 	EventInvalidUser   DirtyEvent = "dirty_user"
 	EventInvalidTag    DirtyEvent = "dirty_tag"
 	EventInvalidEntity DirtyEvent = "dirty_entity"
+	// EventInvalidEntityTags 精确清理一次标签变更涉及的缓存，见 InvalidateEntityTags
+	EventInvalidEntityTags DirtyEvent = "dirty_entity_tags"
 )
 
 var (
@@ -108,7 +124,8 @@ func NewTagService[EntityType any](
 	ctx context.Context,
 	repo TagRepository[EntityType],
 	supportedTypes []EntityType,
-	producer Producer, consumer Consumer[*redismq.Package],
+	producer Producer, consumer Consumer,
+	opts ...UpdateOption,
 ) *TagService[EntityType] {
 	svr := &TagService[EntityType]{repo: repo}
 	svr.Schemas = TagCKs[EntityType]{
@@ -118,7 +135,7 @@ func NewTagService[EntityType any](
 		Entities:    cachekey.MustNewSchema[ParamUserTagType[EntityType]]("users:{uid}:tags:{tag}:{entity_type}", TagCacheExpiration),
 	}
 	svr.supportedTypes = supportedTypes
-	svr.UpdateMgr = NewTagUpdateManager[EntityType](producer, consumer, svr.handleTagUpdateMessage).Start(ctx)
+	svr.UpdateMgr = NewTagUpdateManager[EntityType](producer, consumer, svr.handleTagUpdateMessage, opts...).Start(ctx)
 	return svr
 }
 
@@ -203,22 +220,72 @@ func (s *TagService[EntityType]) GetUsersByTag(ctx context.Context, tag string)
 	return users, nil
 }
 
+// GetEntities 获取打了 tag 或 tag 的任意子孙标签的 entities (如 lang/ja 会包含 lang/ja/kanji)
+// 结果由 user 的标签列表和各个标签精确匹配的缓存组合而成，因此只要这两类缓存正确，前缀查询就是正确的
 func (s *TagService[EntityType]) GetEntities(ctx context.Context, userID utils.UInt64, tag string, entityType *EntityType) ([]utils.UInt64, error) {
+	userTags, err := s.GetTagsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	subtree := SubtreeOf(userTags, tag)
+	if len(subtree) == 0 {
+		subtree = []string{tag} // 用户标签列表中没有该标签时，仍然按精确匹配查询一次
+	}
+
+	types := s.supportedTypes
 	if entityType != nil {
-		return s.getEntitiesByTagAndType(ctx, userID, tag, *entityType)
+		types = []EntityType{*entityType}
 	}
 
 	var allEntities []utils.UInt64
-	for _, et := range s.supportedTypes {
-		entities, err := s.getEntitiesByTagAndType(ctx, userID, tag, et)
-		if err != nil {
-			return nil, err
+	seen := make(map[utils.UInt64]struct{})
+	for _, et := range types {
+		for _, t := range subtree {
+			entities, err := s.getEntitiesByTagAndType(ctx, userID, t, et)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entities {
+				if _, ok := seen[e]; ok {
+					continue
+				}
+				seen[e] = struct{}{}
+				allEntities = append(allEntities, e)
+			}
 		}
-		allEntities = append(allEntities, entities...)
 	}
 	return allEntities, nil
 }
 
+// GetExactEntities 获取直接打了 tag 的 entities，不包含子孙标签
+func (s *TagService[EntityType]) GetExactEntities(ctx context.Context, userID utils.UInt64, tag string, entityType EntityType) ([]utils.UInt64, error) {
+	return s.getEntitiesByTagAndType(ctx, userID, tag, entityType)
+}
+
+// GetTagTree 获取用户的标签树，entityType 不为空时只统计该类型的 entities
+func (s *TagService[EntityType]) GetTagTree(ctx context.Context, userID utils.UInt64, entityType *EntityType) ([]*TagNode, error) {
+	userTags, err := s.GetTagsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	types := s.supportedTypes
+	if entityType != nil {
+		types = []EntityType{*entityType}
+	}
+
+	entitiesOfTag := make(map[string][]utils.UInt64, len(userTags))
+	for _, tag := range userTags {
+		for _, et := range types {
+			entities, err := s.getEntitiesByTagAndType(ctx, userID, tag, et)
+			if err != nil {
+				return nil, err
+			}
+			entitiesOfTag[tag] = append(entitiesOfTag[tag], entities...)
+		}
+	}
+	return BuildTagTree(entitiesOfTag), nil
+}
+
 func (s *TagService[EntityType]) getEntitiesByTagAndType(ctx context.Context, userID utils.UInt64, tag string, entityType EntityType) ([]utils.UInt64, error) {
 	ll, ctx := wlog.ByCtxAndCache(ctx, "getEntitiesByTagAndType")
 	log := ll.WithField("userID", userID).WithField("tag", tag).WithField("entityType", entityType)
@@ -451,6 +518,50 @@ func (s *TagService[EntityType]) InvalidateEntityCache(ctx context.Context, enti
 	return nil
 }
 
+// InvalidateEntityTags 清理一次标签变更涉及的所有缓存：entity 的标签、user 的标签、
+// user+tag+type 的 entities 以及 tag 的 users
+// 变更通常发生在事务中，提交前可能有并发读把旧数据重新写回缓存，因此除了立即清理外，
+// 还会通过 UpdateMgr 投递一条消息，在异步处理时再清理一次
+func (s *TagService[EntityType]) InvalidateEntityTags(ctx context.Context, changes ...EntityTagChange[EntityType]) error {
+	log := wlog.ByCtx(ctx, "InvalidateEntityTags")
+	if err := s.ClearEntityTags(ctx, changes...); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if err := s.UpdateMgr.Put(ctx, TagUpdateMessage[EntityType]{
+			Action:     EventInvalidEntityTags,
+			UserID:     change.UserID,
+			EntityID:   change.EntityID,
+			EntityType: change.EntityType,
+			TagList:    change.Tags,
+		}); err != nil {
+			log.Errorf("Failed to enqueue entity tags invalidation message: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ClearEntityTags 立即清理一次标签变更涉及的所有缓存，不投递消息。
+// 在事务中变更时，调用方需要在提交后再清理一次 (比如通过事务性的事件)，否则提交前的并发读可能把旧数据写回缓存
+func (s *TagService[EntityType]) ClearEntityTags(ctx context.Context, changes ...EntityTagChange[EntityType]) error {
+	keys := make(map[string]struct{})
+	for _, change := range changes {
+		keys[s.Schemas.Entity2Tags.MustBuild(change.EntityID)] = struct{}{}
+		keys[s.Schemas.User2Tags.MustBuild(change.UserID)] = struct{}{}
+		for _, tag := range change.Tags {
+			keys[s.Schemas.Tag2Users.MustBuild(tag)] = struct{}{}
+			keys[s.Schemas.Entities.MustBuild(ParamUserTagType[EntityType]{UserID: change.UserID, Tag: tag, Type: change.EntityType})] = struct{}{}
+		}
+	}
+	for key := range keys {
+		if err := cache.SET().Clear(ctx, key, MaxRetryAttempts); err != nil {
+			return irr.Wrap(err, "failed to clear cache, key= %s", key)
+		}
+	}
+	return nil
+}
+
 // handleTagUpdateMessage handles a tag update message.
 func (s *TagService[EntityType]) handleTagUpdateMessage(ctx context.Context, message TagUpdateMessage[EntityType]) error {
 	switch message.Action {
@@ -460,6 +571,13 @@ func (s *TagService[EntityType]) handleTagUpdateMessage(ctx context.Context, mes
 		return s.InvalidateTagCache(ctx, message.Tag, false)
 	case EventInvalidEntity:
 		return s.InvalidateEntityCache(ctx, message.EntityID, false)
+	case EventInvalidEntityTags:
+		return s.ClearEntityTags(ctx, EntityTagChange[EntityType]{
+			UserID:     message.UserID,
+			EntityID:   message.EntityID,
+			EntityType: message.EntityType,
+			Tags:       message.TagList,
+		})
 	default:
 		return irr.Trace("unknown action: %v", message.Action)
 	}
@@ -0,0 +1,215 @@
+package tags
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/bagaking/memorianexus/pkg/search"
+)
+
+const (
+	// 推荐分数中各项信号的权重，总和为 1
+	suggestWeightContent = 0.5
+	suggestWeightCooccur = 0.3
+	suggestWeightName    = 0.2
+
+	// MinSuggestScore 低于该分数的标签不推荐
+	MinSuggestScore = 0.05
+)
+
+type (
+	// TagProfile 用户标签的统计信息，用于根据内容推荐标签:
+	//   - 标签下已有内容的词项分布，用于计算新内容与标签的词项重合度
+	//   - 标签之间的共现次数，用于根据已选标签推荐相关标签
+	// 分词与全文搜索一致 (见 search.Tokenize)，CJK 文本按二元组切分
+	TagProfile struct {
+		vocabulary []string
+		docs       map[string]int            // tag -> 打了该标签的 entity 数
+		textDocs   map[string]int            // tag -> 打了该标签且有内容的 entity 数
+		termDocs   map[string]map[string]int // tag -> term -> 该标签下包含该词项的 entity 数
+		termDF     map[string]int            // term -> 包含该词项的 entity 数
+		totalText  int                       // 有内容的 entity 数
+		cooccur    map[string]map[string]int // tag -> tag -> 同时打了两个标签的 entity 数
+	}
+
+	// TagSuggestion 推荐的标签，Score 在 [0, 1] 之间，各项信号也归一化到 [0, 1]
+	TagSuggestion struct {
+		Tag     string  `json:"tag"`
+		Score   float64 `json:"score"`
+		Content float64 `json:"content"` // 与该标签下已有内容的词项重合度
+		Cooccur float64 `json:"cooccur"` // 与已选标签的共现程度
+		Name    float64 `json:"name"`    // 标签名 (最后一级) 在内容中出现的程度
+	}
+)
+
+// NewTagProfile 以用户的标签列表为候选创建 TagProfile，统计数据通过 Add 添加
+func NewTagProfile(vocabulary []string) *TagProfile {
+	return &TagProfile{
+		vocabulary: vocabulary,
+		docs:       make(map[string]int),
+		textDocs:   make(map[string]int),
+		termDocs:   make(map[string]map[string]int),
+		termDF:     make(map[string]int),
+		cooccur:    make(map[string]map[string]int),
+	}
+}
+
+// Add 统计一个 entity 的标签和内容，没有文本内容的 entity (如 book) content 传空即可
+func (p *TagProfile) Add(entityTags []string, content string) {
+	entityTags = uniqueStrings(entityTags)
+	for i, a := range entityTags {
+		p.docs[a]++
+		for _, b := range entityTags[i+1:] {
+			p.addCooccur(a, b)
+			p.addCooccur(b, a)
+		}
+	}
+
+	terms := search.Terms(content, search.ModeQuery)
+	if len(terms) == 0 {
+		return
+	}
+	p.totalText++
+	for _, term := range terms {
+		p.termDF[term]++
+	}
+	for _, tag := range entityTags {
+		p.textDocs[tag]++
+		m, ok := p.termDocs[tag]
+		if !ok {
+			m = make(map[string]int)
+			p.termDocs[tag] = m
+		}
+		for _, term := range terms {
+			m[term]++
+		}
+	}
+}
+
+func (p *TagProfile) addCooccur(a, b string) {
+	m, ok := p.cooccur[a]
+	if !ok {
+		m = make(map[string]int)
+		p.cooccur[a] = m
+	}
+	m[b]++
+}
+
+// Suggest 为内容推荐最多 limit 个标签，按分数从高到低排序，chosen 为已经选择的标签，不会被推荐
+func (p *TagProfile) Suggest(content string, chosen []string, limit int) []*TagSuggestion {
+	terms := search.Terms(content, search.ModeQuery)
+	// 标签名通常很短，匹配时额外使用单字，保证单字的标签名也能命中
+	indexTerms := search.Terms(content, search.ModeIndex)
+	termSet := make(map[string]struct{}, len(indexTerms))
+	for _, term := range indexTerms {
+		termSet[term] = struct{}{}
+	}
+	chosenSet := make(map[string]struct{}, len(chosen))
+	for _, tag := range chosen {
+		chosenSet[tag] = struct{}{}
+	}
+
+	candidates := make([]*TagSuggestion, 0, len(p.vocabulary))
+	maxContent := 0.0
+	for _, tag := range p.vocabulary {
+		if _, ok := chosenSet[tag]; ok {
+			continue
+		}
+		s := &TagSuggestion{
+			Tag:     tag,
+			Content: p.contentScore(tag, terms),
+			Cooccur: p.cooccurScore(tag, chosen),
+			Name:    nameScore(tag, termSet),
+		}
+		maxContent = math.Max(maxContent, s.Content)
+		candidates = append(candidates, s)
+	}
+
+	ret := make([]*TagSuggestion, 0, len(candidates))
+	for _, s := range candidates {
+		if maxContent > 0 {
+			s.Content /= maxContent // 重合度只在候选之间比较，归一化到 [0, 1]
+		}
+		s.Score = suggestWeightContent*s.Content + suggestWeightCooccur*s.Cooccur + suggestWeightName*s.Name
+		if s.Score < MinSuggestScore {
+			continue
+		}
+		s.Content, s.Cooccur, s.Name, s.Score = round(s.Content), round(s.Cooccur), round(s.Name), round(s.Score)
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Score != ret[j].Score {
+			return ret[i].Score > ret[j].Score
+		}
+		return ret[i].Tag < ret[j].Tag
+	})
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret
+}
+
+// contentScore 内容中每个词项在该标签下出现的比例按 idf 加权求和，再按词项数归一化
+func (p *TagProfile) contentScore(tag string, terms []string) float64 {
+	docs := p.textDocs[tag]
+	if docs == 0 || len(terms) == 0 {
+		return 0
+	}
+	termDocs := p.termDocs[tag]
+	score := 0.0
+	for _, term := range terms {
+		if n := termDocs[term]; n > 0 {
+			idf := math.Log(1 + float64(p.totalText)/float64(p.termDF[term]))
+			score += float64(n) / float64(docs) * idf
+		}
+	}
+	return score / float64(len(terms))
+}
+
+// cooccurScore 已选标签中，同时打了该标签的比例的最大值
+func (p *TagProfile) cooccurScore(tag string, chosen []string) float64 {
+	score := 0.0
+	for _, c := range chosen {
+		if docs := p.docs[c]; docs > 0 {
+			score = math.Max(score, float64(p.cooccur[c][tag])/float64(docs))
+		}
+	}
+	return score
+}
+
+// nameScore 标签最后一级名称的词项在内容中出现的比例
+func nameScore(tag string, termSet map[string]struct{}) float64 {
+	name := tag
+	if i := strings.LastIndex(tag, PathSeparator); i >= 0 {
+		name = tag[i+len(PathSeparator):]
+	}
+	nameTerms := search.Terms(name, search.ModeQuery)
+	if len(nameTerms) == 0 {
+		return 0
+	}
+	hit := 0
+	for _, term := range nameTerms {
+		if _, ok := termSet[term]; ok {
+			hit++
+		}
+	}
+	return float64(hit) / float64(len(nameTerms))
+}
+
+func uniqueStrings(lst []string) []string {
+	seen := make(map[string]struct{}, len(lst))
+	ret := make([]string, 0, len(lst))
+	for _, s := range lst {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func round(f float64) float64 {
+	return math.Round(f*1e4) / 1e4
+}
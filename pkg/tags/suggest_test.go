@@ -0,0 +1,84 @@
+package tags_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/pkg/tags"
+)
+
+func newTestProfile() *tags.TagProfile {
+	profile := tags.NewTagProfile([]string{"lang/go", "lang/go/concurrency", "database", "记忆", "unused"})
+	profile.Add([]string{"lang/go", "lang/go/concurrency"}, "goroutine and channel make concurrency easy")
+	profile.Add([]string{"lang/go", "lang/go/concurrency"}, "select statement waits on channel operations")
+	profile.Add([]string{"lang/go"}, "interface and struct embedding")
+	profile.Add([]string{"database"}, "index makes query fast")
+	profile.Add([]string{"记忆"}, "间隔重复可以对抗遗忘曲线")
+	return profile
+}
+
+func tagsOf(suggestions []*tags.TagSuggestion) []string {
+	ret := make([]string, 0, len(suggestions))
+	for _, s := range suggestions {
+		ret = append(ret, s.Tag)
+	}
+	return ret
+}
+
+func TestTagProfile_Suggest_ContentOverlap(t *testing.T) {
+	profile := newTestProfile()
+
+	suggestions := profile.Suggest("buffered channel with goroutine", nil, 0)
+	require.NotEmpty(t, suggestions)
+	assert.Equal(t, "lang/go/concurrency", suggestions[0].Tag)
+	assert.Equal(t, 1.0, suggestions[0].Content)
+	assert.NotContains(t, tagsOf(suggestions), "database")
+	assert.NotContains(t, tagsOf(suggestions), "unused")
+	for i := 1; i < len(suggestions); i++ {
+		assert.GreaterOrEqual(t, suggestions[i-1].Score, suggestions[i].Score)
+	}
+
+	// CJK 内容按二元组匹配
+	suggestions = profile.Suggest("遗忘曲线", nil, 0)
+	require.NotEmpty(t, suggestions)
+	assert.Equal(t, "记忆", suggestions[0].Tag)
+}
+
+func TestTagProfile_Suggest_Cooccur(t *testing.T) {
+	profile := newTestProfile()
+
+	// 内容没有任何线索时，根据已选标签推荐经常一起出现的标签
+	suggestions := profile.Suggest("something unrelated", []string{"lang/go/concurrency"}, 0)
+	require.Len(t, suggestions, 1)
+	assert.Equal(t, "lang/go", suggestions[0].Tag)
+	assert.Equal(t, 1.0, suggestions[0].Cooccur)
+	assert.Zero(t, suggestions[0].Content)
+}
+
+func TestTagProfile_Suggest_Name(t *testing.T) {
+	profile := newTestProfile()
+
+	suggestions := profile.Suggest("how to design a database schema", nil, 0)
+	require.NotEmpty(t, suggestions)
+	assert.Equal(t, "database", suggestions[0].Tag)
+	assert.Equal(t, 1.0, suggestions[0].Name)
+
+	// 没有统计数据的标签也可以通过标签名命中
+	suggestions = profile.Suggest("this tag is unused", nil, 0)
+	assert.Equal(t, []string{"unused"}, tagsOf(suggestions))
+}
+
+func TestTagProfile_Suggest_ChosenAndLimit(t *testing.T) {
+	profile := newTestProfile()
+
+	suggestions := profile.Suggest("goroutine channel concurrency in go", []string{"lang/go/concurrency"}, 0)
+	assert.NotContains(t, tagsOf(suggestions), "lang/go/concurrency")
+	assert.Contains(t, tagsOf(suggestions), "lang/go")
+
+	suggestions = profile.Suggest("goroutine channel database index", nil, 1)
+	assert.Len(t, suggestions, 1)
+
+	assert.Empty(t, tags.NewTagProfile(nil).Suggest("anything", nil, 5))
+}
@@ -8,7 +8,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/adjust/redismq"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/internal/utils/cache"
@@ -26,54 +25,6 @@ const (
 	EntityTypeComment
 )
 
-// MockMQ 是 Producer 和 Consumer 接口的模拟实现
-type MockMQ struct {
-	lst []string
-}
-
-func (m *MockMQ) Put(ctx context.Context, payload string) error {
-	m.lst = append(m.lst, payload)
-	return nil
-}
-
-func (m *MockMQ) Get(ctx context.Context) (*redismq.Package, error) {
-	if len(m.lst) == 0 {
-		return nil, nil
-	}
-	msg := m.lst[0]
-	m.lst = m.lst[1:]
-	return &redismq.Package{Payload: msg}, nil
-}
-
-func (m *MockMQ) MGet(ctx context.Context, count int) ([]*redismq.Package, error) {
-	if len(m.lst) == 0 {
-		return []*redismq.Package{}, nil
-	}
-	var ret []string
-	if count >= len(m.lst) {
-		ret, m.lst = m.lst, []string{}
-	} else {
-		ret, m.lst = m.lst[0:count], m.lst[count:]
-	}
-	return typer.SliceMap(ret, func(s string) *redismq.Package {
-		return &redismq.Package{Payload: s}
-	}), nil
-}
-
-func (m *MockMQ) Ack(ctx context.Context, pkg *redismq.Package) error {
-	return nil
-}
-
-func (m *MockMQ) Fail(ctx context.Context, pkg *redismq.Package) error {
-	m.lst = append(m.lst, pkg.Payload)
-	return nil
-}
-
-func (m *MockMQ) Requeue(ctx context.Context, pkg *redismq.Package) error {
-	m.lst = append(m.lst, pkg.Payload)
-	return nil
-}
-
 // MockTagRepository 是 TagRepository 接口的模拟实现
 type MockTagRepository struct {
 	tagsByUser    map[utils.UInt64][]string
@@ -122,13 +73,15 @@ func (m *MockTagRepository) GetEntitiesByTag(ctx context.Context, userID utils.U
 	return nil, nil
 }
 
+var redisServer *miniredis.Miniredis
+
 func TestMain(m *testing.M) {
-	redisServer, err := miniredis.Run()
+	var err error
+	redisServer, err = miniredis.Run()
 	if err != nil {
 		panic(fmt.Sprintf("Failed to start miniredis: %v", err))
 	}
 
-	defer redisServer.Close()
 	fmt.Println("Redis server started at", redisServer.Addr())
 	// 初始化缓存
 	cache.Init(redisServer.Addr())
@@ -137,12 +90,20 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 
 	// 退出测试
+	redisServer.Close()
 	os.Exit(code)
 }
 
+// newTestQueue 清空 miniredis 并创建一个进程内队列，保证每个用例从空缓存开始
+func newTestQueue(t *testing.T) *tags.ChanQueue {
+	t.Helper()
+	redisServer.FlushAll()
+	return tags.NewChanQueue(64, time.Minute)
+}
+
 // 测试 TagUpdateManager 的启动和停止
 func TestTagUpdateManager_StartStop(t *testing.T) {
-	mq := new(MockMQ)
+	mq := newTestQueue(t)
 	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
 		return nil
 	})
@@ -164,7 +125,7 @@ func TestTagUpdateManager_StartStop(t *testing.T) {
 
 // 测试 TagUpdateManager 的 Put 方法
 func TestTagUpdateManager_Put(t *testing.T) {
-	mq := new(MockMQ)
+	mq := newTestQueue(t)
 	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
 		return nil
 	})
@@ -173,12 +134,12 @@ func TestTagUpdateManager_Put(t *testing.T) {
 	message := tags.TagUpdateMessage[EntityType]{Action: tags.EventInvalidUser, UserID: 12345}
 	err := manager.Put(ctx, message)
 	assert.NoError(t, err)
-	assert.NotEmpty(t, mq.lst)
+	assert.Equal(t, 1, mq.Len())
 }
 
-// 测试 TagUpdateManager 的 HandlePackage 方法
-func TestTagUpdateManager_HandlePackage(t *testing.T) {
-	mq := new(MockMQ)
+// 测试 TagUpdateManager 的 HandleMessage 方法
+func TestTagUpdateManager_HandleMessage(t *testing.T) {
+	mq := newTestQueue(t)
 	manager := tags.NewTagUpdateManager(mq, mq, func(ctx context.Context, message tags.TagUpdateMessage[EntityType]) error {
 		return nil
 	})
@@ -186,18 +147,24 @@ func TestTagUpdateManager_HandlePackage(t *testing.T) {
 	ctx := context.TODO()
 	message := tags.TagUpdateMessage[EntityType]{Action: tags.EventInvalidUser, UserID: 12345}
 	payload, _ := json.Marshal(message)
-	pkg := &redismq.Package{Payload: string(payload)}
+	assert.NoError(t, mq.Put(ctx, string(payload)))
+	msg, err := mq.Get(ctx)
+	assert.NoError(t, err)
 
-	err := manager.HandlePackage(ctx, mq, pkg)
+	err = manager.HandleMessage(ctx, mq, msg)
 	assert.NoError(t, err)
-	assert.Empty(t, mq.lst)
+	assert.Zero(t, mq.Len())
+	assert.Empty(t, mq.Failed())
+
+	// 已经确认的消息不能再次确认
+	assert.Error(t, mq.Ack(ctx, msg))
 }
 
 // 测试 TagService 的 GetTagsByUser 方法
 func TestTagService_GetTagsByUser(t *testing.T) {
 	repo := NewMockTagRepository()
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
@@ -210,21 +177,21 @@ func TestTagService_GetTagsByUser(t *testing.T) {
 	// 设置缓存
 	tags, err = service.GetTagsByUser(ctx, 12345)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 
 	time.Sleep(time.Second)
 
 	// 验证缓存是否存在
 	tags, err = cache.SET().GetAll(ctx, cacheKey)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 }
 
 // 测试 TagService 的 InvalidateUserCache 方法
 func TestTagService_InvalidateUserCache(t *testing.T) {
 	repo := NewMockTagRepository()
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
@@ -237,12 +204,12 @@ func TestTagService_InvalidateUserCache(t *testing.T) {
 	// 设置缓存
 	tags, err = service.GetTagsByUser(ctx, 12345)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 
 	// 验证缓存是否存在
 	tags, err = cache.SET().GetAll(ctx, cacheKey)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 
 	// 调用 InvalidateUserCache 方法
 	err = service.InvalidateUserCache(ctx, 12345, true)
@@ -258,8 +225,8 @@ func TestTagService_InvalidateUserCache(t *testing.T) {
 func TestTagService_InvalidateTagCache(t *testing.T) {
 	repo := NewMockTagRepository()
 	repo.usersByTag["tag1"] = []utils.UInt64{12345, 67890}
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
@@ -272,12 +239,12 @@ func TestTagService_InvalidateTagCache(t *testing.T) {
 	// 设置缓存
 	users, err = service.GetUsersByTag(ctx, "tag1")
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{12345, 67890}, users)
+	assert.ElementsMatch(t, []utils.UInt64{12345, 67890}, users)
 
 	// 验证缓存是否存在
 	users, err = cache.SET().GetAllUInt64s(ctx, cacheKey)
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{12345, 67890}, users)
+	assert.ElementsMatch(t, []utils.UInt64{12345, 67890}, users)
 
 	// 调用 InvalidateTagCache 方法
 	err = service.InvalidateTagCache(ctx, "tag1", true)
@@ -292,8 +259,8 @@ func TestTagService_InvalidateTagCache(t *testing.T) {
 // 测试 TagService 的 InvalidateUserTagCache 方法
 func TestTagService_InvalidateUserTagCache(t *testing.T) {
 	repo := NewMockTagRepository()
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
@@ -306,12 +273,12 @@ func TestTagService_InvalidateUserTagCache(t *testing.T) {
 	// 设置缓存
 	entities, err = service.GetEntities(ctx, 12345, "tag1", nil)
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{100001, 100002}, entities)
+	assert.ElementsMatch(t, []utils.UInt64{100001, 100002}, entities)
 
 	// 验证缓存是否存在
 	entities, err = cache.SET().GetAllUInt64s(ctx, cacheKey)
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{100001, 100002}, entities)
+	assert.ElementsMatch(t, []utils.UInt64{100001, 100002}, entities)
 
 	// 调用 InvalidateUserTagCache 方法
 	err = service.InvalidateUserTagCache(ctx, 12345, "tag1", true)
@@ -327,8 +294,8 @@ func TestTagService_InvalidateUserTagCache(t *testing.T) {
 func TestTagService_InvalidateEntityCache(t *testing.T) {
 	repo := NewMockTagRepository()
 	repo.tagsByEntity[12345] = []string{"tag1", "tag2"}
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
@@ -341,12 +308,12 @@ func TestTagService_InvalidateEntityCache(t *testing.T) {
 	// 设置缓存
 	tags, err = service.GetTagsOfEntity(ctx, 12345)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 
 	// 验证缓存是否存在
 	tags, err = cache.SET().GetAll(ctx, cacheKey)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 
 	// 调用 InvalidateEntityCache 方法
 	err = service.InvalidateEntityCache(ctx, 12345, true)
@@ -362,8 +329,8 @@ func TestTagService_InvalidateEntityCache(t *testing.T) {
 func TestTagService_GetUsersByTag(t *testing.T) {
 	repo := NewMockTagRepository()
 	repo.usersByTag["tag1"] = []utils.UInt64{12345, 67890}
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
@@ -376,46 +343,55 @@ func TestTagService_GetUsersByTag(t *testing.T) {
 	// 设置缓存
 	users, err = service.GetUsersByTag(ctx, "tag1")
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{12345, 67890}, users)
+	assert.ElementsMatch(t, []utils.UInt64{12345, 67890}, users)
 
 	// 验证缓存是否存在
 	users, err = cache.SET().GetAllUInt64s(ctx, cacheKey)
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{12345, 67890}, users)
+	assert.ElementsMatch(t, []utils.UInt64{12345, 67890}, users)
 }
 
 // 测试 TagService 的 GetEntities 方法
 func TestTagService_GetEntities(t *testing.T) {
 	repo := NewMockTagRepository()
 	repo.entitiesByTag["tag1"] = map[EntityType][]utils.UInt64{EntityTypeBlock: {100001, 100002}, EntityTypePost: {200001}}
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
-	// 验证缓存不存在
-	cacheKey := service.Schemas.Entities.MustBuild(tags.ParamUserTagType[EntityType]{UserID: 12345, Tag: "tag1"})
-	entities, err := cache.SET().GetAllUInt64s(ctx, cacheKey)
+	// 验证缓存不存在，缓存按 entity 类型分开存放
+	blockKey := service.Schemas.Entities.MustBuild(tags.ParamUserTagType[EntityType]{UserID: 12345, Tag: "tag1", Type: EntityTypeBlock})
+	postKey := service.Schemas.Entities.MustBuild(tags.ParamUserTagType[EntityType]{UserID: 12345, Tag: "tag1", Type: EntityTypePost})
+	entities, err := cache.SET().GetAllUInt64s(ctx, blockKey)
 	assert.NoError(t, err)
 	assert.Empty(t, entities)
 
-	// 设置缓存
+	// 设置缓存，不指定类型时返回所有支持类型的 entities
 	entities, err = service.GetEntities(ctx, 12345, "tag1", nil)
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{100001, 100002, 200001}, entities)
+	assert.ElementsMatch(t, []utils.UInt64{100001, 100002, 200001}, entities)
 
 	// 验证缓存是否存在
-	entities, err = cache.SET().GetAllUInt64s(ctx, cacheKey)
+	entities, err = cache.SET().GetAllUInt64s(ctx, blockKey)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []utils.UInt64{100001, 100002}, entities)
+	entities, err = cache.SET().GetAllUInt64s(ctx, postKey)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []utils.UInt64{200001}, entities)
+
+	// 指定类型时只返回该类型的 entities
+	entities, err = service.GetEntities(ctx, 12345, "tag1", typer.Ptr(EntityTypePost))
 	assert.NoError(t, err)
-	assert.Equal(t, []utils.UInt64{100001, 100002, 200001}, entities)
+	assert.ElementsMatch(t, []utils.UInt64{200001}, entities)
 }
 
 // 测试 TagService 的 GetTagsOfEntity 方法
 func TestTagService_GetTagsOfEntity(t *testing.T) {
 	repo := NewMockTagRepository()
 	repo.tagsByEntity[12345] = []string{"tag1", "tag2"}
-	mq := new(MockMQ)
-	service := tags.NewTagService(repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
+	mq := newTestQueue(t)
+	service := tags.NewTagService(context.TODO(), repo, []EntityType{EntityTypeBlock, EntityTypePost}, mq, mq)
 
 	ctx := context.TODO()
 
@@ -428,10 +404,10 @@ func TestTagService_GetTagsOfEntity(t *testing.T) {
 	// 设置缓存
 	tags, err = service.GetTagsOfEntity(ctx, 12345)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 
 	// 验证缓存是否存在
 	tags, err = cache.SET().GetAll(ctx, cacheKey)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"tag1", "tag2"}, tags)
+	assert.ElementsMatch(t, []string{"tag1", "tag2"}, tags)
 }
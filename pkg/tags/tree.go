@@ -0,0 +1,67 @@
+package tags
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+// TagNode 标签树的节点
+type TagNode struct {
+	Name string `json:"name"` // 当前层级的名字
+	Path string `json:"path"` // 完整路径
+	// Count 直接打上该标签的 entity 数
+	Count int `json:"count"`
+	// Total 子树 (包括自身) 中不重复的 entity 数
+	Total    int        `json:"total"`
+	Children []*TagNode `json:"children,omitempty"`
+
+	entities map[utils.UInt64]struct{}
+}
+
+// BuildTagTree 根据每个标签直接关联的 entities 构建标签树
+// 即使中间层级没有被直接使用 (如只有 lang/ja/kanji)，也会生成对应的节点 (lang、lang/ja)
+func BuildTagTree(entitiesOfTag map[string][]utils.UInt64) []*TagNode {
+	root := &TagNode{entities: make(map[utils.UInt64]struct{})}
+	nodes := map[string]*TagNode{"": root}
+
+	var ensure func(path string) *TagNode
+	ensure = func(path string) *TagNode {
+		if n, ok := nodes[path]; ok {
+			return n
+		}
+		parentPath, name := "", path
+		if i := strings.LastIndex(path, PathSeparator); i >= 0 {
+			parentPath, name = path[:i], path[i+1:]
+		}
+		parent := ensure(parentPath)
+		n := &TagNode{Name: name, Path: path, entities: make(map[utils.UInt64]struct{})}
+		parent.Children = append(parent.Children, n)
+		nodes[path] = n
+		return n
+	}
+
+	for tag, entities := range entitiesOfTag {
+		n := ensure(tag)
+		for _, e := range entities {
+			n.entities[e] = struct{}{}
+		}
+		n.Count = len(n.entities)
+	}
+
+	var fill func(n *TagNode) map[utils.UInt64]struct{}
+	fill = func(n *TagNode) map[utils.UInt64]struct{} {
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+		all := n.entities
+		for _, child := range n.Children {
+			for e := range fill(child) {
+				all[e] = struct{}{}
+			}
+		}
+		n.Total = len(all)
+		return all
+	}
+	fill(root)
+	return root.Children
+}
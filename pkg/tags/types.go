@@ -18,19 +18,43 @@ type (
 		GetEntitiesByTag(ctx context.Context, userID utils.UInt64, tag string, entityType EntityType) ([]utils.UInt64, error)
 	}
 
+	// Message 队列中的一条消息，与具体的传输实现 (channel、Redis Streams 等) 无关
+	Message struct {
+		ID      string // 传输层分配的消息 id，在同一个队列中唯一
+		Payload string
+	}
+
 	// Producer defines the interface for a message producer.
 	Producer interface {
 		Put(ctx context.Context, payload string) error
 	}
 
 	// Consumer defines the interface for a message consumer.
-	Consumer[MessageType any] interface {
-		Get(ctx context.Context) (MessageType, error)
-		MGet(ctx context.Context, count int) ([]MessageType, error)
-		GetUnacked(ctx context.Context) (MessageType, error)
-
-		Ack(ctx context.Context, pkg MessageType) error
-		Fail(ctx context.Context, pkg MessageType) error
-		Requeue(ctx context.Context, pkg MessageType) error
+	// 取到的消息需要通过 Ack、Fail 或 Requeue 之一确认，否则会在超时后被 GetUnacked 重新取回
+	Consumer interface {
+		// Get 取一条消息，队列为空时返回 nil, nil
+		Get(ctx context.Context) (*Message, error)
+		// MGet 最多取 count 条消息，队列为空时返回空列表
+		MGet(ctx context.Context, count int) ([]*Message, error)
+		// GetUnacked 取回一条投递后长时间未确认的消息 (比如消费者在处理中途退出)，没有时返回 nil, nil
+		GetUnacked(ctx context.Context) (*Message, error)
+
+		// Ack 确认消息处理成功
+		Ack(ctx context.Context, msg *Message) error
+		// Fail 确认消息处理失败，消息不会再被投递
+		Fail(ctx context.Context, msg *Message) error
+		// Requeue 把消息放回队列，稍后重新投递
+		Requeue(ctx context.Context, msg *Message) error
+
+		// Touch 重新计算已投递消息的确认超时，消费者暂存的消息因此不会被 GetUnacked 取回
+		Touch(ctx context.Context, messages ...*Message) error
+		// Backlog 统计队列中积压的消息数
+		Backlog(ctx context.Context) (Backlog, error)
+	}
+
+	// Backlog 队列中还没有被确认的消息数
+	Backlog struct {
+		Undelivered int64 // 还没有投递给任何消费者的消息数
+		Pending     int64 // 已投递但还没有确认的消息数，包括消费者暂存等待重试的消息
 	}
 )
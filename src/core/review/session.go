@@ -1,6 +1,189 @@
 // Package review provides review session management logic.
-//
-// This file was generated by setup_project.sh script.
 package review
 
-// TODO: Implement review session management logic.
+import (
+	"context"
+	"time"
+
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// DefaultRelearnGap 答错的 monster 在之后再作答多少次后重新出现
+const DefaultRelearnGap = 3
+
+var (
+	ErrNotCurrent    = irr.Error("monster is not the current one of the session")
+	ErrInvalidResult = irr.Error("invalid attack result")
+)
+
+type (
+	// Engine 复习会话读取和修改复习计划的操作，由具体的复习计划实现
+	Engine interface {
+		// Due 返回当前到期的 monsters，按复习的优先级排列。每次调用都应该反映最新的复习状态
+		Due(ctx context.Context, limit int) ([]model.DungeonMonster, error)
+		// Monster 获取 monster 的最新状态
+		Monster(ctx context.Context, itemID utils.UInt64) (*model.DungeonMonster, error)
+		// Apply 应用一次作答
+		Apply(ctx context.Context, dm *model.DungeonMonster, answer Answer) (*Grade, error)
+	}
+
+	// Answer 会话中的一次作答
+	Answer struct {
+		Seq          int // 会话中的序号，从 1 开始
+		Result       def.AttackResult
+		At           time.Time
+		ResponseTime time.Duration // 从下发 monster 到收到作答的时间
+	}
+
+	// Grade 作答的评分
+	Grade struct {
+		Seq               int
+		ItemID            utils.UInt64
+		Result            def.AttackResult
+		FamiliarityBefore utils.Percentage
+		FamiliarityAfter  utils.Percentage
+		NextPracticeAt    time.Time
+		Cash              utils.UInt64
+		ResponseTime      time.Duration
+		Relearn           bool // 答错了，会在会话中再次出现
+	}
+
+	// Summary 会话的统计
+	Summary struct {
+		Answered        int
+		Failed          int
+		Cash            utils.UInt64
+		FamiliarityGain int
+		ResponseTime    time.Duration
+	}
+
+	// Session 一次复习会话: 每次下发一个 monster，收到作答后立即评分，下一个 monster 根据更新后的状态选择。
+	// 答错的 monster 在之后再作答 RelearnGap 次后重新出现，没有其他到期的 monster 时立即出现。
+	// Session 不是并发安全的，由传输层 (如 WebSocket 连接) 顺序调用
+	Session struct {
+		RelearnGap int
+
+		engine  Engine
+		now     func() time.Time
+		current *model.DungeonMonster
+		shownAt time.Time
+		relearn []relearnCard
+		summary Summary
+	}
+
+	relearnCard struct {
+		itemID utils.UInt64
+		dueSeq int // 作答次数达到 dueSeq 后重新出现
+	}
+)
+
+// NewSession 创建复习会话
+func NewSession(engine Engine) *Session {
+	return &Session{
+		RelearnGap: DefaultRelearnGap,
+		engine:     engine,
+		now:        time.Now,
+	}
+}
+
+// Current 当前等待作答的 monster
+func (s *Session) Current() *model.DungeonMonster {
+	return s.current
+}
+
+// Summary 会话到目前为止的统计
+func (s *Session) Summary() Summary {
+	return s.summary
+}
+
+// Next 选择下一个 monster，当前的 monster 还没有作答时返回当前的。没有可以复习的 monster 时返回 nil
+func (s *Session) Next(ctx context.Context) (*model.DungeonMonster, error) {
+	if s.current != nil {
+		return s.current, nil
+	}
+
+	itemID, ok := s.popRelearn(false)
+	if !ok {
+		due, err := s.engine.Due(ctx, 1)
+		if err != nil {
+			return nil, irr.Wrap(err, "get due monsters failed")
+		}
+		if len(due) > 0 {
+			s.removeRelearn(due[0].ItemID)
+			return s.show(&due[0]), nil
+		}
+		// 没有其他到期的 monsters 时不再等待间隔
+		if itemID, ok = s.popRelearn(true); !ok {
+			return nil, nil
+		}
+	}
+
+	dm, err := s.engine.Monster(ctx, itemID)
+	if err != nil {
+		return nil, irr.Wrap(err, "get monster %d failed", itemID)
+	}
+	return s.show(dm), nil
+}
+
+// Answer 对当前的 monster 作答，作答成功后可以通过 Next 获取下一个
+func (s *Session) Answer(ctx context.Context, itemID utils.UInt64, result def.AttackResult) (*Grade, error) {
+	if s.current == nil || s.current.ItemID != itemID {
+		return nil, irr.Wrap(ErrNotCurrent, "item %d", itemID)
+	}
+	if result.DamageRate() <= 0 {
+		return nil, irr.Wrap(ErrInvalidResult, "result %q", result)
+	}
+
+	now := s.now()
+	answer := Answer{
+		Seq:          s.summary.Answered + 1,
+		Result:       result,
+		At:           now,
+		ResponseTime: now.Sub(s.shownAt),
+	}
+	grade, err := s.engine.Apply(ctx, s.current, answer)
+	if err != nil {
+		return nil, irr.Wrap(err, "apply answer of item %d failed", itemID)
+	}
+	grade.Seq, grade.ResponseTime = answer.Seq, answer.ResponseTime
+
+	s.summary.Answered++
+	s.summary.Cash += grade.Cash
+	s.summary.FamiliarityGain += int(grade.FamiliarityAfter) - int(grade.FamiliarityBefore)
+	s.summary.ResponseTime += answer.ResponseTime
+	if result.Failed() {
+		s.summary.Failed++
+		s.relearn = append(s.relearn, relearnCard{itemID: itemID, dueSeq: answer.Seq + s.RelearnGap})
+		grade.Relearn = true
+	}
+	s.current = nil
+	return grade, nil
+}
+
+func (s *Session) show(dm *model.DungeonMonster) *model.DungeonMonster {
+	s.current, s.shownAt = dm, s.now()
+	return dm
+}
+
+// popRelearn 取出最早到期的答错的 monster，force 为 true 时不检查是否到期
+func (s *Session) popRelearn(force bool) (utils.UInt64, bool) {
+	if len(s.relearn) == 0 || (!force && s.relearn[0].dueSeq > s.summary.Answered) {
+		return 0, false
+	}
+	card := s.relearn[0]
+	s.relearn = s.relearn[1:]
+	return card.itemID, true
+}
+
+func (s *Session) removeRelearn(itemID utils.UInt64) {
+	for i, card := range s.relearn {
+		if card.itemID == itemID {
+			s.relearn = append(s.relearn[:i], s.relearn[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package review
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// fakeEngine 按顺序返回到期的 monsters，作答后的 monster 不再到期
+type fakeEngine struct {
+	due     []utils.UInt64
+	applied []Answer
+}
+
+func (e *fakeEngine) Due(ctx context.Context, limit int) ([]model.DungeonMonster, error) {
+	ret := make([]model.DungeonMonster, 0, limit)
+	for _, id := range e.due {
+		if len(ret) == limit {
+			break
+		}
+		ret = append(ret, model.DungeonMonster{ItemID: id})
+	}
+	return ret, nil
+}
+
+func (e *fakeEngine) Monster(ctx context.Context, itemID utils.UInt64) (*model.DungeonMonster, error) {
+	return &model.DungeonMonster{ItemID: itemID, Familiarity: 10}, nil
+}
+
+func (e *fakeEngine) Apply(ctx context.Context, dm *model.DungeonMonster, answer Answer) (*Grade, error) {
+	for i, id := range e.due {
+		if id == dm.ItemID {
+			e.due = append(e.due[:i], e.due[i+1:]...)
+			break
+		}
+	}
+	e.applied = append(e.applied, answer)
+	return &Grade{ItemID: dm.ItemID, FamiliarityBefore: dm.Familiarity, FamiliarityAfter: dm.Familiarity + 5, Cash: 10}, nil
+}
+
+func TestSession_FailedMonsterReappears(t *testing.T) {
+	ctx := context.Background()
+	engine := &fakeEngine{due: []utils.UInt64{1, 2, 3, 4}}
+	s := NewSession(engine)
+	s.RelearnGap = 2
+	clock := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return clock }
+
+	var order []utils.UInt64
+	answer := func(result def.AttackResult) *Grade {
+		dm, err := s.Next(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, dm)
+		order = append(order, dm.ItemID)
+		clock = clock.Add(2 * time.Second)
+		grade, err := s.Answer(ctx, dm.ItemID, result)
+		require.NoError(t, err)
+		return grade
+	}
+
+	grade := answer(def.AttackMiss) // 1 答错，在 2 次作答后重新出现
+	assert.True(t, grade.Relearn)
+	assert.Equal(t, 2*time.Second, grade.ResponseTime)
+	answer(def.AttackKill)
+	answer(def.AttackKill)
+	answer(def.AttackKill)
+	answer(def.AttackDefeat) // 4 答错，没有其他到期的 monsters 时立即出现
+	answer(def.AttackHit)
+	dm, err := s.Next(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, dm)
+
+	assert.Equal(t, []utils.UInt64{1, 2, 3, 1, 4, 4}, order)
+	summary := s.Summary()
+	assert.Equal(t, 6, summary.Answered)
+	assert.Equal(t, 2, summary.Failed)
+	assert.Equal(t, utils.UInt64(60), summary.Cash)
+	assert.Equal(t, 30, summary.FamiliarityGain)
+	assert.Equal(t, 12*time.Second, summary.ResponseTime)
+	assert.Equal(t, 6, engine.applied[5].Seq)
+}
+
+func TestSession_AnswerMustMatchCurrent(t *testing.T) {
+	ctx := context.Background()
+	s := NewSession(&fakeEngine{due: []utils.UInt64{1}})
+
+	_, err := s.Answer(ctx, 1, def.AttackKill)
+	assert.ErrorIs(t, err, ErrNotCurrent)
+
+	dm, err := s.Next(ctx)
+	require.NoError(t, err)
+	again, err := s.Next(ctx)
+	require.NoError(t, err)
+	assert.Same(t, dm, again)
+
+	_, err = s.Answer(ctx, 2, def.AttackKill)
+	assert.ErrorIs(t, err, ErrNotCurrent)
+	_, err = s.Answer(ctx, 1, "dance")
+	assert.ErrorIs(t, err, ErrInvalidResult)
+	_, err = s.Answer(ctx, 1, def.AttackKill)
+	require.NoError(t, err)
+	assert.Nil(t, s.Current())
+}
@@ -34,3 +34,8 @@ func (ar AttackResult) DamageRate() utils.Percentage {
 	}
 	return utils.Percentage(0)
 }
+
+// Failed 是否是没有答对的结果，复习会话中答错的 monster 会在会话中再次出现
+func (ar AttackResult) Failed() bool {
+	return ar == AttackDefeat || ar == AttackMiss
+}
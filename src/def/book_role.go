@@ -0,0 +1,80 @@
+package def
+
+import (
+	"fmt"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// BookRole 协作者在册子中的角色，高级角色包含低级角色的权限
+type BookRole uint8
+
+const (
+	BookRoleNone   BookRole = 0x0 // 不是成员
+	BookRoleViewer BookRole = 0x1 // 可以查看册子和其中的学习材料
+	BookRoleEditor BookRole = 0x2 // 可以添加、移除和编辑册子中的学习材料
+	BookRoleOwner  BookRole = 0x3 // 可以管理成员、修改可见性和删除册子
+)
+
+func (br *BookRole) String() string {
+	switch *br {
+	case BookRoleNone:
+		return "none"
+	case BookRoleViewer:
+		return "viewer"
+	case BookRoleEditor:
+		return "editor"
+	case BookRoleOwner:
+		return "owner"
+	default:
+		return "unknown"
+	}
+}
+
+// Valid 是否是可以授予成员的角色
+func (br *BookRole) Valid() bool {
+	switch *br {
+	case BookRoleViewer:
+	case BookRoleEditor:
+	case BookRoleOwner:
+	default:
+		return false
+	}
+	return true
+}
+
+func (br BookRole) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(br.String())
+}
+
+// UnmarshalJSON custom unmarshaller to handle both strings and numbers
+func (br *BookRole) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := jsoniter.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*br = BookRole(v)
+	case string:
+		switch strings.TrimSpace(strings.ToLower(v)) {
+		case "viewer", "1":
+			*br = BookRoleViewer
+		case "editor", "2":
+			*br = BookRoleEditor
+		case "owner", "3":
+			*br = BookRoleOwner
+		default:
+			return fmt.Errorf("invalid book role: %s", v)
+		}
+	default:
+		return fmt.Errorf("invalid book role: %v", v)
+	}
+
+	if !br.Valid() {
+		return fmt.Errorf("invalid book role: %v", value)
+	}
+	return nil
+}
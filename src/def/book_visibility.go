@@ -0,0 +1,77 @@
+package def
+
+import (
+	"fmt"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// BookVisibility 册子的可见性，决定了其他用户能否查看和订阅
+type BookVisibility uint8
+
+const (
+	BookVisibilityPrivate  BookVisibility = 0x0 // 仅所有者和被授权的用户可见
+	BookVisibilityUnlisted BookVisibility = 0x1 // 持有分享链接的用户可见，不出现在公开目录中
+	BookVisibilityPublic   BookVisibility = 0x2 // 所有用户可见，出现在公开目录中
+)
+
+func (bv *BookVisibility) String() string {
+	switch *bv {
+	case BookVisibilityPrivate:
+		return "private"
+	case BookVisibilityUnlisted:
+		return "unlisted"
+	case BookVisibilityPublic:
+		return "public"
+	default:
+		return "unknown"
+	}
+}
+
+func (bv *BookVisibility) Valid() bool {
+	switch *bv {
+	case BookVisibilityPrivate:
+	case BookVisibilityUnlisted:
+	case BookVisibilityPublic:
+	default:
+		return false
+	}
+	return true
+}
+
+// Shared 是否可以被其他用户通过分享链接或公开目录访问
+func (bv *BookVisibility) Shared() bool {
+	return *bv == BookVisibilityUnlisted || *bv == BookVisibilityPublic
+}
+
+// UnmarshalJSON custom unmarshaller to handle both strings and numbers
+func (bv *BookVisibility) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := jsoniter.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*bv = BookVisibility(v)
+	case string:
+		switch strings.TrimSpace(strings.ToLower(v)) {
+		case "private", "0":
+			*bv = BookVisibilityPrivate
+		case "unlisted", "1":
+			*bv = BookVisibilityUnlisted
+		case "public", "2":
+			*bv = BookVisibilityPublic
+		default:
+			return fmt.Errorf("invalid book visibility: %s", v)
+		}
+	default:
+		return fmt.Errorf("invalid book visibility: %v", v)
+	}
+
+	if !bv.Valid() {
+		return fmt.Errorf("invalid book visibility: %v", value)
+	}
+	return nil
+}
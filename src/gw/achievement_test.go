@@ -0,0 +1,123 @@
+package gw_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+func (env *testEnv) achievement(t *testing.T, uid, id utils.UInt64) map[string]any {
+	w := env.do(t, uid, http.MethodGet, fmt.Sprintf("/achievements/%d", id), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[map[string]any](t, w.Body.Bytes())
+}
+
+func TestAchievement_ItemCreatedUnlocksWithReward(t *testing.T) {
+	env := setupEnv(t)
+
+	w := env.do(t, alice, http.MethodPost, "/items", map[string]any{"type": model.TyItemFlashCard, "content": "new item"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = env.do(t, alice, http.MethodGet, "/achievements", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	list := decodeData[[]map[string]any](t, w.Body.Bytes())
+	require.Len(t, list, len(model.Achievements()))
+
+	first := env.achievement(t, alice, 1001)
+	assert.Equal(t, true, first["unlocked"])
+	assert.NotEmpty(t, first["unlocked_at"])
+	hundred := env.achievement(t, alice, 1002)
+	assert.Equal(t, false, hundred["unlocked"])
+	assert.Equal(t, float64(1), hundred["progress"])
+	assert.Equal(t, utils.UInt64(10), env.balance(t, alice).Cash)
+
+	// 其他用户的进度是独立的
+	assert.Equal(t, false, env.achievement(t, bob, 1001)["unlocked"])
+
+	// 已解锁的成就不再发放奖励
+	w = env.do(t, alice, http.MethodPost, "/items", map[string]any{"type": model.TyItemFlashCard, "content": "another item"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, utils.UInt64(10), env.balance(t, alice).Cash)
+	assert.Equal(t, float64(2), env.achievement(t, alice, 1002)["progress"])
+
+	w = env.do(t, alice, http.MethodGet, "/achievements/42", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestAchievement_PracticeKillsMonsterAndBoss(t *testing.T) {
+	env := setupEnv(t)
+	require.NoError(t, env.db.Model(&model.DungeonMonster{}).Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).
+		Update("familiarity", model.MasteredFamiliarity-1).Error)
+
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+		"monster_id": idStr(aliceItem), "result": "complete",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, true, env.achievement(t, alice, 2001)["unlocked"])
+	assert.Equal(t, true, env.achievement(t, alice, 4001)["unlocked"], "the only monster is mastered")
+
+	var rewards int64
+	require.NoError(t, env.db.Model(&model.PointTransaction{}).
+		Where("user_id = ? AND reason = ?", alice, model.PointReasonAchievement).Count(&rewards).Error)
+	assert.EqualValues(t, 2, rewards)
+
+	// 一次普通的作答不计入完美击败
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+		"monster_id": idStr(aliceItem), "result": "kill",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, float64(1), env.achievement(t, alice, 2002)["progress"])
+}
+
+func TestAchievement_BookPublishedCountsOnce(t *testing.T) {
+	env := setupEnv(t)
+
+	env.setVisibility(t, "public")
+	env.setVisibility(t, "private")
+	env.setVisibility(t, "public")
+
+	assert.Equal(t, true, env.achievement(t, alice, 5001)["unlocked"])
+	var count int64
+	require.NoError(t, env.db.Model(&model.AchievementEventKey{}).Where("user_id = ?", alice).Count(&count).Error)
+	assert.EqualValues(t, 1, count)
+	assert.Equal(t, utils.UInt64(50), env.balance(t, alice).Cash)
+}
+
+func TestAchievement_RulesAreData(t *testing.T) {
+	env := setupEnv(t)
+	ctx := context.Background()
+	defaults := model.Achievements()
+	t.Cleanup(func() {
+		data, err := yaml.Marshal(defaults)
+		require.NoError(t, err)
+		require.NoError(t, model.LoadAchievements(data))
+	})
+
+	require.Error(t, model.LoadAchievements([]byte(`[{id: 1, event: item.created}]`)), "threshold is required")
+	require.Error(t, model.LoadAchievements([]byte(`[{id: 1, event: dance, threshold: 1}]`)))
+	require.Error(t, model.LoadAchievements([]byte(`[{id: 1, event: item.created, threshold: 1, reward: {currency: gold, amount: 1}}]`)))
+	assert.Equal(t, defaults, model.Achievements(), "invalid definitions are not applied")
+
+	require.NoError(t, model.LoadAchievements([]byte(`
+- {id: 7, event: streak.reached, counter: max, threshold: 3, reward: {currency: gem, amount: 5}}
+`)))
+	record := func(value uint64) []*model.Achievement {
+		unlocked, err := model.RecordAchievementEvent(ctx, env.db, model.AchievementEvent{UserID: alice, Type: model.AchievementEventStreakReached, Value: value})
+		require.NoError(t, err)
+		return unlocked
+	}
+	assert.Empty(t, record(2))
+	assert.Empty(t, record(1))
+	assert.Equal(t, float64(2), env.achievement(t, alice, 7)["progress"], "max counter keeps the highest value")
+	require.Len(t, record(3), 1)
+	assert.Empty(t, record(4), "unlocked only once")
+	assert.Equal(t, utils.UInt64(5), env.balance(t, alice).Gem)
+}
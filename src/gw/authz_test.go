@@ -0,0 +1,333 @@
+package gw_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/khgame/ranger_iam/pkg/authcli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/internal/utils/cache"
+	"github.com/bagaking/memorianexus/pkg/blobstore"
+	"github.com/bagaking/memorianexus/pkg/tags"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/gw"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+const (
+	alice utils.UInt64 = 1001
+	bob   utils.UInt64 = 2002
+
+	aliceItem    utils.UInt64 = 3001
+	aliceBook    utils.UInt64 = 4001
+	aliceDungeon utils.UInt64 = 5001
+	bobDungeon   utils.UInt64 = 5002
+	missingID    utils.UInt64 = 9999
+)
+
+var redisServer *miniredis.Miniredis
+
+func TestMain(m *testing.M) {
+	var err error
+	redisServer, err = miniredis.Run()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to start miniredis: %v", err))
+	}
+	cache.Init(redisServer.Addr())
+
+	code := m.Run()
+
+	redisServer.Close()
+	os.Exit(code)
+}
+
+type testEnv struct {
+	db     *gorm.DB
+	router *gin.Engine
+	store  blobstore.Store
+}
+
+// testAuthN 用 X-User-ID 头代替 iam 认证
+func testAuthN(c *gin.Context) {
+	uid, err := strconv.ParseUint(c.GetHeader("X-User-ID"), 10, 64)
+	if err != nil || uid == 0 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set(authcli.UserCtxKey, uid)
+	c.Next()
+}
+
+func setupEnv(t *testing.T) *testEnv {
+	return setupEnvWithDSN(t, fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+}
+
+// setupConcurrentEnv 使用文件数据库，事务以 BEGIN IMMEDIATE 开始并等待其他事务提交，用于测试并发的请求
+func setupConcurrentEnv(t *testing.T) *testEnv {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_txlock=immediate&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)"
+	return setupEnvWithDSN(t, dsn)
+}
+
+func setupEnvWithDSN(t *testing.T, dsn string) *testEnv {
+	gin.SetMode(gin.TestMode)
+
+	redisServer.FlushAll()
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&model.Item{}, &model.Book{}, &model.BookItem{},
+		&model.Dungeon{}, &model.DungeonBook{}, &model.DungeonMonster{}, &model.DungeonTag{},
+		&model.UserMonster{}, &model.Tag{}, &model.Grant{}, &model.BookSubscription{},
+		&model.BookFork{}, &model.ItemFork{}, &model.BookActivity{}, &model.BookChapter{},
+		&model.Media{}, &model.ItemMedia{}, &model.ProfilePoints{}, &model.PointTransaction{},
+		&model.PracticeAttempt{}, &model.ReviewLog{}, &model.PracticeSession{},
+		&model.UserStreak{}, &model.DailyActivity{},
+		&model.UserAchievement{}, &model.AchievementEventKey{},
+		&model.EventOutbox{},
+		&model.NFT{}, &model.NFTDrawSeed{}, &model.NFTPityCounter{}, &model.NFTDraw{},
+		&model.Profile{}, &model.ProfileMemorizationSetting{}, &model.IdleIncome{},
+		&model.NFTTrade{}, &model.NFTShopStock{}, &model.NFTShopOrder{},
+	))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q := tags.NewChanQueue(16, time.Second)
+	model.MustInit(ctx, db, q, q)
+
+	store, err := blobstore.NewLocalFS(t.TempDir())
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.UseRawPath, router.UnescapePathValues = true, true // 与 RegRouter 一致，层级标签在路径中编码为 %2F
+	gw.RegisterRoutes(router.Group("/api/v1"), db, testAuthN, store)
+
+	// alice 的 item、book 和 campaign 复习计划，bob 自己的空复习计划
+	require.NoError(t, db.Create(&model.Item{ID: aliceItem, CreatorID: alice, Type: model.TyItemFlashCard, Content: "alice secret"}).Error)
+	require.NoError(t, db.Create(&model.Book{ID: aliceBook, UserID: alice, Title: "alice book"}).Error)
+	require.NoError(t, db.Create(&model.BookItem{BookID: aliceBook, ItemID: aliceItem}).Error)
+	require.NoError(t, db.Create(&model.Dungeon{ID: aliceDungeon, UserID: alice, Type: def.DungeonTypeCampaign, Title: "alice dungeon"}).Error)
+	require.NoError(t, db.Create(&model.Dungeon{ID: bobDungeon, UserID: bob, Type: def.DungeonTypeCampaign, Title: "bob dungeon"}).Error)
+	require.NoError(t, db.Create(&model.DungeonMonster{
+		DungeonID: aliceDungeon, ItemID: aliceItem,
+		SourceType: model.MonsterSourceItem, SourceID: aliceItem,
+	}).Error)
+
+	return &testEnv{db: db, router: router, store: store}
+}
+
+func (env *testEnv) do(t *testing.T, uid utils.UInt64, method, path string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, "/api/v1"+path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", idStr(uid))
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	return w
+}
+
+func (env *testEnv) listItems(t *testing.T, uid utils.UInt64, query string) []map[string]any {
+	w := env.do(t, uid, http.MethodGet, "/items?"+query, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Data []map[string]any `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Data
+}
+
+func TestAuthz_OtherUserGetsNotFound(t *testing.T) {
+	env := setupEnv(t)
+
+	cases := []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{http.MethodGet, "/items/%d", nil},
+		{http.MethodPut, "/items/%d", map[string]any{"content": "hacked"}},
+		{http.MethodDelete, "/items/%d", nil},
+	}
+	bookCases := []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{http.MethodGet, "/books/%d", nil},
+		{http.MethodPut, "/books/%d", map[string]any{"title": "hacked"}},
+		{http.MethodDelete, "/books/%d", nil},
+		{http.MethodGet, "/books/%d/items", nil},
+		{http.MethodPost, "/books/%d/items", map[string]any{"item_ids": []string{idStr(aliceItem)}}},
+		{http.MethodPut, "/books/%d/items/order", map[string]any{"item_ids": []string{idStr(aliceItem)}}},
+		{http.MethodGet, "/books/%d/chapters", nil},
+		{http.MethodPost, "/books/%d/chapters", map[string]any{"title": "hacked"}},
+	}
+	dungeonCases := []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{http.MethodGet, "/dungeon/dungeons/%d", nil},
+		{http.MethodPut, "/dungeon/dungeons/%d", map[string]any{"title": "hacked"}},
+		{http.MethodDelete, "/dungeon/dungeons/%d", nil},
+		{http.MethodGet, "/dungeon/dungeons/%d/items", nil},
+		{http.MethodPost, "/dungeon/dungeons/%d/items", map[string]any{"items": []string{idStr(aliceItem)}}},
+		{http.MethodDelete, "/dungeon/dungeons/%d/items", map[string]any{"items": []string{idStr(aliceItem)}}},
+		{http.MethodGet, "/dungeon/campaigns/%d/monsters", nil},
+		{http.MethodGet, "/dungeon/campaigns/%d/practice", nil},
+		{http.MethodPost, "/dungeon/campaigns/%d/submit", map[string]any{"monster_id": idStr(aliceItem), "result": "kill"}},
+		{http.MethodGet, "/dungeon/campaigns/%d/sync", nil},
+		{http.MethodGet, "/dungeon/campaigns/%d/session", nil},
+		{http.MethodGet, "/dungeon/campaigns/%d/sessions", nil},
+		{http.MethodPost, "/dungeon/campaigns/%d/sync", map[string]any{"attempts": []map[string]any{{"attempt_id": "x", "monster_id": idStr(aliceItem), "result": "kill", "practiced_at": "2024-01-01T00:00:00Z"}}}},
+		{http.MethodGet, "/dungeon/endless/%d/monsters", nil},
+	}
+
+	check := func(method, path string, body any, id utils.UInt64) {
+		p := fmt.Sprintf(path, id)
+		w := env.do(t, bob, method, p, body)
+		assert.Equal(t, http.StatusNotFound, w.Code, "%s %s: %s", method, p, w.Body.String())
+		// 不存在的资源和没有权限的资源返回一致
+		p = fmt.Sprintf(path, missingID)
+		w = env.do(t, bob, method, p, body)
+		assert.Equal(t, http.StatusNotFound, w.Code, "%s %s: %s", method, p, w.Body.String())
+	}
+	for _, tc := range cases {
+		check(tc.method, tc.path, tc.body, aliceItem)
+	}
+	for _, tc := range bookCases {
+		check(tc.method, tc.path, tc.body, aliceBook)
+	}
+	for _, tc := range dungeonCases {
+		check(tc.method, tc.path, tc.body, aliceDungeon)
+	}
+
+	// 资源没有被修改或删除
+	item := &model.Item{}
+	require.NoError(t, env.db.First(item, aliceItem).Error)
+	assert.Equal(t, "alice secret", item.Content)
+	require.NoError(t, env.db.First(&model.Book{}, aliceBook).Error)
+	require.NoError(t, env.db.First(&model.Dungeon{}, aliceDungeon).Error)
+}
+
+func TestAuthz_CrossUserReferences(t *testing.T) {
+	env := setupEnv(t)
+
+	// 列表中看不到其他用户的 items
+	assert.Empty(t, env.listItems(t, bob, "user_id="+idStr(alice)))
+	w := env.do(t, bob, http.MethodGet, "/items?book_id="+idStr(aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// 不能把 item 加入其他用户的 book
+	w = env.do(t, bob, http.MethodPost, "/items", map[string]any{
+		"type": model.TyItemFlashCard, "content": "bob item", "book_ids": []string{idStr(aliceBook)},
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	var count int64
+	require.NoError(t, env.db.Model(&model.BookItem{}).Where("book_id = ?", aliceBook).Count(&count).Error)
+	assert.EqualValues(t, 1, count)
+
+	// 不能把其他用户的 item 加入自己的复习计划
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/dungeon/dungeons/%d/items", bobDungeon), map[string]any{
+		"items": []string{idStr(aliceItem)},
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	require.NoError(t, env.db.Model(&model.DungeonMonster{}).Where("dungeon_id = ?", bobDungeon).Count(&count).Error)
+	assert.EqualValues(t, 0, count)
+
+	// 创建复习计划时引用了其他用户的 item，已经加入的 book 也一起回滚
+	const bobBook utils.UInt64 = 4002
+	require.NoError(t, env.db.Create(&model.Profile{ID: bob, Email: idStr(bob) + "@example.com"}).Error)
+	require.NoError(t, env.db.Create(&model.Book{ID: bobBook, UserID: bob, Title: "bob book"}).Error)
+	w = env.do(t, bob, http.MethodPost, "/dungeon/dungeons", map[string]any{
+		"type": "campaign", "title": "mixed", "books": []string{idStr(bobBook)}, "items": []string{idStr(aliceItem)},
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	require.NoError(t, env.db.Model(&model.Dungeon{}).Where("user_id = ?", bob).Count(&count).Error)
+	assert.EqualValues(t, 1, count)
+	require.NoError(t, env.db.Model(&model.DungeonBook{}).Where("book_id = ?", bobBook).Count(&count).Error)
+	assert.EqualValues(t, 0, count)
+}
+
+func TestAuthz_OwnerAccess(t *testing.T) {
+	env := setupEnv(t)
+
+	for _, p := range []string{
+		fmt.Sprintf("/items/%d", aliceItem),
+		fmt.Sprintf("/books/%d", aliceBook),
+		fmt.Sprintf("/books/%d/items", aliceBook),
+		fmt.Sprintf("/dungeon/dungeons/%d", aliceDungeon),
+		fmt.Sprintf("/dungeon/dungeons/%d/items", aliceDungeon),
+		fmt.Sprintf("/dungeon/campaigns/%d/monsters", aliceDungeon),
+	} {
+		w := env.do(t, alice, http.MethodGet, p, nil)
+		assert.Equal(t, http.StatusOK, w.Code, "GET %s: %s", p, w.Body.String())
+	}
+	assert.Len(t, env.listItems(t, alice, "user_id="+idStr(alice)), 1)
+
+	w := env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "updated"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d", aliceBook), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestAuthz_Grants(t *testing.T) {
+	env := setupEnv(t)
+	ctx := context.Background()
+
+	require.NoError(t, model.GrantAccess(ctx, env.db, model.ResourceBook, aliceBook, bob, model.ActionRead, alice))
+	w := env.do(t, bob, http.MethodGet, fmt.Sprintf("/books/%d", aliceBook), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/books/%d", aliceBook), map[string]any{"title": "hacked"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// 升级为写权限后可以修改，但仍不能删除
+	require.NoError(t, model.GrantAccess(ctx, env.db, model.ResourceBook, aliceBook, bob, model.ActionWrite, alice))
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/books/%d", aliceBook), map[string]any{"title": "shared"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// 可读的 book 中的 items 也可读，撤销 book 的授权后只能通过 item 自己的授权读取
+	assert.Len(t, env.listItems(t, bob, "user_id="+idStr(alice)), 1)
+	require.NoError(t, model.RevokeAccess(ctx, env.db, model.ResourceBook, aliceBook, bob))
+	assert.Empty(t, env.listItems(t, bob, "user_id="+idStr(alice)))
+
+	require.NoError(t, model.GrantAccess(ctx, env.db, model.ResourceItem, aliceItem, bob, model.ActionRead, alice))
+	assert.Len(t, env.listItems(t, bob, "user_id="+idStr(alice)), 1)
+
+	require.NoError(t, model.RevokeAccess(ctx, env.db, model.ResourceItem, aliceItem, bob))
+	assert.Empty(t, env.listItems(t, bob, "user_id="+idStr(alice)))
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/items/%d", aliceItem), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func idStr(id utils.UInt64) string {
+	return strconv.FormatUint(id.Raw(), 10)
+}
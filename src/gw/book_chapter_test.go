@@ -0,0 +1,178 @@
+package gw_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// addBookItems 创建 alice 的 items 并按顺序追加到 aliceBook
+func (env *testEnv) addBookItems(t *testing.T, ids ...utils.UInt64) {
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		require.NoError(t, env.db.Create(&model.Item{ID: id, CreatorID: alice, Type: model.TyItemFlashCard, Content: fmt.Sprintf("card %d", id)}).Error)
+		strs = append(strs, idStr(id))
+	}
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/books/%d/items", aliceBook), map[string]any{"item_ids": strs})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func (env *testEnv) bookItemIDs(t *testing.T, uid, bookID utils.UInt64, query string) []string {
+	w := env.do(t, uid, http.MethodGet, fmt.Sprintf("/books/%d/items?limit=100&%s", bookID, query), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	ids := make([]string, 0)
+	for _, item := range decodeData[[]map[string]any](t, w.Body.Bytes()) {
+		ids = append(ids, item["id"].(string))
+	}
+	return ids
+}
+
+func (env *testEnv) createChapter(t *testing.T, body map[string]any) string {
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/books/%d/chapters", aliceBook), body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	return decodeData[map[string]any](t, w.Body.Bytes())["id"].(string)
+}
+
+func (env *testEnv) moveItems(t *testing.T, body map[string]any) int {
+	w := env.do(t, alice, http.MethodPut, fmt.Sprintf("/books/%d/items/order", aliceBook), body)
+	return w.Code
+}
+
+func (env *testEnv) chapterTree(t *testing.T, uid, bookID utils.UInt64) []map[string]any {
+	w := env.do(t, uid, http.MethodGet, fmt.Sprintf("/books/%d/chapters", bookID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[[]map[string]any](t, w.Body.Bytes())
+}
+
+func TestBookChapter_OrderAndMove(t *testing.T) {
+	env := setupEnv(t)
+	env.addBookItems(t, 3002, 3003, 3004)
+	assert.Equal(t, []string{idStr(aliceItem), "3002", "3003", "3004"}, env.bookItemIDs(t, alice, aliceBook, ""))
+
+	ch1 := env.createChapter(t, map[string]any{"title": "one"})
+	ch2 := env.createChapter(t, map[string]any{"title": "two", "before": ch1})
+	tree := env.chapterTree(t, alice, aliceBook)
+	require.Len(t, tree, 2)
+	assert.Equal(t, []any{ch2, ch1}, []any{tree[0]["id"], tree[1]["id"]})
+
+	// 移动到章节中，按给定的顺序放置
+	require.Equal(t, http.StatusOK, env.moveItems(t, map[string]any{"item_ids": []string{"3004", "3002"}, "chapter_id": ch1}))
+	require.Equal(t, http.StatusOK, env.moveItems(t, map[string]any{"item_ids": []string{"3003"}, "chapter_id": ch1, "after": "3004"}))
+	assert.Equal(t, []string{"3004", "3003", "3002"}, env.bookItemIDs(t, alice, aliceBook, "chapter_id="+ch1))
+	assert.Equal(t, []string{idStr(aliceItem)}, env.bookItemIDs(t, alice, aliceBook, "chapter_id=0"))
+	require.Equal(t, http.StatusOK, env.moveItems(t, map[string]any{"item_ids": []string{"3002"}, "chapter_id": ch2}))
+	assert.Equal(t, []string{idStr(aliceItem), "3002", "3004", "3003"}, env.bookItemIDs(t, alice, aliceBook, ""))
+
+	// 位置必须是目标章节中的其他 item，item 必须在 book 中
+	assert.Equal(t, http.StatusBadRequest, env.moveItems(t, map[string]any{"item_ids": []string{"3003"}, "chapter_id": ch1, "before": "3002"}))
+	assert.Equal(t, http.StatusBadRequest, env.moveItems(t, map[string]any{"item_ids": []string{"3003"}, "chapter_id": ch1, "before": "3003"}))
+	assert.Equal(t, http.StatusNotFound, env.moveItems(t, map[string]any{"item_ids": []string{"3999"}, "chapter_id": ch1}))
+	assert.Equal(t, http.StatusNotFound, env.moveItems(t, map[string]any{"item_ids": []string{"3003"}, "chapter_id": "9999"}))
+
+	// 嵌套章节不能移动到自己或子孙章节下
+	sub := env.createChapter(t, map[string]any{"title": "one.one", "parent_id": ch1})
+	w := env.do(t, alice, http.MethodPut, fmt.Sprintf("/books/%d/chapters/%s", aliceBook, ch1), map[string]any{"parent_id": sub})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodPut, fmt.Sprintf("/books/%d/chapters/%s", aliceBook, ch1), map[string]any{"parent_id": ch1})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	require.Equal(t, http.StatusOK, env.moveItems(t, map[string]any{"item_ids": []string{idStr(aliceItem)}, "chapter_id": sub}))
+
+	// 移动章节时其中的 items 一起移动
+	w = env.do(t, alice, http.MethodPut, fmt.Sprintf("/books/%d/chapters/%s", aliceBook, ch1), map[string]any{"title": "first", "before": ch2})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tree = env.chapterTree(t, alice, aliceBook)
+	require.Len(t, tree, 2)
+	assert.Equal(t, "first", tree[0]["title"])
+	require.Len(t, tree[0]["children"], 1)
+	assert.Equal(t, []string{"3004", "3003", idStr(aliceItem), "3002"}, env.bookItemIDs(t, alice, aliceBook, ""))
+
+	// 删除章节后，items 和子章节按顺序移动到父章节的末尾
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d/chapters/%s", aliceBook, ch1), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tree = env.chapterTree(t, alice, aliceBook)
+	require.Len(t, tree, 2)
+	assert.Equal(t, []any{ch2, sub}, []any{tree[0]["id"], tree[1]["id"]})
+	assert.Equal(t, []string{"3004", "3003"}, env.bookItemIDs(t, alice, aliceBook, "chapter_id=0"))
+	assert.Equal(t, []string{"3004", "3003", "3002", idStr(aliceItem)}, env.bookItemIDs(t, alice, aliceBook, ""))
+
+	// 其他用户看不到章节
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/books/%d/chapters", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestBookChapter_CampaignIntroducesItemsInBookOrder(t *testing.T) {
+	env := setupEnv(t)
+	env.addBookItems(t, 3002, 3003)
+
+	const campaign utils.UInt64 = 5003
+	require.NoError(t, env.db.Create(&model.Dungeon{ID: campaign, UserID: alice, Type: def.DungeonTypeCampaign, Title: "in order"}).Error)
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/dungeons/%d/books", campaign), map[string]any{
+		"books": []string{idStr(aliceBook)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	positions := func() map[utils.UInt64]uint32 {
+		var list []model.DungeonMonster
+		require.NoError(t, env.db.Where("dungeon_id = ?", campaign).Find(&list).Error)
+		ret := make(map[utils.UInt64]uint32, len(list))
+		for _, m := range list {
+			ret[m.ItemID] = m.Position
+		}
+		return ret
+	}
+	assert.Equal(t, map[utils.UInt64]uint32{aliceItem: 1, 3002: 2, 3003: 3}, positions())
+
+	// book 中的顺序变化后同步到复习计划
+	ch := env.createChapter(t, map[string]any{"title": "later"})
+	require.Equal(t, http.StatusOK, env.moveItems(t, map[string]any{"item_ids": []string{idStr(aliceItem)}, "chapter_id": ch}))
+	require.Equal(t, http.StatusOK, env.moveItems(t, map[string]any{"item_ids": []string{"3003"}, "before": "3002"}))
+	assert.Equal(t, map[utils.UInt64]uint32{3003: 1, 3002: 2, aliceItem: 3}, positions())
+
+	// 直接加入的 item 没有位置，排在来自 book 的 items 之后
+	require.NoError(t, env.db.Create(&model.Item{ID: 3005, CreatorID: alice, Type: model.TyItemFlashCard, Content: "direct"}).Error)
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/dungeons/%d/items", campaign), map[string]any{"items": []string{"3005"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// 新的 items 按 book 中的顺序出现
+	w = env.do(t, alice, http.MethodGet, fmt.Sprintf("/dungeon/campaigns/%d/practice", campaign), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var order []any
+	for _, m := range decodeData[[]map[string]any](t, w.Body.Bytes()) {
+		order = append(order, m["item_id"])
+	}
+	assert.Equal(t, []any{"3003", "3002", idStr(aliceItem), "3005"}, order)
+}
+
+func TestBookChapter_ForkCopiesChapters(t *testing.T) {
+	env := setupEnv(t)
+	env.addBookItems(t, 3002)
+	ch := env.createChapter(t, map[string]any{"title": "basics"})
+	env.createChapter(t, map[string]any{"title": "advanced", "parent_id": ch})
+	require.Equal(t, http.StatusOK, env.moveItems(t, map[string]any{"item_ids": []string{idStr(aliceItem)}, "chapter_id": ch}))
+
+	forkID, _ := env.forkBook(t)
+	tree := env.chapterTree(t, bob, forkID)
+	require.Len(t, tree, 1)
+	assert.Equal(t, "basics", tree[0]["title"])
+	assert.NotEqual(t, ch, tree[0]["id"])
+	children := tree[0]["children"].([]any)
+	require.Len(t, children, 1)
+	assert.Equal(t, "advanced", children[0].(map[string]any)["title"])
+
+	// fork 中的 items 保持原来的顺序和章节
+	var copied []string
+	w := env.do(t, bob, http.MethodGet, fmt.Sprintf("/books/%d/items?chapter_id=%s", forkID, tree[0]["id"]), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	for _, item := range decodeData[[]map[string]any](t, w.Body.Bytes()) {
+		copied = append(copied, item["content"].(string))
+	}
+	assert.Equal(t, []string{"alice secret"}, copied)
+	assert.Len(t, env.bookItemIDs(t, bob, forkID, "chapter_id=0"), 1)
+}
@@ -0,0 +1,194 @@
+package gw_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// forkBook bob fork alice 的公开 book，返回 fork 的 id 和复制出的 item id
+func (env *testEnv) forkBook(t *testing.T) (utils.UInt64, utils.UInt64) {
+	env.setVisibility(t, "public")
+	w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/fork", aliceBook), map[string]any{"title": "bob copy"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	book := decodeData[map[string]any](t, w.Body.Bytes())
+	assert.Equal(t, "bob copy", book["title"])
+	assert.Equal(t, idStr(aliceBook), book["forked_from"])
+
+	var fork model.BookFork
+	require.NoError(t, env.db.Where("source_book_id = ?", aliceBook).First(&fork).Error)
+	var link model.ItemFork
+	require.NoError(t, env.db.Where("book_id = ? AND source_item_id = ?", fork.BookID, aliceItem).First(&link).Error)
+	return fork.BookID, link.ItemID
+}
+
+func (env *testEnv) upstream(t *testing.T, bookID utils.UInt64) []map[string]any {
+	w := env.do(t, bob, http.MethodGet, fmt.Sprintf("/books/%d/upstream", bookID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[struct {
+		Changes []map[string]any `json:"changes"`
+	}](t, w.Body.Bytes()).Changes
+}
+
+func TestBookFork_CopiesItemsWithProvenance(t *testing.T) {
+	env := setupEnv(t)
+
+	// 不可读的 book 不能 fork
+	w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/fork", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	forkID, itemID := env.forkBook(t)
+	assert.NotEqual(t, aliceBook, forkID)
+	assert.NotEqual(t, aliceItem, itemID)
+
+	var item model.Item
+	require.NoError(t, env.db.First(&item, itemID).Error)
+	assert.Equal(t, bob, item.CreatorID)
+	assert.Equal(t, "alice secret", item.Content)
+
+	// fork 属于 bob，可以编辑，alice 看不到
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", itemID), map[string]any{"content": "bob notes"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodGet, fmt.Sprintf("/books/%d", forkID), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	assert.Empty(t, env.upstream(t, forkID))
+
+	// 不是 fork 的 book 没有上游，上游改回私有后不能再比对
+	w = env.do(t, alice, http.MethodGet, fmt.Sprintf("/books/%d/upstream", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	env.setVisibility(t, "private")
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/books/%d/upstream", forkID), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d", forkID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var count int64
+	require.NoError(t, env.db.Model(&model.ItemFork{}).Where("book_id = ?", forkID).Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+// 复制出的 item 引用相同的媒体文件，媒体文件同时属于 fork 的创建者
+func TestBookFork_CopiesItemMedia(t *testing.T) {
+	env := setupEnv(t)
+	hash := strings.Repeat("d", 64)
+	require.NoError(t, env.store.Put(context.Background(), hash, strings.NewReader("ogg")))
+	require.NoError(t, env.db.Create(&model.Media{UserID: alice, Hash: hash, Kind: model.MediaKindAudio, MimeType: "audio/ogg", Size: 3}).Error)
+	require.NoError(t, model.SetItemMedia(context.Background(), env.db, aliceItem, []string{hash}))
+
+	forkID, itemID := env.forkBook(t)
+	w := env.do(t, bob, http.MethodGet, fmt.Sprintf("/items/%d", itemID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	medias := decodeData[struct {
+		Media []map[string]any `json:"media"`
+	}](t, w.Body.Bytes()).Media
+	require.Len(t, medias, 1)
+	assert.Equal(t, hash, medias[0]["hash"])
+
+	// 上游改回私有，alice 移除引用并删除媒体文件后，fork 中的 item 仍然可以获取
+	env.setVisibility(t, "private")
+	w = env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"media": []string{}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodDelete, "/media/"+hash, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodGet, "/media/"+hash, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "ogg", w.Body.String())
+
+	// fork 中的 item 引用的媒体文件不能被 bob 删除
+	w = env.do(t, bob, http.MethodDelete, "/media/"+hash, nil)
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d", forkID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestBookFork_PullModifiedFields(t *testing.T) {
+	env := setupEnv(t)
+	forkID, itemID := env.forkBook(t)
+
+	// alice 修改内容和重要程度，bob 也修改了内容
+	w := env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "alice v2", "importance": 2})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", itemID), map[string]any{"content": "bob notes"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	changes := env.upstream(t, forkID)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "modified", changes[0]["status"])
+	assert.Equal(t, idStr(itemID), changes[0]["item_id"])
+	assert.EqualValues(t, 2, changes[0]["source_revision"])
+	fields := map[string]map[string]any{}
+	for _, f := range changes[0]["fields"].([]any) {
+		diff := f.(map[string]any)
+		fields[diff["field"].(string)] = diff
+	}
+	require.Contains(t, fields, "content")
+	require.Contains(t, fields, "importance")
+	assert.Equal(t, "alice secret", fields["content"]["base"])
+	assert.Equal(t, "bob notes", fields["content"]["mine"])
+	assert.Equal(t, "alice v2", fields["content"]["theirs"])
+	assert.Equal(t, true, fields["content"]["conflict"])
+	assert.Equal(t, false, fields["importance"]["conflict"])
+
+	// 只同步重要程度，保留本地的内容
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/upstream", forkID), map[string]any{
+		"items": []map[string]any{{"source_item_id": idStr(aliceItem), "fields": []string{"importance"}}},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var item model.Item
+	require.NoError(t, env.db.First(&item, itemID).Error)
+	assert.Equal(t, "bob notes", item.Content)
+	assert.EqualValues(t, 2, item.Importance)
+	assert.Empty(t, env.upstream(t, forkID), "declined changes are not offered again")
+
+	// 已经同步过的变化不能再次同步
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/upstream", forkID), map[string]any{
+		"items": []map[string]any{{"source_item_id": idStr(aliceItem)}},
+	})
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+}
+
+func TestBookFork_PullAddedAndRemovedItems(t *testing.T) {
+	env := setupEnv(t)
+	forkID, itemID := env.forkBook(t)
+
+	const newItem utils.UInt64 = 3002
+	require.NoError(t, env.db.Create(&model.Item{ID: newItem, CreatorID: alice, Type: model.TyItemFlashCard, Content: "new"}).Error)
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/books/%d/items", aliceBook), map[string]any{
+		"item_ids": []string{idStr(newItem)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d/items?item_ids=%d", aliceBook, aliceItem), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	changes := env.upstream(t, forkID)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "removed", changes[0]["status"])
+	assert.Equal(t, idStr(aliceItem), changes[0]["source_item_id"])
+	assert.Equal(t, "added", changes[1]["status"])
+	assert.Equal(t, "new", changes[1]["theirs"].(map[string]any)["content"])
+
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/upstream", forkID), map[string]any{
+		"items": []map[string]any{{"source_item_id": idStr(aliceItem)}, {"source_item_id": idStr(newItem)}},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, env.upstream(t, forkID))
+
+	var bookItems []model.BookItem
+	require.NoError(t, env.db.Where("book_id = ?", forkID).Find(&bookItems).Error)
+	require.Len(t, bookItems, 1)
+	assert.NotEqual(t, itemID, bookItems[0].ItemID)
+	assert.NotEqual(t, newItem, bookItems[0].ItemID)
+
+	// 移出 fork 的 item 仍然属于 bob
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/items/%d", itemID), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
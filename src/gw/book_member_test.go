@@ -0,0 +1,228 @@
+package gw_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+func (env *testEnv) setMember(t *testing.T, uid, member utils.UInt64, role string) *httptest.ResponseRecorder {
+	return env.do(t, uid, http.MethodPut, fmt.Sprintf("/books/%d/members/%d", aliceBook, member), map[string]any{"role": role})
+}
+
+func (env *testEnv) activities(t *testing.T, uid utils.UInt64) []map[string]any {
+	w := env.do(t, uid, http.MethodGet, fmt.Sprintf("/books/%d/activities", aliceBook), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[[]map[string]any](t, w.Body.Bytes())
+}
+
+func TestBookMember_Roles(t *testing.T) {
+	env := setupEnv(t)
+
+	// 只有 owner 可以管理成员，创建者的角色不能修改
+	w := env.setMember(t, bob, bob, "editor")
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.setMember(t, alice, alice, "viewer")
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.setMember(t, alice, bob, "admin")
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	// viewer 只能查看
+	w = env.setMember(t, alice, bob, "viewer")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "viewer", decodeData[map[string]any](t, w.Body.Bytes())["role"])
+	library := env.listBooks(t, bob, "/books")
+	require.Len(t, library, 1)
+	assert.Equal(t, "viewer", library[0]["role"])
+	assert.Nil(t, library[0]["subscribed"])
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/items/%d", aliceItem), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "viewer edit"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.setMember(t, bob, carol, "viewer")
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// editor 可以编辑所有者创建的 items，添加和移除 items，但不能管理成员或删除 book
+	w = env.setMember(t, alice, bob, "editor")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "editor edit", "tags": []string{"shared"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var item model.Item
+	require.NoError(t, env.db.First(&item, aliceItem).Error)
+	assert.Equal(t, "editor edit", item.Content)
+	var tag model.Tag
+	require.NoError(t, env.db.Where("entity_id = ?", aliceItem).First(&tag).Error)
+	assert.Equal(t, alice, tag.UserID, "tags belong to the item creator")
+
+	const bobItem utils.UInt64 = 3102
+	require.NoError(t, env.db.Create(&model.Item{ID: bobItem, CreatorID: bob, Type: model.TyItemFlashCard, Content: "bob card"}).Error)
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/items", aliceBook), map[string]any{"item_ids": []string{idStr(bobItem)}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d/items?item_ids=%d", aliceBook, bobItem), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.setMember(t, bob, carol, "viewer")
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/items/%d", aliceItem), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// 成员的 items 加入 book 后，所有者可以读取但不能修改
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/items", aliceBook), map[string]any{"item_ids": []string{idStr(bobItem)}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodGet, fmt.Sprintf("/items/%d", bobItem), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", bobItem), map[string]any{"content": "owner edit"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// owner 角色可以管理成员，但不能移除创建者
+	w = env.setMember(t, alice, bob, "owner")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.setMember(t, bob, carol, "viewer")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d/members/%d", aliceBook, alice), nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = env.do(t, carol, http.MethodGet, fmt.Sprintf("/books/%d/members", aliceBook), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	members := decodeData[[]map[string]any](t, w.Body.Bytes())
+	require.Len(t, members, 3)
+	assert.Equal(t, idStr(alice), members[0]["user_id"])
+	assert.Equal(t, true, members[0]["creator"])
+	assert.Equal(t, "owner", members[1]["role"])
+	assert.Equal(t, "viewer", members[2]["role"])
+}
+
+func TestBookMember_LeaveAndRemove(t *testing.T) {
+	env := setupEnv(t)
+
+	require.Equal(t, http.StatusOK, env.setMember(t, alice, bob, "editor").Code)
+	require.Equal(t, http.StatusOK, env.setMember(t, alice, carol, "viewer").Code)
+
+	// 非 owner 只能移除自己
+	w := env.do(t, carol, http.MethodDelete, fmt.Sprintf("/books/%d/members/%d", aliceBook, bob), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, carol, http.MethodDelete, fmt.Sprintf("/books/%d/members/%d", aliceBook, carol), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, carol, http.MethodGet, fmt.Sprintf("/books/%d", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d/members/%d", aliceBook, bob), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d/members/%d", aliceBook, bob), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "too late"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	assert.Empty(t, env.listBooks(t, bob, "/books"))
+}
+
+func TestBookMember_ActivityFeed(t *testing.T) {
+	env := setupEnv(t)
+
+	require.Equal(t, http.StatusOK, env.setMember(t, alice, bob, "editor").Code)
+	w := env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "editor edit"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	const bobItem utils.UInt64 = 3102
+	require.NoError(t, env.db.Create(&model.Item{ID: bobItem, CreatorID: bob, Type: model.TyItemFlashCard, Content: "bob card"}).Error)
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/items", aliceBook), map[string]any{"item_ids": []string{idStr(bobItem)}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d/items?item_ids=%d", aliceBook, bobItem), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	type entry struct {
+		user, target string
+	}
+	got := map[string]entry{}
+	for _, a := range env.activities(t, bob) {
+		target, _ := a["target_id"].(string)
+		got[a["type"].(string)] = entry{a["user_id"].(string), target}
+	}
+	assert.Equal(t, entry{idStr(alice), idStr(bob)}, got["member.set"])
+	assert.Equal(t, entry{idStr(bob), idStr(aliceItem)}, got["item.updated"])
+	assert.Equal(t, entry{idStr(bob), idStr(bobItem)}, got["item.added"])
+	assert.Equal(t, entry{idStr(alice), idStr(bobItem)}, got["item.removed"])
+
+	// 非成员看不到动态
+	w = env.do(t, carol, http.MethodGet, fmt.Sprintf("/books/%d/activities", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+// editor 修改 item 时引用的媒体文件属于 item 的创建者，引用计数也算在创建者上
+func TestBookMember_EditorUpdatesMedia(t *testing.T) {
+	env := setupEnv(t)
+	aliceHash, bobHash := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	require.NoError(t, env.db.Create(&model.Media{UserID: alice, Hash: aliceHash, Kind: model.MediaKindImage, MimeType: "image/png", Size: 1}).Error)
+	require.NoError(t, env.db.Create(&model.Media{UserID: bob, Hash: bobHash, Kind: model.MediaKindImage, MimeType: "image/png", Size: 1}).Error)
+	require.Equal(t, http.StatusOK, env.setMember(t, alice, bob, "editor").Code)
+
+	itemMedia := func() []string {
+		w := env.do(t, bob, http.MethodGet, fmt.Sprintf("/items/%d", aliceItem), nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		hashes := make([]string, 0)
+		for _, m := range decodeData[struct {
+			Media []map[string]any `json:"media"`
+		}](t, w.Body.Bytes()).Media {
+			hashes = append(hashes, m["hash"].(string))
+		}
+		return hashes
+	}
+
+	// editor 可以引用 (或重新提交) 创建者的媒体文件
+	w := env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"media": []string{aliceHash}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{aliceHash}, itemMedia())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"media": []string{aliceHash}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// 自己上传的媒体文件不能被创建者的 item 引用，引用保持不变
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"media": []string{aliceHash, bobHash}})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	assert.Equal(t, []string{aliceHash}, itemMedia())
+
+	// 被引用的媒体文件不能被创建者删除，editor 自己的媒体文件没有被引用
+	w = env.do(t, alice, http.MethodDelete, "/media/"+aliceHash, nil)
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodDelete, "/media/"+bobHash, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+// 可以读取 item 的成员和订阅者可以获取 item 引用的媒体文件
+func TestBookMember_ReadersServeMedia(t *testing.T) {
+	env := setupEnv(t)
+	hash := strings.Repeat("c", 64)
+	require.NoError(t, env.store.Put(context.Background(), hash, strings.NewReader("png")))
+	require.NoError(t, env.db.Create(&model.Media{UserID: alice, Hash: hash, Kind: model.MediaKindImage, MimeType: "image/png", Size: 3}).Error)
+	require.NoError(t, model.SetItemMedia(context.Background(), env.db, aliceItem, []string{hash}))
+
+	serve := func(uid utils.UInt64) int {
+		return env.do(t, uid, http.MethodGet, "/media/"+hash, nil).Code
+	}
+	assert.Equal(t, http.StatusOK, serve(alice))
+	assert.Equal(t, http.StatusNotFound, serve(bob))
+	assert.Equal(t, http.StatusNotFound, serve(carol))
+
+	require.Equal(t, http.StatusOK, env.setMember(t, alice, bob, "viewer").Code)
+	env.setVisibility(t, "public")
+	w := env.do(t, carol, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodGet, "/media/"+hash, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "png", w.Body.String())
+	assert.Equal(t, http.StatusOK, serve(carol))
+
+	// 失去读取权限后不能再获取，其他用户的媒体文件也不能通过 item 获取
+	env.setVisibility(t, "private")
+	assert.Equal(t, http.StatusNotFound, serve(carol))
+	require.NoError(t, env.db.Model(&model.Media{}).Where("hash = ?", hash).Update("user_id", bob).Error)
+	assert.Equal(t, http.StatusOK, serve(bob), "bob owns the media now")
+	assert.Equal(t, http.StatusNotFound, serve(alice), "the media does not belong to the item creator")
+}
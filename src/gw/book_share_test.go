@@ -0,0 +1,257 @@
+package gw_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/gw"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+const carol utils.UInt64 = 3003
+
+func decodeData[T any](t *testing.T, body []byte) T {
+	var resp struct {
+		Data T `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(body, &resp), string(body))
+	return resp.Data
+}
+
+func (env *testEnv) setVisibility(t *testing.T, visibility string) map[string]any {
+	w := env.do(t, alice, http.MethodPut, fmt.Sprintf("/books/%d/visibility", aliceBook), map[string]any{"visibility": visibility})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[map[string]any](t, w.Body.Bytes())
+}
+
+func (env *testEnv) listBooks(t *testing.T, uid utils.UInt64, path string) []map[string]any {
+	w := env.do(t, uid, http.MethodGet, path, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[[]map[string]any](t, w.Body.Bytes())
+}
+
+func TestBookShare_PrivateByDefault(t *testing.T) {
+	env := setupEnv(t)
+
+	assert.Empty(t, env.listBooks(t, bob, "/books/public"))
+	w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// 只有所有者可以修改可见性
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/books/%d/visibility", aliceBook), map[string]any{"visibility": "public"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodPut, fmt.Sprintf("/books/%d/visibility", aliceBook), map[string]any{"visibility": "everyone"})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
+
+func TestBookShare_UnlistedSubscription(t *testing.T) {
+	env := setupEnv(t)
+
+	share := env.setVisibility(t, "unlisted")
+	code, _ := share["share_code"].(string)
+	require.NotEmpty(t, code)
+	assert.Equal(t, "/share/books/"+code, share["share_path"])
+	assert.Contains(t, share["short_url"], gw.ShortURLRoute)
+
+	// 不出现在公开目录中，也不能不带分享码订阅
+	assert.Empty(t, env.listBooks(t, bob, "/books/public"))
+	w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), map[string]any{"share_code": "wrong"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	w = env.do(t, bob, http.MethodGet, "/books/shared/"+code, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	book := decodeData[map[string]any](t, w.Body.Bytes())
+	assert.Equal(t, "unlisted", book["visibility"])
+	assert.Nil(t, book["share_code"])
+
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), map[string]any{"share_code": code})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// 订阅的 book 只读地出现在书库中
+	library := env.listBooks(t, bob, "/books")
+	require.Len(t, library, 1)
+	assert.Equal(t, true, library[0]["subscribed"])
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/books/%d", aliceBook), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/items/%d", aliceItem), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/books/%d", aliceBook), map[string]any{"title": "hacked"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "hacked"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, fmt.Sprintf("/books/%d/visibility", aliceBook), map[string]any{"visibility": "public"})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// 改回私有后订阅不再生效，重新分享沿用原来的分享码并恢复订阅
+	env.setVisibility(t, "private")
+	assert.Empty(t, env.listBooks(t, bob, "/books"))
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/books/%d", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodGet, "/books/shared/"+code, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	share = env.setVisibility(t, "unlisted")
+	assert.Equal(t, code, share["share_code"])
+	assert.Len(t, env.listBooks(t, bob, "/books"), 1)
+
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, env.listBooks(t, bob, "/books"))
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestBookShare_PublicCatalogue(t *testing.T) {
+	env := setupEnv(t)
+
+	env.setVisibility(t, "public")
+	w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	books := env.listBooks(t, carol, "/books/public")
+	require.Len(t, books, 1)
+	assert.Equal(t, "public", books[0]["visibility"])
+	assert.EqualValues(t, 1, books[0]["subscribers"])
+	assert.Empty(t, env.listBooks(t, carol, "/books/public?search=nothing"))
+	assert.Len(t, env.listBooks(t, carol, "/books/public?search=alice"), 1)
+
+	// 公开的 book 不订阅也可读，但不在书库中
+	w = env.do(t, carol, http.MethodGet, fmt.Sprintf("/books/%d/items", aliceBook), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, env.listBooks(t, carol, "/books"))
+}
+
+func TestBookShare_SubscriberDungeonReceivesUpstreamEdits(t *testing.T) {
+	env := setupEnv(t)
+
+	env.setVisibility(t, "public")
+	w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/dungeon/dungeons/%d/books", bobDungeon), map[string]any{
+		"books": []string{idStr(aliceBook)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	monsters := func() map[utils.UInt64]model.DungeonMonster {
+		var list []model.DungeonMonster
+		require.NoError(t, env.db.Where("dungeon_id = ?", bobDungeon).Find(&list).Error)
+		ret := make(map[utils.UInt64]model.DungeonMonster, len(list))
+		for _, m := range list {
+			ret[m.ItemID] = m
+		}
+		return ret
+	}
+	require.Contains(t, monsters(), aliceItem)
+
+	// 所有者修改 item，订阅者的复习计划同步修改
+	w = env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "revised"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "revised", monsters()[aliceItem].Description)
+
+	// 所有者向 book 添加和移除 item，订阅者的复习计划同步增减
+	const newItem utils.UInt64 = 3002
+	require.NoError(t, env.db.Create(&model.Item{ID: newItem, CreatorID: alice, Type: model.TyItemFlashCard, Content: "new"}).Error)
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/books/%d/items", aliceBook), map[string]any{
+		"item_ids": []string{idStr(newItem)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, monsters(), newItem)
+
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d/items?item_ids=%d", aliceBook, newItem), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotContains(t, monsters(), newItem)
+	assert.Contains(t, monsters(), aliceItem)
+
+	// 取消订阅不影响已经加入复习计划的 monsters
+	w = env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, monsters(), aliceItem)
+}
+
+// lostAccessEnv bob 把 alice 的 book 加入自己的复习计划，revoke 让 bob 失去 book 的读取权限，
+// 返回 bob 的复习计划中 item 的描述，item 不在复习计划中时返回空
+func lostAccessEnv(t *testing.T, grant, revoke func(env *testEnv)) (*testEnv, func(itemID utils.UInt64) string) {
+	env := setupEnv(t)
+	grant(env)
+	w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/dungeon/dungeons/%d/books", bobDungeon), map[string]any{
+		"books": []string{idStr(aliceBook)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	revoke(env)
+
+	description := func(itemID utils.UInt64) string {
+		var m model.DungeonMonster
+		if err := env.db.Where("dungeon_id = ? AND item_id = ?", bobDungeon, itemID).First(&m).Error; err != nil {
+			return ""
+		}
+		return m.Description
+	}
+	require.Equal(t, "alice secret", description(aliceItem), "the monsters added before are kept")
+
+	// 失去权限后 item 的修改和 book 中新增的 item 都不再同步到 bob 的复习计划
+	w = env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "revised"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	const newItem utils.UInt64 = 3002
+	require.NoError(t, env.db.Create(&model.Item{ID: newItem, CreatorID: alice, Type: model.TyItemFlashCard, Content: "new"}).Error)
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/books/%d/items", aliceBook), map[string]any{
+		"item_ids": []string{idStr(newItem)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "alice secret", description(aliceItem))
+	assert.Empty(t, description(newItem))
+	return env, description
+}
+
+func (env *testEnv) linkedBooks(t *testing.T, dungeonID utils.UInt64) []utils.UInt64 {
+	var ids []utils.UInt64
+	require.NoError(t, env.db.Model(&model.DungeonBook{}).Where("dungeon_id = ?", dungeonID).Pluck("book_id", &ids).Error)
+	return ids
+}
+
+func TestBookShare_UnsubscribeStopsSync(t *testing.T) {
+	env, _ := lostAccessEnv(t, func(env *testEnv) {
+		code := env.setVisibility(t, "unlisted")["share_code"]
+		w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), map[string]any{"share_code": code})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}, func(env *testEnv) {
+		w := env.do(t, bob, http.MethodDelete, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+	assert.Empty(t, env.linkedBooks(t, bobDungeon), "the dungeon no longer references the book")
+}
+
+func TestBookShare_SetPrivateFreezesSync(t *testing.T) {
+	env, description := lostAccessEnv(t, func(env *testEnv) {
+		env.setVisibility(t, "public")
+		w := env.do(t, bob, http.MethodPost, fmt.Sprintf("/books/%d/subscription", aliceBook), nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}, func(env *testEnv) {
+		env.setVisibility(t, "private")
+	})
+
+	// 重新分享后订阅恢复，之后的修改继续同步
+	env.setVisibility(t, "public")
+	w := env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", aliceItem), map[string]any{"content": "shared again"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "shared again", description(aliceItem))
+}
+
+func TestBookShare_RemovedMemberStopsSync(t *testing.T) {
+	env, _ := lostAccessEnv(t, func(env *testEnv) {
+		w := env.setMember(t, alice, bob, "viewer")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}, func(env *testEnv) {
+		w := env.do(t, alice, http.MethodDelete, fmt.Sprintf("/books/%d/members/%d", aliceBook, bob), nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+	assert.Empty(t, env.linkedBooks(t, bobDungeon), "the dungeon no longer references the book")
+}
@@ -0,0 +1,163 @@
+package gw_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// dispatchEvents 把已经提交的事件投递给异步订阅者
+func dispatchEvents(t *testing.T) {
+	_, _, err := model.Events().Dispatch(context.Background())
+	require.NoError(t, err)
+}
+
+// tagMonsters 复习计划中来自标签来源的 monsters 对应的 items
+func (env *testEnv) tagMonsters(t *testing.T, dungeonID utils.UInt64) []utils.UInt64 {
+	var itemIDs []utils.UInt64
+	require.NoError(t, env.db.Model(&model.DungeonMonster{}).
+		Where("dungeon_id = ? AND source_type = ?", dungeonID, model.MonsterSourceTag).
+		Order("item_id ASC").Pluck("item_id", &itemIDs).Error)
+	return itemIDs
+}
+
+func (env *testEnv) retagItem(t *testing.T, itemID utils.UInt64, tags ...string) {
+	w := env.do(t, alice, http.MethodPut, fmt.Sprintf("/items/%d", itemID), map[string]any{"tags": tags})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestDungeonTag_CampaignFollowsItemTags(t *testing.T) {
+	env := setupEnv(t)
+	const item utils.UInt64 = 3002
+	require.NoError(t, env.db.Create(&model.Item{ID: item, CreatorID: alice, Type: model.TyItemFlashCard, Content: "kanji"}).Error)
+
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/dungeons/%d/tags", aliceDungeon), map[string]any{"tags": []string{"lang/ja"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	dispatchEvents(t)
+	assert.Empty(t, env.tagMonsters(t, aliceDungeon))
+
+	// 标签的变化在事务提交后才投递，投递后复习计划得到新的 monster
+	env.retagItem(t, item, "lang/ja/kanji")
+	assert.Empty(t, env.tagMonsters(t, aliceDungeon), "synced after commit by the dispatcher")
+	dispatchEvents(t)
+	assert.Equal(t, []utils.UInt64{item}, env.tagMonsters(t, aliceDungeon))
+
+	// 重复投递是安全的
+	require.NoError(t, model.PublishEvents(context.Background(), env.db, model.ItemTagsChanged{
+		UserID: alice, EntityID: item, EntityType: model.EntityTypeItem, Tags: []string{"lang/ja/kanji"},
+	}))
+	dispatchEvents(t)
+	assert.Equal(t, []utils.UInt64{item}, env.tagMonsters(t, aliceDungeon))
+
+	// 移除标签后 monster 被移除，直接加入的 monster 不受影响
+	env.retagItem(t, item, "lang/en")
+	dispatchEvents(t)
+	assert.Empty(t, env.tagMonsters(t, aliceDungeon))
+	var direct int64
+	require.NoError(t, env.db.Model(&model.DungeonMonster{}).Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).Count(&direct).Error)
+	assert.EqualValues(t, 1, direct)
+	assert.Zero(t, env.outboxSize(t))
+}
+
+// 不再匹配标签来源的 monster 重新匹配时恢复复习进度，被直接加入的 monster 不再随标签移除
+func TestDungeonTag_RetiredMonsterKeepsProgress(t *testing.T) {
+	env := setupEnv(t)
+	const item utils.UInt64 = 3002
+	require.NoError(t, env.db.Create(&model.Item{ID: item, CreatorID: alice, Type: model.TyItemFlashCard, Content: "kanji"}).Error)
+	tagsPath := fmt.Sprintf("/dungeon/dungeons/%d/tags", aliceDungeon)
+	w := env.do(t, alice, http.MethodPost, tagsPath, map[string]any{"tags": []string{"lang/ja"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	env.retagItem(t, item, "lang/ja")
+	dispatchEvents(t)
+	require.Equal(t, []utils.UInt64{item}, env.tagMonsters(t, aliceDungeon))
+
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+		"monster_id": idStr(item), "result": "kill",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	progress := func() model.DungeonMonster {
+		var dm model.DungeonMonster
+		require.NoError(t, env.db.Where("dungeon_id = ? AND item_id = ?", aliceDungeon, item).First(&dm).Error)
+		return dm
+	}
+	practiced := progress()
+	require.Equal(t, uint32(1), practiced.PracticeCount)
+	require.NotZero(t, practiced.Familiarity)
+
+	// item 的标签变化和复习计划的标签来源变化都会移除 monster，重新匹配时复习进度不变
+	env.retagItem(t, item, "lang/en")
+	dispatchEvents(t)
+	assert.Empty(t, env.tagMonsters(t, aliceDungeon))
+	env.retagItem(t, item, "lang/ja")
+	dispatchEvents(t)
+	restored := progress()
+	assert.Equal(t, practiced.PracticeCount, restored.PracticeCount)
+	assert.Equal(t, practiced.Familiarity, restored.Familiarity)
+	assert.True(t, practiced.NextPracticeAt.Equal(restored.NextPracticeAt))
+
+	w = env.do(t, alice, http.MethodDelete, tagsPath, map[string]any{"tags": []string{"lang/ja"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, env.tagMonsters(t, aliceDungeon))
+	w = env.do(t, alice, http.MethodPost, tagsPath, map[string]any{"tags": []string{"lang/ja"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, practiced.PracticeCount, progress().PracticeCount)
+
+	// 直接加入后来源不再是标签，标签不再匹配时保留
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/dungeons/%d/items", aliceDungeon), map[string]any{"items": []string{idStr(item)}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	env.retagItem(t, item, "lang/en")
+	dispatchEvents(t)
+	assert.Equal(t, model.MonsterSourceItem, progress().SourceType)
+	assert.Equal(t, practiced.PracticeCount, progress().PracticeCount)
+}
+
+func TestDungeonTag_TagQueryUpdate(t *testing.T) {
+	env := setupEnv(t)
+	for _, item := range []utils.UInt64{3002, 3003} {
+		require.NoError(t, env.db.Create(&model.Item{ID: item, CreatorID: alice, Type: model.TyItemFlashCard, Content: "word"}).Error)
+	}
+	env.retagItem(t, 3002, "vocab")
+	env.retagItem(t, 3003, "vocab", "hard")
+	dispatchEvents(t)
+
+	path := fmt.Sprintf("/dungeon/dungeons/%d", aliceDungeon)
+	w := env.do(t, alice, http.MethodPut, path, map[string]any{"title": "vocab", "tag_query": "vocab  AND NOT hard"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	updated := decodeData[map[string]any](t, w.Body.Bytes())
+	assert.Equal(t, "vocab AND NOT hard", updated["tag_query"], "normalized")
+	assert.Equal(t, []utils.UInt64{3002}, env.tagMonsters(t, aliceDungeon), "synced in the update")
+
+	// 无效的表达式和没有权限的用户都不会修改复习计划
+	w = env.do(t, alice, http.MethodPut, path, map[string]any{"title": "broken", "tag_query": "(vocab"})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodPut, path, map[string]any{"title": "bob", "tag_query": ""})
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	dungeon := &model.Dungeon{}
+	require.NoError(t, env.db.First(dungeon, aliceDungeon).Error)
+	assert.Equal(t, "vocab", dungeon.Title)
+	assert.Equal(t, "vocab AND NOT hard", dungeon.TagQuery)
+	assert.Equal(t, []utils.UInt64{3002}, env.tagMonsters(t, aliceDungeon))
+
+	// 标签变化后按表达式同步
+	env.retagItem(t, 3003, "vocab")
+	dispatchEvents(t)
+	assert.Equal(t, []utils.UInt64{3002, 3003}, env.tagMonsters(t, aliceDungeon))
+
+	// 清除表达式后来自表达式的 monsters 被移除，直接加入的 monster 不受影响
+	w = env.do(t, alice, http.MethodPut, path, map[string]any{"tag_query": ""})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, env.tagMonsters(t, aliceDungeon))
+	require.NoError(t, env.db.First(dungeon, aliceDungeon).Error)
+	assert.Empty(t, dungeon.TagQuery)
+	assert.Equal(t, "vocab", dungeon.Title, "fields not in the request are kept")
+	var direct int64
+	require.NoError(t, env.db.Model(&model.DungeonMonster{}).Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).Count(&direct).Error)
+	assert.EqualValues(t, 1, direct)
+}
@@ -0,0 +1,161 @@
+package gw_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/khicago/irr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// eventRecorder 记录异步订阅者收到的事件。model.Events 是全局的，订阅只注册一次
+type eventRecorder[E eventbus.Event] struct {
+	mu   sync.Mutex
+	seen []E
+	fail func(E) bool
+}
+
+func (r *eventRecorder[E]) handle(ctx context.Context, e E) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail != nil && r.fail(e) {
+		return irr.Error("subscriber is down")
+	}
+	r.seen = append(r.seen, e)
+	return nil
+}
+
+func (r *eventRecorder[E]) take() []E {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := r.seen
+	r.seen = nil
+	return seen
+}
+
+var (
+	itemCreatedEvents  = &eventRecorder[model.ItemCreated]{}
+	itemUpdatedEvents  = &eventRecorder[model.ItemUpdated]{}
+	bookChangedEvents  = &eventRecorder[model.BookItemsChanged]{fail: func(e model.BookItemsChanged) bool { return e.BookID == 0 }}
+	subscribeTestsOnce sync.Once
+)
+
+func subscribeTestEvents() {
+	subscribeTestsOnce.Do(func() {
+		eventbus.SubscribeAsync(model.Events(), "test", itemCreatedEvents.handle)
+		eventbus.SubscribeAsync(model.Events(), "test", itemUpdatedEvents.handle)
+		eventbus.SubscribeAsync(model.Events(), "test", bookChangedEvents.handle)
+	})
+}
+
+func (env *testEnv) outboxSize(t *testing.T) int64 {
+	var count int64
+	require.NoError(t, env.db.Model(&model.EventOutbox{}).Count(&count).Error)
+	return count
+}
+
+func TestEvents_DeliveredAfterCommit(t *testing.T) {
+	env := setupEnv(t)
+	subscribeTestEvents()
+	itemCreatedEvents.take()
+
+	w := env.do(t, alice, http.MethodPost, "/items", map[string]any{"type": model.TyItemFlashCard, "content": "event item"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	created := decodeData[map[string]any](t, w.Body.Bytes())
+
+	// 同步订阅者 (成就) 已经在事务中处理了事件
+	assert.Equal(t, true, env.achievement(t, alice, 1001)["unlocked"])
+	assert.EqualValues(t, 1, env.outboxSize(t))
+	assert.Empty(t, itemCreatedEvents.take(), "async subscribers run in the dispatcher")
+
+	_, delivered, err := model.Events().Dispatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	seen := itemCreatedEvents.take()
+	require.Len(t, seen, 1)
+	assert.Equal(t, alice, seen[0].UserID)
+	require.Len(t, seen[0].ItemIDs, 1)
+	assert.Equal(t, created["id"], idStr(seen[0].ItemIDs[0]))
+	assert.Zero(t, env.outboxSize(t))
+}
+
+func TestEvents_RolledBackNotDelivered(t *testing.T) {
+	env := setupEnv(t)
+	subscribeTestEvents()
+	itemUpdatedEvents.take()
+	ctx := context.Background()
+
+	err := env.db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, model.PublishEvents(ctx, tx, model.ItemUpdated{UserID: alice, ItemID: aliceItem}))
+		return irr.Error("abort")
+	})
+	require.Error(t, err)
+	assert.Zero(t, env.outboxSize(t))
+
+	fetched, _, err := model.Events().Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, fetched)
+	assert.Empty(t, itemUpdatedEvents.take())
+}
+
+func TestEvents_FailedDeliveryIsRetried(t *testing.T) {
+	env := setupEnv(t)
+	subscribeTestEvents()
+	ctx := context.Background()
+
+	require.NoError(t, env.db.Transaction(func(tx *gorm.DB) error {
+		return model.PublishEvents(ctx, tx, model.BookItemsChanged{UserID: alice, BookID: 0, Added: []utils.UInt64{aliceItem}})
+	}))
+	fetched, delivered, err := model.Events().Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fetched)
+	assert.Zero(t, delivered)
+
+	row := &model.EventOutbox{}
+	require.NoError(t, env.db.First(row).Error)
+	assert.Equal(t, model.BookItemsChanged{}.EventName(), row.Name)
+	assert.Equal(t, 1, row.Attempts)
+	assert.False(t, row.Dead)
+	assert.Contains(t, row.LastError, "subscriber is down")
+	assert.True(t, row.NextAttemptAt.After(time.Now()), "retried with backoff")
+
+	fetched, _, err = model.Events().Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, fetched, "not due yet")
+}
+
+// 事务提交前的并发读会把旧的标签写回缓存，提交后由 item.tags_changed 的异步订阅者再清理一次
+func TestEvents_TagCacheClearedAfterCommit(t *testing.T) {
+	env := setupConcurrentEnv(t)
+	ctx := context.Background()
+	require.NoError(t, model.AddEntityTags(ctx, env.db, alice, model.EntityTypeItem, aliceItem, "old"))
+	dispatchEvents(t)
+
+	require.NoError(t, env.db.Transaction(func(tx *gorm.DB) error {
+		if err := model.AddEntityTags(ctx, tx, alice, model.EntityTypeItem, aliceItem, "new"); err != nil {
+			return err
+		}
+		stale, err := model.TagModel().GetTagsOfEntity(ctx, aliceItem)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"old"}, stale, "read outside the transaction")
+		return nil
+	}))
+
+	cached, err := model.TagModel().GetTagsOfEntity(ctx, aliceItem)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old"}, cached, "stale until the event is delivered")
+
+	dispatchEvents(t)
+	fresh, err := model.TagModel().GetTagsOfEntity(ctx, aliceItem)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"old", "new"}, fresh)
+}
@@ -15,13 +15,18 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/bagaking/memorianexus/doc"
+	"github.com/bagaking/memorianexus/pkg/blobstore"
 )
 
 const (
 	IndexFile = "index.html"
 )
 
-func RegRouter(router *gin.Engine, db *gorm.DB, iamCli *authcli.Cli, APIGroup string, staticFilePath string) {
+func RegRouter(router *gin.Engine, db *gorm.DB, iamCli *authcli.Cli, APIGroup string, staticFilePath string, mediaStore blobstore.Store) {
+	// 层级标签等路径参数中可能包含编码后的 /，路由匹配使用原始路径，参数再做解码
+	router.UseRawPath = true
+	router.UnescapePathValues = true
+
 	router.Use(gzip.Gzip(gzip.DefaultCompression))
 	router.Use(PerformanceMonitor())
 
@@ -32,7 +37,7 @@ func RegRouter(router *gin.Engine, db *gorm.DB, iamCli *authcli.Cli, APIGroup st
 	doc.SwaggerInfo.BasePath = APIGroup
 	group := router.Group(APIGroup)
 	RegisterCallbacks(group)
-	RegisterRoutes(group, db, iamCli)
+	RegisterRoutes(group, db, iamCli.GinMW(), mediaStore)
 
 	// 设置短网址路由
 	SetupShortURLRoutes(router)
@@ -0,0 +1,207 @@
+package gw_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+type idleIncome struct {
+	Rate        uint64       `json:"rate"`
+	NFTRate     uint64       `json:"nft_rate"`
+	MonsterRate uint64       `json:"monster_rate"`
+	Claimable   utils.UInt64 `json:"claimable"`
+	ClaimedAt   time.Time    `json:"claimed_at"`
+	FullAt      time.Time    `json:"full_at"`
+}
+
+type idleClaim struct {
+	Claimed utils.UInt64 `json:"claimed"`
+	Points  struct {
+		Cash utils.UInt64 `json:"cash"`
+		Idle idleIncome   `json:"idle"`
+	} `json:"points"`
+}
+
+// mint 创建用户持有的 NFT 并发布 NFTMinted，与抽卡一样在同一个事务中
+func (env *testEnv) mint(t *testing.T, uid, templateID utils.UInt64) {
+	template, err := model.GetNFTTemplate(templateID)
+	require.NoError(t, err)
+	ctx := context.Background()
+	id, err := utils.GenIDU64(ctx)
+	require.NoError(t, err)
+	require.NoError(t, env.db.Transaction(func(tx *gorm.DB) error {
+		nft := &model.NFT{ID: id, OwnerID: uid, TemplateID: templateID, Rarity: template.Rarity, Source: model.NFTSourceDraw}
+		if err := tx.Create(nft).Error; err != nil {
+			return err
+		}
+		return model.PublishEvents(ctx, tx, model.NFTMinted{OwnerID: uid, NFTID: id, TemplateID: templateID, Rarity: template.Rarity, Source: nft.Source})
+	}))
+}
+
+func (env *testEnv) idle(t *testing.T, uid utils.UInt64) idleIncome {
+	w := env.do(t, uid, http.MethodGet, "/profile/points", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[struct {
+		Idle idleIncome `json:"idle"`
+	}](t, w.Body.Bytes()).Idle
+}
+
+func (env *testEnv) claim(t *testing.T, uid utils.UInt64, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/profile/points/claim", nil)
+	req.Header.Set("X-User-ID", idStr(uid))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	return w
+}
+
+// rewind 把挂机收益的时间提前 d，相当于过去了 d
+func (env *testEnv) rewind(t *testing.T, uid utils.UInt64, d time.Duration) {
+	income := &model.IdleIncome{}
+	require.NoError(t, env.db.Where("user_id = ?", uid).First(income).Error)
+	require.NoError(t, env.db.Model(income).Updates(map[string]any{
+		"settled_at": income.SettledAt.Add(-d),
+		"claimed_at": income.ClaimedAt.Add(-d),
+	}).Error)
+}
+
+func TestIdleIncome_AccruesOnReadAndClaims(t *testing.T) {
+	env := setupEnv(t)
+	assert.Zero(t, env.idle(t, alice).Rate, "no idle nfts or mastered monsters")
+
+	env.mint(t, alice, 402) // 20 cash / 小时
+	env.mint(t, alice, 101) // 不是挂机类
+	idle := env.idle(t, alice)
+	assert.Equal(t, uint64(20), idle.Rate)
+	assert.Equal(t, uint64(20), idle.NFTRate)
+	assert.Zero(t, idle.Claimable)
+
+	env.rewind(t, alice, 2*time.Hour)
+	assert.Equal(t, utils.UInt64(40), env.idle(t, alice).Claimable, "accrued lazily on read")
+	assert.Zero(t, env.balance(t, alice).Cash.Raw(), "nothing is credited before the claim")
+
+	w := env.claim(t, alice, "claim:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	claimed := decodeData[idleClaim](t, w.Body.Bytes())
+	assert.Equal(t, utils.UInt64(40), claimed.Claimed)
+	assert.Equal(t, utils.UInt64(40), claimed.Points.Cash)
+	assert.Zero(t, claimed.Points.Idle.Claimable)
+	assert.Equal(t, utils.UInt64(40), env.balance(t, alice).Cash)
+
+	// 重复的领取返回第一次的数量，不重复发放
+	w = env.claim(t, alice, "claim:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, utils.UInt64(40), decodeData[idleClaim](t, w.Body.Bytes()).Claimed)
+	assert.Equal(t, utils.UInt64(40), env.balance(t, alice).Cash)
+
+	w = env.claim(t, alice, "claim:2")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Zero(t, decodeData[idleClaim](t, w.Body.Bytes()).Claimed, "just claimed")
+
+	var txs []*model.PointTransaction
+	require.NoError(t, env.db.Where("user_id = ? AND reason = ?", alice, model.PointReasonIdleClaim).Find(&txs).Error)
+	require.Len(t, txs, 1)
+	assert.EqualValues(t, 40, txs[0].Delta)
+}
+
+func TestIdleIncome_IsCapped(t *testing.T) {
+	env := setupEnv(t)
+	for i := 0; i < 6; i++ {
+		env.mint(t, alice, 402)
+	}
+	idle := env.idle(t, alice)
+	assert.Equal(t, uint64(6*20), idle.NFTRate)
+	assert.Equal(t, uint64(model.MaxIdleIncomePerHour), idle.Rate)
+
+	env.rewind(t, alice, 3*model.IdleIncomeMaxHours*time.Hour)
+	idle = env.idle(t, alice)
+	assert.Equal(t, utils.UInt64(model.MaxIdleIncomePerHour*model.IdleIncomeMaxHours), idle.Claimable)
+	assert.True(t, idle.FullAt.Before(time.Now()))
+
+	w := env.claim(t, alice, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	claimed := decodeData[idleClaim](t, w.Body.Bytes())
+	assert.Equal(t, utils.UInt64(model.MaxIdleIncomePerHour*model.IdleIncomeMaxHours), claimed.Claimed)
+	assert.True(t, claimed.Points.Idle.FullAt.After(time.Now()), "accrues again after the claim")
+}
+
+// 产出变化时先按原来的产出结算，新的产出不会追溯
+func TestIdleIncome_RateChangesSettleFirst(t *testing.T) {
+	env := setupEnv(t)
+	env.mint(t, alice, 402)
+	env.rewind(t, alice, time.Hour)
+
+	env.mint(t, alice, 202) // 3 cash / 小时
+	idle := env.idle(t, alice)
+	assert.Equal(t, uint64(23), idle.Rate)
+	assert.Equal(t, utils.UInt64(20), idle.Claimable)
+
+	// 掌握的 monster 每 10 个产出 1 cash / 小时
+	for i := 1; i < model.IdleMonstersPerCash; i++ {
+		itemID := utils.UInt64(9000 + i)
+		require.NoError(t, env.db.Create(&model.Item{ID: itemID, CreatorID: alice, Type: model.TyItemFlashCard, Content: "mastered"}).Error)
+		require.NoError(t, env.db.Create(&model.UserMonster{UserID: alice, ItemID: itemID, Familiarity: model.MasteredFamiliarity}).Error)
+	}
+	require.NoError(t, env.db.Model(&model.DungeonMonster{}).Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).
+		Update("familiarity", model.MasteredFamiliarity-1).Error)
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+		"monster_id": idStr(aliceItem), "result": "complete",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	idle = env.idle(t, alice)
+	assert.Equal(t, uint64(1), idle.MonsterRate)
+	assert.Equal(t, uint64(24), idle.Rate)
+	assert.Equal(t, utils.UInt64(20), idle.Claimable)
+
+	// 删除掌握的 item 后不再计入
+	w = env.do(t, alice, http.MethodDelete, fmt.Sprintf("/items/%d", 9001), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	idle = env.idle(t, alice)
+	assert.Zero(t, idle.MonsterRate)
+	assert.Equal(t, uint64(23), idle.Rate)
+	income := &model.IdleIncome{}
+	require.NoError(t, env.db.Where("user_id = ?", alice).First(income).Error)
+	assert.Zero(t, income.MonsterRate, "refreshed when the item is deleted")
+}
+
+// 同一个 item 在其他 dungeon 中已经掌握，在这个 dungeon 中作答后 user_monsters 中的熟练度降低，不再计入掌握的 monster
+func TestIdleIncome_MasteredInAnotherDungeon(t *testing.T) {
+	env := setupEnv(t)
+	for i := 1; i < model.IdleMonstersPerCash; i++ {
+		itemID := utils.UInt64(9000 + i)
+		require.NoError(t, env.db.Create(&model.Item{ID: itemID, CreatorID: alice, Type: model.TyItemFlashCard, Content: "mastered"}).Error)
+		require.NoError(t, env.db.Create(&model.UserMonster{UserID: alice, ItemID: itemID, Familiarity: model.MasteredFamiliarity}).Error)
+	}
+	require.NoError(t, env.db.Create(&model.UserMonster{UserID: alice, ItemID: aliceItem, Familiarity: model.MasteredFamiliarity}).Error)
+	require.NoError(t, env.db.Model(&model.DungeonMonster{}).Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).
+		Update("familiarity", 10).Error)
+	assert.Equal(t, uint64(1), env.idle(t, alice).MonsterRate)
+
+	// dungeon 中的熟练度没有跨过掌握的阈值，但 user_monsters 中的跨过了
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+		"monster_id": idStr(aliceItem), "result": "miss",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	um := &model.UserMonster{}
+	require.NoError(t, env.db.Where("user_id = ? AND item_id = ?", alice, aliceItem).First(um).Error)
+	require.Less(t, um.Familiarity, model.MasteredFamiliarity)
+
+	idle := env.idle(t, alice)
+	assert.Zero(t, idle.MonsterRate)
+	assert.Zero(t, idle.Rate)
+}
@@ -0,0 +1,175 @@
+package gw_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// luckyTemplate 每次作答都获得一张抽卡券，只在测试的卡池定义中存在
+const luckyTemplate utils.UInt64 = 901
+
+type submitResult struct {
+	PointsUpdate struct {
+		Cash       utils.UInt64 `json:"cash"`
+		DrawTicket utils.UInt64 `json:"draw_ticket"`
+	} `json:"points_update"`
+	PointsBreakdown struct {
+		Base       utils.UInt64 `json:"base"`
+		Bonus      utils.UInt64 `json:"bonus"`
+		DrawTicket utils.UInt64 `json:"draw_ticket"`
+		NFTIDs     []string     `json:"nft_ids"`
+	} `json:"points_breakdown"`
+}
+
+// loadTestCatalog 在默认的卡池定义中加入 luckyTemplate，测试结束后恢复
+func loadTestCatalog(t *testing.T) {
+	data, err := os.ReadFile("../model/nfts.yaml")
+	require.NoError(t, err)
+	lucky := `
+  - id: 901
+    name: 必中的骰子
+    description: 每次作答获得一张抽卡券
+    rarity: legendary
+    effect: { type: extra_draw, value: 100 }
+`
+	require.NoError(t, model.LoadNFTCatalog(append(data, lucky...)))
+	t.Cleanup(func() { require.NoError(t, model.LoadNFTCatalog(data)) })
+}
+
+// giveNFT 直接创建用户持有的 NFT
+func (env *testEnv) giveNFT(t *testing.T, uid, templateID utils.UInt64) string {
+	template, err := model.GetNFTTemplate(templateID)
+	require.NoError(t, err)
+	id, err := utils.GenIDU64(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, env.db.Create(&model.NFT{ID: id, OwnerID: uid, TemplateID: templateID, Rarity: template.Rarity, Source: model.NFTSourceDraw}).Error)
+	return idStr(id)
+}
+
+func TestNFTEffect_EquippedNFTsApplyToSubmit(t *testing.T) {
+	env := setupEnv(t)
+	loadTestCatalog(t)
+	bonus := env.giveNFT(t, alice, 401) // cash +50%
+	lucky := env.giveNFT(t, alice, luckyTemplate)
+
+	w := env.submit(t, map[string]any{"monster_id": idStr(aliceItem), "result": "kill", "attempt_id": "e-1"}, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	plain := decodeData[submitResult](t, w.Body.Bytes())
+	assert.Zero(t, plain.PointsBreakdown.Bonus, "nfts are not equipped")
+	assert.Equal(t, plain.PointsBreakdown.Base, plain.PointsUpdate.Cash)
+	assert.Zero(t, plain.PointsUpdate.DrawTicket)
+
+	for _, id := range []string{bonus, lucky} {
+		w = env.do(t, alice, http.MethodPost, "/nft/nfts/"+id+"/equip", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.NotEmpty(t, decodeData[map[string]any](t, w.Body.Bytes())["equipped_at"])
+	}
+	w = env.do(t, alice, http.MethodGet, "/nft/effects", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	effects := decodeData[map[string]any](t, w.Body.Bytes())
+	assert.Equal(t, float64(50), effects["bonus_percent"])
+	assert.Equal(t, float64(100), effects["extra_draw_percent"])
+	assert.Equal(t, []any{bonus, lucky}, effects["nft_ids"])
+
+	cash := env.balance(t, alice).Cash
+	w = env.submit(t, map[string]any{"monster_id": idStr(aliceItem), "result": "kill", "attempt_id": "e-2"}, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	boosted := decodeData[submitResult](t, w.Body.Bytes())
+	base := boosted.PointsBreakdown.Base
+	require.NotZero(t, base)
+	assert.Equal(t, base*50/100, boosted.PointsBreakdown.Bonus)
+	assert.Equal(t, base+boosted.PointsBreakdown.Bonus, boosted.PointsUpdate.Cash)
+	assert.Equal(t, utils.UInt64(1), boosted.PointsUpdate.DrawTicket)
+	assert.Equal(t, []string{bonus, lucky}, boosted.PointsBreakdown.NFTIDs)
+
+	balance := env.balance(t, alice)
+	assert.Equal(t, cash+boosted.PointsUpdate.Cash, balance.Cash)
+	assert.Equal(t, uint64(1), balance.DrawTicket.Raw())
+
+	// 重复的提交不重复发放积分和抽卡券
+	w = env.submit(t, map[string]any{"monster_id": idStr(aliceItem), "result": "kill", "attempt_id": "e-2"}, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, boosted, decodeData[submitResult](t, w.Body.Bytes()))
+	assert.Equal(t, balance, env.balance(t, alice))
+
+	// 卸下后缓存的特效失效
+	w = env.do(t, alice, http.MethodDelete, "/nft/nfts/"+bonus+"/equip", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, decodeData[map[string]any](t, w.Body.Bytes())["equipped_at"])
+	w = env.do(t, alice, http.MethodGet, "/nft/effects", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, float64(0), decodeData[map[string]any](t, w.Body.Bytes())["bonus_percent"])
+}
+
+func TestNFTEffect_EquipSlotsAreLimited(t *testing.T) {
+	env := setupEnv(t)
+	ids := make([]string, 0, model.MaxEquippedNFTs+1)
+	for i := 0; i <= model.MaxEquippedNFTs; i++ {
+		ids = append(ids, env.giveNFT(t, alice, 101))
+	}
+
+	for _, id := range ids[:model.MaxEquippedNFTs] {
+		require.Equal(t, http.StatusOK, env.do(t, alice, http.MethodPost, "/nft/nfts/"+id+"/equip", nil).Code)
+	}
+	assert.Equal(t, http.StatusOK, env.do(t, alice, http.MethodPost, "/nft/nfts/"+ids[0]+"/equip", nil).Code,
+		"equipping an equipped nft changes nothing")
+	assert.Equal(t, http.StatusConflict, env.do(t, alice, http.MethodPost, "/nft/nfts/"+ids[model.MaxEquippedNFTs]+"/equip", nil).Code)
+	assert.Equal(t, http.StatusNotFound, env.do(t, bob, http.MethodPost, "/nft/nfts/"+ids[0]+"/equip", nil).Code,
+		"other users can not equip the nft")
+	assert.Equal(t, http.StatusNotFound, env.do(t, bob, http.MethodDelete, "/nft/nfts/"+ids[0]+"/equip", nil).Code)
+
+	w := env.do(t, alice, http.MethodGet, "/nft/effects", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, float64(5*model.MaxEquippedNFTs), decodeData[map[string]any](t, w.Body.Bytes())["bonus_percent"])
+
+	require.Equal(t, http.StatusOK, env.do(t, alice, http.MethodDelete, "/nft/nfts/"+ids[0]+"/equip", nil).Code)
+	assert.Equal(t, http.StatusOK, env.do(t, alice, http.MethodPost, "/nft/nfts/"+ids[model.MaxEquippedNFTs]+"/equip", nil).Code)
+}
+
+func TestNFTEffect_UnlockGatesDungeonTypes(t *testing.T) {
+	env := setupEnv(t)
+	for _, uid := range []utils.UInt64{alice, bob} {
+		require.NoError(t, env.db.Create(&model.Profile{ID: uid, Email: idStr(uid) + "@example.com"}).Error)
+	}
+	body := map[string]any{"type": "instance", "title": "rift"}
+
+	w := env.do(t, alice, http.MethodPost, "/dungeon/dungeons", body)
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodPut, "/dungeon/dungeons/"+idStr(aliceDungeon), map[string]any{"type": "instance"})
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+	rift := env.giveNFT(t, alice, 301)
+	require.Equal(t, http.StatusOK, env.do(t, alice, http.MethodPost, "/nft/nfts/"+rift+"/equip", nil).Code)
+	w = env.do(t, alice, http.MethodPost, "/dungeon/dungeons", body)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, float64(0x21), decodeData[map[string]any](t, w.Body.Bytes())["type"])
+
+	assert.Equal(t, http.StatusForbidden, env.do(t, bob, http.MethodPost, "/dungeon/dungeons", body).Code,
+		"the unlock belongs to the owner")
+	assert.Equal(t, http.StatusOK, env.do(t, bob, http.MethodPost, "/dungeon/dungeons", map[string]any{"type": "campaign", "title": "plain"}).Code)
+}
+
+func TestNFTEffect_DrawWithTickets(t *testing.T) {
+	env := setupEnv(t)
+	env.grant(t, alice, model.CurrencyDrawTicket, 2)
+
+	assert.Equal(t, http.StatusBadRequest, env.draw(t, alice, map[string]any{"pool_id": "2", "use_ticket": true}, "").Code,
+		"the gem pool does not accept tickets")
+	assert.Equal(t, http.StatusBadRequest, env.draw(t, alice, map[string]any{"count": 3, "use_ticket": true}, "").Code,
+		"insufficient tickets")
+
+	w := env.draw(t, alice, map[string]any{"count": 2, "use_ticket": true}, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, decodeData[drawResult](t, w.Body.Bytes()).NFTs, 2)
+	balance := env.balance(t, alice)
+	assert.Zero(t, balance.DrawTicket.Raw())
+	assert.Zero(t, balance.Cash.Raw(), "the draw is paid with tickets")
+}
@@ -0,0 +1,419 @@
+package gw_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+type nftTrade struct {
+	ID       string               `json:"id"`
+	SellerID string               `json:"seller_id"`
+	BuyerID  string               `json:"buyer_id"`
+	NFTID    string               `json:"nft_id"`
+	Currency model.Currency       `json:"currency"`
+	Price    uint64               `json:"price"`
+	Status   model.NFTTradeStatus `json:"status"`
+}
+
+type nftShopItem struct {
+	ID     string `json:"id"`
+	Price  uint64 `json:"price"`
+	OnSale bool   `json:"on_sale"`
+	Stock  uint64 `json:"stock"`
+	Sold   uint64 `json:"sold"`
+}
+
+// doKey 与 do 相同，key 不为空时带上 Idempotency-Key 头
+func (env *testEnv) doKey(t *testing.T, uid utils.UInt64, method, path string, body any, key string) *httptest.ResponseRecorder {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest(method, "/api/v1"+path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", idStr(uid))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	return w
+}
+
+func (env *testEnv) list(t *testing.T, uid utils.UInt64, nftID string, price uint64) nftTrade {
+	w := env.do(t, uid, http.MethodPost, "/nft/trades", map[string]any{"nft_id": nftID, "price": price})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[nftTrade](t, w.Body.Bytes())
+}
+
+func (env *testEnv) ownerOf(t *testing.T, nftID string) utils.UInt64 {
+	nft := &model.NFT{}
+	require.NoError(t, env.db.Where("id = ?", nftID).First(nft).Error)
+	return nft.OwnerID
+}
+
+func (env *testEnv) reconcile(t *testing.T, uids ...utils.UInt64) {
+	discrepancies, err := model.ReconcilePoints(context.Background(), env.db, uids...)
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+}
+
+// loadShopCatalog 把默认定义中的商店换成 shops，测试结束后恢复
+func loadShopCatalog(t *testing.T, shops string) {
+	data, err := os.ReadFile("../model/nfts.yaml")
+	require.NoError(t, err)
+	start, end := bytes.Index(data, []byte("\nshops:\n")), bytes.Index(data, []byte("\ntemplates:\n"))
+	require.True(t, start > 0 && end > start)
+	catalog := string(data[:start]) + "\nshops:\n" + shops + string(data[end:])
+	require.NoError(t, model.LoadNFTCatalog([]byte(catalog)))
+	t.Cleanup(func() { require.NoError(t, model.LoadNFTCatalog(data)) })
+}
+
+func TestNFTMarket_BuyMovesPointsAndOwnership(t *testing.T) {
+	env := setupEnv(t)
+	bonus := env.giveNFT(t, alice, 401) // cash +50%
+	require.Equal(t, http.StatusOK, env.do(t, alice, http.MethodPost, "/nft/nfts/"+bonus+"/equip", nil).Code)
+
+	assert.Equal(t, http.StatusBadRequest, env.do(t, alice, http.MethodPost, "/nft/trades", map[string]any{"nft_id": bonus, "price": 0}).Code)
+	assert.Equal(t, http.StatusBadRequest, env.do(t, alice, http.MethodPost, "/nft/trades", map[string]any{"nft_id": bonus, "price": 10, "currency": "vip_score"}).Code)
+	assert.Equal(t, http.StatusNotFound, env.do(t, bob, http.MethodPost, "/nft/trades", map[string]any{"nft_id": bonus, "price": 10}).Code,
+		"only the owner can list the nft")
+
+	trade := env.list(t, alice, bonus, 50)
+	assert.Equal(t, model.NFTTradeOpen, trade.Status)
+	assert.Equal(t, model.CurrencyCash, trade.Currency)
+
+	// 挂单中的 NFT 由市场托管，特效不再生效
+	assert.Equal(t, model.NFTEscrowOwner, env.ownerOf(t, bonus))
+	assert.Equal(t, http.StatusNotFound, env.do(t, alice, http.MethodGet, "/nft/nfts/"+bonus, nil).Code)
+	assert.Equal(t, http.StatusNotFound, env.do(t, alice, http.MethodPost, "/nft/nfts/"+bonus+"/equip", nil).Code)
+	w := env.do(t, alice, http.MethodGet, "/nft/effects", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, float64(0), decodeData[map[string]any](t, w.Body.Bytes())["bonus_percent"])
+	assert.Equal(t, http.StatusNotFound, env.do(t, alice, http.MethodPost, "/nft/trades", map[string]any{"nft_id": bonus, "price": 10}).Code,
+		"the nft can not be listed twice")
+
+	assert.Equal(t, http.StatusBadRequest, env.doKey(t, alice, http.MethodPost, "/nft/trades/"+trade.ID+"/buy", nil, "").Code, "own listing")
+	assert.Equal(t, http.StatusBadRequest, env.doKey(t, bob, http.MethodPost, "/nft/trades/"+trade.ID+"/buy", nil, "").Code, "insufficient cash")
+	assert.Equal(t, http.StatusNotFound, env.doKey(t, bob, http.MethodPost, "/nft/trades/"+idStr(missingID)+"/buy", nil, "").Code)
+
+	env.grant(t, bob, model.CurrencyCash, 80)
+	w = env.doKey(t, bob, http.MethodPost, "/nft/trades/"+trade.ID+"/buy", nil, "buy:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	bought := decodeData[struct {
+		Trade nftTrade       `json:"trade"`
+		NFT   map[string]any `json:"nft"`
+	}](t, w.Body.Bytes())
+	assert.Equal(t, model.NFTTradeSold, bought.Trade.Status)
+	assert.Equal(t, idStr(bob), bought.Trade.BuyerID)
+	assert.Equal(t, bonus, bought.NFT["id"])
+	assert.Empty(t, bought.NFT["equipped_at"], "the nft is unequipped")
+	assert.Equal(t, bob, env.ownerOf(t, bonus))
+	assert.Equal(t, utils.UInt64(30), env.balance(t, bob).Cash)
+	assert.Equal(t, utils.UInt64(50), env.balance(t, alice).Cash)
+
+	// 重复的购买返回第一次的结果，不重复扣款
+	w = env.doKey(t, bob, http.MethodPost, "/nft/trades/"+trade.ID+"/buy", nil, "buy:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, utils.UInt64(30), env.balance(t, bob).Cash)
+
+	assert.Equal(t, http.StatusConflict, env.doKey(t, bob, http.MethodPost, "/nft/trades/"+trade.ID+"/buy", nil, "buy:2").Code)
+	assert.Equal(t, http.StatusConflict, env.do(t, alice, http.MethodDelete, "/nft/trades/"+trade.ID, nil).Code)
+	assert.Equal(t, http.StatusOK, env.do(t, bob, http.MethodGet, "/nft/nfts/"+bonus, nil).Code)
+
+	w = env.do(t, bob, http.MethodGet, "/nft/trades", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, decodeData[[]nftTrade](t, w.Body.Bytes()), "only open trades by default")
+	w = env.do(t, bob, http.MethodGet, "/nft/trades?status=sold&seller_id="+idStr(alice), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	sold := decodeData[[]nftTrade](t, w.Body.Bytes())
+	require.Len(t, sold, 1)
+	assert.Equal(t, trade.ID, sold[0].ID)
+	assert.Equal(t, http.StatusBadRequest, env.do(t, bob, http.MethodGet, "/nft/trades?status=unknown", nil).Code)
+
+	env.reconcile(t, alice, bob)
+}
+
+func TestNFTMarket_CancelReleasesEscrow(t *testing.T) {
+	env := setupEnv(t)
+	env.mint(t, alice, 402) // 20 cash / 小时
+	var nft model.NFT
+	require.NoError(t, env.db.Where("owner_id = ?", alice).First(&nft).Error)
+	id := idStr(nft.ID)
+
+	trade := env.list(t, alice, id, 100)
+	assert.Zero(t, env.idle(t, alice).Rate, "escrowed nfts do not produce idle income")
+
+	assert.Equal(t, http.StatusNotFound, env.do(t, bob, http.MethodDelete, "/nft/trades/"+trade.ID, nil).Code)
+	w := env.do(t, alice, http.MethodDelete, "/nft/trades/"+trade.ID, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, model.NFTTradeCancelled, decodeData[nftTrade](t, w.Body.Bytes()).Status)
+	assert.Equal(t, alice, env.ownerOf(t, id))
+	assert.Equal(t, uint64(20), env.idle(t, alice).Rate)
+
+	assert.Equal(t, http.StatusConflict, env.do(t, alice, http.MethodDelete, "/nft/trades/"+trade.ID, nil).Code)
+	env.grant(t, bob, model.CurrencyCash, 100)
+	assert.Equal(t, http.StatusConflict, env.doKey(t, bob, http.MethodPost, "/nft/trades/"+trade.ID+"/buy", nil, "").Code)
+	assert.Equal(t, utils.UInt64(100), env.balance(t, bob).Cash)
+
+	w = env.do(t, bob, http.MethodGet, "/nft/trades/"+trade.ID, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, model.NFTTradeCancelled, decodeData[nftTrade](t, w.Body.Bytes()).Status)
+}
+
+func TestNFTMarket_Transfer(t *testing.T) {
+	env := setupEnv(t)
+	for _, uid := range []utils.UInt64{alice, bob} {
+		require.NoError(t, env.db.Create(&model.Profile{ID: uid, Email: idStr(uid) + "@example.com"}).Error)
+	}
+	env.mint(t, alice, 402)
+	var nft model.NFT
+	require.NoError(t, env.db.Where("owner_id = ?", alice).First(&nft).Error)
+	id := idStr(nft.ID)
+	require.Equal(t, http.StatusOK, env.do(t, alice, http.MethodPost, "/nft/nfts/"+id+"/equip", nil).Code)
+
+	assert.Equal(t, http.StatusBadRequest, env.do(t, alice, http.MethodPost, "/nft/transfer", map[string]any{"nft_id": id, "to_user_id": idStr(alice)}).Code)
+	assert.Equal(t, http.StatusNotFound, env.do(t, alice, http.MethodPost, "/nft/transfer", map[string]any{"nft_id": id, "to_user_id": idStr(missingID)}).Code)
+	assert.Equal(t, http.StatusNotFound, env.do(t, bob, http.MethodPost, "/nft/transfer", map[string]any{"nft_id": id, "to_user_id": idStr(alice)}).Code)
+
+	w := env.do(t, alice, http.MethodPost, "/nft/transfer", map[string]any{"nft_id": id, "to_user_id": idStr(bob)})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, decodeData[map[string]any](t, w.Body.Bytes())["equipped_at"])
+	assert.Equal(t, bob, env.ownerOf(t, id))
+	assert.Zero(t, env.idle(t, alice).Rate)
+	assert.Equal(t, uint64(20), env.idle(t, bob).Rate)
+
+	w = env.do(t, alice, http.MethodGet, "/nft/effects", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, decodeData[map[string]any](t, w.Body.Bytes())["nft_ids"])
+}
+
+func TestNFTShop_StockAndPriceSchedule(t *testing.T) {
+	env := setupEnv(t)
+	now := time.Now().UTC()
+	at := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+	loadShopCatalog(t, fmt.Sprintf(`
+  - id: 7
+    name: test
+    items:
+      - { id: 71, template_id: 402, currency: cash, stock: 2, prices: [{ from: %s, price: 30 }, { from: %s, price: 10 }] }
+      - { id: 72, template_id: 101, currency: gem, prices: [{ from: %s, price: 5 }] }
+      - { id: 73, template_id: 101, currency: cash, prices: [{ from: %s, price: 5 }, { from: %s, price: 0 }] }
+`, at(-48*time.Hour), at(-time.Hour), at(time.Hour), at(-48*time.Hour), at(-time.Hour)))
+
+	w := env.do(t, alice, http.MethodGet, "/nft/shops/7", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	items := decodeData[struct {
+		Items []nftShopItem `json:"items"`
+	}](t, w.Body.Bytes()).Items
+	require.Len(t, items, 3)
+	assert.Equal(t, nftShopItem{ID: "71", Price: 10, OnSale: true, Stock: 2}, items[0], "the latest price in effect")
+	assert.False(t, items[1].OnSale, "not on sale yet")
+	assert.False(t, items[2].OnSale, "off sale")
+	assert.Equal(t, http.StatusNotFound, env.do(t, alice, http.MethodGet, "/nft/shops/"+idStr(missingID), nil).Code)
+
+	buy := func(item, key string) *httptest.ResponseRecorder {
+		return env.doKey(t, alice, http.MethodPost, "/nft/shops/7/buy", map[string]any{"item_id": item}, key)
+	}
+	assert.Equal(t, http.StatusBadRequest, buy("71", "").Code, "insufficient cash")
+	env.grant(t, alice, model.CurrencyCash, 100)
+
+	w = buy("71", "shop:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	order := decodeData[struct {
+		Order map[string]any `json:"order"`
+		NFT   map[string]any `json:"nft"`
+	}](t, w.Body.Bytes())
+	assert.Equal(t, "shop", order.NFT["source"])
+	assert.Equal(t, utils.UInt64(90), env.balance(t, alice).Cash)
+	assert.Equal(t, uint64(20), env.idle(t, alice).Rate, "minted nfts produce idle income")
+
+	w = buy("71", "shop:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, order.NFT["id"], decodeData[map[string]map[string]any](t, w.Body.Bytes())["nft"]["id"])
+
+	require.Equal(t, http.StatusOK, buy("71", "shop:2").Code)
+	assert.Equal(t, http.StatusConflict, buy("71", "shop:3").Code, "sold out")
+	assert.Equal(t, http.StatusConflict, buy("72", "").Code)
+	assert.Equal(t, http.StatusConflict, buy("73", "").Code)
+	assert.Equal(t, http.StatusNotFound, buy(idStr(missingID), "").Code)
+	assert.Equal(t, utils.UInt64(80), env.balance(t, alice).Cash, "failed purchases are not charged")
+
+	// 商品下架后重试仍然返回第一次的购买，key 不能用于购买其他商品
+	loadShopCatalog(t, fmt.Sprintf(`
+  - id: 7
+    name: test
+    items:
+      - { id: 71, template_id: 402, currency: cash, stock: 2, prices: [{ from: %s, price: 0 }] }
+      - { id: 74, template_id: 101, currency: cash, prices: [{ from: %s, price: 5 }] }
+`, at(-time.Hour), at(-time.Hour)))
+	w = buy("71", "shop:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, order.NFT["id"], decodeData[map[string]map[string]any](t, w.Body.Bytes())["nft"]["id"])
+	assert.Equal(t, http.StatusConflict, buy("74", "shop:1").Code, "the key is used by another item")
+	assert.Equal(t, utils.UInt64(80), env.balance(t, alice).Cash)
+
+	var count int64
+	require.NoError(t, env.db.Model(&model.NFT{}).Where("owner_id = ?", alice).Count(&count).Error)
+	assert.EqualValues(t, 2, count)
+	env.reconcile(t, alice)
+}
+
+func TestNFTMarket_ConcurrentBuysSellOnce(t *testing.T) {
+	env := setupConcurrentEnv(t)
+	const buyers = 8
+	nftID := env.giveNFT(t, alice, 101)
+	trade := env.list(t, alice, nftID, 40)
+	for i := 1; i <= buyers; i++ {
+		env.grant(t, utils.UInt64(7000+i), model.CurrencyCash, 100)
+	}
+
+	codes := make([]int, buyers+1)
+	var wg sync.WaitGroup
+	for i := 1; i <= buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = env.doKey(t, utils.UInt64(7000+i), http.MethodPost, "/nft/trades/"+trade.ID+"/buy", nil, "").Code
+		}(i)
+	}
+	// 卖家同时撤单
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		codes[0] = env.do(t, alice, http.MethodDelete, "/nft/trades/"+trade.ID, nil).Code
+	}()
+	wg.Wait()
+
+	succeeded := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
+	}
+	assert.Equal(t, 1, succeeded, "only one purchase or the cancel wins")
+
+	tradeID, err := strconv.ParseUint(trade.ID, 10, 64)
+	require.NoError(t, err)
+	closed, err := model.GetNFTTrade(context.Background(), env.db, utils.UInt64(tradeID))
+	require.NoError(t, err)
+	var charged uint64
+	for i := 1; i <= buyers; i++ {
+		charged += 100 - env.balance(t, utils.UInt64(7000+i)).Cash.Raw()
+	}
+	if closed.Status == model.NFTTradeSold {
+		assert.Equal(t, closed.BuyerID, env.ownerOf(t, nftID))
+		assert.Equal(t, uint64(40), charged)
+		assert.Equal(t, utils.UInt64(40), env.balance(t, alice).Cash)
+	} else {
+		assert.Equal(t, model.NFTTradeCancelled, closed.Status)
+		assert.Equal(t, alice, env.ownerOf(t, nftID))
+		assert.Zero(t, charged)
+	}
+	uids := []utils.UInt64{alice}
+	for i := 1; i <= buyers; i++ {
+		uids = append(uids, utils.UInt64(7000+i))
+	}
+	env.reconcile(t, uids...)
+}
+
+func TestNFTShop_ConcurrentBuysDoNotOversell(t *testing.T) {
+	env := setupConcurrentEnv(t)
+	loadShopCatalog(t, fmt.Sprintf(`
+  - id: 7
+    name: test
+    items:
+      - { id: 71, template_id: 101, currency: gem, stock: 3, prices: [{ from: %s, price: 5 }] }
+`, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)))
+	const buyers = 10
+	for i := 1; i <= buyers; i++ {
+		env.grant(t, utils.UInt64(7000+i), model.CurrencyGem, 5)
+	}
+
+	codes := make([]int, buyers)
+	var wg sync.WaitGroup
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = env.doKey(t, utils.UInt64(7001+i), http.MethodPost, "/nft/shops/7/buy", map[string]any{"item_id": "71"}, "").Code
+		}(i)
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, code := range codes {
+		counts[code]++
+	}
+	assert.Equal(t, map[int]int{http.StatusOK: 3, http.StatusConflict: buyers - 3}, counts)
+
+	var minted int64
+	require.NoError(t, env.db.Model(&model.NFT{}).Where("source = ?", model.NFTSourceShop).Count(&minted).Error)
+	assert.EqualValues(t, 3, minted)
+	stock := &model.NFTShopStock{}
+	require.NoError(t, env.db.Where("item_id = ?", 71).First(stock).Error)
+	assert.Equal(t, uint64(3), stock.Sold)
+	var spent int
+	for i := 1; i <= buyers; i++ {
+		if env.balance(t, utils.UInt64(7000+i)).Gem == 0 {
+			spent++
+		}
+	}
+	assert.Equal(t, 3, spent, "only the buyers who got the item are charged")
+}
+
+// 赠予和挂单同时修改同一个 NFT 时只有一个生效，NFT 不会既被赠予又被托管
+func TestNFTMarket_ConcurrentTransferAndList(t *testing.T) {
+	env := setupConcurrentEnv(t)
+	for _, uid := range []utils.UInt64{alice, bob} {
+		require.NoError(t, env.db.Create(&model.Profile{ID: uid, Email: idStr(uid) + "@example.com"}).Error)
+	}
+
+	const rounds = 5
+	for i := 0; i < rounds; i++ {
+		nftID := env.giveNFT(t, alice, 101)
+		var transfer, list int
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			transfer = env.do(t, alice, http.MethodPost, "/nft/transfer", map[string]any{"nft_id": nftID, "to_user_id": idStr(bob)}).Code
+		}()
+		go func() {
+			defer wg.Done()
+			list = env.do(t, alice, http.MethodPost, "/nft/trades", map[string]any{"nft_id": nftID, "price": 10}).Code
+		}()
+		wg.Wait()
+
+		var trades int64
+		require.NoError(t, env.db.Model(&model.NFTTrade{}).Where("nft_id = ?", nftID).Count(&trades).Error)
+		if transfer == http.StatusOK {
+			assert.Contains(t, []int{http.StatusNotFound, http.StatusConflict}, list)
+			assert.Equal(t, bob, env.ownerOf(t, nftID))
+			assert.Zero(t, trades)
+		} else {
+			require.Equal(t, http.StatusOK, list, "one of the requests wins")
+			assert.Contains(t, []int{http.StatusNotFound, http.StatusConflict}, transfer)
+			assert.Equal(t, model.NFTEscrowOwner, env.ownerOf(t, nftID))
+			assert.EqualValues(t, 1, trades)
+		}
+	}
+}
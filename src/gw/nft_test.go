@@ -0,0 +1,227 @@
+package gw_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/gacha"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// draw 抽卡，key 不为空时通过 Idempotency-Key header 提供
+func (env *testEnv) draw(t *testing.T, uid utils.UInt64, body map[string]any, key string) *httptest.ResponseRecorder {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/nft/draw_card", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", idStr(uid))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	return w
+}
+
+func (env *testEnv) grant(t *testing.T, uid utils.UInt64, currency model.Currency, amount int64) {
+	_, _, err := model.ApplyPointChange(context.Background(), env.db, model.PointChange{
+		UserID: uid, Currency: currency, Delta: amount, Reason: "test", IdempotencyKey: fmt.Sprintf("grant:%d:%s:%d", uid, currency, amount),
+	})
+	require.NoError(t, err)
+}
+
+type drawResult struct {
+	Draws []map[string]any `json:"draws"`
+	NFTs  []map[string]any `json:"nfts"`
+}
+
+func TestNFT_DrawSpendsPointsAndFillsInventory(t *testing.T) {
+	env := setupEnv(t)
+	pool, err := model.GetNFTPool(1)
+	require.NoError(t, err)
+
+	w := env.draw(t, alice, nil, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "insufficient cash: %s", w.Body.String())
+
+	env.grant(t, alice, model.CurrencyCash, int64(3*pool.Price))
+	w = env.draw(t, alice, map[string]any{"count": 2}, "draw:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	first := decodeData[drawResult](t, w.Body.Bytes())
+	require.Len(t, first.Draws, 2)
+	require.Len(t, first.NFTs, 2)
+	assert.Equal(t, uint64(pool.Price), env.balance(t, alice).Cash.Raw())
+	for i, nft := range first.NFTs {
+		assert.Equal(t, first.Draws[i]["nft_id"], nft["id"])
+		assert.NotEmpty(t, nft["name"])
+		assert.NotEmpty(t, nft["category"])
+		assert.NotEmpty(t, first.Draws[i]["server_seed_hash"])
+		assert.Empty(t, first.Draws[i]["server_seed"], "the seed is not revealed yet")
+	}
+
+	// 重复的请求返回第一次的结果，不重复扣费
+	w = env.draw(t, alice, map[string]any{"count": 2}, "draw:1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first, decodeData[drawResult](t, w.Body.Bytes()))
+	assert.Equal(t, uint64(pool.Price), env.balance(t, alice).Cash.Raw())
+
+	w = env.do(t, alice, http.MethodGet, "/nft/nfts", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, decodeData[[]map[string]any](t, w.Body.Bytes()), 2)
+
+	nftID := first.NFTs[0]["id"].(string)
+	w = env.do(t, alice, http.MethodGet, "/nft/nfts/"+nftID, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, first.NFTs[0], decodeData[map[string]any](t, w.Body.Bytes()))
+	w = env.do(t, bob, http.MethodGet, "/nft/nfts/"+nftID, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "other users can not see the nft")
+
+	assert.Equal(t, http.StatusBadRequest, env.draw(t, alice, map[string]any{"count": model.MaxDrawCount + 1}, "").Code)
+	assert.Equal(t, http.StatusNotFound, env.draw(t, alice, map[string]any{"pool_id": "42"}, "").Code)
+	assert.Equal(t, http.StatusConflict, env.draw(t, alice, map[string]any{"pool_id": "2"}, "draw:1").Code,
+		"the key is used by a cash payment")
+	assert.Equal(t, http.StatusConflict, env.draw(t, alice, map[string]any{"count": 1}, "draw:1").Code,
+		"the key is used by a draw of another count")
+	_, _, _, err = model.DrawNFTs(context.Background(), env.db, model.NFTDrawRequest{
+		UserID: alice, PoolID: pool.ID, Count: 1, IdempotencyKey: fmt.Sprintf("grant:%d:%s:%d", alice, model.CurrencyCash, 3*pool.Price),
+	})
+	assert.True(t, errors.Is(err, model.ErrIdempotencyConflict), "the key is used by a cash payment of another reason: %v", err)
+	assert.Equal(t, uint64(pool.Price), env.balance(t, alice).Cash.Raw())
+}
+
+// 标准卡池中连续 10 次没有 rare 或更高稀有度时，第 10 次一定是 rare 或更高
+func TestNFT_PityGuaranteesRarity(t *testing.T) {
+	env := setupEnv(t)
+	pool, err := model.GetNFTPool(1)
+	require.NoError(t, err)
+	var rareAfter uint32
+	for _, rule := range pool.Pity {
+		if rule.Rarity == model.NFTRarityRare {
+			rareAfter = rule.After
+		}
+	}
+	require.NotZero(t, rareAfter)
+
+	rounds := 5
+	env.grant(t, alice, model.CurrencyCash, int64(pool.Price)*int64(rounds)*int64(rareAfter))
+	var rarities []model.NFTRarity
+	for i := 0; i < rounds; i++ {
+		w := env.draw(t, alice, map[string]any{"count": rareAfter}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		for _, d := range decodeData[drawResult](t, w.Body.Bytes()).Draws {
+			rarities = append(rarities, model.NFTRarity(d["rarity"].(string)))
+		}
+	}
+
+	sinceRare := 0
+	for _, rarity := range rarities {
+		if rarity == model.NFTRarityCommon {
+			sinceRare++
+			require.Less(t, sinceRare, int(rareAfter), "draws= %v", rarities)
+		} else {
+			sinceRare = 0
+		}
+	}
+
+	w := env.do(t, alice, http.MethodGet, "/nft/pools", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	pools := decodeData[[]map[string]any](t, w.Body.Bytes())
+	require.Len(t, pools, len(model.NFTPools()))
+	for _, p := range pools[0]["pity"].([]any) {
+		if rule := p.(map[string]any); rule["rarity"] == string(model.NFTRarityRare) {
+			assert.Equal(t, float64(sinceRare), rule["count"])
+		}
+	}
+}
+
+// 更换种子后公开的种子可以复算之前的每一次抽卡
+func TestNFT_DrawsAreAuditable(t *testing.T) {
+	env := setupEnv(t)
+	pool, err := model.GetNFTPool(2)
+	require.NoError(t, err)
+	env.grant(t, alice, model.CurrencyGem, int64(5*pool.Price))
+
+	w := env.do(t, alice, http.MethodGet, "/nft/draws/seed", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	committed := decodeData[map[string]any](t, w.Body.Bytes())
+	assert.Empty(t, committed["server_seed"])
+
+	w = env.draw(t, alice, map[string]any{"pool_id": "2", "count": 5, "client_seed": "lucky"}, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, float64(5), decodeData[map[string]any](t, env.do(t, alice, http.MethodGet, "/nft/draws/seed", nil).Body.Bytes())["nonce"])
+
+	w = env.do(t, alice, http.MethodPost, "/nft/draws/seed", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	rotation := decodeData[map[string]map[string]any](t, w.Body.Bytes())
+	revealed := rotation["revealed"]["server_seed"].(string)
+	assert.Equal(t, committed["server_seed_hash"], gacha.HashSeed(revealed))
+	assert.NotEqual(t, committed["server_seed_hash"], rotation["active"]["server_seed_hash"])
+	assert.Empty(t, rotation["active"]["server_seed"])
+
+	table := &gacha.Table{}
+	for _, rarity := range model.NFTRarities {
+		table.Tiers = append(table.Tiers, gacha.Tier{Name: string(rarity), Weight: pool.Rates[rarity]})
+	}
+	candidates := map[string][]utils.UInt64{}
+	for _, tpl := range model.NFTTemplates() {
+		candidates[string(tpl.Rarity)] = append(candidates[string(tpl.Rarity)], tpl.ID)
+	}
+
+	w = env.do(t, alice, http.MethodGet, "/nft/draws", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	draws := decodeData[[]map[string]any](t, w.Body.Bytes())
+	require.Len(t, draws, 5)
+	for _, d := range draws {
+		require.Equal(t, revealed, d["server_seed"])
+		assert.Equal(t, "lucky", d["client_seed"])
+		r := gacha.NewRand(revealed, "lucky", uint64(d["nonce"].(float64)))
+		if d["pity"] == false {
+			assert.Equal(t, d["rarity"], table.Draw(r, nil).Tier)
+		}
+		pick := candidates[d["rarity"].(string)]
+		assert.Equal(t, d["template_id"], idStr(pick[r.Pick(len(pick))]))
+	}
+}
+
+type fakeChain struct {
+	minted []utils.UInt64
+}
+
+func (f *fakeChain) Mint(ctx context.Context, nft *model.NFT) (string, error) {
+	f.minted = append(f.minted, nft.ID)
+	return fmt.Sprintf("0x%x", nft.ID.Raw()), nil
+}
+
+func TestNFT_ChainAdapterMintsAfterCommit(t *testing.T) {
+	env := setupEnv(t)
+	chain := &fakeChain{}
+	model.SetChainAdapter(env.db, chain)
+	t.Cleanup(func() { model.SetChainAdapter(nil, nil) })
+
+	pool, err := model.GetNFTPool(1)
+	require.NoError(t, err)
+	env.grant(t, alice, model.CurrencyCash, int64(pool.Price))
+	w := env.draw(t, alice, nil, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	nft := decodeData[drawResult](t, w.Body.Bytes()).NFTs[0]
+	assert.Empty(t, nft["chain_token_id"], "minted on chain after commit")
+
+	_, _, err = model.Events().Dispatch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, chain.minted, 1)
+	assert.Equal(t, nft["id"], idStr(chain.minted[0]))
+
+	w = env.do(t, alice, http.MethodGet, fmt.Sprintf("/nft/nfts/%s", nft["id"]), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, fmt.Sprintf("0x%x", chain.minted[0].Raw()), decodeData[map[string]any](t, w.Body.Bytes())["chain_token_id"])
+}
@@ -0,0 +1,115 @@
+package gw_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+func (env *testEnv) balance(t *testing.T, uid utils.UInt64) *model.ProfilePoints {
+	points, err := model.EnsureLoadProfilePoints(env.db, uid)
+	require.NoError(t, err)
+	return points
+}
+
+func TestPoints_LedgerIsIdempotent(t *testing.T) {
+	env := setupEnv(t)
+	ctx := context.Background()
+
+	change := model.PointChange{UserID: alice, Currency: model.CurrencyGem, Delta: 50, Reason: "test", IdempotencyKey: "gift:1"}
+	record, applied, err := model.ApplyPointChange(ctx, env.db, change)
+	require.NoError(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, utils.UInt64(50), record.Balance)
+
+	// 相同的幂等键不会再次生效
+	again, applied, err := model.ApplyPointChange(ctx, env.db, change)
+	require.NoError(t, err)
+	assert.False(t, applied)
+	assert.Equal(t, record.ID, again.ID)
+	assert.Equal(t, utils.UInt64(50), env.balance(t, alice).Gem)
+
+	// 幂等键不能被其他用户使用
+	_, _, err = model.ApplyPointChange(ctx, env.db, model.PointChange{UserID: bob, Currency: model.CurrencyGem, Delta: 50, Reason: "test", IdempotencyKey: "gift:1"})
+	assert.ErrorIs(t, err, model.ErrIdempotencyConflict)
+
+	// 余额不足时不做任何修改
+	_, _, err = model.ApplyPointChange(ctx, env.db, model.PointChange{UserID: alice, Currency: model.CurrencyGem, Delta: -80, Reason: "test", IdempotencyKey: "spend:1"})
+	assert.ErrorIs(t, err, model.ErrInsufficientPoints)
+	record, applied, err = model.ApplyPointChange(ctx, env.db, model.PointChange{UserID: alice, Currency: model.CurrencyGem, Delta: -30, Reason: "test", IdempotencyKey: "spend:1"})
+	require.NoError(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, utils.UInt64(20), record.Balance)
+
+	var count int64
+	require.NoError(t, env.db.Model(&model.PointTransaction{}).Where("user_id = ?", alice).Count(&count).Error)
+	assert.Equal(t, int64(2), count)
+
+	_, _, err = model.ApplyPointChange(ctx, env.db, model.PointChange{UserID: alice, Currency: "gold", Delta: 1, IdempotencyKey: "x"})
+	assert.ErrorIs(t, err, model.ErrInvalidCurrency)
+}
+
+func TestPoints_CampaignSubmitAndHistory(t *testing.T) {
+	env := setupEnv(t)
+
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+		"monster_id": idStr(aliceItem), "result": "kill",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	cash := env.balance(t, alice).Cash
+	require.NotZero(t, cash)
+
+	w = env.do(t, alice, http.MethodGet, "/profile/points/history?currency=cash", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	history := decodeData[[]map[string]any](t, w.Body.Bytes())
+	require.Len(t, history, 1)
+	assert.Equal(t, "campaign.submit", history[0]["reason"])
+	assert.Equal(t, idStr(aliceDungeon), history[0]["ref_id"])
+	assert.Equal(t, idStr(cash), history[0]["balance"])
+	assert.Nil(t, history[0]["idempotency_key"])
+
+	w = env.do(t, alice, http.MethodGet, "/profile/points/history?currency=gold", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodGet, "/profile/points/history", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, decodeData[[]map[string]any](t, w.Body.Bytes()))
+}
+
+func TestPoints_Reconcile(t *testing.T) {
+	env := setupEnv(t)
+	t.Setenv(utils.OperatorsENVKey, idStr(carol))
+	ctx := context.Background()
+
+	for i, uid := range []utils.UInt64{alice, bob} {
+		_, _, err := model.ApplyPointChange(ctx, env.db, model.PointChange{UserID: uid, Currency: model.CurrencyCash, Delta: int64(100 * (i + 1)), Reason: "test", IdempotencyKey: fmt.Sprintf("seed:%d", uid)})
+		require.NoError(t, err)
+	}
+
+	reconcile := func(query string) []map[string]any {
+		w := env.do(t, carol, http.MethodGet, "/system/points/reconcile"+query, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return decodeData[[]map[string]any](t, w.Body.Bytes())
+	}
+	assert.Empty(t, reconcile(""))
+
+	// 绕过流水修改的余额会被发现
+	require.NoError(t, env.db.Model(&model.ProfilePoints{}).Where("id = ?", bob).Update("cash", 999).Error)
+	found := reconcile("")
+	require.Len(t, found, 1)
+	assert.Equal(t, idStr(bob), found[0]["user_id"])
+	assert.Equal(t, "cash", found[0]["currency"])
+	assert.EqualValues(t, 999, found[0]["balance"])
+	assert.EqualValues(t, 200, found[0]["ledger"])
+	assert.Empty(t, reconcile("?user_ids="+idStr(alice)))
+
+	// 只有运维人员可以对账
+	w := env.do(t, alice, http.MethodGet, "/system/points/reconcile", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+}
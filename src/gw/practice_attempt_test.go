@@ -0,0 +1,168 @@
+package gw_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// submit 上报 aliceDungeon 中 aliceItem 的结果，key 不为空时通过 Idempotency-Key header 提供
+func (env *testEnv) submit(t *testing.T, body map[string]any, key string) *httptest.ResponseRecorder {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/dungeon/campaigns/%d/submit", aliceDungeon), bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", idStr(alice))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	return w
+}
+
+func (env *testEnv) practiceState(t *testing.T) (practiceCount uint32, cash utils.UInt64, txs int64) {
+	dm := &model.DungeonMonster{}
+	require.NoError(t, env.db.Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).First(dm).Error)
+	require.NoError(t, env.db.Model(&model.PointTransaction{}).Where("user_id = ?", alice).Count(&txs).Error)
+	return dm.PracticeCount, env.balance(t, alice).Cash, txs
+}
+
+func TestPracticeAttempt_ReplayReturnsFirstResponse(t *testing.T) {
+	env := setupEnv(t)
+	body := map[string]any{"monster_id": idStr(aliceItem), "result": "kill", "attempt_id": "a-1"}
+
+	first := env.submit(t, body, "")
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+	count, cash, txs := env.practiceState(t)
+	assert.Equal(t, uint32(1), count)
+	require.NotZero(t, cash)
+	assert.Equal(t, int64(1), txs)
+
+	// 重试时返回相同的响应，不再修改熟练度和积分
+	again := env.submit(t, body, "")
+	require.Equal(t, http.StatusOK, again.Code, again.Body.String())
+	assert.Equal(t, "true", again.Header().Get("Idempotent-Replayed"))
+	assert.JSONEq(t, first.Body.String(), again.Body.String())
+	c2, cash2, txs2 := env.practiceState(t)
+	assert.Equal(t, []any{count, cash, txs}, []any{c2, cash2, txs2})
+
+	// 同一个 attempt id 不能用于其他的结果
+	body["result"] = "miss"
+	w := env.submit(t, body, "")
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	// 其他用户的 attempt id 互不影响
+	w = env.do(t, bob, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", bobDungeon), map[string]any{
+		"monster_id": idStr(aliceItem), "result": "kill", "attempt_id": "a-1",
+	})
+	assert.NotEqual(t, http.StatusConflict, w.Code, w.Body.String())
+}
+
+func TestPracticeAttempt_IdempotencyKeyHeader(t *testing.T) {
+	env := setupEnv(t)
+	body := map[string]any{"monster_id": idStr(aliceItem), "result": "hit", "attempt_id": "ignored"}
+
+	require.Equal(t, http.StatusOK, env.submit(t, body, "k-1").Code)
+	w := env.submit(t, map[string]any{"monster_id": idStr(aliceItem), "result": "hit"}, "k-1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	count, _, _ := env.practiceState(t)
+	assert.Equal(t, uint32(1), count)
+
+	// header 优先于 body 中的 attempt_id
+	var n int64
+	require.NoError(t, env.db.Model(&model.PracticeAttempt{}).Where("attempt_id = ?", "ignored").Count(&n).Error)
+	assert.Zero(t, n)
+
+	w = env.submit(t, body, string(bytes.Repeat([]byte("x"), model.MaxAttemptIDLen+1)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
+
+func TestPracticeAttempt_WithoutKeyAlwaysApplies(t *testing.T) {
+	env := setupEnv(t)
+	body := map[string]any{"monster_id": idStr(aliceItem), "result": "kill"}
+
+	require.Equal(t, http.StatusOK, env.submit(t, body, "").Code)
+	_, cash, _ := env.practiceState(t)
+	require.Equal(t, http.StatusOK, env.submit(t, body, "").Code)
+	count, cash2, txs := env.practiceState(t)
+	assert.Equal(t, uint32(2), count)
+	assert.Greater(t, cash2, cash)
+	assert.Equal(t, int64(2), txs)
+
+	// monster 不存在时不记录提交
+	w := env.submit(t, map[string]any{"monster_id": "9999", "result": "kill", "attempt_id": "missing"}, "")
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	var n int64
+	require.NoError(t, env.db.Model(&model.PracticeAttempt{}).Count(&n).Error)
+	assert.Zero(t, n)
+}
+
+// 移除后重新加入的 monster 从 practice_count 0 开始，没有 attempt id 的提交仍然发放积分
+func TestPracticeAttempt_WithoutKeyAfterReAdd(t *testing.T) {
+	env := setupEnv(t)
+	body := map[string]any{"monster_id": idStr(aliceItem), "result": "kill"}
+	require.Equal(t, http.StatusOK, env.submit(t, body, "").Code)
+	_, cash, _ := env.practiceState(t)
+
+	dm := &model.DungeonMonster{}
+	require.NoError(t, env.db.Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).First(dm).Error)
+	require.NoError(t, env.db.Unscoped().Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).Delete(&model.DungeonMonster{}).Error)
+	require.NoError(t, env.db.Create(&model.DungeonMonster{
+		DungeonID: aliceDungeon, ItemID: aliceItem, SourceType: dm.SourceType, SourceID: dm.SourceID,
+	}).Error)
+
+	w := env.submit(t, body, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	earned := decodeData[struct {
+		PointsUpdate struct {
+			Cash utils.UInt64 `json:"cash"`
+		} `json:"points_update"`
+	}](t, w.Body.Bytes()).PointsUpdate.Cash
+	count, cash2, txs := env.practiceState(t)
+	assert.Equal(t, uint32(1), count)
+	assert.Equal(t, int64(2), txs)
+	assert.NotZero(t, earned)
+	assert.Equal(t, cash+earned, cash2, "the reported cash is the cash applied")
+}
+
+// 没有 attempt id 的并发提交依次生效，每次作答都发放积分，不会因为读到相同的 practice_count 而丢失
+func TestPracticeAttempt_ConcurrentWithoutKey(t *testing.T) {
+	env := setupConcurrentEnv(t)
+	body := map[string]any{"monster_id": idStr(aliceItem), "result": "hit"}
+
+	const n = 6
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = env.submit(t, body, "").Code
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	count, cash, txs := env.practiceState(t)
+	assert.Equal(t, uint32(n), count)
+	assert.Equal(t, int64(n), txs)
+	var sum int64
+	require.NoError(t, env.db.Model(&model.PointTransaction{}).Where("user_id = ? AND currency = ?", alice, model.CurrencyCash).
+		Select("COALESCE(SUM(delta), 0)").Scan(&sum).Error)
+	assert.EqualValues(t, sum, cash)
+}
@@ -0,0 +1,145 @@
+package gw_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/campaign"
+)
+
+type sessionClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func (env *testEnv) openSession(t *testing.T, uid, dungeonID utils.UInt64) (*sessionClient, *http.Response, error) {
+	server := httptest.NewServer(env.router)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + fmt.Sprintf("/api/v1/dungeon/campaigns/%d/session", dungeonID)
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-User-ID": []string{idStr(uid)}})
+	if err != nil {
+		return nil, resp, err
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &sessionClient{t: t, conn: conn}, resp, nil
+}
+
+func (s *sessionClient) read() map[string]any {
+	require.NoError(s.t, s.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var msg map[string]any
+	require.NoError(s.t, s.conn.ReadJSON(&msg))
+	return msg
+}
+
+func (s *sessionClient) expect(typ string) map[string]any {
+	msg := s.read()
+	require.Equal(s.t, typ, msg["type"], "%v", msg)
+	return msg
+}
+
+func (s *sessionClient) send(msg map[string]any) {
+	require.NoError(s.t, s.conn.WriteJSON(msg))
+}
+
+func TestPracticeSession_FailedMonsterReappearsAndSummaryIsSaved(t *testing.T) {
+	env := setupEnv(t)
+	s, _, err := env.openSession(t, alice, aliceDungeon)
+	require.NoError(t, err)
+
+	started := s.expect("started")["session"].(map[string]any)
+	monster := s.expect("monster")["monster"].(map[string]any)
+	require.Equal(t, idStr(aliceItem), monster["item_id"])
+
+	// 不是当前的 monster 或者结果无效时返回错误，会话继续
+	s.send(map[string]any{"type": "answer", "item_id": "9999", "result": "kill"})
+	s.expect("error")
+	s.send(map[string]any{"type": "dance"})
+	s.expect("error")
+
+	time.Sleep(20 * time.Millisecond)
+	s.send(map[string]any{"type": "answer", "item_id": idStr(aliceItem), "result": "miss"})
+	graded := s.expect("graded")["graded"].(map[string]any)
+	assert.Equal(t, true, graded["relearn"])
+	assert.GreaterOrEqual(t, graded["response_ms"].(float64), float64(20))
+	assert.EqualValues(t, 1, graded["seq"])
+
+	// 答错的 monster 在会话中再次出现，以更新后的熟练度计算
+	monster = s.expect("monster")["monster"].(map[string]any)
+	require.Equal(t, idStr(aliceItem), monster["item_id"])
+	assert.Equal(t, graded["familiarity_after"], monster["familiarity"])
+	s.send(map[string]any{"type": "answer", "item_id": idStr(aliceItem), "result": "kill"})
+	graded = s.expect("graded")["graded"].(map[string]any)
+	assert.Equal(t, false, graded["relearn"])
+	assert.Positive(t, graded["familiarity_delta"].(float64))
+
+	// 没有到期的 monsters 后会话结束
+	summary := s.expect("summary")["session"].(map[string]any)
+	assert.Equal(t, started["id"], summary["id"])
+	assert.Equal(t, "completed", summary["end_reason"])
+	assert.EqualValues(t, 2, summary["answered"])
+	assert.EqualValues(t, 1, summary["failed"])
+	_, _, err = s.conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "%v", err)
+
+	// 汇总和复习记录已经保存
+	w := env.do(t, alice, http.MethodGet, fmt.Sprintf("/dungeon/campaigns/%d/sessions", aliceDungeon), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	sessions := decodeData[[]map[string]any](t, w.Body.Bytes())
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "completed", sessions[0]["end_reason"])
+	assert.Equal(t, summary["points_update"], sessions[0]["points_update"])
+	assert.NotZero(t, env.balance(t, alice).Cash)
+
+	var logs []model.ReviewLog
+	require.NoError(t, env.db.Where("user_id = ?", alice).Order("practiced_at").Find(&logs).Error)
+	require.Len(t, logs, 2)
+	assert.Equal(t, started["id"], idStr(logs[0].SessionID))
+	assert.GreaterOrEqual(t, logs[0].ResponseMS, int64(20))
+	assert.Equal(t, logs[0].FamiliarityAfter, logs[1].FamiliarityBefore)
+}
+
+func TestPracticeSession_TimeoutAndAccess(t *testing.T) {
+	env := setupEnv(t)
+	timeout := campaign.SessionIdleTimeout
+	campaign.SessionIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { campaign.SessionIdleTimeout = timeout })
+
+	s, _, err := env.openSession(t, alice, aliceDungeon)
+	require.NoError(t, err)
+	s.expect("started")
+	s.expect("monster")
+	summary := s.expect("summary")["session"].(map[string]any)
+	assert.Equal(t, "timeout", summary["end_reason"])
+	assert.EqualValues(t, 0, summary["answered"])
+
+	// 其他用户的复习计划和普通的 HTTP 请求
+	_, resp, err := env.openSession(t, bob, aliceDungeon)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	w := env.do(t, alice, http.MethodGet, fmt.Sprintf("/dungeon/campaigns/%d/session", aliceDungeon), nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.do(t, bob, http.MethodGet, fmt.Sprintf("/dungeon/campaigns/%d/sessions", aliceDungeon), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestPracticeSession_ClientEndsSession(t *testing.T) {
+	env := setupEnv(t)
+	s, _, err := env.openSession(t, alice, aliceDungeon)
+	require.NoError(t, err)
+	s.expect("started")
+	s.expect("monster")
+	s.send(map[string]any{"type": "end"})
+	summary := s.expect("summary")["session"].(map[string]any)
+	assert.Equal(t, "finished", summary["end_reason"])
+	assert.NotEmpty(t, summary["ended_at"])
+}
@@ -0,0 +1,109 @@
+package gw_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+func (env *testEnv) syncUpload(t *testing.T, body map[string]any) map[string]any {
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/sync", aliceDungeon), body)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[map[string]any](t, w.Body.Bytes())
+}
+
+func attempt(id, result string, at time.Time) map[string]any {
+	return map[string]any{"attempt_id": id, "monster_id": idStr(aliceItem), "result": result, "practiced_at": at.Format(time.RFC3339Nano)}
+}
+
+func statuses(data map[string]any) map[string]string {
+	ret := make(map[string]string)
+	for _, o := range data["outcomes"].([]any) {
+		outcome := o.(map[string]any)
+		ret[outcome["attempt_id"].(string)] = outcome["status"].(string)
+	}
+	return ret
+}
+
+func TestPracticeSync_DownloadAndReplayInOrder(t *testing.T) {
+	env := setupEnv(t)
+
+	w := env.do(t, alice, http.MethodGet, fmt.Sprintf("/dungeon/campaigns/%d/sync?count=5", aliceDungeon), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	download := decodeData[map[string]any](t, w.Body.Bytes())
+	require.Len(t, download["monsters"], 1)
+	assert.NotEmpty(t, download["server_time"])
+	w = env.do(t, alice, http.MethodGet, fmt.Sprintf("/dungeon/campaigns/%d/sync?count=999", aliceDungeon), nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	// 上传的顺序与作答的顺序不同，按作答时间重放
+	t0 := time.Now().Add(-3 * time.Hour).UTC()
+	data := env.syncUpload(t, map[string]any{"attempts": []map[string]any{
+		attempt("late", "kill", t0.Add(2*time.Hour)),
+		attempt("early", "miss", t0),
+		attempt("future", "kill", time.Now().Add(time.Hour)),
+		attempt("bad", "dance", t0),
+	}})
+	outcomes := data["outcomes"].([]any)
+	require.Len(t, outcomes, 4)
+	assert.Equal(t, "early", outcomes[0].(map[string]any)["attempt_id"])
+	assert.Equal(t, map[string]string{"early": "applied", "late": "applied", "future": "rejected", "bad": "rejected"}, statuses(data))
+
+	dm := &model.DungeonMonster{}
+	require.NoError(t, env.db.Where("dungeon_id = ? AND item_id = ?", aliceDungeon, aliceItem).First(dm).Error)
+	assert.Equal(t, uint32(2), dm.PracticeCount)
+	assert.WithinDuration(t, t0.Add(2*time.Hour), dm.PracticeAt, time.Second)
+	// 下次复习时间从作答时间开始计算
+	assert.True(t, dm.NextPracticeAt.Before(time.Now().Add(24*time.Hour)))
+	require.NotZero(t, env.balance(t, alice).Cash)
+
+	// 重试时不会再次生效
+	cash := env.balance(t, alice).Cash
+	data = env.syncUpload(t, map[string]any{"attempts": []map[string]any{attempt("late", "kill", t0.Add(2*time.Hour))}})
+	assert.Equal(t, map[string]string{"late": "duplicate"}, statuses(data))
+	assert.NotNil(t, data["outcomes"].([]any)[0].(map[string]any)["results"])
+	assert.Equal(t, cash, env.balance(t, alice).Cash)
+}
+
+func TestPracticeSync_ConflictBetweenDevices(t *testing.T) {
+	env := setupEnv(t)
+	t0 := time.Now().Add(-time.Hour).UTC()
+
+	// 设备 A 先同步了较晚的作答
+	data := env.syncUpload(t, map[string]any{"attempts": []map[string]any{attempt("a-1", "hit", t0.Add(30*time.Minute))}})
+	require.Equal(t, map[string]string{"a-1": "applied"}, statuses(data))
+	cash := env.balance(t, alice).Cash
+
+	// 设备 B 上较早的作答不再生效，之后的作答正常生效
+	data = env.syncUpload(t, map[string]any{"attempts": []map[string]any{
+		attempt("b-1", "kill", t0),
+		attempt("b-2", "kill", t0.Add(40*time.Minute)),
+	}})
+	assert.Equal(t, map[string]string{"b-1": "superseded", "b-2": "applied"}, statuses(data))
+	assert.NotEmpty(t, data["outcomes"].([]any)[0].(map[string]any)["reason"])
+	assert.Greater(t, env.balance(t, alice).Cash, cash)
+
+	// 客户端时钟慢了一小时: 修正后作答时间晚于 b-2，因此生效
+	clientNow := time.Now().Add(-time.Hour)
+	data = env.syncUpload(t, map[string]any{
+		"client_time": clientNow.Format(time.RFC3339Nano),
+		"attempts":    []map[string]any{attempt("c-1", "kill", clientNow.Add(-5*time.Minute))},
+	})
+	assert.Equal(t, map[string]string{"c-1": "applied"}, statuses(data))
+
+	// 与 submit 接口共用 attempt id
+	w := env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+		"monster_id": idStr(aliceItem), "result": "kill", "attempt_id": "c-1",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+	w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/sync", aliceDungeon), map[string]any{"attempts": []any{}})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
@@ -4,17 +4,18 @@ package gw
 
 import (
 	"github.com/gin-gonic/gin"
-	"github.com/khgame/ranger_iam/pkg/authcli"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"gorm.io/gorm"
 
+	"github.com/bagaking/memorianexus/pkg/blobstore"
 	"github.com/bagaking/memorianexus/src/module/achievement"
 	"github.com/bagaking/memorianexus/src/module/analytic"
 	"github.com/bagaking/memorianexus/src/module/book"
 	"github.com/bagaking/memorianexus/src/module/campaign"
 	"github.com/bagaking/memorianexus/src/module/dungeon"
 	"github.com/bagaking/memorianexus/src/module/item"
+	"github.com/bagaking/memorianexus/src/module/media"
 	"github.com/bagaking/memorianexus/src/module/nft"
 	"github.com/bagaking/memorianexus/src/module/operation"
 	"github.com/bagaking/memorianexus/src/module/profile"
@@ -83,72 +84,79 @@ func RegisterCallbacks(router gin.IRouter) {
 	group.GET("/event", LarkEventHandler)
 }
 
-// RegisterRoutes - routers all in one
+// RegisterRoutes - routers all in one, authN 为认证中间件，认证通过后需要在 ctx 中设置用户 ID (见 authcli.GetUIDFromGinCtx)
 // todo: using rpc
-func RegisterRoutes(router gin.IRouter, db *gorm.DB, iamCli *authcli.Cli) {
+func RegisterRoutes(router gin.IRouter, db *gorm.DB, authN gin.HandlerFunc, mediaStore blobstore.Store) {
 	// 用户账户服务路由组
 	svrProfile := profile.NewService(db)
 	g := router.Group("/profile")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrProfile.ApplyMux(g)
 
 	// 学习材料管理路由组
 	svrItems := item.NewService(db)
 	g = router.Group("/items")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrItems.ApplyMux(g)
 
+	// 媒体文件路由组，用户上传的文件不走静态文件服务
+	svrMedia, _ := media.Init(db, mediaStore)
+	g = router.Group("/media")
+	g.Use(authN)
+	svrMedia.ApplyMux(g)
+
 	// 册子管理路由组
 	svrBooks, _ := book.Init(db)
+	svrBooks.SetShortener(ShortenPath)
 	g = router.Group("/books")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrBooks.ApplyMux(g)
 
 	// 标签管理路由组
 	svrTags, _ := tag.Init(db)
 	g = router.Group("/tags")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrTags.ApplyMux(g)
 
 	// 系统操作路由组
 	svrSystem, _ := system.Init(db)
 	g = router.Group("/system")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrSystem.ApplyMux(g)
 
 	// 复习计划管理路由组
 	svrDungeon, _ := dungeon.Init(db)
 	g = router.Group("/dungeon")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrDungeon.ApplyMux(g)
 
 	svrCampaignDungeon, _ := campaign.Init(db)
 	g = router.Group("/dungeon")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrCampaignDungeon.ApplyMux(g)
 
 	// 数据分析路由组
 	svrAnalytics, _ := analytic.Init(db)
 	g = router.Group("/analytic")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrAnalytics.ApplyMux(g)
 
 	// NFT管理路由组
 	svrNfts, _ := nft.Init(db)
 	g = router.Group("/nft")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrNfts.ApplyMux(g)
 
 	// 成就系统路由组
 	svrAchievements, _ := achievement.Init(db)
 	g = router.Group("/achievements")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrAchievements.ApplyMux(g)
 
 	// 运营管理路由组
 	svrOperation, _ := operation.Init(db)
 	g = router.Group("/operation")
-	g.Use(iamCli.GinMW())
+	g.Use(authN)
 	svrOperation.ApplyMux(g)
 
 	// 社区互动路由组
@@ -60,6 +60,11 @@ func GetFullURLFromGinCtx(c *gin.Context) string {
 		originalURI = c.Request.URL.Path
 	}
 
+	return GetBaseURLFromGinCtx(c) + originalURI
+}
+
+// GetBaseURLFromGinCtx 从 Gin 上下文中获取站点的 scheme 和 host，处理 X-Forwarded-Proto 和 X-Forwarded-Host 头
+func GetBaseURLFromGinCtx(c *gin.Context) string {
 	// 确定 scheme
 	scheme := "https"
 	if c.Request.TLS == nil {
@@ -77,8 +82,23 @@ func GetFullURLFromGinCtx(c *gin.Context) string {
 		host = forwardedHost
 	}
 
-	// 构建并返回完整的 URL
-	return fmt.Sprintf("%s://%s%s", scheme, host, originalURI)
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// ShortenPath 为站内的 path 生成短网址并返回完整的短网址，用于分享链接等场景 (见 book.Shortener)
+func ShortenPath(c *gin.Context, p string) string {
+	baseURL := GetBaseURLFromGinCtx(c)
+	shortURL := storeShortURL(baseURL + p)
+	return baseURL + ShortURLRoute + shortURL
+}
+
+func storeShortURL(originalURL string) string {
+	shortURL := generateShortURL(originalURL)
+	shortURLCache.Store(shortURL, ShortURLEntry{
+		OriginalURL: originalURL,
+		ExpiresAt:   time.Now().Add(ShortURLTTL),
+	})
+	return shortURL
 }
 
 // 创建短网址
@@ -0,0 +1,154 @@
+package gw_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+func (env *testEnv) streak(t *testing.T) map[string]any {
+	w := env.do(t, alice, http.MethodGet, "/profile/streak", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[map[string]any](t, w.Body.Bytes())
+}
+
+// buyFreezes 为 alice 购买补签卡，key 不为空时通过 Idempotency-Key header 提供
+func (env *testEnv) buyFreezes(t *testing.T, count int, key string) *httptest.ResponseRecorder {
+	data, err := json.Marshal(map[string]any{"count": count})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/profile/streak/freezes", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", idStr(alice))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestStreak_SubmitMeetsDailyGoal(t *testing.T) {
+	env := setupEnv(t)
+
+	w := env.do(t, alice, http.MethodPut, "/profile/streak", map[string]any{"goal_target": 2, "timezone": "Asia/Shanghai"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	streak := decodeData[map[string]any](t, w.Body.Bytes())
+	assert.Equal(t, "Asia/Shanghai", streak["timezone"])
+	assert.Equal(t, map[string]any{"type": "reviews", "target": float64(2)}, streak["goal"])
+
+	for i := 0; i < 2; i++ {
+		w = env.do(t, alice, http.MethodPost, fmt.Sprintf("/dungeon/campaigns/%d/submit", aliceDungeon), map[string]any{
+			"monster_id": idStr(aliceItem), "result": "kill",
+		})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		streak = env.streak(t)
+		if i == 0 {
+			assert.Equal(t, float64(0), streak["current_streak"], "goal is not met by the first review")
+		}
+	}
+
+	today := time.Now().In(time.FixedZone("CST", 8*3600)).Format("2006-01-02")
+	assert.Equal(t, float64(1), streak["current_streak"])
+	assert.Equal(t, float64(1), streak["longest_streak"])
+	assert.Equal(t, today, streak["last_goal_date"])
+	day := streak["today"].(map[string]any)
+	assert.Equal(t, today, day["date"])
+	assert.Equal(t, float64(2), day["reviews"])
+	assert.Equal(t, true, day["goal_met"])
+	assert.Len(t, streak["days"], 1)
+
+	w = env.do(t, alice, http.MethodPut, "/profile/streak", map[string]any{"timezone": "Mars/Olympus"})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodPut, "/profile/streak", map[string]any{"goal_type": "minutes"})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = env.do(t, alice, http.MethodPut, "/profile/streak", map[string]any{"goal_target": 0})
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
+
+func TestStreak_BuyFreezesWithGem(t *testing.T) {
+	env := setupEnv(t)
+
+	w := env.do(t, alice, http.MethodPost, "/profile/streak/freezes", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "insufficient gem: %s", w.Body.String())
+
+	_, _, err := model.ApplyPointChange(context.Background(), env.db, model.PointChange{
+		UserID: alice, Currency: model.CurrencyGem, Delta: 3 * model.StreakFreezePrice, Reason: "test", IdempotencyKey: "gift:1",
+	})
+	require.NoError(t, err)
+
+	buy := func(count int, key string) int {
+		return env.buyFreezes(t, count, key).Code
+	}
+	assert.Equal(t, http.StatusOK, buy(1, "buy:1"))
+	w = env.buyFreezes(t, 1, "buy:1")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, float64(1), env.streak(t)["freezes"])
+	assert.Equal(t, uint64(2*model.StreakFreezePrice), env.balance(t, alice).Gem.Raw())
+
+	assert.Equal(t, http.StatusBadRequest, buy(2, ""), "exceeds the max freezes")
+	assert.Equal(t, http.StatusBadRequest, buy(0, ""))
+	assert.Equal(t, uint64(2*model.StreakFreezePrice), env.balance(t, alice).Gem.Raw(), "failed purchases are not charged")
+
+	assert.Equal(t, http.StatusOK, buy(1, ""))
+	streak := env.streak(t)
+	assert.Equal(t, float64(model.MaxStreakFreezes), streak["freezes"])
+	assert.Equal(t, uint64(model.StreakFreezePrice), env.balance(t, alice).Gem.Raw())
+}
+
+func TestStreak_RolloverUsesFreezesOrBreaks(t *testing.T) {
+	env := setupEnv(t)
+	ctx := context.Background()
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	// alice 错过了 1 天，有补签卡；bob 错过了 2 天，只有 1 张补签卡
+	require.NoError(t, env.db.Create(&model.UserStreak{
+		UserID: alice, Timezone: "UTC", GoalType: model.GoalTypeReviews, GoalTarget: 1,
+		CurrentStreak: 5, LongestStreak: 5, LastGoalDate: "2024-05-08", Freezes: 2,
+	}).Error)
+	require.NoError(t, env.db.Create(&model.UserStreak{
+		UserID: bob, Timezone: "UTC", GoalType: model.GoalTypeReviews, GoalTarget: 1,
+		CurrentStreak: 3, LongestStreak: 7, LastGoalDate: "2024-05-07", Freezes: 1,
+	}).Error)
+
+	frozen, broken, err := model.RolloverStreaks(ctx, env.db, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, frozen)
+	assert.Equal(t, 1, broken)
+
+	streak, days, err := model.GetUserStreak(ctx, env.db, alice, now, 7)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5), streak.CurrentStreak, "frozen days keep the streak without increasing it")
+	assert.Equal(t, "2024-05-09", streak.LastGoalDate)
+	assert.Equal(t, uint32(1), streak.Freezes)
+	require.Len(t, days, 1)
+	assert.True(t, days[0].Frozen)
+
+	streak, _, err = model.GetUserStreak(ctx, env.db, bob, now, 7)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), streak.CurrentStreak)
+	assert.Equal(t, uint32(7), streak.LongestStreak)
+	assert.Equal(t, uint32(1), streak.Freezes, "freezes are kept when they can not cover the gap")
+
+	// 重复执行不会再次生效
+	frozen, broken, err = model.RolloverStreaks(ctx, env.db, now)
+	require.NoError(t, err)
+	assert.Zero(t, frozen)
+	assert.Zero(t, broken)
+
+	// 新的一天由 alice 的时区决定
+	require.NoError(t, env.db.Model(&model.UserStreak{}).Where("user_id = ?", alice).Update("timezone", "America/New_York").Error)
+	frozen, _, err = model.RolloverStreaks(ctx, env.db, time.Date(2024, 5, 11, 3, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Zero(t, frozen, "it is still 2024-05-10 in New York")
+}
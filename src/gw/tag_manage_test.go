@@ -0,0 +1,181 @@
+package gw_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// tagPath 标签的路径，层级标签中的 / 编码为 %2F
+func tagPath(tag string, suffix string) string {
+	return "/tags/" + url.PathEscape(tag) + suffix
+}
+
+// itemTags 通过 item 详情读取标签 (entity -> tags 缓存)
+func (env *testEnv) itemTags(t *testing.T, uid, itemID utils.UInt64) []string {
+	w := env.do(t, uid, http.MethodGet, fmt.Sprintf("/items/%d", itemID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[struct {
+		Tags []string `json:"tags"`
+	}](t, w.Body.Bytes()).Tags
+}
+
+// userTags 用户的所有标签 (user -> tags 缓存)
+func (env *testEnv) userTags(t *testing.T, uid utils.UInt64) []string {
+	w := env.do(t, uid, http.MethodGet, "/tags?flat=true", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return decodeData[[]string](t, w.Body.Bytes())
+}
+
+// taggedItems 带有标签 (包括子标签) 的 items (tag -> entities 缓存)
+func (env *testEnv) taggedItems(t *testing.T, uid utils.UInt64, tag string) []string {
+	w := env.do(t, uid, http.MethodGet, tagPath(tag, "/items"), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var ids []string
+	for _, item := range decodeData[[]map[string]any](t, w.Body.Bytes()) {
+		ids = append(ids, item["id"].(string))
+	}
+	return ids
+}
+
+// tagChange 修改标签的请求，返回受影响的标签记录数
+func (env *testEnv) tagChange(t *testing.T, uid utils.UInt64, method, path string, body any, status int) int {
+	w := env.do(t, uid, method, path, body)
+	require.Equal(t, status, w.Code, w.Body.String())
+	if status != http.StatusOK {
+		return 0
+	}
+	dispatchEvents(t)
+	return decodeData[struct {
+		Affected int `json:"affected"`
+	}](t, w.Body.Bytes()).Affected
+}
+
+func TestTagManage_RenameMergeDelete(t *testing.T) {
+	env := setupEnv(t)
+	const kanji utils.UInt64 = 3002
+	require.NoError(t, env.db.Create(&model.Item{ID: kanji, CreatorID: alice, Type: model.TyItemFlashCard, Content: "kanji"}).Error)
+	env.retagItem(t, aliceItem, "lang/ja", "vocab")
+	env.retagItem(t, kanji, "lang/ja/kanji", "jp")
+	dispatchEvents(t)
+
+	// 读取一次，填充各个缓存
+	assert.ElementsMatch(t, []string{"lang/ja", "vocab"}, env.itemTags(t, alice, aliceItem))
+	assert.ElementsMatch(t, []string{"lang/ja", "lang/ja/kanji", "jp", "vocab"}, env.userTags(t, alice))
+	assert.ElementsMatch(t, []string{idStr(aliceItem), idStr(kanji)}, env.taggedItems(t, alice, "lang/ja"))
+
+	// 其他用户的标签不受影响
+	env.tagChange(t, bob, http.MethodPut, tagPath("lang/ja", ""), map[string]any{"tag": "bob"}, http.StatusNotFound)
+	env.tagChange(t, bob, http.MethodPost, tagPath("lang/ja", "/merge"), map[string]any{"into": "bob"}, http.StatusNotFound)
+	env.tagChange(t, bob, http.MethodDelete, tagPath("lang/ja", ""), nil, http.StatusNotFound)
+	assert.ElementsMatch(t, []string{"lang/ja", "vocab"}, env.itemTags(t, alice, aliceItem))
+
+	// 重命名: 子标签一起移动，新标签已经存在时需要改用合并
+	env.tagChange(t, alice, http.MethodPut, tagPath("lang/ja", ""), map[string]any{"tag": "jp"}, http.StatusConflict)
+	env.tagChange(t, alice, http.MethodPut, tagPath("lang/ja", ""), map[string]any{"tag": "lang/ja/n5"}, http.StatusBadRequest)
+	assert.Equal(t, 2, env.tagChange(t, alice, http.MethodPut, tagPath("lang/ja", ""), map[string]any{"tag": "japanese"}, http.StatusOK))
+	assert.ElementsMatch(t, []string{"japanese", "vocab"}, env.itemTags(t, alice, aliceItem))
+	assert.ElementsMatch(t, []string{"japanese/kanji", "jp"}, env.itemTags(t, alice, kanji))
+	assert.ElementsMatch(t, []string{"japanese", "japanese/kanji", "jp", "vocab"}, env.userTags(t, alice))
+	assert.ElementsMatch(t, []string{idStr(aliceItem), idStr(kanji)}, env.taggedItems(t, alice, "japanese"))
+	assert.Empty(t, env.taggedItems(t, alice, "lang/ja"))
+
+	// 合并到已经存在的标签: 已经带有目标标签的 entity 只保留一个
+	assert.Equal(t, 1, env.tagChange(t, alice, http.MethodPost, tagPath("jp", "/merge"), map[string]any{"into": "japanese/kanji"}, http.StatusOK))
+	assert.Equal(t, []string{"japanese/kanji"}, env.itemTags(t, alice, kanji))
+	assert.ElementsMatch(t, []string{"japanese", "japanese/kanji", "vocab"}, env.userTags(t, alice))
+	assert.Empty(t, env.taggedItems(t, alice, "jp"))
+	assert.Equal(t, 1, env.tagChange(t, alice, http.MethodPost, tagPath("vocab", "/merge"), map[string]any{"into": "japanese"}, http.StatusOK))
+	assert.Equal(t, []string{"japanese"}, env.itemTags(t, alice, aliceItem))
+	env.tagChange(t, alice, http.MethodPost, tagPath("japanese", "/merge"), map[string]any{"into": "japanese/kanji"}, http.StatusBadRequest)
+	env.tagChange(t, alice, http.MethodPost, tagPath("missing", "/merge"), map[string]any{"into": "japanese"}, http.StatusNotFound)
+
+	// 删除: 子标签一起移除，entity 保留
+	assert.Equal(t, 2, env.tagChange(t, alice, http.MethodDelete, tagPath("japanese", ""), nil, http.StatusOK))
+	assert.Empty(t, env.itemTags(t, alice, aliceItem))
+	assert.Empty(t, env.itemTags(t, alice, kanji))
+	assert.Empty(t, env.userTags(t, alice))
+	assert.Empty(t, env.taggedItems(t, alice, "japanese"))
+	env.tagChange(t, alice, http.MethodDelete, tagPath("japanese", ""), nil, http.StatusNotFound)
+	assert.Zero(t, env.outboxSize(t))
+}
+
+func TestTagManage_BulkUpdate(t *testing.T) {
+	env := setupEnv(t)
+	const kanji utils.UInt64 = 3002
+	require.NoError(t, env.db.Create(&model.Item{ID: kanji, CreatorID: alice, Type: model.TyItemFlashCard, Content: "kanji"}).Error)
+	env.retagItem(t, aliceItem, "vocab")
+	env.retagItem(t, kanji, "vocab", "hard")
+	dispatchEvents(t)
+	assert.ElementsMatch(t, []string{idStr(aliceItem), idStr(kanji)}, env.taggedItems(t, alice, "vocab"))
+	assert.ElementsMatch(t, []string{"hard", "vocab"}, env.userTags(t, alice))
+
+	// 只能修改自己的 entities
+	body := map[string]any{"entity_ids": []string{idStr(aliceItem), idStr(kanji), idStr(aliceBook)}, "add": []string{"grammar"}, "remove": []string{"vocab"}}
+	env.tagChange(t, bob, http.MethodPost, "/tags/bulk", body, http.StatusNotFound)
+	env.tagChange(t, alice, http.MethodPost, "/tags/bulk", map[string]any{"entity_ids": []string{idStr(aliceItem), idStr(missingID)}, "add": []string{"grammar"}}, http.StatusNotFound)
+	env.tagChange(t, alice, http.MethodPost, "/tags/bulk", map[string]any{"entity_ids": []string{idStr(aliceItem)}}, http.StatusBadRequest)
+	assert.Equal(t, []string{"vocab"}, env.itemTags(t, alice, aliceItem))
+
+	env.tagChange(t, alice, http.MethodPost, "/tags/bulk", body, http.StatusOK)
+	assert.Equal(t, []string{"grammar"}, env.itemTags(t, alice, aliceItem))
+	assert.ElementsMatch(t, []string{"grammar", "hard"}, env.itemTags(t, alice, kanji))
+	assert.ElementsMatch(t, []string{"grammar", "hard"}, env.userTags(t, alice))
+	assert.Empty(t, env.taggedItems(t, alice, "vocab"))
+	assert.ElementsMatch(t, []string{idStr(aliceItem), idStr(kanji)}, env.taggedItems(t, alice, "grammar"))
+	w := env.do(t, alice, http.MethodGet, tagPath("grammar", "/books"), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	books := decodeData[[]map[string]any](t, w.Body.Bytes())
+	require.Len(t, books, 1)
+	assert.Equal(t, idStr(aliceBook), books[0]["id"])
+
+	// 同时添加和移除的标签会被添加
+	env.tagChange(t, alice, http.MethodPost, "/tags/bulk", map[string]any{"entity_ids": []string{idStr(kanji)}, "add": []string{"hard"}, "remove": []string{"hard", "grammar"}}, http.StatusOK)
+	assert.Equal(t, []string{"hard"}, env.itemTags(t, alice, kanji))
+	assert.Equal(t, []string{idStr(aliceItem)}, env.taggedItems(t, alice, "grammar"))
+	assert.Zero(t, env.outboxSize(t))
+}
+
+// 并发地把不同的标签重命名为同一个新标签，只有一个成功，其他的返回 409 而不是被合并
+func TestTagManage_ConcurrentRenameIntoSameTag(t *testing.T) {
+	env := setupConcurrentEnv(t)
+	const n = 4
+	for i := 0; i < n; i++ {
+		itemID := utils.UInt64(3100 + i)
+		require.NoError(t, env.db.Create(&model.Item{ID: itemID, CreatorID: alice, Type: model.TyItemFlashCard, Content: "item"}).Error)
+		env.retagItem(t, itemID, fmt.Sprintf("t%d", i))
+	}
+	dispatchEvents(t)
+
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = env.do(t, alice, http.MethodPut, tagPath(fmt.Sprintf("t%d", i), ""), map[string]any{"tag": "x"}).Code
+		}(i)
+	}
+	wg.Wait()
+	dispatchEvents(t)
+
+	renamed := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			renamed++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
+	}
+	assert.Equal(t, 1, renamed)
+	assert.Len(t, env.taggedItems(t, alice, "x"), 1)
+	assert.Len(t, env.userTags(t, alice), n)
+}
@@ -0,0 +1,28 @@
+package gw_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 创建 item 时只在请求时推荐标签
+func TestTagSuggest_OnlyWhenRequested(t *testing.T) {
+	env := setupEnv(t)
+	env.retagItem(t, aliceItem, "secret")
+	dispatchEvents(t)
+
+	w := env.do(t, alice, http.MethodPost, "/items", map[string]any{"type": "flash_card", "content": "another secret"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotContains(t, decodeData[map[string]any](t, w.Body.Bytes()), "suggested_tags")
+
+	w = env.do(t, alice, http.MethodPost, "/items", map[string]any{"type": "flash_card", "content": "another secret", "suggest_tags": true})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	suggested := decodeData[struct {
+		SuggestedTags []map[string]any `json:"suggested_tags"`
+	}](t, w.Body.Bytes()).SuggestedTags
+	require.NotEmpty(t, suggested)
+	assert.Equal(t, "secret", suggested[0]["tag"])
+}
@@ -0,0 +1,300 @@
+package model
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/khicago/irr"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+type (
+	// AchievementEventType 成就监听的领域事件
+	AchievementEventType string
+
+	// AchievementCounter 成就进度的累计方式
+	AchievementCounter string
+
+	// AchievementReward 解锁成就时发放的积分
+	AchievementReward struct {
+		Currency Currency `yaml:"currency" json:"currency"`
+		Amount   uint64   `yaml:"amount" json:"amount"`
+	}
+
+	// Achievement 成就的定义，由数据 (见 achievements.yaml) 而不是代码描述
+	Achievement struct {
+		ID          utils.UInt64         `yaml:"id" json:"id"`
+		Name        string               `yaml:"name" json:"name"`
+		Description string               `yaml:"description" json:"description"`
+		Event       AchievementEventType `yaml:"event" json:"event"`
+		Counter     AchievementCounter   `yaml:"counter" json:"counter"`
+		Threshold   uint64               `yaml:"threshold" json:"threshold"`
+		Reward      AchievementReward    `yaml:"reward" json:"reward"`
+	}
+
+	// AchievementEvent 一次领域事件。Key 不为空时同一个用户相同 Key 的事件只计入一次，如同一个册子多次公开发布
+	AchievementEvent struct {
+		UserID utils.UInt64
+		Type   AchievementEventType
+		Value  uint64 // 事件的值，sum 累加，max 取最大值；为 0 时视为 1
+		Key    string
+	}
+
+	// UserAchievement 用户在一个成就上的进度，解锁后不再变化
+	UserAchievement struct {
+		UserID        utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"-"`
+		AchievementID utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"achievement_id"`
+		Progress      uint64       `json:"progress"`
+		UnlockedAt    *time.Time   `json:"unlocked_at,omitempty"`
+		UpdatedAt     time.Time    `json:"updated_at"`
+	}
+
+	// AchievementEventKey 已经计入成就的带 Key 的事件
+	AchievementEventKey struct {
+		UserID    utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		EventKey  string       `gorm:"primaryKey;size:128"`
+		CreatedAt time.Time
+	}
+)
+
+const (
+	AchievementEventItemCreated   AchievementEventType = "item.created"   // 创建学习材料，Value 为数量
+	AchievementEventMonsterKilled AchievementEventType = "monster.killed" // 作答结果为 def.AttackComplete
+	AchievementEventStreakReached AchievementEventType = "streak.reached" // 连续打卡增加，Value 为当前的连续天数
+	AchievementEventBossDefeated  AchievementEventType = "boss.defeated"  // 掌握了复习计划中的所有 monsters，Key 为复习计划
+	AchievementEventBookPublished AchievementEventType = "book.published" // 册子公开发布，Key 为册子
+
+	AchievementCounterSum AchievementCounter = "sum"
+	AchievementCounterMax AchievementCounter = "max"
+
+	PointReasonAchievement PointReason = "achievement.unlock"
+
+	// MasteredFamiliarity 熟练度达到这个值时认为已经掌握了 monster
+	MasteredFamiliarity utils.Percentage = 90
+)
+
+var ErrAchievementNotFound = irr.Error("achievement not found")
+
+//go:embed achievements.yaml
+var defaultAchievements []byte
+
+// achievements 当前生效的成就定义，按 id 排序
+var achievements atomic.Pointer[[]*Achievement]
+
+func init() {
+	if err := LoadAchievements(defaultAchievements); err != nil {
+		panic(fmt.Sprintf("load default achievements failed: %v", err))
+	}
+	subscribeAchievementEvents()
+}
+
+// subscribeAchievementEvents 把领域事件转换成成就事件。同步订阅，成就进度和奖励与产生事件的业务一起提交或回滚
+func subscribeAchievementEvents() {
+	const subscriber = "achievement"
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e ItemCreated) error {
+		_, err := RecordAchievementEvent(ctx, tx, AchievementEvent{UserID: e.UserID, Type: AchievementEventItemCreated, Value: uint64(len(e.ItemIDs))})
+		return err
+	})
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e MonsterPracticed) error {
+		if e.Result != def.AttackComplete {
+			return nil
+		}
+		_, err := RecordAchievementEvent(ctx, tx, AchievementEvent{UserID: e.UserID, Type: AchievementEventMonsterKilled})
+		return err
+	})
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e BossDefeated) error {
+		_, err := RecordAchievementEvent(ctx, tx, AchievementEvent{
+			UserID: e.UserID,
+			Type:   AchievementEventBossDefeated,
+			Key:    fmt.Sprintf("%s:%d", AchievementEventBossDefeated, e.DungeonID),
+		})
+		return err
+	})
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e BookPublished) error {
+		_, err := RecordAchievementEvent(ctx, tx, AchievementEvent{
+			UserID: e.UserID,
+			Type:   AchievementEventBookPublished,
+			Key:    fmt.Sprintf("%s:%d", AchievementEventBookPublished, e.BookID),
+		})
+		return err
+	})
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e StreakReached) error {
+		_, err := RecordAchievementEvent(ctx, tx, AchievementEvent{UserID: e.UserID, Type: AchievementEventStreakReached, Value: uint64(e.Streak)})
+		return err
+	})
+}
+
+func (UserAchievement) TableName() string {
+	return "user_achievements"
+}
+
+func (AchievementEventKey) TableName() string {
+	return "achievement_event_keys"
+}
+
+// Valid 是否是支持的事件
+func (t AchievementEventType) Valid() bool {
+	switch t {
+	case AchievementEventItemCreated, AchievementEventMonsterKilled, AchievementEventStreakReached,
+		AchievementEventBossDefeated, AchievementEventBookPublished:
+		return true
+	}
+	return false
+}
+
+// LoadAchievements 解析 YAML 格式的成就定义并替换当前的定义，定义无效时保持当前的定义
+func LoadAchievements(data []byte) error {
+	var defs []*Achievement
+	if err := yaml.Unmarshal(data, &defs); err != nil {
+		return irr.Wrap(err, "parse achievements failed")
+	}
+	ids := make(map[utils.UInt64]bool, len(defs))
+	for _, a := range defs {
+		if a.Counter == "" {
+			a.Counter = AchievementCounterSum
+		}
+		switch {
+		case a.ID == 0 || ids[a.ID]:
+			return irr.Error("achievement id %d is missing or duplicated", a.ID)
+		case !a.Event.Valid():
+			return irr.Error("achievement %d has unknown event %q", a.ID, a.Event)
+		case a.Counter != AchievementCounterSum && a.Counter != AchievementCounterMax:
+			return irr.Error("achievement %d has unknown counter %q", a.ID, a.Counter)
+		case a.Threshold == 0:
+			return irr.Error("achievement %d should have a threshold", a.ID)
+		case a.Reward.Amount > 0 && !a.Reward.Currency.Valid():
+			return irr.Error("achievement %d has invalid reward currency %q", a.ID, a.Reward.Currency)
+		}
+		ids[a.ID] = true
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].ID < defs[j].ID })
+	achievements.Store(&defs)
+	return nil
+}
+
+// Achievements 所有的成就定义，按 id 排序。返回的定义不应该被修改
+func Achievements() []*Achievement {
+	return *achievements.Load()
+}
+
+// GetAchievement 获取成就定义，不存在时返回 ErrAchievementNotFound
+func GetAchievement(id utils.UInt64) (*Achievement, error) {
+	for _, a := range Achievements() {
+		if a.ID == id {
+			return a, nil
+		}
+	}
+	return nil, irr.Wrap(ErrAchievementNotFound, "achievement %d", id)
+}
+
+// RecordAchievementEvent 把事件计入用户监听该事件的成就，进度达到阈值时解锁并发放奖励，返回这次解锁的成就。
+// 需要在产生事件的事务中调用，事务回滚时进度和奖励一起回滚
+func RecordAchievementEvent(ctx context.Context, tx *gorm.DB, event AchievementEvent) ([]*Achievement, error) {
+	var matched []*Achievement
+	for _, a := range Achievements() {
+		if a.Event == event.Type {
+			matched = append(matched, a)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+	if event.Value == 0 {
+		event.Value = 1
+	}
+
+	if event.Key != "" {
+		result := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&AchievementEventKey{UserID: event.UserID, EventKey: event.Key})
+		if result.Error != nil {
+			return nil, irr.Wrap(result.Error, "record achievement event %q of user %d failed", event.Key, event.UserID)
+		}
+		if result.RowsAffected == 0 {
+			return nil, nil // 已经计入过
+		}
+	}
+
+	var unlocked []*Achievement
+	for _, a := range matched {
+		ok, err := advanceAchievement(ctx, tx, event, a)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			unlocked = append(unlocked, a)
+		}
+	}
+	return unlocked, nil
+}
+
+// advanceAchievement 更新一个成就的进度，这次解锁时返回 true
+func advanceAchievement(ctx context.Context, tx *gorm.DB, event AchievementEvent, a *Achievement) (bool, error) {
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&UserAchievement{UserID: event.UserID, AchievementID: a.ID}).Error; err != nil {
+		return false, irr.Wrap(err, "create achievement %d of user %d failed", a.ID, event.UserID)
+	}
+	ua := &UserAchievement{}
+	if err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND achievement_id = ?", event.UserID, a.ID).First(ua).Error; err != nil {
+		return false, irr.Wrap(err, "get achievement %d of user %d failed", a.ID, event.UserID)
+	}
+	if ua.UnlockedAt != nil {
+		return false, nil
+	}
+
+	progress := ua.Progress + event.Value
+	if a.Counter == AchievementCounterMax {
+		progress = max(ua.Progress, event.Value)
+	}
+	if progress == ua.Progress {
+		return false, nil
+	}
+	updater := map[string]any{"progress": progress}
+	if progress >= a.Threshold {
+		updater["unlocked_at"] = time.Now()
+	}
+	if err := tx.WithContext(ctx).Model(&UserAchievement{}).
+		Where("user_id = ? AND achievement_id = ?", event.UserID, a.ID).Updates(updater).Error; err != nil {
+		return false, irr.Wrap(err, "update achievement %d of user %d failed", a.ID, event.UserID)
+	}
+	if progress < a.Threshold {
+		return false, nil
+	}
+
+	if a.Reward.Amount > 0 {
+		if _, _, err := ApplyPointChange(ctx, tx, PointChange{
+			UserID:         event.UserID,
+			Currency:       a.Reward.Currency,
+			Delta:          int64(a.Reward.Amount),
+			Reason:         PointReasonAchievement,
+			RefID:          a.ID,
+			IdempotencyKey: fmt.Sprintf("%s:%d:%d", PointReasonAchievement, event.UserID, a.ID),
+		}); err != nil {
+			return false, irr.Wrap(err, "grant reward of achievement %d to user %d failed", a.ID, event.UserID)
+		}
+	}
+	return true, nil
+}
+
+// GetUserAchievements 获取用户所有成就的进度，以成就 id 为 key，没有进度的成就不存在
+func GetUserAchievements(ctx context.Context, db *gorm.DB, userID utils.UInt64) (map[utils.UInt64]*UserAchievement, error) {
+	var records []*UserAchievement
+	if err := db.WithContext(ctx).Where("user_id = ?", userID).Find(&records).Error; err != nil {
+		return nil, irr.Wrap(err, "get achievements of user %d failed", userID)
+	}
+	ret := make(map[utils.UInt64]*UserAchievement, len(records))
+	for _, r := range records {
+		ret[r.AchievementID] = r
+	}
+	return ret, nil
+}
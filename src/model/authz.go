@@ -0,0 +1,177 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+type (
+	// Resource 受权限控制的资源类型
+	Resource string
+
+	// Action 对资源的操作，高级操作包含低级操作的权限，如有写权限也就有读权限
+	Action uint8
+
+	// Grant 资源所有者显式授予其他用户的权限
+	Grant struct {
+		Resource   Resource     `gorm:"primaryKey;size:32" json:"resource"`
+		ResourceID utils.UInt64 `gorm:"primaryKey" json:"resource_id"`
+		UserID     utils.UInt64 `gorm:"primaryKey;index:idx_grant_user" json:"user_id"`
+		Action     Action       `gorm:"not null" json:"action"`
+		GrantedBy  utils.UInt64 `gorm:"not null" json:"granted_by"`
+		CreatedAt  time.Time    `json:"created_at"`
+		UpdatedAt  time.Time    `json:"updated_at"`
+	}
+
+	// Policy 权限策略，决定用户可以访问哪些资源
+	// handler 的中间件 (见 Authorizer 和 utils.GinMWAuthorize) 和 model 中按 id 查找资源的方法 (如 FindItem) 都通过它限定范围
+	Policy interface {
+		// Scope 把对资源表的查询限定在 userID 有 action 权限的资源内
+		Scope(userID utils.UInt64, resource Resource, action Action) GormScope
+	}
+
+	// OwnerPolicy 默认的权限策略: 资源的所有者拥有全部权限，其他用户只拥有被显式授予的权限 (见 Grant)，
+	// 以及资源被分享时的权限 (如公开或被订阅的 book，见 BookSubscription)
+	OwnerPolicy struct{}
+
+	resourceSchema struct {
+		table       string
+		ownerColumn string
+		model       func() any
+
+		// shared 返回所有者和授权之外，userID 可以以 action 访问的资源的条件，没有时返回空字符串
+		shared func(db *gorm.DB, userID utils.UInt64, action Action) (string, []any)
+	}
+)
+
+const (
+	ResourceItem    Resource = "item"
+	ResourceBook    Resource = "book"
+	ResourceDungeon Resource = "dungeon"
+
+	ActionRead   Action = 1
+	ActionWrite  Action = 2
+	ActionManage Action = 3 // 删除资源等只有所有者才能做的操作
+)
+
+var (
+	_ Policy = OwnerPolicy{}
+
+	resourceSchemas = map[Resource]resourceSchema{
+		ResourceItem:    {table: "items", ownerColumn: "creator_id", model: func() any { return &Item{} }, shared: sharedItems},
+		ResourceBook:    {table: "books", ownerColumn: "user_id", model: func() any { return &Book{} }, shared: sharedBooks},
+		ResourceDungeon: {table: "dungeons", ownerColumn: "user_id", model: func() any { return &Dungeon{} }},
+	}
+
+	policy Policy = OwnerPolicy{}
+)
+
+func (Grant) TableName() string {
+	return "grants"
+}
+
+// AuthzPolicy 当前使用的权限策略
+func AuthzPolicy() Policy {
+	return policy
+}
+
+// SetAuthzPolicy 替换权限策略，需要在处理请求之前调用
+func SetAuthzPolicy(p Policy) {
+	policy = p
+}
+
+func (OwnerPolicy) Scope(userID utils.UInt64, resource Resource, action Action) GormScope {
+	return func(tx *gorm.DB) *gorm.DB {
+		schema, ok := resourceSchemas[resource]
+		if !ok {
+			_ = tx.AddError(irr.Error("unknown resource %s", resource))
+			return tx
+		}
+		db := tx.Session(&gorm.Session{NewDB: true})
+		granted := db.Model(&Grant{}).Select("resource_id").
+			Where("resource = ? AND user_id = ? AND action >= ?", resource, userID, action)
+		cond := fmt.Sprintf("%s.%s = ? OR %s.id IN (?)", schema.table, schema.ownerColumn, schema.table)
+		args := []any{userID, granted}
+		if schema.shared != nil {
+			if sharedCond, sharedArgs := schema.shared(db, userID, action); sharedCond != "" {
+				cond += " OR " + sharedCond
+				args = append(args, sharedArgs...)
+			}
+		}
+		return tx.Where("("+cond+")", args...)
+	}
+}
+
+// Authorize 检查 userID 对资源有 action 权限，资源不存在和没有权限时都返回 gorm.ErrRecordNotFound，不向其他用户暴露资源是否存在
+func Authorize(ctx context.Context, tx *gorm.DB, userID utils.UInt64, resource Resource, id utils.UInt64, action Action) error {
+	ids, err := FilterAuthorized(ctx, tx, userID, resource, []utils.UInt64{id}, action)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Authorizer 返回用于 utils.GinMWAuthorize 的权限检查
+func Authorizer(tx *gorm.DB, resource Resource, action Action) func(ctx context.Context, userID, id utils.UInt64) error {
+	return func(ctx context.Context, userID, id utils.UInt64) error {
+		return Authorize(ctx, tx, userID, resource, id, action)
+	}
+}
+
+// FilterAuthorized 返回 ids 中 userID 有 action 权限的资源 id，不存在的资源也会被过滤掉
+func FilterAuthorized(ctx context.Context, tx *gorm.DB, userID utils.UInt64, resource Resource, ids []utils.UInt64, action Action) ([]utils.UInt64, error) {
+	schema, ok := resourceSchemas[resource]
+	if !ok {
+		return nil, irr.Error("unknown resource %s", resource)
+	}
+	ret := make([]utils.UInt64, 0, len(ids))
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	if err := tx.WithContext(ctx).Model(schema.model()).
+		Scopes(AuthzPolicy().Scope(userID, resource, action)).
+		Where(schema.table+".id IN ?", ids).Pluck(schema.table+".id", &ret).Error; err != nil {
+		return nil, irr.Wrap(err, "filter authorized %s failed", resource)
+	}
+	return ret, nil
+}
+
+// GrantAccess 授予 userID 对资源的 action 权限，已有授权时覆盖
+func GrantAccess(ctx context.Context, tx *gorm.DB, resource Resource, resourceID, userID utils.UInt64, action Action, grantedBy utils.UInt64) error {
+	if _, ok := resourceSchemas[resource]; !ok {
+		return irr.Error("unknown resource %s", resource)
+	}
+	grant := &Grant{
+		Resource:   resource,
+		ResourceID: resourceID,
+		UserID:     userID,
+		Action:     action,
+		GrantedBy:  grantedBy,
+	}
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "resource"}, {Name: "resource_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"action", "granted_by", "updated_at"}),
+	}).Create(grant).Error; err != nil {
+		return irr.Wrap(err, "grant %s %d to user %d failed", resource, resourceID, userID)
+	}
+	return nil
+}
+
+// RevokeAccess 撤销 userID 对资源的授权
+func RevokeAccess(ctx context.Context, tx *gorm.DB, resource Resource, resourceID, userID utils.UInt64) error {
+	if err := tx.WithContext(ctx).Where("resource = ? AND resource_id = ? AND user_id = ?", resource, resourceID, userID).
+		Delete(&Grant{}).Error; err != nil {
+		return irr.Wrap(err, "revoke %s %d from user %d failed", resource, resourceID, userID)
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/khgame/memstore/cachekey"
 
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
 
 	"github.com/khicago/irr"
 
@@ -24,8 +25,12 @@ type Book struct {
 	UserID      utils.UInt64 `gorm:"index:idx_user;not null" json:"user_id"`
 	Title       string       `gorm:"not null"`
 	Description string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+
+	Visibility def.BookVisibility `gorm:"not null;default:0"`
+	ShareCode  *string            `gorm:"size:16;uniqueIndex:uk_share_code"` // 分享链接中的随机码，第一次设置为非私有时生成，见 SetBookVisibility
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
 
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
@@ -89,17 +94,22 @@ func (b *Book) TableName() string {
 }
 
 type BookItem struct {
-	BookID utils.UInt64 `gorm:"primaryKey"`
+	BookID utils.UInt64 `gorm:"primaryKey;index:idx_book_item_order,priority:1"`
 	ItemID utils.UInt64 `gorm:"primaryKey"`
+
+	// 在书中的位置，见 BookChapter
+	ChapterID utils.UInt64 `gorm:"not null;default:0;index:idx_book_item_order,priority:2"` // 0 表示不属于任何章节
+	Rank      string       `gorm:"size:64;not null;default:'';index:idx_book_item_order,priority:3"`
 }
 
 func (b *BookItem) TableName() string {
 	return "book_items"
 }
 
-func FindBook(ctx context.Context, tx *gorm.DB, id utils.UInt64) (*Book, error) {
+// FindBook 查找 userID 有 action 权限的 book，不存在或没有权限时返回 gorm.ErrRecordNotFound
+func FindBook(ctx context.Context, tx *gorm.DB, userID, id utils.UInt64, action Action) (*Book, error) {
 	book := &Book{}
-	result := tx.Where("id = ?", id).First(book)
+	result := tx.WithContext(ctx).Scopes(AuthzPolicy().Scope(userID, ResourceBook, action)).Where("books.id = ?", id).First(book)
 	if err := result.Error; err != nil {
 		return nil, err
 	}
@@ -110,14 +120,16 @@ func (b *Book) GetTags(ctx context.Context) ([]string, error) {
 	return TagModel().GetTagsOfEntity(ctx, b.ID)
 }
 
+// MPutItems 把 items 按顺序追加到 book 的末尾，已经在 book 中的 items 位置不变
 func (b *Book) MPutItems(ctx context.Context, tx *gorm.DB, itemIDs []utils.UInt64) (successItemIDs []utils.UInt64, err error) {
 	successItemIDs = make([]utils.UInt64, 0, len(itemIDs))
-	for _, id := range itemIDs {
-		bookItem := &BookItem{
-			BookID: b.ID,
-			ItemID: id,
-		}
-		if err = tx.Where(bookItem).FirstOrCreate(bookItem).Error; err != nil {
+	bookItems, err := NewBookItems(ctx, tx, b.ID, 0, itemIDs)
+	if err != nil {
+		return successItemIDs, irr.Wrap(err, "failed to place items in book")
+	}
+	for i, id := range itemIDs {
+		bookItem := &bookItems[i]
+		if err = tx.Where(BookItem{BookID: b.ID, ItemID: id}).FirstOrCreate(bookItem).Error; err != nil {
 			return successItemIDs, irr.Wrap(err, "failed to add item to book")
 		}
 		successItemIDs = append(successItemIDs, id)
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+type (
+	// BookActivityType book 动态的类型
+	BookActivityType string
+
+	// BookActivity book 的动态，记录成员对 book 和其中 items 的修改
+	BookActivity struct {
+		ID        utils.UInt64     `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		BookID    utils.UInt64     `gorm:"not null;index:idx_activity_book" json:"book_id"`
+		UserID    utils.UInt64     `gorm:"not null" json:"user_id"` // 操作者
+		Type      BookActivityType `gorm:"size:32;not null" json:"type"`
+		TargetID  utils.UInt64     `json:"target_id,omitempty"`              // item、章节或成员的 id
+		Detail    string           `gorm:"size:255" json:"detail,omitempty"` // 如成员的新角色
+		CreatedAt time.Time        `json:"created_at"`
+	}
+)
+
+const (
+	BookActivityUpdated        BookActivityType = "book.updated"
+	BookActivityVisibility     BookActivityType = "book.visibility"
+	BookActivityItemAdded      BookActivityType = "item.added"
+	BookActivityItemRemoved    BookActivityType = "item.removed"
+	BookActivityItemUpdated    BookActivityType = "item.updated"
+	BookActivityItemDeleted    BookActivityType = "item.deleted"
+	BookActivityMemberSet      BookActivityType = "member.set"
+	BookActivityMemberRemoved  BookActivityType = "member.removed"
+	BookActivityUpstreamPulled BookActivityType = "upstream.pulled"
+	BookActivityChapterCreated BookActivityType = "chapter.created"
+	BookActivityChapterUpdated BookActivityType = "chapter.updated"
+	BookActivityChapterDeleted BookActivityType = "chapter.deleted"
+	BookActivityItemMoved      BookActivityType = "item.moved"
+)
+
+func (BookActivity) TableName() string {
+	return "book_activities"
+}
+
+// RecordBookActivity 记录 userID 对 book 的操作，targetIDs 不为空时每个 target 记录一条
+func RecordBookActivity(ctx context.Context, tx *gorm.DB, bookID, userID utils.UInt64, typ BookActivityType, detail string, targetIDs ...utils.UInt64) error {
+	if len(targetIDs) == 0 {
+		targetIDs = []utils.UInt64{0}
+	}
+	ids, err := utils.MGenIDU64(ctx, len(targetIDs))
+	if err != nil {
+		return irr.Wrap(err, "generate activity ids failed")
+	}
+	if len(ids) != len(targetIDs) {
+		return irr.Error("generate activity ids failed, want %d, got %d", len(targetIDs), len(ids))
+	}
+	activities := make([]*BookActivity, 0, len(targetIDs))
+	for i, targetID := range targetIDs {
+		activities = append(activities, &BookActivity{
+			ID:       ids[i],
+			BookID:   bookID,
+			UserID:   userID,
+			Type:     typ,
+			TargetID: targetID,
+			Detail:   detail,
+		})
+	}
+	if err = tx.WithContext(ctx).Create(&activities).Error; err != nil {
+		return irr.Wrap(err, "record %s activity of book %d failed", typ, bookID)
+	}
+	return nil
+}
+
+// RecordItemActivity 在包含 item 的所有 book 中记录 userID 对 item 的操作
+func RecordItemActivity(ctx context.Context, tx *gorm.DB, userID, itemID utils.UInt64, typ BookActivityType) error {
+	var bookIDs []utils.UInt64
+	if err := tx.WithContext(ctx).Model(&BookItem{}).Where("item_id = ?", itemID).Pluck("book_id", &bookIDs).Error; err != nil {
+		return irr.Wrap(err, "get books of item %d failed", itemID)
+	}
+	for _, bookID := range bookIDs {
+		if err := RecordBookActivity(ctx, tx, bookID, userID, typ, "", itemID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBookActivities 获取 book 的动态，最新的在前
+func GetBookActivities(ctx context.Context, tx *gorm.DB, bookID utils.UInt64, offset, limit int) ([]*BookActivity, int64, error) {
+	query := tx.WithContext(ctx).Model(&BookActivity{}).Where("book_id = ?", bookID)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count activities of book %d failed", bookID)
+	}
+	var activities []*BookActivity
+	if err := query.Order("created_at DESC, id DESC").Offset(offset).Limit(limit).Find(&activities).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get activities of book %d failed", bookID)
+	}
+	return activities, total, nil
+}
+
+// DeleteBookActivities 删除 book 的动态，book 被删除时调用
+func DeleteBookActivities(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) error {
+	if err := tx.WithContext(ctx).Where("book_id = ?", bookID).Delete(&BookActivity{}).Error; err != nil {
+		return irr.Wrap(err, "delete activities of book %d failed", bookID)
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/rank"
+)
+
+type (
+	// BookChapter book 中的章节，可以嵌套。同一父章节下的章节、同一章节中的 items 都按 Rank 排序，
+	// Rank 是分数式的 key (见 pkg/rank)，移动时只需要修改被移动的记录
+	BookChapter struct {
+		ID        utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		BookID    utils.UInt64 `gorm:"not null;index:idx_chapter_book" json:"book_id"`
+		ParentID  utils.UInt64 `gorm:"not null;default:0" json:"parent_id,omitempty"` // 0 表示顶层章节
+		Title     string       `gorm:"size:255;not null" json:"title"`
+		Rank      string       `gorm:"size:64;not null" json:"-"`
+		CreatedAt time.Time    `json:"created_at"`
+		UpdatedAt time.Time    `json:"updated_at"`
+	}
+
+	// Placement 在目标列表中的位置，Before 和 After 为列表中相邻记录的 id，都为 0 时放在末尾
+	Placement struct {
+		Before utils.UInt64 `json:"before,omitempty"`
+		After  utils.UInt64 `json:"after,omitempty"`
+	}
+
+	ranked struct {
+		ID   utils.UInt64
+		Rank string
+	}
+)
+
+var (
+	ErrChapterCycle     = irr.Error("cannot move a chapter into itself or its descendants")
+	ErrInvalidPlacement = irr.Error("placement target is not in the list")
+)
+
+func (BookChapter) TableName() string {
+	return "book_chapters"
+}
+
+// placeRanks 计算把 moved 按顺序插入 siblings (已排序，不包含 moved) 中 p 指定位置时需要写入的 rank。
+// 通常只需要为 moved 生成新的 rank；siblings 中有旧数据没有 rank 或 rank 过长时，整个列表重新分布
+func placeRanks(siblings []ranked, moved []utils.UInt64, p Placement) (map[utils.UInt64]string, error) {
+	idx := len(siblings)
+	if p.After != 0 || p.Before != 0 {
+		idx = -1
+		for i, s := range siblings {
+			if p.After != 0 && s.ID == p.After {
+				idx = i + 1
+				break
+			}
+			if p.After == 0 && s.ID == p.Before {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, irr.Wrap(ErrInvalidPlacement, "placement %+v", p)
+		}
+	}
+
+	ret := make(map[utils.UInt64]string, len(moved))
+	if len(moved) == 0 {
+		return ret, nil
+	}
+	lo, hi := "", ""
+	if idx > 0 {
+		lo = siblings[idx-1].Rank
+	}
+	if idx < len(siblings) {
+		hi = siblings[idx].Rank
+	}
+	if keys, err := rank.BetweenN(lo, hi, len(moved)); err == nil && validRanks(siblings) && len(keys[len(keys)-1]) <= rank.MaxLen {
+		for i, id := range moved {
+			ret[id] = keys[i]
+		}
+		return ret, nil
+	}
+
+	// 重新分布整个列表
+	order := make([]utils.UInt64, 0, len(siblings)+len(moved))
+	for _, s := range siblings[:idx] {
+		order = append(order, s.ID)
+	}
+	order = append(order, moved...)
+	for _, s := range siblings[idx:] {
+		order = append(order, s.ID)
+	}
+	for i, key := range rank.Spread(len(order)) {
+		ret[order[i]] = key
+	}
+	return ret, nil
+}
+
+func validRanks(list []ranked) bool {
+	for _, r := range list {
+		if rank.Validate(r.Rank) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// sortRanked 按 rank 排序，没有 rank 的旧数据按 id 排在最前
+func sortRanked(list []ranked) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Rank != list[j].Rank {
+			return list[i].Rank < list[j].Rank
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+func chapterSiblings(ctx context.Context, tx *gorm.DB, bookID, parentID utils.UInt64, exclude ...utils.UInt64) ([]ranked, error) {
+	var list []ranked
+	query := tx.WithContext(ctx).Model(&BookChapter{}).Select("id, `rank`").Where("book_id = ? AND parent_id = ?", bookID, parentID)
+	if len(exclude) > 0 {
+		query = query.Where("id NOT IN ?", exclude)
+	}
+	if err := query.Scan(&list).Error; err != nil {
+		return nil, irr.Wrap(err, "get chapters of book %d failed", bookID)
+	}
+	sortRanked(list)
+	return list, nil
+}
+
+func chapterItems(ctx context.Context, tx *gorm.DB, bookID, chapterID utils.UInt64, exclude ...utils.UInt64) ([]ranked, error) {
+	var list []ranked
+	query := tx.WithContext(ctx).Model(&BookItem{}).Select("item_id AS id, `rank`").Where("book_id = ? AND chapter_id = ?", bookID, chapterID)
+	if len(exclude) > 0 {
+		query = query.Where("item_id NOT IN ?", exclude)
+	}
+	if err := query.Scan(&list).Error; err != nil {
+		return nil, irr.Wrap(err, "get items of chapter %d failed", chapterID)
+	}
+	sortRanked(list)
+	return list, nil
+}
+
+func saveChapterRanks(ctx context.Context, tx *gorm.DB, parentID utils.UInt64, ranks map[utils.UInt64]string) error {
+	for id, key := range ranks {
+		if err := tx.WithContext(ctx).Model(&BookChapter{}).Where("id = ?", id).
+			Updates(map[string]any{"parent_id": parentID, "rank": key}).Error; err != nil {
+			return irr.Wrap(err, "update rank of chapter %d failed", id)
+		}
+	}
+	return nil
+}
+
+func saveItemRanks(ctx context.Context, tx *gorm.DB, bookID, chapterID utils.UInt64, ranks map[utils.UInt64]string) error {
+	for id, key := range ranks {
+		if err := tx.WithContext(ctx).Model(&BookItem{}).Where("book_id = ? AND item_id = ?", bookID, id).
+			Updates(map[string]any{"chapter_id": chapterID, "rank": key}).Error; err != nil {
+			return irr.Wrap(err, "update rank of item %d in book %d failed", id, bookID)
+		}
+	}
+	return nil
+}
+
+// NewBookItems 创建把 itemIDs 按顺序追加到 book 的章节末尾的记录，chapterID 为 0 时追加到不属于任何章节的 items 末尾。
+// 返回的记录需要由调用方写入；列表中已有的 items 会被重新分布时直接在这里更新
+func NewBookItems(ctx context.Context, tx *gorm.DB, bookID, chapterID utils.UInt64, itemIDs []utils.UInt64) ([]BookItem, error) {
+	siblings, err := chapterItems(ctx, tx, bookID, chapterID, itemIDs...)
+	if err != nil {
+		return nil, err
+	}
+	ranks, err := placeRanks(siblings, itemIDs, Placement{})
+	if err != nil {
+		return nil, err
+	}
+	// 重新分布时 siblings 的 rank 也需要更新
+	if len(ranks) > len(itemIDs) {
+		existing := make(map[utils.UInt64]string, len(siblings))
+		for _, s := range siblings {
+			existing[s.ID] = ranks[s.ID]
+		}
+		if err = saveItemRanks(ctx, tx, bookID, chapterID, existing); err != nil {
+			return nil, err
+		}
+	}
+	items := make([]BookItem, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		items = append(items, BookItem{BookID: bookID, ItemID: id, ChapterID: chapterID, Rank: ranks[id]})
+	}
+	return items, nil
+}
+
+// GetBookChapters 获取 book 的所有章节，按书中的顺序 (深度优先) 排列
+func GetBookChapters(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) ([]*BookChapter, error) {
+	var chapters []*BookChapter
+	if err := tx.WithContext(ctx).Where("book_id = ?", bookID).Find(&chapters).Error; err != nil {
+		return nil, irr.Wrap(err, "get chapters of book %d failed", bookID)
+	}
+	children := make(map[utils.UInt64][]*BookChapter)
+	for _, c := range chapters {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+	ordered := make([]*BookChapter, 0, len(chapters))
+	var walk func(parentID utils.UInt64)
+	walk = func(parentID utils.UInt64) {
+		list := children[parentID]
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Rank != list[j].Rank {
+				return list[i].Rank < list[j].Rank
+			}
+			return list[i].ID < list[j].ID
+		})
+		for _, c := range list {
+			ordered = append(ordered, c)
+			walk(c.ID)
+		}
+	}
+	walk(0)
+	return ordered, nil
+}
+
+// FindBookChapter 查找 book 中的章节，不存在时返回 gorm.ErrRecordNotFound
+func FindBookChapter(ctx context.Context, tx *gorm.DB, bookID, chapterID utils.UInt64) (*BookChapter, error) {
+	chapter := &BookChapter{}
+	if err := tx.WithContext(ctx).Where("book_id = ? AND id = ?", bookID, chapterID).First(chapter).Error; err != nil {
+		return nil, err
+	}
+	return chapter, nil
+}
+
+// checkChapterParent 校验 parentID 是 book 中的章节 (0 表示顶层)，并且不是 chapterID 自己或它的子孙
+func checkChapterParent(ctx context.Context, tx *gorm.DB, bookID, parentID, chapterID utils.UInt64) error {
+	for id := parentID; id != 0; {
+		if id == chapterID {
+			return ErrChapterCycle
+		}
+		parent, err := FindBookChapter(ctx, tx, bookID, id)
+		if err != nil {
+			return irr.Wrap(err, "parent chapter %d", id)
+		}
+		id = parent.ParentID
+	}
+	return nil
+}
+
+// CreateBookChapter 在 parentID 下 p 指定的位置创建章节
+func CreateBookChapter(ctx context.Context, tx *gorm.DB, bookID, parentID utils.UInt64, title string, p Placement) (*BookChapter, error) {
+	if err := checkChapterParent(ctx, tx, bookID, parentID, 0); err != nil {
+		return nil, err
+	}
+	id, err := utils.GenIDU64(ctx)
+	if err != nil {
+		return nil, irr.Wrap(err, "generate chapter id failed")
+	}
+	siblings, err := chapterSiblings(ctx, tx, bookID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	ranks, err := placeRanks(siblings, []utils.UInt64{id}, p)
+	if err != nil {
+		return nil, err
+	}
+	chapter := &BookChapter{ID: id, BookID: bookID, ParentID: parentID, Title: title, Rank: ranks[id]}
+	delete(ranks, id)
+	if err = saveChapterRanks(ctx, tx, parentID, ranks); err != nil {
+		return nil, err
+	}
+	if err = tx.WithContext(ctx).Create(chapter).Error; err != nil {
+		return nil, irr.Wrap(err, "create chapter in book %d failed", bookID)
+	}
+	return chapter, nil
+}
+
+// MoveBookChapter 把章节 (连同其中的 items 和子章节) 移动到 parentID 下 p 指定的位置
+func MoveBookChapter(ctx context.Context, tx *gorm.DB, chapter *BookChapter, parentID utils.UInt64, p Placement) error {
+	if err := checkChapterParent(ctx, tx, chapter.BookID, parentID, chapter.ID); err != nil {
+		return err
+	}
+	siblings, err := chapterSiblings(ctx, tx, chapter.BookID, parentID, chapter.ID)
+	if err != nil {
+		return err
+	}
+	ranks, err := placeRanks(siblings, []utils.UInt64{chapter.ID}, p)
+	if err != nil {
+		return err
+	}
+	if err = saveChapterRanks(ctx, tx, parentID, ranks); err != nil {
+		return err
+	}
+	chapter.ParentID, chapter.Rank = parentID, ranks[chapter.ID]
+	return nil
+}
+
+// DeleteBookChapter 删除章节，其中的 items 和子章节按原来的顺序移动到父章节的末尾
+func DeleteBookChapter(ctx context.Context, tx *gorm.DB, chapter *BookChapter) error {
+	children, err := chapterSiblings(ctx, tx, chapter.BookID, chapter.ID)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		siblings, err := chapterSiblings(ctx, tx, chapter.BookID, chapter.ParentID, chapter.ID)
+		if err != nil {
+			return err
+		}
+		ranks, err := placeRanks(siblings, rankedIDs(children), Placement{})
+		if err != nil {
+			return err
+		}
+		if err = saveChapterRanks(ctx, tx, chapter.ParentID, ranks); err != nil {
+			return err
+		}
+	}
+
+	items, err := chapterItems(ctx, tx, chapter.BookID, chapter.ID)
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 {
+		if err = moveItems(ctx, tx, chapter.BookID, rankedIDs(items), chapter.ParentID, Placement{}); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.WithContext(ctx).Delete(chapter).Error; err != nil {
+		return irr.Wrap(err, "delete chapter %d failed", chapter.ID)
+	}
+	return nil
+}
+
+func rankedIDs(list []ranked) []utils.UInt64 {
+	ids := make([]utils.UInt64, 0, len(list))
+	for _, r := range list {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func moveItems(ctx context.Context, tx *gorm.DB, bookID utils.UInt64, itemIDs []utils.UInt64, chapterID utils.UInt64, p Placement) error {
+	siblings, err := chapterItems(ctx, tx, bookID, chapterID, itemIDs...)
+	if err != nil {
+		return err
+	}
+	ranks, err := placeRanks(siblings, itemIDs, p)
+	if err != nil {
+		return err
+	}
+	return saveItemRanks(ctx, tx, bookID, chapterID, ranks)
+}
+
+// MoveBookItems 把 book 中的 itemIDs 按给定的顺序移动到章节 chapterID (0 表示不属于任何章节) 中 p 指定的位置，
+// items 不都在 book 中或章节不存在时返回 gorm.ErrRecordNotFound
+func MoveBookItems(ctx context.Context, tx *gorm.DB, bookID utils.UInt64, itemIDs []utils.UInt64, chapterID utils.UInt64, p Placement) error {
+	if chapterID != 0 {
+		if _, err := FindBookChapter(ctx, tx, bookID, chapterID); err != nil {
+			return irr.Wrap(err, "chapter %d", chapterID)
+		}
+	}
+	seen := make(map[utils.UInt64]bool, len(itemIDs))
+	for _, id := range itemIDs {
+		if seen[id] || id == p.Before || id == p.After {
+			return irr.Wrap(ErrInvalidPlacement, "item %d is duplicated or used as placement", id)
+		}
+		seen[id] = true
+	}
+	var count int64
+	if err := tx.WithContext(ctx).Model(&BookItem{}).Where("book_id = ? AND item_id IN ?", bookID, itemIDs).
+		Count(&count).Error; err != nil {
+		return irr.Wrap(err, "count items of book %d failed", bookID)
+	}
+	if int(count) != len(itemIDs) {
+		return irr.Wrap(gorm.ErrRecordNotFound, "some items are not in book %d, items= %v", bookID, itemIDs)
+	}
+	return moveItems(ctx, tx, bookID, itemIDs, chapterID, p)
+}
+
+// GetOrderedItemIDsOfBook 按书中的顺序获取 book 的所有 item ids: 先是不属于任何章节的 items，
+// 然后按章节的顺序 (深度优先)，章节内按 rank 排列
+func GetOrderedItemIDsOfBook(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) ([]utils.UInt64, error) {
+	chapters, err := GetBookChapters(ctx, tx, bookID)
+	if err != nil {
+		return nil, err
+	}
+	chapterOrder := make(map[utils.UInt64]int, len(chapters)+1)
+	for i, c := range chapters {
+		chapterOrder[c.ID] = i + 1
+	}
+
+	var bookItems []BookItem
+	if err = tx.WithContext(ctx).Where("book_id = ?", bookID).Find(&bookItems).Error; err != nil {
+		return nil, irr.Wrap(err, "get items of book %d failed", bookID)
+	}
+	sort.SliceStable(bookItems, func(i, j int) bool {
+		a, b := &bookItems[i], &bookItems[j]
+		if oa, ob := chapterOrder[a.ChapterID], chapterOrder[b.ChapterID]; oa != ob {
+			return oa < ob
+		}
+		if a.Rank != b.Rank {
+			return a.Rank < b.Rank
+		}
+		return a.ItemID < b.ItemID
+	})
+	ids := make([]utils.UInt64, 0, len(bookItems))
+	for _, bi := range bookItems {
+		ids = append(ids, bi.ItemID)
+	}
+	return ids, nil
+}
+
+// copyBookOrder 把 source book 的章节复制到 target book，并按 itemMap (source item -> target item) 复制 items 的位置
+func copyBookOrder(ctx context.Context, tx *gorm.DB, sourceBookID, targetBookID utils.UInt64, itemMap map[utils.UInt64]utils.UInt64) error {
+	chapters, err := GetBookChapters(ctx, tx, sourceBookID)
+	if err != nil {
+		return err
+	}
+	chapterMap := map[utils.UInt64]utils.UInt64{0: 0}
+	if len(chapters) > 0 {
+		ids, err := utils.MGenIDU64(ctx, len(chapters))
+		if err != nil {
+			return irr.Wrap(err, "generate chapter ids failed")
+		}
+		if len(ids) != len(chapters) {
+			return irr.Error("generate chapter ids failed, want %d, got %d", len(chapters), len(ids))
+		}
+		// GetBookChapters 是深度优先的顺序，父章节总在子章节之前
+		for i, c := range chapters {
+			chapterMap[c.ID] = ids[i]
+			if err = tx.WithContext(ctx).Create(&BookChapter{
+				ID:       ids[i],
+				BookID:   targetBookID,
+				ParentID: chapterMap[c.ParentID],
+				Title:    c.Title,
+				Rank:     c.Rank,
+			}).Error; err != nil {
+				return irr.Wrap(err, "copy chapter %d failed", c.ID)
+			}
+		}
+	}
+
+	var bookItems []BookItem
+	if err = tx.WithContext(ctx).Where("book_id = ?", sourceBookID).Find(&bookItems).Error; err != nil {
+		return irr.Wrap(err, "get items of book %d failed", sourceBookID)
+	}
+	for _, bi := range bookItems {
+		target, ok := itemMap[bi.ItemID]
+		if !ok {
+			continue
+		}
+		if err = tx.WithContext(ctx).Model(&BookItem{}).Where("book_id = ? AND item_id = ?", targetBookID, target).
+			Updates(map[string]any{"chapter_id": chapterMap[bi.ChapterID], "rank": bi.Rank}).Error; err != nil {
+			return irr.Wrap(err, "copy position of item %d failed", bi.ItemID)
+		}
+	}
+	return nil
+}
+
+// DeleteBookChapters 删除 book 的所有章节，book 被删除时调用
+func DeleteBookChapters(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) error {
+	if err := tx.WithContext(ctx).Where("book_id = ?", bookID).Delete(&BookChapter{}).Error; err != nil {
+		return irr.Wrap(err, "delete chapters of book %d failed", bookID)
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+type (
+	// ItemSnapshot item 中参与 fork 三方比对的内容
+	ItemSnapshot struct {
+		Type       string              `gorm:"size:50" json:"type"`
+		Content    string              `gorm:"type:text" json:"content"`
+		Difficulty def.DifficultyLevel `json:"difficulty"`
+		Importance def.ImportanceLevel `json:"importance"`
+		Tags       []string            `gorm:"serializer:json;type:text" json:"tags"` // 排序后的标签
+	}
+
+	// BookFork 记录 fork 出的 book 的来源
+	BookFork struct {
+		BookID       utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		SourceBookID utils.UInt64 `gorm:"not null;index:idx_fork_source"`
+		UserID       utils.UInt64 `gorm:"not null"`
+		PulledAt     *time.Time   // 上次同步上游修改的时间
+		CreatedAt    time.Time
+	}
+
+	// ItemFork 记录 fork 出的 item 的来源，Base 为上次同步时上游 item 的内容，
+	// 和本地 (mine)、上游当前 (theirs) 的内容一起做三方比对
+	ItemFork struct {
+		ItemID       utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		BookID       utils.UInt64 `gorm:"not null;index:idx_item_fork_book"`
+		SourceItemID utils.UInt64 `gorm:"not null"`
+		BaseRevision uint32       `gorm:"not null"`
+		Base         ItemSnapshot `gorm:"embedded;embeddedPrefix:base_"`
+		CreatedAt    time.Time
+		UpdatedAt    time.Time
+	}
+
+	// UpstreamStatus 上游 item 相对 fork 的变化
+	UpstreamStatus string
+
+	// ItemFieldDiff item 中一个字段的三方比对，只包含上游修改过的字段
+	ItemFieldDiff struct {
+		Field    string `json:"field"`
+		Base     any    `json:"base"`
+		Mine     any    `json:"mine"`
+		Theirs   any    `json:"theirs"`
+		Conflict bool   `json:"conflict"` // 本地也修改了这个字段，并且和上游不一致
+	}
+
+	// ItemUpstreamChange 一个上游 item 的变化
+	ItemUpstreamChange struct {
+		Status         UpstreamStatus   `json:"status"`
+		SourceItemID   utils.UInt64     `json:"source_item_id"`
+		ItemID         utils.UInt64     `json:"item_id,omitempty"` // fork 中对应的 item，added 时为空
+		BaseRevision   uint32           `json:"base_revision,omitempty"`
+		SourceRevision uint32           `json:"source_revision,omitempty"`
+		Fields         []*ItemFieldDiff `json:"fields,omitempty"` // modified 时返回
+		Theirs         *ItemSnapshot    `json:"theirs,omitempty"` // added 时返回上游的内容
+
+		link   *ItemFork
+		source *Item
+		theirs *ItemSnapshot
+	}
+
+	// UpstreamPick 用户选择同步的上游变化，Fields 为空时同步该 item 所有被修改的字段
+	UpstreamPick struct {
+		SourceItemID utils.UInt64 `json:"source_item_id"`
+		Fields       []string     `json:"fields,omitempty"`
+	}
+)
+
+const (
+	UpstreamAdded    UpstreamStatus = "added"    // 上游 book 新增的 item
+	UpstreamRemoved  UpstreamStatus = "removed"  // 上游 book 移除或删除了 item
+	UpstreamModified UpstreamStatus = "modified" // 上游修改了 item 的内容或标签
+)
+
+var (
+	ErrNotForked              = irr.Error("book is not a fork")
+	ErrUpstreamChangeNotFound = irr.Error("upstream change not found")
+
+	// ItemSnapshotFields 参与三方比对的字段
+	ItemSnapshotFields = []string{"type", "content", "difficulty", "importance", "tags"}
+)
+
+func (BookFork) TableName() string {
+	return "book_forks"
+}
+
+func (ItemFork) TableName() string {
+	return "item_forks"
+}
+
+func newItemSnapshot(item *Item, tags []string) *ItemSnapshot {
+	sorted := append(make([]string, 0, len(tags)), tags...)
+	sort.Strings(sorted)
+	return &ItemSnapshot{
+		Type:       item.Type,
+		Content:    item.Content,
+		Difficulty: item.Difficulty,
+		Importance: item.Importance,
+		Tags:       sorted,
+	}
+}
+
+func (s *ItemSnapshot) field(name string) any {
+	switch name {
+	case "type":
+		return s.Type
+	case "content":
+		return s.Content
+	case "difficulty":
+		return s.Difficulty
+	case "importance":
+		return s.Importance
+	case "tags":
+		if s.Tags == nil {
+			return []string{}
+		}
+		return s.Tags
+	default:
+		return nil
+	}
+}
+
+// diffSnapshots 返回上游相对 base 修改过、且和本地不一致的字段
+func diffSnapshots(base, mine, theirs *ItemSnapshot) []*ItemFieldDiff {
+	var diffs []*ItemFieldDiff
+	for _, name := range ItemSnapshotFields {
+		b, m, t := base.field(name), mine.field(name), theirs.field(name)
+		if reflect.DeepEqual(t, b) || reflect.DeepEqual(m, t) {
+			continue
+		}
+		diffs = append(diffs, &ItemFieldDiff{
+			Field: name, Base: b, Mine: m, Theirs: t,
+			Conflict: !reflect.DeepEqual(m, b),
+		})
+	}
+	return diffs
+}
+
+func snapshotItems(ctx context.Context, items []Item) (map[utils.UInt64]*ItemSnapshot, error) {
+	ret := make(map[utils.UInt64]*ItemSnapshot, len(items))
+	for i := range items {
+		tags, err := TagModel().GetTagsOfEntity(ctx, items[i].ID)
+		if err != nil {
+			return nil, irr.Wrap(err, "get tags of item %d failed", items[i].ID)
+		}
+		ret[items[i].ID] = newItemSnapshot(&items[i], tags)
+	}
+	return ret, nil
+}
+
+func itemsOfBook(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) ([]Item, error) {
+	var items []Item
+	if err := tx.WithContext(ctx).Model(&Item{}).Joins("JOIN book_items ON book_items.item_id = items.id").
+		Where("book_items.book_id = ?", bookID).Order("items.id ASC").Find(&items).Error; err != nil {
+		return nil, irr.Wrap(err, "get items of book %d failed", bookID)
+	}
+	return items, nil
+}
+
+// copyItems 把 sources 复制为 userID 的新 items (新的 id) 并加入 bookID，同时复制标签和引用的 media 并记录来源
+func copyItems(ctx context.Context, tx *gorm.DB, userID, bookID utils.UInt64, sources []Item) ([]utils.UInt64, error) {
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	snapshots, err := snapshotItems(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := utils.MGenIDU64(ctx, len(sources))
+	if err != nil {
+		return nil, irr.Wrap(err, "generate item ids failed")
+	}
+	if len(ids) != len(sources) {
+		return nil, irr.Error("generate item ids failed, want %d, got %d", len(sources), len(ids))
+	}
+
+	// 复制出的 items 追加在 book 的末尾，fork 时再按来源 book 的章节调整位置 (见 copyBookOrder)
+	bookItems, err := NewBookItems(ctx, tx, bookID, 0, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sources {
+		src, snapshot := &sources[i], snapshots[sources[i].ID]
+		item := &Item{
+			ID:         ids[i],
+			CreatorID:  userID,
+			Type:       src.Type,
+			Content:    src.Content,
+			Difficulty: src.Difficulty,
+			Importance: src.Importance,
+		}
+		if err = tx.Create(item).Error; err != nil {
+			return nil, irr.Wrap(err, "copy item %d failed", src.ID)
+		}
+		if err = tx.Create(&bookItems[i]).Error; err != nil {
+			return nil, irr.Wrap(err, "add item %d to book %d failed", item.ID, bookID)
+		}
+		if len(snapshot.Tags) > 0 {
+			if err = AddEntityTags(ctx, tx, userID, EntityTypeItem, item.ID, snapshot.Tags...); err != nil {
+				return nil, irr.Wrap(err, "copy tags of item %d failed", src.ID)
+			}
+		}
+		if err = copyItemMedia(ctx, tx, userID, src, item.ID); err != nil {
+			return nil, err
+		}
+		if err = tx.Create(&ItemFork{
+			ItemID:       item.ID,
+			BookID:       bookID,
+			SourceItemID: src.ID,
+			BaseRevision: src.Revision,
+			Base:         *snapshot,
+		}).Error; err != nil {
+			return nil, irr.Wrap(err, "record provenance of item %d failed", item.ID)
+		}
+	}
+	return ids, nil
+}
+
+// ForkBook 把 source 复制到 userID 名下: 新的 book、章节、其中的 items (使用新的 id) 和它们的标签，
+// 并记录来源，之后可以通过 DiffUpstream 和 PullUpstream 同步上游的修改。返回新的 book 和复制出的 item ids
+func ForkBook(ctx context.Context, tx *gorm.DB, userID utils.UInt64, source *Book, title string) (*Book, []utils.UInt64, error) {
+	sources, err := itemsOfBook(ctx, tx, source.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	bookID, err := utils.GenIDU64(ctx)
+	if err != nil {
+		return nil, nil, irr.Wrap(err, "generate book id failed")
+	}
+	if title == "" {
+		title = source.Title
+	}
+
+	fork := &Book{
+		ID:          bookID,
+		UserID:      userID,
+		Title:       title,
+		Description: source.Description,
+	}
+	if err = tx.Create(fork).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "create fork of book %d failed", source.ID)
+	}
+	bookTags, err := source.GetTags(ctx)
+	if err != nil {
+		return nil, nil, irr.Wrap(err, "get tags of book %d failed", source.ID)
+	}
+	if len(bookTags) > 0 {
+		if err = AddEntityTags(ctx, tx, userID, EntityTypeBook, fork.ID, bookTags...); err != nil {
+			return nil, nil, irr.Wrap(err, "copy tags of book %d failed", source.ID)
+		}
+	}
+	if err = tx.Create(&BookFork{BookID: fork.ID, SourceBookID: source.ID, UserID: userID}).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "record provenance of book %d failed", fork.ID)
+	}
+
+	itemIDs, err := copyItems(ctx, tx, userID, fork.ID, sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	itemMap := make(map[utils.UInt64]utils.UInt64, len(itemIDs))
+	for i := range sources {
+		itemMap[sources[i].ID] = itemIDs[i]
+	}
+	if err = copyBookOrder(ctx, tx, source.ID, fork.ID, itemMap); err != nil {
+		return nil, nil, err
+	}
+	return fork, itemIDs, nil
+}
+
+// FindBookFork 查找 book 的来源，book 不是 fork 时返回 ErrNotForked
+func FindBookFork(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) (*BookFork, error) {
+	fork := &BookFork{}
+	if err := tx.WithContext(ctx).Where("book_id = ?", bookID).First(fork).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotForked
+		}
+		return nil, irr.Wrap(err, "find fork of book %d failed", bookID)
+	}
+	return fork, nil
+}
+
+// DeleteBookFork 删除 book 的来源记录，book 被删除时调用
+func DeleteBookFork(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) error {
+	if err := tx.WithContext(ctx).Where("book_id = ?", bookID).Delete(&ItemFork{}).Error; err != nil {
+		return irr.Wrap(err, "delete item forks of book %d failed", bookID)
+	}
+	if err := tx.WithContext(ctx).Where("book_id = ?", bookID).Delete(&BookFork{}).Error; err != nil {
+		return irr.Wrap(err, "delete fork of book %d failed", bookID)
+	}
+	return nil
+}
+
+// DiffUpstream 比对 fork 和上游 book，返回上游新增、移除和修改的 items，按上游 item id 排序。
+// 本地已经移出 fork 的 items 不再跟踪
+func DiffUpstream(ctx context.Context, tx *gorm.DB, fork *BookFork) ([]*ItemUpstreamChange, error) {
+	var links []*ItemFork
+	if err := tx.WithContext(ctx).Where("book_id = ?", fork.BookID).Find(&links).Error; err != nil {
+		return nil, irr.Wrap(err, "get item forks of book %d failed", fork.BookID)
+	}
+	sources, err := itemsOfBook(ctx, tx, fork.SourceBookID)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := snapshotItems(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+	mineItems, err := itemsOfBook(ctx, tx, fork.BookID)
+	if err != nil {
+		return nil, err
+	}
+	mine, err := snapshotItems(ctx, mineItems)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceByID := make(map[utils.UInt64]*Item, len(sources))
+	for i := range sources {
+		sourceByID[sources[i].ID] = &sources[i]
+	}
+
+	changes := make([]*ItemUpstreamChange, 0)
+	known := make(map[utils.UInt64]bool, len(links))
+	for _, link := range links {
+		known[link.SourceItemID] = true
+		mineSnapshot, ok := mine[link.ItemID]
+		if !ok {
+			continue
+		}
+		change := &ItemUpstreamChange{
+			SourceItemID: link.SourceItemID,
+			ItemID:       link.ItemID,
+			BaseRevision: link.BaseRevision,
+			link:         link,
+		}
+		source, ok := sourceByID[link.SourceItemID]
+		if !ok {
+			change.Status = UpstreamRemoved
+			changes = append(changes, change)
+			continue
+		}
+		if change.Fields = diffSnapshots(&link.Base, mineSnapshot, theirs[source.ID]); len(change.Fields) == 0 {
+			continue
+		}
+		change.Status = UpstreamModified
+		change.SourceRevision = source.Revision
+		change.source, change.theirs = source, theirs[source.ID]
+		changes = append(changes, change)
+	}
+	for i := range sources {
+		source := &sources[i]
+		if known[source.ID] {
+			continue
+		}
+		changes = append(changes, &ItemUpstreamChange{
+			Status:         UpstreamAdded,
+			SourceItemID:   source.ID,
+			SourceRevision: source.Revision,
+			Theirs:         theirs[source.ID],
+			source:         source,
+		})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].SourceItemID < changes[j].SourceItemID
+	})
+	return changes, nil
+}
+
+// PullUpstream 把用户选择的上游变化同步到 fork: 新增的 items 被复制进 fork，移除的 items 移出 fork (不删除)，
+// 修改的 items 只覆盖选择的字段，未选择的字段保留本地的内容。同步后 item 的 base 更新为上游当前的内容。
+// 返回同步的变化和需要重建索引的 fork 中的 item ids
+func PullUpstream(ctx context.Context, tx *gorm.DB, fork *BookFork, picks []UpstreamPick) ([]*ItemUpstreamChange, []utils.UInt64, error) {
+	changes, err := DiffUpstream(ctx, tx, fork)
+	if err != nil {
+		return nil, nil, err
+	}
+	changeBySource := make(map[utils.UInt64]*ItemUpstreamChange, len(changes))
+	for _, change := range changes {
+		changeBySource[change.SourceItemID] = change
+	}
+
+	applied := make([]*ItemUpstreamChange, 0, len(picks))
+	touched := make([]utils.UInt64, 0, len(picks))
+	for _, pick := range picks {
+		change, ok := changeBySource[pick.SourceItemID]
+		if !ok {
+			return nil, nil, irr.Wrap(ErrUpstreamChangeNotFound, "source item %d", pick.SourceItemID)
+		}
+		switch change.Status {
+		case UpstreamAdded:
+			ids, err := copyItems(ctx, tx, fork.UserID, fork.BookID, []Item{*change.source})
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = SyncBookMonsters(ctx, tx, fork.BookID, ids, nil); err != nil {
+				return nil, nil, err
+			}
+			change.ItemID = ids[0]
+			touched = append(touched, ids...)
+		case UpstreamRemoved:
+			if err = tx.WithContext(ctx).Where("book_id = ? AND item_id = ?", fork.BookID, change.ItemID).
+				Delete(&BookItem{}).Error; err != nil {
+				return nil, nil, irr.Wrap(err, "remove item %d from book %d failed", change.ItemID, fork.BookID)
+			}
+			if err = SyncBookMonsters(ctx, tx, fork.BookID, nil, []utils.UInt64{change.ItemID}); err != nil {
+				return nil, nil, err
+			}
+			if err = tx.WithContext(ctx).Delete(change.link).Error; err != nil {
+				return nil, nil, irr.Wrap(err, "delete provenance of item %d failed", change.ItemID)
+			}
+		case UpstreamModified:
+			if err = applyUpstreamFields(ctx, tx, fork.UserID, change, pick.Fields); err != nil {
+				return nil, nil, err
+			}
+			touched = append(touched, change.ItemID)
+		}
+		applied = append(applied, change)
+	}
+
+	now := time.Now()
+	if err = tx.WithContext(ctx).Model(fork).Update("pulled_at", now).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "update pulled_at of book %d failed", fork.BookID)
+	}
+	fork.PulledAt = &now
+	return applied, touched, nil
+}
+
+func applyUpstreamFields(ctx context.Context, tx *gorm.DB, userID utils.UInt64, change *ItemUpstreamChange, fields []string) error {
+	changed := make(map[string]bool, len(change.Fields))
+	for _, diff := range change.Fields {
+		changed[diff.Field] = true
+	}
+	if len(fields) == 0 {
+		fields = make([]string, 0, len(change.Fields))
+		for _, diff := range change.Fields {
+			fields = append(fields, diff.Field)
+		}
+	}
+
+	theirs := change.theirs
+	updater := make(map[string]any, len(fields))
+	syncTags := false
+	for _, field := range fields {
+		if !changed[field] {
+			return irr.Wrap(ErrUpstreamChangeNotFound, "field %s of source item %d", field, change.SourceItemID)
+		}
+		switch field {
+		case "tags":
+			syncTags = true
+		default:
+			updater[field] = theirs.field(field)
+		}
+	}
+
+	if len(updater) > 0 {
+		if err := tx.WithContext(ctx).Model(&Item{}).Where("id = ?", change.ItemID).Updates(updater).Error; err != nil {
+			return irr.Wrap(err, "apply upstream changes to item %d failed", change.ItemID)
+		}
+	}
+	if syncTags {
+		if err := UpdateEntityTagsDiff(ctx, tx, userID, change.ItemID, theirs.Tags); err != nil {
+			return irr.Wrap(err, "apply upstream tags to item %d failed", change.ItemID)
+		}
+	}
+	if err := BumpItemRevision(ctx, tx, change.ItemID); err != nil {
+		return err
+	}
+	if err := SyncItemMonsters(ctx, tx, change.ItemID); err != nil {
+		return err
+	}
+
+	// 无论选择了哪些字段，base 都前进到上游当前的内容，未选择的字段之后视为本地的修改
+	change.link.Base = *theirs
+	change.link.BaseRevision = change.SourceRevision
+	if err := tx.WithContext(ctx).Save(change.link).Error; err != nil {
+		return irr.Wrap(err, "update provenance of item %d failed", change.ItemID)
+	}
+	return nil
+}
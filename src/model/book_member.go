@@ -0,0 +1,160 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+// BookMember book 的协作者。成员关系保存为 book 上的 Grant (viewer 读、editor 写、owner 管理)，
+// 因此权限检查不需要额外处理；创建者 (books.user_id) 始终是 owner，不保存在 grants 中
+type BookMember struct {
+	BookID    utils.UInt64 `json:"book_id"`
+	UserID    utils.UInt64 `json:"user_id"`
+	Role      def.BookRole `json:"role"`
+	Creator   bool         `json:"creator,omitempty"` // 创建者不能被移除或修改角色
+	GrantedBy utils.UInt64 `json:"granted_by,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+var (
+	ErrBookCreatorRole = irr.Error("the role of the book creator cannot be changed")
+	ErrInvalidBookRole = irr.Error("invalid book role")
+)
+
+// RoleAction 角色对应的权限
+func RoleAction(role def.BookRole) Action {
+	switch role {
+	case def.BookRoleViewer:
+		return ActionRead
+	case def.BookRoleEditor:
+		return ActionWrite
+	case def.BookRoleOwner:
+		return ActionManage
+	default:
+		return 0
+	}
+}
+
+func actionRole(action Action) def.BookRole {
+	switch {
+	case action >= ActionManage:
+		return def.BookRoleOwner
+	case action >= ActionWrite:
+		return def.BookRoleEditor
+	case action >= ActionRead:
+		return def.BookRoleViewer
+	default:
+		return def.BookRoleNone
+	}
+}
+
+// memberBooks 返回 userID 作为成员的 book id 的子查询
+func memberBooks(db *gorm.DB, userID utils.UInt64) *gorm.DB {
+	return db.Model(&Grant{}).Select("resource_id").Where("resource = ? AND user_id = ?", ResourceBook, userID)
+}
+
+func memberFromGrant(g *Grant) *BookMember {
+	return &BookMember{
+		BookID:    g.ResourceID,
+		UserID:    g.UserID,
+		Role:      actionRole(g.Action),
+		GrantedBy: g.GrantedBy,
+		CreatedAt: g.CreatedAt,
+	}
+}
+
+// GetBookMembers 获取 book 的成员，创建者在最前，其余按加入时间排序
+func GetBookMembers(ctx context.Context, tx *gorm.DB, book *Book) ([]*BookMember, error) {
+	var grants []*Grant
+	if err := tx.WithContext(ctx).Where("resource = ? AND resource_id = ?", ResourceBook, book.ID).
+		Order("created_at ASC").Find(&grants).Error; err != nil {
+		return nil, irr.Wrap(err, "get members of book %d failed", book.ID)
+	}
+	members := make([]*BookMember, 0, len(grants)+1)
+	members = append(members, &BookMember{
+		BookID:    book.ID,
+		UserID:    book.UserID,
+		Role:      def.BookRoleOwner,
+		Creator:   true,
+		CreatedAt: book.CreatedAt,
+	})
+	for _, g := range grants {
+		members = append(members, memberFromGrant(g))
+	}
+	return members, nil
+}
+
+// GetBookRoles 获取 userID 在 books 中的角色，创建的 book 为 owner，不是成员的 book 不在结果中
+func GetBookRoles(ctx context.Context, tx *gorm.DB, userID utils.UInt64, books []*Book) (map[utils.UInt64]def.BookRole, error) {
+	roles := make(map[utils.UInt64]def.BookRole, len(books))
+	ids := make([]utils.UInt64, 0, len(books))
+	for _, book := range books {
+		if book.UserID == userID {
+			roles[book.ID] = def.BookRoleOwner
+		} else {
+			ids = append(ids, book.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return roles, nil
+	}
+	var grants []*Grant
+	if err := tx.WithContext(ctx).Where("resource = ? AND user_id = ? AND resource_id IN ?", ResourceBook, userID, ids).
+		Find(&grants).Error; err != nil {
+		return nil, irr.Wrap(err, "get book roles of user %d failed", userID)
+	}
+	for _, g := range grants {
+		roles[g.ResourceID] = actionRole(g.Action)
+	}
+	return roles, nil
+}
+
+// SetBookMember 添加成员或修改成员的角色，返回修改后的成员
+func SetBookMember(ctx context.Context, tx *gorm.DB, book *Book, userID utils.UInt64, role def.BookRole, grantedBy utils.UInt64) (*BookMember, error) {
+	if userID == book.UserID {
+		return nil, ErrBookCreatorRole
+	}
+	if !role.Valid() {
+		return nil, irr.Wrap(ErrInvalidBookRole, "role %d", role)
+	}
+	if err := GrantAccess(ctx, tx, ResourceBook, book.ID, userID, RoleAction(role), grantedBy); err != nil {
+		return nil, err
+	}
+	grant := &Grant{}
+	if err := tx.WithContext(ctx).Where("resource = ? AND resource_id = ? AND user_id = ?", ResourceBook, book.ID, userID).
+		First(grant).Error; err != nil {
+		return nil, irr.Wrap(err, "get member %d of book %d failed", userID, book.ID)
+	}
+	return memberFromGrant(grant), nil
+}
+
+// RemoveBookMember 移除成员，返回成员是否存在；移除后不能再读取 book 时，成员的复习计划不再引用 book
+func RemoveBookMember(ctx context.Context, tx *gorm.DB, book *Book, userID utils.UInt64) (bool, error) {
+	if userID == book.UserID {
+		return false, ErrBookCreatorRole
+	}
+	result := tx.WithContext(ctx).Where("resource = ? AND resource_id = ? AND user_id = ?", ResourceBook, book.ID, userID).
+		Delete(&Grant{})
+	if err := result.Error; err != nil {
+		return false, irr.Wrap(err, "remove member %d of book %d failed", userID, book.ID)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	return true, unlinkUnreadableBook(ctx, tx, userID, book.ID)
+}
+
+// DeleteBookMembers 删除 book 的所有成员，book 被删除时调用
+func DeleteBookMembers(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) error {
+	if err := tx.WithContext(ctx).Where("resource = ? AND resource_id = ?", ResourceBook, bookID).
+		Delete(&Grant{}).Error; err != nil {
+		return irr.Wrap(err, "delete members of book %d failed", bookID)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+// BookSubscription 用户订阅的其他用户的 book，订阅后 book 以只读方式出现在用户的书库中
+// book 被所有者改回私有时订阅保留但不再生效，重新分享后恢复
+type BookSubscription struct {
+	BookID    utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"book_id"`
+	UserID    utils.UInt64 `gorm:"primaryKey;autoIncrement:false;index:idx_subscription_user" json:"user_id"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+const shareCodeBytes = 9 // base64 编码后为 12 个字符
+
+var ErrSubscribeOwnBook = irr.Error("cannot subscribe to own book")
+
+func (BookSubscription) TableName() string {
+	return "book_subscriptions"
+}
+
+// subscribedBooks 返回 userID 订阅的 book id 的子查询
+func subscribedBooks(db *gorm.DB, userID utils.UInt64) *gorm.DB {
+	return db.Model(&BookSubscription{}).Select("book_id").Where("user_id = ?", userID)
+}
+
+// sharedBooks 公开的 book 所有用户可读，非私有的 book 订阅者可读
+func sharedBooks(db *gorm.DB, userID utils.UInt64, action Action) (string, []any) {
+	if action != ActionRead {
+		return "", nil
+	}
+	return "books.visibility = ? OR (books.visibility <> ? AND books.id IN (?))",
+		[]any{def.BookVisibilityPublic, def.BookVisibilityPrivate, subscribedBooks(db, userID)}
+}
+
+// sharedItems 可读的 book 中的 items 可读；可写的 book (如作为 editor) 中由 book 所有者创建的 items 可写，
+// 其他用户创建的 items 即使被加入 book 也只有它们的创建者可以修改
+func sharedItems(db *gorm.DB, userID utils.UInt64, action Action) (string, []any) {
+	switch action {
+	case ActionRead:
+		readableBooks := db.Model(&Book{}).Select("books.id").Scopes(AuthzPolicy().Scope(userID, ResourceBook, ActionRead))
+		return "items.id IN (?)", []any{db.Model(&BookItem{}).Select("item_id").Where("book_id IN (?)", readableBooks)}
+	case ActionWrite:
+		writableBooks := db.Model(&Book{}).Select("books.id").Scopes(AuthzPolicy().Scope(userID, ResourceBook, ActionWrite))
+		return "items.id IN (?)", []any{db.Model(&BookItem{}).Select("book_items.item_id").
+			Joins("JOIN books AS item_books ON item_books.id = book_items.book_id").
+			Joins("JOIN items AS book_owned ON book_owned.id = book_items.item_id").
+			Where("book_owned.creator_id = item_books.user_id AND item_books.id IN (?)", writableBooks)}
+	default:
+		return "", nil
+	}
+}
+
+func newShareCode() (string, error) {
+	b := make([]byte, shareCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", irr.Wrap(err, "generate share code failed")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SetBookVisibility 修改 book 的可见性，第一次分享时生成分享码，之后改回私有再分享时沿用原来的分享码
+func SetBookVisibility(ctx context.Context, tx *gorm.DB, book *Book, visibility def.BookVisibility) error {
+	if !visibility.Valid() {
+		return irr.Error("invalid book visibility %d", visibility)
+	}
+	updater := map[string]any{"visibility": visibility}
+	if visibility.Shared() && book.ShareCode == nil {
+		code, err := newShareCode()
+		if err != nil {
+			return err
+		}
+		updater["share_code"] = code
+		book.ShareCode = &code
+	}
+	if err := tx.WithContext(ctx).Model(book).Updates(updater).Error; err != nil {
+		return irr.Wrap(err, "update visibility of book %d failed", book.ID)
+	}
+	book.Visibility = visibility
+	return nil
+}
+
+// FindSharedBook 通过分享码查找 book，book 不存在或是私有时返回 gorm.ErrRecordNotFound
+func FindSharedBook(ctx context.Context, tx *gorm.DB, shareCode string) (*Book, error) {
+	book := &Book{}
+	if err := tx.WithContext(ctx).Where("share_code = ? AND visibility <> ?", shareCode, def.BookVisibilityPrivate).
+		First(book).Error; err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// FindSubscribableBook 查找 userID 可以订阅的 book: 公开的 book，或者提供了正确分享码的非私有 book，
+// 不满足条件时返回 gorm.ErrRecordNotFound，不暴露 book 是否存在
+func FindSubscribableBook(ctx context.Context, tx *gorm.DB, userID, bookID utils.UInt64, shareCode string) (*Book, error) {
+	book := &Book{}
+	if err := tx.WithContext(ctx).Where("id = ?", bookID).First(book).Error; err != nil {
+		return nil, err
+	}
+	if book.UserID == userID {
+		return nil, ErrSubscribeOwnBook
+	}
+	switch {
+	case book.Visibility == def.BookVisibilityPublic:
+	case book.Visibility.Shared() && book.ShareCode != nil && *book.ShareCode == shareCode:
+	default:
+		return nil, gorm.ErrRecordNotFound
+	}
+	return book, nil
+}
+
+// SubscribeBook 订阅 book，重复订阅不会报错
+func SubscribeBook(ctx context.Context, tx *gorm.DB, userID, bookID utils.UInt64) error {
+	subscription := &BookSubscription{BookID: bookID, UserID: userID}
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(subscription).Error; err != nil {
+		return irr.Wrap(err, "user %d subscribe book %d failed", userID, bookID)
+	}
+	return nil
+}
+
+// UnsubscribeBook 取消订阅 book，已经加入复习计划的 monsters 不受影响；
+// 取消后不能再读取 book 时，用户的复习计划不再引用 book，之后 book 的修改不再同步过来
+func UnsubscribeBook(ctx context.Context, tx *gorm.DB, userID, bookID utils.UInt64) (bool, error) {
+	result := tx.WithContext(ctx).Where("book_id = ? AND user_id = ?", bookID, userID).Delete(&BookSubscription{})
+	if err := result.Error; err != nil {
+		return false, irr.Wrap(err, "user %d unsubscribe book %d failed", userID, bookID)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	return true, unlinkUnreadableBook(ctx, tx, userID, bookID)
+}
+
+// GetLibraryBooks 获取用户的书库: 自己的 book、作为成员的 book 和订阅的非私有 book
+func GetLibraryBooks(ctx context.Context, tx *gorm.DB, userID utils.UInt64, offset, limit int) ([]*Book, int64, error) {
+	db := tx.Session(&gorm.Session{NewDB: true})
+	query := tx.WithContext(ctx).Model(&Book{}).Where("books.user_id = ? OR books.id IN (?) OR (books.visibility <> ? AND books.id IN (?))",
+		userID, memberBooks(db, userID), def.BookVisibilityPrivate, subscribedBooks(db, userID))
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count library books of user %d failed", userID)
+	}
+	var books []*Book
+	if err := query.Order("books.created_at ASC").Offset(offset).Limit(limit).Find(&books).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get library books of user %d failed", userID)
+	}
+	return books, total, nil
+}
+
+// GetPublicBooks 获取公开目录中的 book，按更新时间倒序，keyword 不为空时按标题过滤
+func GetPublicBooks(ctx context.Context, tx *gorm.DB, keyword string, offset, limit int) ([]*Book, int64, error) {
+	query := tx.WithContext(ctx).Model(&Book{}).Where("visibility = ?", def.BookVisibilityPublic)
+	if keyword != "" {
+		query = query.Where("title LIKE ?", "%"+keyword+"%")
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count public books failed")
+	}
+	var books []*Book
+	if err := query.Order("updated_at DESC").Offset(offset).Limit(limit).Find(&books).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get public books failed")
+	}
+	return books, total, nil
+}
+
+// CountBookSubscribers 统计 books 的订阅人数
+func CountBookSubscribers(ctx context.Context, tx *gorm.DB, bookIDs []utils.UInt64) (map[utils.UInt64]int64, error) {
+	ret := make(map[utils.UInt64]int64, len(bookIDs))
+	if len(bookIDs) == 0 {
+		return ret, nil
+	}
+	var rows []struct {
+		BookID utils.UInt64
+		Count  int64
+	}
+	if err := tx.WithContext(ctx).Model(&BookSubscription{}).Select("book_id, COUNT(*) AS count").
+		Where("book_id IN ?", bookIDs).Group("book_id").Scan(&rows).Error; err != nil {
+		return nil, irr.Wrap(err, "count subscribers of books failed")
+	}
+	for _, row := range rows {
+		ret[row.BookID] = row.Count
+	}
+	return ret, nil
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/bagaking/memorianexus/internal/utils"
@@ -10,8 +11,11 @@ import (
 	"github.com/bagaking/memorianexus/src/def"
 
 	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
 
+	"github.com/bagaking/memorianexus/pkg/tags"
+
 	"gorm.io/gorm"
 )
 
@@ -23,6 +27,7 @@ type (
 		Type        def.DungeonType `gorm:"not null" json:"type"`
 		Title       string          `gorm:"not null" json:"title"`
 		Description string          `json:"description"`
+		TagQuery    string          `gorm:"not null;default:''" json:"tag_query"` // 标签表达式，见 tags.ParseQuery，非空时匹配的 items 也会加入复习 (见 SyncTagMonsters)
 
 		MemorizationSetting
 
@@ -38,11 +43,6 @@ type DungeonBook struct {
 	BookID    utils.UInt64 `gorm:"primaryKey"`
 }
 
-type DungeonTag struct {
-	DungeonID utils.UInt64 `gorm:"primaryKey"`
-	TagID     utils.UInt64 `gorm:"primaryKey"`
-}
-
 // BeforeCreate 钩子
 func (d *Dungeon) BeforeCreate(tx *gorm.DB) (err error) {
 	// 确保UserID不为0
@@ -65,25 +65,31 @@ func (d *Dungeon) BeforeDelete(tx *gorm.DB) (err error) {
 		return irr.Wrap(err, "failed to delete dungeon tags")
 	}
 
-	if err = tx.Where("dungeon_id = ?", d.ID).Delete(&DungeonMonster{}).Error; err != nil {
+	if err = tx.Unscoped().Where("dungeon_id = ?", d.ID).Delete(&DungeonMonster{}).Error; err != nil {
 		return irr.Wrap(err, "failed to delete dungeon monsters")
 	}
 
 	return nil
 }
 
+// CreateDungeon 创建复习计划并发布 DungeonCreated 事件，tx 应该是调用方的事务
 func CreateDungeon(ctx context.Context, tx *gorm.DB, d *Dungeon) (*Dungeon, error) {
 	d.CreatedAt = time.Now()
 	d.UpdatedAt = time.Now()
 	if err := tx.Create(d).Error; err != nil {
 		return nil, irr.Wrap(err, "failed to create dungeon")
 	}
+	if err := PublishEvents(ctx, tx, DungeonCreated{UserID: d.UserID, DungeonID: d.ID, Type: d.Type}); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
-func FindDungeon(ctx context.Context, tx *gorm.DB, dungeonID utils.UInt64) (*Dungeon, error) {
+// FindDungeon 查找 userID 有 action 权限的复习计划，不存在或没有权限时返回 gorm.ErrRecordNotFound
+func FindDungeon(ctx context.Context, tx *gorm.DB, userID, dungeonID utils.UInt64, action Action) (*Dungeon, error) {
 	dungeon := &Dungeon{}
-	if err := tx.Where("id = ?", dungeonID).First(dungeon).Error; err != nil {
+	if err := tx.WithContext(ctx).Scopes(AuthzPolicy().Scope(userID, ResourceDungeon, action)).
+		Where("dungeons.id = ?", dungeonID).First(dungeon).Error; err != nil {
 		return nil, err
 	}
 	return dungeon, nil
@@ -128,20 +134,12 @@ func (d *Dungeon) GetItemIDs(ctx context.Context, tx *gorm.DB) ([]utils.UInt64,
 	return items, nil
 }
 
-func (d *Dungeon) GetTags(ctx context.Context) ([]string, error) {
-	tags, err := TagModel().GetTagsOfEntity(ctx, d.ID)
-	if err != nil {
-		return nil, irr.Wrap(err, "failed to fetch tag ids")
-	}
-	return tags, nil
-}
-
 // GetAssociations Helper function to get associated books, items, and tags for a dungeon
 func (d *Dungeon) GetAssociations(ctx context.Context, tx *gorm.DB) (books, items []utils.UInt64, tags []string, err error) {
 	if books, err = d.GetBookIDs(ctx, tx); err != nil {
 		return nil, nil, nil, irr.Wrap(err, "failed to fetch dungeon-book associations")
 	}
-	if tags, err = d.GetTags(ctx); err != nil {
+	if tags, err = d.GetTags(ctx, tx); err != nil {
 		return nil, nil, nil, irr.Wrap(err, "failed to fetch dungeon-tag associations")
 	}
 	if items, err = d.GetItemIDs(ctx, tx); err != nil { // todo: 先不分页
@@ -150,6 +148,30 @@ func (d *Dungeon) GetAssociations(ctx context.Context, tx *gorm.DB) (books, item
 	return books, items, tags, nil
 }
 
+// NormalizeTagQuery 校验并规范化复习计划的标签表达式，空表达式表示不使用
+func NormalizeTagQuery(q string) (string, error) {
+	if strings.TrimSpace(q) == "" {
+		return "", nil
+	}
+	query, err := tags.ParseQuery(q)
+	if err != nil {
+		return "", err
+	}
+	return query.String(), nil
+}
+
+// GetItemIDsOfTagQuery 获取满足复习计划标签表达式的 items，未设置表达式时返回空
+func (d *Dungeon) GetItemIDsOfTagQuery(ctx context.Context) ([]utils.UInt64, error) {
+	if d.TagQuery == "" {
+		return nil, nil
+	}
+	query, err := tags.ParseQuery(d.TagQuery)
+	if err != nil {
+		return nil, irr.Wrap(err, "invalid tag query of dungeon %d", d.ID)
+	}
+	return TagModel().QueryEntities(ctx, d.UserID, query, typer.Ptr(EntityTypeItem))
+}
+
 func (d *Dungeon) SubtractBooks(ctx context.Context, tx *gorm.DB, books []utils.UInt64) (successIDs []utils.UInt64, err error) {
 	successIDs = make([]utils.UInt64, 0, len(books))
 	for _, bookID := range books {
@@ -0,0 +1,254 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/pkg/tags"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+// DungeonTag 复习计划的标签来源，用户打了该标签 (或其子标签) 的 items 都会加入复习计划
+type DungeonTag struct {
+	DungeonID utils.UInt64 `gorm:"primaryKey"`
+	Tag       string       `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+func init() {
+	// campaign 复习计划的 monsters 随 items 的标签变化自动增减，标签变更的事务提交后才会执行
+	eventbus.SubscribeAsync(events, "dungeon.tag_monsters", func(ctx context.Context, e ItemTagsChanged) error {
+		return syncItemTagMonsters(ctx, outbox.db.Load(), e)
+	})
+}
+
+func (DungeonTag) TableName() string {
+	return "dungeon_tags"
+}
+
+// GetTags 获取复习计划的标签来源
+func (d *Dungeon) GetTags(ctx context.Context, tx *gorm.DB) ([]string, error) {
+	var dungeonTags []string
+	if err := tx.WithContext(ctx).Model(&DungeonTag{}).Where("dungeon_id = ?", d.ID).
+		Order("tag ASC").Pluck("tag", &dungeonTags).Error; err != nil {
+		return nil, irr.Wrap(err, "failed to fetch dungeon tags")
+	}
+	return dungeonTags, nil
+}
+
+// AddTags 为复习计划添加标签来源，campaign 类型的复习计划会立即加入匹配的 items
+func (d *Dungeon) AddTags(ctx context.Context, tx *gorm.DB, tagsToAdd []string) ([]string, error) {
+	tagsToAdd, err := tags.NormalizeTags(tagsToAdd)
+	if err != nil {
+		return nil, err
+	}
+	if len(tagsToAdd) == 0 {
+		return tagsToAdd, nil
+	}
+
+	now := time.Now()
+	records := typer.SliceMap(tagsToAdd, func(tag string) DungeonTag {
+		return DungeonTag{DungeonID: d.ID, Tag: tag, CreatedAt: now}
+	})
+	if err = tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&records).Error; err != nil {
+		return nil, irr.Wrap(err, "failed to add dungeon tags")
+	}
+	if err = d.SyncTagMonsters(ctx, tx); err != nil {
+		return nil, err
+	}
+	return tagsToAdd, nil
+}
+
+// SubtractTags 移除复习计划的标签来源，campaign 类型的复习计划中不再匹配任何标签来源的 monsters 会被移除
+func (d *Dungeon) SubtractTags(ctx context.Context, tx *gorm.DB, tagsToRemove []string) ([]string, error) {
+	tagsToRemove, err := tags.NormalizeTags(tagsToRemove)
+	if err != nil {
+		return nil, err
+	}
+	if len(tagsToRemove) == 0 {
+		return tagsToRemove, nil
+	}
+
+	if err = tx.WithContext(ctx).Where("dungeon_id = ? AND tag IN ?", d.ID, tagsToRemove).
+		Delete(&DungeonTag{}).Error; err != nil {
+		return nil, irr.Wrap(err, "failed to remove dungeon tags")
+	}
+	if err = d.SyncTagMonsters(ctx, tx); err != nil {
+		return nil, err
+	}
+	return tagsToRemove, nil
+}
+
+// SyncTagMonsters 根据标签来源 (dungeon tags 和 tag_query) 同步 campaign 类型复习计划的 monsters:
+// 新匹配的 items 会被加入，来源为标签但已经不再匹配的 monsters 会被移除 (软删除，重新匹配时恢复复习进度)，来自 item 或 book 的 monsters 不受影响
+// endless 类型的复习计划在查询时展开，不需要同步
+func (d *Dungeon) SyncTagMonsters(ctx context.Context, tx *gorm.DB) error {
+	if d.Type != def.DungeonTypeCampaign {
+		return nil
+	}
+
+	dungeonTags, err := d.GetTags(ctx, tx)
+	if err != nil {
+		return err
+	}
+	expected := make(map[utils.UInt64]struct{})
+	for _, tag := range dungeonTags {
+		itemIDs, err := TagModel().GetEntities(ctx, d.UserID, tag, typer.Ptr(EntityTypeItem))
+		if err != nil {
+			return irr.Wrap(err, "failed to get items of tag %s", tag)
+		}
+		for _, id := range itemIDs {
+			expected[id] = struct{}{}
+		}
+	}
+	queryItemIDs, err := d.GetItemIDsOfTagQuery(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range queryItemIDs {
+		expected[id] = struct{}{}
+	}
+
+	var existing []DungeonMonster
+	if err = tx.WithContext(ctx).Select("item_id", "source_type").Where("dungeon_id = ?", d.ID).
+		Find(&existing).Error; err != nil {
+		return irr.Wrap(err, "failed to fetch monsters of dungeon %d", d.ID)
+	}
+	toRetire := make([]utils.UInt64, 0)
+	for _, m := range existing {
+		if _, ok := expected[m.ItemID]; ok {
+			delete(expected, m.ItemID)
+			continue
+		}
+		if m.SourceType == MonsterSourceTag {
+			toRetire = append(toRetire, m.ItemID)
+		}
+	}
+
+	if len(expected) > 0 {
+		items, err := FindItems(ctx, tx, typer.Keys(expected))
+		if err != nil {
+			return irr.Wrap(err, "failed to find items of tags")
+		}
+		for _, item := range items {
+			if item.CreatorID != d.UserID {
+				continue
+			}
+			if err = createDungeonMonster(tx, d.ID, item, MonsterSourceTag, 0); err != nil {
+				return irr.Wrap(err, "failed to add monster of item %d", item.ID)
+			}
+		}
+	}
+	if len(toRetire) > 0 {
+		if err = tx.WithContext(ctx).Where("dungeon_id = ? AND source_type = ? AND item_id IN ?", d.ID, MonsterSourceTag, toRetire).
+			Delete(&DungeonMonster{}).Error; err != nil {
+			return irr.Wrap(err, "failed to retire monsters of dungeon %d", d.ID)
+		}
+	}
+	return nil
+}
+
+// syncItemTagMonsters 在 item 的标签变化后，同步用户所有使用标签来源的 campaign 复习计划中该 item 对应的 monster
+// 由 ItemTagsChanged 的异步订阅者触发，以数据库的当前状态为准，重复投递是安全的
+func syncItemTagMonsters(ctx context.Context, tx *gorm.DB, change ItemTagsChanged) error {
+	if change.EntityType != EntityTypeItem {
+		return nil
+	}
+	log := wlog.ByCtx(ctx, "syncItemTagMonsters").WithField("user_id", change.UserID).WithField("item_id", change.EntityID)
+
+	var dungeons []*Dungeon
+	if err := tx.WithContext(ctx).Where("user_id = ? AND type = ?", change.UserID, def.DungeonTypeCampaign).
+		Where("tag_query <> '' OR id IN (?)", tx.Model(&DungeonTag{}).Select("dungeon_id")).
+		Find(&dungeons).Error; err != nil {
+		return irr.Wrap(err, "failed to find dungeons with tag sources")
+	}
+	if len(dungeons) == 0 {
+		return nil
+	}
+
+	// 直接读数据库，变更刚发生时缓存中可能还是旧数据
+	var itemTags []string
+	if err := tx.WithContext(ctx).Model(&Tag{}).
+		Where("user_id = ? AND entity_id = ? AND entity_type = ?", change.UserID, change.EntityID, EntityTypeItem).
+		Pluck("tag", &itemTags).Error; err != nil {
+		return irr.Wrap(err, "failed to get tags of item")
+	}
+	var item *Item
+	if len(itemTags) > 0 {
+		items, err := FindItems(ctx, tx, []utils.UInt64{change.EntityID})
+		if err != nil {
+			return irr.Wrap(err, "failed to find item")
+		}
+		if len(items) == 0 || items[0].CreatorID != change.UserID {
+			return nil // item 已经被删除，monsters 会在删除时清理
+		}
+		item = &items[0]
+	}
+
+	for _, d := range dungeons {
+		matched, err := d.matchItemTags(ctx, tx, change.EntityID, itemTags)
+		if err != nil {
+			return err
+		}
+		if matched {
+			if err = createDungeonMonster(tx, d.ID, *item, MonsterSourceTag, 0); err != nil {
+				return irr.Wrap(err, "failed to add monster to dungeon %d", d.ID)
+			}
+			continue
+		}
+		result := tx.WithContext(ctx).Where("dungeon_id = ? AND item_id = ? AND source_type = ?", d.ID, change.EntityID, MonsterSourceTag).
+			Delete(&DungeonMonster{})
+		if result.Error != nil {
+			return irr.Wrap(result.Error, "failed to retire monster from dungeon %d", d.ID)
+		}
+		if result.RowsAffected > 0 {
+			log.Infof("monster retired from dungeon %d", d.ID)
+		}
+	}
+	return nil
+}
+
+// matchItemTags 判断带有 itemTags 的 item 是否匹配复习计划的标签来源
+func (d *Dungeon) matchItemTags(ctx context.Context, tx *gorm.DB, itemID utils.UInt64, itemTags []string) (bool, error) {
+	if len(itemTags) == 0 {
+		return false, nil
+	}
+	dungeonTags, err := d.GetTags(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	for _, dungeonTag := range dungeonTags {
+		if len(tags.SubtreeOf(itemTags, dungeonTag)) > 0 {
+			return true, nil
+		}
+	}
+
+	if d.TagQuery == "" {
+		return false, nil
+	}
+	query, err := tags.ParseQuery(d.TagQuery)
+	if err != nil {
+		return false, irr.Wrap(err, "invalid tag query of dungeon %d", d.ID)
+	}
+	self := []utils.UInt64{itemID}
+	matched, err := tags.EvalQuery(query, func(tag string) ([]utils.UInt64, error) {
+		if len(tags.SubtreeOf(itemTags, tag)) > 0 {
+			return self, nil
+		}
+		return nil, nil
+	}, func() ([]utils.UInt64, error) {
+		return self, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(matched) > 0, nil
+}
@@ -0,0 +1,257 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/internal/utils/cache"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+// 领域事件。同步订阅者 (如成就) 在发布事件的事务中被调用，异步订阅者 (如统计、通知、缓存失效) 在事务提交后从 outbox 收到事件。
+// 订阅方式见 Events，事件的字段只增不减，outbox 中可能还有旧版本的事件
+type (
+	// ItemCreated 创建了学习材料
+	ItemCreated struct {
+		UserID  utils.UInt64   `json:"user_id"`
+		ItemIDs []utils.UInt64 `json:"item_ids"`
+	}
+
+	// ItemUpdated 修改了学习材料
+	ItemUpdated struct {
+		UserID utils.UInt64 `json:"user_id"`
+		ItemID utils.UInt64 `json:"item_id"`
+	}
+
+	// ItemDeleted 删除了学习材料
+	ItemDeleted struct {
+		UserID utils.UInt64 `json:"user_id"` // 操作者
+		ItemID utils.UInt64 `json:"item_id"`
+	}
+
+	// ItemTagsChanged entity (item、book 或 dungeon，见 EntityType) 上的标签变化了: 添加、移除、重命名、合并或删除，Tags 是变化的标签
+	ItemTagsChanged struct {
+		UserID     utils.UInt64 `json:"user_id"` // 标签的所有者
+		EntityID   utils.UInt64 `json:"entity_id"`
+		EntityType EntityType   `json:"entity_type"`
+		Tags       []string     `json:"tags"`
+	}
+
+	// MonsterPracticed 一次作答生效 (submit、离线同步或复习会话)
+	MonsterPracticed struct {
+		UserID            utils.UInt64     `json:"user_id"`
+		DungeonID         utils.UInt64     `json:"dungeon_id"`
+		ItemID            utils.UInt64     `json:"item_id"`
+		Result            def.AttackResult `json:"result"`
+		FamiliarityBefore utils.Percentage `json:"familiarity_before"` // 作答前 dungeon 中 monster 的熟练度
+		FamiliarityAfter  utils.Percentage `json:"familiarity_after"`  // 作答后的熟练度，同时写入 dungeon 和 user_monsters
+		// UserFamiliarityBefore 作答前 user_monsters 中的熟练度，即这个 item 最近一次作答后的熟练度，
+		// 同一个 item 在多个 dungeon 中练习时可能与 FamiliarityBefore 不同
+		UserFamiliarityBefore utils.Percentage `json:"user_familiarity_before"`
+		Cash                  utils.UInt64     `json:"cash"`
+		PracticedAt           time.Time        `json:"practiced_at"`
+	}
+
+	// BossDefeated 复习计划中的所有 monsters 都被掌握了 (见 MasteredFamiliarity)
+	BossDefeated struct {
+		UserID    utils.UInt64 `json:"user_id"`
+		DungeonID utils.UInt64 `json:"dungeon_id"`
+	}
+
+	// DungeonCreated 创建了复习计划
+	DungeonCreated struct {
+		UserID    utils.UInt64    `json:"user_id"`
+		DungeonID utils.UInt64    `json:"dungeon_id"`
+		Type      def.DungeonType `json:"type"`
+	}
+
+	// BookItemsChanged 册子中加入或移除了学习材料
+	BookItemsChanged struct {
+		UserID  utils.UInt64   `json:"user_id"` // 操作者
+		BookID  utils.UInt64   `json:"book_id"`
+		Added   []utils.UInt64 `json:"added,omitempty"`
+		Removed []utils.UInt64 `json:"removed,omitempty"`
+	}
+
+	// BookPublished 册子被公开
+	BookPublished struct {
+		UserID utils.UInt64 `json:"user_id"` // 册子的所有者
+		BookID utils.UInt64 `json:"book_id"`
+	}
+
+	// StreakReached 连续打卡的天数增加了
+	StreakReached struct {
+		UserID utils.UInt64 `json:"user_id"`
+		Streak uint32       `json:"streak"`
+		Date   string       `json:"date"` // 用户时区中达成目标的日期
+	}
+
+	// NFTMinted 通过抽卡等方式创建了新的 NFT
+	NFTMinted struct {
+		OwnerID    utils.UInt64 `json:"owner_id"`
+		NFTID      utils.UInt64 `json:"nft_id"`
+		TemplateID utils.UInt64 `json:"template_id"`
+		Rarity     NFTRarity    `json:"rarity"`
+		Source     NFTSource    `json:"source"`
+	}
+
+	// NFTTransferred NFT 的所有权变化了 (挂单、撤单、成交或赠予)，FromID 或 ToID 为 NFTEscrowOwner 表示由市场托管
+	NFTTransferred struct {
+		NFTID      utils.UInt64      `json:"nft_id"`
+		TemplateID utils.UInt64      `json:"template_id"`
+		FromID     utils.UInt64      `json:"from_id"`
+		ToID       utils.UInt64      `json:"to_id"`
+		Reason     NFTTransferReason `json:"reason"`
+		RefID      utils.UInt64      `json:"ref_id,omitempty"` // 相关的挂单
+	}
+)
+
+func (ItemCreated) EventName() string      { return "item.created" }
+func (ItemUpdated) EventName() string      { return "item.updated" }
+func (ItemDeleted) EventName() string      { return "item.deleted" }
+func (ItemTagsChanged) EventName() string  { return "item.tags_changed" }
+func (MonsterPracticed) EventName() string { return "monster.practiced" }
+func (BossDefeated) EventName() string     { return "boss.defeated" }
+func (DungeonCreated) EventName() string   { return "dungeon.created" }
+func (BookItemsChanged) EventName() string { return "book.items_changed" }
+func (BookPublished) EventName() string    { return "book.published" }
+func (StreakReached) EventName() string    { return "streak.reached" }
+func (NFTMinted) EventName() string        { return "nft.minted" }
+func (NFTTransferred) EventName() string   { return "nft.transferred" }
+
+// EventOutbox 已经发布、等待投递给异步订阅者的事件。投递成功后删除，多次失败后标记为 dead 保留
+type EventOutbox struct {
+	ID            utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+	Name          string       `gorm:"size:64;not null"`
+	Payload       string       `gorm:"type:text;not null"`
+	Attempts      int          `gorm:"not null;default:0"`
+	NextAttemptAt time.Time    `gorm:"not null;index:idx_event_outbox_pending,priority:2"`
+	Dead          bool         `gorm:"not null;default:false;index:idx_event_outbox_pending,priority:1"`
+	LastError     string       `gorm:"size:512"`
+	CreatedAt     time.Time
+}
+
+func (EventOutbox) TableName() string {
+	return "event_outbox"
+}
+
+// gormOutbox 基于 event_outbox 表的 eventbus.Outbox，db 在 MustInit 时设置
+type gormOutbox struct {
+	db atomic.Pointer[gorm.DB]
+}
+
+var (
+	outbox = &gormOutbox{}
+	events = eventbus.New[*gorm.DB](outbox, eventbus.DefaultRetryPolicy())
+)
+
+// Events 领域事件总线，其他模块通过 eventbus.SubscribeSync / eventbus.SubscribeAsync 订阅，订阅需要在服务启动前完成
+func Events() *eventbus.Bus[*gorm.DB] {
+	return events
+}
+
+// PublishEvents 在事务 tx 中发布领域事件，同步订阅者的错误会使发布失败，调用方需要回滚事务
+func PublishEvents(ctx context.Context, tx *gorm.DB, evs ...eventbus.Event) error {
+	return events.Publish(ctx, tx, evs...)
+}
+
+// initEvents 设置 outbox 使用的数据库
+func initEvents(db *gorm.DB) {
+	outbox.db.Store(db)
+}
+
+// StartEventDispatcher 在后台把 outbox 中的事件投递给异步订阅者，直到 ctx 结束。多实例部署时通过分布式锁避免同时投递
+func StartEventDispatcher(ctx context.Context, interval time.Duration) {
+	log := wlog.ByCtx(ctx, "EventDispatcher")
+	go events.Run(ctx, interval, func(ctx context.Context, task func() error) error {
+		err := cache.Locker(ctx).Execute(ctx, "event_outbox", time.Minute, task)
+		if errors.Is(err, cache.ErrFailedToAcquireLock) {
+			log.Debugf("events are dispatched by another instance")
+			return nil
+		}
+		return err
+	})
+}
+
+func (o *gormOutbox) Append(ctx context.Context, tx *gorm.DB, records ...*eventbus.Record) error {
+	ids, err := utils.MGenIDU64(ctx, len(records))
+	if err != nil {
+		return irr.Wrap(err, "generate event ids failed")
+	}
+	if len(ids) != len(records) {
+		return irr.Error("generate event ids failed, want %d, got %d", len(records), len(ids))
+	}
+	rows := make([]*EventOutbox, 0, len(records))
+	for i, r := range records {
+		r.ID = ids[i].Raw()
+		rows = append(rows, &EventOutbox{
+			ID:            ids[i],
+			Name:          r.Name,
+			Payload:       string(r.Payload),
+			NextAttemptAt: r.CreatedAt,
+			CreatedAt:     r.CreatedAt,
+		})
+	}
+	if err = tx.WithContext(ctx).Create(&rows).Error; err != nil {
+		return irr.Wrap(err, "insert events into outbox failed")
+	}
+	return nil
+}
+
+func (o *gormOutbox) Pending(ctx context.Context, limit int) ([]*eventbus.Record, error) {
+	db := o.db.Load()
+	if db == nil {
+		return nil, irr.Error("event outbox is not initialized")
+	}
+	var rows []*EventOutbox
+	if err := db.WithContext(ctx).Where("dead = ? AND next_attempt_at <= ?", false, time.Now()).
+		Order("created_at ASC, id ASC").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, irr.Wrap(err, "get pending events failed")
+	}
+	records := make([]*eventbus.Record, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, &eventbus.Record{
+			ID:        row.ID.Raw(),
+			Name:      row.Name,
+			Payload:   []byte(row.Payload),
+			Attempts:  row.Attempts,
+			CreatedAt: row.CreatedAt,
+		})
+	}
+	return records, nil
+}
+
+func (o *gormOutbox) Done(ctx context.Context, id uint64) error {
+	if err := o.db.Load().WithContext(ctx).Delete(&EventOutbox{}, "id = ?", id).Error; err != nil {
+		return irr.Wrap(err, "delete event %d failed", id)
+	}
+	return nil
+}
+
+func (o *gormOutbox) Retry(ctx context.Context, id uint64, cause error, retryAt time.Time) error {
+	msg := cause.Error()
+	if len(msg) > 512 {
+		msg = msg[:512]
+	}
+	updater := map[string]any{
+		"attempts":   gorm.Expr("attempts + ?", 1),
+		"last_error": msg,
+	}
+	if retryAt.IsZero() {
+		updater["dead"] = true
+	} else {
+		updater["next_attempt_at"] = retryAt
+	}
+	if err := o.db.Load().WithContext(ctx).Model(&EventOutbox{}).Where("id = ?", id).Updates(updater).Error; err != nil {
+		return irr.Wrap(err, "update event %d failed", id)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+)
+
+// IdleIncome 用户的挂机收益。收益按 Rate 从 SettledAt 开始累积，最多累积到领取后 IdleIncomeMaxHours 小时，
+// 读取时按当前时间计算 (见 At)，领取时通过积分流水发放 (见 ClaimIdleIncome)。
+// Rate 来自持有的挂机类 NFT 和掌握的 monster，它们变化时先按原来的 Rate 结算到当前时间再更新 Rate (见 refreshIdleIncome)
+type IdleIncome struct {
+	UserID      utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
+	NFTRate     uint64       `gorm:"not null;default:0" json:"nft_rate"`     // 持有的 idle_income NFT 每小时产出的 cash
+	MonsterRate uint64       `gorm:"not null;default:0" json:"monster_rate"` // 掌握的 monster 每小时产出的 cash
+	Rate        uint64       `gorm:"not null;default:0" json:"rate"`         // 每小时产出的 cash，不超过 MaxIdleIncomePerHour
+	Accrued     uint64       `gorm:"not null;default:0" json:"-"`            // 截止 SettledAt 累积的收益，单位为 cash/3600 (即 Rate x 秒数)
+	SettledAt   time.Time    `gorm:"not null" json:"settled_at"`
+	ClaimedAt   time.Time    `gorm:"not null" json:"claimed_at"` // 上一次领取的时间，从这时开始计算累积的时长
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+const (
+	// IdleIncomeMaxHours 领取后最多累积的时长，超过后不再产出
+	IdleIncomeMaxHours = 24
+	// IdleMonstersPerCash 每掌握这么多个 monster 每小时产出 1 cash
+	IdleMonstersPerCash = 10
+	// MaxIdleIncomePerHour 每小时产出的上限
+	MaxIdleIncomePerHour = 100
+
+	PointReasonIdleClaim PointReason = "idle.claim"
+)
+
+func init() {
+	subscribeIdleIncomeEvents()
+}
+
+func (IdleIncome) TableName() string {
+	return "idle_incomes"
+}
+
+// FullAt 收益不再累积的时间
+func (i *IdleIncome) FullAt() time.Time {
+	return i.ClaimedAt.Add(IdleIncomeMaxHours * time.Hour)
+}
+
+// accrue 按当前的 Rate 结算到 now，不保存。没有产出也没有累积的收益时从 now 重新开始计算累积的时长
+func (i *IdleIncome) accrue(now time.Time) {
+	if i.Rate == 0 && i.Accrued == 0 {
+		i.SettledAt, i.ClaimedAt = now, now
+		return
+	}
+	end, full := now, i.FullAt()
+	if end.After(full) {
+		end = full
+	}
+	// 只结算整秒，不足 1 秒的部分留到下一次结算，多次结算不会丢失收益
+	if end.After(i.SettledAt) {
+		seconds := end.Sub(i.SettledAt) / time.Second
+		i.Accrued += i.Rate * uint64(seconds)
+		i.SettledAt = i.SettledAt.Add(seconds * time.Second)
+	}
+	// 已经累积满时不再产出，领取后从 now 重新开始
+	if now.After(full) {
+		i.SettledAt = now
+	}
+}
+
+// At 结算到 now 的副本，用于查询
+func (i *IdleIncome) At(now time.Time) *IdleIncome {
+	copied := *i
+	copied.accrue(now)
+	return &copied
+}
+
+// Claimable 截止 SettledAt 可以领取的 cash，向下取整
+func (i *IdleIncome) Claimable() uint64 {
+	return i.Accrued / 3600
+}
+
+// GetIdleIncome 获取用户的挂机收益，第一次查询时从 now 开始挂机
+func GetIdleIncome(ctx context.Context, db *gorm.DB, userID utils.UInt64, now time.Time) (*IdleIncome, error) {
+	income := &IdleIncome{}
+	err := db.WithContext(ctx).Where("user_id = ?", userID).First(income).Error
+	if err == nil {
+		return income, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, irr.Wrap(err, "get idle income of user %d failed", userID)
+	}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		income, err = lockIdleIncome(ctx, tx, userID, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return income, nil
+}
+
+// lockIdleIncome 锁定用户的挂机收益，不存在时从 now 开始挂机
+func lockIdleIncome(ctx context.Context, tx *gorm.DB, userID utils.UInt64, now time.Time) (*IdleIncome, error) {
+	var count int64
+	if err := tx.WithContext(ctx).Model(&IdleIncome{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return nil, irr.Wrap(err, "get idle income of user %d failed", userID)
+	}
+	if count == 0 {
+		income := &IdleIncome{UserID: userID, SettledAt: now, ClaimedAt: now}
+		if err := income.updateRate(ctx, tx); err != nil {
+			return nil, err
+		}
+		if err := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(income).Error; err != nil {
+			return nil, irr.Wrap(err, "create idle income of user %d failed", userID)
+		}
+	}
+	income := &IdleIncome{}
+	if err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ?", userID).First(income).Error; err != nil {
+		return nil, irr.Wrap(err, "get idle income of user %d failed", userID)
+	}
+	return income, nil
+}
+
+// updateRate 按持有的 NFT 和掌握的 monster 重新计算 Rate
+func (i *IdleIncome) updateRate(ctx context.Context, tx *gorm.DB) error {
+	var templates []struct {
+		TemplateID utils.UInt64
+		Count      uint64
+	}
+	if err := tx.WithContext(ctx).Model(&NFT{}).Select("template_id, COUNT(*) AS count").
+		Where("owner_id = ?", i.UserID).Group("template_id").Scan(&templates).Error; err != nil {
+		return irr.Wrap(err, "count nfts of user %d failed", i.UserID)
+	}
+	i.NFTRate = 0
+	for _, t := range templates {
+		if template, err := GetNFTTemplate(t.TemplateID); err == nil && template.Effect.Type == NFTEffectIdleIncome {
+			i.NFTRate += template.Effect.Value * t.Count
+		}
+	}
+
+	var mastered int64
+	if err := tx.WithContext(ctx).Model(&UserMonster{}).
+		Joins("JOIN items ON items.id = user_monsters.item_id AND items.deleted_at IS NULL").
+		Where("user_monsters.user_id = ? AND user_monsters.familiarity >= ?", i.UserID, MasteredFamiliarity).Count(&mastered).Error; err != nil {
+		return irr.Wrap(err, "count mastered monsters of user %d failed", i.UserID)
+	}
+	i.MonsterRate = uint64(mastered) / IdleMonstersPerCash
+	i.Rate = min(i.NFTRate+i.MonsterRate, MaxIdleIncomePerHour)
+	return nil
+}
+
+func saveIdleIncome(ctx context.Context, tx *gorm.DB, income *IdleIncome) error {
+	if err := tx.WithContext(ctx).Model(income).
+		Select("nft_rate", "monster_rate", "rate", "accrued", "settled_at", "claimed_at").
+		Updates(income).Error; err != nil {
+		return irr.Wrap(err, "save idle income of user %d failed", income.UserID)
+	}
+	return nil
+}
+
+// refreshIdleIncome 在持有的 NFT 或掌握的 monster 变化后调用: 按原来的 Rate 结算到 now，再重新计算 Rate。
+// 需要在产生变化的事务中调用，加锁顺序为 积分 -> 挂机收益
+func refreshIdleIncome(ctx context.Context, tx *gorm.DB, userID utils.UInt64, now time.Time) error {
+	income, err := lockIdleIncome(ctx, tx, userID, now)
+	if err != nil {
+		return err
+	}
+	income.accrue(now)
+	if err = income.updateRate(ctx, tx); err != nil {
+		return err
+	}
+	return saveIdleIncome(ctx, tx, income)
+}
+
+// ClaimIdleIncome 领取截止 now 的挂机收益，通过积分流水发放后重新开始累积。没有可以领取的收益时不做修改，返回的流水为 nil。
+// idempotencyKey 相同的领取只生效一次，重复的领取返回已有的流水和 false
+func ClaimIdleIncome(ctx context.Context, db *gorm.DB, userID utils.UInt64, now time.Time, idempotencyKey string) (*IdleIncome, *PointTransaction, bool, error) {
+	var (
+		income  *IdleIncome
+		record  *PointTransaction
+		applied bool
+	)
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// 与作答和抽卡中的事件订阅者的加锁顺序一致，先锁定积分
+		if _, err := EnsureLoadProfilePoints(tx, userID); err != nil {
+			return irr.Wrap(err, "load points of user %d failed", userID)
+		}
+		if err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", userID).First(&ProfilePoints{}).Error; err != nil {
+			return irr.Wrap(err, "lock points of user %d failed", userID)
+		}
+		var err error
+		if income, err = lockIdleIncome(ctx, tx, userID, now); err != nil {
+			return err
+		}
+
+		// 重复的领取不依赖当前的收益
+		existing := &PointTransaction{}
+		err = tx.WithContext(ctx).Where("idempotency_key = ?", idempotencyKey).First(existing).Error
+		if err == nil {
+			if existing.UserID != userID || existing.Reason != PointReasonIdleClaim {
+				return irr.Wrap(ErrIdempotencyConflict, "key %q", idempotencyKey)
+			}
+			record = existing
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return irr.Wrap(err, "get point transaction %q failed", idempotencyKey)
+		}
+
+		income.accrue(now)
+		amount := income.Claimable()
+		if amount == 0 {
+			if !now.After(income.FullAt()) {
+				return nil
+			}
+			// 累积满了但不足 1 cash 时也重新开始累积
+			income.ClaimedAt = income.SettledAt
+			return saveIdleIncome(ctx, tx, income)
+		}
+		if record, applied, err = ApplyPointChange(ctx, tx, PointChange{
+			UserID:         userID,
+			Currency:       CurrencyCash,
+			Delta:          int64(amount),
+			Reason:         PointReasonIdleClaim,
+			IdempotencyKey: idempotencyKey,
+		}); err != nil {
+			return err
+		}
+		// 不足 1 cash 的部分保留到下一次领取
+		income.Accrued -= amount * 3600
+		income.ClaimedAt = income.SettledAt
+		if err = income.updateRate(ctx, tx); err != nil {
+			return err
+		}
+		return saveIdleIncome(ctx, tx, income)
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return income, record, applied, nil
+}
+
+// subscribeIdleIncomeEvents 持有的挂机类 NFT (抽到、交易或赠予) 或掌握的 monster (作答或删除 item) 变化时更新挂机收益。同步订阅，与产生变化的业务一起提交
+func subscribeIdleIncomeEvents() {
+	const subscriber = "idle_income"
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e NFTMinted) error {
+		template, err := GetNFTTemplate(e.TemplateID)
+		if err != nil || template.Effect.Type != NFTEffectIdleIncome {
+			return nil
+		}
+		return refreshIdleIncome(ctx, tx, e.OwnerID, time.Now())
+	})
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e NFTTransferred) error {
+		template, err := GetNFTTemplate(e.TemplateID)
+		if err != nil || template.Effect.Type != NFTEffectIdleIncome {
+			return nil
+		}
+		// 按用户 id 的顺序加锁，互相赠予时不会死锁
+		now, userIDs := time.Now(), []utils.UInt64{min(e.FromID, e.ToID), max(e.FromID, e.ToID)}
+		for _, userID := range userIDs {
+			if userID == NFTEscrowOwner {
+				continue
+			}
+			if err = refreshIdleIncome(ctx, tx, userID, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e MonsterPracticed) error {
+		// 与 updateRate 一样按 user_monsters 判断是否掌握，而不是 dungeon 中的熟练度
+		if (e.UserFamiliarityBefore >= MasteredFamiliarity) == (e.FamiliarityAfter >= MasteredFamiliarity) {
+			return nil
+		}
+		return refreshIdleIncome(ctx, tx, e.UserID, time.Now())
+	})
+	eventbus.SubscribeSync(events, subscriber, func(ctx context.Context, tx *gorm.DB, e ItemDeleted) error {
+		// 掌握了这个 item 的用户少了一个掌握的 monster，按用户 id 的顺序加锁
+		var userIDs []utils.UInt64
+		if err := tx.WithContext(ctx).Model(&UserMonster{}).Where("item_id = ? AND familiarity >= ?", e.ItemID, MasteredFamiliarity).
+			Order("user_id ASC").Pluck("user_id", &userIDs).Error; err != nil {
+			return irr.Wrap(err, "get users mastered item %d failed", e.ItemID)
+		}
+		now := time.Now()
+		for _, userID := range userIDs {
+			if err := refreshIdleIncome(ctx, tx, userID, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
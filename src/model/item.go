@@ -29,6 +29,8 @@ type Item struct {
 	Difficulty def.DifficultyLevel `gorm:"default:0x01"` // 难度，默认值为 NoviceNormal (0x01)
 	Importance def.ImportanceLevel `gorm:"default:0x01"` // 重要程度，默认值为 DomainGeneral (0x01)
 
+	Revision uint32 `gorm:"not null;default:1"` // 修订号，每次修改内容时增加，用于 fork 的三方比对 (见 ItemFork)
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 
@@ -63,7 +65,29 @@ func (i *Item) BeforeDelete(tx *gorm.DB) (err error) {
 	if err = tx.Where("item_id = ?", i.ID).Delete(&BookItem{}).Error; err != nil {
 		return irr.Wrap(err, "failed to delete item books")
 	}
+	if err = tx.Where("item_id = ?", i.ID).Delete(&ItemMedia{}).Error; err != nil {
+		return irr.Wrap(err, "failed to delete item media")
+	}
+
+	return nil
+}
+
+// FindItem 查找 userID 有 action 权限的 item，不存在或没有权限时返回 gorm.ErrRecordNotFound
+func FindItem(ctx context.Context, tx *gorm.DB, userID, id utils.UInt64, action Action) (*Item, error) {
+	item := &Item{}
+	if err := tx.WithContext(ctx).Scopes(AuthzPolicy().Scope(userID, ResourceItem, action)).
+		Where("items.id = ?", id).First(item).Error; err != nil {
+		return nil, err
+	}
+	return item, nil
+}
 
+// BumpItemRevision 增加 item 的修订号，修改 item 的内容或标签后调用
+func BumpItemRevision(ctx context.Context, tx *gorm.DB, id utils.UInt64) error {
+	if err := tx.WithContext(ctx).Model(&Item{}).Where("id = ?", id).
+		UpdateColumn("revision", gorm.Expr("revision + 1")).Error; err != nil {
+		return irr.Wrap(err, "bump revision of item %d failed", id)
+	}
 	return nil
 }
 
@@ -88,25 +112,61 @@ func GetItemIDsOfBooks(tx *gorm.DB, bookIDs []utils.UInt64) (itemBookMap map[uti
 	return itemBookMap, nil
 }
 
-// GetItemIDsOfBook 获取某个 book 的 items
+// GetItemIDsOfBook 按书中的顺序获取某个 book 的 items (见 GetOrderedItemIDsOfBook)，limit < 0 时不限制数量
 func GetItemIDsOfBook(tx *gorm.DB, bookID utils.UInt64, offset, limit int) (itemIDs []utils.UInt64, err error) {
-	if err = tx.Model(&BookItem{}).Where(
-		"book_id = ?", bookID,
-	).Offset(offset).Limit(limit).Pluck("item_id", &itemIDs).Error; err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, err
-		}
+	ids, err := GetOrderedItemIDsOfBook(tx.Statement.Context, tx, bookID)
+	if err != nil {
+		return nil, err
 	}
-	return itemIDs, nil
+	return pageIDs(ids, offset, limit), nil
 }
 
-// GetItemsOfBook 获取某个 book 的 items
+// GetItemIDsOfChapter 按顺序获取 book 中某个章节的 items，chapterID 为 0 时获取不属于任何章节的 items
+func GetItemIDsOfChapter(tx *gorm.DB, bookID, chapterID utils.UInt64, offset, limit int) (itemIDs []utils.UInt64, total int64, err error) {
+	list, err := chapterItems(tx.Statement.Context, tx, bookID, chapterID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return pageIDs(rankedIDs(list), offset, limit), int64(len(list)), nil
+}
+
+func pageIDs(ids []utils.UInt64, offset, limit int) []utils.UInt64 {
+	if offset >= len(ids) {
+		return []utils.UInt64{}
+	}
+	ids = ids[offset:]
+	if limit >= 0 && limit < len(ids) {
+		ids = ids[:limit]
+	}
+	return ids
+}
+
+// GetItemsOfBook 按书中的顺序获取某个 book 的 items
 func GetItemsOfBook(tx *gorm.DB, bookID utils.UInt64, offset, limit int) (items []*Item, err error) {
 	ids, err := GetItemIDsOfBook(tx, bookID, offset, limit)
 	if err != nil {
 		return nil, irr.Wrap(err, "get item ids for book failed")
 	}
-	return GetItemsByID(tx, ids)
+	return GetItemsInOrder(tx, ids)
+}
+
+// GetItemsInOrder 按 itemIDs 的顺序获取 items，不存在的 items 被跳过
+func GetItemsInOrder(tx *gorm.DB, itemIDs []utils.UInt64) ([]*Item, error) {
+	items, err := GetItemsByID(tx, itemIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[utils.UInt64]*Item, len(items))
+	for _, item := range items {
+		byID[item.ID] = item
+	}
+	ordered := make([]*Item, 0, len(items))
+	for _, id := range itemIDs {
+		if item, ok := byID[id]; ok {
+			ordered = append(ordered, item)
+		}
+	}
+	return ordered, nil
 }
 
 func GetItemsByID(tx *gorm.DB, itemIDs []utils.UInt64) (items []*Item, err error) {
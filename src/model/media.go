@@ -0,0 +1,187 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+const (
+	MediaKindImage = "image"
+	MediaKindAudio = "audio"
+
+	// MaxMediaSize 单个媒体文件的大小上限
+	MaxMediaSize int64 = 10 << 20
+	// MediaQuotaPerUser 每个用户可以使用的媒体空间，同一内容多次上传只计算一次
+	MediaQuotaPerUser int64 = 200 << 20
+)
+
+type (
+	// Media 用户上传的媒体文件
+	// 文件内容按 hash 存放在 blob store 中，多个用户上传同一内容时共享同一份 blob
+	Media struct {
+		UserID   utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
+		Hash     string       `gorm:"primaryKey;size:64" json:"hash"`
+		Kind     string       `gorm:"size:16;not null" json:"kind"`
+		MimeType string       `gorm:"size:128;not null" json:"mime_type"`
+		Size     int64        `gorm:"not null" json:"size"`
+		FileName string       `gorm:"size:255" json:"file_name"`
+
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// ItemMedia item 对 media 的引用
+	ItemMedia struct {
+		ItemID    utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		Hash      string       `gorm:"primaryKey;size:64"`
+		Position  int          `gorm:"not null;default:0"`
+		CreatedAt time.Time
+	}
+)
+
+func (m *Media) TableName() string {
+	return "media"
+}
+
+func (im *ItemMedia) TableName() string {
+	return "item_media"
+}
+
+// GetMediaUsage 获取用户已使用的媒体空间 (bytes)
+func GetMediaUsage(ctx context.Context, tx *gorm.DB, userID utils.UInt64) (int64, error) {
+	var used int64
+	if err := tx.WithContext(ctx).Model(&Media{}).Where("user_id = ?", userID).
+		Select("COALESCE(SUM(size), 0)").Scan(&used).Error; err != nil {
+		return 0, irr.Wrap(err, "sum media size failed, user_id= %d", userID)
+	}
+	return used, nil
+}
+
+// FindMediaOfUser 获取用户自己上传的 media，未找到的 hash 会被忽略
+func FindMediaOfUser(ctx context.Context, tx *gorm.DB, userID utils.UInt64, hashes []string) ([]*Media, error) {
+	medias := make([]*Media, 0, len(hashes))
+	if len(hashes) == 0 {
+		return medias, nil
+	}
+	if err := tx.WithContext(ctx).Where("user_id = ? AND hash IN ?", userID, hashes).Find(&medias).Error; err != nil {
+		return nil, irr.Wrap(err, "find media failed")
+	}
+	return medias, nil
+}
+
+// GetMediaOfItem 获取 item 引用的 media，按引用顺序返回
+func GetMediaOfItem(ctx context.Context, tx *gorm.DB, item *Item) ([]*Media, error) {
+	var hashes []string
+	if err := tx.WithContext(ctx).Model(&ItemMedia{}).Where("item_id = ?", item.ID).
+		Order("position").Pluck("hash", &hashes).Error; err != nil {
+		return nil, irr.Wrap(err, "find item media failed, item_id= %d", item.ID)
+	}
+	medias, err := FindMediaOfUser(ctx, tx, item.CreatorID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	mMedia := make(map[string]*Media, len(medias))
+	for _, m := range medias {
+		mMedia[m.Hash] = m
+	}
+	ret := make([]*Media, 0, len(hashes))
+	for _, h := range hashes {
+		if m, ok := mMedia[h]; ok {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+// SetItemMedia 以覆盖的方式设置 item 引用的 media，hashes 的顺序即展示顺序
+// 调用方需要保证 hashes 都是 item 创建者自己的 media
+func SetItemMedia(ctx context.Context, tx *gorm.DB, itemID utils.UInt64, hashes []string) error {
+	if err := tx.WithContext(ctx).Where("item_id = ?", itemID).Delete(&ItemMedia{}).Error; err != nil {
+		return irr.Wrap(err, "clear item media failed, item_id= %d", itemID)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	refs := make([]*ItemMedia, 0, len(hashes))
+	for i, h := range hashes {
+		refs = append(refs, &ItemMedia{ItemID: itemID, Hash: h, Position: i})
+	}
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&refs).Error; err != nil {
+		return irr.Wrap(err, "create item media failed, item_id= %d", itemID)
+	}
+	return nil
+}
+
+// copyItemMedia 让 dstID 引用 src 引用的 media，dst 的创建者 userID 同时获得这些 media 的记录 (共享同一份 blob，
+// 占用 userID 的配额)，之后 src 的创建者删除自己的 media 不影响复制出的 item
+func copyItemMedia(ctx context.Context, tx *gorm.DB, userID utils.UInt64, src *Item, dstID utils.UInt64) error {
+	medias, err := GetMediaOfItem(ctx, tx, src)
+	if err != nil || len(medias) == 0 {
+		return err
+	}
+	hashes := make([]string, 0, len(medias))
+	copies := make([]*Media, 0, len(medias))
+	for _, m := range medias {
+		hashes = append(hashes, m.Hash)
+		copies = append(copies, &Media{UserID: userID, Hash: m.Hash, Kind: m.Kind, MimeType: m.MimeType, Size: m.Size, FileName: m.FileName})
+	}
+	if err = tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&copies).Error; err != nil {
+		return irr.Wrap(err, "copy media of item %d failed", src.ID)
+	}
+	return SetItemMedia(ctx, tx, dstID, hashes)
+}
+
+// CountMediaRefsOfUser 统计用户的 items 中对某个 media 的引用数
+func CountMediaRefsOfUser(ctx context.Context, tx *gorm.DB, userID utils.UInt64, hash string) (int64, error) {
+	var cnt int64
+	if err := tx.WithContext(ctx).Model(&ItemMedia{}).
+		Joins("JOIN items ON items.id = item_media.item_id AND items.deleted_at IS NULL").
+		Where("items.creator_id = ? AND item_media.hash = ?", userID, hash).
+		Count(&cnt).Error; err != nil {
+		return 0, irr.Wrap(err, "count media refs failed")
+	}
+	return cnt, nil
+}
+
+// CountMediaOwners 统计有多少用户持有该 hash 的 media，为 0 时 blob 可以被回收
+func CountMediaOwners(ctx context.Context, tx *gorm.DB, hash string) (int64, error) {
+	var cnt int64
+	if err := tx.WithContext(ctx).Model(&Media{}).Where("hash = ?", hash).Count(&cnt).Error; err != nil {
+		return 0, irr.Wrap(err, "count media owners failed")
+	}
+	return cnt, nil
+}
+
+// GetMediaOfUser 获取用户自己上传的某个 media，不存在时返回 gorm.ErrRecordNotFound
+func GetMediaOfUser(ctx context.Context, tx *gorm.DB, userID utils.UInt64, hash string) (*Media, error) {
+	var media Media
+	if err := tx.WithContext(ctx).Where("user_id = ? AND hash = ?", userID, hash).First(&media).Error; err != nil {
+		return nil, err
+	}
+	return &media, nil
+}
+
+// GetReadableMedia 获取 userID 可以读取的 media: 自己上传的，或者被 userID 可读的 item 引用的 (media 属于 item 的创建者)，
+// 都不满足时返回 gorm.ErrRecordNotFound
+func GetReadableMedia(ctx context.Context, tx *gorm.DB, userID utils.UInt64, hash string) (*Media, error) {
+	media, err := GetMediaOfUser(ctx, tx, userID, hash)
+	if err == nil || !errors.Is(err, gorm.ErrRecordNotFound) {
+		return media, err
+	}
+
+	db := tx.Session(&gorm.Session{NewDB: true})
+	creators := db.Model(&Item{}).Scopes(AuthzPolicy().Scope(userID, ResourceItem, ActionRead)).
+		Joins("JOIN item_media ON item_media.item_id = items.id").
+		Where("item_media.hash = ?", hash).Select("items.creator_id")
+	media = &Media{}
+	if err = tx.WithContext(ctx).Where("hash = ? AND user_id IN (?)", hash, creators).First(media).Error; err != nil {
+		return nil, err
+	}
+	return media, nil
+}
@@ -15,13 +15,14 @@ import (
 	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type (
 	// UserMonster - Item 对特定用户的属性
 	UserMonster struct {
-		UserID utils.UInt64
-		ItemID utils.UInt64
+		UserID utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		ItemID utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
 
 		Familiarity utils.Percentage `gorm:"default:0"` // 熟练度，范围为0-100，默认值为0
 
@@ -34,6 +35,7 @@ type (
 
 		SourceType MonsterSource
 		SourceID   utils.UInt64
+		Position   uint32 `gorm:"not null;default:0"` // 在来源 book 中的顺序 (从 1 开始)，campaign 按这个顺序引入新的 items
 
 		// 用于 runtime
 		PracticeAt     time.Time // 上次复习时间的记录
@@ -51,6 +53,7 @@ type (
 		Importance def.ImportanceLevel `gorm:"default:0x01"` // Item 向 DungeonMonster 单项同步
 
 		CreatedAt time.Time
+		DeletedAt gorm.DeletedAt // 来自标签来源的 monster 不再匹配时软删除，重新匹配时恢复复习进度
 
 		// StoryTelling & Gaming
 		Name        string
@@ -63,6 +66,7 @@ type (
 const (
 	MonsterSourceItem MonsterSource = 1
 	MonsterSourceBook MonsterSource = 2
+	MonsterSourceTag  MonsterSource = 3 // 来自复习计划的标签来源，标签变化时自动加入或移除，见 Dungeon.SyncTagMonsters
 )
 
 var CKDungeonMonsterCounts = cachekey.MustNewSchema[utils.UInt64](
@@ -74,6 +78,8 @@ func (ms MonsterSource) String() string {
 		return "item"
 	case MonsterSourceBook:
 		return "book"
+	case MonsterSourceTag:
+		return "tag"
 	default:
 		return fmt.Sprintf("unsupported_monster_source(%d)", ms)
 	}
@@ -81,7 +87,7 @@ func (ms MonsterSource) String() string {
 
 func (d *Dungeon) AddMonsters(ctx context.Context, tx *gorm.DB, items []utils.UInt64) error {
 	// Validate the existence of resources
-	if err := validateExistence(tx, MonsterSourceItem, items); err != nil {
+	if err := validateExistence(ctx, tx, d.UserID, MonsterSourceItem, items); err != nil {
 		return irr.Track(err, "add monsters items to dungeon failed, ids= %v", items)
 	}
 
@@ -93,7 +99,7 @@ func (d *Dungeon) AddMonsters(ctx context.Context, tx *gorm.DB, items []utils.UI
 
 func (d *Dungeon) AddMonsterFromBook(ctx context.Context, tx *gorm.DB, sourceEntityIDs []utils.UInt64) error {
 	// Validate the existence of resources
-	if err := validateExistence(tx, MonsterSourceBook, sourceEntityIDs); err != nil {
+	if err := validateExistence(ctx, tx, d.UserID, MonsterSourceBook, sourceEntityIDs); err != nil {
 		return irr.Track(err, "add monsters from book to dungeon failed, ids= %v", sourceEntityIDs)
 	}
 
@@ -111,23 +117,25 @@ func (d *Dungeon) AddMonsterFromBook(ctx context.Context, tx *gorm.DB, sourceEnt
 	return nil
 }
 
-func validateExistence(tx *gorm.DB, source MonsterSource, resourceIDs []utils.UInt64) error {
-	var count int64
+// validateExistence 校验资源都存在，并且复习计划的所有者 userID 有读取权限
+func validateExistence(ctx context.Context, tx *gorm.DB, userID utils.UInt64, source MonsterSource, resourceIDs []utils.UInt64) error {
+	var resource Resource
 	switch source {
 	case MonsterSourceItem:
-		if err := tx.Model(&Item{}).Where("id IN ?", resourceIDs).Count(&count).Error; err != nil {
-			return irr.Track(err, "find items in ids failed, ids=%v", resourceIDs)
-		}
+		resource = ResourceItem
 	case MonsterSourceBook:
-		if err := tx.Model(&Book{}).Where("id IN ?", resourceIDs).Count(&count).Error; err != nil {
-			return irr.Track(err, "find books in ids failed, ids=%v", resourceIDs)
-		}
+		resource = ResourceBook
 	default:
 		return irr.Trace("validate failed, unknown resource type: %v", source)
 	}
 
-	if count != int64(len(resourceIDs)) {
-		return irr.Error("some resources not found")
+	uniqIDs := typer.Keys(typer.SliceToTrueMap(resourceIDs))
+	found, err := FilterAuthorized(ctx, tx, userID, resource, uniqIDs, ActionRead)
+	if err != nil {
+		return irr.Track(err, "find %s in ids failed, ids=%v", resource, resourceIDs)
+	}
+	if len(found) != len(uniqIDs) {
+		return irr.Wrap(gorm.ErrRecordNotFound, "some %s not found, ids=%v, found=%v", resource, resourceIDs, found)
 	}
 
 	return nil
@@ -144,17 +152,6 @@ func createDungeonBookRecord(tx *gorm.DB, dungeonID, bookID utils.UInt64) error
 	return nil
 }
 
-func createDungeonTagRecord(tx *gorm.DB, dungeonID, tagID utils.UInt64) error {
-	dungeonTag := DungeonTag{
-		DungeonID: dungeonID,
-		TagID:     tagID,
-	}
-	if err := tx.Where(&dungeonTag).FirstOrCreate(&dungeonTag).Error; err != nil {
-		return err
-	}
-	return nil
-}
-
 func createDungeonMonster(tx *gorm.DB, dungeonID utils.UInt64, item Item, source MonsterSource, sourceEntityID utils.UInt64) error {
 	dungeonMonster := DungeonMonster{
 		DungeonID: dungeonID,
@@ -180,10 +177,30 @@ func createDungeonMonster(tx *gorm.DB, dungeonID utils.UInt64, item Item, source
 		Name:        "",           // todo: created by AI
 		Description: item.Content, // todo: created by AI
 	}
-	if err := tx.Where("dungeon_id = ? AND item_id = ?", dungeonID, item.ID).FirstOrCreate(&dungeonMonster).Error; err != nil {
-		return err
+	existing := &DungeonMonster{}
+	result := tx.Unscoped().Where("dungeon_id = ? AND item_id = ?", dungeonID, item.ID).Limit(1).Find(existing)
+	if result.Error != nil {
+		return result.Error
 	}
-	return nil
+	if result.RowsAffected == 0 {
+		return tx.Create(&dungeonMonster).Error
+	}
+
+	// 已经移除的 monster 恢复原来的复习进度；标签来源是推导出的，被直接或通过 book 加入时改为明确的来源，
+	// 之后标签不再匹配时不会被移除
+	updater := map[string]any{}
+	if existing.DeletedAt.Valid {
+		updater["deleted_at"] = nil
+		updater["difficulty"], updater["importance"], updater["description"] = item.Difficulty, item.Importance, item.Content
+	}
+	if existing.DeletedAt.Valid || (existing.SourceType == MonsterSourceTag && source != MonsterSourceTag) {
+		updater["source_type"], updater["source_id"] = source, sourceEntityID
+	}
+	if len(updater) == 0 {
+		return nil
+	}
+	return tx.Unscoped().Model(&DungeonMonster{}).Where("dungeon_id = ? AND item_id = ?", dungeonID, item.ID).
+		Updates(updater).Error
 }
 
 func createMonstersForBook(tx *gorm.DB, dungeonID, bookID utils.UInt64) error {
@@ -206,6 +223,177 @@ func createMonstersForBook(tx *gorm.DB, dungeonID, bookID utils.UInt64) error {
 			return err
 		}
 	}
+	return syncMonsterPositions(tx.Statement.Context, tx, []utils.UInt64{dungeonID}, bookID)
+}
+
+// campaignDungeonsOfBook 获取引用了 book 的 campaign 复习计划，包括订阅者的复习计划
+func campaignDungeonsOfBook(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) ([]utils.UInt64, error) {
+	var dungeonIDs []utils.UInt64
+	if err := tx.WithContext(ctx).Model(&Dungeon{}).
+		Joins("JOIN dungeon_books ON dungeon_books.dungeon_id = dungeons.id").
+		Where("dungeon_books.book_id = ? AND dungeons.type = ?", bookID, def.DungeonTypeCampaign).
+		Pluck("dungeons.id", &dungeonIDs).Error; err != nil {
+		return nil, irr.Wrap(err, "find dungeons of book %d failed", bookID)
+	}
+	return dungeonIDs, nil
+}
+
+// filterReadableDungeons 过滤出所有者仍然可以读取资源的复习计划，
+// 失去权限 (取消订阅、被移出成员或 book 改回私有) 的复习计划不再同步资源的内容
+func filterReadableDungeons(ctx context.Context, tx *gorm.DB, dungeonIDs []utils.UInt64, resource Resource, resourceID utils.UInt64) ([]utils.UInt64, error) {
+	if len(dungeonIDs) == 0 {
+		return dungeonIDs, nil
+	}
+	var dungeons []Dungeon
+	if err := tx.WithContext(ctx).Select("id", "user_id").Where("id IN ?", dungeonIDs).Find(&dungeons).Error; err != nil {
+		return nil, irr.Wrap(err, "find owners of dungeons %v failed", dungeonIDs)
+	}
+	readable := make(map[utils.UInt64]bool)
+	ret := make([]utils.UInt64, 0, len(dungeons))
+	for _, d := range dungeons {
+		ok, checked := readable[d.UserID]
+		if !checked {
+			ids, err := FilterAuthorized(ctx, tx, d.UserID, resource, []utils.UInt64{resourceID}, ActionRead)
+			if err != nil {
+				return nil, err
+			}
+			ok = len(ids) > 0
+			readable[d.UserID] = ok
+		}
+		if ok {
+			ret = append(ret, d.ID)
+		}
+	}
+	return ret, nil
+}
+
+// unlinkUnreadableBook 用户失去 book 的读取权限后，移除用户的复习计划对 book 的引用，之后 book 的修改不再同步过来，
+// 已经加入复习计划的 monsters 保留
+func unlinkUnreadableBook(ctx context.Context, tx *gorm.DB, userID, bookID utils.UInt64) error {
+	ids, err := FilterAuthorized(ctx, tx, userID, ResourceBook, []utils.UInt64{bookID}, ActionRead)
+	if err != nil || len(ids) > 0 {
+		return err
+	}
+	db := tx.Session(&gorm.Session{NewDB: true})
+	if err = tx.WithContext(ctx).
+		Where("book_id = ? AND dungeon_id IN (?)", bookID, db.Unscoped().Model(&Dungeon{}).Select("id").Where("user_id = ?", userID)).
+		Delete(&DungeonBook{}).Error; err != nil {
+		return irr.Wrap(err, "unlink book %d from dungeons of user %d failed", bookID, userID)
+	}
+	return nil
+}
+
+// SyncBookMonsterPositions 把 book 中 items 的顺序同步到引用了这个 book 的 campaign 复习计划，
+// book 中的 items 或章节的顺序变化后调用
+func SyncBookMonsterPositions(ctx context.Context, tx *gorm.DB, bookID utils.UInt64) error {
+	dungeonIDs, err := campaignDungeonsOfBook(ctx, tx, bookID)
+	if err != nil {
+		return err
+	}
+	if dungeonIDs, err = filterReadableDungeons(ctx, tx, dungeonIDs, ResourceBook, bookID); err != nil {
+		return err
+	}
+	return syncMonsterPositions(ctx, tx, dungeonIDs, bookID)
+}
+
+// syncMonsterPositions 只更新位置发生变化的 monsters
+func syncMonsterPositions(ctx context.Context, tx *gorm.DB, dungeonIDs []utils.UInt64, bookID utils.UInt64) error {
+	if len(dungeonIDs) == 0 {
+		return nil
+	}
+	itemIDs, err := GetOrderedItemIDsOfBook(ctx, tx, bookID)
+	if err != nil {
+		return err
+	}
+	positions := make(map[utils.UInt64]uint32, len(itemIDs))
+	for i, id := range itemIDs {
+		positions[id] = uint32(i + 1)
+	}
+
+	var monsters []DungeonMonster
+	if err = tx.WithContext(ctx).Select("dungeon_id", "item_id", "position").
+		Where("dungeon_id IN ? AND source_id = ?", dungeonIDs, bookID).Find(&monsters).Error; err != nil {
+		return irr.Wrap(err, "get monsters of book %d failed", bookID)
+	}
+	for _, m := range monsters {
+		position, ok := positions[m.ItemID]
+		if !ok || position == m.Position {
+			continue
+		}
+		if err = tx.WithContext(ctx).Model(&DungeonMonster{}).
+			Where("dungeon_id = ? AND item_id = ?", m.DungeonID, m.ItemID).
+			Update("position", position).Error; err != nil {
+			return irr.Wrap(err, "update position of monster %d in dungeon %d failed", m.ItemID, m.DungeonID)
+		}
+	}
+	return nil
+}
+
+// SyncBookMonsters 把 book 中新增和移除的 items 同步到引用了这个 book 的 campaign 复习计划，包括订阅者的复习计划，
+// 所有者已经不能读取 book 的复习计划只同步移除
+func SyncBookMonsters(ctx context.Context, tx *gorm.DB, bookID utils.UInt64, added, removed []utils.UInt64) error {
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	linked, err := campaignDungeonsOfBook(ctx, tx, bookID)
+	if err != nil {
+		return err
+	}
+	if len(linked) == 0 {
+		return nil
+	}
+
+	// 只移除由这个 book 带入的 monsters，直接添加的 item 保留
+	if len(removed) > 0 {
+		if err = tx.WithContext(ctx).Unscoped().Where("dungeon_id IN ? AND item_id IN ? AND source_id = ?", linked, removed, bookID).
+			Delete(&DungeonMonster{}).Error; err != nil {
+			return irr.Wrap(err, "remove monsters of book %d failed", bookID)
+		}
+	}
+
+	dungeonIDs, err := filterReadableDungeons(ctx, tx, linked, ResourceBook, bookID)
+	if err != nil {
+		return err
+	}
+	if len(added) > 0 {
+		items, err := FindItems(ctx, tx, added)
+		if err != nil {
+			return irr.Wrap(err, "find items %v failed", added)
+		}
+		for _, dungeonID := range dungeonIDs {
+			for _, item := range items {
+				if err = createDungeonMonster(tx, dungeonID, item, MonsterSourceItem, bookID); err != nil {
+					return irr.Wrap(err, "add monster %d to dungeon %d failed", item.ID, dungeonID)
+				}
+			}
+		}
+	}
+	return syncMonsterPositions(ctx, tx, dungeonIDs, bookID)
+}
+
+// SyncItemMonsters 把 item 的修改同步到复习计划中 monster 的宽表字段，包括订阅了 item 所在 book 的用户的复习计划，
+// 所有者已经不能读取 item 的复习计划不再同步
+func SyncItemMonsters(ctx context.Context, tx *gorm.DB, itemID utils.UInt64) error {
+	item := &Item{}
+	if err := tx.WithContext(ctx).Where("id = ?", itemID).First(item).Error; err != nil {
+		return irr.Wrap(err, "find item %d failed", itemID)
+	}
+	var dungeonIDs []utils.UInt64
+	if err := tx.WithContext(ctx).Model(&DungeonMonster{}).Where("item_id = ?", itemID).
+		Distinct().Pluck("dungeon_id", &dungeonIDs).Error; err != nil {
+		return irr.Wrap(err, "find dungeons of item %d failed", itemID)
+	}
+	dungeonIDs, err := filterReadableDungeons(ctx, tx, dungeonIDs, ResourceItem, itemID)
+	if err != nil || len(dungeonIDs) == 0 {
+		return err
+	}
+	if err = tx.WithContext(ctx).Model(&DungeonMonster{}).Where("item_id = ? AND dungeon_id IN ?", itemID, dungeonIDs).Updates(map[string]any{
+		"difficulty":  item.Difficulty,
+		"importance":  item.Importance,
+		"description": item.Content,
+	}).Error; err != nil {
+		return irr.Wrap(err, "sync monsters of item %d failed", itemID)
+	}
 	return nil
 }
 
@@ -244,6 +432,11 @@ func (d *Dungeon) GetMonster(ctx context.Context, tx *gorm.DB, itemID utils.UInt
 	return &dm, nil
 }
 
+// GetMonsterForUpdate 在事务中获取并锁定 DungeonMonster，直到事务结束，用于先检查再修改的场景
+func (d *Dungeon) GetMonsterForUpdate(ctx context.Context, tx *gorm.DB, itemID utils.UInt64) (*DungeonMonster, error) {
+	return d.GetMonster(ctx, tx.Clauses(clause.Locking{Strength: "UPDATE"}), itemID)
+}
+
 func (d *Dungeon) CountMonsters(ctx context.Context, tx *gorm.DB) (int64, error) {
 	cacheKey := CKDungeonMonsterCounts.MustBuild(d.ID)
 	if t, err := cache.Client().Get(ctx, cacheKey).Int64(); err == nil {
@@ -292,20 +485,31 @@ func (d *Dungeon) GetMonstersWithExpandedAssociations(ctx context.Context, tx *g
 	if err != nil {
 		return nil, err
 	}
-	for itemID := range bookItemMap {
-		if bookID, exists := itemSourceMap[itemID]; exists {
+	for itemID, bookID := range bookItemMap {
+		if _, exists := itemSourceMap[itemID]; !exists {
 			itemSourceMap[itemID] = bookID
 		}
 	}
 
-	// 获取 tag 关联的 items
+	// 获取 tag 关联的 items，tag 没有数字 id，source 记为 item 本身
 	tagItemMap, err := GetItemIDsOfTags(ctx, d.UserID, tags)
 	if err != nil {
 		return nil, err
 	}
 	for itemID := range tagItemMap {
-		if tagID, exists := itemSourceMap[itemID]; exists {
-			itemSourceMap[itemID] = tagID
+		if _, exists := itemSourceMap[itemID]; !exists {
+			itemSourceMap[itemID] = itemID
+		}
+	}
+
+	// 获取标签表达式匹配的 items
+	queryItemIDs, err := d.GetItemIDsOfTagQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, itemID := range queryItemIDs {
+		if _, exists := itemSourceMap[itemID]; !exists {
+			itemSourceMap[itemID] = itemID
 		}
 	}
 
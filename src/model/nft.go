@@ -0,0 +1,345 @@
+package model
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/pkg/gacha"
+)
+
+type (
+	// NFTRarity NFT 的稀有度
+	NFTRarity string
+
+	// NFTEffectType NFT 的特效
+	NFTEffectType string
+
+	// NFTEffectCategory 特效的分类，见 doc/DESIGN.md
+	NFTEffectCategory string
+
+	// NFTSource NFT 的来源
+	NFTSource string
+
+	// NFTEffect 模板的特效，Value 和 Target 的含义取决于 Type (见 nfts.yaml)
+	NFTEffect struct {
+		Type   NFTEffectType `yaml:"type" json:"type"`
+		Value  uint64        `yaml:"value" json:"value,omitempty"`
+		Target string        `yaml:"target" json:"target,omitempty"`
+	}
+
+	// NFTTemplate NFT 的模板，同一个模板可以被抽到多次，每次得到一个新的 NFT
+	NFTTemplate struct {
+		ID          utils.UInt64 `yaml:"id" json:"id"`
+		Name        string       `yaml:"name" json:"name"`
+		Description string       `yaml:"description" json:"description"`
+		Rarity      NFTRarity    `yaml:"rarity" json:"rarity"`
+		Effect      NFTEffect    `yaml:"effect" json:"effect"`
+	}
+
+	// NFTPityRule 卡池的保底规则，见 gacha.PityRule
+	NFTPityRule struct {
+		Rarity NFTRarity `yaml:"rarity" json:"rarity"`
+		After  uint32    `yaml:"after" json:"after"`
+	}
+
+	// NFTPool 卡池，抽一次花费 Price 个 Currency 或一张抽卡券 (Ticket 为 true 时)
+	NFTPool struct {
+		ID          utils.UInt64         `yaml:"id" json:"id"`
+		Name        string               `yaml:"name" json:"name"`
+		Description string               `yaml:"description" json:"description"`
+		Currency    Currency             `yaml:"currency" json:"currency"`
+		Price       uint64               `yaml:"price" json:"price"`
+		Rates       map[NFTRarity]uint64 `yaml:"rates" json:"rates"`
+		Pity        []NFTPityRule        `yaml:"pity" json:"pity,omitempty"`
+		Ticket      bool                 `yaml:"ticket" json:"ticket"` // 是否可以用抽卡券抽卡，一张抽一次
+
+		table *gacha.Table
+	}
+
+	// NFTCatalog 所有的卡池、模板和商店，由数据 (见 nfts.yaml) 而不是代码描述
+	NFTCatalog struct {
+		Pools     []*NFTPool     `yaml:"pools" json:"pools"`
+		Templates []*NFTTemplate `yaml:"templates" json:"templates"`
+		Shops     []*NFTShop     `yaml:"shops" json:"shops"`
+
+		byRarity map[NFTRarity][]*NFTTemplate
+	}
+
+	// NFT 用户持有的 NFT。所有权以链下 (MySQL) 的记录为准，ChainTokenID 为空表示还没有同步到链上 (见 ChainAdapter)。
+	// 挂单中的 NFT 由市场托管，OwnerID 为 NFTEscrowOwner (见 CreateNFTTrade)
+	NFT struct {
+		ID           utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		OwnerID      utils.UInt64 `gorm:"not null;index:idx_nft_owner" json:"owner_id"`
+		Version      uint64       `gorm:"not null;default:0" json:"-"` // 所有权每次变化时加一，用于乐观锁
+		TemplateID   utils.UInt64 `gorm:"not null" json:"template_id"`
+		Rarity       NFTRarity    `gorm:"size:16;not null" json:"rarity"`
+		Source       NFTSource    `gorm:"size:16;not null" json:"source"`
+		ChainTokenID string       `gorm:"size:128;not null;default:''" json:"chain_token_id,omitempty"`
+		EquippedAt   *time.Time   `json:"equipped_at,omitempty"` // 追加类和通道类的特效只在装备中时生效，见 EquipNFT
+		CreatedAt    time.Time    `json:"created_at"`
+		UpdatedAt    time.Time    `json:"updated_at"`
+	}
+
+	// ChainAdapter 把链下的 NFT 同步到链上。在事务提交后由 NFTMinted 的异步订阅者调用，可能被重复调用，需要是幂等的
+	ChainAdapter interface {
+		// Mint 在链上铸造 nft，返回链上的 token id
+		Mint(ctx context.Context, nft *NFT) (tokenID string, err error)
+	}
+
+	chainSync struct {
+		db      *gorm.DB
+		adapter ChainAdapter
+	}
+)
+
+const (
+	NFTRarityCommon    NFTRarity = "common"
+	NFTRarityRare      NFTRarity = "rare"
+	NFTRarityEpic      NFTRarity = "epic"
+	NFTRarityLegendary NFTRarity = "legendary"
+
+	NFTEffectBonusPoints   NFTEffectType = "bonus_points"   // 作答获得的 cash 增加 Value%
+	NFTEffectExtraDraw     NFTEffectType = "extra_draw"     // 每次作答有 Value% 的概率获得一张抽卡券
+	NFTEffectIdleIncome    NFTEffectType = "idle_income"    // 每小时获得 Value cash
+	NFTEffectUnlockDungeon NFTEffectType = "unlock_dungeon" // 解锁 Target 类型的复习计划
+
+	NFTEffectCategoryBonus  NFTEffectCategory = "bonus"  // 追加类
+	NFTEffectCategoryIdle   NFTEffectCategory = "idle"   // 挂机类
+	NFTEffectCategoryUnlock NFTEffectCategory = "unlock" // 通道类
+
+	NFTSourceDraw NFTSource = "draw"
+	NFTSourceShop NFTSource = "shop"
+
+	// NFTEscrowOwner 挂单中的 NFT 的 OwnerID，用户 id 不会是 0
+	NFTEscrowOwner utils.UInt64 = 0
+)
+
+// NFTRarities 所有的稀有度，从低到高
+var NFTRarities = []NFTRarity{NFTRarityCommon, NFTRarityRare, NFTRarityEpic, NFTRarityLegendary}
+
+var (
+	ErrNFTPoolNotFound     = irr.Error("nft pool not found")
+	ErrNFTTemplateNotFound = irr.Error("nft template not found")
+	// ErrNFTConflict NFT 的所有权在读取之后被并发修改了，可以重试
+	ErrNFTConflict = irr.Error("nft is changed concurrently")
+)
+
+//go:embed nfts.yaml
+var defaultNFTCatalog []byte
+
+var (
+	// nftCatalog 当前生效的卡池、模板和商店，按 id 排序
+	nftCatalog atomic.Pointer[NFTCatalog]
+	// nftChain 为空时 NFT 只保存在链下
+	nftChain atomic.Pointer[chainSync]
+)
+
+func init() {
+	if err := LoadNFTCatalog(defaultNFTCatalog); err != nil {
+		panic(fmt.Sprintf("load default nft catalog failed: %v", err))
+	}
+	eventbus.SubscribeAsync(events, "nft.chain", mintOnChain)
+}
+
+func (NFT) TableName() string {
+	return "nfts"
+}
+
+// Valid 是否是支持的稀有度
+func (r NFTRarity) Valid() bool {
+	for _, rarity := range NFTRarities {
+		if r == rarity {
+			return true
+		}
+	}
+	return false
+}
+
+// Category 特效的分类，不支持的特效返回空
+func (t NFTEffectType) Category() NFTEffectCategory {
+	switch t {
+	case NFTEffectBonusPoints, NFTEffectExtraDraw:
+		return NFTEffectCategoryBonus
+	case NFTEffectIdleIncome:
+		return NFTEffectCategoryIdle
+	case NFTEffectUnlockDungeon:
+		return NFTEffectCategoryUnlock
+	}
+	return ""
+}
+
+// LoadNFTCatalog 解析并校验卡池、模板和商店，校验通过后替换当前生效的定义
+func LoadNFTCatalog(data []byte) error {
+	catalog := &NFTCatalog{}
+	if err := yaml.Unmarshal(data, catalog); err != nil {
+		return irr.Wrap(err, "parse nft catalog failed")
+	}
+
+	catalog.byRarity = make(map[NFTRarity][]*NFTTemplate)
+	templateIDs := make(map[utils.UInt64]bool, len(catalog.Templates))
+	for _, t := range catalog.Templates {
+		switch {
+		case t.ID == 0 || templateIDs[t.ID]:
+			return irr.Error("nft template id %d is missing or duplicated", t.ID)
+		case !t.Rarity.Valid():
+			return irr.Error("nft template %d has unknown rarity %q", t.ID, t.Rarity)
+		case t.Effect.Type.Category() == "":
+			return irr.Error("nft template %d has unknown effect %q", t.ID, t.Effect.Type)
+		case t.Effect.Type == NFTEffectUnlockDungeon && t.Effect.Target == "":
+			return irr.Error("nft template %d should have an unlock target", t.ID)
+		case t.Effect.Type != NFTEffectUnlockDungeon && t.Effect.Value == 0:
+			return irr.Error("nft template %d should have an effect value", t.ID)
+		}
+		templateIDs[t.ID] = true
+	}
+	sort.Slice(catalog.Templates, func(i, j int) bool { return catalog.Templates[i].ID < catalog.Templates[j].ID })
+	for _, t := range catalog.Templates {
+		catalog.byRarity[t.Rarity] = append(catalog.byRarity[t.Rarity], t)
+	}
+
+	poolIDs := make(map[utils.UInt64]bool, len(catalog.Pools))
+	for _, p := range catalog.Pools {
+		switch {
+		case p.ID == 0 || poolIDs[p.ID]:
+			return irr.Error("nft pool id %d is missing or duplicated", p.ID)
+		case p.Currency != CurrencyCash && p.Currency != CurrencyGem:
+			return irr.Error("nft pool %d should be paid with cash or gem, got %q", p.ID, p.Currency)
+		case p.Price == 0:
+			return irr.Error("nft pool %d should have a price", p.ID)
+		}
+		poolIDs[p.ID] = true
+
+		p.table = &gacha.Table{}
+		for rarity, rate := range p.Rates {
+			if !rarity.Valid() {
+				return irr.Error("nft pool %d has unknown rarity %q", p.ID, rarity)
+			}
+			if rate > 0 && len(catalog.byRarity[rarity]) == 0 {
+				return irr.Error("nft pool %d has no template of rarity %q", p.ID, rarity)
+			}
+		}
+		for _, rarity := range NFTRarities {
+			p.table.Tiers = append(p.table.Tiers, gacha.Tier{Name: string(rarity), Weight: p.Rates[rarity]})
+		}
+		for _, rule := range p.Pity {
+			if len(catalog.byRarity[rule.Rarity]) == 0 {
+				return irr.Error("nft pool %d has no template of pity rarity %q", p.ID, rule.Rarity)
+			}
+			p.table.Pity = append(p.table.Pity, gacha.PityRule{Tier: string(rule.Rarity), After: rule.After})
+		}
+		if err := p.table.Validate(); err != nil {
+			return irr.Wrap(err, "nft pool %d", p.ID)
+		}
+	}
+	sort.Slice(catalog.Pools, func(i, j int) bool { return catalog.Pools[i].ID < catalog.Pools[j].ID })
+
+	if err := catalog.validateShops(templateIDs); err != nil {
+		return err
+	}
+
+	nftCatalog.Store(catalog)
+	return nil
+}
+
+// NFTPools 所有的卡池，按 id 排序。返回的定义不应该被修改
+func NFTPools() []*NFTPool {
+	return nftCatalog.Load().Pools
+}
+
+// NFTTemplates 所有的模板，按 id 排序。返回的定义不应该被修改
+func NFTTemplates() []*NFTTemplate {
+	return nftCatalog.Load().Templates
+}
+
+// GetNFTPool 获取卡池，不存在时返回 ErrNFTPoolNotFound
+func GetNFTPool(id utils.UInt64) (*NFTPool, error) {
+	return nftCatalog.Load().pool(id)
+}
+
+// GetNFTTemplate 获取模板，不存在时返回 ErrNFTTemplateNotFound
+func GetNFTTemplate(id utils.UInt64) (*NFTTemplate, error) {
+	for _, t := range NFTTemplates() {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return nil, irr.Wrap(ErrNFTTemplateNotFound, "template %d", id)
+}
+
+func (c *NFTCatalog) pool(id utils.UInt64) (*NFTPool, error) {
+	for _, p := range c.Pools {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return nil, irr.Wrap(ErrNFTPoolNotFound, "pool %d", id)
+}
+
+// GetUserNFTs 获取用户持有的 NFT，最新的在前
+func GetUserNFTs(ctx context.Context, tx *gorm.DB, ownerID utils.UInt64, offset, limit int) ([]*NFT, int64, error) {
+	query := tx.WithContext(ctx).Model(&NFT{}).Where("owner_id = ?", ownerID)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count nfts of user %d failed", ownerID)
+	}
+	var nfts []*NFT
+	if err := query.Order("created_at DESC, id DESC").Offset(offset).Limit(limit).Find(&nfts).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get nfts of user %d failed", ownerID)
+	}
+	return nfts, total, nil
+}
+
+// FindUserNFT 获取用户持有的 NFT，不存在或不属于用户时返回 gorm.ErrRecordNotFound
+func FindUserNFT(ctx context.Context, tx *gorm.DB, ownerID, id utils.UInt64) (*NFT, error) {
+	nft := &NFT{}
+	if err := tx.WithContext(ctx).Where("id = ? AND owner_id = ?", id, ownerID).First(nft).Error; err != nil {
+		return nil, err
+	}
+	return nft, nil
+}
+
+// SetChainAdapter 设置把 NFT 同步到链上的 adapter，adapter 为 nil 时只保存在链下。db 用于记录链上的 token id
+func SetChainAdapter(db *gorm.DB, adapter ChainAdapter) {
+	if adapter == nil {
+		nftChain.Store(nil)
+		return
+	}
+	nftChain.Store(&chainSync{db: db, adapter: adapter})
+}
+
+// mintOnChain 在链上铸造新的 NFT，已经有 token id 的 NFT 不重复铸造
+func mintOnChain(ctx context.Context, e NFTMinted) error {
+	chain := nftChain.Load()
+	if chain == nil {
+		return nil
+	}
+	nft := &NFT{}
+	if err := chain.db.WithContext(ctx).Where("id = ?", e.NFTID).First(nft).Error; err != nil {
+		return irr.Wrap(err, "get nft %d failed", e.NFTID)
+	}
+	if nft.ChainTokenID != "" {
+		return nil
+	}
+	tokenID, err := chain.adapter.Mint(ctx, nft)
+	if err != nil {
+		return irr.Wrap(err, "mint nft %d on chain failed", e.NFTID)
+	}
+	if err = chain.db.WithContext(ctx).Model(&NFT{}).Where("id = ? AND chain_token_id = ''", e.NFTID).
+		Update("chain_token_id", tokenID).Error; err != nil {
+		return irr.Wrap(err, "save chain token of nft %d failed", e.NFTID)
+	}
+	wlog.ByCtx(ctx, "mintOnChain").Infof("nft %d minted on chain, token= %s", e.NFTID, tokenID)
+	return nil
+}
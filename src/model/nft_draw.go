@@ -0,0 +1,395 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/pkg/gacha"
+)
+
+type (
+	// NFTDrawSeed 用户抽卡使用的服务端种子。使用中的种子只公开哈希，更换后公开种子本身，用于校验之前的抽卡 (见 pkg/gacha)
+	NFTDrawSeed struct {
+		ID             utils.UInt64  `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		UserID         utils.UInt64  `gorm:"not null;index:idx_nft_seed_user" json:"user_id"`
+		ActiveUserID   *utils.UInt64 `gorm:"uniqueIndex:idx_nft_seed_active" json:"-"` // 使用中时等于 UserID，保证每个用户只有一个使用中的种子
+		ServerSeed     string        `gorm:"size:64;not null" json:"-"`
+		ServerSeedHash string        `gorm:"size:64;not null" json:"server_seed_hash"`
+		Nonce          uint64        `gorm:"not null;default:0" json:"nonce"` // 最后一次抽卡使用的 nonce
+		RevealedAt     *time.Time    `json:"revealed_at,omitempty"`
+		CreatedAt      time.Time     `json:"created_at"`
+	}
+
+	// NFTPityCounter 用户在卡池中距离上一次抽到 Rarity 或更高稀有度的次数
+	NFTPityCounter struct {
+		UserID utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		PoolID utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		Rarity NFTRarity    `gorm:"primaryKey;size:16"`
+		Count  uint32       `gorm:"not null;default:0"`
+	}
+
+	// NFTDraw 一次抽卡的记录，由种子、ClientSeed 和 Nonce 可以复算出 Rarity 和 TemplateID
+	NFTDraw struct {
+		ID         utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		UserID     utils.UInt64 `gorm:"not null;index:idx_nft_draw_user,priority:1" json:"user_id"`
+		PoolID     utils.UInt64 `gorm:"not null" json:"pool_id"`
+		SeedID     utils.UInt64 `gorm:"not null" json:"seed_id"`
+		ClientSeed string       `gorm:"size:64;not null;default:''" json:"client_seed"`
+		Nonce      uint64       `gorm:"not null" json:"nonce"`
+		Rarity     NFTRarity    `gorm:"size:16;not null" json:"rarity"`
+		Pity       bool         `gorm:"not null;default:false" json:"pity"` // 稀有度由保底决定
+		TemplateID utils.UInt64 `gorm:"not null" json:"template_id"`
+		NFTID      utils.UInt64 `gorm:"not null" json:"nft_id"`
+		PaymentID  utils.UInt64 `gorm:"not null;index:idx_nft_draw_payment" json:"payment_id"` // 支付抽卡的积分流水
+		CreatedAt  time.Time    `gorm:"index:idx_nft_draw_user,priority:2" json:"created_at"`
+	}
+
+	// NFTDrawRequest 一次抽卡请求，一次请求可以连续抽 Count 次，IdempotencyKey 相同的请求只生效一次
+	NFTDrawRequest struct {
+		UserID         utils.UInt64
+		PoolID         utils.UInt64
+		Count          uint32
+		ClientSeed     string
+		UseTicket      bool // 用抽卡券代替积分支付，卡池需要支持抽卡券
+		IdempotencyKey string
+	}
+)
+
+const (
+	// MaxDrawCount 一次请求最多抽卡的次数
+	MaxDrawCount = 10
+	// MaxClientSeedLen 客户端种子的最大长度
+	MaxClientSeedLen = 64
+
+	PointReasonNFTDraw PointReason = "nft.draw"
+)
+
+var (
+	ErrInvalidDrawCount  = irr.Error("invalid draw count")
+	ErrInvalidDrawSeed   = irr.Error("invalid client seed")
+	ErrTicketNotAccepted = irr.Error("the pool does not accept draw tickets")
+)
+
+func (NFTDrawSeed) TableName() string {
+	return "nft_draw_seeds"
+}
+
+func (NFTPityCounter) TableName() string {
+	return "nft_pity_counters"
+}
+
+func (NFTDraw) TableName() string {
+	return "nft_draws"
+}
+
+// lockActiveDrawSeed 锁定用户使用中的种子，没有时创建一个。同一个用户的抽卡因此是串行的，nonce 不会重复
+func lockActiveDrawSeed(ctx context.Context, tx *gorm.DB, userID utils.UInt64) (*NFTDrawSeed, error) {
+	if err := ensureActiveDrawSeed(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+	seed := &NFTDrawSeed{}
+	if err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("active_user_id = ?", userID).First(seed).Error; err != nil {
+		return nil, irr.Wrap(err, "get draw seed of user %d failed", userID)
+	}
+	return seed, nil
+}
+
+// ensureActiveDrawSeed 用户没有使用中的种子时创建一个，并发创建时只有一个生效
+func ensureActiveDrawSeed(ctx context.Context, tx *gorm.DB, userID utils.UInt64) error {
+	var count int64
+	if err := tx.WithContext(ctx).Model(&NFTDrawSeed{}).Where("active_user_id = ?", userID).Count(&count).Error; err != nil {
+		return irr.Wrap(err, "get draw seed of user %d failed", userID)
+	}
+	if count > 0 {
+		return nil
+	}
+	seed, err := newDrawSeed(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err = tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(seed).Error; err != nil {
+		return irr.Wrap(err, "create draw seed of user %d failed", userID)
+	}
+	return nil
+}
+
+func newDrawSeed(ctx context.Context, userID utils.UInt64) (*NFTDrawSeed, error) {
+	id, err := utils.GenIDU64(ctx)
+	if err != nil {
+		return nil, irr.Wrap(err, "generate draw seed id failed")
+	}
+	serverSeed, hash, err := gacha.NewSeed()
+	if err != nil {
+		return nil, irr.Wrap(err, "generate draw seed failed")
+	}
+	return &NFTDrawSeed{
+		ID:             id,
+		UserID:         userID,
+		ActiveUserID:   &userID,
+		ServerSeed:     serverSeed,
+		ServerSeedHash: hash,
+	}, nil
+}
+
+// GetActiveDrawSeed 获取用户使用中的种子，没有时创建一个。调用方只应该公开种子的哈希
+func GetActiveDrawSeed(ctx context.Context, db *gorm.DB, userID utils.UInt64) (*NFTDrawSeed, error) {
+	if err := ensureActiveDrawSeed(ctx, db, userID); err != nil {
+		return nil, err
+	}
+	seed := &NFTDrawSeed{}
+	if err := db.WithContext(ctx).Where("active_user_id = ?", userID).First(seed).Error; err != nil {
+		return nil, irr.Wrap(err, "get draw seed of user %d failed", userID)
+	}
+	return seed, nil
+}
+
+// RotateDrawSeed 公开用户使用中的种子并换成新的种子，返回被公开的种子和新的种子
+func RotateDrawSeed(ctx context.Context, db *gorm.DB, userID utils.UInt64) (revealed, active *NFTDrawSeed, err error) {
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if revealed, err = lockActiveDrawSeed(ctx, tx, userID); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err = tx.Model(revealed).Updates(map[string]any{"active_user_id": nil, "revealed_at": now}).Error; err != nil {
+			return irr.Wrap(err, "reveal draw seed %d failed", revealed.ID)
+		}
+		revealed.ActiveUserID, revealed.RevealedAt = nil, &now
+
+		if active, err = newDrawSeed(ctx, userID); err != nil {
+			return err
+		}
+		if err = tx.Create(active).Error; err != nil {
+			return irr.Wrap(err, "create draw seed of user %d failed", userID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return revealed, active, nil
+}
+
+// GetDrawSeeds 批量获取种子
+func GetDrawSeeds(ctx context.Context, tx *gorm.DB, ids ...utils.UInt64) (map[utils.UInt64]*NFTDrawSeed, error) {
+	var seeds []*NFTDrawSeed
+	if err := tx.WithContext(ctx).Where("id IN ?", ids).Find(&seeds).Error; err != nil {
+		return nil, irr.Wrap(err, "get draw seeds failed")
+	}
+	ret := make(map[utils.UInt64]*NFTDrawSeed, len(seeds))
+	for _, s := range seeds {
+		ret[s.ID] = s
+	}
+	return ret, nil
+}
+
+// DrawNFTs 在卡池中抽卡: 通过积分流水支付 (积分或抽卡券)，按种子生成的随机数和保底计数决定稀有度和模板，创建 NFT 和抽卡记录。
+// 加锁顺序为 种子 -> 积分。IdempotencyKey 已经使用过时不重复抽卡，返回已有的记录和 false
+func DrawNFTs(ctx context.Context, db *gorm.DB, req NFTDrawRequest) ([]*NFTDraw, []*NFT, bool, error) {
+	catalog := nftCatalog.Load()
+	pool, err := catalog.pool(req.PoolID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if req.Count == 0 || req.Count > MaxDrawCount {
+		return nil, nil, false, irr.Wrap(ErrInvalidDrawCount, "count should be in [1, %d]", MaxDrawCount)
+	}
+	if len(req.ClientSeed) > MaxClientSeedLen {
+		return nil, nil, false, irr.Wrap(ErrInvalidDrawSeed, "client seed is longer than %d", MaxClientSeedLen)
+	}
+	currency, price := pool.Currency, pool.Price
+	if req.UseTicket {
+		if !pool.Ticket {
+			return nil, nil, false, irr.Wrap(ErrTicketNotAccepted, "pool %d", pool.ID)
+		}
+		currency, price = CurrencyDrawTicket, 1
+	}
+
+	var (
+		draws   []*NFTDraw
+		nfts    []*NFT
+		applied bool
+	)
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		seed, err := lockActiveDrawSeed(ctx, tx, req.UserID)
+		if err != nil {
+			return err
+		}
+		payment, ok, err := ApplyPointChange(ctx, tx, PointChange{
+			UserID:         req.UserID,
+			Currency:       currency,
+			Delta:          -int64(price) * int64(req.Count),
+			Reason:         PointReasonNFTDraw,
+			RefID:          pool.ID,
+			IdempotencyKey: req.IdempotencyKey,
+		})
+		if err != nil {
+			return err
+		}
+		if applied = ok; !applied {
+			if payment.Reason != PointReasonNFTDraw || payment.RefID != pool.ID {
+				return irr.Wrap(ErrIdempotencyConflict, "key %q is used by %s %d", req.IdempotencyKey, payment.Reason, payment.RefID)
+			}
+			if draws, nfts, err = getDrawsByPayment(ctx, tx, req.UserID, payment.ID); err != nil {
+				return err
+			}
+			if len(draws) != int(req.Count) {
+				return irr.Wrap(ErrIdempotencyConflict, "key %q is used by a draw of %d, got %d", req.IdempotencyKey, len(draws), req.Count)
+			}
+			return nil
+		}
+
+		counters, err := getPityCounters(ctx, tx, req.UserID, pool.ID)
+		if err != nil {
+			return err
+		}
+		ids, err := utils.MGenIDU64(ctx, 2*int(req.Count))
+		if err != nil {
+			return irr.Wrap(err, "generate nft ids failed")
+		}
+		if len(ids) != 2*int(req.Count) {
+			return irr.Error("generate nft ids failed, want %d, got %d", 2*req.Count, len(ids))
+		}
+
+		minted := make([]eventbus.Event, 0, req.Count)
+		for i := 0; i < int(req.Count); i++ {
+			seed.Nonce++
+			r := gacha.NewRand(seed.ServerSeed, req.ClientSeed, seed.Nonce)
+			result := pool.table.Draw(r, counters)
+			candidates := catalog.byRarity[NFTRarity(result.Tier)]
+			template := candidates[r.Pick(len(candidates))]
+
+			nft := &NFT{
+				ID:         ids[2*i],
+				OwnerID:    req.UserID,
+				TemplateID: template.ID,
+				Rarity:     template.Rarity,
+				Source:     NFTSourceDraw,
+			}
+			nfts = append(nfts, nft)
+			draws = append(draws, &NFTDraw{
+				ID:         ids[2*i+1],
+				UserID:     req.UserID,
+				PoolID:     pool.ID,
+				SeedID:     seed.ID,
+				ClientSeed: req.ClientSeed,
+				Nonce:      seed.Nonce,
+				Rarity:     template.Rarity,
+				Pity:       result.Pity,
+				TemplateID: template.ID,
+				NFTID:      nft.ID,
+				PaymentID:  payment.ID,
+			})
+			minted = append(minted, NFTMinted{OwnerID: req.UserID, NFTID: nft.ID, TemplateID: template.ID, Rarity: template.Rarity, Source: NFTSourceDraw})
+		}
+
+		if err = tx.Create(&nfts).Error; err != nil {
+			return irr.Wrap(err, "create nfts failed")
+		}
+		if err = tx.Create(&draws).Error; err != nil {
+			return irr.Wrap(err, "create nft draws failed")
+		}
+		if err = tx.Model(seed).Update("nonce", seed.Nonce).Error; err != nil {
+			return irr.Wrap(err, "update nonce of draw seed %d failed", seed.ID)
+		}
+		if err = savePityCounters(ctx, tx, req.UserID, pool.ID, counters); err != nil {
+			return err
+		}
+		return PublishEvents(ctx, tx, minted...)
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return draws, nfts, applied, nil
+}
+
+func getPityCounters(ctx context.Context, tx *gorm.DB, userID, poolID utils.UInt64) (map[string]uint32, error) {
+	var rows []*NFTPityCounter
+	if err := tx.WithContext(ctx).Where("user_id = ? AND pool_id = ?", userID, poolID).Find(&rows).Error; err != nil {
+		return nil, irr.Wrap(err, "get pity counters of user %d in pool %d failed", userID, poolID)
+	}
+	counters := make(map[string]uint32, len(rows))
+	for _, row := range rows {
+		counters[string(row.Rarity)] = row.Count
+	}
+	return counters, nil
+}
+
+func savePityCounters(ctx context.Context, tx *gorm.DB, userID, poolID utils.UInt64, counters map[string]uint32) error {
+	rows := make([]*NFTPityCounter, 0, len(counters))
+	for rarity, count := range counters {
+		rows = append(rows, &NFTPityCounter{UserID: userID, PoolID: poolID, Rarity: NFTRarity(rarity), Count: count})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "pool_id"}, {Name: "rarity"}},
+		DoUpdates: clause.AssignmentColumns([]string{"count"}),
+	}).Create(&rows).Error; err != nil {
+		return irr.Wrap(err, "save pity counters of user %d in pool %d failed", userID, poolID)
+	}
+	return nil
+}
+
+// GetPityCounters 获取用户在卡池中的保底计数，稀有度 -> 距离上一次抽到它或更高稀有度的次数
+func GetPityCounters(ctx context.Context, tx *gorm.DB, userID, poolID utils.UInt64) (map[NFTRarity]uint32, error) {
+	counters, err := getPityCounters(ctx, tx, userID, poolID)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[NFTRarity]uint32, len(counters))
+	for rarity, count := range counters {
+		ret[NFTRarity(rarity)] = count
+	}
+	return ret, nil
+}
+
+// getDrawsByPayment 获取一次支付对应的抽卡记录和 NFT，用于幂等的重放
+func getDrawsByPayment(ctx context.Context, tx *gorm.DB, userID, paymentID utils.UInt64) ([]*NFTDraw, []*NFT, error) {
+	var draws []*NFTDraw
+	if err := tx.WithContext(ctx).Where("user_id = ? AND payment_id = ?", userID, paymentID).
+		Order("nonce ASC").Find(&draws).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "get draws of payment %d failed", paymentID)
+	}
+	nftIDs := make([]utils.UInt64, 0, len(draws))
+	for _, d := range draws {
+		nftIDs = append(nftIDs, d.NFTID)
+	}
+	var nfts []*NFT
+	if err := tx.WithContext(ctx).Where("id IN ?", nftIDs).Find(&nfts).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "get nfts of payment %d failed", paymentID)
+	}
+	byID := make(map[utils.UInt64]*NFT, len(nfts))
+	for _, n := range nfts {
+		byID[n.ID] = n
+	}
+	ordered := make([]*NFT, 0, len(draws))
+	for _, d := range draws {
+		if n, ok := byID[d.NFTID]; ok {
+			ordered = append(ordered, n)
+		}
+	}
+	return draws, ordered, nil
+}
+
+// GetNFTDraws 获取用户的抽卡记录，最新的在前
+func GetNFTDraws(ctx context.Context, tx *gorm.DB, userID utils.UInt64, offset, limit int) ([]*NFTDraw, int64, error) {
+	query := tx.WithContext(ctx).Model(&NFTDraw{}).Where("user_id = ?", userID)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count draws of user %d failed", userID)
+	}
+	var draws []*NFTDraw
+	if err := query.Order("created_at DESC, nonce DESC").Offset(offset).Limit(limit).Find(&draws).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get draws of user %d failed", userID)
+	}
+	return draws, total, nil
+}
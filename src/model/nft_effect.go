@@ -0,0 +1,190 @@
+package model
+
+import (
+	"context"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"github.com/bagaking/goulp/jsonex"
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khgame/memstore/cachekey"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/internal/utils/cache"
+)
+
+// NFTModifiers 用户装备中的 NFT 的特效合并后的结果，作答和创建复习计划时使用
+type NFTModifiers struct {
+	BonusPercent     uint64         `json:"bonus_percent"`      // 作答获得的 cash 增加的百分比，不超过 MaxBonusPercent
+	ExtraDrawPercent uint64         `json:"extra_draw_percent"` // 每次作答获得一张抽卡券的概率，不超过 100
+	Unlocks          []string       `json:"unlocks"`            // 解锁的复习计划类型，见 def.DungeonType
+	NFTIDs           []utils.UInt64 `json:"nft_ids"`            // 装备中的 NFT
+}
+
+const (
+	// MaxEquippedNFTs 每个用户最多同时装备的 NFT 数量
+	MaxEquippedNFTs = 3
+	// MaxBonusPercent 叠加后 bonus_points 的上限
+	MaxBonusPercent = 100
+
+	PointReasonNFTExtraDraw PointReason = "nft.extra_draw"
+)
+
+var ErrNFTEquipSlotsFull = irr.Error("equip slots are full")
+
+// CKNFTModifiers 用户的 NFTModifiers，装备变化后主动淘汰
+var CKNFTModifiers = cachekey.MustNewSchema[utils.UInt64]("user:{user_id}:nft_modifiers", 5*time.Minute)
+
+// Bonus cash 在 BonusPercent 下增加的部分，向下取整
+func (m *NFTModifiers) Bonus(cash uint64) uint64 {
+	return cash * m.BonusPercent / 100
+}
+
+// RollExtraDraw 按 ExtraDrawPercent 的概率决定是否获得一张抽卡券
+func (m *NFTModifiers) RollExtraDraw() bool {
+	return m.ExtraDrawPercent > 0 && rand.Uint64N(100) < m.ExtraDrawPercent
+}
+
+// Unlocked 是否解锁了 target 类型的复习计划
+func (m *NFTModifiers) Unlocked(target string) bool {
+	for _, u := range m.Unlocks {
+		if u == target {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveNFTModifiers 合并 NFT 的特效，模板已经下线的 NFT 不生效
+func resolveNFTModifiers(nfts []*NFT) *NFTModifiers {
+	m := &NFTModifiers{Unlocks: make([]string, 0), NFTIDs: make([]utils.UInt64, 0, len(nfts))}
+	for _, nft := range nfts {
+		m.NFTIDs = append(m.NFTIDs, nft.ID)
+		template, err := GetNFTTemplate(nft.TemplateID)
+		if err != nil {
+			continue
+		}
+		switch template.Effect.Type {
+		case NFTEffectBonusPoints:
+			m.BonusPercent += template.Effect.Value
+		case NFTEffectExtraDraw:
+			m.ExtraDrawPercent += template.Effect.Value
+		case NFTEffectUnlockDungeon:
+			if !m.Unlocked(template.Effect.Target) {
+				m.Unlocks = append(m.Unlocks, template.Effect.Target)
+			}
+		}
+	}
+	m.BonusPercent = min(m.BonusPercent, MaxBonusPercent)
+	m.ExtraDrawPercent = min(m.ExtraDrawPercent, 100)
+	sort.Strings(m.Unlocks)
+	return m
+}
+
+// GetNFTModifiers 获取用户装备中的 NFT 合并后的特效，优先读取缓存
+func GetNFTModifiers(ctx context.Context, tx *gorm.DB, userID utils.UInt64) (*NFTModifiers, error) {
+	log := wlog.ByCtx(ctx, "GetNFTModifiers").WithField("user_id", userID)
+	cacheKey := CKNFTModifiers.MustBuild(userID)
+	if data, err := cache.Client().Get(ctx, cacheKey).Result(); err == nil {
+		m := &NFTModifiers{}
+		if err = jsonex.Unmarshal([]byte(data), m); err == nil {
+			return m, nil
+		}
+		log.WithError(err).Warnf("decode cached nft modifiers failed")
+	} else {
+		log.WithError(err).Warnf("read cache for nft modifiers failed")
+	}
+
+	nfts, err := getEquippedNFTs(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	m := resolveNFTModifiers(nfts)
+	data, err := jsonex.Marshal(m)
+	if err != nil {
+		return nil, irr.Wrap(err, "encode nft modifiers failed")
+	}
+	if err = cache.Client().Set(ctx, cacheKey, string(data), CKNFTModifiers.GetExp()).Err(); err != nil {
+		log.WithError(err).Warnf("set cache for nft modifiers failed")
+	}
+	return m, nil
+}
+
+// invalidateNFTModifiers 在装备变化的事务提交后调用
+func invalidateNFTModifiers(ctx context.Context, userIDs ...utils.UInt64) {
+	for _, userID := range userIDs {
+		if err := cache.Client().Del(ctx, CKNFTModifiers.MustBuild(userID)).Err(); err != nil {
+			wlog.ByCtx(ctx, "invalidateNFTModifiers").WithField("user_id", userID).WithError(err).Warnf("delete cached nft modifiers failed")
+		}
+	}
+}
+
+// getEquippedNFTs 获取用户装备中的 NFT，先装备的在前
+func getEquippedNFTs(ctx context.Context, tx *gorm.DB, userID utils.UInt64) ([]*NFT, error) {
+	var nfts []*NFT
+	if err := tx.WithContext(ctx).Where("owner_id = ? AND equipped_at IS NOT NULL", userID).
+		Order("equipped_at, id").Find(&nfts).Error; err != nil {
+		return nil, irr.Wrap(err, "get equipped nfts of user %d failed", userID)
+	}
+	return nfts, nil
+}
+
+// EquipNFT 装备用户持有的 NFT，已经装备时不做修改。装备数量达到 MaxEquippedNFTs 时返回 ErrNFTEquipSlotsFull，
+// NFT 不存在或不属于用户时返回 gorm.ErrRecordNotFound
+func EquipNFT(ctx context.Context, db *gorm.DB, userID, id utils.UInt64) (*NFT, error) {
+	nft := &NFT{}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// 锁住用户所有的 NFT，并发装备时装备数量不会超过上限
+		var owned []*NFT
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("owner_id = ?", userID).Find(&owned).Error; err != nil {
+			return irr.Wrap(err, "lock nfts of user %d failed", userID)
+		}
+		equipped := 0
+		for _, n := range owned {
+			if n.ID == id {
+				nft = n
+			}
+			if n.EquippedAt != nil {
+				equipped++
+			}
+		}
+		switch {
+		case nft.ID == 0:
+			return gorm.ErrRecordNotFound
+		case nft.EquippedAt != nil:
+			return nil
+		case equipped >= MaxEquippedNFTs:
+			return irr.Wrap(ErrNFTEquipSlotsFull, "user %d has equipped %d nfts", userID, equipped)
+		}
+		now := time.Now()
+		if err := tx.Model(nft).Update("equipped_at", now).Error; err != nil {
+			return irr.Wrap(err, "equip nft %d failed", id)
+		}
+		nft.EquippedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	invalidateNFTModifiers(ctx, userID)
+	return nft, nil
+}
+
+// UnequipNFT 卸下用户装备中的 NFT，没有装备时不做修改。NFT 不存在或不属于用户时返回 gorm.ErrRecordNotFound
+func UnequipNFT(ctx context.Context, db *gorm.DB, userID, id utils.UInt64) (*NFT, error) {
+	nft, err := FindUserNFT(ctx, db, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.WithContext(ctx).Model(&NFT{}).Where("id = ? AND owner_id = ?", id, userID).
+		Update("equipped_at", nil).Error; err != nil {
+		return nil, irr.Wrap(err, "unequip nft %d failed", id)
+	}
+	nft.EquippedAt = nil
+	invalidateNFTModifiers(ctx, userID)
+	return nft, nil
+}
@@ -0,0 +1,299 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+type (
+	// NFTShopPrice 商品从 From 开始的价格，Price 为 0 表示从 From 开始下架
+	NFTShopPrice struct {
+		From  time.Time `yaml:"from" json:"from"`
+		Price uint64    `yaml:"price" json:"price"`
+	}
+
+	// NFTShopItem 商店出售的模板，价格按 Prices 的时间表变化 (第一个 From 之前没有上架)，Stock 为 0 表示不限量
+	NFTShopItem struct {
+		ID         utils.UInt64    `yaml:"id" json:"id"`
+		TemplateID utils.UInt64    `yaml:"template_id" json:"template_id"`
+		Currency   Currency        `yaml:"currency" json:"currency"`
+		Stock      uint64          `yaml:"stock" json:"stock"`
+		Prices     []*NFTShopPrice `yaml:"prices" json:"prices"`
+	}
+
+	// NFTShop 系统经营的商店，每次购买一个 NFT
+	NFTShop struct {
+		ID          utils.UInt64   `yaml:"id" json:"id"`
+		Name        string         `yaml:"name" json:"name"`
+		Description string         `yaml:"description" json:"description"`
+		Items       []*NFTShopItem `yaml:"items" json:"items"`
+	}
+
+	// NFTShopStock 商品已经售出的数量，所有商店的商品 id 不重复
+	NFTShopStock struct {
+		ItemID utils.UInt64 `gorm:"primaryKey;autoIncrement:false"`
+		Sold   uint64       `gorm:"not null;default:0"`
+	}
+
+	// NFTShopOrder 在商店购买的记录
+	NFTShopOrder struct {
+		ID         utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		UserID     utils.UInt64 `gorm:"not null;index:idx_nft_shop_order_user" json:"user_id"`
+		ShopID     utils.UInt64 `gorm:"not null" json:"shop_id"`
+		ItemID     utils.UInt64 `gorm:"not null" json:"item_id"`
+		TemplateID utils.UInt64 `gorm:"not null" json:"template_id"`
+		NFTID      utils.UInt64 `gorm:"not null" json:"nft_id"`
+		Currency   Currency     `gorm:"size:16;not null" json:"currency"`
+		Price      uint64       `gorm:"not null" json:"price"`
+		PaymentID  utils.UInt64 `gorm:"not null;uniqueIndex:idx_nft_shop_order_payment" json:"payment_id"` // 支付的积分流水
+		CreatedAt  time.Time    `json:"created_at"`
+	}
+)
+
+const PointReasonNFTShopBuy PointReason = "nft.shop.buy"
+
+var (
+	ErrNFTShopNotFound     = irr.Error("nft shop not found")
+	ErrNFTShopItemNotFound = irr.Error("nft shop item not found")
+	ErrNFTShopItemOffSale  = irr.Error("nft shop item is not on sale")
+	ErrNFTShopSoldOut      = irr.Error("nft shop item is sold out")
+)
+
+func (NFTShopStock) TableName() string {
+	return "nft_shop_stocks"
+}
+
+func (NFTShopOrder) TableName() string {
+	return "nft_shop_orders"
+}
+
+// PriceAt 商品在 now 的价格，没有上架时返回 false
+func (i *NFTShopItem) PriceAt(now time.Time) (uint64, bool) {
+	var price uint64
+	for _, p := range i.Prices {
+		if p.From.After(now) {
+			break
+		}
+		price = p.Price
+	}
+	return price, price > 0
+}
+
+// validateShops 校验商店的定义，templateIDs 是所有模板的 id
+func (c *NFTCatalog) validateShops(templateIDs map[utils.UInt64]bool) error {
+	shopIDs := make(map[utils.UInt64]bool, len(c.Shops))
+	itemIDs := make(map[utils.UInt64]bool)
+	for _, s := range c.Shops {
+		if s.ID == 0 || shopIDs[s.ID] {
+			return irr.Error("nft shop id %d is missing or duplicated", s.ID)
+		}
+		shopIDs[s.ID] = true
+		for _, item := range s.Items {
+			switch {
+			case item.ID == 0 || itemIDs[item.ID]:
+				return irr.Error("nft shop item id %d is missing or duplicated", item.ID)
+			case !templateIDs[item.TemplateID]:
+				return irr.Error("nft shop item %d has unknown template %d", item.ID, item.TemplateID)
+			case item.Currency != CurrencyCash && item.Currency != CurrencyGem:
+				return irr.Error("nft shop item %d should be paid with cash or gem, got %q", item.ID, item.Currency)
+			case len(item.Prices) == 0:
+				return irr.Error("nft shop item %d should have a price schedule", item.ID)
+			}
+			itemIDs[item.ID] = true
+			sort.SliceStable(item.Prices, func(i, j int) bool { return item.Prices[i].From.Before(item.Prices[j].From) })
+			for i := 1; i < len(item.Prices); i++ {
+				if item.Prices[i].From.Equal(item.Prices[i-1].From) {
+					return irr.Error("nft shop item %d has duplicated price at %s", item.ID, item.Prices[i].From)
+				}
+			}
+		}
+	}
+	sort.Slice(c.Shops, func(i, j int) bool { return c.Shops[i].ID < c.Shops[j].ID })
+	return nil
+}
+
+// NFTShops 所有的商店，按 id 排序。返回的定义不应该被修改
+func NFTShops() []*NFTShop {
+	return nftCatalog.Load().Shops
+}
+
+// GetNFTShop 获取商店，不存在时返回 ErrNFTShopNotFound
+func GetNFTShop(id utils.UInt64) (*NFTShop, error) {
+	for _, s := range NFTShops() {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return nil, irr.Wrap(ErrNFTShopNotFound, "shop %d", id)
+}
+
+func (s *NFTShop) item(id utils.UInt64) (*NFTShopItem, error) {
+	for _, item := range s.Items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return nil, irr.Wrap(ErrNFTShopItemNotFound, "item %d in shop %d", id, s.ID)
+}
+
+// GetNFTShopSold 获取商店中各商品已经售出的数量
+func GetNFTShopSold(ctx context.Context, tx *gorm.DB, shop *NFTShop) (map[utils.UInt64]uint64, error) {
+	itemIDs := make([]utils.UInt64, 0, len(shop.Items))
+	for _, item := range shop.Items {
+		itemIDs = append(itemIDs, item.ID)
+	}
+	var stocks []*NFTShopStock
+	if err := tx.WithContext(ctx).Where("item_id IN ?", itemIDs).Find(&stocks).Error; err != nil {
+		return nil, irr.Wrap(err, "get stocks of shop %d failed", shop.ID)
+	}
+	sold := make(map[utils.UInt64]uint64, len(stocks))
+	for _, s := range stocks {
+		sold[s.ItemID] = s.Sold
+	}
+	return sold, nil
+}
+
+// sellNFTShopItem 售出一个商品，限量的商品售罄时返回 ErrNFTShopSoldOut。条件更新保证并发购买时不会超卖
+func sellNFTShopItem(ctx context.Context, tx *gorm.DB, item *NFTShopItem) error {
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&NFTShopStock{ItemID: item.ID}).Error; err != nil {
+		return irr.Wrap(err, "create stock of item %d failed", item.ID)
+	}
+	update := tx.WithContext(ctx).Model(&NFTShopStock{}).Where("item_id = ?", item.ID)
+	if item.Stock > 0 {
+		update = update.Where("sold < ?", item.Stock)
+	}
+	result := update.Update("sold", gorm.Expr("sold + ?", 1))
+	if result.Error != nil {
+		return irr.Wrap(result.Error, "update stock of item %d failed", item.ID)
+	}
+	if result.RowsAffected == 0 {
+		return irr.Wrap(ErrNFTShopSoldOut, "item %d, stock %d", item.ID, item.Stock)
+	}
+	return nil
+}
+
+// findNFTShopOrder 查找 idempotencyKey 对应的购买记录，key 没有使用过时返回 nil；
+// key 被其他的积分流水或其他商品的购买使用时返回 ErrIdempotencyConflict
+func findNFTShopOrder(ctx context.Context, tx *gorm.DB, userID, shopID, itemID utils.UInt64, idempotencyKey string) (*NFTShopOrder, *NFT, error) {
+	payment := &PointTransaction{}
+	result := tx.WithContext(ctx).Where("idempotency_key = ?", idempotencyKey).Limit(1).Find(payment)
+	if result.Error != nil {
+		return nil, nil, irr.Wrap(result.Error, "get point transaction %q failed", idempotencyKey)
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil, nil
+	}
+	order := &NFTShopOrder{}
+	if err := tx.WithContext(ctx).Where("user_id = ? AND payment_id = ?", userID, payment.ID).First(order).Error; err != nil {
+		return nil, nil, irr.Wrap(ErrIdempotencyConflict, "key %q is not used by a shop order", idempotencyKey)
+	}
+	if order.ShopID != shopID || order.ItemID != itemID {
+		return nil, nil, irr.Wrap(ErrIdempotencyConflict, "key %q is used by item %d of shop %d", idempotencyKey, order.ItemID, order.ShopID)
+	}
+	nft := &NFT{}
+	if err := tx.WithContext(ctx).Where("id = ?", order.NFTID).First(nft).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "get nft %d of shop order failed", order.NFTID)
+	}
+	return order, nft, nil
+}
+
+// BuyFromNFTShop 按 now 的价格在商店购买一个商品: 通过积分流水支付、扣减库存、创建 NFT 和购买记录并发布 NFTMinted，
+// 加锁顺序为 积分 -> 库存。idempotencyKey 已经用于购买同一个商品时不重复购买，返回已有的记录和 false，
+// 即使商品之后改价或下架
+func BuyFromNFTShop(ctx context.Context, db *gorm.DB, userID, shopID, itemID utils.UInt64, now time.Time, idempotencyKey string) (*NFTShopOrder, *NFT, bool, error) {
+	if order, nft, err := findNFTShopOrder(ctx, db, userID, shopID, itemID, idempotencyKey); err != nil || order != nil {
+		return order, nft, false, err
+	}
+
+	shop, err := GetNFTShop(shopID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	item, err := shop.item(itemID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	price, ok := item.PriceAt(now)
+	if !ok {
+		return nil, nil, false, irr.Wrap(ErrNFTShopItemOffSale, "item %d at %s", itemID, now)
+	}
+	template, err := GetNFTTemplate(item.TemplateID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	var (
+		order   = &NFTShopOrder{}
+		nft     = &NFT{}
+		applied bool
+	)
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		payment, ok, err := ApplyPointChange(ctx, tx, PointChange{
+			UserID:         userID,
+			Currency:       item.Currency,
+			Delta:          -int64(price),
+			Reason:         PointReasonNFTShopBuy,
+			RefID:          item.ID,
+			IdempotencyKey: idempotencyKey,
+		})
+		if err != nil {
+			return err
+		}
+		if applied = ok; !applied {
+			// 并发的重复请求已经完成了购买
+			order, nft, err = findNFTShopOrder(ctx, tx, userID, shopID, itemID, payment.IdempotencyKey)
+			if err == nil && order == nil {
+				err = irr.Error("point transaction %d is not found", payment.ID)
+			}
+			return err
+		}
+
+		if err = sellNFTShopItem(ctx, tx, item); err != nil {
+			return err
+		}
+		ids, err := utils.MGenIDU64(ctx, 2)
+		if err != nil {
+			return irr.Wrap(err, "generate nft ids failed")
+		}
+		if len(ids) != 2 {
+			return irr.Error("generate nft ids failed, want 2, got %d", len(ids))
+		}
+		nft = &NFT{
+			ID:         ids[0],
+			OwnerID:    userID,
+			TemplateID: template.ID,
+			Rarity:     template.Rarity,
+			Source:     NFTSourceShop,
+		}
+		order = &NFTShopOrder{
+			ID:         ids[1],
+			UserID:     userID,
+			ShopID:     shop.ID,
+			ItemID:     item.ID,
+			TemplateID: template.ID,
+			NFTID:      nft.ID,
+			Currency:   item.Currency,
+			Price:      price,
+			PaymentID:  payment.ID,
+		}
+		if err = tx.Create(nft).Error; err != nil {
+			return irr.Wrap(err, "create nft failed")
+		}
+		if err = tx.Create(order).Error; err != nil {
+			return irr.Wrap(err, "create shop order failed")
+		}
+		return PublishEvents(ctx, tx, NFTMinted{OwnerID: userID, NFTID: nft.ID, TemplateID: template.ID, Rarity: template.Rarity, Source: NFTSourceShop})
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return order, nft, applied, nil
+}
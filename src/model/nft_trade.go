@@ -0,0 +1,348 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+type (
+	// NFTTradeStatus 挂单的状态，只能从 open 变为 sold 或 cancelled
+	NFTTradeStatus string
+
+	// NFTTransferReason NFT 所有权变化的原因
+	NFTTransferReason string
+
+	// NFTTrade 用户之间的挂单。挂单时 NFT 交给市场托管，成交时在同一个事务中完成支付和所有权的转移，撤单时归还。
+	// 挂单和 NFT 都通过 Version 乐观锁修改，并发的购买和撤单只有一个生效
+	NFTTrade struct {
+		ID         utils.UInt64   `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		SellerID   utils.UInt64   `gorm:"not null;index:idx_nft_trade_seller" json:"seller_id"`
+		BuyerID    utils.UInt64   `gorm:"not null;default:0" json:"buyer_id,omitempty"`
+		NFTID      utils.UInt64   `gorm:"not null;index:idx_nft_trade_nft" json:"nft_id"`
+		TemplateID utils.UInt64   `gorm:"not null" json:"template_id"`
+		Rarity     NFTRarity      `gorm:"size:16;not null" json:"rarity"`
+		Currency   Currency       `gorm:"size:16;not null" json:"currency"`
+		Price      uint64         `gorm:"not null" json:"price"`
+		Status     NFTTradeStatus `gorm:"size:16;not null;index:idx_nft_trade_status,priority:1" json:"status"`
+		Version    uint64         `gorm:"not null;default:0" json:"-"`
+		ClosedAt   *time.Time     `json:"closed_at,omitempty"` // 成交或撤单的时间
+		CreatedAt  time.Time      `gorm:"index:idx_nft_trade_status,priority:2" json:"created_at"`
+		UpdatedAt  time.Time      `json:"updated_at"`
+	}
+
+	// NFTTradeQuery 查询挂单的条件，零值的条件不生效
+	NFTTradeQuery struct {
+		Status     NFTTradeStatus
+		SellerID   utils.UInt64
+		TemplateID utils.UInt64
+		Rarity     NFTRarity
+	}
+)
+
+const (
+	NFTTradeOpen      NFTTradeStatus = "open"
+	NFTTradeSold      NFTTradeStatus = "sold"
+	NFTTradeCancelled NFTTradeStatus = "cancelled"
+
+	NFTTransferGift   NFTTransferReason = "gift"
+	NFTTransferList   NFTTransferReason = "trade.list"
+	NFTTransferCancel NFTTransferReason = "trade.cancel"
+	NFTTransferSold   NFTTransferReason = "trade.sold"
+
+	// MaxNFTTradePrice 挂单价格的上限
+	MaxNFTTradePrice = 1_000_000
+
+	PointReasonNFTTradeBuy  PointReason = "nft.trade.buy"
+	PointReasonNFTTradeSell PointReason = "nft.trade.sell"
+)
+
+var (
+	ErrInvalidTradePrice = irr.Error("invalid trade price")
+	ErrTradeNotOpen      = irr.Error("trade is not open")
+	ErrTradeOwnListing   = irr.Error("cannot buy own listing")
+	// ErrTradeConflict 挂单在读取之后被并发的购买或撤单修改了
+	ErrTradeConflict      = irr.Error("trade is changed concurrently")
+	ErrInvalidRecipient   = irr.Error("invalid recipient")
+	ErrRecipientNotFound  = irr.Error("recipient not found")
+	ErrInvalidTradeStatus = irr.Error("invalid trade status")
+)
+
+func (NFTTrade) TableName() string {
+	return "nft_trades"
+}
+
+// Valid 是否是支持的状态
+func (s NFTTradeStatus) Valid() bool {
+	return s == NFTTradeOpen || s == NFTTradeSold || s == NFTTradeCancelled
+}
+
+// moveNFT 把事务中读取到的 nft 转移给 to 并卸下，同时发布 NFTTransferred。
+// 读取之后所有权被并发修改 (Version 变化) 时返回 ErrNFTConflict
+func moveNFT(ctx context.Context, tx *gorm.DB, nft *NFT, to utils.UInt64, reason NFTTransferReason, refID utils.UInt64) error {
+	from := nft.OwnerID
+	result := tx.WithContext(ctx).Model(&NFT{}).Where("id = ? AND owner_id = ? AND version = ?", nft.ID, from, nft.Version).
+		Updates(map[string]any{"owner_id": to, "equipped_at": nil, "version": nft.Version + 1})
+	if result.Error != nil {
+		return irr.Wrap(result.Error, "move nft %d from %d to %d failed", nft.ID, from, to)
+	}
+	if result.RowsAffected == 0 {
+		return irr.Wrap(ErrNFTConflict, "nft %d", nft.ID)
+	}
+	nft.OwnerID, nft.EquippedAt, nft.Version = to, nil, nft.Version+1
+	return PublishEvents(ctx, tx, NFTTransferred{
+		NFTID:      nft.ID,
+		TemplateID: nft.TemplateID,
+		FromID:     from,
+		ToID:       to,
+		Reason:     reason,
+		RefID:      refID,
+	})
+}
+
+// TransferNFT 把用户持有的 NFT 赠予 toID，装备中的 NFT 会被卸下。
+// NFT 不存在或不属于用户时返回 gorm.ErrRecordNotFound，接收者不存在时返回 ErrRecipientNotFound
+func TransferNFT(ctx context.Context, db *gorm.DB, fromID, toID, id utils.UInt64) (*NFT, error) {
+	if toID == NFTEscrowOwner || toID == fromID {
+		return nil, irr.Wrap(ErrInvalidRecipient, "transfer nft %d from %d to %d", id, fromID, toID)
+	}
+	var nft *NFT
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Profile{}).Where("id = ?", toID).Count(&count).Error; err != nil {
+			return irr.Wrap(err, "get profile of user %d failed", toID)
+		}
+		if count == 0 {
+			return irr.Wrap(ErrRecipientNotFound, "user %d", toID)
+		}
+		var err error
+		if nft, err = FindUserNFT(ctx, tx, fromID, id); err != nil {
+			return err
+		}
+		return moveNFT(ctx, tx, nft, toID, NFTTransferGift, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	invalidateNFTModifiers(ctx, fromID)
+	return nft, nil
+}
+
+// CreateNFTTrade 以 price 个 currency (cash 或 gem) 挂单出售用户持有的 NFT，NFT 交给市场托管直到成交或撤单。
+// NFT 不存在或不属于用户时返回 gorm.ErrRecordNotFound
+func CreateNFTTrade(ctx context.Context, db *gorm.DB, sellerID, nftID utils.UInt64, currency Currency, price uint64) (*NFTTrade, error) {
+	if currency != CurrencyCash && currency != CurrencyGem {
+		return nil, irr.Wrap(ErrInvalidCurrency, "trade should be paid with cash or gem, got %q", currency)
+	}
+	if price == 0 || price > MaxNFTTradePrice {
+		return nil, irr.Wrap(ErrInvalidTradePrice, "price should be in [1, %d]", MaxNFTTradePrice)
+	}
+	var trade *NFTTrade
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		nft, err := FindUserNFT(ctx, tx, sellerID, nftID)
+		if err != nil {
+			return err
+		}
+		id, err := utils.GenIDU64(ctx)
+		if err != nil {
+			return irr.Wrap(err, "generate trade id failed")
+		}
+		trade = &NFTTrade{
+			ID:         id,
+			SellerID:   sellerID,
+			NFTID:      nft.ID,
+			TemplateID: nft.TemplateID,
+			Rarity:     nft.Rarity,
+			Currency:   currency,
+			Price:      price,
+			Status:     NFTTradeOpen,
+		}
+		if err = moveNFT(ctx, tx, nft, NFTEscrowOwner, NFTTransferList, trade.ID); err != nil {
+			return err
+		}
+		if err = tx.Create(trade).Error; err != nil {
+			return irr.Wrap(err, "create trade of nft %d failed", nftID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	invalidateNFTModifiers(ctx, sellerID)
+	return trade, nil
+}
+
+// closeNFTTrade 把事务中读取到的挂单从 open 改为 status，读取之后被并发修改时返回 ErrTradeConflict
+func closeNFTTrade(ctx context.Context, tx *gorm.DB, trade *NFTTrade, status NFTTradeStatus, buyerID utils.UInt64) error {
+	now := time.Now()
+	result := tx.WithContext(ctx).Model(&NFTTrade{}).
+		Where("id = ? AND status = ? AND version = ?", trade.ID, NFTTradeOpen, trade.Version).
+		Updates(map[string]any{"status": status, "buyer_id": buyerID, "closed_at": now, "version": trade.Version + 1})
+	if result.Error != nil {
+		return irr.Wrap(result.Error, "close trade %d failed", trade.ID)
+	}
+	if result.RowsAffected == 0 {
+		return irr.Wrap(ErrTradeConflict, "trade %d", trade.ID)
+	}
+	trade.Status, trade.BuyerID, trade.ClosedAt, trade.Version = status, buyerID, &now, trade.Version+1
+	return nil
+}
+
+// getEscrowedNFT 获取挂单托管的 NFT
+func getEscrowedNFT(ctx context.Context, tx *gorm.DB, trade *NFTTrade) (*NFT, error) {
+	nft := &NFT{}
+	if err := tx.WithContext(ctx).Where("id = ? AND owner_id = ?", trade.NFTID, NFTEscrowOwner).First(nft).Error; err != nil {
+		return nil, irr.Wrap(err, "get nft %d escrowed by trade %d failed", trade.NFTID, trade.ID)
+	}
+	return nft, nil
+}
+
+// CancelNFTTrade 撤销用户的挂单并归还 NFT。挂单不存在或不属于用户时返回 gorm.ErrRecordNotFound，
+// 已经成交或撤销时返回 ErrTradeNotOpen
+func CancelNFTTrade(ctx context.Context, db *gorm.DB, sellerID, id utils.UInt64) (*NFTTrade, error) {
+	trade := &NFTTrade{}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND seller_id = ?", id, sellerID).First(trade).Error; err != nil {
+			return err
+		}
+		if trade.Status != NFTTradeOpen {
+			return irr.Wrap(ErrTradeNotOpen, "trade %d is %s", id, trade.Status)
+		}
+		if err := closeNFTTrade(ctx, tx, trade, NFTTradeCancelled, 0); err != nil {
+			return err
+		}
+		nft, err := getEscrowedNFT(ctx, tx, trade)
+		if err != nil {
+			return err
+		}
+		return moveNFT(ctx, tx, nft, sellerID, NFTTransferCancel, trade.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trade, nil
+}
+
+// BuyNFTTrade 购买挂单: 买家支付、卖家收款、挂单成交和 NFT 转移在同一个事务中完成。
+// 挂单不存在时返回 gorm.ErrRecordNotFound，已经成交或撤销时返回 ErrTradeNotOpen，并发的购买中只有一个成功，其余返回 ErrTradeConflict。
+// idempotencyKey 已经使用过时不重复购买，返回已有的挂单、NFT 和 false
+func BuyNFTTrade(ctx context.Context, db *gorm.DB, buyerID, id utils.UInt64, idempotencyKey string) (*NFTTrade, *NFT, bool, error) {
+	var (
+		trade   = &NFTTrade{}
+		nft     *NFT
+		applied bool
+	)
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", id).First(trade).Error; err != nil {
+			return err
+		}
+
+		// 重复的购买不依赖挂单当前的状态
+		existing := &PointTransaction{}
+		err := tx.Where("idempotency_key = ?", idempotencyKey).First(existing).Error
+		if err == nil {
+			if existing.UserID != buyerID || existing.Reason != PointReasonNFTTradeBuy || existing.RefID != trade.ID {
+				return irr.Wrap(ErrIdempotencyConflict, "key %q", idempotencyKey)
+			}
+			nft = &NFT{}
+			return tx.Where("id = ?", trade.NFTID).First(nft).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return irr.Wrap(err, "get point transaction %q failed", idempotencyKey)
+		}
+
+		switch {
+		case trade.SellerID == buyerID:
+			return irr.Wrap(ErrTradeOwnListing, "trade %d", id)
+		case trade.Status != NFTTradeOpen:
+			return irr.Wrap(ErrTradeNotOpen, "trade %d is %s", id, trade.Status)
+		}
+
+		// 按用户 id 的顺序修改积分，互相购买对方的挂单时不会死锁
+		changes := []PointChange{{
+			UserID:         buyerID,
+			Currency:       trade.Currency,
+			Delta:          -int64(trade.Price),
+			Reason:         PointReasonNFTTradeBuy,
+			RefID:          trade.ID,
+			IdempotencyKey: idempotencyKey,
+		}, {
+			UserID:         trade.SellerID,
+			Currency:       trade.Currency,
+			Delta:          int64(trade.Price),
+			Reason:         PointReasonNFTTradeSell,
+			RefID:          trade.ID,
+			IdempotencyKey: fmt.Sprintf("%s:%d", PointReasonNFTTradeSell, trade.ID),
+		}}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].UserID < changes[j].UserID })
+		for _, change := range changes {
+			_, ok, err := ApplyPointChange(ctx, tx, change)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				// 并发的相同请求已经写入了流水，或者挂单已经成交过
+				return irr.Wrap(ErrTradeConflict, "point change %q is already applied", change.IdempotencyKey)
+			}
+		}
+
+		if err = closeNFTTrade(ctx, tx, trade, NFTTradeSold, buyerID); err != nil {
+			return err
+		}
+		if nft, err = getEscrowedNFT(ctx, tx, trade); err != nil {
+			return err
+		}
+		if err = moveNFT(ctx, tx, nft, buyerID, NFTTransferSold, trade.ID); err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return trade, nft, applied, nil
+}
+
+// GetNFTTrade 获取挂单，不存在时返回 gorm.ErrRecordNotFound
+func GetNFTTrade(ctx context.Context, tx *gorm.DB, id utils.UInt64) (*NFTTrade, error) {
+	trade := &NFTTrade{}
+	if err := tx.WithContext(ctx).Where("id = ?", id).First(trade).Error; err != nil {
+		return nil, err
+	}
+	return trade, nil
+}
+
+// GetNFTTrades 查询挂单，最新的在前
+func GetNFTTrades(ctx context.Context, tx *gorm.DB, q NFTTradeQuery, offset, limit int) ([]*NFTTrade, int64, error) {
+	query := tx.WithContext(ctx).Model(&NFTTrade{})
+	if q.Status != "" {
+		query = query.Where("status = ?", q.Status)
+	}
+	if q.SellerID != 0 {
+		query = query.Where("seller_id = ?", q.SellerID)
+	}
+	if q.TemplateID != 0 {
+		query = query.Where("template_id = ?", q.TemplateID)
+	}
+	if q.Rarity != "" {
+		query = query.Where("rarity = ?", q.Rarity)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count trades failed")
+	}
+	var trades []*NFTTrade
+	if err := query.Order("created_at DESC, id DESC").Offset(offset).Limit(limit).Find(&trades).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get trades failed")
+	}
+	return trades, total, nil
+}
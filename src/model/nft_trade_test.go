@@ -0,0 +1,110 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+const (
+	tradeSeller utils.UInt64 = 1001
+	tradeBuyer  utils.UInt64 = 2002
+	tradeOther  utils.UInt64 = 3003
+)
+
+func setupTradeDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&NFT{}, &NFTTrade{}, &EventOutbox{}, &IdleIncome{}))
+	initEvents(db)
+	return db
+}
+
+// outboxNames 已经发布的事件名
+func outboxNames(t *testing.T, db *gorm.DB) []string {
+	var names []string
+	require.NoError(t, db.Model(&EventOutbox{}).Order("created_at ASC, id ASC").Pluck("name", &names).Error)
+	return names
+}
+
+// 读取之后 NFT 被转移过 (version 变化) 时，基于旧版本的转移返回 ErrNFTConflict，不修改所有者也不发布事件
+func TestMoveNFT_StaleVersionConflicts(t *testing.T) {
+	db := setupTradeDB(t)
+	ctx := context.Background()
+	require.NoError(t, db.Create(&NFT{ID: 1, OwnerID: tradeSeller, TemplateID: 101, Rarity: NFTRarityCommon, Source: NFTSourceDraw}).Error)
+
+	stale := &NFT{}
+	require.NoError(t, db.First(stale, 1).Error)
+	fresh := *stale
+
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		return moveNFT(ctx, tx, &fresh, tradeBuyer, NFTTransferGift, 0)
+	}))
+	assert.Equal(t, uint64(1), fresh.Version)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return moveNFT(ctx, tx, stale, tradeOther, NFTTransferGift, 0)
+	})
+	assert.True(t, errors.Is(err, ErrNFTConflict), "%v", err)
+	assert.Equal(t, tradeSeller, stale.OwnerID, "the stale copy is not changed")
+
+	saved := &NFT{}
+	require.NoError(t, db.First(saved, 1).Error)
+	assert.Equal(t, tradeBuyer, saved.OwnerID)
+	assert.Equal(t, uint64(1), saved.Version)
+	assert.Equal(t, []string{NFTTransferred{}.EventName()}, outboxNames(t, db))
+
+	// 版本相同但所有者已经变化时同样冲突
+	stale.Version = saved.Version
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return moveNFT(ctx, tx, stale, tradeOther, NFTTransferGift, 0)
+	})
+	assert.True(t, errors.Is(err, ErrNFTConflict), "%v", err)
+}
+
+// 读取之后挂单被关闭过 (version 变化) 时，基于旧版本的成交或撤单返回 ErrTradeConflict，只有第一个生效
+func TestCloseNFTTrade_StaleVersionConflicts(t *testing.T) {
+	db := setupTradeDB(t)
+	ctx := context.Background()
+	require.NoError(t, db.Create(&NFTTrade{
+		ID: 1, SellerID: tradeSeller, NFTID: 1, TemplateID: 101, Rarity: NFTRarityCommon,
+		Currency: CurrencyCash, Price: 10, Status: NFTTradeOpen,
+	}).Error)
+
+	cancel := &NFTTrade{}
+	require.NoError(t, db.First(cancel, 1).Error)
+	buy := *cancel
+
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		return closeNFTTrade(ctx, tx, &buy, NFTTradeSold, tradeBuyer)
+	}))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return closeNFTTrade(ctx, tx, cancel, NFTTradeCancelled, 0)
+	})
+	assert.True(t, errors.Is(err, ErrTradeConflict), "%v", err)
+	assert.Equal(t, NFTTradeOpen, cancel.Status, "the stale copy is not changed")
+
+	saved := &NFTTrade{}
+	require.NoError(t, db.First(saved, 1).Error)
+	assert.Equal(t, NFTTradeSold, saved.Status)
+	assert.Equal(t, tradeBuyer, saved.BuyerID)
+	assert.Equal(t, uint64(1), saved.Version)
+	require.NotNil(t, saved.ClosedAt)
+
+	// 另一个版本的挂单 (如被重新打开后) 不能用旧版本关闭
+	require.NoError(t, db.Model(&NFTTrade{}).Where("id = ?", 1).Updates(map[string]any{"status": NFTTradeOpen, "version": 2}).Error)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return closeNFTTrade(ctx, tx, &buy, NFTTradeSold, tradeOther)
+	})
+	assert.True(t, errors.Is(err, ErrTradeConflict), "%v", err)
+}
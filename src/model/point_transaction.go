@@ -0,0 +1,255 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+type (
+	// Currency 积分的种类，对应 ProfilePoints 中的一列
+	Currency string
+
+	// PointReason 积分变化的原因
+	PointReason string
+
+	// PointTransaction 积分流水。ProfilePoints 中的余额只通过流水修改 (见 ApplyPointChange)，
+	// 因此每个用户每种积分的余额总是等于流水中 Delta 的和 (见 ReconcilePoints)
+	PointTransaction struct {
+		ID             utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		UserID         utils.UInt64 `gorm:"not null;index:idx_point_tx_user,priority:1" json:"user_id"`
+		Currency       Currency     `gorm:"size:16;not null;index:idx_point_tx_user,priority:2" json:"currency"`
+		Delta          int64        `gorm:"not null" json:"delta"`
+		Balance        utils.UInt64 `gorm:"not null" json:"balance"` // 变化后的余额
+		Reason         PointReason  `gorm:"size:32;not null" json:"reason"`
+		RefID          utils.UInt64 `json:"ref_id,omitempty"` // 相关的实体，如复习计划的 id
+		IdempotencyKey string       `gorm:"size:128;not null;uniqueIndex:idx_point_tx_idempotency" json:"-"`
+		CreatedAt      time.Time    `json:"created_at"`
+	}
+
+	// PointChange 一次积分变化，IdempotencyKey 相同的变化只会生效一次
+	PointChange struct {
+		UserID         utils.UInt64
+		Currency       Currency
+		Delta          int64
+		Reason         PointReason
+		RefID          utils.UInt64
+		IdempotencyKey string
+	}
+
+	// PointDiscrepancy 余额与流水不一致的记录
+	PointDiscrepancy struct {
+		UserID   utils.UInt64 `json:"user_id"`
+		Currency Currency     `json:"currency"`
+		Balance  int64        `json:"balance"` // profile_points 中的余额
+		Ledger   int64        `json:"ledger"`  // 由流水计算出的余额
+	}
+)
+
+const (
+	CurrencyCash     Currency = "cash"
+	CurrencyGem      Currency = "gem"
+	CurrencyVipScore Currency = "vip_score"
+	// CurrencyDrawTicket 抽卡券，可以代替积分在支持的卡池中抽卡 (见 NFTPool.Ticket)
+	CurrencyDrawTicket Currency = "draw_ticket"
+
+	PointReasonOpeningBalance PointReason = "opening_balance" // 引入流水前已有的余额，见 migration
+	PointReasonCampaignSubmit PointReason = "campaign.submit"
+)
+
+// Currencies 所有种类的积分
+var Currencies = []Currency{CurrencyCash, CurrencyGem, CurrencyVipScore, CurrencyDrawTicket}
+
+var (
+	ErrInvalidCurrency     = irr.Error("invalid currency")
+	ErrInsufficientPoints  = irr.Error("insufficient points")
+	ErrIdempotencyConflict = irr.Error("idempotency key is used by another change")
+)
+
+func (PointTransaction) TableName() string {
+	return "point_transactions"
+}
+
+// Valid 是否是支持的积分种类
+func (c Currency) Valid() bool {
+	for _, cur := range Currencies {
+		if c == cur {
+			return true
+		}
+	}
+	return false
+}
+
+// column ProfilePoints 中对应的列
+func (c Currency) column() string {
+	return string(c)
+}
+
+// ApplyPointChange 记录一条流水并修改余额，两者在同一个事务中完成。
+// 已经存在相同 IdempotencyKey 的流水时不做修改，返回已有的流水和 false；余额不足时返回 ErrInsufficientPoints
+func ApplyPointChange(ctx context.Context, tx *gorm.DB, change PointChange) (*PointTransaction, bool, error) {
+	if !change.Currency.Valid() {
+		return nil, false, irr.Wrap(ErrInvalidCurrency, "currency %q", change.Currency)
+	}
+	if change.IdempotencyKey == "" {
+		return nil, false, irr.Error("idempotency key is required")
+	}
+
+	var (
+		record  *PointTransaction
+		applied bool
+	)
+	err := tx.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if _, err := EnsureLoadProfilePoints(tx, change.UserID); err != nil {
+			return irr.Wrap(err, "load points of user %d failed", change.UserID)
+		}
+
+		id, err := utils.GenIDU64(ctx)
+		if err != nil {
+			return irr.Wrap(err, "generate point transaction id failed")
+		}
+		record = &PointTransaction{
+			ID:             id,
+			UserID:         change.UserID,
+			Currency:       change.Currency,
+			Delta:          change.Delta,
+			Reason:         change.Reason,
+			RefID:          change.RefID,
+			IdempotencyKey: change.IdempotencyKey,
+		}
+		// 唯一索引保证并发的重复请求只有一个能写入流水
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+		if result.Error != nil {
+			return irr.Wrap(result.Error, "create point transaction failed")
+		}
+		if result.RowsAffected == 0 {
+			existing := &PointTransaction{}
+			if err = tx.Where("idempotency_key = ?", change.IdempotencyKey).First(existing).Error; err != nil {
+				return irr.Wrap(err, "get point transaction %q failed", change.IdempotencyKey)
+			}
+			if existing.UserID != change.UserID || existing.Currency != change.Currency {
+				return irr.Wrap(ErrIdempotencyConflict, "key %q", change.IdempotencyKey)
+			}
+			record = existing
+			return nil
+		}
+
+		col := change.Currency.column()
+		update := tx.Model(&ProfilePoints{}).Where("id = ?", change.UserID)
+		if change.Delta < 0 {
+			update = update.Where(col+" >= ?", -change.Delta)
+		}
+		result = update.Update(col, gorm.Expr(col+" + ?", change.Delta))
+		if result.Error != nil {
+			return irr.Wrap(result.Error, "update %s of user %d failed", col, change.UserID)
+		}
+		if result.RowsAffected == 0 {
+			return irr.Wrap(ErrInsufficientPoints, "user %d, %s %d", change.UserID, col, change.Delta)
+		}
+
+		var balances []utils.UInt64
+		if err = tx.Model(&ProfilePoints{}).Where("id = ?", change.UserID).Pluck(col, &balances).Error; err != nil {
+			return irr.Wrap(err, "get %s of user %d failed", col, change.UserID)
+		}
+		if len(balances) != 1 {
+			return irr.Error("get %s of user %d failed, points not found", col, change.UserID)
+		}
+		balance := balances[0]
+		if err = tx.Model(record).Update("balance", balance).Error; err != nil {
+			return irr.Wrap(err, "update balance of point transaction %d failed", record.ID)
+		}
+		record.Balance, applied = balance, true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return record, applied, nil
+}
+
+// GetPointTransactions 获取用户的积分流水，最新的在前，currency 为空时获取所有种类
+func GetPointTransactions(ctx context.Context, tx *gorm.DB, userID utils.UInt64, currency Currency, offset, limit int) ([]*PointTransaction, int64, error) {
+	query := tx.WithContext(ctx).Model(&PointTransaction{}).Where("user_id = ?", userID)
+	if currency != "" {
+		query = query.Where("currency = ?", currency)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count point transactions of user %d failed", userID)
+	}
+	var records []*PointTransaction
+	if err := query.Order("created_at DESC, id DESC").Offset(offset).Limit(limit).Find(&records).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get point transactions of user %d failed", userID)
+	}
+	return records, total, nil
+}
+
+// ReconcilePoints 由流水重新计算余额，返回与 profile_points 不一致的记录。userIDs 为空时检查所有用户
+func ReconcilePoints(ctx context.Context, tx *gorm.DB, userIDs ...utils.UInt64) ([]*PointDiscrepancy, error) {
+	var sums []struct {
+		UserID   utils.UInt64
+		Currency Currency
+		Total    int64
+	}
+	query := tx.WithContext(ctx).Model(&PointTransaction{}).
+		Select("user_id, currency, SUM(delta) AS total").Group("user_id, currency")
+	if len(userIDs) > 0 {
+		query = query.Where("user_id IN ?", userIDs)
+	}
+	if err := query.Scan(&sums).Error; err != nil {
+		return nil, irr.Wrap(err, "sum point transactions failed")
+	}
+	ledger := make(map[utils.UInt64]map[Currency]int64)
+	for _, s := range sums {
+		if ledger[s.UserID] == nil {
+			ledger[s.UserID] = make(map[Currency]int64, len(Currencies))
+		}
+		ledger[s.UserID][s.Currency] = s.Total
+	}
+
+	var balances []*ProfilePoints
+	query = tx.WithContext(ctx).Model(&ProfilePoints{})
+	if len(userIDs) > 0 {
+		query = query.Where("id IN ?", userIDs)
+	}
+	if err := query.Find(&balances).Error; err != nil {
+		return nil, irr.Wrap(err, "get profile points failed")
+	}
+
+	discrepancies := make([]*PointDiscrepancy, 0)
+	check := func(userID utils.UInt64, currency Currency, balance int64) {
+		if sum := ledger[userID][currency]; sum != balance {
+			discrepancies = append(discrepancies, &PointDiscrepancy{UserID: userID, Currency: currency, Balance: balance, Ledger: sum})
+		}
+	}
+	seen := make(map[utils.UInt64]bool, len(balances))
+	for _, p := range balances {
+		seen[p.ID] = true
+		check(p.ID, CurrencyCash, int64(p.Cash))
+		check(p.ID, CurrencyGem, int64(p.Gem))
+		check(p.ID, CurrencyVipScore, int64(p.VipScore))
+		check(p.ID, CurrencyDrawTicket, int64(p.DrawTicket))
+	}
+	// 有流水但没有余额记录的用户
+	for userID := range ledger {
+		if !seen[userID] {
+			for _, currency := range Currencies {
+				check(userID, currency, 0)
+			}
+		}
+	}
+	sort.Slice(discrepancies, func(i, j int) bool {
+		if discrepancies[i].UserID != discrepancies[j].UserID {
+			return discrepancies[i].UserID < discrepancies[j].UserID
+		}
+		return discrepancies[i].Currency < discrepancies[j].Currency
+	})
+	return discrepancies, nil
+}
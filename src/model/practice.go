@@ -42,12 +42,19 @@ func (d *Dungeon) GetMonstersForPractice(ctx context.Context, tx *gorm.DB, count
 	log.Infof("start get monsters")
 	now := time.Now()
 
-	// Helper function to create the base query
-	makeQuery := func(limit int) GormScope {
+	// Helper function to create the base query, fresh 为 true 时查询还没有学习过的 monsters
+	makeQuery := func(limit int, fresh bool) GormScope {
 		return func(tx *gorm.DB) *gorm.DB {
-			return tx.Where("dungeon_id = ? AND next_practice_at < ?", d.ID, now).
-				Order("importance DESC, difficulty ASC").
-				Limit(limit)
+			tx = tx.Where("dungeon_id = ? AND next_practice_at < ?", d.ID, now)
+			if !fresh {
+				return tx.Where("familiarity > 0").Order("importance DESC, difficulty ASC").Limit(limit)
+			}
+			tx = tx.Where("familiarity = 0")
+			// campaign 按 book 中的顺序引入新的 items (见 SyncBookMonsterPositions)，直接加入的 items 没有位置 (为 0)，排在后面
+			if d.Type == def.DungeonTypeCampaign {
+				tx = tx.Order("position = 0, position ASC")
+			}
+			return tx.Order("importance DESC, difficulty ASC").Limit(limit)
 		}
 	}
 
@@ -79,47 +86,47 @@ func (d *Dungeon) GetMonstersForPractice(ctx context.Context, tx *gorm.DB, count
 
 // Helper functions for different QuizModes
 
-func getMonstersAlwaysNew(ctx context.Context, tx *gorm.DB, makeQuery func(int) GormScope, count int) ([]DungeonMonster, error) {
+func getMonstersAlwaysNew(ctx context.Context, tx *gorm.DB, makeQuery func(int, bool) GormScope, count int) ([]DungeonMonster, error) {
 	var m1, m2 []DungeonMonster
-	if err := tx.Scopes(makeQuery(count)).Where("familiarity = 0").Find(&m1).Error; err != nil {
+	if err := tx.Scopes(makeQuery(count, true)).Find(&m1).Error; err != nil {
 		return nil, err
 	}
 	if len(m1) < count {
-		if err := tx.Scopes(makeQuery(count - len(m1))).Where("familiarity > 0").Find(&m2).Error; err != nil {
+		if err := tx.Scopes(makeQuery(count-len(m1), false)).Find(&m2).Error; err != nil {
 			return nil, err
 		}
 	}
 	return append(m1, m2...), nil
 }
 
-func getMonstersAlwaysOld(ctx context.Context, tx *gorm.DB, makeQuery func(int) GormScope, count int) ([]DungeonMonster, error) {
+func getMonstersAlwaysOld(ctx context.Context, tx *gorm.DB, makeQuery func(int, bool) GormScope, count int) ([]DungeonMonster, error) {
 	var m1, m2 []DungeonMonster
-	if err := tx.Scopes(makeQuery(count)).Where("familiarity > 0").Find(&m1).Error; err != nil {
+	if err := tx.Scopes(makeQuery(count, false)).Find(&m1).Error; err != nil {
 		return nil, err
 	}
 	if len(m1) < count {
-		if err := tx.Scopes(makeQuery(count - len(m1))).Where("familiarity = 0").Find(&m2).Error; err != nil {
+		if err := tx.Scopes(makeQuery(count-len(m1), true)).Find(&m2).Error; err != nil {
 			return nil, err
 		}
 	}
 	return append(m1, m2...), nil
 }
 
-func getMonstersBalance(ctx context.Context, tx *gorm.DB, makeQuery func(int) GormScope, count int) ([]DungeonMonster, error) {
+func getMonstersBalance(ctx context.Context, tx *gorm.DB, makeQuery func(int, bool) GormScope, count int) ([]DungeonMonster, error) {
 	var m1, m2 []DungeonMonster
 	if rand.Intn(100) < int(balanceModeNewStuffRate.Clamp0100()) {
-		if err := tx.Scopes(makeQuery(count)).Where("familiarity = 0").Find(&m1).Error; err != nil {
+		if err := tx.Scopes(makeQuery(count, true)).Find(&m1).Error; err != nil {
 			return nil, err
 		}
 	}
 	if len(m1) < count {
-		if err := tx.Scopes(makeQuery(count - len(m1))).Where("familiarity > 0").Find(&m2).Error; err != nil {
+		if err := tx.Scopes(makeQuery(count-len(m1), false)).Find(&m2).Error; err != nil {
 			return nil, err
 		}
 	}
 	m2 = append(m2, m1...)
 	if len(m2) < count { // 可能是没有走 threshold 的逻辑, 所以这里再查一次
-		if err := tx.Scopes(makeQuery(count - len(m2))).Where("familiarity = 0").Find(&m1).Error; err != nil {
+		if err := tx.Scopes(makeQuery(count-len(m2), true)).Find(&m1).Error; err != nil {
 			return nil, err
 		}
 		m2 = append(m2, m1...)
@@ -127,22 +134,22 @@ func getMonstersBalance(ctx context.Context, tx *gorm.DB, makeQuery func(int) Go
 	return m2, nil
 }
 
-func getMonstersThreshold(ctx context.Context, tx *gorm.DB, makeQuery func(int) GormScope, dungeonID utils.UInt64, count int) ([]DungeonMonster, error) {
+func getMonstersThreshold(ctx context.Context, tx *gorm.DB, makeQuery func(int, bool) GormScope, dungeonID utils.UInt64, count int) ([]DungeonMonster, error) {
 	var m1, m2 []DungeonMonster
 	minOne := min(defaultThreshold, count)
-	if err := tx.Scopes(makeQuery(minOne)).Where("familiarity = 0").Find(&m1).Error; err != nil {
+	if err := tx.Scopes(makeQuery(minOne, true)).Find(&m1).Error; err != nil {
 		return nil, err
 	}
 
 	if len(m1) < count {
-		if err := tx.Scopes(makeQuery(count - len(m1))).Where("familiarity > 0").Find(&m2).Error; err != nil {
+		if err := tx.Scopes(makeQuery(count-len(m1), false)).Find(&m2).Error; err != nil {
 			return nil, err
 		}
 	}
 	return append(m1, m2...), nil
 }
 
-func getMonstersDynamic(ctx context.Context, tx *gorm.DB, makeQuery func(int) GormScope, dungeonID utils.UInt64, count int) ([]DungeonMonster, error) {
+func getMonstersDynamic(ctx context.Context, tx *gorm.DB, makeQuery func(int, bool) GormScope, dungeonID utils.UInt64, count int) ([]DungeonMonster, error) {
 	var m1, m2 []DungeonMonster
 
 	key := CKDungeonNewStuffCountDaily.MustBuild(CParamNewStuffCountDaily{ID: dungeonID, Date: time.Now().Format("2006-01-02")})
@@ -154,20 +161,20 @@ func getMonstersDynamic(ctx context.Context, tx *gorm.DB, makeQuery func(int) Go
 	}
 
 	if cNewStuff < defaultDalyNewCount {
-		if err = tx.Scopes(makeQuery(count)).Where("familiarity = 0").Find(&m1).Error; err != nil {
+		if err = tx.Scopes(makeQuery(count, true)).Find(&m1).Error; err != nil {
 			return nil, err
 		}
 		cache.Client().Set(ctx, key, cNewStuff+1, time.Hour*24) // todo: 先按次数 set cache 实现了, 预期是应该在 submit 的时候再 incr cache
 	}
 
 	if len(m1) < count {
-		if err = tx.Scopes(makeQuery(count - len(m1))).Where("familiarity > 0").Find(&m2).Error; err != nil {
+		if err = tx.Scopes(makeQuery(count-len(m1), false)).Find(&m2).Error; err != nil {
 			return nil, err
 		}
 	}
 	m2 = append(m2, m1...)
 	if len(m2) < count { // 可能是没有走 threshold 的逻辑, 所以这里再查一次
-		if err = tx.Scopes(makeQuery(count - len(m2))).Where("familiarity = 0").Find(&m1).Error; err != nil {
+		if err = tx.Scopes(makeQuery(count-len(m2), true)).Find(&m1).Error; err != nil {
 			return nil, err
 		}
 		m2 = append(m2, m1...)
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+// PracticeAttempt 已处理的复习提交。客户端为每次作答生成 AttemptID，重试时保持不变，
+// 服务端据此识别重复的提交并返回第一次处理时的响应，而不是再次更新熟练度和发放积分
+type PracticeAttempt struct {
+	UserID    utils.UInt64     `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
+	AttemptID string           `gorm:"primaryKey;size:64" json:"attempt_id"`
+	DungeonID utils.UInt64     `gorm:"not null" json:"dungeon_id"`
+	ItemID    utils.UInt64     `gorm:"not null" json:"item_id"`
+	Result    def.AttackResult `gorm:"size:16;not null" json:"result"`
+	Response  string           `gorm:"type:text" json:"-"` // 第一次处理时响应的 data (json)，重放时原样返回
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// MaxAttemptIDLen AttemptID 的最大长度
+const MaxAttemptIDLen = 64
+
+// ErrAttemptMismatch 同一个 AttemptID 被用于不同的提交
+var ErrAttemptMismatch = irr.Error("attempt id is already used by another submission")
+
+func (PracticeAttempt) TableName() string {
+	return "practice_attempts"
+}
+
+// Matches 是否是同一次提交
+func (a *PracticeAttempt) Matches(dungeonID, itemID utils.UInt64, result def.AttackResult) bool {
+	return a.DungeonID == dungeonID && a.ItemID == itemID && a.Result == result
+}
+
+// FindPracticeAttempt 查找已处理的提交，不存在时返回 nil
+func FindPracticeAttempt(ctx context.Context, tx *gorm.DB, userID utils.UInt64, attemptID string) (*PracticeAttempt, error) {
+	attempt := &PracticeAttempt{}
+	err := tx.WithContext(ctx).Where("user_id = ? AND attempt_id = ?", userID, attemptID).First(attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, irr.Wrap(err, "find attempt %q of user %d failed", attemptID, userID)
+	}
+	return attempt, nil
+}
+
+// SavePracticeAttempt 记录已处理的提交，需要与提交的修改在同一个事务中调用。
+// 返回 false 表示同一个 AttemptID 已经被并发的请求记录，调用方应回滚并返回已记录的响应
+func SavePracticeAttempt(ctx context.Context, tx *gorm.DB, attempt *PracticeAttempt) (bool, error) {
+	result := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(attempt)
+	if result.Error != nil {
+		return false, irr.Wrap(result.Error, "save attempt %q of user %d failed", attempt.AttemptID, attempt.UserID)
+	}
+	return result.RowsAffected > 0, nil
+}
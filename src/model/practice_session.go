@@ -0,0 +1,76 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+)
+
+type (
+	// SessionEndReason 复习会话结束的原因，会话进行中时为空
+	SessionEndReason string
+
+	// PracticeSession 复习会话的汇总，会话开始时创建，结束时写入统计
+	PracticeSession struct {
+		ID              utils.UInt64     `gorm:"primaryKey;autoIncrement:false" json:"id"`
+		UserID          utils.UInt64     `gorm:"not null;index:idx_practice_session_user,priority:1" json:"user_id"`
+		DungeonID       utils.UInt64     `gorm:"not null;index:idx_practice_session_user,priority:2" json:"dungeon_id"`
+		EndReason       SessionEndReason `gorm:"size:16" json:"end_reason,omitempty"`
+		Answered        uint32           `json:"answered"`         // 作答次数，同一个 monster 可能作答多次
+		Failed          uint32           `json:"failed"`           // 答错的次数
+		Cash            utils.UInt64     `json:"cash"`             // 获得的积分
+		FamiliarityGain int64            `json:"familiarity_gain"` // 熟练度变化的和
+		ResponseMS      int64            `json:"response_ms"`      // 作答耗时的和
+		StartedAt       time.Time        `gorm:"not null" json:"started_at"`
+		EndedAt         *time.Time       `json:"ended_at,omitempty"`
+	}
+)
+
+const (
+	SessionEndCompleted    SessionEndReason = "completed"    // 没有到期的 monsters 了
+	SessionEndFinished     SessionEndReason = "finished"     // 客户端主动结束
+	SessionEndTimeout      SessionEndReason = "timeout"      // 长时间没有作答
+	SessionEndDisconnected SessionEndReason = "disconnected" // 连接断开
+	SessionEndError        SessionEndReason = "error"        // 服务端出错
+)
+
+func (PracticeSession) TableName() string {
+	return "practice_sessions"
+}
+
+// CreatePracticeSession 记录开始的复习会话
+func CreatePracticeSession(ctx context.Context, tx *gorm.DB, session *PracticeSession) error {
+	if err := tx.WithContext(ctx).Create(session).Error; err != nil {
+		return irr.Wrap(err, "create practice session of user %d failed", session.UserID)
+	}
+	return nil
+}
+
+// FinishPracticeSession 写入复习会话的统计和结束原因
+func FinishPracticeSession(ctx context.Context, tx *gorm.DB, session *PracticeSession) error {
+	if err := tx.WithContext(ctx).Model(session).
+		Select("end_reason", "answered", "failed", "cash", "familiarity_gain", "response_ms", "ended_at").
+		Updates(session).Error; err != nil {
+		return irr.Wrap(err, "finish practice session %d failed", session.ID)
+	}
+	return nil
+}
+
+// GetPracticeSessions 获取用户在复习计划中的复习会话，最新的在前
+func GetPracticeSessions(ctx context.Context, tx *gorm.DB, userID, dungeonID utils.UInt64, offset, limit int) ([]*PracticeSession, int64, error) {
+	query := tx.WithContext(ctx).Model(&PracticeSession{}).Where("user_id = ? AND dungeon_id = ?", userID, dungeonID)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count practice sessions of dungeon %d failed", dungeonID)
+	}
+	var sessions []*PracticeSession
+	if err := query.Order("started_at DESC, id DESC").Offset(offset).Limit(limit).Find(&sessions).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "get practice sessions of dungeon %d failed", dungeonID)
+	}
+	return sessions, total, nil
+}
@@ -8,15 +8,16 @@ import (
 	"gorm.io/gorm"
 )
 
-// ProfilePoints 定义了用户积分信息的模型
+// ProfilePoints 定义了用户积分信息的模型，余额只通过积分流水修改 (见 ApplyPointChange)
 type ProfilePoints struct {
-	ID        utils.UInt64   `gorm:"primaryKey;autoIncrement:false"` // 与用户ID一致
-	Cash      utils.UInt64   `gorm:"default:0"`                      // 现金
-	Gem       utils.UInt64   `gorm:"default:0"`                      // 宝石
-	VipScore  utils.UInt64   `gorm:"default:0"`                      // VIP 积分
-	CreatedAt time.Time      // 记录的创建时间
-	UpdatedAt time.Time      // 记录的更新时间
-	DeletedAt gorm.DeletedAt `gorm:"index"` // 记录的删除时间
+	ID         utils.UInt64   `gorm:"primaryKey;autoIncrement:false"` // 与用户ID一致
+	Cash       utils.UInt64   `gorm:"default:0"`                      // 现金
+	Gem        utils.UInt64   `gorm:"default:0"`                      // 宝石
+	VipScore   utils.UInt64   `gorm:"default:0"`                      // VIP 积分
+	DrawTicket utils.UInt64   `gorm:"default:0"`                      // 抽卡券
+	CreatedAt  time.Time      // 记录的创建时间
+	UpdatedAt  time.Time      // 记录的更新时间
+	DeletedAt  gorm.DeletedAt `gorm:"index"` // 记录的删除时间
 }
 
 // TableName 自定义表名
@@ -42,12 +43,3 @@ func EnsureLoadProfilePoints(db *gorm.DB, userID utils.UInt64) (*ProfilePoints,
 
 	return points, nil
 }
-
-// AddUserCash 更新用户积分
-func AddUserCash(db *gorm.DB, userID utils.UInt64, points int) error {
-	return db.Model(&ProfilePoints{}).Where("id = ?", userID).
-		Update("cash", gorm.Expr("cash + ?", points)).
-		Error
-}
-
-// todo: update
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"time"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+// ReviewLog 复习记录，每次作答 (submit、离线同步和复习会话) 生效时记录一条，用于分析记忆效果
+type ReviewLog struct {
+	ID                utils.UInt64     `gorm:"primaryKey;autoIncrement:false" json:"id"`
+	UserID            utils.UInt64     `gorm:"not null;index:idx_review_log_user,priority:1" json:"user_id"`
+	DungeonID         utils.UInt64     `gorm:"not null" json:"dungeon_id"`
+	ItemID            utils.UInt64     `gorm:"not null;index:idx_review_log_item" json:"item_id"`
+	SessionID         utils.UInt64     `gorm:"index:idx_review_log_session" json:"session_id,omitempty"` // 复习会话中的作答，见 PracticeSession
+	Result            def.AttackResult `gorm:"size:16;not null" json:"result"`
+	FamiliarityBefore utils.Percentage `json:"familiarity_before"`
+	FamiliarityAfter  utils.Percentage `json:"familiarity_after"`
+	ResponseMS        int64            `json:"response_ms,omitempty"` // 服务器记录的作答耗时 (从下发 monster 到收到作答)，未知时为 0
+	PracticedAt       time.Time        `gorm:"not null;index:idx_review_log_user,priority:2" json:"practiced_at"`
+	NextPracticeAt    time.Time        `json:"next_practice_at"`
+	CreatedAt         time.Time        `json:"created_at"`
+}
+
+func (ReviewLog) TableName() string {
+	return "review_logs"
+}
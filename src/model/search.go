@@ -0,0 +1,234 @@
+package model
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/search"
+	"github.com/bagaking/memorianexus/src/def"
+)
+
+const (
+	searchAttrType       = "type"
+	searchAttrDifficulty = "difficulty"
+
+	searchRebuildBatchSize = 500
+)
+
+var itemSearcher search.Index = search.NewMemoryIndex()
+
+type (
+	// ItemFilter items 的过滤条件，DB 查询和搜索共用
+	ItemFilter struct {
+		UserID       utils.UInt64 // items 的创建者
+		ViewerID     utils.UInt64 // 查询者，不是创建者时只返回查询者有读取权限的 items (见 AuthzPolicy)
+		Type         string
+		Difficulties []def.DifficultyLevel
+		Tag          string
+		BookID       utils.UInt64
+	}
+
+	// ItemSearchHit 搜索命中的 item
+	ItemSearchHit struct {
+		*Item
+		Score      float64
+		Highlights []search.Span
+		Snippet    string
+	}
+)
+
+// ItemSearcher 返回 items 的全文索引
+func ItemSearcher() search.Index {
+	return itemSearcher
+}
+
+// initItemSearcher 在后台从 DB 重建 items 的全文索引
+// 重建期间的写入通过 UpdatedAt 和删除标记保证不会被旧数据覆盖，重建完成后清理重建开始前的删除标记
+func initItemSearcher(ctx context.Context, db *gorm.DB) {
+	go func() {
+		log := wlog.ByCtx(ctx, "model.initItemSearcher")
+		start := time.Now()
+		count := 0
+		var batch []*Item
+		err := db.WithContext(ctx).Model(&Item{}).FindInBatches(&batch, searchRebuildBatchSize, func(tx *gorm.DB, _ int) error {
+			count += len(batch)
+			return itemSearcher.Upsert(ctx, typer.SliceMap(batch, itemDocument)...)
+		}).Error
+		if err != nil {
+			log.WithError(err).Errorf("rebuild item search index failed, indexed= %d", count)
+			return
+		}
+		// 重建开始前的删除已经不在 DB 的查询结果中，删除标记不再需要
+		pruned := 0
+		if pruner, ok := itemSearcher.(search.TombstonePruner); ok {
+			pruned = pruner.PruneTombstones(start)
+		}
+		log.Infof("item search index rebuilt, count= %d, pruned= %d, cost= %v", count, pruned, time.Since(start))
+	}()
+}
+
+func itemDocument(item *Item) *search.Document {
+	return &search.Document{
+		ID:    uint64(item.ID),
+		Owner: uint64(item.CreatorID),
+		Text:  item.Content,
+		Attrs: map[string]string{
+			searchAttrType:       item.Type,
+			searchAttrDifficulty: strconv.Itoa(int(item.Difficulty)),
+		},
+		UpdatedAt: item.UpdatedAt,
+	}
+}
+
+// IndexItems 在事务提交后更新 items 的全文索引，索引失败不影响主流程
+func IndexItems(ctx context.Context, items ...*Item) {
+	if err := itemSearcher.Upsert(ctx, typer.SliceMap(items, itemDocument)...); err != nil {
+		wlog.ByCtx(ctx, "model.IndexItems").WithError(err).Errorf("index items failed, count= %d", len(items))
+	}
+}
+
+// ReindexItems 从 DB 重新读取 items 并更新全文索引，用于只做了部分字段更新的场景
+func ReindexItems(ctx context.Context, tx *gorm.DB, itemIDs ...utils.UInt64) {
+	items, err := GetItemsByID(tx.WithContext(ctx), itemIDs)
+	if err != nil {
+		wlog.ByCtx(ctx, "model.ReindexItems").WithError(err).Errorf("load items failed, ids= %v", itemIDs)
+		return
+	}
+	IndexItems(ctx, items...)
+}
+
+// UnindexItems 从全文索引中删除 items
+func UnindexItems(ctx context.Context, itemIDs ...utils.UInt64) {
+	ids := typer.SliceMap(itemIDs, func(id utils.UInt64) uint64 { return uint64(id) })
+	if err := itemSearcher.Delete(ctx, ids...); err != nil {
+		wlog.ByCtx(ctx, "model.UnindexItems").WithError(err).Errorf("unindex items failed, ids= %v", itemIDs)
+	}
+}
+
+// candidates 根据 tag 和 book 过滤条件得到候选 item 集合，没有此类条件时返回 nil
+func (f *ItemFilter) candidates(ctx context.Context, tx *gorm.DB) (map[utils.UInt64]struct{}, error) {
+	var ret map[utils.UInt64]struct{}
+	if f.ViewerID > 0 && f.ViewerID != f.UserID {
+		var ids []utils.UInt64
+		if err := tx.WithContext(ctx).Model(&Item{}).Scopes(AuthzPolicy().Scope(f.ViewerID, ResourceItem, ActionRead)).
+			Where("items.creator_id = ?", f.UserID).Pluck("items.id", &ids).Error; err != nil {
+			return nil, irr.Wrap(err, "get readable items failed")
+		}
+		ret = typer.SliceToTrueMap(ids)
+	}
+	if f.Tag != "" {
+		itemTags, err := GetItemIDsOfTags(ctx, f.UserID, []string{f.Tag})
+		if err != nil {
+			return nil, irr.Wrap(err, "get items of tag failed")
+		}
+		tagged := make(map[utils.UInt64]struct{}, len(itemTags))
+		for id := range itemTags {
+			if _, ok := ret[id]; ret == nil || ok {
+				tagged[id] = struct{}{}
+			}
+		}
+		ret = tagged
+	}
+	if f.BookID > 0 {
+		ids, err := GetItemIDsOfBook(tx, f.BookID, 0, -1)
+		if err != nil {
+			return nil, irr.Wrap(err, "get items of book failed")
+		}
+		inBook := make(map[utils.UInt64]struct{}, len(ids))
+		for _, id := range ids {
+			if _, ok := ret[id]; ret == nil || ok {
+				inBook[id] = struct{}{}
+			}
+		}
+		ret = inBook
+	}
+	return ret, nil
+}
+
+// FindItemsByFilter 按条件分页查询 items，按创建时间倒序
+func FindItemsByFilter(ctx context.Context, tx *gorm.DB, f *ItemFilter, offset, limit int) (items []*Item, total int64, err error) {
+	query := tx.WithContext(ctx).Model(&Item{}).Where("creator_id = ?", f.UserID)
+	if f.Type != "" {
+		query = query.Where("type = ?", f.Type)
+	}
+	if len(f.Difficulties) > 0 {
+		query = query.Where("difficulty IN ?", f.Difficulties)
+	}
+	candidates, err := f.candidates(ctx, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if candidates != nil {
+		if len(candidates) == 0 {
+			return make([]*Item, 0), 0, nil
+		}
+		query = query.Where("id IN ?", typer.Keys(candidates))
+	}
+
+	if err = query.Count(&total).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "count items failed")
+	}
+	if err = query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&items).Error; err != nil {
+		return nil, 0, irr.Wrap(err, "find items failed")
+	}
+	return items, total, nil
+}
+
+// SearchItems 全文搜索 items，返回按相关度排序的当前页结果和满足条件的总数
+func SearchItems(ctx context.Context, tx *gorm.DB, f *ItemFilter, text string, offset, limit int) ([]*ItemSearchHit, int64, error) {
+	q := &search.Query{
+		Owner:  uint64(f.UserID),
+		Text:   text,
+		Attrs:  make(map[string][]string),
+		Offset: offset,
+		Limit:  limit,
+	}
+	if f.Type != "" {
+		q.Attrs[searchAttrType] = []string{f.Type}
+	}
+	for _, d := range f.Difficulties {
+		q.Attrs[searchAttrDifficulty] = append(q.Attrs[searchAttrDifficulty], strconv.Itoa(int(d)))
+	}
+	candidates, err := f.candidates(ctx, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if candidates != nil {
+		q.Candidates = make(map[uint64]struct{}, len(candidates))
+		for id := range candidates {
+			q.Candidates[uint64(id)] = struct{}{}
+		}
+	}
+
+	result, err := itemSearcher.Search(ctx, q)
+	if err != nil {
+		return nil, 0, irr.Wrap(err, "search items failed")
+	}
+
+	ids := typer.SliceMap(result.Hits, func(h *search.Hit) utils.UInt64 { return utils.UInt64(h.ID) })
+	items, err := GetItemsByID(tx.WithContext(ctx), ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	mItems := make(map[utils.UInt64]*Item, len(items))
+	for _, item := range items {
+		mItems[item.ID] = item
+	}
+
+	hits := make([]*ItemSearchHit, 0, len(result.Hits))
+	for _, h := range result.Hits {
+		item, ok := mItems[utils.UInt64(h.ID)]
+		if !ok { // 索引与 DB 短暂不一致，跳过即可
+			continue
+		}
+		hits = append(hits, &ItemSearchHit{Item: item, Score: h.Score, Highlights: h.Highlights, Snippet: h.Snippet})
+	}
+	return hits, int64(result.Total), nil
+}
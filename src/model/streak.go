@@ -0,0 +1,400 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+	_ "time/tzdata" // 用户时区不依赖运行环境中的时区数据
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/internal/utils/cache"
+)
+
+type (
+	// GoalType 每日目标的类型
+	GoalType string
+
+	// UserStreak 用户的连续打卡。每天达成每日目标时连续天数加一，某天没有达成时由补签卡 (streak freeze) 保护，
+	// 没有补签卡时连续天数清零。日期按用户的时区计算
+	UserStreak struct {
+		UserID        utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
+		Timezone      string       `gorm:"size:64;not null" json:"timezone"`
+		GoalType      GoalType     `gorm:"size:16;not null" json:"goal_type"`
+		GoalTarget    uint32       `gorm:"not null" json:"goal_target"`
+		CurrentStreak uint32       `gorm:"index:idx_user_streak_current" json:"current_streak"`
+		LongestStreak uint32       `json:"longest_streak"`
+		LastGoalDate  string       `gorm:"size:10" json:"last_goal_date,omitempty"` // 最后一个计入连续打卡的日期 (达成目标或使用了补签卡)
+		Freezes       uint32       `json:"freezes"`                                 // 持有的补签卡
+		UpdatedAt     time.Time    `json:"updated_at"`
+	}
+
+	// DailyActivity 用户每天的复习统计，日期按用户的时区计算
+	DailyActivity struct {
+		UserID    utils.UInt64 `gorm:"primaryKey;autoIncrement:false" json:"-"`
+		Date      string       `gorm:"primaryKey;size:10" json:"date"`
+		Reviews   uint32       `json:"reviews"`
+		Points    utils.UInt64 `json:"points"`
+		GoalMet   bool         `json:"goal_met"`
+		Frozen    bool         `json:"frozen"` // 没有达成目标，使用补签卡保持了连续打卡
+		UpdatedAt time.Time    `json:"updated_at"`
+	}
+)
+
+const (
+	GoalTypeReviews GoalType = "reviews" // 每天作答的次数
+	GoalTypePoints  GoalType = "points"  // 每天复习获得的积分
+
+	PointReasonStreakFreeze PointReason = "streak.freeze"
+
+	// StreakFreezePrice 一张补签卡的价格 (Gem)
+	StreakFreezePrice = 50
+	// MaxStreakFreezes 最多持有的补签卡
+	MaxStreakFreezes = 2
+	// MaxGoalTarget 每日目标的上限
+	MaxGoalTarget = 100000
+
+	dateLayout        = "2006-01-02"
+	rolloverBatchSize = 200
+)
+
+var (
+	ErrInvalidGoal        = irr.Error("invalid daily goal")
+	ErrInvalidTimezone    = irr.Error("invalid timezone")
+	ErrTooManyFreezes     = irr.Error("too many streak freezes")
+	ErrInvalidFreezeCount = irr.Error("invalid count of streak freezes")
+)
+
+func (UserStreak) TableName() string {
+	return "user_streaks"
+}
+
+func (DailyActivity) TableName() string {
+	return "daily_activities"
+}
+
+// Valid 是否是支持的目标类型
+func (g GoalType) Valid() bool {
+	return g == GoalTypeReviews || g == GoalTypePoints
+}
+
+// Location 用户的时区，无法解析时使用 UTC
+func (s *UserStreak) Location() *time.Location {
+	if loc, err := time.LoadLocation(s.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// DateOf 用户时区中 t 所在的日期
+func (s *UserStreak) DateOf(t time.Time) string {
+	return t.In(s.Location()).Format(dateLayout)
+}
+
+// GoalMet 当天的统计是否达成了每日目标
+func (s *UserStreak) GoalMet(day *DailyActivity) bool {
+	if s.GoalType == GoalTypePoints {
+		return day.Points >= utils.UInt64(s.GoalTarget)
+	}
+	return day.Reviews >= s.GoalTarget
+}
+
+// addDays 日期加减天数
+func addDays(date string, days int) string {
+	t, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return date
+	}
+	return t.AddDate(0, 0, days).Format(dateLayout)
+}
+
+// rollover 处理 today 之前没有达成目标的日子: 补签卡足够覆盖所有的日子时逐天使用补签卡，否则连续天数清零 (补签卡保留)。
+// 返回使用了补签卡的日期，只修改 s，由调用方保存
+func (s *UserStreak) rollover(today string) (frozen []string, broken bool) {
+	if s.CurrentStreak == 0 || s.LastGoalDate == "" || addDays(s.LastGoalDate, 1) >= today {
+		return nil, false
+	}
+	missed := make([]string, 0)
+	for d := addDays(s.LastGoalDate, 1); d < today; d = addDays(d, 1) {
+		if len(missed) >= int(s.Freezes) {
+			s.CurrentStreak = 0
+			return nil, true
+		}
+		missed = append(missed, d)
+	}
+	s.Freezes -= uint32(len(missed))
+	s.LastGoalDate = missed[len(missed)-1]
+	return missed, false
+}
+
+// applyRollover 对 s 执行 rollover 并记录使用了补签卡的日子，需要在事务中调用
+func (s *UserStreak) applyRollover(ctx context.Context, tx *gorm.DB, today string) (frozen []string, broken bool, err error) {
+	frozen, broken = s.rollover(today)
+	for _, date := range frozen {
+		if err = tx.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "date"}},
+			DoUpdates: clause.AssignmentColumns([]string{"frozen"}),
+		}).Create(&DailyActivity{UserID: s.UserID, Date: date, Frozen: true}).Error; err != nil {
+			return nil, false, irr.Wrap(err, "record frozen day %s of user %d failed", date, s.UserID)
+		}
+	}
+	return frozen, broken, nil
+}
+
+// lockUserStreak 在事务中获取并锁定用户的连续打卡记录，不存在时以默认设置创建
+func lockUserStreak(ctx context.Context, tx *gorm.DB, userID utils.UInt64) (*UserStreak, error) {
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&UserStreak{
+		UserID:     userID,
+		Timezone:   "UTC",
+		GoalType:   GoalTypeReviews,
+		GoalTarget: 1,
+	}).Error; err != nil {
+		return nil, irr.Wrap(err, "create streak of user %d failed", userID)
+	}
+	streak := &UserStreak{}
+	if err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ?", userID).First(streak).Error; err != nil {
+		return nil, irr.Wrap(err, "get streak of user %d failed", userID)
+	}
+	return streak, nil
+}
+
+func saveUserStreak(ctx context.Context, tx *gorm.DB, streak *UserStreak) error {
+	if err := tx.WithContext(ctx).Model(streak).
+		Select("timezone", "goal_type", "goal_target", "current_streak", "longest_streak", "last_goal_date", "freezes").
+		Updates(streak).Error; err != nil {
+		return irr.Wrap(err, "save streak of user %d failed", streak.UserID)
+	}
+	return nil
+}
+
+// RecordPracticeActivity 记录一次生效的作答，达成当天的目标时更新连续打卡。需要在作答的事务中调用。
+// 离线同步的作答按作答的日期记录，早于最后打卡日期的作答只计入当天的统计，不会修复已经中断的连续打卡
+func RecordPracticeActivity(ctx context.Context, tx *gorm.DB, userID utils.UInt64, at time.Time, points utils.UInt64) error {
+	streak, err := lockUserStreak(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	date := streak.DateOf(at)
+
+	if err = tx.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "date"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"reviews":    gorm.Expr("reviews + ?", 1),
+			"points":     gorm.Expr("points + ?", points),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&DailyActivity{UserID: userID, Date: date, Reviews: 1, Points: points}).Error; err != nil {
+		return irr.Wrap(err, "record activity of user %d on %s failed", userID, date)
+	}
+	day := &DailyActivity{}
+	if err = tx.WithContext(ctx).Where("user_id = ? AND date = ?", userID, date).First(day).Error; err != nil {
+		return irr.Wrap(err, "get activity of user %d on %s failed", userID, date)
+	}
+	if day.GoalMet || !streak.GoalMet(day) {
+		return nil
+	}
+	if err = tx.WithContext(ctx).Model(day).Where("user_id = ? AND date = ?", userID, date).Update("goal_met", true).Error; err != nil {
+		return irr.Wrap(err, "mark goal of user %d on %s failed", userID, date)
+	}
+	if date <= streak.LastGoalDate {
+		return nil
+	}
+
+	if _, _, err = streak.applyRollover(ctx, tx, date); err != nil {
+		return err
+	}
+	if streak.CurrentStreak > 0 && addDays(streak.LastGoalDate, 1) == date {
+		streak.CurrentStreak++
+	} else {
+		streak.CurrentStreak = 1
+	}
+	streak.LastGoalDate = date
+	streak.LongestStreak = max(streak.LongestStreak, streak.CurrentStreak)
+	if err = saveUserStreak(ctx, tx, streak); err != nil {
+		return err
+	}
+	return PublishEvents(ctx, tx, StreakReached{UserID: userID, Streak: streak.CurrentStreak, Date: date})
+}
+
+// GetUserStreak 获取用户的连续打卡 (先处理到今天为止的 rollover) 和最近 days 天的统计，最新的在前
+func GetUserStreak(ctx context.Context, db *gorm.DB, userID utils.UInt64, now time.Time, days int) (*UserStreak, []*DailyActivity, error) {
+	var (
+		streak *UserStreak
+		recent []*DailyActivity
+	)
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if streak, err = lockUserStreak(ctx, tx, userID); err != nil {
+			return err
+		}
+		today := streak.DateOf(now)
+		frozen, broken, err := streak.applyRollover(ctx, tx, today)
+		if err != nil {
+			return err
+		}
+		if len(frozen) > 0 || broken {
+			if err = saveUserStreak(ctx, tx, streak); err != nil {
+				return err
+			}
+		}
+		if err = tx.Where("user_id = ? AND date > ? AND date <= ?", userID, addDays(today, -days), today).
+			Order("date DESC").Find(&recent).Error; err != nil {
+			return irr.Wrap(err, "get recent activities of user %d failed", userID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return streak, recent, nil
+}
+
+// UpdateStreakSettings 修改每日目标和时区，参数为空时不修改
+func UpdateStreakSettings(ctx context.Context, db *gorm.DB, userID utils.UInt64, goalType *GoalType, goalTarget *uint32, timezone *string) (*UserStreak, error) {
+	if goalType != nil && !goalType.Valid() {
+		return nil, irr.Wrap(ErrInvalidGoal, "goal type %q", *goalType)
+	}
+	if goalTarget != nil && (*goalTarget == 0 || *goalTarget > MaxGoalTarget) {
+		return nil, irr.Wrap(ErrInvalidGoal, "goal target should be in [1, %d]", MaxGoalTarget)
+	}
+	if timezone != nil {
+		if _, err := time.LoadLocation(*timezone); err != nil || *timezone == "" || *timezone == "Local" {
+			return nil, irr.Wrap(ErrInvalidTimezone, "timezone %q", *timezone)
+		}
+	}
+
+	var streak *UserStreak
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if streak, err = lockUserStreak(ctx, tx, userID); err != nil {
+			return err
+		}
+		if goalType != nil {
+			streak.GoalType = *goalType
+		}
+		if goalTarget != nil {
+			streak.GoalTarget = *goalTarget
+		}
+		if timezone != nil {
+			streak.Timezone = *timezone
+		}
+		return saveUserStreak(ctx, tx, streak)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return streak, nil
+}
+
+// BuyStreakFreezes 用 Gem 购买补签卡。idempotencyKey 相同的购买只生效一次，重复的购买返回 false
+func BuyStreakFreezes(ctx context.Context, db *gorm.DB, userID utils.UInt64, count uint32, idempotencyKey string) (*UserStreak, bool, error) {
+	if count == 0 || count > MaxStreakFreezes {
+		return nil, false, irr.Wrap(ErrInvalidFreezeCount, "count should be in [1, %d]", MaxStreakFreezes)
+	}
+
+	var (
+		streak  *UserStreak
+		applied bool
+	)
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if streak, err = lockUserStreak(ctx, tx, userID); err != nil {
+			return err
+		}
+		if _, applied, err = ApplyPointChange(ctx, tx, PointChange{
+			UserID:         userID,
+			Currency:       CurrencyGem,
+			Delta:          -int64(count) * StreakFreezePrice,
+			Reason:         PointReasonStreakFreeze,
+			IdempotencyKey: idempotencyKey,
+		}); err != nil || !applied {
+			return err
+		}
+		// 超出上限时回滚扣除的 Gem
+		if streak.Freezes+count > MaxStreakFreezes {
+			return irr.Wrap(ErrTooManyFreezes, "user %d has %d, at most %d", userID, streak.Freezes, MaxStreakFreezes)
+		}
+		streak.Freezes += count
+		return saveUserStreak(ctx, tx, streak)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return streak, applied, nil
+}
+
+// RolloverStreaks 处理所有进行中的连续打卡在各自时区的日期变化: 昨天及之前没有达成目标的日子使用补签卡或者中断连续打卡。
+// 重复执行是安全的，返回使用了补签卡和中断的用户数
+func RolloverStreaks(ctx context.Context, db *gorm.DB, now time.Time) (frozen, broken int, err error) {
+	var lastID utils.UInt64
+	for {
+		var userIDs []utils.UInt64
+		if err = db.WithContext(ctx).Model(&UserStreak{}).Where("current_streak > 0 AND user_id > ?", lastID).
+			Order("user_id ASC").Limit(rolloverBatchSize).Pluck("user_id", &userIDs).Error; err != nil {
+			return frozen, broken, irr.Wrap(err, "get active streaks failed")
+		}
+		for _, userID := range userIDs {
+			err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				streak, err := lockUserStreak(ctx, tx, userID)
+				if err != nil {
+					return err
+				}
+				days, isBroken, err := streak.applyRollover(ctx, tx, streak.DateOf(now))
+				if err != nil || (len(days) == 0 && !isBroken) {
+					return err
+				}
+				if len(days) > 0 {
+					frozen++
+				}
+				if isBroken {
+					broken++
+				}
+				return saveUserStreak(ctx, tx, streak)
+			})
+			if err != nil {
+				return frozen, broken, err
+			}
+		}
+		if len(userIDs) < rolloverBatchSize {
+			return frozen, broken, nil
+		}
+		lastID = userIDs[len(userIDs)-1]
+	}
+}
+
+// StartStreakRolloverJob 定期执行 RolloverStreaks，直到 ctx 结束。各个时区在不同的时刻进入新的一天，因此 interval 不应该超过一小时。
+// 多实例部署时通过分布式锁避免同时执行
+func StartStreakRolloverJob(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	log := wlog.ByCtx(ctx, "StreakRolloverJob")
+	run := func() {
+		err := cache.Locker(ctx).Execute(ctx, "streak_rollover", time.Minute, func() error {
+			frozen, broken, err := RolloverStreaks(ctx, db, time.Now())
+			log.Infof("streak rollover finished, frozen= %d, broken= %d", frozen, broken)
+			return err
+		})
+		if errors.Is(err, cache.ErrFailedToAcquireLock) {
+			log.Debugf("streak rollover is running on another instance")
+		} else if err != nil {
+			log.WithError(err).Error("streak rollover failed")
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		run()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				run()
+			}
+		}
+	}()
+}
@@ -2,13 +2,15 @@ package model
 
 import (
 	"context"
+	"strings"
 	"time"
 
-	"github.com/adjust/redismq"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/bagaking/goulp/wlog"
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
 	"github.com/bagaking/memorianexus/pkg/tags"
 	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
@@ -54,7 +56,7 @@ func (t TagRepo) GetTag(ctx context.Context, tag string) (*tags.Tag[EntityType],
 
 func (t TagRepo) GetTagsByUser(ctx context.Context, userID utils.UInt64) ([]string, error) {
 	var tags []string
-	if err := t.db.WithContext(ctx).Model(&Tag{}).Where("user_id = ?", userID).Pluck("tag", &tags).Error; err != nil {
+	if err := t.db.WithContext(ctx).Model(&Tag{}).Where("user_id = ?", userID).Distinct("tag").Pluck("tag", &tags).Error; err != nil {
 		return nil, irr.Wrap(err, "failed to get tags by user")
 	}
 
@@ -98,12 +100,14 @@ func (t TagRepo) RemoveTags(ctx context.Context, userID utils.UInt64, entityID u
 	return nil
 }
 
+// RenameTag 重命名用户的标签，子标签会一起移动，见 RenameUserTag
 func (t TagRepo) RenameTag(ctx context.Context, userID utils.UInt64, oldTag, newTag string) error {
-	if err := t.db.WithContext(ctx).Model(&Tag{}).Where("user_id = ? AND tag = ?", userID, oldTag).Update("tag", newTag).Error; err != nil {
-		return irr.Wrap(err, "failed to rename tag")
-	}
-
-	return nil
+	return t.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if _, err := RenameUserTag(ctx, tx, userID, oldTag, newTag); err != nil {
+			return irr.Wrap(err, "failed to rename tag")
+		}
+		return nil
+	})
 }
 
 func (t TagRepo) GetTagsByEntity(ctx context.Context, entityID utils.UInt64) ([]string, error) {
@@ -130,31 +134,56 @@ const (
 	EntityTypeDungeon EntityType = 3
 )
 
-var tagModel *TModel
+// TagEntityTypes 支持打标签的 entity 类型
+var TagEntityTypes = []EntityType{
+	EntityTypeItem,
+	EntityTypeBook,
+	EntityTypeDungeon,
+}
 
-func MustInit(ctx context.Context, db *gorm.DB, queue *redismq.Queue) {
-	producer := tags.NewRedisMQProducer(queue)
-	consumer, err := tags.NewRedisMQConsumer(queue, "tag_consumer")
-	if err != nil {
-		wlog.ByCtx(ctx, "model.MustInit").WithError(err).Fatalf("failed to create redis mq consumer")
+// ParseEntityType 解析 entity 类型的名字，如 item、book、dungeon
+func ParseEntityType(name string) (EntityType, bool) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "item", "items":
+		return EntityTypeItem, true
+	case "book", "books":
+		return EntityTypeBook, true
+	case "dungeon", "dungeons":
+		return EntityTypeDungeon, true
+	default:
+		return 0, false
 	}
+}
+
+var tagModel *TModel
+
+func init() {
+	// 事务提交前的并发读可能把旧的标签写回缓存，提交后再清理一次
+	eventbus.SubscribeAsync(events, "tag.cache", func(ctx context.Context, e ItemTagsChanged) error {
+		return TagModel().ClearEntityTags(ctx, tags.EntityTagChange[EntityType]{
+			UserID: e.UserID, EntityID: e.EntityID, EntityType: e.EntityType, Tags: e.Tags,
+		})
+	})
+}
 
+// MustInit 初始化标签服务，producer 和 consumer 是标签缓存失效消息使用的队列 (见 tags.ChanQueue 和 tags.RedisStreamQueue)，
+// opts 用于配置消息的重试策略和死信存储
+func MustInit(ctx context.Context, db *gorm.DB, producer tags.Producer, consumer tags.Consumer, opts ...tags.UpdateOption) {
 	tagService := tags.NewTagService[EntityType](
 		ctx,
 		&TagRepo{
 			db: db,
 		},
-		[]EntityType{
-			EntityTypeItem,
-			EntityTypeBook,
-			EntityTypeDungeon,
-		},
+		TagEntityTypes,
 		producer, consumer,
+		opts...,
 	)
 
 	tagModel = &TModel{
 		TagService: tagService,
 	}
+	initItemSearcher(ctx, db)
+	initEvents(db)
 }
 
 func TagModel() *TModel {
@@ -166,38 +195,41 @@ func (Tag) TableName() string {
 }
 
 // AddEntityTags adds tags to an entity for a user.
-func AddEntityTags(ctx context.Context, tx *gorm.DB, userID utils.UInt64, entityType EntityType, entityID utils.UInt64, tags ...string) error {
-	if len(tags) == 0 {
+// tags 会被规范化为层级路径 (见 tags.NormalizeTag)，之前被移除的同名标签会被恢复
+func AddEntityTags(ctx context.Context, tx *gorm.DB, userID utils.UInt64, entityType EntityType, entityID utils.UInt64, tagsToAdd ...string) error {
+	if len(tagsToAdd) == 0 {
 		wlog.ByCtx(ctx, "AddEntityTags").WithField("user_id", userID).WithField("entity_id", entityID).
 			Warnf("cannot add tags with empty list")
 		return nil
 	}
-	tagModels := make([]Tag, len(tags))
-	for i, tag := range tags {
+	tagsToAdd, err := tags.NormalizeTags(tagsToAdd)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tagModels := make([]Tag, len(tagsToAdd))
+	for i, tag := range tagsToAdd {
 		tagModels[i] = Tag{
 			UserID:     userID,
 			Tag:        tag,
 			EntityID:   entityID,
 			EntityType: entityType,
-			CreatedAt:  time.Now(),
-			UpdatedAt:  time.Now(),
+			CreatedAt:  now,
+			UpdatedAt:  now,
 		}
 	}
 
-	if err := tx.Create(&tagModels).Error; err != nil {
+	if err = tx.Clauses(clause.OnConflict{
+		DoUpdates: clause.Assignments(map[string]any{"deleted_at": nil, "entity_type": entityType, "updated_at": now}),
+	}).Create(&tagModels).Error; err != nil {
 		return irr.Wrap(err, "failed to add entity tag")
 	}
 
 	// Invalidate relevant caches
-	if err := TagModel().InvalidateEntityCache(ctx, entityID, true); err != nil {
-		return err
-	}
-	// all user's tag-related cache should be cleared
-	// todo: consider to clear only the cache with the entity type
-	if err := invalidateTagsCache(ctx, tags...); err != nil {
-		return err
-	}
-	return nil
+	return publishTagChanges(ctx, tx, tags.EntityTagChange[EntityType]{
+		UserID: userID, EntityID: entityID, EntityType: entityType, Tags: tagsToAdd,
+	})
 }
 
 // RemoveEntityTags removes tags from an entity for a user.
@@ -208,21 +240,212 @@ func RemoveEntityTags(ctx context.Context, tx *gorm.DB, userID utils.UInt64, ent
 		return nil
 	}
 
+	// 被移除的标签所在 entity 的类型，没有匹配的标签时不需要清理缓存
+	var entityTypes []EntityType
+	if err := tx.Model(&Tag{}).Where("user_id = ? AND tag IN ? AND entity_id = ?", userID, tagsToRemove, entityID).
+		Distinct("entity_type").Pluck("entity_type", &entityTypes).Error; err != nil {
+		return irr.Wrap(err, "failed to find entity tags")
+	}
+	if len(entityTypes) == 0 {
+		return nil
+	}
 	if err := tx.Model(&Tag{}).Where("user_id = ? AND tag IN ? AND entity_id = ?", userID, tagsToRemove, entityID).Update("deleted_at", time.Now()).Error; err != nil {
 		return irr.Wrap(err, "failed to remove entity tag")
 	}
 
 	// Invalidate relevant caches
-	if err := TagModel().InvalidateEntityCache(ctx, entityID, true); err != nil {
+	changes := typer.SliceMap(entityTypes, func(et EntityType) tags.EntityTagChange[EntityType] {
+		return tags.EntityTagChange[EntityType]{
+			UserID: userID, EntityID: entityID, EntityType: et, Tags: tagsToRemove,
+		}
+	})
+	return publishTagChanges(ctx, tx, changes...)
+}
+
+// RenameUserTag 重命名 (移动) 用户的标签，整个子树会一起移动，如 lang/ja => jp 时 lang/ja/kanji => jp/kanji
+// 目标位置上已经存在的相同 entity 标签会被合并，返回受影响的标签记录数
+func RenameUserTag(ctx context.Context, tx *gorm.DB, userID utils.UInt64, from, to string) (int, error) {
+	from, err := tags.NormalizeTag(from)
+	if err != nil {
+		return 0, err
+	}
+	if to, err = tags.NormalizeTag(to); err != nil {
+		return 0, err
+	}
+	if from == to {
+		return 0, nil
+	}
+	if tags.InSubtree(to, from) {
+		return 0, irr.Wrap(tags.ErrInvalidTag, "cannot move tag %s into its own subtree %s", from, to)
+	}
+
+	var rows []Tag
+	if err = tx.WithContext(ctx).Where("user_id = ? AND (tag = ? OR tag LIKE ?)", userID, from, likeSubtree(from)).
+		Find(&rows).Error; err != nil {
+		return 0, irr.Wrap(err, "failed to find tags of subtree %s", from)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	changes := make([]tags.EntityTagChange[EntityType], 0, len(rows))
+	for _, row := range rows {
+		newTag := tags.Rebase(row.Tag, from, to)
+		if len(newTag) > tags.MaxTagLength {
+			return 0, irr.Wrap(tags.ErrInvalidTag, "tag is too long after rename, tag= %s", newTag)
+		}
+		moved := Tag{
+			UserID:     row.UserID,
+			Tag:        newTag,
+			EntityID:   row.EntityID,
+			EntityType: row.EntityType,
+			CreatedAt:  row.CreatedAt,
+			UpdatedAt:  now,
+		}
+		if err = tx.WithContext(ctx).Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]any{"deleted_at": nil, "entity_type": row.EntityType, "updated_at": now}),
+		}).Create(&moved).Error; err != nil {
+			return 0, irr.Wrap(err, "failed to move tag %s to %s", row.Tag, newTag)
+		}
+		if err = tx.WithContext(ctx).Unscoped().Where("user_id = ? AND tag = ? AND entity_id = ?", row.UserID, row.Tag, row.EntityID).
+			Delete(&Tag{}).Error; err != nil {
+			return 0, irr.Wrap(err, "failed to delete tag %s", row.Tag)
+		}
+		changes = append(changes, tags.EntityTagChange[EntityType]{
+			UserID: userID, EntityID: row.EntityID, EntityType: row.EntityType, Tags: []string{row.Tag, newTag},
+		})
+	}
+
+	if err = publishTagChanges(ctx, tx, changes...); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// publishTagChanges 清理标签变更涉及的缓存，并在 tx 中发布 ItemTagsChanged。
+// 依赖标签的异步处理 (缓存的再次清理、campaign 的 monsters 随 items 的标签增减) 在事务提交后才会收到变更，读到的是提交后的标签
+func publishTagChanges(ctx context.Context, tx *gorm.DB, changes ...tags.EntityTagChange[EntityType]) error {
+	if err := TagModel().ClearEntityTags(ctx, changes...); err != nil {
+		return err
+	}
+	evs := make([]eventbus.Event, 0, len(changes))
+	for _, change := range changes {
+		evs = append(evs, ItemTagsChanged{
+			UserID: change.UserID, EntityID: change.EntityID, EntityType: change.EntityType, Tags: change.Tags,
+		})
+	}
+	return PublishEvents(ctx, tx, evs...)
+}
+
+// ErrTagExists 重命名的目标标签已经被使用
+var ErrTagExists = irr.Error("tag already exists")
+
+// UserTagExists 判断用户是否已经使用了 tag 或它的子标签。
+// 在事务中调用时锁住查询的范围，并发的重命名到同一个标签时依次执行，后执行的能看到先执行的结果
+func UserTagExists(ctx context.Context, tx *gorm.DB, userID utils.UInt64, tag string) (bool, error) {
+	var count int64
+	if err := tx.WithContext(ctx).Model(&Tag{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ? AND (tag = ? OR tag LIKE ?)", userID, tag, likeSubtree(tag)).
+		Limit(1).Count(&count).Error; err != nil {
+		return false, irr.Wrap(err, "failed to check tag %s", tag)
+	}
+	return count > 0, nil
+}
+
+// DeleteUserTag 把用户的标签 (包括所有子标签) 从所有 entity 上移除，返回受影响的标签记录数
+func DeleteUserTag(ctx context.Context, tx *gorm.DB, userID utils.UInt64, tag string) (int, error) {
+	tag, err := tags.NormalizeTag(tag)
+	if err != nil {
+		return 0, err
+	}
+
+	var rows []Tag
+	if err = tx.WithContext(ctx).Where("user_id = ? AND (tag = ? OR tag LIKE ?)", userID, tag, likeSubtree(tag)).
+		Find(&rows).Error; err != nil {
+		return 0, irr.Wrap(err, "failed to find tags of subtree %s", tag)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	if err = tx.WithContext(ctx).Where("user_id = ? AND (tag = ? OR tag LIKE ?)", userID, tag, likeSubtree(tag)).
+		Delete(&Tag{}).Error; err != nil {
+		return 0, irr.Wrap(err, "failed to delete tags of subtree %s", tag)
+	}
+
+	changes := typer.SliceMap(rows, func(row Tag) tags.EntityTagChange[EntityType] {
+		return tags.EntityTagChange[EntityType]{
+			UserID: userID, EntityID: row.EntityID, EntityType: row.EntityType, Tags: []string{row.Tag},
+		}
+	})
+	if err = publishTagChanges(ctx, tx, changes...); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// FindUserEntityTypes 查找属于用户的 entity 及其类型，不存在或不属于用户的 entity 不会出现在结果中
+func FindUserEntityTypes(ctx context.Context, tx *gorm.DB, userID utils.UInt64, entityIDs []utils.UInt64) (map[utils.UInt64]EntityType, error) {
+	result := make(map[utils.UInt64]EntityType, len(entityIDs))
+	if len(entityIDs) == 0 {
+		return result, nil
+	}
+
+	lookups := []struct {
+		model      any
+		ownerField string
+		entityType EntityType
+	}{
+		{&Item{}, "creator_id", EntityTypeItem},
+		{&Book{}, "user_id", EntityTypeBook},
+		{&Dungeon{}, "user_id", EntityTypeDungeon},
+	}
+	for _, lookup := range lookups {
+		var ids []utils.UInt64
+		if err := tx.WithContext(ctx).Model(lookup.model).Where(lookup.ownerField+" = ? AND id IN ?", userID, entityIDs).
+			Pluck("id", &ids).Error; err != nil {
+			return nil, irr.Wrap(err, "failed to find entities of type %d", lookup.entityType)
+		}
+		for _, id := range ids {
+			result[id] = lookup.entityType
+		}
+	}
+	return result, nil
+}
+
+// BulkUpdateEntityTags 批量给 entities 添加和移除标签，entities 的类型需要事先确定 (见 FindUserEntityTypes)
+// 同一个标签同时出现在 toAdd 和 toRemove 中时，以添加为准
+func BulkUpdateEntityTags(ctx context.Context, tx *gorm.DB, userID utils.UInt64, entities map[utils.UInt64]EntityType, toAdd, toRemove []string) error {
+	toAdd, err := tags.NormalizeTags(toAdd)
+	if err != nil {
 		return err
 	}
-	if err := invalidateTagsCache(ctx, tagsToRemove...); err != nil {
+	if toRemove, err = tags.NormalizeTags(toRemove); err != nil {
 		return err
 	}
+	_, toRemove = typer.SliceDiff(toRemove, toAdd)
 
+	for entityID, entityType := range entities {
+		if len(toAdd) > 0 {
+			if err = AddEntityTags(ctx, tx, userID, entityType, entityID, toAdd...); err != nil {
+				return irr.Wrap(err, "failed to add tags to entity %d", entityID)
+			}
+		}
+		if len(toRemove) > 0 {
+			if err = RemoveEntityTags(ctx, tx, userID, entityID, toRemove...); err != nil {
+				return irr.Wrap(err, "failed to remove tags from entity %d", entityID)
+			}
+		}
+	}
 	return nil
 }
 
+// likeSubtree 构造匹配 tag 所有子孙标签的 LIKE 模式
+func likeSubtree(tag string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(tag)
+	return escaped + tags.PathSeparator + "%"
+}
+
 // FindItemsOfTag returns the items
 func FindItemsOfTag(ctx context.Context, tx *gorm.DB, userID utils.UInt64, tag string, pager *utils.Pager) ([]Item, error) {
 	entityType := EntityTypeItem
@@ -253,23 +476,27 @@ func FindBooksOfTag(ctx context.Context, tx *gorm.DB, userID utils.UInt64, tag s
 }
 
 // UpdateEntityTagsDiff handles the difference between the tags of an entity and the new tags.
-func UpdateEntityTagsDiff(ctx context.Context, tx *gorm.DB, userID utils.UInt64, entityID utils.UInt64, tags []string) error {
+func UpdateEntityTagsDiff(ctx context.Context, tx *gorm.DB, userID utils.UInt64, entityID utils.UInt64, newTags []string) error {
 	log := wlog.ByCtx(ctx, "UpdateEntityTagsDiff")
+	newTags, err := tags.NormalizeTags(newTags)
+	if err != nil {
+		return err
+	}
 	tagsExist, err := TagModel().GetTagsOfEntity(ctx, entityID)
 	if err != nil {
 		return irr.Wrap(err, "failed to get exist tags")
 	}
 	if len(tagsExist) == 0 {
-		if len(tags) > 0 {
-			if err = AddEntityTags(ctx, tx, userID, EntityTypeItem, entityID, tags...); err != nil {
+		if len(newTags) > 0 {
+			if err = AddEntityTags(ctx, tx, userID, EntityTypeItem, entityID, newTags...); err != nil {
 				return irr.Wrap(err, "failed to add tags")
 			}
 		}
 		return nil
 	}
 
-	toAdd, toRemove := typer.SliceDiff(tagsExist, tags)
-	log.Debugf("diffLists, add= %v, rem= %v, from= %v, to= %v", toAdd, toRemove, tagsExist, tags)
+	toAdd, toRemove := typer.SliceDiff(tagsExist, newTags)
+	log.Debugf("diffLists, add= %v, rem= %v, from= %v, to= %v", toAdd, toRemove, tagsExist, newTags)
 	if len(toAdd) > 0 {
 		if err = AddEntityTags(ctx, tx, userID, EntityTypeItem, entityID, toAdd...); err != nil {
 			return irr.Wrap(err, "failed to add tags")
@@ -282,13 +509,3 @@ func UpdateEntityTagsDiff(ctx context.Context, tx *gorm.DB, userID utils.UInt64,
 	}
 	return nil
 }
-
-// invalidateTagsCache invalidates caches related to a given tag.
-func invalidateTagsCache(ctx context.Context, tags ...string) error {
-	for _, tag := range tags {
-		if err := TagModel().InvalidateTagCache(ctx, tag, true); err != nil {
-			return irr.Wrap(err, "failed to invalidate cache for tag")
-		}
-	}
-	return nil
-}
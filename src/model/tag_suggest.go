@@ -0,0 +1,64 @@
+package model
+
+import (
+	"context"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+)
+
+const (
+	// tagProfileMaxRows 统计标签推荐数据时最多读取的标签记录数，按更新时间倒序，只统计最近的使用习惯
+	tagProfileMaxRows = 5000
+	// tagProfileBatchSize 读取 items 内容时每批的数量
+	tagProfileBatchSize = 500
+)
+
+// LoadTagProfile 从 tags 表和 items 的内容统计用户的标签使用情况，用于推荐标签
+// 候选标签为用户的全部标签 (见 TagService.GetTagsByUser)
+func LoadTagProfile(ctx context.Context, tx *gorm.DB, userID utils.UInt64) (*tags.TagProfile, error) {
+	vocabulary, err := TagModel().GetTagsByUser(ctx, userID)
+	if err != nil {
+		return nil, irr.Wrap(err, "failed to get tags of user")
+	}
+	profile := tags.NewTagProfile(vocabulary)
+	if len(vocabulary) == 0 {
+		return profile, nil
+	}
+
+	var rows []Tag
+	if err = tx.WithContext(ctx).Select("entity_id", "entity_type", "tag").
+		Where("user_id = ?", userID).Order("updated_at DESC").Limit(tagProfileMaxRows).
+		Find(&rows).Error; err != nil {
+		return nil, irr.Wrap(err, "failed to get tag records of user")
+	}
+	entityTags := make(map[utils.UInt64][]string)
+	itemIDs := make([]utils.UInt64, 0)
+	for _, row := range rows {
+		if _, ok := entityTags[row.EntityID]; !ok && row.EntityType == EntityTypeItem {
+			itemIDs = append(itemIDs, row.EntityID)
+		}
+		entityTags[row.EntityID] = append(entityTags[row.EntityID], row.Tag)
+	}
+
+	contents := make(map[utils.UInt64]string, len(itemIDs))
+	for from := 0; from < len(itemIDs); from += tagProfileBatchSize {
+		var items []Item
+		batch := itemIDs[from:min(from+tagProfileBatchSize, len(itemIDs))]
+		if err = tx.WithContext(ctx).Select("id", "content").Where("id IN ? AND creator_id = ?", batch, userID).
+			Find(&items).Error; err != nil {
+			return nil, irr.Wrap(err, "failed to get contents of items")
+		}
+		for _, item := range items {
+			contents[item.ID] = item.Content
+		}
+	}
+
+	for id, t := range entityTags {
+		profile.Add(t, contents[id])
+	}
+	return profile, nil
+}
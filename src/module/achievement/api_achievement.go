@@ -0,0 +1,69 @@
+package achievement
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// GetAllAchievements handles listing all achievements with the progress of the current user
+// @Summary List achievements
+// @Description 获取所有成就的定义和当前用户的进度，按 id 排序。成就在对应的事件 (如创建学习材料、完美击败 monster、连续打卡) 累计到 threshold 时解锁并发放奖励
+// @Tags achievement
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} dto.RespAchievements "Successfully retrieved achievements"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /achievements [get]
+func (svr *Service) GetAllAchievements(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "GetAllAchievements").WithField("user_id", userID)
+
+	progress, err := model.GetUserAchievements(c, svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get achievements")
+		return
+	}
+
+	defs := model.Achievements()
+	achievements := make([]*dto.Achievement, 0, len(defs))
+	for _, def := range defs {
+		achievements = append(achievements, new(dto.Achievement).FromModel(def, progress[def.ID]))
+	}
+	new(dto.RespAchievements).With(achievements).Response(c, "achievements found")
+}
+
+// GetAchievementDetails handles retrieving an achievement with the progress of the current user
+// @Summary Get achievement details
+// @Description 获取成就的定义和当前用户的进度
+// @Tags achievement
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "Achievement ID"
+// @Success 200 {object} dto.RespAchievement "Successfully retrieved achievement"
+// @Failure 404 {object} utils.ErrorResponse "Achievement not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /achievements/{id} [get]
+func (svr *Service) GetAchievementDetails(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "GetAchievementDetails").WithField("user_id", userID).WithField("achievement_id", id)
+
+	def, err := model.GetAchievement(id)
+	if errors.Is(err, model.ErrAchievementNotFound) {
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "achievement not found")
+		return
+	}
+	progress, err := model.GetUserAchievements(c, svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get achievement progress")
+		return
+	}
+
+	new(dto.RespAchievement).With(new(dto.Achievement).FromModel(def, progress[id])).Response(c, "achievement found")
+}
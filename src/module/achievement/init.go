@@ -1,34 +1,29 @@
 package achievement
 
 import (
-	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
 )
 
 type Service struct {
-	// db *model.db
+	db *gorm.DB
 }
 
 var svr *Service
 
 func Init(db *gorm.DB) (*Service, error) {
 	svr = &Service{
-		// db: model.NewRepo(db),
+		db: db,
 	}
 	return svr, nil
 }
 
 func (svr *Service) ApplyMux(group gin.IRouter) {
-	group.GET("/", svr.GetAllAchievements)
+	group.GET("", svr.GetAllAchievements)
 	idGroup := group.Group("/:id").Use(utils.GinMWParseID())
 	{
 		idGroup.GET("", svr.GetAchievementDetails)
 	}
 }
-
-func (svr *Service) GetAllAchievements(context *gin.Context) {
-}
-
-func (svr *Service) GetAchievementDetails(context *gin.Context) {
-}
@@ -114,19 +114,13 @@ func (svr *Service) GetBook(c *gin.Context) {
 	id := utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "GetBook").WithField("user_id", userID).WithField("id", id)
 
-	book, err := model.FindBook(c, svr.db, id)
+	book, err := model.FindBook(c, svr.db, userID, id, model.ActionRead)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
 			return
 		}
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to fetch books")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching book"})
-		return
-	}
-
-	if book.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Error fetching book"})
 		return
 	}
 
@@ -135,7 +129,12 @@ func (svr *Service) GetBook(c *gin.Context) {
 		log.WithError(err).Warnf("Failed to fetch book tags")
 	}
 
-	new(dto.RespBookGet).With(new(dto.Book).FromModel(book, tags...)).Response(c, "book found")
+	fork, err := model.FindBookFork(c, svr.db, id)
+	if err != nil && !errors.Is(err, model.ErrNotForked) {
+		log.WithError(err).Warnf("Failed to fetch book fork")
+	}
+
+	new(dto.RespBookGet).With(new(dto.Book).FromModel(book, tags...).WithShareCode(book, userID).WithFork(fork)).Response(c, "book found")
 }
 
 // UpdateBook handles updating a book's information.
@@ -165,7 +164,8 @@ func (svr *Service) UpdateBook(c *gin.Context) {
 		Title:       req.Title,
 		Description: req.Description,
 	}
-	result := svr.db.Model(updater).Where("id = ? AND user_id = ?", bookID, userID).Updates(updater)
+	result := svr.db.Model(updater).Scopes(model.AuthzPolicy().Scope(userID, model.ResourceBook, model.ActionWrite)).
+		Where("books.id = ?", bookID).Updates(updater)
 
 	// 处理错误
 	if err := result.Error; err != nil {
@@ -186,6 +186,10 @@ func (svr *Service) UpdateBook(c *gin.Context) {
 		return
 	}
 
+	if err := model.RecordBookActivity(c, svr.db, bookID, userID, model.BookActivityUpdated, ""); err != nil {
+		log.WithError(err).Warnf("Failed to record book activity")
+	}
+
 	new(dto.RespBookUpdate).With(new(dto.Book).FromModel(updater)).Response(c, "book updated")
 }
 
@@ -204,9 +208,8 @@ func (svr *Service) DeleteBook(c *gin.Context) {
 
 	log := wlog.ByCtx(c, "DeleteBook").WithField("user_id", userID).WithField("book_id", id)
 
-	// 删除前校验所有者
-	var book model.Book
-	if err := svr.db.Where("id = ? AND user_id = ?", id, userID).First(&book).Error; err != nil {
+	// 删除前校验权限，只有所有者 (或被授予管理权限的用户) 可以删除
+	if _, err := model.FindBook(c, svr.db, userID, id, model.ActionManage); err != nil {
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found or permission denied")
 		return
 	}
@@ -222,6 +225,34 @@ func (svr *Service) DeleteBook(c *gin.Context) {
 		return
 	}
 
+	// 删除 fork 的来源记录
+	if err := model.DeleteBookFork(c, tx, id); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError,
+			irr.Wrap(err, "user=%v book_id=%v", userID, id), "failed to delete book fork")
+		return
+	}
+
+	// 删除成员和动态
+	if err := model.DeleteBookMembers(c, tx, id); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError,
+			irr.Wrap(err, "user=%v book_id=%v", userID, id), "failed to delete book members")
+		return
+	}
+	if err := model.DeleteBookActivities(c, tx, id); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError,
+			irr.Wrap(err, "user=%v book_id=%v", userID, id), "failed to delete book activities")
+		return
+	}
+	if err := model.DeleteBookChapters(c, tx, id); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError,
+			irr.Wrap(err, "user=%v book_id=%v", userID, id), "failed to delete book chapters")
+		return
+	}
+
 	// 删除书册
 	if err := tx.Delete(&model.Book{}, id).Error; err != nil {
 		tx.Rollback()
@@ -2,6 +2,7 @@ package book
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/bagaking/goulp/wlog"
 	"github.com/gin-gonic/gin"
@@ -14,7 +15,7 @@ import (
 
 // ListBooks handles retrieving a list of books with pagination.
 // @Summary Get list of books with pagination
-// @Description Get a paginated list of books for the user.
+// @Description Get a paginated list of books in the user's library, including books the user is a member of (with its role) and subscribed books (read-only).
 // @Tags book
 // @Accept json
 // @Produce json
@@ -27,18 +28,67 @@ func (svr *Service) ListBooks(c *gin.Context) {
 	pager := utils.GinGetPagerFromQuery(c)
 	log := wlog.ByCtx(c, "ListBooks").WithField("user_id", userID).WithField("pager", pager)
 
-	var books []*model.Book
-	result := svr.db.Where("user_id = ?", userID).Offset(pager.Offset).Limit(pager.Limit).Find(&books)
+	books, total, err := model.GetLibraryBooks(c, svr.db, userID, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Error fetching books")
+		return
+	}
+	pager.Total = total
 
-	if result.Error != nil {
-		log.WithError(result.Error).Errorf("Failed to fetch books for user %v", userID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching books"})
+	roles, err := model.GetBookRoles(c, svr.db, userID, books)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Error fetching book roles")
 		return
 	}
 
 	resp := new(dto.RespBooks).WithPager(pager).Append(
 		typer.SliceMap(books, func(book *model.Book) dto.Book {
-			return *(&dto.Book{}).FromModel(book)
+			d := (&dto.Book{}).FromModel(book).WithShareCode(book, userID)
+			if role, ok := roles[book.ID]; ok {
+				d.Role = role.String()
+			} else {
+				d.Subscribed = true
+			}
+			return *d
 		})...)
 	resp.Response(c, "books found")
 }
+
+// ListPublicBooks handles retrieving the public catalogue of books.
+// @Summary Get public books
+// @Description Get a paginated list of public books of all users, ordered by update time.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param search query string false "Filter by title"
+// @Param page query int false "Page number for pagination" default(1)
+// @Param limit query int false "Number of items per page" default(10)
+// @Success 200 {object} dto.RespBooks "Successfully retrieved public books"
+// @Router /books/public [get]
+func (svr *Service) ListPublicBooks(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	pager := utils.GinGetPagerFromQuery(c)
+	keyword := strings.TrimSpace(c.Query("search"))
+	log := wlog.ByCtx(c, "ListPublicBooks").WithField("user_id", userID).WithField("pager", pager).WithField("search", keyword)
+
+	books, total, err := model.GetPublicBooks(c, svr.db, keyword, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Error fetching public books")
+		return
+	}
+	pager.Total = total
+
+	subscribers, err := model.CountBookSubscribers(c, svr.db, typer.SliceMap(books, func(book *model.Book) utils.UInt64 {
+		return book.ID
+	}))
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Error counting subscribers")
+		return
+	}
+
+	resp := new(dto.RespBooks).WithPager(pager).Append(
+		typer.SliceMap(books, func(book *model.Book) dto.Book {
+			return *(&dto.Book{}).FromModel(book).WithSubscribers(subscribers[book.ID])
+		})...)
+	resp.Response(c, "public books found")
+}
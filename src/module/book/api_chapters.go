@@ -0,0 +1,290 @@
+package book
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// ListBookChapters handles retrieving the chapter tree of a book.
+// @Summary List book chapters
+// @Description Get the chapters of a book as a tree. Sibling chapters are listed in book order.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Success 200 {object} dto.RespBookChapters "Successfully retrieved chapters"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/{id}/chapters [get]
+func (svr *Service) ListBookChapters(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "ListBookChapters").WithField("user_id", userID).WithField("book_id", bookID)
+
+	chapters, err := model.GetBookChapters(c, svr.db, bookID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get chapters")
+		return
+	}
+
+	new(dto.RespBookChapters).With(dto.BuildChapterTree(chapters)).Response(c, "chapters found")
+}
+
+// CreateBookChapter handles adding a chapter to a book.
+// @Summary Create a chapter
+// @Description Create a chapter under the given parent chapter (top level when parent_id is empty). Use before or after to place it next to a sibling chapter; by default it is appended.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param body body ReqCreateChapter true "Chapter title, parent and placement"
+// @Success 201 {object} dto.RespBookChapter "Successfully created chapter"
+// @Failure 400 {object} utils.ErrorResponse "Invalid title or placement"
+// @Failure 404 {object} utils.ErrorResponse "Book or parent chapter not found"
+// @Router /books/{id}/chapters [post]
+func (svr *Service) CreateBookChapter(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "CreateBookChapter").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var req ReqCreateChapter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("title is required"), "invalid request body")
+		return
+	}
+
+	tx := svr.db.Begin()
+	chapter, err := model.CreateBookChapter(c, tx, bookID, req.ParentID, req.Title, req.Placement)
+	if err != nil {
+		tx.Rollback()
+		handleChapterError(c, log, err, "failed to create chapter")
+		return
+	}
+	if err = model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityChapterCreated, chapter.Title, chapter.ID); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+	if err = tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
+	c.JSON(http.StatusCreated, dto.RespBookChapter{
+		Message: "chapter created",
+		Data:    new(dto.BookChapter).FromModel(chapter),
+	})
+}
+
+// UpdateBookChapter handles renaming or moving a chapter.
+// @Summary Update a chapter
+// @Description Rename a chapter, and/or move it (with its items and sub-chapters) under another parent or next to a sibling chapter. A chapter cannot be moved into itself or its descendants.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param chapter_id path uint64 true "Chapter ID"
+// @Param body body ReqUpdateChapter true "New title, parent and placement"
+// @Success 200 {object} dto.RespBookChapter "Successfully updated chapter"
+// @Failure 400 {object} utils.ErrorResponse "Invalid title or placement, or the move would create a cycle"
+// @Failure 404 {object} utils.ErrorResponse "Book or chapter not found"
+// @Router /books/{id}/chapters/{chapter_id} [put]
+func (svr *Service) UpdateBookChapter(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "UpdateBookChapter").WithField("user_id", userID).WithField("book_id", bookID)
+
+	chapter, ok := svr.findChapter(c, log, bookID)
+	if !ok {
+		return
+	}
+	var req ReqUpdateChapter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if req.Title != nil {
+		if *req.Title = strings.TrimSpace(*req.Title); *req.Title == "" {
+			utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("title cannot be empty"), "invalid request body")
+			return
+		}
+	}
+
+	tx := svr.db.Begin()
+	moved := req.ParentID != nil || req.Before != 0 || req.After != 0
+	if moved {
+		parentID := chapter.ParentID
+		if req.ParentID != nil {
+			parentID = *req.ParentID
+		}
+		if err := model.MoveBookChapter(c, tx, chapter, parentID, req.Placement); err != nil {
+			tx.Rollback()
+			handleChapterError(c, log, err, "failed to move chapter")
+			return
+		}
+		// 章节的顺序决定了其中 items 在书中的顺序
+		if err := model.SyncBookMonsterPositions(c, tx, bookID); err != nil {
+			tx.Rollback()
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to sync dungeon monsters")
+			return
+		}
+	}
+	if req.Title != nil {
+		if err := tx.Model(chapter).Update("title", *req.Title).Error; err != nil {
+			tx.Rollback()
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update chapter")
+			return
+		}
+	}
+	if err := model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityChapterUpdated, chapter.Title, chapter.ID); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
+	new(dto.RespBookChapter).With(new(dto.BookChapter).FromModel(chapter)).Response(c, "chapter updated")
+}
+
+// DeleteBookChapter handles deleting a chapter.
+// @Summary Delete a chapter
+// @Description Delete a chapter. Its items and sub-chapters are kept and moved, in order, to the end of its parent.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param chapter_id path uint64 true "Chapter ID"
+// @Success 200 {object} dto.RespBookChapterDelete "Successfully deleted chapter"
+// @Failure 404 {object} utils.ErrorResponse "Book or chapter not found"
+// @Router /books/{id}/chapters/{chapter_id} [delete]
+func (svr *Service) DeleteBookChapter(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "DeleteBookChapter").WithField("user_id", userID).WithField("book_id", bookID)
+
+	chapter, ok := svr.findChapter(c, log, bookID)
+	if !ok {
+		return
+	}
+
+	tx := svr.db.Begin()
+	if err := model.DeleteBookChapter(c, tx, chapter); err != nil {
+		tx.Rollback()
+		handleChapterError(c, log, err, "failed to delete chapter")
+		return
+	}
+	if err := model.SyncBookMonsterPositions(c, tx, bookID); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to sync dungeon monsters")
+		return
+	}
+	if err := model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityChapterDeleted, chapter.Title, chapter.ID); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
+	new(dto.RespBookChapterDelete).With(chapter.ID).Response(c, "chapter deleted")
+}
+
+// MoveItemsInBook handles reordering items and moving them between chapters.
+// @Summary Reorder items of a book
+// @Description Move items of the book, in the given order, into a chapter (or out of all chapters when chapter_id is empty). Use before or after to place them next to an item of the target chapter; by default they are appended.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param body body ReqMoveItems true "Items to move, target chapter and placement"
+// @Success 200 {object} dto.RespBookItemsMove "Successfully moved items"
+// @Failure 400 {object} utils.ErrorResponse "Invalid placement"
+// @Failure 404 {object} utils.ErrorResponse "Book, chapter or item not found"
+// @Router /books/{id}/items/order [put]
+func (svr *Service) MoveItemsInBook(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "MoveItemsInBook").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var req ReqMoveItems
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if len(req.ItemIDs) == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("item_ids is required"), "invalid request body")
+		return
+	}
+
+	tx := svr.db.Begin()
+	if err := model.MoveBookItems(c, tx, bookID, req.ItemIDs, req.ChapterID, req.Placement); err != nil {
+		tx.Rollback()
+		handleChapterError(c, log, err, "failed to move items")
+		return
+	}
+	if err := model.SyncBookMonsterPositions(c, tx, bookID); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to sync dungeon monsters")
+		return
+	}
+	if err := model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityItemMoved, "", req.ItemIDs...); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
+	new(dto.RespBookItemsMove).With(typer.SliceMap(req.ItemIDs, func(itemID utils.UInt64) *dto.BookItem {
+		return &dto.BookItem{BookID: bookID, ItemID: itemID, ChapterID: req.ChapterID}
+	})).Response(c, "items moved")
+}
+
+// findChapter 查找路径中的章节，失败时已写入响应
+func (svr *Service) findChapter(c *gin.Context, log logrus.FieldLogger, bookID utils.UInt64) (*model.BookChapter, bool) {
+	var chapterID utils.UInt64
+	if err := chapterID.Scan(c.Param("chapter_id")); err != nil || chapterID == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("invalid chapter_id %s", c.Param("chapter_id")), "invalid chapter_id")
+		return nil, false
+	}
+	chapter, err := model.FindBookChapter(c, svr.db, bookID, chapterID)
+	if err != nil {
+		handleChapterError(c, log, err, "failed to find chapter")
+		return nil, false
+	}
+	return chapter, true
+}
+
+func handleChapterError(c *gin.Context, log logrus.FieldLogger, err error, msg string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "chapter or item not found")
+	case errors.Is(err, model.ErrChapterCycle), errors.Is(err, model.ErrInvalidPlacement):
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, msg)
+	default:
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, msg)
+	}
+}
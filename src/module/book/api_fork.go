@@ -0,0 +1,178 @@
+package book
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// ForkBook handles copying a readable book into the caller's account.
+// @Summary Fork a book
+// @Description Copy a book, its items (with new IDs) and their tags into the caller's account. The fork records its source so upstream changes can be pulled later.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param body body ReqForkBook false "Title of the fork, defaults to the source title"
+// @Success 201 {object} dto.RespBookFork "Successfully forked book"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/{id}/fork [post]
+func (svr *Service) ForkBook(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "ForkBook").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var req ReqForkBook
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+			return
+		}
+	}
+
+	source, err := model.FindBook(c, svr.db, userID, bookID, model.ActionRead)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book")
+		}
+		return
+	}
+
+	tx := svr.db.Begin()
+	fork, itemIDs, err := model.ForkBook(c, tx, userID, source, req.Title)
+	if err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to fork book")
+		return
+	}
+	if err = tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+	model.ReindexItems(c, svr.db, itemIDs...)
+
+	tags, err := fork.GetTags(c)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to fetch book tags")
+	}
+
+	c.JSON(http.StatusCreated, dto.RespBookFork{
+		Message: "book forked",
+		Data:    new(dto.Book).FromModel(fork, tags...).WithFork(&model.BookFork{BookID: fork.ID, SourceBookID: source.ID}),
+	})
+}
+
+// findUpstream 查找 fork 的来源，并确认用户仍然可以读取上游 book
+func (svr *Service) findUpstream(c *gin.Context, log logrus.FieldLogger, userID, bookID utils.UInt64) (*model.BookFork, bool) {
+	fork, err := model.FindBookFork(c, svr.db, bookID)
+	if err != nil {
+		if errors.Is(err, model.ErrNotForked) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book is not a fork")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book fork")
+		}
+		return nil, false
+	}
+	if err = model.Authorize(c, svr.db, userID, model.ResourceBook, fork.SourceBookID, model.ActionRead); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "upstream book is not accessible")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to authorize upstream book")
+		}
+		return nil, false
+	}
+	return fork, true
+}
+
+// GetUpstreamChanges handles comparing a fork with its upstream book.
+// @Summary Get upstream changes of a fork
+// @Description List items added, removed or modified in the upstream book since the last pull. Modified items carry a three-way diff (base, mine, theirs) per field.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Success 200 {object} dto.RespBookUpstream "Successfully retrieved upstream changes"
+// @Failure 404 {object} utils.ErrorResponse "Book is not a fork or upstream is not accessible"
+// @Router /books/{id}/upstream [get]
+func (svr *Service) GetUpstreamChanges(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "GetUpstreamChanges").WithField("user_id", userID).WithField("book_id", bookID)
+
+	fork, ok := svr.findUpstream(c, log, userID, bookID)
+	if !ok {
+		return
+	}
+
+	changes, err := model.DiffUpstream(c, svr.db, fork)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to diff upstream")
+		return
+	}
+
+	new(dto.RespBookUpstream).With(new(dto.BookUpstream).FromModel(fork, changes)).Response(c, "upstream changes found")
+}
+
+// PullUpstreamChanges handles applying picked upstream changes to a fork.
+// @Summary Pull upstream changes into a fork
+// @Description Apply the picked upstream changes. Added items are copied, removed items are taken out of the fork, and for modified items only the picked fields (all changed fields if none given) are overwritten.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param body body ReqPullUpstream true "Upstream changes to apply"
+// @Success 200 {object} dto.RespBookUpstream "Successfully pulled upstream changes"
+// @Failure 400 {object} utils.ErrorResponse "Invalid request body"
+// @Failure 404 {object} utils.ErrorResponse "Book is not a fork or upstream is not accessible"
+// @Failure 409 {object} utils.ErrorResponse "Picked change no longer exists upstream"
+// @Router /books/{id}/upstream [post]
+func (svr *Service) PullUpstreamChanges(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "PullUpstreamChanges").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var req ReqPullUpstream
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+
+	fork, ok := svr.findUpstream(c, log, userID, bookID)
+	if !ok {
+		return
+	}
+
+	tx := svr.db.Begin()
+	applied, touched, err := model.PullUpstream(c, tx, fork, req.Items)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, model.ErrUpstreamChangeNotFound) {
+			utils.GinHandleError(c, log, http.StatusConflict, err, "upstream change not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to pull upstream")
+		}
+		return
+	}
+	if err = model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityUpstreamPulled, "", touched...); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+	if err = tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+	model.ReindexItems(c, svr.db, touched...)
+
+	new(dto.RespBookUpstream).With(new(dto.BookUpstream).FromModel(fork, applied)).Response(c, "upstream changes pulled")
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
+	"github.com/sirupsen/logrus"
 
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/src/model"
@@ -21,13 +22,15 @@ import (
 
 // GetItemsOfBook handles retrieving a list of books with pagination.
 // @Summary Get item list of books with pagination
-// @Description Get a paginated list of items for the book.
+// @Description Get a paginated list of items for the book in book order. With chapter_id, only the items directly in that chapter are listed (0 for items not in any chapter).
 // @Tags book
 // @Accept json
 // @Produce json
+// @Param chapter_id query uint64 false "Only list the items of this chapter"
 // @Param page query int false "Page number for pagination" default(1)
 // @Param limit query int false "Number of items per page" default(10)
 // @Success 200 {object} dto.RespItemList "items of the book found"
+// @Failure 404 {object} utils.ErrorResponse "Chapter not found"
 // @Router /books/{id}/items [get]
 func (svr *Service) GetItemsOfBook(c *gin.Context) {
 	userID := utils.GinMustGetUserID(c)
@@ -35,10 +38,15 @@ func (svr *Service) GetItemsOfBook(c *gin.Context) {
 	pager := utils.GinGetPagerFromQuery(c)
 	log := wlog.ByCtx(c, "GetItemsOfBook").WithField("user_id", userID).WithField("book_id", bookID).WithField("pager", pager)
 
+	if chapterIDStr := c.Query("chapter_id"); chapterIDStr != "" {
+		svr.getItemsOfChapter(c, log, bookID, chapterIDStr, pager)
+		return
+	}
+
 	items, err := model.GetItemsOfBook(svr.db, bookID, pager.Offset, pager.Limit)
 	if err != nil {
-		log.WithError(err).Errorf("Failed to fetch books for user %v", userID)
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "error when fetching book items")
+		return
 	}
 
 	resp := new(dto.RespItemList)
@@ -56,6 +64,42 @@ func (svr *Service) GetItemsOfBook(c *gin.Context) {
 	resp.WithPager(pager).Response(c, "items of the book found")
 }
 
+func (svr *Service) getItemsOfChapter(c *gin.Context, log logrus.FieldLogger, bookID utils.UInt64, chapterIDStr string, pager *utils.Pager) {
+	var chapterID utils.UInt64
+	if err := chapterID.Scan(chapterIDStr); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid chapter_id")
+		return
+	}
+	if chapterID != 0 {
+		if _, err := model.FindBookChapter(c, svr.db, bookID, chapterID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				utils.GinHandleError(c, log, http.StatusNotFound, err, "chapter not found")
+			} else {
+				utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find chapter")
+			}
+			return
+		}
+	}
+
+	ids, total, err := model.GetItemIDsOfChapter(svr.db.WithContext(c), bookID, chapterID, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "error when fetching chapter items")
+		return
+	}
+	items, err := model.GetItemsInOrder(svr.db, ids)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "error when fetching chapter items")
+		return
+	}
+	pager.Total = total
+
+	resp := new(dto.RespItemList)
+	for _, item := range items {
+		resp.Append(new(dto.Item).FromModel(item))
+	}
+	resp.WithPager(pager).Response(c, "items of the chapter found")
+}
+
 // AddItemsToBook handles adding items to a book
 // @Summary Add items to a book
 // @Description Add a list of items to the specified book.
@@ -63,9 +107,10 @@ func (svr *Service) GetItemsOfBook(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path uint64 true "Book ID"
-// @Param body body ReqAddItems true "List of item IDs to add"
+// @Param body body ReqAddItems true "List of item IDs to add, and optionally the chapter to append them to"
 // @Success 200 {object} dto.SuccessResponse "items added to book successfully"
 // @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
+// @Failure 404 {object} utils.ErrorResponse "Item or chapter not found"
 // @Failure 500 {object} utils.ErrorResponse "Failed to upsert book items"
 // @Router /books/{id}/items [post]
 func (svr *Service) AddItemsToBook(c *gin.Context) {
@@ -79,22 +124,71 @@ func (svr *Service) AddItemsToBook(c *gin.Context) {
 		return
 	}
 
-	bookItems := typer.SliceMap(req.ItemIDs, func(from utils.UInt64) model.BookItem {
-		return model.BookItem{
-			BookID: bookID,
-			ItemID: from,
+	// 只能添加自己有读取权限的 items
+	itemIDs, err := model.FilterAuthorized(c, svr.db, userID, model.ResourceItem, req.ItemIDs, model.ActionRead)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to check items")
+		return
+	}
+	if len(itemIDs) != len(typer.SliceToTrueMap(req.ItemIDs)) {
+		err = irr.Error("some items are not found, items= %v, found= %v", req.ItemIDs, itemIDs)
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "item not found")
+		return
+	}
+
+	if req.ChapterID != 0 {
+		if _, err = model.FindBookChapter(c, svr.db, bookID, req.ChapterID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				utils.GinHandleError(c, log, http.StatusNotFound, err, "chapter not found")
+			} else {
+				utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find chapter")
+			}
+			return
 		}
-	})
+	}
 
+	tx := svr.db.Begin()
+	// 新的 items 按请求中的顺序追加到章节末尾，已在 book 中的 items 保持原来的位置
+	bookItems, err := model.NewBookItems(c, tx, bookID, req.ChapterID, itemIDs)
+	if err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to place book items")
+		return
+	}
 	// 使用 OnConflict 方法处理 upsert 逻辑
-	if err := svr.db.Clauses(clause.OnConflict{
+	if err = tx.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "book_id"}, {Name: "item_id"}},
 		DoNothing: true, // 如果冲突则不做任何操作
 	}).Create(&bookItems).Error; err != nil {
+		tx.Rollback()
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to upsert book items")
 		return
 	}
 
+	// 引用了这个 book 的复习计划 (包括订阅者的) 同步加入新的 items
+	if err = model.SyncBookMonsters(c, tx, bookID, itemIDs, nil); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to sync dungeon monsters")
+		return
+	}
+
+	if err = model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityItemAdded, "", itemIDs...); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+
+	if err = model.PublishEvents(c, tx, model.BookItemsChanged{UserID: userID, BookID: bookID, Added: itemIDs}); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to publish events")
+		return
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
 	new(dto.RespBookAddItems).With(typer.SliceMap(bookItems, func(from model.BookItem) *dto.BookItem {
 		return new(dto.BookItem).FromModel(&from)
 	})).Response(c, "items added to book successfully")
@@ -135,11 +229,37 @@ func (svr *Service) RemoveItemsFromBook(c *gin.Context) {
 		itemIDsUInt64 = append(itemIDsUInt64, id)
 	}
 
-	if err := svr.db.Where("book_id = ? AND item_id IN ?", bookID, itemIDsUInt64).Delete(&model.BookItem{}).Error; err != nil {
+	tx := svr.db.Begin()
+	if err := tx.Where("book_id = ? AND item_id IN ?", bookID, itemIDsUInt64).Delete(&model.BookItem{}).Error; err != nil {
+		tx.Rollback()
 		utils.GinHandleError(c, log, http.StatusBadRequest, err, "failed to remove book items")
 		return
 	}
 
+	// 引用了这个 book 的复习计划 (包括订阅者的) 同步移除由 book 带入的 items
+	if err := model.SyncBookMonsters(c, tx, bookID, nil, itemIDsUInt64); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to sync dungeon monsters")
+		return
+	}
+
+	if err := model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityItemRemoved, "", itemIDsUInt64...); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+
+	if err := model.PublishEvents(c, tx, model.BookItemsChanged{UserID: userID, BookID: bookID, Removed: itemIDsUInt64}); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to publish events")
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
 	new(dto.RespBookAddItems).With(typer.SliceMap(itemIDsUInt64, func(itemID utils.UInt64) *dto.BookItem {
 		return &dto.BookItem{
 			BookID: bookID,
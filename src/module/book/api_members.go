@@ -0,0 +1,211 @@
+package book
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// ListBookMembers handles retrieving the collaborators of a book.
+// @Summary List book members
+// @Description List the members of a book with their roles. The creator is always the first member with the owner role.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Success 200 {object} dto.RespBookMembers "Successfully retrieved members"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/{id}/members [get]
+func (svr *Service) ListBookMembers(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "ListBookMembers").WithField("user_id", userID).WithField("book_id", bookID)
+
+	book, err := model.FindBook(c, svr.db, userID, bookID, model.ActionRead)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book")
+		}
+		return
+	}
+
+	members, err := model.GetBookMembers(c, svr.db, book)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get members")
+		return
+	}
+
+	new(dto.RespBookMembers).With(members).Response(c, "members found")
+}
+
+// SetBookMember handles adding a member to a book or changing the role of a member.
+// @Summary Add or update a book member
+// @Description Add a user to a book as viewer, editor or owner, or change the role of an existing member. The role of the creator cannot be changed.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param user_id path uint64 true "Member user ID"
+// @Param body body ReqSetMember true "Role: viewer, editor or owner"
+// @Success 200 {object} dto.RespBookMember "Successfully updated member"
+// @Failure 400 {object} utils.ErrorResponse "Invalid role or the creator"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/{id}/members/{user_id} [put]
+func (svr *Service) SetBookMember(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "SetBookMember").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var memberID utils.UInt64
+	if err := memberID.Scan(c.Param("user_id")); err != nil || memberID == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("invalid user_id %s", c.Param("user_id")), "invalid user_id")
+		return
+	}
+	var req ReqSetMember
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if req.Role == nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("role is required"), "invalid request body")
+		return
+	}
+
+	book, err := model.FindBook(c, svr.db, userID, bookID, model.ActionManage)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book")
+		}
+		return
+	}
+
+	tx := svr.db.Begin()
+	member, err := model.SetBookMember(c, tx, book, memberID, *req.Role, userID)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, model.ErrBookCreatorRole) || errors.Is(err, model.ErrInvalidBookRole) {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "cannot set member")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to set member")
+		}
+		return
+	}
+	if err = model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityMemberSet, req.Role.String(), memberID); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+	if err = tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
+	new(dto.RespBookMember).With(member).Response(c, "member updated")
+}
+
+// RemoveBookMember handles removing a member from a book.
+// @Summary Remove a book member
+// @Description Remove a member from a book. Owners may remove any member except the creator; other members may only remove themselves (leave the book).
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param user_id path uint64 true "Member user ID"
+// @Success 200 {object} dto.RespBookMemberRemove "Successfully removed member"
+// @Failure 400 {object} utils.ErrorResponse "Cannot remove the creator"
+// @Failure 404 {object} utils.ErrorResponse "Book or member not found"
+// @Router /books/{id}/members/{user_id} [delete]
+func (svr *Service) RemoveBookMember(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "RemoveBookMember").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var memberID utils.UInt64
+	if err := memberID.Scan(c.Param("user_id")); err != nil || memberID == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("invalid user_id %s", c.Param("user_id")), "invalid user_id")
+		return
+	}
+
+	// 成员可以自己退出，移除其他成员需要管理权限
+	action := model.ActionManage
+	if memberID == userID {
+		action = model.ActionRead
+	}
+	book, err := model.FindBook(c, svr.db, userID, bookID, action)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book")
+		}
+		return
+	}
+
+	tx := svr.db.Begin()
+	removed, err := model.RemoveBookMember(c, tx, book, memberID)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, model.ErrBookCreatorRole) {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "cannot remove the creator")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to remove member")
+		}
+		return
+	}
+	if !removed {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusNotFound, irr.Error("member not found"), "member not found")
+		return
+	}
+	if err = model.RecordBookActivity(c, tx, bookID, userID, model.BookActivityMemberRemoved, "", memberID); err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		return
+	}
+	if err = tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
+		return
+	}
+
+	new(dto.RespBookMemberRemove).With(memberID).Response(c, "member removed")
+}
+
+// ListBookActivities handles retrieving the activity feed of a book.
+// @Summary Get book activities
+// @Description Get a paginated list of changes made to a book and its items by its members, newest first.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param page query int false "Page number for pagination" default(1)
+// @Param limit query int false "Number of items per page" default(10)
+// @Success 200 {object} dto.RespBookActivities "Successfully retrieved activities"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/{id}/activities [get]
+func (svr *Service) ListBookActivities(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	pager := utils.GinGetPagerFromQuery(c)
+	log := wlog.ByCtx(c, "ListBookActivities").WithField("user_id", userID).WithField("book_id", bookID).WithField("pager", pager)
+
+	activities, total, err := model.GetBookActivities(c, svr.db, bookID, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get activities")
+		return
+	}
+	pager.Total = total
+
+	new(dto.RespBookActivities).WithPager(pager).Append(activities...).Response(c, "activities found")
+}
@@ -0,0 +1,204 @@
+package book
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// SharePathPrefix 分享页面的路径前缀，页面由前端处理，再通过 GET /books/shared/:code 获取 book
+const SharePathPrefix = "/share/books/"
+
+func (svr *Service) bookShare(c *gin.Context, book *model.Book) *dto.BookShare {
+	share := &dto.BookShare{
+		BookID:     book.ID,
+		Visibility: book.Visibility.String(),
+	}
+	if !book.Visibility.Shared() || book.ShareCode == nil {
+		return share
+	}
+	share.ShareCode = *book.ShareCode
+	share.SharePath = SharePathPrefix + *book.ShareCode
+	if svr.shortener != nil {
+		share.ShortURL = svr.shortener(c, share.SharePath)
+	}
+	return share
+}
+
+// SetBookVisibility handles changing the visibility of a book.
+// @Summary Set book visibility
+// @Description Make a book private, unlisted (visible with the share link) or public (listed in the catalogue). Returns the share link of shared books.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param body body ReqSetVisibility true "Visibility: private, unlisted or public"
+// @Success 200 {object} dto.RespBookShare "Successfully updated visibility"
+// @Failure 400 {object} utils.ErrorResponse "Invalid visibility"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/{id}/visibility [put]
+func (svr *Service) SetBookVisibility(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "SetBookVisibility").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var req ReqSetVisibility
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if req.Visibility == nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("visibility is required"), "invalid request body")
+		return
+	}
+
+	book, err := model.FindBook(c, svr.db, userID, bookID, model.ActionManage)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book")
+		}
+		return
+	}
+
+	wasPublic := book.Visibility == def.BookVisibilityPublic
+	if err = svr.db.Transaction(func(tx *gorm.DB) error {
+		if err := model.SetBookVisibility(c, tx, book, *req.Visibility); err != nil {
+			return err
+		}
+		if wasPublic || book.Visibility != def.BookVisibilityPublic {
+			return nil
+		}
+		return model.PublishEvents(c, tx, model.BookPublished{UserID: book.UserID, BookID: bookID})
+	}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update visibility")
+		return
+	}
+	if err = model.RecordBookActivity(c, svr.db, bookID, userID, model.BookActivityVisibility, book.Visibility.String()); err != nil {
+		log.WithError(err).Warnf("Failed to record book activity")
+	}
+
+	new(dto.RespBookShare).With(svr.bookShare(c, book)).Response(c, "visibility updated")
+}
+
+// GetSharedBook handles retrieving a book by its share code.
+// @Summary Get a shared book
+// @Description Get an unlisted or public book by the code in its share link.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param code path string true "Share code"
+// @Success 200 {object} dto.RespBookGet "Successfully retrieved book"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/shared/{code} [get]
+func (svr *Service) GetSharedBook(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	code := c.Param("code")
+	log := wlog.ByCtx(c, "GetSharedBook").WithField("user_id", userID).WithField("code", code)
+
+	book, err := model.FindSharedBook(c, svr.db, code)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book")
+		}
+		return
+	}
+
+	tags, err := book.GetTags(c)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to fetch book tags")
+	}
+
+	new(dto.RespBookGet).With(new(dto.Book).FromModel(book, tags...).WithShareCode(book, userID)).Response(c, "book found")
+}
+
+// SubscribeBook handles subscribing to a book of another user.
+// @Summary Subscribe to a book
+// @Description Subscribe to a public book, or an unlisted book with its share code. Subscribed books appear read-only in the library and can be added to the subscriber's dungeons.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Param body body ReqSubscribe false "Share code, required for unlisted books"
+// @Success 200 {object} dto.RespBookSubscribe "Successfully subscribed"
+// @Failure 400 {object} utils.ErrorResponse "Cannot subscribe to own book"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
+// @Router /books/{id}/subscription [post]
+func (svr *Service) SubscribeBook(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "SubscribeBook").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var req ReqSubscribe
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+			return
+		}
+	}
+
+	book, err := model.FindSubscribableBook(c, svr.db, userID, bookID, req.ShareCode)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrSubscribeOwnBook):
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "cannot subscribe to own book")
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find book")
+		}
+		return
+	}
+
+	if err = model.SubscribeBook(c, svr.db, userID, bookID); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to subscribe book")
+		return
+	}
+
+	d := new(dto.Book).FromModel(book)
+	d.Subscribed = true
+	new(dto.RespBookSubscribe).With(d).Response(c, "book subscribed")
+}
+
+// UnsubscribeBook handles unsubscribing from a book.
+// @Summary Unsubscribe from a book
+// @Description Remove a subscribed book from the library. Monsters already added to dungeons are kept.
+// @Tags book
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Book ID"
+// @Success 200 {object} dto.RespBookUnsubscribe "Successfully unsubscribed"
+// @Failure 404 {object} utils.ErrorResponse "Subscription not found"
+// @Router /books/{id}/subscription [delete]
+func (svr *Service) UnsubscribeBook(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	bookID := utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "UnsubscribeBook").WithField("user_id", userID).WithField("book_id", bookID)
+
+	var deleted bool
+	if err := svr.db.Transaction(func(tx *gorm.DB) (err error) {
+		deleted, err = model.UnsubscribeBook(c, tx, userID, bookID)
+		return err
+	}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to unsubscribe book")
+		return
+	}
+	if !deleted {
+		utils.GinHandleError(c, log, http.StatusNotFound, irr.Error("subscription not found"), "subscription not found")
+		return
+	}
+
+	new(dto.RespBookUnsubscribe).With(bookID).Response(c, "book unsubscribed")
+}
@@ -6,11 +6,18 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
 )
 
-type Service struct {
-	db *gorm.DB
-}
+type (
+	Service struct {
+		db        *gorm.DB
+		shortener Shortener
+	}
+
+	// Shortener 为站内的 path 生成完整的短网址
+	Shortener func(c *gin.Context, path string) string
+)
 
 var svr *Service
 
@@ -21,17 +28,51 @@ func Init(db *gorm.DB) (*Service, error) {
 	return svr, nil
 }
 
+// SetShortener 设置分享链接使用的短网址生成方法，不设置时只返回分享路径
+func (svr *Service) SetShortener(shortener Shortener) *Service {
+	svr.shortener = shortener
+	return svr
+}
+
 func (svr *Service) ApplyMux(group gin.IRouter) {
 	group.POST("", svr.CreateBook)
 	group.GET("", svr.ListBooks)
+	group.GET("/public", svr.ListPublicBooks)
+	group.GET("/shared/:code", svr.GetSharedBook)
 	idGroup := group.Group("/:id").Use(utils.GinMWParseID())
 	{
-		idGroup.GET("", svr.GetBook)
-		idGroup.PUT("", svr.UpdateBook)
-		idGroup.DELETE("", svr.DeleteBook)
+		idGroup.GET("", svr.authorize(model.ActionRead), svr.GetBook)
+		idGroup.PUT("", svr.authorize(model.ActionWrite), svr.UpdateBook)
+		idGroup.DELETE("", svr.authorize(model.ActionManage), svr.DeleteBook)
 
-		idGroup.GET("/items", svr.GetItemsOfBook)
-		idGroup.POST("/items", svr.AddItemsToBook)
-		idGroup.DELETE("/items", svr.RemoveItemsFromBook)
+		idGroup.GET("/items", svr.authorize(model.ActionRead), svr.GetItemsOfBook)
+		idGroup.POST("/items", svr.authorize(model.ActionWrite), svr.AddItemsToBook)
+		idGroup.DELETE("/items", svr.authorize(model.ActionWrite), svr.RemoveItemsFromBook)
+		idGroup.PUT("/items/order", svr.authorize(model.ActionWrite), svr.MoveItemsInBook)
+
+		idGroup.GET("/chapters", svr.authorize(model.ActionRead), svr.ListBookChapters)
+		idGroup.POST("/chapters", svr.authorize(model.ActionWrite), svr.CreateBookChapter)
+		idGroup.PUT("/chapters/:chapter_id", svr.authorize(model.ActionWrite), svr.UpdateBookChapter)
+		idGroup.DELETE("/chapters/:chapter_id", svr.authorize(model.ActionWrite), svr.DeleteBookChapter)
+
+		idGroup.GET("/members", svr.authorize(model.ActionRead), svr.ListBookMembers)
+		idGroup.PUT("/members/:user_id", svr.authorize(model.ActionManage), svr.SetBookMember)
+		// 成员可以自己退出，在 handler 中校验
+		idGroup.DELETE("/members/:user_id", svr.authorize(model.ActionRead), svr.RemoveBookMember)
+		idGroup.GET("/activities", svr.authorize(model.ActionRead), svr.ListBookActivities)
+
+		idGroup.POST("/fork", svr.authorize(model.ActionRead), svr.ForkBook)
+		idGroup.GET("/upstream", svr.authorize(model.ActionWrite), svr.GetUpstreamChanges)
+		idGroup.POST("/upstream", svr.authorize(model.ActionWrite), svr.PullUpstreamChanges)
+
+		idGroup.PUT("/visibility", svr.authorize(model.ActionManage), svr.SetBookVisibility)
+		// 订阅的是其他用户的 book，在 handler 中根据可见性和分享码校验
+		idGroup.POST("/subscription", svr.SubscribeBook)
+		idGroup.DELETE("/subscription", svr.UnsubscribeBook)
 	}
 }
+
+// authorize 校验当前用户对路径中的 book 有 action 权限，没有权限时返回 404
+func (svr *Service) authorize(action model.Action) gin.HandlerFunc {
+	return utils.GinMWAuthorize(model.Authorizer(svr.db, model.ResourceBook, action))
+}
@@ -1,10 +1,15 @@
 package book
 
-import "github.com/bagaking/memorianexus/internal/utils"
+import (
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+)
 
 type (
 	ReqAddItems struct {
-		ItemIDs []utils.UInt64 `json:"item_ids"`
+		ItemIDs   []utils.UInt64 `json:"item_ids"`
+		ChapterID utils.UInt64   `json:"chapter_id,omitempty"` // 追加到的章节，为空时不属于任何章节
 	}
 
 	ReqCreateOrUpdateBook struct {
@@ -12,4 +17,42 @@ type (
 		Description string   `json:"description"`
 		Tags        []string `json:"tags,omitempty"`
 	}
+
+	ReqSetVisibility struct {
+		Visibility *def.BookVisibility `json:"visibility"` // private, unlisted 或 public
+	}
+
+	ReqForkBook struct {
+		Title string `json:"title,omitempty"` // 为空时沿用原来的标题
+	}
+
+	ReqPullUpstream struct {
+		Items []model.UpstreamPick `json:"items"`
+	}
+
+	ReqSetMember struct {
+		Role *def.BookRole `json:"role"` // viewer, editor 或 owner
+	}
+
+	ReqCreateChapter struct {
+		Title    string       `json:"title"`
+		ParentID utils.UInt64 `json:"parent_id,omitempty"` // 为空时创建顶层章节
+		model.Placement
+	}
+
+	ReqUpdateChapter struct {
+		Title    *string       `json:"title,omitempty"`
+		ParentID *utils.UInt64 `json:"parent_id,omitempty"` // 移动到的父章节，0 表示顶层；为空且没有 before/after 时不移动
+		model.Placement
+	}
+
+	ReqMoveItems struct {
+		ItemIDs   []utils.UInt64 `json:"item_ids"`             // 按给定的顺序放置
+		ChapterID utils.UInt64   `json:"chapter_id,omitempty"` // 目标章节，为空时不属于任何章节
+		model.Placement
+	}
+
+	ReqSubscribe struct {
+		ShareCode string `json:"share_code,omitempty"` // 订阅 unlisted 的 book 时需要提供分享码
+	}
 )
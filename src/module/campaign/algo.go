@@ -42,9 +42,10 @@ var DefaultDecaySettings = FamiliarityFixSettings{
 // CalculateNewFamiliarity 计算熟练度
 // 熟练度主要受到难度和复习间隔影响，难度影响新熟练度的权重，复习间隔影响旧熟练度的比重
 // 熟练度的计算反应的是用户固有的记忆效果，和任务、偏好等外在因素无关
-func CalculateNewFamiliarity(currentFamiliarity, damageRate utils.Percentage, lastPracticeAt time.Time, difficulty def.DifficultyLevel) utils.Percentage {
+// at 为本次复习的时间，离线复习同步时为客户端记录的时间
+func CalculateNewFamiliarity(currentFamiliarity, damageRate utils.Percentage, lastPracticeAt, at time.Time, difficulty def.DifficultyLevel) utils.Percentage {
 	// 时间衰减因子
-	timeDecayFactor := DefaultDecaySettings.DecaySetting.Factor(time.Since(lastPracticeAt).Hours())
+	timeDecayFactor := DefaultDecaySettings.DecaySetting.Factor(at.Sub(lastPracticeAt).Hours())
 	// 难度因子
 	difficultyFactor := difficulty.Factor()
 
@@ -77,7 +78,9 @@ func CalculateNewFamiliarity(currentFamiliarity, damageRate utils.Percentage, la
 // CalculateNextPracticeAt calculates the next recall time for a monster
 // 下次练习时间主要由 familiarity 决定，受到重要程度、用户挑战偏好和 Dungeon 挑战偏好影响而进行修正
 // 下次练习时间计算是用户在固有的记忆效果的基础上，反应任务、偏好等外在因素的要求
+// 间隔从本次复习的时间 at 开始计算
 func CalculateNextPracticeAt(ctx context.Context,
+	at time.Time,
 	familiarity utils.Percentage,
 	importance def.ImportanceLevel,
 	memSetting *model.MemorizationSetting,
@@ -103,5 +106,5 @@ func CalculateNextPracticeAt(ctx context.Context,
 	}
 
 	// 计算下次复习时间
-	return time.Now().Add(nextInterval)
+	return at.Add(nextInterval)
 }
@@ -1,16 +1,17 @@
 package campaign
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
-	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
-
 	"github.com/bagaking/goulp/wlog"
 	"github.com/gin-gonic/gin"
 	"github.com/khicago/got/util/typer"
 	"github.com/khicago/irr"
+	"github.com/sirupsen/logrus"
 
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/src/def"
@@ -20,7 +21,20 @@ import (
 
 type ReqReportMonsterResult struct {
 	MonsterID utils.UInt64     `json:"monster_id"`
-	Result    def.AttackResult `json:"result"` // "defeat", "miss", "hit", "kill", "complete"
+	Result    def.AttackResult `json:"result"`               // "defeat", "miss", "hit", "kill", "complete"
+	AttemptID string           `json:"attempt_id,omitempty"` // 客户端为每次作答生成的唯一 id，重试时保持不变
+}
+
+// pointsKey 积分流水的幂等键。没有 attempt id 的提交不是幂等的，每次都是一次新的作答，使用新生成的 id 作为键
+func (req *ReqReportMonsterResult) pointsKey(ctx context.Context, userID utils.UInt64) (string, error) {
+	if req.AttemptID != "" {
+		return fmt.Sprintf("practice:%d:%s", userID, req.AttemptID), nil
+	}
+	id, err := utils.GenIDU64(ctx)
+	if err != nil {
+		return "", irr.Wrap(err, "generate points key failed")
+	}
+	return fmt.Sprintf("campaign:%d:%d", userID, id), nil
 }
 
 type ReqGetForPractice struct {
@@ -47,8 +61,8 @@ func (svr *Service) GetCampaignMonsters(c *gin.Context) {
 	log := wlog.ByCtx(c, "GetCampaignMonsters").
 		WithField("user_id", userID).WithField("campaign_id", campaignID).WithField("pager", pager)
 
-	var dungeon model.Dungeon
-	if err := svr.db.Where("id = ?", campaignID).First(&dungeon).Error; err != nil {
+	dungeon, err := model.FindDungeon(c, svr.db, userID, campaignID, model.ActionRead)
+	if err != nil {
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
 		return
 	}
@@ -98,7 +112,7 @@ func (svr *Service) GetMonstersForCampaignPractice(c *gin.Context) {
 	log = log.WithField("count", req.Count)
 	pager := new(utils.Pager).SetFirstCount(req.Count)
 
-	dungeon, err := model.FindDungeon(c, svr.db, campaignID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, campaignID, model.ActionRead)
 	if err != nil {
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
 		return
@@ -119,15 +133,18 @@ func (svr *Service) GetMonstersForCampaignPractice(c *gin.Context) {
 
 // SubmitCampaignResult handles reporting the result of a specific monster recall
 // @Summary Report the result of a specific monster recall
-// @Description 上报复习计划的Monster结果
+// @Description 上报复习计划的Monster结果。客户端为每次作答生成 attempt_id (或通过 Idempotency-Key header 传入)，
+// @Description 重试时保持不变：重复的提交不会再次生效，而是返回第一次处理时的响应 (带 Idempotent-Replayed: true header)
 // @Tags dungeon
 // @Accept json
 // @Produce json
 // @Param id path uint64 true "Dungeon ID"
+// @Param Idempotency-Key header string false "Client generated attempt ID, overrides attempt_id in the body"
 // @Param result body ReqReportMonsterResult true "UserMonster result data"
-// @Success 200 {object} dto.SuccessResponse "Successfully reported result"
+// @Success 200 {object} dto.RespMonsterUpdate "Successfully reported result"
 // @Failure 400 {object} utils.ErrorResponse "Invalid request body"
 // @Failure 404 {object} utils.ErrorResponse "Dungeon or UserMonster not found"
+// @Failure 409 {object} utils.ErrorResponse "The attempt ID was used by another submission"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/campaigns/{id}/submit [post]
 func (svr *Service) SubmitCampaignResult(c *gin.Context) {
@@ -139,78 +156,121 @@ func (svr *Service) SubmitCampaignResult(c *gin.Context) {
 		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
 		return
 	}
+	if key := c.GetHeader(utils.HeaderIdempotencyKey); key != "" {
+		req.AttemptID = key
+	}
+	if len(req.AttemptID) > model.MaxAttemptIDLen {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("attempt id is longer than %d", model.MaxAttemptIDLen), "invalid attempt id")
+		return
+	}
+	log = log.WithField("attempt_id", req.AttemptID)
+
+	// 处理 Monster结果 - 根据需求调整处理逻辑，例如更新Monster的熟练度或状态等
+	if req.Result.DamageRate() <= 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("invalid attack result %s", req.Result), "Invalid result")
+		return
+	}
 
-	dungeon, err := model.FindDungeon(c, svr.db, campaignID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, campaignID, model.ActionWrite)
 	if err != nil {
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
 		return
 	}
 
-	dm, err := dungeon.GetMonster(c, svr.db, req.MonsterID)
+	// 已经处理过的提交直接返回第一次的响应
+	if req.AttemptID != "" && svr.replayAttempt(c, log, userID, campaignID, &req) {
+		return
+	}
+
+	pointsKey, err := req.pointsKey(c, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to generate points key")
+		return
+	}
+
+	// 熟练度、复习时间、积分和提交记录在同一个事务中修改，锁住 monster 使并发的提交依次生效
+	tx := svr.db.Begin()
+	dm, err := dungeon.GetMonsterForUpdate(c, tx, req.MonsterID)
 	if err != nil {
+		tx.Rollback()
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "monster are not found in dungeon")
 		return
 	}
 	log = log.WithField("item_id", dm.ItemID)
 
-	// 处理 Monster结果 - 根据需求调整处理逻辑，例如更新Monster的熟练度或状态等
-	damageRate := req.Result.DamageRate()
-	if damageRate <= 0 {
-		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("invalid attack result %s", req.Result), "Invalid result")
+	results, _, err := applyPracticeResult(c, tx, userID, dungeon, dm, practiceInput{
+		Result:    req.Result,
+		At:        time.Now(),
+		PointsKey: pointsKey,
+	})
+	if err != nil {
+		tx.Rollback()
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to apply practice result")
 		return
 	}
 
-	// 更新UserMonster的熟练度
-	newFamiliarity := CalculateNewFamiliarity(dm.Familiarity, damageRate, dm.PracticeAt, dm.Difficulty)
-	userMonster := model.UserMonster{
-		UserID:      userID,
-		ItemID:      req.MonsterID,
-		Familiarity: newFamiliarity,
+	if req.AttemptID != "" {
+		response, err := json.Marshal(results)
+		if err != nil {
+			tx.Rollback()
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to encode practice result")
+			return
+		}
+		saved, err := model.SavePracticeAttempt(c, tx, &model.PracticeAttempt{
+			UserID:    userID,
+			AttemptID: req.AttemptID,
+			DungeonID: campaignID,
+			ItemID:    req.MonsterID,
+			Result:    req.Result,
+			Response:  string(response),
+		})
+		if err != nil {
+			tx.Rollback()
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to save practice attempt")
+			return
+		}
+		if !saved {
+			// 并发的重复请求已经处理完成，放弃这次的修改
+			tx.Rollback()
+			if !svr.replayAttempt(c, log, userID, campaignID, &req) {
+				utils.GinHandleError(c, log, http.StatusInternalServerError, irr.Error("attempt is not found after conflict"), "failed to save practice attempt")
+			}
+			return
+		}
 	}
-	if err := svr.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "user_id"}, {Name: "item_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"familiarity"}),
-	}).Create(&userMonster).Error; err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update UserMonster familiarity")
+
+	if err = tx.Commit().Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
 		return
 	}
-	log.Infof("damage calculate, last_practice_at %v, damage_rate= %v, difficulty= %v, current= %v, new= %v", dm.PracticeAt, damageRate, dm.Difficulty, dm.Familiarity, newFamiliarity)
 
-	nextRecallTime := CalculateNextPracticeAt(c, newFamiliarity, dm.Importance, &dungeon.MemorizationSetting)
-	updater := map[string]any{
-		"visibility":       utils.Percentage(newFamiliarity.Times(dm.Visibility.NormalizedFloat())),
-		"familiarity":      newFamiliarity,
-		"practice_at":      time.Now(),
-		"next_practice_at": nextRecallTime,
-		"practice_count":   gorm.Expr("practice_count + ?", 1),
-	}
+	new(dto.RespMonsterUpdate).With(results).Response(c, "user-monster practice result updated")
+}
 
-	if err = svr.db.Model(dm).
-		Where("dungeon_id = ? AND item_id = ?", campaignID, req.MonsterID).
-		Updates(updater).Error; err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update DungeonMonster visibility and next recall time")
-		return
+// replayAttempt 如果 attempt 已经被处理过，返回第一次处理时的响应。返回 true 表示已经写入了响应
+func (svr *Service) replayAttempt(c *gin.Context, log logrus.FieldLogger, userID, campaignID utils.UInt64, req *ReqReportMonsterResult) bool {
+	attempt, err := model.FindPracticeAttempt(c, svr.db, userID, req.AttemptID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find practice attempt")
+		return true
+	}
+	if attempt == nil {
+		return false
+	}
+	if !attempt.Matches(campaignID, req.MonsterID, req.Result) {
+		utils.GinHandleError(c, log, http.StatusConflict, irr.Wrap(model.ErrAttemptMismatch, "attempt %q", req.AttemptID), "attempt id is already used")
+		return true
 	}
-	log.Infof("next_practice_at updated, last_practice_at= %v, new_familiarity= %v, importance= %v, next_recall_at= %v", dm.PracticeAt, newFamiliarity, dm.Importance, nextRecallTime)
 
-	// 计算积分变化
-	cashEarned := calculatePoints(damageRate, newFamiliarity-dm.Familiarity, dm.Difficulty)
-	if err = model.AddUserCash(svr.db, userID, cashEarned); err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update user points")
-		return
+	results := &dto.SubmitResults{}
+	if err = json.Unmarshal([]byte(attempt.Response), results); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to decode practice attempt")
+		return true
 	}
-	log.Infof("points earned: %v", cashEarned)
-
-	new(dto.RespMonsterUpdate).With(
-		&dto.SubmitResults{
-			Updater: dto.Updater[*dto.DungeonMonster]{
-				From:    new(dto.DungeonMonster).FromModel(*dm),
-				Updates: updater,
-			},
-			PointsUpdate: dto.Points{
-				Cash: utils.UInt64(cashEarned),
-			},
-		}).Response(c, "user-monster practice result updated")
+	log.Infof("replay practice attempt created at %v", attempt.CreatedAt)
+	utils.GinMarkReplayed(c)
+	new(dto.RespMonsterUpdate).With(results).Response(c, "user-monster practice result updated")
+	return true
 }
 
 // calculatePoints 根据熟练度变化和难度计算积分
@@ -225,8 +285,7 @@ func (svr *Service) GetCampaignDungeonConclusionOfToday(c *gin.Context) {
 	userID, campaignID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "GetCampaignDungeonConclusionOfToday").WithField("user_id", userID).WithField("campaign_id", campaignID)
 
-	var dungeon model.Dungeon
-	if err := svr.db.Where("id = ?", campaignID).First(&dungeon).Error; err != nil {
+	if _, err := model.FindDungeon(c, svr.db, userID, campaignID, model.ActionRead); err != nil {
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
 		return
 	}
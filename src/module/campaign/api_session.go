@@ -0,0 +1,251 @@
+package campaign
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/core/review"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// SessionIdleTimeout 复习会话中超过这个时间没有收到消息时结束会话
+var SessionIdleTimeout = 5 * time.Minute
+
+// sessionUpgrader 使用默认的同源检查
+var sessionUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// sessionEngine 复习会话在 campaign 上的实现，每次作答在各自的事务中生效
+type sessionEngine struct {
+	db        *gorm.DB
+	userID    utils.UInt64
+	dungeon   *model.Dungeon
+	sessionID utils.UInt64
+}
+
+func (e *sessionEngine) Due(ctx context.Context, limit int) ([]model.DungeonMonster, error) {
+	return e.dungeon.GetMonstersForPractice(ctx, e.db, limit)
+}
+
+func (e *sessionEngine) Monster(ctx context.Context, itemID utils.UInt64) (*model.DungeonMonster, error) {
+	return e.dungeon.GetMonster(ctx, e.db, itemID)
+}
+
+func (e *sessionEngine) Apply(ctx context.Context, current *model.DungeonMonster, answer review.Answer) (*review.Grade, error) {
+	tx := e.db.WithContext(ctx).Begin()
+	defer tx.Rollback() // 提交后 rollback 不生效
+
+	// 下发之后 monster 可能已经在其他地方被复习过，以最新的状态计算
+	dm, err := e.dungeon.GetMonsterForUpdate(ctx, tx, current.ItemID)
+	if err != nil {
+		return nil, err
+	}
+	results, log, err := applyPracticeResult(ctx, tx, e.userID, e.dungeon, dm, practiceInput{
+		Result:       answer.Result,
+		At:           answer.At,
+		PointsKey:    fmt.Sprintf("session:%d:%d", e.sessionID, answer.Seq),
+		SessionID:    e.sessionID,
+		ResponseTime: answer.ResponseTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return nil, irr.Wrap(err, "commit answer failed")
+	}
+	return &review.Grade{
+		ItemID:            dm.ItemID,
+		Result:            answer.Result,
+		FamiliarityBefore: log.FamiliarityBefore,
+		FamiliarityAfter:  log.FamiliarityAfter,
+		NextPracticeAt:    log.NextPracticeAt,
+		Cash:              results.PointsUpdate.Cash,
+	}, nil
+}
+
+// OpenCampaignSession handles a real-time practice session over WebSocket
+// @Summary Open a practice session over WebSocket
+// @Description 建立 WebSocket 连接后，服务端依次下发 monster (`monster`)，客户端作答 (`answer`) 后立即返回评分 (`graded`)，
+// @Description 答错的 monster 会在会话中再次出现。没有到期的 monsters、客户端结束 (`end`)、超时或连接断开时会话结束，服务端发送汇总 (`summary`) 后关闭连接
+// @Tags campaign
+// @Security ApiKeyAuth
+// @Param id path uint64 true "Dungeon ID"
+// @Success 101 "Switching to the WebSocket protocol"
+// @Failure 400 {object} utils.ErrorResponse "Not a WebSocket handshake"
+// @Failure 404 {object} utils.ErrorResponse "Dungeon not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /dungeon/campaigns/{id}/session [get]
+func (svr *Service) OpenCampaignSession(c *gin.Context) {
+	userID, campaignID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "OpenCampaignSession").WithField("user_id", userID).WithField("campaign_id", campaignID)
+
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("not a websocket handshake"), "websocket is required")
+		return
+	}
+	dungeon, err := model.FindDungeon(c, svr.db, userID, campaignID, model.ActionWrite)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
+		return
+	}
+	sessionID, err := utils.GenIDU64(c)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to generate session id")
+		return
+	}
+
+	conn, err := sessionUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade 已经写入了错误响应
+		log.WithError(err).Warn("upgrade to websocket failed")
+		return
+	}
+	defer conn.Close()
+	log = log.WithField("session_id", sessionID)
+
+	record := &model.PracticeSession{ID: sessionID, UserID: userID, DungeonID: campaignID, StartedAt: time.Now()}
+	if err = model.CreatePracticeSession(c, svr.db, record); err != nil {
+		log.WithError(err).Error("create practice session failed")
+		_ = conn.WriteJSON(dto.SessionServerMessage{Type: dto.SessionMsgError, Error: "failed to start session"})
+		return
+	}
+
+	session := review.NewSession(&sessionEngine{db: svr.db, userID: userID, dungeon: dungeon, sessionID: sessionID})
+	reason := runSession(c, log, conn, session, record)
+
+	// 汇总在连接断开后也要保存
+	summary := session.Summary()
+	endedAt := time.Now()
+	record.EndReason = reason
+	record.Answered = uint32(summary.Answered)
+	record.Failed = uint32(summary.Failed)
+	record.Cash = summary.Cash
+	record.FamiliarityGain = int64(summary.FamiliarityGain)
+	record.ResponseMS = summary.ResponseTime.Milliseconds()
+	record.EndedAt = &endedAt
+	if err = model.FinishPracticeSession(context.WithoutCancel(c), svr.db, record); err != nil {
+		log.WithError(err).Error("finish practice session failed")
+	}
+	log.Infof("practice session ended, reason= %s, answered= %d", reason, summary.Answered)
+
+	if reason == model.SessionEndDisconnected {
+		return
+	}
+	_ = conn.WriteJSON(dto.SessionServerMessage{Type: dto.SessionMsgSummary, Session: new(dto.PracticeSession).FromModel(record)})
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, string(reason)), time.Now().Add(time.Second))
+}
+
+// runSession 驱动复习会话直到结束，返回结束的原因。消息的读写都在调用方的 goroutine 中
+func runSession(ctx context.Context, log logrus.FieldLogger, conn *websocket.Conn, session *review.Session, record *model.PracticeSession) model.SessionEndReason {
+	send := func(msg dto.SessionServerMessage) bool {
+		if err := conn.WriteJSON(msg); err != nil {
+			log.WithError(err).Warn("write session message failed")
+			return false
+		}
+		return true
+	}
+	if !send(dto.SessionServerMessage{Type: dto.SessionMsgStarted, Session: new(dto.PracticeSession).FromModel(record)}) {
+		return model.SessionEndDisconnected
+	}
+
+	for {
+		dm, err := session.Next(ctx)
+		if err != nil {
+			log.WithError(err).Error("pick next monster failed")
+			send(dto.SessionServerMessage{Type: dto.SessionMsgError, Error: "failed to pick next monster"})
+			return model.SessionEndError
+		}
+		if dm == nil {
+			return model.SessionEndCompleted
+		}
+		if !send(dto.SessionServerMessage{Type: dto.SessionMsgMonster, Monster: new(dto.DungeonMonster).FromModel(*dm)}) {
+			return model.SessionEndDisconnected
+		}
+
+		// 直到当前的 monster 作答成功
+		for answered := false; !answered; {
+			_ = conn.SetReadDeadline(time.Now().Add(SessionIdleTimeout))
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					return model.SessionEndTimeout
+				}
+				return model.SessionEndDisconnected
+			}
+
+			var msg dto.SessionClientMessage
+			if err = json.Unmarshal(data, &msg); err != nil {
+				send(dto.SessionServerMessage{Type: dto.SessionMsgError, Error: "invalid message"})
+				continue
+			}
+			switch msg.Type {
+			case dto.SessionMsgEnd:
+				return model.SessionEndFinished
+			case dto.SessionMsgAnswer:
+				grade, err := session.Answer(ctx, msg.ItemID, msg.Result)
+				if errors.Is(err, review.ErrNotCurrent) || errors.Is(err, review.ErrInvalidResult) {
+					send(dto.SessionServerMessage{Type: dto.SessionMsgError, Error: err.Error()})
+					continue
+				}
+				if err != nil {
+					log.WithError(err).Error("apply answer failed")
+					send(dto.SessionServerMessage{Type: dto.SessionMsgError, Error: "failed to apply answer"})
+					return model.SessionEndError
+				}
+				if !send(dto.SessionServerMessage{Type: dto.SessionMsgGraded, Graded: new(dto.SessionGrade).FromReview(grade)}) {
+					return model.SessionEndDisconnected
+				}
+				answered = true
+			default:
+				send(dto.SessionServerMessage{Type: dto.SessionMsgError, Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+			}
+		}
+	}
+}
+
+// GetCampaignSessions handles listing the practice sessions of a campaign
+// @Summary List the practice sessions of a campaign
+// @Description 获取当前用户在复习计划中的复习会话汇总，最新的在前。进行中的会话没有 end_reason
+// @Tags campaign
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "Dungeon ID"
+// @Param page query int false "Page number"
+// @Param limit query int false "Number of sessions per page"
+// @Success 200 {object} dto.RespPracticeSessions "Successfully retrieved sessions"
+// @Failure 404 {object} utils.ErrorResponse "Dungeon not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /dungeon/campaigns/{id}/sessions [get]
+func (svr *Service) GetCampaignSessions(c *gin.Context) {
+	userID, campaignID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "GetCampaignSessions").WithField("user_id", userID).WithField("campaign_id", campaignID)
+
+	pager := utils.GinGetPagerFromQuery(c)
+	sessions, total, err := model.GetPracticeSessions(c, svr.db, userID, campaignID, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get practice sessions")
+		return
+	}
+	pager.Total = total
+	new(dto.RespPracticeSessions).WithPager(pager).Append(typer.SliceMap(sessions, func(from *model.PracticeSession) *dto.PracticeSession {
+		return new(dto.PracticeSession).FromModel(from)
+	})...).Response(c)
+}
@@ -0,0 +1,267 @@
+package campaign
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+const (
+	// MaxSyncDownload 一次最多下载的 monsters 数量
+	MaxSyncDownload = 200
+	// MaxSyncAttempts 一次最多上传的作答数量
+	MaxSyncAttempts = 500
+	// maxClockSkew 修正时钟偏差后，作答时间最多可以比服务器时间晚多少
+	maxClockSkew = time.Minute
+)
+
+type (
+	ReqSyncDownload struct {
+		Count int `form:"count" json:"count"`
+	}
+
+	// SyncAttempt 离线时的一次作答
+	SyncAttempt struct {
+		AttemptID   string           `json:"attempt_id"` // 客户端生成的唯一 id，与 submit 接口的 attempt_id 共用
+		MonsterID   utils.UInt64     `json:"monster_id"`
+		Result      def.AttackResult `json:"result"`
+		PracticedAt time.Time        `json:"practiced_at"` // 客户端记录的作答时间
+	}
+
+	ReqSyncUpload struct {
+		// ClientTime 上传时客户端的时间，用于修正客户端时钟的偏差，为空时不修正
+		ClientTime time.Time     `json:"client_time"`
+		Attempts   []SyncAttempt `json:"attempts"`
+	}
+)
+
+// DownloadCampaignForSync handles downloading due monsters for offline practice
+// @Summary Download due monsters for offline practice
+// @Description 下载到期的 monsters 用于离线复习，之后通过 POST /dungeon/campaigns/{id}/sync 上传作答
+// @Tags campaign
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "Dungeon ID"
+// @Param count query int false "Number of monsters to download, default 50, at most 200"
+// @Success 200 {object} dto.RespSyncDownload "Successfully downloaded monsters"
+// @Failure 400 {object} utils.ErrorResponse "Invalid request query"
+// @Failure 404 {object} utils.ErrorResponse "Dungeon not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /dungeon/campaigns/{id}/sync [get]
+func (svr *Service) DownloadCampaignForSync(c *gin.Context) {
+	userID, campaignID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "DownloadCampaignForSync").WithField("user_id", userID).WithField("campaign_id", campaignID)
+
+	req := ReqSyncDownload{Count: 50}
+	if err := c.ShouldBindQuery(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request query")
+		return
+	}
+	if req.Count <= 0 || req.Count > MaxSyncDownload {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("count should be in [1, %d]", MaxSyncDownload), "invalid count")
+		return
+	}
+
+	dungeon, err := model.FindDungeon(c, svr.db, userID, campaignID, model.ActionRead)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
+		return
+	}
+
+	serverTime := time.Now()
+	monsters, err := dungeon.GetMonstersForPractice(c, svr.db, req.Count)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to fetch dungeon monsters")
+		return
+	}
+
+	new(dto.RespSyncDownload).With(&dto.SyncDownload{
+		ServerTime: serverTime,
+		Monsters: typer.SliceMap(monsters, func(from model.DungeonMonster) *dto.DungeonMonster {
+			return new(dto.DungeonMonster).FromModel(from)
+		}),
+	}).Response(c, "monsters downloaded")
+}
+
+// UploadCampaignSync handles uploading attempts practised offline
+// @Summary Upload attempts practised offline
+// @Description 按作答时间的顺序重放离线时的作答，返回每次作答的处理结果。同一个 monster 在之后已经被复习过 (例如在另一台设备上) 时，较早的作答不再生效
+// @Tags campaign
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Dungeon ID"
+// @Param attempts body ReqSyncUpload true "Attempts practised offline"
+// @Success 200 {object} dto.RespSyncResults "Outcome of each attempt"
+// @Failure 400 {object} utils.ErrorResponse "Invalid request body"
+// @Failure 404 {object} utils.ErrorResponse "Dungeon not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /dungeon/campaigns/{id}/sync [post]
+func (svr *Service) UploadCampaignSync(c *gin.Context) {
+	userID, campaignID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "UploadCampaignSync").WithField("user_id", userID).WithField("campaign_id", campaignID)
+
+	var req ReqSyncUpload
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if len(req.Attempts) == 0 || len(req.Attempts) > MaxSyncAttempts {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("attempts count should be in [1, %d]", MaxSyncAttempts), "invalid attempts")
+		return
+	}
+
+	dungeon, err := model.FindDungeon(c, svr.db, userID, campaignID, model.ActionWrite)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
+		return
+	}
+
+	serverTime := time.Now()
+	var offset time.Duration
+	if !req.ClientTime.IsZero() {
+		offset = serverTime.Sub(req.ClientTime)
+	}
+	log = log.WithField("clock_offset", offset)
+
+	// 按作答时间重放，时间相同的保持上传的顺序
+	attempts := req.Attempts
+	sort.SliceStable(attempts, func(i, j int) bool {
+		return attempts[i].PracticedAt.Before(attempts[j].PracticedAt)
+	})
+
+	results := &dto.SyncResults{ServerTime: serverTime, Outcomes: make([]*dto.SyncOutcome, 0, len(attempts))}
+	for i := range attempts {
+		// 每次作答在各自的事务中处理，出错时已经处理的作答保持生效，客户端可以原样重试
+		outcome, err := svr.syncAttempt(c, log, userID, dungeon, &attempts[i], offset, serverTime)
+		if err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to sync attempt")
+			return
+		}
+		if outcome.Status == dto.SyncStatusApplied {
+			results.PointsUpdate.Cash += outcome.Results.PointsUpdate.Cash
+			results.PointsUpdate.DrawTicket += outcome.Results.PointsUpdate.DrawTicket
+		}
+		results.Outcomes = append(results.Outcomes, outcome)
+	}
+
+	new(dto.RespSyncResults).With(results).Response(c, "attempts synced")
+}
+
+// syncAttempt 处理一次离线作答。只有数据库等内部错误返回 error，作答本身的问题记录在 outcome 中
+func (svr *Service) syncAttempt(ctx context.Context, log logrus.FieldLogger, userID utils.UInt64, dungeon *model.Dungeon,
+	attempt *SyncAttempt, offset time.Duration, serverTime time.Time,
+) (*dto.SyncOutcome, error) {
+	outcome := &dto.SyncOutcome{AttemptID: attempt.AttemptID, MonsterID: attempt.MonsterID}
+	reject := func(reason string, args ...any) (*dto.SyncOutcome, error) {
+		outcome.Status, outcome.Reason = dto.SyncStatusRejected, fmt.Sprintf(reason, args...)
+		return outcome, nil
+	}
+
+	switch {
+	case attempt.AttemptID == "":
+		return reject("attempt_id is required")
+	case len(attempt.AttemptID) > model.MaxAttemptIDLen:
+		return reject("attempt_id is longer than %d", model.MaxAttemptIDLen)
+	case attempt.Result.DamageRate() <= 0:
+		return reject("invalid result %q", attempt.Result)
+	case attempt.PracticedAt.IsZero():
+		return reject("practiced_at is required")
+	}
+	at := attempt.PracticedAt.Add(offset)
+	if at.After(serverTime.Add(maxClockSkew)) {
+		return reject("practiced_at is in the future")
+	}
+	log = log.WithField("attempt_id", attempt.AttemptID).WithField("item_id", attempt.MonsterID)
+
+	duplicate := func() (*dto.SyncOutcome, error) {
+		existing, err := model.FindPracticeAttempt(ctx, svr.db, userID, attempt.AttemptID)
+		if err != nil || existing == nil {
+			return nil, err
+		}
+		if !existing.Matches(dungeon.ID, attempt.MonsterID, attempt.Result) {
+			return reject("attempt_id is already used by another submission")
+		}
+		results := &dto.SubmitResults{}
+		if err = json.Unmarshal([]byte(existing.Response), results); err != nil {
+			return nil, irr.Wrap(err, "decode practice attempt %q failed", attempt.AttemptID)
+		}
+		outcome.Status, outcome.Results = dto.SyncStatusDuplicate, results
+		return outcome, nil
+	}
+	if ret, err := duplicate(); ret != nil || err != nil {
+		return ret, err
+	}
+
+	tx := svr.db.WithContext(ctx).Begin()
+	defer tx.Rollback() // 提交后 rollback 不生效
+
+	dm, err := dungeon.GetMonsterForUpdate(ctx, tx, attempt.MonsterID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return reject("monster not found in dungeon")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 冲突处理: 以最后一次复习为准。monster 在这次作答之后已经被复习过时 (例如在另一台设备上离线复习后先同步)，
+	// 较早的作答已经不能按时间顺序重放，不再生效
+	if !at.After(dm.PracticeAt) {
+		log.Infof("attempt at %v is superseded by the practice at %v", at, dm.PracticeAt)
+		outcome.Status, outcome.Reason = dto.SyncStatusSuperseded, fmt.Sprintf("monster was practiced at %s", dm.PracticeAt.Format(time.RFC3339))
+		return outcome, nil
+	}
+
+	results, _, err := applyPracticeResult(ctx, tx, userID, dungeon, dm, practiceInput{
+		Result:    attempt.Result,
+		At:        at,
+		PointsKey: fmt.Sprintf("practice:%d:%s", userID, attempt.AttemptID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	response, err := json.Marshal(results)
+	if err != nil {
+		return nil, irr.Wrap(err, "encode practice result failed")
+	}
+	saved, err := model.SavePracticeAttempt(ctx, tx, &model.PracticeAttempt{
+		UserID:    userID,
+		AttemptID: attempt.AttemptID,
+		DungeonID: dungeon.ID,
+		ItemID:    attempt.MonsterID,
+		Result:    attempt.Result,
+		Response:  string(response),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !saved {
+		// 并发的请求已经处理了这次作答
+		tx.Rollback()
+		if ret, err := duplicate(); ret != nil || err != nil {
+			return ret, err
+		}
+		return nil, irr.Error("attempt %q is not found after conflict", attempt.AttemptID)
+	}
+	if err = tx.Commit().Error; err != nil {
+		return nil, irr.Wrap(err, "commit attempt %q failed", attempt.AttemptID)
+	}
+
+	outcome.Status, outcome.Results = dto.SyncStatusApplied, results
+	return outcome, nil
+}
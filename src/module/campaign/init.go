@@ -5,6 +5,7 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
 )
 
 type Service struct {
@@ -23,10 +24,19 @@ func Init(db *gorm.DB) (*Service, error) {
 func (svr *Service) ApplyMux(group gin.IRouter) {
 	campaignsDetailGroup := group.Group("/campaigns/:id").Use(utils.GinMWParseID())
 	{
-		campaignsDetailGroup.GET("/monsters", svr.GetCampaignMonsters)
-		campaignsDetailGroup.GET("/practice", svr.GetMonstersForCampaignPractice)
-		campaignsDetailGroup.POST("/submit", svr.SubmitCampaignResult)
+		campaignsDetailGroup.GET("/monsters", svr.authorize(model.ActionRead), svr.GetCampaignMonsters)
+		campaignsDetailGroup.GET("/practice", svr.authorize(model.ActionRead), svr.GetMonstersForCampaignPractice)
+		campaignsDetailGroup.POST("/submit", svr.authorize(model.ActionWrite), svr.SubmitCampaignResult)
+		campaignsDetailGroup.GET("/sync", svr.authorize(model.ActionRead), svr.DownloadCampaignForSync)
+		campaignsDetailGroup.POST("/sync", svr.authorize(model.ActionWrite), svr.UploadCampaignSync)
+		campaignsDetailGroup.GET("/session", svr.authorize(model.ActionWrite), svr.OpenCampaignSession)
+		campaignsDetailGroup.GET("/sessions", svr.authorize(model.ActionRead), svr.GetCampaignSessions)
 
-		campaignsDetailGroup.GET("/conclusion/today", svr.GetCampaignDungeonConclusionOfToday)
+		campaignsDetailGroup.GET("/conclusion/today", svr.authorize(model.ActionRead), svr.GetCampaignDungeonConclusionOfToday)
 	}
 }
+
+// authorize 校验当前用户对路径中的复习计划有 action 权限，没有权限时返回 404
+func (svr *Service) authorize(action model.Action) gin.HandlerFunc {
+	return utils.GinMWAuthorize(model.Authorizer(svr.db, model.ResourceDungeon, action))
+}
@@ -0,0 +1,212 @@
+package campaign
+
+import (
+	"context"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/eventbus"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// practiceInput 一次作答
+type practiceInput struct {
+	Result       def.AttackResult
+	At           time.Time     // 作答的时间，离线同步时为客户端记录的时间
+	PointsKey    string        // 积分流水的幂等键
+	SessionID    utils.UInt64  // 复习会话中的作答，见 PracticeSession
+	ResponseTime time.Duration // 服务器记录的作答耗时，未知时为 0
+}
+
+// applyPracticeResult 把一次作答的结果应用到 monster 上: 更新用户的熟练度、monster 的显影程度和下次复习时间，发放积分并写入复习记录。
+// tx 应该是调用方的事务
+func applyPracticeResult(ctx context.Context, tx *gorm.DB, userID utils.UInt64, dungeon *model.Dungeon, dm *model.DungeonMonster,
+	in practiceInput,
+) (*dto.SubmitResults, *model.ReviewLog, error) {
+	log := wlog.ByCtx(ctx, "applyPracticeResult").WithField("user_id", userID).
+		WithField("dungeon_id", dungeon.ID).WithField("item_id", dm.ItemID)
+
+	result, at := in.Result, in.At
+	damageRate := result.DamageRate()
+	if damageRate <= 0 {
+		return nil, nil, irr.Error("invalid attack result %s", result)
+	}
+
+	// 更新UserMonster的熟练度，同一个 item 可能在多个 dungeon 中练习，user_monsters 中是最近一次作答后的熟练度
+	var userFamiliarityBefore utils.Percentage
+	if err := tx.WithContext(ctx).Model(&model.UserMonster{}).Where("user_id = ? AND item_id = ?", userID, dm.ItemID).
+		Select("familiarity").Scan(&userFamiliarityBefore).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "failed to get UserMonster familiarity")
+	}
+	newFamiliarity := CalculateNewFamiliarity(dm.Familiarity, damageRate, dm.PracticeAt, at, dm.Difficulty)
+	userMonster := model.UserMonster{
+		UserID:      userID,
+		ItemID:      dm.ItemID,
+		Familiarity: newFamiliarity,
+	}
+	if err := tx.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "item_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"familiarity"}),
+	}).Create(&userMonster).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "failed to update UserMonster familiarity")
+	}
+	log.Infof("damage calculate, last_practice_at %v, damage_rate= %v, difficulty= %v, current= %v, new= %v", dm.PracticeAt, damageRate, dm.Difficulty, dm.Familiarity, newFamiliarity)
+
+	nextRecallTime := CalculateNextPracticeAt(ctx, at, newFamiliarity, dm.Importance, &dungeon.MemorizationSetting)
+	updater := map[string]any{
+		"visibility":       utils.Percentage(newFamiliarity.Times(dm.Visibility.NormalizedFloat())),
+		"familiarity":      newFamiliarity,
+		"practice_at":      at,
+		"next_practice_at": nextRecallTime,
+		"practice_count":   gorm.Expr("practice_count + ?", 1),
+	}
+	// 不修改 dm，之后还要用复习前的状态计算积分和记录
+	if err := tx.WithContext(ctx).Model(&model.DungeonMonster{}).
+		Where("dungeon_id = ? AND item_id = ?", dm.DungeonID, dm.ItemID).
+		Updates(updater).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "failed to update DungeonMonster visibility and next recall time")
+	}
+	log.Infof("next_practice_at updated, last_practice_at= %v, new_familiarity= %v, importance= %v, next_recall_at= %v", dm.PracticeAt, newFamiliarity, dm.Importance, nextRecallTime)
+
+	// 计算积分变化
+	var familiarityAdd utils.Percentage
+	if newFamiliarity > dm.Familiarity {
+		familiarityAdd = newFamiliarity - dm.Familiarity
+	}
+	modifiers, err := model.GetNFTModifiers(ctx, tx, userID)
+	if err != nil {
+		return nil, nil, irr.Wrap(err, "failed to resolve nft modifiers")
+	}
+	breakdown := calculatePointsBreakdown(calculatePoints(damageRate, familiarityAdd, dm.Difficulty), modifiers)
+	cashEarned := breakdown.Base + breakdown.Bonus
+
+	// 先于积分修改，与购买补签卡时的加锁顺序一致
+	if err := model.RecordPracticeActivity(ctx, tx, userID, at, cashEarned); err != nil {
+		return nil, nil, irr.Wrap(err, "failed to record daily activity")
+	}
+	if cashEarned > 0 {
+		_, applied, err := model.ApplyPointChange(ctx, tx, model.PointChange{
+			UserID:         userID,
+			Currency:       model.CurrencyCash,
+			Delta:          int64(cashEarned),
+			Reason:         model.PointReasonCampaignSubmit,
+			RefID:          dungeon.ID,
+			IdempotencyKey: in.PointsKey,
+		})
+		if err != nil {
+			return nil, nil, irr.Wrap(err, "failed to update user points")
+		}
+		log.Infof("points earned: %v (bonus %v), applied: %v", cashEarned, breakdown.Bonus, applied)
+		if !applied {
+			// 相同的键已经发放过积分，这次作答没有获得积分
+			breakdown.Base, breakdown.Bonus, cashEarned = 0, 0, 0
+		}
+	}
+	if breakdown.DrawTicket > 0 {
+		// 与作答的积分共用幂等键，重复的提交不会再次发放
+		if _, _, err := model.ApplyPointChange(ctx, tx, model.PointChange{
+			UserID:         userID,
+			Currency:       model.CurrencyDrawTicket,
+			Delta:          int64(breakdown.DrawTicket),
+			Reason:         model.PointReasonNFTExtraDraw,
+			RefID:          dungeon.ID,
+			IdempotencyKey: in.PointsKey + ":ticket",
+		}); err != nil {
+			return nil, nil, irr.Wrap(err, "failed to grant draw ticket")
+		}
+	}
+
+	if err := publishPracticeEvents(ctx, tx, userID, dungeon, dm, result, userFamiliarityBefore, newFamiliarity, cashEarned, at); err != nil {
+		return nil, nil, irr.Wrap(err, "failed to publish practice events")
+	}
+
+	id, err := utils.GenIDU64(ctx)
+	if err != nil {
+		return nil, nil, irr.Wrap(err, "generate review log id failed")
+	}
+	review := &model.ReviewLog{
+		ID:                id,
+		UserID:            userID,
+		DungeonID:         dungeon.ID,
+		ItemID:            dm.ItemID,
+		SessionID:         in.SessionID,
+		Result:            result,
+		FamiliarityBefore: dm.Familiarity,
+		FamiliarityAfter:  newFamiliarity,
+		ResponseMS:        in.ResponseTime.Milliseconds(),
+		PracticedAt:       at,
+		NextPracticeAt:    nextRecallTime,
+	}
+	if err = tx.WithContext(ctx).Create(review).Error; err != nil {
+		return nil, nil, irr.Wrap(err, "failed to create review log")
+	}
+
+	// gorm.Expr 不能被序列化，返回计算后的次数
+	updater["practice_count"] = dm.PracticeCount + 1
+	return &dto.SubmitResults{
+		Updater: dto.Updater[*dto.DungeonMonster]{
+			From:    new(dto.DungeonMonster).FromModel(*dm),
+			Updates: updater,
+		},
+		PointsUpdate: dto.Points{
+			Cash:       cashEarned,
+			DrawTicket: breakdown.DrawTicket,
+		},
+		PointsBreakdown: breakdown,
+	}, review, nil
+}
+
+// calculatePointsBreakdown 在作答的基础积分上应用装备中的 NFT 的特效
+func calculatePointsBreakdown(base int, modifiers *model.NFTModifiers) *dto.PointsBreakdown {
+	breakdown := &dto.PointsBreakdown{
+		BonusPercent:     modifiers.BonusPercent,
+		ExtraDrawPercent: modifiers.ExtraDrawPercent,
+		NFTIDs:           modifiers.NFTIDs,
+	}
+	if base > 0 {
+		breakdown.Base = utils.UInt64(base)
+		breakdown.Bonus = utils.UInt64(modifiers.Bonus(uint64(base)))
+	}
+	if modifiers.RollExtraDraw() {
+		breakdown.DrawTicket = 1
+	}
+	return breakdown
+}
+
+// publishPracticeEvents 发布作答产生的领域事件，复习计划中的最后一个 monster 被掌握时同时发布 BossDefeated
+func publishPracticeEvents(ctx context.Context, tx *gorm.DB, userID utils.UInt64, dungeon *model.Dungeon, dm *model.DungeonMonster,
+	result def.AttackResult, userFamiliarityBefore, newFamiliarity utils.Percentage, cash utils.UInt64, at time.Time,
+) error {
+	events := []eventbus.Event{model.MonsterPracticed{
+		UserID:                userID,
+		DungeonID:             dungeon.ID,
+		ItemID:                dm.ItemID,
+		Result:                result,
+		FamiliarityBefore:     dm.Familiarity,
+		FamiliarityAfter:      newFamiliarity,
+		UserFamiliarityBefore: userFamiliarityBefore,
+		Cash:                  cash,
+		PracticedAt:           at,
+	}}
+
+	// 只在最后一个 monster 被掌握时检查
+	if dungeon.Type == def.DungeonTypeCampaign && dm.Familiarity < model.MasteredFamiliarity && newFamiliarity >= model.MasteredFamiliarity {
+		var remaining int64
+		if err := tx.WithContext(ctx).Model(&model.DungeonMonster{}).
+			Where("dungeon_id = ? AND familiarity < ?", dungeon.ID, model.MasteredFamiliarity).
+			Count(&remaining).Error; err != nil {
+			return irr.Wrap(err, "count unmastered monsters failed")
+		}
+		if remaining == 0 {
+			events = append(events, model.BossDefeated{UserID: userID, DungeonID: dungeon.ID})
+		}
+	}
+	return model.PublishEvents(ctx, tx, events...)
+}
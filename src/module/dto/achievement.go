@@ -0,0 +1,44 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+type (
+	// Achievement 成就的定义和当前用户的进度
+	Achievement struct {
+		ID          utils.UInt64               `json:"id"`
+		Name        string                     `json:"name"`
+		Description string                     `json:"description"`
+		Event       model.AchievementEventType `json:"event"`
+		Counter     model.AchievementCounter   `json:"counter"`
+		Threshold   uint64                     `json:"threshold"`
+		Reward      model.AchievementReward    `json:"reward"`
+		Progress    uint64                     `json:"progress"`
+		Unlocked    bool                       `json:"unlocked"`
+		UnlockedAt  *time.Time                 `json:"unlocked_at,omitempty"`
+	}
+
+	RespAchievement  = RespSuccess[*Achievement]
+	RespAchievements = RespSuccess[[]*Achievement]
+)
+
+// FromModel progress 为 nil 时表示用户还没有进度
+func (a *Achievement) FromModel(def *model.Achievement, progress *model.UserAchievement) *Achievement {
+	a.ID = def.ID
+	a.Name = def.Name
+	a.Description = def.Description
+	a.Event = def.Event
+	a.Counter = def.Counter
+	a.Threshold = def.Threshold
+	a.Reward = def.Reward
+	if progress != nil {
+		a.Progress = min(progress.Progress, def.Threshold)
+		a.Unlocked = progress.UnlockedAt != nil
+		a.UnlockedAt = progress.UnlockedAt
+	}
+	return a
+}
@@ -16,15 +16,49 @@ type (
 		UserID      utils.UInt64 `json:"user_id"`
 		Title       string       `json:"title"`
 		Description string       `json:"description"`
+		Visibility  string       `json:"visibility"`
 		CreatedAt   time.Time    `json:"created_at"`
 		UpdatedAt   time.Time    `json:"updated_at"`
 
 		Tags []string `json:"tags,omitempty"`
+
+		ShareCode   string `json:"share_code,omitempty"`  // 只返回给所有者
+		Subscribed  bool   `json:"subscribed,omitempty"`  // 订阅的其他用户的 book，只读
+		Subscribers *int64 `json:"subscribers,omitempty"` // 订阅人数，公开目录中返回
+
+		ForkedFrom *utils.UInt64 `json:"forked_from,omitempty"` // fork 的来源 book
+		Role       string        `json:"role,omitempty"`        // 当前用户在 book 中的角色，书库中返回
+	}
+
+	// BookUpstream fork 相对上游 book 的变化
+	BookUpstream struct {
+		BookID       utils.UInt64                `json:"book_id"`
+		SourceBookID utils.UInt64                `json:"source_book_id"`
+		PulledAt     *time.Time                  `json:"pulled_at,omitempty"`
+		Changes      []*model.ItemUpstreamChange `json:"changes"`
+	}
+
+	// BookShare 册子的分享信息
+	BookShare struct {
+		BookID     utils.UInt64 `json:"book_id"`
+		Visibility string       `json:"visibility"`
+		ShareCode  string       `json:"share_code,omitempty"`
+		SharePath  string       `json:"share_path,omitempty"` // 分享页面的路径，由前端处理
+		ShortURL   string       `json:"short_url,omitempty"`
 	}
 
 	BookItem struct {
-		BookID utils.UInt64 `json:"book_id"`
-		ItemID utils.UInt64 `json:"item_id"`
+		BookID    utils.UInt64 `json:"book_id"`
+		ItemID    utils.UInt64 `json:"item_id"`
+		ChapterID utils.UInt64 `json:"chapter_id,omitempty"`
+	}
+
+	// BookChapter 章节树中的节点，Children 按书中的顺序排列
+	BookChapter struct {
+		ID       utils.UInt64   `json:"id"`
+		ParentID utils.UInt64   `json:"parent_id,omitempty"`
+		Title    string         `json:"title"`
+		Children []*BookChapter `json:"children,omitempty"`
 	}
 
 	RespBookList     = RespSuccessPage[*Book]
@@ -37,6 +71,7 @@ func (b *Book) FromModel(m *model.Book, tags ...string) *Book {
 	b.UserID = m.UserID
 	b.Title = m.Title
 	b.Description = m.Description
+	b.Visibility = m.Visibility.String()
 	b.CreatedAt = m.CreatedAt
 	b.UpdatedAt = m.UpdatedAt
 	if tags != nil && len(tags) > 0 {
@@ -50,6 +85,26 @@ func (b *Book) SetTags(tags []string) *Book {
 	return b
 }
 
+// WithShareCode 分享码只返回给所有者
+func (b *Book) WithShareCode(m *model.Book, viewerID utils.UInt64) *Book {
+	if m.UserID == viewerID && m.ShareCode != nil {
+		b.ShareCode = *m.ShareCode
+	}
+	return b
+}
+
+func (b *Book) WithFork(fork *model.BookFork) *Book {
+	if fork != nil {
+		b.ForkedFrom = &fork.SourceBookID
+	}
+	return b
+}
+
+func (b *Book) WithSubscribers(count int64) *Book {
+	b.Subscribers = &count
+	return b
+}
+
 // responses
 type (
 	RespBookGet    = RespSuccess[*Book]
@@ -58,10 +113,59 @@ type (
 
 	RespBookDelete = RespSuccess[utils.UInt64]
 	RespBooks      = RespSuccessPage[Book]
+
+	RespBookShare       = RespSuccess[*BookShare]
+	RespBookSubscribe   = RespSuccess[*Book]
+	RespBookUnsubscribe = RespSuccess[utils.UInt64]
+
+	RespBookMembers      = RespSuccess[[]*model.BookMember]
+	RespBookMember       = RespSuccess[*model.BookMember]
+	RespBookMemberRemove = RespSuccess[utils.UInt64]
+	RespBookActivities   = RespSuccessPage[*model.BookActivity]
+
+	RespBookFork     = RespSuccess[*Book]
+	RespBookUpstream = RespSuccess[*BookUpstream]
+
+	RespBookChapters      = RespSuccess[[]*BookChapter]
+	RespBookChapter       = RespSuccess[*BookChapter]
+	RespBookChapterDelete = RespSuccess[utils.UInt64]
+	RespBookItemsMove     = RespSuccess[[]*BookItem]
 )
 
+func (bu *BookUpstream) FromModel(fork *model.BookFork, changes []*model.ItemUpstreamChange) *BookUpstream {
+	bu.BookID = fork.BookID
+	bu.SourceBookID = fork.SourceBookID
+	bu.PulledAt = fork.PulledAt
+	bu.Changes = changes
+	return bu
+}
+
 func (bi *BookItem) FromModel(m *model.BookItem) *BookItem {
 	bi.BookID = m.BookID
 	bi.ItemID = m.ItemID
+	bi.ChapterID = m.ChapterID
 	return bi
 }
+
+func (bc *BookChapter) FromModel(m *model.BookChapter) *BookChapter {
+	bc.ID = m.ID
+	bc.ParentID = m.ParentID
+	bc.Title = m.Title
+	return bc
+}
+
+// BuildChapterTree 把按书中顺序 (深度优先) 排列的章节组装成树，返回顶层章节
+func BuildChapterTree(chapters []*model.BookChapter) []*BookChapter {
+	nodes := make(map[utils.UInt64]*BookChapter, len(chapters))
+	roots := make([]*BookChapter, 0)
+	for _, m := range chapters {
+		node := new(BookChapter).FromModel(m)
+		nodes[m.ID] = node
+		if parent, ok := nodes[m.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
@@ -24,9 +24,10 @@ type (
 		CreatedAt time.Time `json:"created_at"`
 		UpdatedAt time.Time `json:"updated_at"`
 
-		Books []utils.UInt64 `json:"books,omitempty"`
-		Items []utils.UInt64 `json:"items,omitempty"`
-		Tags  []string       `json:"tags,omitempty"`
+		Books    []utils.UInt64 `json:"books,omitempty"`
+		Items    []utils.UInt64 `json:"items,omitempty"`
+		Tags     []string       `json:"tags,omitempty"`
+		TagQuery string         `json:"tag_query,omitempty"` // 标签表达式，匹配的 items 也会加入复习
 	}
 
 	DungeonMonster struct {
@@ -63,17 +64,62 @@ type (
 
 	SubmitResults struct {
 		Updater[*DungeonMonster]
-		PointsUpdate Points `json:"points_update"`
+		PointsUpdate    Points           `json:"points_update"`
+		PointsBreakdown *PointsBreakdown `json:"points_breakdown,omitempty"`
+	}
+
+	// PointsBreakdown 一次作答的积分来源，Base + Bonus 等于 PointsUpdate.Cash
+	PointsBreakdown struct {
+		Base             utils.UInt64   `json:"base"`               // 按熟练度变化和难度计算的积分
+		Bonus            utils.UInt64   `json:"bonus"`              // 装备中的 NFT 增加的积分
+		BonusPercent     uint64         `json:"bonus_percent"`      // 见 model.NFTModifiers
+		DrawTicket       utils.UInt64   `json:"draw_ticket"`        // 获得的抽卡券
+		ExtraDrawPercent uint64         `json:"extra_draw_percent"` // 获得抽卡券的概率
+		NFTIDs           []utils.UInt64 `json:"nft_ids"`            // 生效的 NFT
+	}
+
+	// SyncStatus 离线复习同步时每次作答的处理结果
+	SyncStatus string
+
+	// SyncOutcome 离线复习同步时一次作答的处理结果，Results 只在 applied 和 duplicate 时存在
+	SyncOutcome struct {
+		AttemptID string         `json:"attempt_id"`
+		MonsterID utils.UInt64   `json:"monster_id"`
+		Status    SyncStatus     `json:"status"`
+		Reason    string         `json:"reason,omitempty"`
+		Results   *SubmitResults `json:"results,omitempty"`
+	}
+
+	// SyncDownload 离线复习前下载的 monsters
+	SyncDownload struct {
+		ServerTime time.Time         `json:"server_time"`
+		Monsters   []*DungeonMonster `json:"monsters"`
+	}
+
+	// SyncResults 离线复习上传的处理结果，Outcomes 与上传的作答一一对应，按处理的顺序 (时间顺序) 排列
+	SyncResults struct {
+		ServerTime   time.Time      `json:"server_time"`
+		Outcomes     []*SyncOutcome `json:"outcomes"`
+		PointsUpdate Points         `json:"points_update"` // 本次同步新发放的积分
 	}
 
 	RespDungeon     = RespSuccess[*Dungeon]
 	RespDungeonList = RespSuccessPage[*Dungeon]
 
 	RespMonsterUpdate = RespSuccess[*SubmitResults]
+	RespSyncDownload  = RespSuccess[*SyncDownload]
+	RespSyncResults   = RespSuccess[*SyncResults]
 	RespMonsterGet    = RespSuccess[*DungeonMonster]
 	RespMonsterList   = RespSuccessPage[*DungeonMonster]
 )
 
+const (
+	SyncStatusApplied    SyncStatus = "applied"    // 已经按作答的时间更新了熟练度和复习时间
+	SyncStatusDuplicate  SyncStatus = "duplicate"  // 之前已经处理过，Results 为第一次处理的结果
+	SyncStatusSuperseded SyncStatus = "superseded" // monster 在这之后已经被复习过 (例如在另一台设备上)，不再生效
+	SyncStatusRejected   SyncStatus = "rejected"   // 作答不合法，见 Reason
+)
+
 func (dto *DungeonMonster) FromModel(dm model.DungeonMonster) *DungeonMonster {
 	dto.DungeonID = dm.DungeonID
 	dto.ItemID = dm.ItemID
@@ -104,6 +150,7 @@ func (d *Dungeon) FromModel(model *model.Dungeon) *Dungeon {
 	d.Type = model.Type
 	d.Title = model.Title
 	d.Description = model.Description
+	d.TagQuery = model.TagQuery
 	memSetting := model.MemorizationSetting
 	d.SettingsMemorization = &SettingsMemorization{
 		ReviewInterval:       &memSetting.ReviewInterval,
@@ -4,6 +4,8 @@ import (
 	"time"
 
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/search"
+	"github.com/bagaking/memorianexus/pkg/tags"
 
 	"github.com/bagaking/memorianexus/src/def"
 
@@ -13,15 +15,26 @@ import (
 // Item 数据传输对象
 type (
 	Item struct {
-		ID         utils.UInt64        `json:"id"`
-		CreatorID  utils.UInt64        `json:"creator_id"`
-		Type       string              `json:"type"`
-		Content    string              `json:"content"`
-		Tags       []string            `json:"tags,omitempty"`
-		CreatedAt  time.Time           `json:"created_at"`
-		UpdatedAt  time.Time           `json:"updated_at"`
-		Difficulty def.DifficultyLevel `json:"difficulty"`
-		Importance def.ImportanceLevel `json:"importance"`
+		ID        utils.UInt64   `json:"id"`
+		CreatorID utils.UInt64   `json:"creator_id"`
+		Type      string         `json:"type"`
+		Content   string         `json:"content"`
+		Tags      []string       `json:"tags,omitempty"`
+		Media     []*Media       `json:"media,omitempty"`
+		Highlight *ItemHighlight `json:"highlight,omitempty"` // 仅在搜索时返回
+		// SuggestedTags 推荐的标签，仅在创建时返回
+		SuggestedTags []*tags.TagSuggestion `json:"suggested_tags,omitempty"`
+		CreatedAt     time.Time             `json:"created_at"`
+		UpdatedAt     time.Time             `json:"updated_at"`
+		Difficulty    def.DifficultyLevel   `json:"difficulty"`
+		Importance    def.ImportanceLevel   `json:"importance"`
+	}
+
+	// ItemHighlight 搜索命中信息，Spans 为命中区间在 content 中的 rune 下标，Snippet 已做 html 转义
+	ItemHighlight struct {
+		Score   float64       `json:"score"`
+		Spans   []search.Span `json:"spans,omitempty"`
+		Snippet string        `json:"snippet,omitempty"`
 	}
 
 	RespItemGet    = RespSuccess[*Item]
@@ -49,3 +62,17 @@ func (dto *Item) FromModel(item *model.Item, tags ...string) *Item {
 	}
 	return dto
 }
+
+func (dto *Item) WithMedia(medias []*model.Media) *Item {
+	if len(medias) > 0 {
+		dto.Media = MediaListFromModels(medias)
+	}
+	return dto
+}
+
+func (dto *Item) WithSearchHit(hit *model.ItemSearchHit) *Item {
+	if hit != nil {
+		dto.Highlight = &ItemHighlight{Score: hit.Score, Spans: hit.Highlights, Snippet: hit.Snippet}
+	}
+	return dto
+}
@@ -0,0 +1,55 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+type (
+	// Media 数据传输对象
+	Media struct {
+		Hash      string    `json:"hash"`
+		Kind      string    `json:"kind"`
+		MimeType  string    `json:"mime_type"`
+		Size      int64     `json:"size"`
+		FileName  string    `json:"file_name,omitempty"`
+		URL       string    `json:"url"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// MediaQuota 用户的媒体空间使用情况
+	MediaQuota struct {
+		Used  int64 `json:"used"`
+		Total int64 `json:"total"`
+	}
+
+	RespMediaUpload = RespSuccess[*Media]
+	RespMediaDelete = RespSuccess[*Media]
+	RespMediaList   = RespSuccessPage[*Media]
+)
+
+// MediaRoute media 的访问路径 (相对于 API Group)
+const MediaRoute = "/media/"
+
+func (dto *Media) FromModel(m *model.Media) *Media {
+	if m == nil {
+		return nil
+	}
+	dto.Hash = m.Hash
+	dto.Kind = m.Kind
+	dto.MimeType = m.MimeType
+	dto.Size = m.Size
+	dto.FileName = m.FileName
+	dto.URL = MediaRoute + m.Hash
+	dto.CreatedAt = m.CreatedAt
+	return dto
+}
+
+func MediaListFromModels(medias []*model.Media) []*Media {
+	ret := make([]*Media, 0, len(medias))
+	for _, m := range medias {
+		ret = append(ret, new(Media).FromModel(m))
+	}
+	return ret
+}
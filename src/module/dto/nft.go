@@ -0,0 +1,281 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+type (
+	// NFT 用户持有的 NFT 和它的模板
+	NFT struct {
+		ID           utils.UInt64            `json:"id"`
+		TemplateID   utils.UInt64            `json:"template_id"`
+		Name         string                  `json:"name"`
+		Description  string                  `json:"description"`
+		Rarity       model.NFTRarity         `json:"rarity"`
+		Effect       model.NFTEffect         `json:"effect"`
+		Category     model.NFTEffectCategory `json:"category"`
+		Source       model.NFTSource         `json:"source"`
+		ChainTokenID string                  `json:"chain_token_id,omitempty"`
+		EquippedAt   *time.Time              `json:"equipped_at,omitempty"` // 为空表示没有装备
+		CreatedAt    time.Time               `json:"created_at"`
+	}
+
+	// NFTPity 卡池的保底规则和当前用户的保底计数
+	NFTPity struct {
+		Rarity model.NFTRarity `json:"rarity"`
+		After  uint32          `json:"after"`
+		Count  uint32          `json:"count"` // 距离上一次抽到 rarity 或更高稀有度的次数
+	}
+
+	// NFTPool 卡池
+	NFTPool struct {
+		ID          utils.UInt64                       `json:"id"`
+		Name        string                             `json:"name"`
+		Description string                             `json:"description"`
+		Currency    model.Currency                     `json:"currency"`
+		Price       uint64                             `json:"price"`
+		Ticket      bool                               `json:"ticket"` // 是否可以用抽卡券抽卡
+		Rates       map[model.NFTRarity]uint64         `json:"rates"`  // 各稀有度的权重
+		Pity        []*NFTPity                         `json:"pity,omitempty"`
+		Templates   map[model.NFTRarity][]utils.UInt64 `json:"templates"` // 各稀有度可以抽到的模板
+	}
+
+	// DrawSeed 抽卡使用的服务端种子，公开 (更换) 之后才返回 ServerSeed
+	DrawSeed struct {
+		ID             utils.UInt64 `json:"id"`
+		ServerSeedHash string       `json:"server_seed_hash"`
+		ServerSeed     string       `json:"server_seed,omitempty"`
+		Nonce          uint64       `json:"nonce"` // 最后一次抽卡使用的 nonce
+		RevealedAt     *time.Time   `json:"revealed_at,omitempty"`
+	}
+
+	// DrawSeedRotation 更换种子的结果
+	DrawSeedRotation struct {
+		Revealed *DrawSeed `json:"revealed"`
+		Active   *DrawSeed `json:"active"`
+	}
+
+	// NFTDraw 一次抽卡的记录，用 server_seed、client_seed 和 nonce 可以复算结果
+	NFTDraw struct {
+		ID             utils.UInt64    `json:"id"`
+		PoolID         utils.UInt64    `json:"pool_id"`
+		ServerSeedHash string          `json:"server_seed_hash"`
+		ServerSeed     string          `json:"server_seed,omitempty"` // 种子公开之后才返回
+		ClientSeed     string          `json:"client_seed"`
+		Nonce          uint64          `json:"nonce"`
+		Rarity         model.NFTRarity `json:"rarity"`
+		Pity           bool            `json:"pity"`
+		TemplateID     utils.UInt64    `json:"template_id"`
+		NFTID          utils.UInt64    `json:"nft_id"`
+		CreatedAt      time.Time       `json:"created_at"`
+	}
+
+	// DrawResult 一次抽卡请求的结果
+	DrawResult struct {
+		Draws []*NFTDraw `json:"draws"`
+		NFTs  []*NFT     `json:"nfts"`
+	}
+
+	// NFTTrade 用户之间的挂单和挂单的 NFT 的模板
+	NFTTrade struct {
+		ID          utils.UInt64            `json:"id"`
+		SellerID    utils.UInt64            `json:"seller_id"`
+		BuyerID     utils.UInt64            `json:"buyer_id,omitempty"`
+		NFTID       utils.UInt64            `json:"nft_id"`
+		TemplateID  utils.UInt64            `json:"template_id"`
+		Name        string                  `json:"name"`
+		Description string                  `json:"description"`
+		Rarity      model.NFTRarity         `json:"rarity"`
+		Effect      model.NFTEffect         `json:"effect"`
+		Category    model.NFTEffectCategory `json:"category"`
+		Currency    model.Currency          `json:"currency"`
+		Price       uint64                  `json:"price"`
+		Status      model.NFTTradeStatus    `json:"status"`
+		CreatedAt   time.Time               `json:"created_at"`
+		ClosedAt    *time.Time              `json:"closed_at,omitempty"`
+	}
+
+	// TradeResult 购买挂单的结果
+	TradeResult struct {
+		Trade *NFTTrade `json:"trade"`
+		NFT   *NFT      `json:"nft"`
+	}
+
+	// NFTShopItem 商店中的商品，price 是当前的价格
+	NFTShopItem struct {
+		ID          utils.UInt64            `json:"id"`
+		TemplateID  utils.UInt64            `json:"template_id"`
+		Name        string                  `json:"name"`
+		Description string                  `json:"description"`
+		Rarity      model.NFTRarity         `json:"rarity"`
+		Effect      model.NFTEffect         `json:"effect"`
+		Category    model.NFTEffectCategory `json:"category"`
+		Currency    model.Currency          `json:"currency"`
+		Price       uint64                  `json:"price"`
+		OnSale      bool                    `json:"on_sale"`
+		Stock       uint64                  `json:"stock"` // 总库存，0 表示不限量
+		Sold        uint64                  `json:"sold"`
+		Prices      []*model.NFTShopPrice   `json:"prices"` // 价格的时间表
+	}
+
+	// NFTShop 系统经营的商店
+	NFTShop struct {
+		ID          utils.UInt64   `json:"id"`
+		Name        string         `json:"name"`
+		Description string         `json:"description"`
+		Items       []*NFTShopItem `json:"items"`
+	}
+
+	// ShopOrder 在商店购买的结果
+	ShopOrder struct {
+		Order *model.NFTShopOrder `json:"order"`
+		NFT   *NFT                `json:"nft"`
+	}
+
+	RespNFT              = RespSuccess[*NFT]
+	RespNFTs             = RespSuccessPage[*NFT]
+	RespNFTPools         = RespSuccess[[]*NFTPool]
+	RespDrawResult       = RespSuccess[*DrawResult]
+	RespNFTDraws         = RespSuccessPage[*NFTDraw]
+	RespDrawSeed         = RespSuccess[*DrawSeed]
+	RespDrawSeedRotation = RespSuccess[*DrawSeedRotation]
+	RespNFTModifiers     = RespSuccess[*model.NFTModifiers]
+	RespNFTTrade         = RespSuccess[*NFTTrade]
+	RespNFTTrades        = RespSuccessPage[*NFTTrade]
+	RespTradeResult      = RespSuccess[*TradeResult]
+	RespNFTShop          = RespSuccess[*NFTShop]
+	RespNFTShops         = RespSuccess[[]*NFTShop]
+	RespShopOrder        = RespSuccess[*ShopOrder]
+)
+
+// FromModel 模板已经下线时只返回 NFT 本身的信息
+func (n *NFT) FromModel(nft *model.NFT) *NFT {
+	n.ID = nft.ID
+	n.TemplateID = nft.TemplateID
+	n.Rarity = nft.Rarity
+	n.Source = nft.Source
+	n.ChainTokenID = nft.ChainTokenID
+	n.EquippedAt = nft.EquippedAt
+	n.CreatedAt = nft.CreatedAt
+	if template, err := model.GetNFTTemplate(nft.TemplateID); err == nil {
+		n.Name = template.Name
+		n.Description = template.Description
+		n.Effect = template.Effect
+		n.Category = template.Effect.Type.Category()
+	}
+	return n
+}
+
+// FromModel counters 是当前用户在卡池中的保底计数
+func (p *NFTPool) FromModel(pool *model.NFTPool, counters map[model.NFTRarity]uint32) *NFTPool {
+	p.ID = pool.ID
+	p.Name = pool.Name
+	p.Description = pool.Description
+	p.Currency = pool.Currency
+	p.Price = pool.Price
+	p.Ticket = pool.Ticket
+	p.Rates = pool.Rates
+	for _, rule := range pool.Pity {
+		p.Pity = append(p.Pity, &NFTPity{Rarity: rule.Rarity, After: rule.After, Count: counters[rule.Rarity]})
+	}
+	p.Templates = make(map[model.NFTRarity][]utils.UInt64)
+	for _, t := range model.NFTTemplates() {
+		if pool.Rates[t.Rarity] > 0 || p.hasPity(t.Rarity) {
+			p.Templates[t.Rarity] = append(p.Templates[t.Rarity], t.ID)
+		}
+	}
+	return p
+}
+
+func (p *NFTPool) hasPity(rarity model.NFTRarity) bool {
+	for _, rule := range p.Pity {
+		if rule.Rarity == rarity {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DrawSeed) FromModel(seed *model.NFTDrawSeed) *DrawSeed {
+	s.ID = seed.ID
+	s.ServerSeedHash = seed.ServerSeedHash
+	s.Nonce = seed.Nonce
+	s.RevealedAt = seed.RevealedAt
+	if seed.RevealedAt != nil {
+		s.ServerSeed = seed.ServerSeed
+	}
+	return s
+}
+
+// FromModel seed 是抽卡使用的种子，未公开时只返回哈希
+func (d *NFTDraw) FromModel(draw *model.NFTDraw, seed *model.NFTDrawSeed) *NFTDraw {
+	d.ID = draw.ID
+	d.PoolID = draw.PoolID
+	d.ClientSeed = draw.ClientSeed
+	d.Nonce = draw.Nonce
+	d.Rarity = draw.Rarity
+	d.Pity = draw.Pity
+	d.TemplateID = draw.TemplateID
+	d.NFTID = draw.NFTID
+	d.CreatedAt = draw.CreatedAt
+	if seed != nil {
+		d.ServerSeedHash = seed.ServerSeedHash
+		if seed.RevealedAt != nil {
+			d.ServerSeed = seed.ServerSeed
+		}
+	}
+	return d
+}
+
+// FromModel 模板已经下线时只返回挂单本身的信息
+func (t *NFTTrade) FromModel(trade *model.NFTTrade) *NFTTrade {
+	t.ID = trade.ID
+	t.SellerID = trade.SellerID
+	t.BuyerID = trade.BuyerID
+	t.NFTID = trade.NFTID
+	t.TemplateID = trade.TemplateID
+	t.Rarity = trade.Rarity
+	t.Currency = trade.Currency
+	t.Price = trade.Price
+	t.Status = trade.Status
+	t.CreatedAt = trade.CreatedAt
+	t.ClosedAt = trade.ClosedAt
+	if template, err := model.GetNFTTemplate(trade.TemplateID); err == nil {
+		t.Name = template.Name
+		t.Description = template.Description
+		t.Effect = template.Effect
+		t.Category = template.Effect.Type.Category()
+	}
+	return t
+}
+
+// FromModel sold 是各商品已经售出的数量，now 决定当前的价格
+func (s *NFTShop) FromModel(shop *model.NFTShop, sold map[utils.UInt64]uint64, now time.Time) *NFTShop {
+	s.ID = shop.ID
+	s.Name = shop.Name
+	s.Description = shop.Description
+	s.Items = make([]*NFTShopItem, 0, len(shop.Items))
+	for _, item := range shop.Items {
+		i := &NFTShopItem{
+			ID:         item.ID,
+			TemplateID: item.TemplateID,
+			Currency:   item.Currency,
+			Stock:      item.Stock,
+			Sold:       sold[item.ID],
+			Prices:     item.Prices,
+		}
+		i.Price, i.OnSale = item.PriceAt(now)
+		if template, err := model.GetNFTTemplate(item.TemplateID); err == nil {
+			i.Name = template.Name
+			i.Description = template.Description
+			i.Rarity = template.Rarity
+			i.Effect = template.Effect
+			i.Category = template.Effect.Type.Category()
+		}
+		s.Items = append(s.Items, i)
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/core/review"
+	"github.com/bagaking/memorianexus/src/def"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+type (
+	// SessionMessageType 复习会话中 WebSocket 消息的类型
+	SessionMessageType string
+
+	// SessionClientMessage 客户端发送的消息
+	SessionClientMessage struct {
+		Type   SessionMessageType `json:"type"`
+		ItemID utils.UInt64       `json:"item_id,omitempty"` // answer: 作答的 monster
+		Result def.AttackResult   `json:"result,omitempty"`  // answer: 作答的结果
+	}
+
+	// SessionServerMessage 服务端发送的消息，根据 Type 只有对应的字段存在
+	SessionServerMessage struct {
+		Type    SessionMessageType `json:"type"`
+		Session *PracticeSession   `json:"session,omitempty"`
+		Monster *DungeonMonster    `json:"monster,omitempty"`
+		Graded  *SessionGrade      `json:"graded,omitempty"`
+		Error   string             `json:"error,omitempty"`
+	}
+
+	// SessionGrade 一次作答的评分
+	SessionGrade struct {
+		Seq               int              `json:"seq"`
+		ItemID            utils.UInt64     `json:"item_id"`
+		Result            def.AttackResult `json:"result"`
+		FamiliarityBefore utils.Percentage `json:"familiarity_before"`
+		FamiliarityAfter  utils.Percentage `json:"familiarity_after"`
+		FamiliarityDelta  int              `json:"familiarity_delta"`
+		NextPracticeAt    time.Time        `json:"next_practice_at"`
+		ResponseMS        int64            `json:"response_ms"`
+		Relearn           bool             `json:"relearn"` // 答错了，会在会话中再次出现
+		PointsUpdate      Points           `json:"points_update"`
+	}
+
+	// PracticeSession 复习会话的汇总
+	PracticeSession struct {
+		ID              utils.UInt64           `json:"id"`
+		DungeonID       utils.UInt64           `json:"dungeon_id"`
+		EndReason       model.SessionEndReason `json:"end_reason,omitempty"`
+		Answered        uint32                 `json:"answered"`
+		Failed          uint32                 `json:"failed"`
+		FamiliarityGain int64                  `json:"familiarity_gain"`
+		AvgResponseMS   int64                  `json:"avg_response_ms"`
+		PointsUpdate    Points                 `json:"points_update"`
+		StartedAt       time.Time              `json:"started_at"`
+		EndedAt         *time.Time             `json:"ended_at,omitempty"`
+	}
+
+	RespPracticeSessions = RespSuccessPage[*PracticeSession]
+)
+
+const (
+	SessionMsgAnswer  SessionMessageType = "answer"  // client: 对当前的 monster 作答
+	SessionMsgEnd     SessionMessageType = "end"     // client: 结束会话
+	SessionMsgStarted SessionMessageType = "started" // server: 会话已经开始
+	SessionMsgMonster SessionMessageType = "monster" // server: 下一个 monster
+	SessionMsgGraded  SessionMessageType = "graded"  // server: 作答的评分
+	SessionMsgError   SessionMessageType = "error"   // server: 消息无法处理，会话继续
+	SessionMsgSummary SessionMessageType = "summary" // server: 会话结束，之后连接关闭
+)
+
+func (s *SessionGrade) FromReview(g *review.Grade) *SessionGrade {
+	s.Seq = g.Seq
+	s.ItemID = g.ItemID
+	s.Result = g.Result
+	s.FamiliarityBefore = g.FamiliarityBefore
+	s.FamiliarityAfter = g.FamiliarityAfter
+	s.FamiliarityDelta = int(g.FamiliarityAfter) - int(g.FamiliarityBefore)
+	s.NextPracticeAt = g.NextPracticeAt
+	s.ResponseMS = g.ResponseTime.Milliseconds()
+	s.Relearn = g.Relearn
+	s.PointsUpdate = Points{Cash: g.Cash}
+	return s
+}
+
+func (s *PracticeSession) FromModel(m *model.PracticeSession) *PracticeSession {
+	s.ID = m.ID
+	s.DungeonID = m.DungeonID
+	s.EndReason = m.EndReason
+	s.Answered = m.Answered
+	s.Failed = m.Failed
+	s.FamiliarityGain = m.FamiliarityGain
+	if m.Answered > 0 {
+		s.AvgResponseMS = m.ResponseMS / int64(m.Answered)
+	}
+	s.PointsUpdate = Points{Cash: m.Cash}
+	s.StartedAt = m.StartedAt
+	s.EndedAt = m.EndedAt
+	return s
+}
@@ -41,15 +41,57 @@ type (
 	}
 
 	Points struct {
-		Cash     utils.UInt64 `json:"cash"`
-		Gem      utils.UInt64 `json:"gem"`
-		VIPScore utils.UInt64 `json:"vip_score"`
+		Cash       utils.UInt64 `json:"cash"`
+		Gem        utils.UInt64 `json:"gem"`
+		VIPScore   utils.UInt64 `json:"vip_score"`
+		DrawTicket utils.UInt64 `json:"draw_ticket"`
+		Idle       *IdleIncome  `json:"idle,omitempty"` // 只在查询积分时返回
+	}
+
+	// IdleIncome 挂机收益，Claimable 为截止查询时可以领取的 cash
+	IdleIncome struct {
+		Rate        uint64       `json:"rate"`         // 每小时产出的 cash
+		NFTRate     uint64       `json:"nft_rate"`     // 持有的挂机类 NFT 每小时产出的 cash
+		MonsterRate uint64       `json:"monster_rate"` // 掌握的 monster 每小时产出的 cash
+		Claimable   utils.UInt64 `json:"claimable"`
+		ClaimedAt   time.Time    `json:"claimed_at"`
+		FullAt      time.Time    `json:"full_at"` // 这之后不再累积，需要领取
+	}
+
+	// IdleClaim 领取挂机收益的结果
+	IdleClaim struct {
+		Claimed utils.UInt64 `json:"claimed"`
+		Points  *Points      `json:"points"`
+	}
+
+	// DailyGoal 每日目标
+	DailyGoal struct {
+		Type   model.GoalType `json:"type"`
+		Target uint32         `json:"target"`
+	}
+
+	// Streak 连续打卡，日期按用户的时区
+	Streak struct {
+		Timezone      string                 `json:"timezone"`
+		Goal          DailyGoal              `json:"goal"`
+		CurrentStreak uint32                 `json:"current_streak"`
+		LongestStreak uint32                 `json:"longest_streak"`
+		LastGoalDate  string                 `json:"last_goal_date,omitempty"`
+		Today         *model.DailyActivity   `json:"today"`
+		Freezes       uint32                 `json:"freezes"`
+		MaxFreezes    uint32                 `json:"max_freezes"`
+		FreezePrice   uint32                 `json:"freeze_price"` // 一张补签卡的价格 (Gem)
+		Days          []*model.DailyActivity `json:"days"`         // 最近的每日统计，最新的在前，没有记录的日子不返回
 	}
 
 	RespProfile              = RespSuccess[*Profile]
 	RespSettingsMemorization = RespSuccess[*SettingsMemorization]
 	RespSettingsAdvance      = RespSuccess[*SettingsAdvance]
 	RespPoints               = RespSuccess[*Points]
+	RespIdleClaim            = RespSuccess[*IdleClaim]
+	RespPointHistory         = RespSuccessPage[*model.PointTransaction]
+	RespPointDiscrepancies   = RespSuccess[[]*model.PointDiscrepancy]
+	RespStreak               = RespSuccess[*Streak]
 )
 
 func (p *Profile) FromModel(model *model.Profile) *Profile {
@@ -101,5 +143,37 @@ func (p *Points) FromModel(model *model.ProfilePoints) *Points {
 	p.Cash = model.Cash
 	p.Gem = model.Gem
 	p.VIPScore = model.VipScore
+	p.DrawTicket = model.DrawTicket
 	return p
 }
+
+// FromModel income 应该已经结算到查询的时间，见 model.IdleIncome.At
+func (i *IdleIncome) FromModel(income *model.IdleIncome) *IdleIncome {
+	i.Rate = income.Rate
+	i.NFTRate = income.NFTRate
+	i.MonsterRate = income.MonsterRate
+	i.Claimable = utils.UInt64(income.Claimable())
+	i.ClaimedAt = income.ClaimedAt
+	i.FullAt = income.FullAt()
+	return i
+}
+
+// FromModel days 为最近的每日统计，today 为用户时区中的今天
+func (s *Streak) FromModel(streak *model.UserStreak, days []*model.DailyActivity, today string) *Streak {
+	s.Timezone = streak.Timezone
+	s.Goal = DailyGoal{Type: streak.GoalType, Target: streak.GoalTarget}
+	s.CurrentStreak = streak.CurrentStreak
+	s.LongestStreak = streak.LongestStreak
+	s.LastGoalDate = streak.LastGoalDate
+	s.Freezes = streak.Freezes
+	s.MaxFreezes = model.MaxStreakFreezes
+	s.FreezePrice = model.StreakFreezePrice
+	s.Today = &model.DailyActivity{Date: today}
+	for _, day := range days {
+		if day.Date == today {
+			s.Today = day
+		}
+	}
+	s.Days = days
+	return s
+}
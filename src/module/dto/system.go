@@ -0,0 +1,9 @@
+package dto
+
+import "github.com/bagaking/memorianexus/pkg/tags"
+
+type (
+	RespTagUpdateStats = RespSuccess[tags.TagUpdateStats]
+	RespDeadLetter     = RespSuccess[*tags.DeadLetter]
+	RespDeadLetterList = RespSuccessPage[*tags.DeadLetter]
+)
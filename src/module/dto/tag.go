@@ -1,6 +1,36 @@
 package dto
 
+import (
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+)
+
 type (
-	RespTagGet  = RespSuccess[string]
-	RespTagList = RespSuccessPage[string]
+	// TagChange 标签重命名、合并或删除的结果
+	TagChange struct {
+		From     string `json:"from"`
+		To       string `json:"to,omitempty"`
+		Affected int    `json:"affected"` // 受影响的标签记录数，即 (entity, tag) 对的数量
+	}
+
+	// TagBulkChange 批量修改标签的结果
+	TagBulkChange struct {
+		EntityIDs []utils.UInt64 `json:"entity_ids"`
+		Added     []string       `json:"added"`
+		Removed   []string       `json:"removed"`
+	}
+
+	// TagQuery 标签表达式查询的附加信息
+	TagQuery struct {
+		Query string   `json:"query"` // 规范化后的表达式
+		Tags  []string `json:"tags"`  // 表达式中出现的标签
+		Type  string   `json:"type,omitempty"`
+	}
+
+	RespTagGet        = RespSuccess[string]
+	RespTagList       = RespSuccessPage[string]
+	RespTagTree       = RespSuccess[[]*tags.TagNode]
+	RespTagChange     = RespSuccess[*TagChange]
+	RespTagBulkChange = RespSuccess[*TagBulkChange]
+	RespTagSuggest    = RespSuccess[[]*tags.TagSuggestion]
 )
@@ -1,12 +1,14 @@
 package dungeon
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
 
 	"github.com/bagaking/memorianexus/internal/utils"
 
+	"github.com/bagaking/memorianexus/pkg/tags"
 	"github.com/bagaking/memorianexus/src/def"
 	"github.com/khicago/irr"
 	"gorm.io/gorm"
@@ -22,24 +24,28 @@ import (
 type ReqCreateDungeon struct {
 	dto.DungeonData
 
-	Books []utils.UInt64 `json:"books,omitempty"`
-	Items []utils.UInt64 `json:"items,omitempty"`
-	Tags  []string       `json:"tags,omitempty"`
+	Books    []utils.UInt64 `json:"books,omitempty"`
+	Items    []utils.UInt64 `json:"items,omitempty"`
+	Tags     []string       `json:"tags,omitempty"`
+	TagQuery string         `json:"tag_query,omitempty"` // 标签表达式，如 (grammar OR vocab) AND NOT hard
 }
 
 type ReqUpdateDungeon struct {
 	dto.DungeonData
+
+	TagQuery *string `json:"tag_query,omitempty"` // 为空字符串时清除标签表达式
 }
 
 // CreateDungeon handles the creation of a new dungeon campaign
 // @Summary Create a new dungeon campaign
-// @Description 创建新的复习计划
+// @Description 创建新的复习计划，campaign 和 endless 之外的类型 (如 instance) 需要装备解锁它的 NFT
 // @Tags dungeon
 // @Accept json
 // @Produce json
 // @Param campaign body ReqCreateDungeon true "Dungeon campaign data"
 // @Success 201 {object} dto.RespDungeon "Successfully created dungeon"
 // @Failure 400 {object} utils.ErrorResponse "Invalid request body"
+// @Failure 403 {object} utils.ErrorResponse "Dungeon type is locked"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/dungeons [post]
 func (svr *Service) CreateDungeon(c *gin.Context) {
@@ -62,11 +68,29 @@ func (svr *Service) CreateDungeon(c *gin.Context) {
 		return
 	}
 
-	if req.Type != def.DungeonTypeCampaign && req.Type != def.DungeonTypeEndless {
+	if !req.Type.Valid() {
 		utils.GinHandleError(c, log, http.StatusBadRequest,
 			irr.Error("invalid dungeon type %v", req.Type), "Invalid request body", utils.GinErrWithReqBody(req))
 		return
 	}
+	if unlocked, err := dungeonTypeUnlocked(c, svr.db, userID, req.Type); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Internal server error, get nft effects failed")
+		return
+	} else if !unlocked {
+		utils.GinHandleError(c, log, http.StatusForbidden,
+			irr.Error("dungeon type %s is locked", req.Type.String()), "Dungeon type is locked", utils.GinErrWithReqBody(req))
+		return
+	}
+
+	tagQuery, err := model.NormalizeTagQuery(req.TagQuery)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid tag query", utils.GinErrWithReqBody(req))
+		return
+	}
+	if req.Tags, err = tags.NormalizeTags(req.Tags); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid tags", utils.GinErrWithReqBody(req))
+		return
+	}
 
 	dungeonID, err := utils.GenIDU64(c)
 	if err != nil {
@@ -86,37 +110,48 @@ func (svr *Service) CreateDungeon(c *gin.Context) {
 		memorizationSetting = s.MemorizationSetting
 	}
 
-	dungeon, err := model.CreateDungeon(c, svr.db, &model.Dungeon{
+	dungeon := &model.Dungeon{
 		ID:                  dungeonID,
 		UserID:              userID,
 		Type:                req.Type,
 		Title:               req.Title,
 		Description:         req.Description,
+		TagQuery:            tagQuery,
 		MemorizationSetting: memorizationSetting, // fork setting form profile
-	})
-	// Create dungeon entry in the database
-	if err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Internal server error, create dungeon failed", utils.GinErrWithReqBody(req))
-		return
 	}
+	// 复习计划和它的 books、items、标签来源在同一个事务中创建，任何一步失败都不会留下不完整的复习计划
+	msg := "Create dungeon failed"
+	err = svr.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := model.CreateDungeon(c, tx, dungeon); err != nil {
+			return err
+		}
 
-	// Add books to dungeon
-	if err = dungeon.AddMonsterFromBook(c, svr.db, req.Books); err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			utils.GinHandleError(c, log, http.StatusNotFound, err, "Internal server error, books not found", utils.GinErrWithReqBody(req))
-		} else {
-			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Internal server error", utils.GinErrWithReqBody(req))
+		// Add books to dungeon
+		if err := dungeon.AddMonsterFromBook(c, tx, req.Books); err != nil {
+			msg = "Add books to dungeon failed"
+			return err
+		}
+
+		// Add items to dungeon
+		if err := dungeon.AddMonsters(c, tx, req.Items); err != nil {
+			msg = "Add items to dungeon failed"
+			return err
 		}
-		return
-	}
 
-	// Add items to dungeon
-	if err = dungeon.AddMonsters(c, svr.db, req.Items); err != nil {
+		// Add tags to dungeon, items of the tags and the tag query become monsters of campaign
+		msg = "Add items of tags to dungeon failed"
+		if len(req.Tags) > 0 {
+			_, err := dungeon.AddTags(c, tx, req.Tags)
+			return err
+		}
+		return dungeon.SyncTagMonsters(c, tx)
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			utils.GinHandleError(c, log, http.StatusNotFound, err, "Internal server error, items not found", utils.GinErrWithReqBody(req))
-		} else {
-			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Internal server error", utils.GinErrWithReqBody(req))
+			status = http.StatusNotFound
 		}
+		utils.GinHandleError(c, log, status, err, msg, utils.GinErrWithReqBody(req))
 		return
 	}
 
@@ -194,8 +229,8 @@ func (svr *Service) GetDungeon(c *gin.Context) {
 	id := utils.GinMustGetID(c)
 	log := l.WithField("user_id", userID).WithField("dungeon_id", id)
 
-	var dungeon model.Dungeon
-	if err := svr.db.Where("user_id = ? and id = ?", userID, id).First(&dungeon).Error; err != nil {
+	dungeon, err := model.FindDungeon(ctx, svr.db, userID, id, model.ActionRead)
+	if err != nil {
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
 		return
 	}
@@ -206,7 +241,7 @@ func (svr *Service) GetDungeon(c *gin.Context) {
 		return
 	}
 
-	resp := new(dto.RespDungeon).With(new(dto.Dungeon).FromModel(&dungeon))
+	resp := new(dto.RespDungeon).With(new(dto.Dungeon).FromModel(dungeon))
 	resp.Data.Books = books
 	resp.Data.Items = items
 	resp.Data.Tags = tags
@@ -223,6 +258,7 @@ func (svr *Service) GetDungeon(c *gin.Context) {
 // @Param campaign body ReqUpdateDungeon true "Dungeon campaign data"
 // @Success 200 {object} dto.RespDungeon "Successfully updated dungeon"
 // @Failure 400 {object} utils.ErrorResponse "Invalid request body"
+// @Failure 403 {object} utils.ErrorResponse "Dungeon type is locked"
 // @Failure 404 {object} utils.ErrorResponse "Dungeon not found"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/dungeons/{id} [put]
@@ -238,6 +274,20 @@ func (svr *Service) UpdateDungeon(c *gin.Context) {
 		return
 	}
 
+	if req.Type != 0 {
+		if !req.Type.Valid() {
+			utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("invalid dungeon type %v", req.Type), "Invalid request body")
+			return
+		}
+		if unlocked, err := dungeonTypeUnlocked(c, svr.db, userID, req.Type); err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Internal server error, get nft effects failed")
+			return
+		} else if !unlocked {
+			utils.GinHandleError(c, log, http.StatusForbidden, irr.Error("dungeon type %s is locked", req.Type.String()), "Dungeon type is locked")
+			return
+		}
+	}
+
 	updater := &model.Dungeon{
 		Type:        req.Type,
 		Title:       req.Title,
@@ -249,8 +299,42 @@ func (svr *Service) UpdateDungeon(c *gin.Context) {
 		req.SettingsMemorization.ToModel(&updater.MemorizationSetting)
 	}
 
-	if err := svr.db.Where("user_id = ? AND id = ?", userID, id).Updates(updater).Error; err != nil {
-		utils.GinHandleError(c, log, http.StatusNotFound, err, "Failed to update dungeon")
+	if req.TagQuery != nil {
+		tagQuery, err := model.NormalizeTagQuery(*req.TagQuery)
+		if err != nil {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid tag query")
+			return
+		}
+		req.TagQuery = &tagQuery
+	}
+
+	// 字段和标签表达式在同一个事务中更新，同步 monsters 失败时不会留下只更新了一半的复习计划
+	err := svr.db.Transaction(func(tx *gorm.DB) error {
+		// updated_at 总会变化，没有更新到记录说明复习计划不存在或没有权限
+		result := tx.Model(&model.Dungeon{}).Scopes(model.AuthzPolicy().Scope(userID, model.ResourceDungeon, model.ActionWrite)).
+			Where("dungeons.id = ?", id).Updates(updater)
+		if err := result.Error; err != nil {
+			return irr.Wrap(err, "failed to update dungeon")
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if req.TagQuery == nil {
+			return nil
+		}
+		dungeon, err := updateTagQuery(c, tx, userID, id, *req.TagQuery)
+		if err != nil {
+			return err
+		}
+		updater.TagQuery = dungeon.TagQuery
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to update dungeon")
+		}
 		return
 	}
 
@@ -258,6 +342,21 @@ func (svr *Service) UpdateDungeon(c *gin.Context) {
 	resp.Response(c, "dungeon updated")
 }
 
+// updateTagQuery 在事务中更新复习计划的标签表达式 (已经规范化，空字符串表示清除)，并同步 campaign 类型复习计划的 monsters
+func updateTagQuery(ctx context.Context, tx *gorm.DB, userID, dungeonID utils.UInt64, tagQuery string) (*model.Dungeon, error) {
+	dungeon, err := model.FindDungeon(ctx, tx, userID, dungeonID, model.ActionWrite)
+	if err != nil {
+		return nil, irr.Wrap(err, "dungeon not found")
+	}
+	if err = tx.Model(dungeon).Update("tag_query", tagQuery).Error; err != nil {
+		return nil, irr.Wrap(err, "failed to save tag query")
+	}
+	if err = dungeon.SyncTagMonsters(ctx, tx); err != nil {
+		return nil, irr.Wrap(err, "failed to add items of tag query")
+	}
+	return dungeon, nil
+}
+
 // DeleteDungeon handles deleting a specific dungeon campaign
 // @Summary Delete a specific dungeon campaign
 // @Description 删除复习计划
@@ -272,26 +371,39 @@ func (svr *Service) DeleteDungeon(c *gin.Context) {
 	id := utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "DeleteDungeon").WithField("user_id", userID).WithField("dungeon_id", id)
 
-	var dungeon model.Dungeon
-
 	tx := svr.db.Begin()
-	if err := tx.Where("user_id = ? AND id = ?", userID, id).First(&dungeon).Error; err != nil {
+	dungeon, err := model.FindDungeon(c, tx, userID, id, model.ActionManage)
+	if err != nil {
+		tx.Rollback()
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
 		return
 	}
 
 	// Delete dungeon entry in the database
-	if err := tx.Delete(&dungeon).Error; err != nil {
+	if err = tx.Delete(dungeon).Error; err != nil {
+		tx.Rollback()
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to delete dungeon")
 		return
 	}
 
-	if err := tx.Commit().Error; err != nil {
+	if err = tx.Commit().Error; err != nil {
 		tx.Rollback()
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "commit failed")
 		return
 	}
 
-	resp := new(dto.RespDungeon).With(new(dto.Dungeon).FromModel(&dungeon))
+	resp := new(dto.RespDungeon).With(new(dto.Dungeon).FromModel(dungeon))
 	resp.Response(c, "dungeon deleted")
 }
+
+// dungeonTypeUnlocked campaign 和 endless 总是可用，其他类型需要装备解锁它的 NFT (见 model.NFTModifiers)
+func dungeonTypeUnlocked(ctx context.Context, tx *gorm.DB, userID utils.UInt64, t def.DungeonType) (bool, error) {
+	if t == def.DungeonTypeCampaign || t == def.DungeonTypeEndless {
+		return true, nil
+	}
+	modifiers, err := model.GetNFTModifiers(ctx, tx, userID)
+	if err != nil {
+		return false, err
+	}
+	return modifiers.Unlocked(t.String()), nil
+}
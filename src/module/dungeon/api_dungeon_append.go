@@ -11,6 +11,7 @@ import (
 	"github.com/khicago/irr"
 
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
 	"github.com/bagaking/memorianexus/src/model"
 	"github.com/bagaking/memorianexus/src/module/dto"
 )
@@ -27,7 +28,7 @@ type ReqAddDungeonItems struct {
 
 // ReqAddDungeonTags defines the request structure for adding tags to a dungeon
 type ReqAddDungeonTags struct {
-	TagNames []string `json:"tag_names"`
+	Tags []string `json:"tags"`
 }
 
 // AppendBooksToDungeon handles adding books to an existing dungeon
@@ -40,6 +41,7 @@ type ReqAddDungeonTags struct {
 // @Param books body ReqAddDungeonBooks true "Books to add"
 // @Success 200 {object} dto.RespDungeon
 // @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
+// @Failure 404 {object} utils.ErrorResponse "Dungeon or book not found"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/dungeons/{id}/books [post]
 func (svr *Service) AppendBooksToDungeon(c *gin.Context) {
@@ -52,7 +54,7 @@ func (svr *Service) AppendBooksToDungeon(c *gin.Context) {
 		return
 	}
 
-	dungeon, err := model.FindDungeon(c, svr.db, dungeonID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionWrite)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
@@ -65,12 +67,13 @@ func (svr *Service) AppendBooksToDungeon(c *gin.Context) {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "got nil dungeon")
 		return
 	}
-	if dungeon.UserID != userID {
-		utils.GinHandleError(c, log, http.StatusForbidden, err, "got permission denied")
-	}
 
 	if err = dungeon.AddMonsterFromBook(c, svr.db, req.Books); err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to add books to dungeon")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to add books to dungeon")
+		}
 		return
 	}
 
@@ -87,6 +90,7 @@ func (svr *Service) AppendBooksToDungeon(c *gin.Context) {
 // @Param items body ReqAddDungeonItems true "Items to add"
 // @Success 200 {object} dto.RespDungeon
 // @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
+// @Failure 404 {object} utils.ErrorResponse "Dungeon or item not found"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/dungeons/{id}/items [post]
 func (svr *Service) AppendItemsToDungeon(c *gin.Context) {
@@ -99,7 +103,7 @@ func (svr *Service) AppendItemsToDungeon(c *gin.Context) {
 		return
 	}
 
-	dungeon, err := model.FindDungeon(c, svr.db, dungeonID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionWrite)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
@@ -112,14 +116,73 @@ func (svr *Service) AppendItemsToDungeon(c *gin.Context) {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "got nil dungeon")
 		return
 	}
-	if dungeon.UserID != userID {
-		utils.GinHandleError(c, log, http.StatusForbidden, err, "got permission denied")
-	}
 
 	if err = dungeon.AddMonsters(c, svr.db, req.Items); err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to add items to dungeon")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "item not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to add items to dungeon")
+		}
 		return
 	}
 
 	new(dto.RespDungeon).With(new(dto.Dungeon).FromModel(dungeon)).Response(c)
 }
+
+// AppendTagsToDungeon handles adding tags to an existing dungeon
+// @Summary Add tags to an existing dungeon
+// @Description 向现有复习计划添加标签来源，打了这些标签 (或其子标签) 的学习材料会加入复习计划，
+// @Description campaign 类型的复习计划中的 monsters 会随学习材料的标签变化自动增减
+// @Tags dungeon
+// @Accept json
+// @Produce json
+// @Param id path string true "Dungeon ID"
+// @Param tags body ReqAddDungeonTags true "Tags to add"
+// @Success 200 {object} dto.RespDungeon
+// @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /dungeon/dungeons/{id}/tags [post]
+func (svr *Service) AppendTagsToDungeon(c *gin.Context) {
+	userID, dungeonID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "AppendTagsToDungeon").WithField("user_id", userID).WithField("dungeon_id", dungeonID)
+
+	var req ReqAddDungeonTags
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Wrap(err, "parse request body failed"), "Invalid request body")
+		return
+	}
+	tagsToAdd, err := tags.NormalizeTags(req.Tags)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid tags")
+		return
+	}
+	if len(tagsToAdd) == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("tags is empty"), "Invalid tags")
+		return
+	}
+
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionWrite)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find dungeon")
+		}
+		return
+	}
+
+	if err = svr.db.Transaction(func(tx *gorm.DB) error {
+		_, err := dungeon.AddTags(c, tx, tagsToAdd)
+		return err
+	}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to add tags to dungeon")
+		return
+	}
+
+	resp := new(dto.RespDungeon).With(new(dto.Dungeon).FromModel(dungeon))
+	if resp.Data.Tags, err = dungeon.GetTags(c, svr.db); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to fetch dungeon tags")
+		return
+	}
+	resp.Response(c)
+}
@@ -29,7 +29,7 @@ func (svr *Service) GetDungeonBooksDetail(c *gin.Context) {
 	userID, dungeonID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "GetDungeonBooksDetail").WithField("user_id", userID).WithField("dungeon_id", dungeonID)
 
-	dungeon, err := model.FindDungeon(c, svr.db, dungeonID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionRead)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
@@ -58,7 +58,7 @@ func (svr *Service) GetDungeonBooksDetail(c *gin.Context) {
 // @Tags dungeon
 // @Produce json
 // @Param id path uint64 true "Dungeon ID"
-// @Success 200 {array} utils.UInt64
+// @Success 200 {array} string
 // @Failure 404 {object} utils.ErrorResponse "Dungeon not found"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/dungeons/{id}/tags [get]
@@ -66,7 +66,7 @@ func (svr *Service) GetDungeonTagsDetail(c *gin.Context) {
 	userID, dungeonID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "GetDungeonTagsDetail").WithField("user_id", userID).WithField("dungeon_id", dungeonID)
 
-	dungeon, err := model.FindDungeon(c, svr.db, dungeonID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionRead)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
@@ -80,7 +80,7 @@ func (svr *Service) GetDungeonTagsDetail(c *gin.Context) {
 		return
 	}
 
-	tags, err := dungeon.GetTags(c)
+	tags, err := dungeon.GetTags(c, svr.db)
 	if err != nil {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to fetch dungeon tags")
 		return
@@ -103,7 +103,7 @@ func (svr *Service) GetDungeonItemsDetail(c *gin.Context) {
 	userID, dungeonID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "GetDungeonItemsDetail").WithField("user_id", userID).WithField("dungeon_id", dungeonID)
 
-	dungeon, err := model.FindDungeon(c, svr.db, dungeonID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionRead)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
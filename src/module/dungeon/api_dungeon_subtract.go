@@ -3,7 +3,6 @@ package dungeon
 import (
 	"errors"
 	"net/http"
-	"strconv"
 
 	"gorm.io/gorm"
 
@@ -25,7 +24,7 @@ type ReqRemoveDungeonItems struct {
 }
 
 type ReqRemoveDungeonTags struct {
-	Tags []utils.UInt64 `json:"tags"`
+	Tags []string `json:"tags"`
 }
 
 // SubtractDungeonBooks handles removing books from a specific dungeon
@@ -51,7 +50,7 @@ func (svr *Service) SubtractDungeonBooks(c *gin.Context) {
 		return
 	}
 
-	dungeon, err := model.FindDungeon(c, svr.db, dungeonID)
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionWrite)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "dungeon not found")
@@ -64,9 +63,6 @@ func (svr *Service) SubtractDungeonBooks(c *gin.Context) {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "got nil dungeon")
 		return
 	}
-	if dungeon.UserID != userID {
-		utils.GinHandleError(c, log, http.StatusForbidden, err, "got permission denied")
-	}
 
 	successIDs, err := dungeon.SubtractBooks(c, svr.db, req.Books)
 	if err != nil {
@@ -81,7 +77,7 @@ func (svr *Service) SubtractDungeonBooks(c *gin.Context) {
 
 // SubtractDungeonTags handles removing tags from a specific dungeon
 // @Summary Remove tags from a specific dungeon
-// @Description 删除复习计划的 Tags
+// @Description 删除复习计划的 Tags，campaign 类型的复习计划中只由这些标签带来的 monsters 会被移除
 // @Tags dungeon
 // @Accept json
 // @Produce json
@@ -93,12 +89,8 @@ func (svr *Service) SubtractDungeonBooks(c *gin.Context) {
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/dungeons/{id}/tags [delete]
 func (svr *Service) SubtractDungeonTags(c *gin.Context) {
-	log := wlog.ByCtx(c, "SubtractDungeonTags")
-	dungeonID, err := strconv.ParseUint(c.Param("id"), 10, 64)
-	if err != nil {
-		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid dungeon ID")
-		return
-	}
+	userID, dungeonID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "SubtractDungeonTags").WithField("user_id", userID).WithField("dungeon_id", dungeonID)
 
 	var req ReqRemoveDungeonTags
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -106,8 +98,8 @@ func (svr *Service) SubtractDungeonTags(c *gin.Context) {
 		return
 	}
 
-	dungeon := model.Dungeon{ID: utils.UInt64(dungeonID)}
-	if err = svr.db.First(&dungeon).Error; err != nil {
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionWrite)
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
 		} else {
@@ -116,16 +108,18 @@ func (svr *Service) SubtractDungeonTags(c *gin.Context) {
 		return
 	}
 
-	for _, tagID := range req.Tags {
-		// 删除关联
-		if err = svr.db.Where("dungeon_id = ? AND tag_id = ?", dungeon.ID, tagID).Delete(&model.DungeonTag{}).Error; err != nil {
-			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to remove tag from dungeon")
-			return
-		}
+	var removed []string
+	if err = svr.db.Transaction(func(tx *gorm.DB) (err error) {
+		removed, err = dungeon.SubtractTags(c, tx, req.Tags)
+		return err
+	}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to remove tag from dungeon")
+		return
 	}
 
 	c.JSON(http.StatusOK, dto.SuccessResponse{
 		Message: "Tags removed from dungeon",
+		Data:    removed,
 	})
 }
 
@@ -143,12 +137,8 @@ func (svr *Service) SubtractDungeonTags(c *gin.Context) {
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/dungeons/{id}/items [delete]
 func (svr *Service) SubtractDungeonItems(c *gin.Context) {
-	log := wlog.ByCtx(c, "SubtractDungeonItems")
-	dungeonID, err := strconv.ParseUint(c.Param("id"), 10, 64)
-	if err != nil {
-		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid dungeon ID")
-		return
-	}
+	userID, dungeonID := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "SubtractDungeonItems").WithField("user_id", userID).WithField("dungeon_id", dungeonID)
 
 	var req ReqRemoveDungeonItems
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -156,8 +146,8 @@ func (svr *Service) SubtractDungeonItems(c *gin.Context) {
 		return
 	}
 
-	dungeon := model.Dungeon{ID: utils.UInt64(dungeonID)}
-	if err = svr.db.First(&dungeon).Error; err != nil {
+	dungeon, err := model.FindDungeon(c, svr.db, userID, dungeonID, model.ActionWrite)
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
 		} else {
@@ -168,7 +158,7 @@ func (svr *Service) SubtractDungeonItems(c *gin.Context) {
 
 	for _, itemID := range req.Items {
 		// 删除关联
-		if err = svr.db.Where("dungeon_id = ? AND item_id = ?", dungeon.ID, itemID).Delete(&model.DungeonMonster{}).Error; err != nil {
+		if err = svr.db.Unscoped().Where("dungeon_id = ? AND item_id = ?", dungeon.ID, itemID).Delete(&model.DungeonMonster{}).Error; err != nil {
 			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to remove item from dungeon")
 			return
 		}
@@ -26,7 +26,8 @@ import (
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
 // @Router /dungeon/endless/{id}/monsters [get]
 func (svr *Service) GetMonstersOfEndlessDungeon(c *gin.Context) {
-	id := c.Param("id")
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "GetMonstersOfEndlessDungeon").WithField("user_id", userID).WithField("dungeon_id", id)
 
 	// sortBy := c.DefaultQuery("sort_by", "familiarity") // (familiarity, difficulty, importance)
 	offsetStr := c.DefaultQuery("offset", "0")
@@ -40,15 +41,15 @@ func (svr *Service) GetMonstersOfEndlessDungeon(c *gin.Context) {
 		limit = 10
 	}
 
-	var dungeon model.Dungeon
-	if err = svr.db.Where("id = ?", id).First(&dungeon).Error; err != nil {
-		utils.GinHandleError(c, wlog.ByCtx(c), http.StatusNotFound, err, "Dungeon not found")
+	dungeon, err := model.FindDungeon(c, svr.db, userID, id, model.ActionRead)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "Dungeon not found")
 		return
 	}
 
 	monsters, err := dungeon.GetMonstersWithExpandedAssociations(c, svr.db, offset, limit)
 	if err != nil {
-		utils.GinHandleError(c, wlog.ByCtx(c), http.StatusInternalServerError, err, "Failed to fetch dungeon monsters with associations")
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to fetch dungeon monsters with associations")
 		return
 	}
 
@@ -2,6 +2,7 @@ package dungeon
 
 import (
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
@@ -34,26 +35,27 @@ func (svr *Service) ApplyMux(group gin.IRouter) {
 
 		dungeonsDetailGroup := dungeonsGeneralGroup.Group("/:id").Use(utils.GinMWParseID())
 		{
-			dungeonsDetailGroup.GET("", svr.GetDungeon)
-			dungeonsDetailGroup.DELETE("", svr.DeleteDungeon)
-			dungeonsDetailGroup.PUT("", svr.UpdateDungeon)
+			dungeonsDetailGroup.GET("", svr.authorize(model.ActionRead), svr.GetDungeon)
+			dungeonsDetailGroup.DELETE("", svr.authorize(model.ActionManage), svr.DeleteDungeon)
+			dungeonsDetailGroup.PUT("", svr.authorize(model.ActionWrite), svr.UpdateDungeon)
 
-			dungeonsDetailGroup.POST("/books", svr.AppendBooksToDungeon)
-			dungeonsDetailGroup.POST("/items", svr.AppendItemsToDungeon)
+			dungeonsDetailGroup.POST("/books", svr.authorize(model.ActionWrite), svr.AppendBooksToDungeon)
+			dungeonsDetailGroup.POST("/items", svr.authorize(model.ActionWrite), svr.AppendItemsToDungeon)
+			dungeonsDetailGroup.POST("/tags", svr.authorize(model.ActionWrite), svr.AppendTagsToDungeon)
 
-			dungeonsDetailGroup.GET("/books", svr.GetDungeonBooksDetail)
-			dungeonsDetailGroup.GET("/items", svr.GetDungeonItemsDetail)
-			dungeonsDetailGroup.GET("/tags", svr.GetDungeonTagsDetail)
+			dungeonsDetailGroup.GET("/books", svr.authorize(model.ActionRead), svr.GetDungeonBooksDetail)
+			dungeonsDetailGroup.GET("/items", svr.authorize(model.ActionRead), svr.GetDungeonItemsDetail)
+			dungeonsDetailGroup.GET("/tags", svr.authorize(model.ActionRead), svr.GetDungeonTagsDetail)
 
-			dungeonsDetailGroup.DELETE("/books", svr.SubtractDungeonBooks)
-			dungeonsDetailGroup.DELETE("/items", svr.SubtractDungeonItems)
-			dungeonsDetailGroup.DELETE("/tags", svr.SubtractDungeonTags)
+			dungeonsDetailGroup.DELETE("/books", svr.authorize(model.ActionWrite), svr.SubtractDungeonBooks)
+			dungeonsDetailGroup.DELETE("/items", svr.authorize(model.ActionWrite), svr.SubtractDungeonItems)
+			dungeonsDetailGroup.DELETE("/tags", svr.authorize(model.ActionWrite), svr.SubtractDungeonTags)
 		}
 	}
 
 	endlessDetailGroup := group.Group("/endless/:id").Use(utils.GinMWParseID())
 	{
-		endlessDetailGroup.GET("/monsters", svr.GetMonstersOfEndlessDungeon)
+		endlessDetailGroup.GET("/monsters", svr.authorize(model.ActionRead), svr.GetMonstersOfEndlessDungeon)
 		// endlessDetailGroup.GET("/next_monsters", svr.GetNextMonstersOfEndlessDungeon)
 		// endlessDetailGroup.GET("/today_conclusion", svr.GetEndlessDungeonTodayConclusion)
 		// endlessDetailGroup.POST("/report_result", svr.ReportEndlessResult)
@@ -62,6 +64,11 @@ func (svr *Service) ApplyMux(group gin.IRouter) {
 	group.GET("/instances/:id", svr.GetDungeonInstance)
 }
 
+// authorize 校验当前用户对路径中的复习计划有 action 权限，没有权限时返回 404
+func (svr *Service) authorize(action model.Action) gin.HandlerFunc {
+	return utils.GinMWAuthorize(model.Authorizer(svr.db, model.ResourceDungeon, action))
+}
+
 func (svr *Service) GetDungeonInstance(context *gin.Context) {
 	// 实现代码
 }
@@ -9,20 +9,24 @@ import (
 
 	"github.com/bagaking/goulp/wlog"
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
 	"github.com/bagaking/memorianexus/src/model"
 	"github.com/bagaking/memorianexus/src/module/dto"
 	"github.com/gin-gonic/gin"
+	"github.com/khicago/got/util/typer"
 )
 
 // CreateItem handles creating a new item with optional book affiliations and tags.
 // @Summary Create a new item
 // @Description Create a new item in the system with optional book affiliations and tags.
+// @Description When suggest_tags is true, the response contains suggested tags for the item, see POST /tags/suggest.
 // @Tags item
 // @Accept json
 // @Produce json
 // @Param item body ReqCreateItem true "Item creation data"
 // @Success 201 {object} dto.RespItemCreate "Successfully created item with books and tags"
 // @Failure 400 {object} utils.ErrorResponse "Bad Request if too many books or tags, or bad data"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
 // @Router /items [post]
 func (svr *Service) CreateItem(c *gin.Context) {
 	userID := utils.GinMustGetUserID(c)
@@ -43,6 +47,28 @@ func (svr *Service) CreateItem(c *gin.Context) {
 		utils.GinHandleError(c, log, http.StatusBadRequest, errors.New("too many tags"), "Too many tags")
 		return
 	}
+	normalizedTags, err := tags.NormalizeTags(req.Tags)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid tags")
+		return
+	}
+	req.Tags = normalizedTags
+	medias, err := resolveMedia(c, svr.db, userID, req.Media)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid media")
+		return
+	}
+	// 只能把 item 加入有写权限的 books
+	bookIDs, err := model.FilterAuthorized(c, svr.db, userID, model.ResourceBook, req.BookIDs, model.ActionWrite)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to check books")
+		return
+	}
+	if len(bookIDs) != len(typer.SliceToTrueMap(req.BookIDs)) {
+		err = irr.Error("some books are not found, books= %v, found= %v", req.BookIDs, bookIDs)
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "Book not found")
+		return
+	}
 
 	id, err := utils.GenIDU64(c)
 	if err != nil {
@@ -69,13 +95,15 @@ func (svr *Service) CreateItem(c *gin.Context) {
 	}
 
 	// 处理关联到 Book
-	for _, bookID := range req.BookIDs {
-		// 创建 Item 和 Book 的关系
-		itemBook := &model.BookItem{
-			ItemID: item.ID,
-			BookID: bookID,
+	for _, bookID := range bookIDs {
+		// 创建 Item 和 Book 的关系，新的 item 追加在 book 的末尾
+		itemBooks, err := model.NewBookItems(c, tx, bookID, 0, []utils.UInt64{item.ID})
+		if err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to place item in book")
+			tx.Rollback()
+			return
 		}
-		if err = svr.db.Create(itemBook).Error; err != nil {
+		if err = tx.Create(&itemBooks[0]).Error; err != nil {
 			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to create book link")
 			tx.Rollback()
 			return
@@ -91,13 +119,33 @@ func (svr *Service) CreateItem(c *gin.Context) {
 		}
 	}
 
+	// 关联媒体文件
+	if len(medias) > 0 {
+		if err = model.SetItemMedia(c, tx, id, mediaHashes(medias)); err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to link item media")
+			tx.Rollback()
+			return
+		}
+	}
+
+	if err = model.PublishEvents(c, tx, model.ItemCreated{UserID: userID, ItemIDs: []utils.UInt64{id}}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to publish events")
+		tx.Rollback()
+		return
+	}
+
 	if err = tx.Commit().Error; err != nil {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to commit transaction")
 		tx.Rollback()
 		return
 	}
 
-	new(dto.RespItemCreate).With(new(dto.Item).FromModel(item, req.Tags...)).Response(c, "item created")
+	model.IndexItems(c, item)
+	created := new(dto.Item).FromModel(item, req.Tags...).WithMedia(medias)
+	if req.SuggestTags {
+		svr.suggestTags(c, userID, created)
+	}
+	new(dto.RespItemCreate).With(created).Response(c, "item created")
 }
 
 // ReadItem handles retrieving a single item by ID, including its tags.
@@ -109,15 +157,20 @@ func (svr *Service) CreateItem(c *gin.Context) {
 // @Param id path uint64 true "Item ID"
 // @Success 200 {object} dto.RespItemGet "Successfully retrieved item with tags"
 // @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Failure 404 {object} utils.ErrorResponse "Item not found"
 // @Router /items/{id} [get]
 func (svr *Service) ReadItem(c *gin.Context) {
 	userID := utils.GinMustGetUserID(c)
 	id := utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "ReadItem").WithField("user_id", userID).WithField("item_id", id)
 
-	var item model.Item
-	if err := svr.db.First(&item, id).Error; err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Cannot find item")
+	item, err := model.FindItem(c, svr.db, userID, id, model.ActionRead)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "Item not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Cannot find item")
+		}
 		return
 	}
 
@@ -128,7 +181,13 @@ func (svr *Service) ReadItem(c *gin.Context) {
 		return
 	}
 
-	new(dto.RespItemGet).With(new(dto.Item).FromModel(&item, tags...)).Response(c, "item found")
+	medias, err := model.GetMediaOfItem(c, svr.db, item)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Get item media failed")
+		return
+	}
+
+	new(dto.RespItemGet).With(new(dto.Item).FromModel(item, tags...).WithMedia(medias)).Response(c, "item found")
 }
 
 // UpdateItem handles updating an existing item's information and associated tags.
@@ -141,6 +200,7 @@ func (svr *Service) ReadItem(c *gin.Context) {
 // @Param item body ReqUpdateItem true "Item update data"
 // @Success 200 {object} dto.RespItemUpdate "the updater"
 // @Failure 400 {object} utils.ErrorResponse "Bad Request with invalid item ID or update data"
+// @Failure 404 {object} utils.ErrorResponse "Item not found"
 // @Failure 500 {object} utils.ErrorResponse "Internal Server Error with failing to update the item"
 // @Router /items/{id} [put]
 func (svr *Service) UpdateItem(c *gin.Context) {
@@ -160,24 +220,80 @@ func (svr *Service) UpdateItem(c *gin.Context) {
 		Difficulty: req.Difficulty,
 		Importance: req.Importance,
 	}
-	// todo: 懒求值 update dungeon-monster 宽表冗余
 
 	// 开始数据库事务
 	tx := svr.db.Begin()
 
-	if err := tx.Model(updater).Where("creator_id = ? AND id = ?", userID, id).Updates(updater).Error; err != nil {
+	// 可写的 item 包括作为 editor 的 book 中由所有者创建的 items
+	item, err := model.FindItem(c, tx, userID, id, model.ActionWrite)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "item not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find item")
+		}
+		tx.Rollback()
+		return
+	}
+
+	// 引用的媒体文件属于 item 的创建者，editor 修改时也是如此
+	var medias []*model.Media
+	if req.Media != nil {
+		if medias, err = resolveMedia(c, tx, item.CreatorID, req.Media); err != nil {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid media")
+			tx.Rollback()
+			return
+		}
+	}
+
+	if err := tx.Model(updater).Where("id = ?", id).Updates(updater).Error; err != nil {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update item")
 		tx.Rollback()
 		return
 	}
 
-	// 更新 Item 的 tags
-	if err := model.UpdateEntityTagsDiff(c, tx, userID, id, req.Tags); err != nil {
+	if err := model.BumpItemRevision(c, tx, id); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update item revision")
+		tx.Rollback()
+		return
+	}
+
+	// 同步复习计划中 monster 的宽表冗余，订阅了 item 所在 book 的用户也会收到修改
+	if err := model.SyncItemMonsters(c, tx, id); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to sync item monsters")
+		tx.Rollback()
+		return
+	}
+
+	// 更新 Item 的 tags，标签属于 item 的创建者
+	if err := model.UpdateEntityTagsDiff(c, tx, item.CreatorID, id, req.Tags); err != nil {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update item tags")
 		tx.Rollback()
 		return
 	}
 
+	// 更新 Item 引用的媒体文件
+	if req.Media != nil {
+		if err := model.SetItemMedia(c, tx, id, mediaHashes(medias)); err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update item media")
+			tx.Rollback()
+			return
+		}
+	}
+
+	// 在包含 item 的 book 的动态中记录修改
+	if err := model.RecordItemActivity(c, tx, userID, id, model.BookActivityItemUpdated); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to record activity")
+		tx.Rollback()
+		return
+	}
+
+	if err := model.PublishEvents(c, tx, model.ItemUpdated{UserID: userID, ItemID: id}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to publish events")
+		tx.Rollback()
+		return
+	}
+
 	// 提交事务
 	if err := tx.Commit().Error; err != nil {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to commit transaction")
@@ -185,7 +301,8 @@ func (svr *Service) UpdateItem(c *gin.Context) {
 		return
 	}
 
-	new(dto.RespItemUpdate).With(new(dto.Item).FromModel(updater)).Response(c, "item updated")
+	model.ReindexItems(c, svr.db, id)
+	new(dto.RespItemUpdate).With(new(dto.Item).FromModel(updater).WithMedia(medias)).Response(c, "item updated")
 }
 
 // DeleteItem handles the deletion of an item.
@@ -203,10 +320,9 @@ func (svr *Service) DeleteItem(c *gin.Context) {
 	id := utils.GinMustGetID(c)
 	log := wlog.ByCtx(c, "DeleteItem").WithField("user_id", userID).WithField("item_id", id)
 
-	// 在删除之前验证Item是否存在，并且属于当前操作的用户
-	var item model.Item
-
-	if err := svr.db.First(&item, id).Error; err != nil {
+	// 在删除之前验证Item是否存在，并且当前用户可以删除 (所有者或被授予管理权限)
+	item, err := model.FindItem(c, svr.db, userID, id, model.ActionManage)
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			utils.GinHandleError(c, log, http.StatusNotFound, err, "item not found")
 		} else {
@@ -215,19 +331,24 @@ func (svr *Service) DeleteItem(c *gin.Context) {
 		return
 	}
 
-	// 如果Item的UserID与请求中的用户ID不匹配，则拒绝删除操作
-	if item.CreatorID != userID {
-		err := irr.Error("unauthorized to delete this item, creator= %d", item.CreatorID)
-		utils.GinHandleError(c, log, http.StatusForbidden, err, "unauthorized to delete this item")
+	// 执行删除操作，同步订阅者 (如挂机收益) 在同一个事务中更新
+	if err = svr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(item).Error; err != nil {
+			return err
+		}
+		return model.PublishEvents(c, tx, model.ItemDeleted{UserID: userID, ItemID: item.ID})
+	}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "delete item failed")
 		return
 	}
 
-	// 执行删除操作
-	if err := svr.db.Delete(&model.Item{}, id).Error; err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "delete item failed")
-		return
+	model.UnindexItems(c, item.ID)
+
+	// book_items 中的引用不会随 item 删除，仍可以找到包含 item 的 books
+	if err = model.RecordItemActivity(c, svr.db, userID, item.ID, model.BookActivityItemDeleted); err != nil {
+		log.WithError(err).Warnf("Failed to record item activity")
 	}
 
 	// 创建 DTO 并返回
-	new(dto.RespItemDelete).With((&dto.Item{}).FromModel(&item)).Response(c, "item deleted")
+	new(dto.RespItemDelete).With((&dto.Item{}).FromModel(item)).Response(c, "item deleted")
 }
@@ -1,12 +1,14 @@
 package item
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/bagaking/goulp/wlog"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/src/model"
@@ -15,16 +17,22 @@ import (
 
 // GetItems handles retrieving a list of items with optional filters and pagination.
 // @Summary Get a list of items with optional filters
-// @Description Get a list of items for the user with optional filters for book and type and support for pagination.
+// @Description Get a list of items for the user with optional filters for book, tag, type and difficulty and support for pagination.
+// @Description When search is given, items are retrieved from the full-text index and ranked by relevance, with highlights.
 // @Tags item
 // @Accept json
 // @Produce json
-// @Param user_id query uint64 false "User ID"
+// @Param user_id query uint64 false "Creator ID, only items the caller is granted to read are returned for other users"
+// @Param book_id query uint64 false "Book ID"
+// @Param tag query string false "Tag"
 // @Param type query string false "Type of item"
+// @Param difficulty query []int false "Difficulty levels" collectionFormat(multi)
+// @Param search query string false "Full-text search keywords"
 // @Param page query int false "Page number for pagination"
 // @Param limit query int false "Number of items per page"
 // @Success 200 {object} dto.RespItemList "Successfully retrieved items"
 // @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Failure 404 {object} utils.ErrorResponse "Book not found"
 // @Router /items [get]
 func (svr *Service) GetItems(c *gin.Context) {
 	userID := utils.GinMustGetUserID(c)
@@ -40,42 +48,59 @@ func (svr *Service) GetItems(c *gin.Context) {
 	if req.UserID <= 0 { // 如果不指定用户，搜索的就是自己的
 		req.UserID = userID
 	}
-	query := &model.Item{
-		CreatorID: req.UserID,
-		Type:      req.Type,
+	if req.BookID > 0 {
+		if err := model.Authorize(c, svr.db, userID, model.ResourceBook, req.BookID, model.ActionRead); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				utils.GinHandleError(c, log, http.StatusNotFound, err, "Book not found")
+			} else {
+				utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to check book")
+			}
+			return
+		}
+	}
+	filter := &model.ItemFilter{
+		UserID:       req.UserID,
+		ViewerID:     userID, // 查询其他用户的 items 时只返回被授权的
+		Type:         req.Type,
+		Difficulties: req.Difficulty,
+		Tag:          strings.TrimSpace(req.Tag),
+		BookID:       req.BookID,
 	}
-	var items []model.Item
-	tx := svr.db.Model(query).Where(query)
+
+	resp := new(dto.RespItemList)
 	search := strings.TrimSpace(req.Search)
 	if search != "" {
 		log = log.WithField("search", search)
-		// todo: 非常临时的 demo, 应该过搜索系统得到 ID 再回 DB 走 pager 的逻辑
-		tx.Where("content LIKE ?", "%"+search+"%")
-	}
-	if err := tx.Offset(pager.Offset).Limit(pager.Limit).Find(&items).Error; err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to retrieve items")
+		hits, total, err := model.SearchItems(c, svr.db, filter, search, pager.Offset, pager.Limit)
+		if err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to search items")
+			return
+		}
+		for _, hit := range hits {
+			tags, err := model.TagModel().GetTagsOfEntity(c, hit.ID)
+			if err != nil {
+				utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get item tag names")
+				return
+			}
+			resp.Append(new(dto.Item).FromModel(hit.Item, tags...).WithSearchHit(hit))
+		}
+		resp.WithPager(pager.SetTotal(total)).Response(c, "items found")
 		return
 	}
 
 	// todo: cache this
-	if search == "" { // todo: search 的搜索不准, 且搜索导致全表扫描, 临时这么用着, 搜索时屏蔽 total
-		var total int64
-		if err := svr.db.Model(query).Where(query).Count(&total).Error; err != nil {
-			log.WithError(err).Warnf("Failed to count items")
-			return
-		}
-		pager = pager.SetTotal(total)
+	items, total, err := model.FindItemsByFilter(c, svr.db, filter, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to retrieve items")
+		return
 	}
-
-	resp := new(dto.RespItemList)
-	// 转换 Item 为 Item
 	for _, item := range items {
 		tags, err := model.TagModel().GetTagsOfEntity(c, item.ID)
 		if err != nil {
 			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get item tag names")
 			return
 		}
-		resp.Append(new(dto.Item).FromModel(&item, tags...))
+		resp.Append(new(dto.Item).FromModel(item, tags...))
 	}
-	resp.WithPager(pager).Response(c, "items found")
+	resp.WithPager(pager.SetTotal(total)).Response(c, "items found")
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/bagaking/ankibuild/anki"
 	"github.com/khicago/irr"
+	"gorm.io/gorm"
 
 	"github.com/bagaking/goulp/wlog"
 	"github.com/gin-gonic/gin"
@@ -27,11 +28,13 @@ import (
 // UploadItems handles uploading a file to create multiple items.
 // @Summary Upload items from a file
 // @Description Upload a file to create multiple items in the system.
+// @Description When suggest_tags is true, each created item contains suggested tags, see POST /tags/suggest.
 // @Tags item
 // @Accept multipart/form-data
 // @Produce json
 // @Param file formData file true "File containing items data, support csv and toml file"
 // @Param book_id query string false "Book ID"
+// @Param suggest_tags query bool false "Return suggested tags of the created items"
 // @Success 201 {object} dto.RespItemList "Successfully created items from file"
 // @Failure 400 {object} utils.ErrorResponse "Bad Request"
 // @Router /items/upload [post]
@@ -47,9 +50,13 @@ func (svr *Service) UploadItems(c *gin.Context) {
 
 	var book *model.Book
 	if req.BookID != nil {
-		b, err := model.FindBook(c, svr.db, *req.BookID)
+		b, err := model.FindBook(c, svr.db, userID, *req.BookID, model.ActionWrite)
 		if err != nil {
-			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find the book")
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				utils.GinHandleError(c, log, http.StatusNotFound, err, "book not found")
+			} else {
+				utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find the book")
+			}
 			return
 		}
 		book = b
@@ -88,10 +95,16 @@ func (svr *Service) UploadItems(c *gin.Context) {
 	}
 
 	// 保存解析后的学习材料
-	if err = model.CreateItems(c, svr.db, userID, items, itemTagRef); err != nil {
+	if err = svr.db.Transaction(func(tx *gorm.DB) error {
+		if err := model.CreateItems(c, tx, userID, items, itemTagRef); err != nil {
+			return err
+		}
+		return model.PublishEvents(c, tx, model.ItemCreated{UserID: userID, ItemIDs: ids})
+	}); err != nil {
 		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to save items")
 		return
 	}
+	model.IndexItems(c, items...)
 
 	if book != nil {
 		successItemIDs, err := book.MPutItems(c, svr.db, typer.SliceMap(items, func(from *model.Item) utils.UInt64 {
@@ -105,9 +118,13 @@ func (svr *Service) UploadItems(c *gin.Context) {
 		log.Infof("mput items successfully, success= %v", successItemIDs)
 	}
 
-	new(dto.RespItemList).Append(typer.SliceMap(items, func(from *model.Item) *dto.Item {
-		return new(dto.Item).FromModel(from)
-	})...).Response(c, "items created from file")
+	created := typer.SliceMap(items, func(from *model.Item) *dto.Item {
+		return new(dto.Item).FromModel(from, itemTagRef[from]...)
+	})
+	if req.SuggestTags {
+		svr.suggestTags(c, userID, created...)
+	}
+	new(dto.RespItemList).Append(created...).Response(c, "items created from file")
 }
 
 func parseItemsFromFile(ctx context.Context, r io.Reader, filename string) ([]*model.Item, map[*model.Item][]string, error) {
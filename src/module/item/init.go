@@ -2,6 +2,7 @@ package item
 
 import (
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
@@ -23,8 +24,13 @@ func (svr *Service) ApplyMux(group gin.IRouter) {
 
 	idGroup := group.Group("/:id").Use(utils.GinMWParseID())
 	{
-		idGroup.GET("", svr.ReadItem)
-		idGroup.PUT("", svr.UpdateItem)
-		idGroup.DELETE("", svr.DeleteItem)
+		idGroup.GET("", svr.authorize(model.ActionRead), svr.ReadItem)
+		idGroup.PUT("", svr.authorize(model.ActionWrite), svr.UpdateItem)
+		idGroup.DELETE("", svr.authorize(model.ActionManage), svr.DeleteItem)
 	}
 }
+
+// authorize 校验当前用户对路径中的 item 有 action 权限，没有权限时返回 404
+func (svr *Service) authorize(action model.Action) gin.HandlerFunc {
+	return utils.GinMWAuthorize(model.Authorizer(svr.db, model.ResourceItem, action))
+}
@@ -0,0 +1,49 @@
+package item
+
+import (
+	"context"
+
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// resolveMedia 校验 item 引用的媒体文件都属于 item 的创建者 creatorID，并按请求的顺序返回
+// 媒体文件的引用计数 (见 model.CountMediaRefsOfUser) 和展示都以创建者为准，editor 也只能引用创建者上传的媒体文件
+func resolveMedia(ctx context.Context, tx *gorm.DB, creatorID utils.UInt64, hashes []string) ([]*model.Media, error) {
+	if len(hashes) > MaxMediaPerItem {
+		return nil, irr.Error("too many media, count= %d, limit= %d", len(hashes), MaxMediaPerItem)
+	}
+	medias, err := model.FindMediaOfUser(ctx, tx, creatorID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	mMedia := make(map[string]*model.Media, len(medias))
+	for _, m := range medias {
+		mMedia[m.Hash] = m
+	}
+
+	ret := make([]*model.Media, 0, len(hashes))
+	for _, h := range hashes {
+		m, ok := mMedia[h]
+		if !ok {
+			return nil, irr.Error("media not found, hash= %s", h)
+		}
+		if m == nil { // 重复引用
+			continue
+		}
+		ret = append(ret, m)
+		mMedia[h] = nil
+	}
+	return ret, nil
+}
+
+func mediaHashes(medias []*model.Media) []string {
+	hashes := make([]string, 0, len(medias))
+	for _, m := range medias {
+		hashes = append(hashes, m.Hash)
+	}
+	return hashes
+}
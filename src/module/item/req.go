@@ -7,12 +7,14 @@ import (
 
 type (
 	ReqCreateItem struct {
-		Type       string              `json:"type"`
-		Content    string              `json:"content"`
-		Difficulty def.DifficultyLevel `json:"difficulty,omitempty"` // 难度，默认值为 NoviceNormal (0x01), todo: 考虑是否允许用户编辑，编辑后要引入写扩散
-		Importance def.ImportanceLevel `json:"importance,omitempty"` // 重要程度，默认值为 DomainGeneral (0x01), todo: 考虑是否允许用户编辑
-		BookIDs    []utils.UInt64      `json:"book_ids,omitempty"`   // 用于接收一个或多个 BookID
-		Tags       []string            `json:"tags,omitempty"`       // 新增字段，用于接收一组 Tag 名称
+		Type        string              `json:"type"`
+		Content     string              `json:"content"`
+		Difficulty  def.DifficultyLevel `json:"difficulty,omitempty"`   // 难度，默认值为 NoviceNormal (0x01), todo: 考虑是否允许用户编辑，编辑后要引入写扩散
+		Importance  def.ImportanceLevel `json:"importance,omitempty"`   // 重要程度，默认值为 DomainGeneral (0x01), todo: 考虑是否允许用户编辑
+		BookIDs     []utils.UInt64      `json:"book_ids,omitempty"`     // 用于接收一个或多个 BookID
+		Tags        []string            `json:"tags,omitempty"`         // 新增字段，用于接收一组 Tag 名称
+		Media       []string            `json:"media,omitempty"`        // 引用的媒体文件 hash，需要先通过 /media 上传
+		SuggestTags bool                `json:"suggest_tags,omitempty"` // 为 true 时在返回中带上推荐的标签
 	}
 
 	ReqUpdateItem struct {
@@ -21,21 +23,26 @@ type (
 		Difficulty def.DifficultyLevel `json:"difficulty,omitempty"` // 难度，默认值为 NoviceNormal (0x01)
 		Importance def.ImportanceLevel `json:"importance,omitempty"` // 重要程度，默认值为 DomainGeneral (0x01)
 		Tags       []string            `json:"tags,omitempty"`       // 新增字段
+		Media      []string            `json:"media"`                // 为 null 时不修改，否则覆盖原有的引用
 	}
 
 	ReqGetItems struct {
-		UserID utils.UInt64 `form:"user_id" json:"user_id,omitempty"`
-		BookID utils.UInt64 `form:"book_id" json:"book_id,omitempty"`
-		Type   string       `form:"type" json:"type,omitempty"`
-		Search string       `form:"search" json:"search,omitempty"`
+		UserID     utils.UInt64          `form:"user_id" json:"user_id,omitempty"`
+		BookID     utils.UInt64          `form:"book_id" json:"book_id,omitempty"`
+		Tag        string                `form:"tag" json:"tag,omitempty"`
+		Type       string                `form:"type" json:"type,omitempty"`
+		Difficulty []def.DifficultyLevel `form:"difficulty" json:"difficulty,omitempty"`
+		Search     string                `form:"search" json:"search,omitempty"` // 全文搜索关键词，不为空时结果按相关度排序
 	}
 
 	ReqUploadItems struct {
-		BookID *utils.UInt64 `form:"book_id,omitempty"`
+		BookID      *utils.UInt64 `form:"book_id,omitempty"`
+		SuggestTags bool          `form:"suggest_tags,omitempty"` // 为 true 时在返回中带上推荐的标签
 	}
 )
 
 const (
 	MaxBooksOncePerItem = 10 // 设定每个 Item 可以关联的最大 Books 数量
 	MaxTagsOncePerItem  = 5  // 设定每个 Item 可以拥有的最大 Tags 数量
+	MaxMediaPerItem     = 10 // 设定每个 Item 可以引用的最大媒体文件数量
 )
@@ -0,0 +1,32 @@
+package item
+
+import (
+	"context"
+
+	"github.com/bagaking/goulp/wlog"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// SuggestTagsPerItem 创建 item 时为每个 item 推荐的标签数
+const SuggestTagsPerItem = 5
+
+// suggestTags 为新创建的 items 推荐标签 (见 POST /tags/suggest)，item 已有的标签不会被推荐。
+// 统计标签使用情况的开销较大，只在客户端请求时 (suggest_tags 为 true) 计算。推荐只是辅助信息，失败时只记录日志，不影响创建结果
+func (svr *Service) suggestTags(ctx context.Context, userID utils.UInt64, items ...*dto.Item) {
+	profile, err := model.LoadTagProfile(ctx, svr.db, userID)
+	if err != nil {
+		wlog.ByCtx(ctx, "suggestTags").WithField("user_id", userID).WithError(err).Warnf("load tag profile failed")
+		return
+	}
+	for _, item := range items {
+		chosen, err := tags.NormalizeTags(item.Tags)
+		if err != nil {
+			chosen = item.Tags
+		}
+		item.SuggestedTags = profile.Suggest(item.Content, chosen, SuggestTagsPerItem)
+	}
+}
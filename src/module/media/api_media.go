@@ -0,0 +1,336 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/internal/utils/cache"
+	"github.com/bagaking/memorianexus/pkg/blobstore"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// allowedMimeTypes 允许上传的媒体类型，以嗅探结果为准，不信任客户端声明的 Content-Type
+// svg 等可以携带脚本的类型不在此列
+var allowedMimeTypes = map[string]string{
+	"image/png":  model.MediaKindImage,
+	"image/jpeg": model.MediaKindImage,
+	"image/gif":  model.MediaKindImage,
+	"image/webp": model.MediaKindImage,
+	"audio/mpeg": model.MediaKindAudio,
+	"audio/wave": model.MediaKindAudio,
+	"audio/ogg":  model.MediaKindAudio,
+	"audio/aiff": model.MediaKindAudio,
+	"audio/midi": model.MediaKindAudio,
+	"audio/mp4":  model.MediaKindAudio,
+}
+
+const blobLockTTL = 5 * time.Second
+
+// UploadMedia handles uploading an image or audio file.
+// @Summary Upload a media file
+// @Description Upload an image or audio file, files with the same content are stored only once.
+// @Tags media
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "Media file (image or audio)"
+// @Success 200 {object} dto.RespMediaUpload "Successfully uploaded media"
+// @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Failure 403 {object} utils.ErrorResponse "Media quota exceeded"
+// @Failure 413 {object} utils.ErrorResponse "File too large"
+// @Failure 415 {object} utils.ErrorResponse "Unsupported media type"
+// @Router /media [post]
+func (svr *Service) UploadMedia(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "UploadMedia").WithField("user_id", userID)
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Failed to get file")
+		return
+	}
+	if fh.Size > model.MaxMediaSize {
+		utils.GinHandleError(c, log, http.StatusRequestEntityTooLarge,
+			irr.Error("size= %d, limit= %d", fh.Size, model.MaxMediaSize), "File too large")
+		return
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Failed to open file")
+		return
+	}
+	defer file.Close()
+
+	mimeType, err := sniffMimeType(file)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Failed to read file")
+		return
+	}
+	kind, ok := allowedMimeTypes[mimeType]
+	if !ok {
+		utils.GinHandleError(c, log, http.StatusUnsupportedMediaType,
+			irr.Error("mime_type= %s", mimeType), "Only image and audio files are supported")
+		return
+	}
+
+	hash, size, err := hashFile(file)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Failed to read file")
+		return
+	}
+	if size > model.MaxMediaSize {
+		utils.GinHandleError(c, log, http.StatusRequestEntityTooLarge,
+			irr.Error("size= %d, limit= %d", size, model.MaxMediaSize), "File too large")
+		return
+	}
+	log = log.WithField("hash", hash)
+
+	media := &model.Media{
+		UserID:   userID,
+		Hash:     hash,
+		Kind:     kind,
+		MimeType: mimeType,
+		Size:     size,
+		FileName: filepath.Base(fh.Filename),
+	}
+
+	// 同一用户的并发上传需要串行化，否则配额检查会失效
+	var existed *model.Media
+	errQuota := irr.Error("media quota exceeded")
+	err = cache.Locker(c).Execute(c, fmt.Sprintf("media_quota:%d", userID), blobLockTTL, func() error {
+		if existed, err = model.GetMediaOfUser(c, svr.db, userID, hash); err == nil {
+			return nil // 用户已经上传过相同内容，不重复计算配额
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		used, err := model.GetMediaUsage(c, svr.db, userID)
+		if err != nil {
+			return err
+		}
+		if used+size > model.MediaQuotaPerUser {
+			return irr.Wrap(errQuota, "used= %d, size= %d, quota= %d", used, size, model.MediaQuotaPerUser)
+		}
+
+		// blob 的写入和记录的创建与回收互斥，避免刚复用的 blob 被删除
+		return cache.Locker(c).Execute(c, blobLockKey(hash), blobLockTTL, func() error {
+			exist, err := svr.store.Exists(c, hash)
+			if err != nil {
+				return err
+			}
+			if !exist {
+				if _, err = file.Seek(0, io.SeekStart); err != nil {
+					return irr.Wrap(err, "rewind file failed")
+				}
+				if err = svr.store.Put(c, hash, io.LimitReader(file, size)); err != nil {
+					return err
+				}
+			}
+			return svr.db.Clauses(clause.OnConflict{DoNothing: true}).Create(media).Error
+		})
+	})
+	if err != nil {
+		if errors.Is(err, errQuota) {
+			utils.GinHandleError(c, log, http.StatusForbidden, err, "Media quota exceeded")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to save media")
+		}
+		return
+	}
+
+	if existed != nil {
+		new(dto.RespMediaUpload).With(new(dto.Media).FromModel(existed)).Response(c, "media already exists")
+		return
+	}
+	new(dto.RespMediaUpload).With(new(dto.Media).FromModel(media)).Response(c, "media uploaded")
+}
+
+// ListMedia handles listing the media of current user.
+// @Summary List media
+// @Description List the media uploaded by current user, the quota usage is returned in extra.
+// @Tags media
+// @Produce json
+// @Param page query int false "Page number"
+// @Param limit query int false "Number of media per page"
+// @Success 200 {object} dto.RespMediaList "Successfully retrieved media"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /media [get]
+func (svr *Service) ListMedia(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "ListMedia").WithField("user_id", userID)
+	pager := utils.GinGetPagerFromQuery(c)
+
+	query := svr.db.Model(&model.Media{}).Where("user_id = ?", userID)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to count media")
+		return
+	}
+
+	var medias []*model.Media
+	if err := query.Order("created_at DESC").Offset(pager.Offset).Limit(pager.Limit).Find(&medias).Error; err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to list media")
+		return
+	}
+
+	used, err := model.GetMediaUsage(c, svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get media usage")
+		return
+	}
+
+	resp := new(dto.RespMediaList).Append(dto.MediaListFromModels(medias)...).WithPager(pager.SetTotal(total))
+	resp.Extra = &dto.MediaQuota{Used: used, Total: model.MediaQuotaPerUser}
+	resp.Response(c)
+}
+
+// ServeMedia handles serving a media file by its content hash.
+// @Summary Get media content
+// @Description Serve the content of a media file to its owner or to users who can read an item referencing it.
+// @Tags media
+// @Produce octet-stream
+// @Param hash path string true "Content hash of the media"
+// @Success 200 {file} file "Media content"
+// @Failure 404 {object} utils.ErrorResponse "Media not found"
+// @Router /media/{hash} [get]
+func (svr *Service) ServeMedia(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	hash := strings.ToLower(c.Param("hash"))
+	log := wlog.ByCtx(c, "ServeMedia").WithField("user_id", userID).WithField("hash", hash)
+
+	if !blobstore.ValidKey(hash) {
+		utils.GinHandleError(c, log, http.StatusNotFound, blobstore.ErrInvalidKey, "Media not found")
+		return
+	}
+
+	media, err := model.GetReadableMedia(c, svr.db, userID, hash)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "Media not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to find media")
+		}
+		return
+	}
+
+	blob, err := svr.store.Open(c, hash)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "Media content not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to open media")
+		}
+		return
+	}
+	defer blob.Close()
+
+	// 内容按 hash 寻址，不会变化，可以长期缓存；但只允许私有缓存
+	c.Header("Content-Type", media.MimeType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	c.Header("ETag", `"`+hash+`"`)
+	http.ServeContent(c.Writer, c.Request, "", blob.Info().ModTime, blob)
+}
+
+// DeleteMedia handles deleting a media of current user.
+// @Summary Delete media
+// @Description Delete a media of current user, media referenced by items cannot be deleted.
+// @Tags media
+// @Produce json
+// @Param hash path string true "Content hash of the media"
+// @Success 200 {object} dto.RespMediaDelete "Successfully deleted media"
+// @Failure 404 {object} utils.ErrorResponse "Media not found"
+// @Failure 409 {object} utils.ErrorResponse "Media is still referenced by items"
+// @Router /media/{hash} [delete]
+func (svr *Service) DeleteMedia(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	hash := strings.ToLower(c.Param("hash"))
+	log := wlog.ByCtx(c, "DeleteMedia").WithField("user_id", userID).WithField("hash", hash)
+
+	media, err := model.GetMediaOfUser(c, svr.db, userID, hash)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "Media not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to find media")
+		}
+		return
+	}
+
+	refs, err := model.CountMediaRefsOfUser(c, svr.db, userID, hash)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to count media references")
+		return
+	}
+	if refs > 0 {
+		utils.GinHandleError(c, log, http.StatusConflict, irr.Error("refs= %d", refs), "Media is still referenced by items")
+		return
+	}
+
+	err = cache.Locker(c).Execute(c, blobLockKey(hash), blobLockTTL, func() error {
+		if err := svr.db.Where("user_id = ? AND hash = ?", userID, hash).Delete(&model.Media{}).Error; err != nil {
+			return irr.Wrap(err, "delete media record failed")
+		}
+		owners, err := model.CountMediaOwners(c, svr.db, hash)
+		if err != nil {
+			return err
+		}
+		if owners > 0 {
+			return nil
+		}
+		return svr.store.Delete(c, hash)
+	})
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to delete media")
+		return
+	}
+
+	new(dto.RespMediaDelete).With(new(dto.Media).FromModel(media)).Response(c, "media deleted")
+}
+
+func blobLockKey(hash string) string {
+	return "media_blob:" + hash
+}
+
+// sniffMimeType 根据文件头判断文件类型
+func sniffMimeType(file multipart.File) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	mimeType := http.DetectContentType(head[:n])
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return mimeType, nil
+}
+
+// hashFile 计算文件内容的 sha256，最多读取 MaxMediaSize+1 字节
+func hashFile(file multipart.File) (hash string, size int64, err error) {
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, irr.Wrap(err, "rewind file failed")
+	}
+	hasher := sha256.New()
+	if size, err = io.Copy(hasher, io.LimitReader(file, model.MaxMediaSize+1)); err != nil {
+		return "", 0, irr.Wrap(err, "hash file failed")
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
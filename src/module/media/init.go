@@ -0,0 +1,28 @@
+package media
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/pkg/blobstore"
+)
+
+type Service struct {
+	db    *gorm.DB
+	store blobstore.Store
+}
+
+func Init(db *gorm.DB, store blobstore.Store) (*Service, error) {
+	return &Service{
+		db:    db,
+		store: store,
+	}, nil
+}
+
+func (svr *Service) ApplyMux(group gin.IRouter) {
+	group.POST("", svr.UploadMedia)
+	group.GET("", svr.ListMedia)
+
+	group.GET("/:hash", svr.ServeMedia)
+	group.DELETE("/:hash", svr.DeleteMedia)
+}
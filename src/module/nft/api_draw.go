@@ -0,0 +1,211 @@
+package nft
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// DefaultPoolID 没有指定卡池时使用的卡池
+const DefaultPoolID utils.UInt64 = 1
+
+// DrawCard handles drawing NFTs from a pool with points
+// @Summary Draw cards
+// @Description 在卡池中抽卡，通过积分流水支付 price * count 个卡池的积分 (cash 或 gem)，use_ticket 为 true 时改为支付 count 张抽卡券 (卡池需要支持抽卡券)。稀有度由权重和保底规则决定，同一稀有度中的模板等概率出现。
+// @Description 随机数由使用中的服务端种子、client_seed 和递增的 nonce 生成，种子公开后可以复算每一次抽卡 (见 /nft/draws)。
+// @Description 相同的 Idempotency-Key 只会抽一次，重复的请求返回第一次的结果并带有 Idempotent-Replayed 头
+// @Tags nft
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param Idempotency-Key header string false "Client generated key of the draw"
+// @Param draw body ReqDrawCard false "Pool, count and client seed, default to 1 draw in the default pool"
+// @Success 200 {object} dto.RespDrawResult "Successfully drew cards"
+// @Failure 400 {object} utils.ErrorResponse "Invalid count, client seed, ticket not accepted or insufficient points"
+// @Failure 404 {object} utils.ErrorResponse "Pool not found"
+// @Failure 409 {object} utils.ErrorResponse "Idempotency key is used by another purchase"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/draw_card [post]
+func (svr *Service) DrawCard(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "DrawCard").WithField("user_id", userID)
+
+	req := ReqDrawCard{PoolID: DefaultPoolID, Count: 1}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+			return
+		}
+	}
+	if req.PoolID == 0 {
+		req.PoolID = DefaultPoolID
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+
+	key, ok := utils.GinIdempotencyKey(c, log, string(model.PointReasonNFTDraw), userID)
+	if !ok {
+		return
+	}
+
+	draws, nfts, applied, err := model.DrawNFTs(c, svr.db, model.NFTDrawRequest{
+		UserID:         userID,
+		PoolID:         req.PoolID,
+		Count:          req.Count,
+		ClientSeed:     req.ClientSeed,
+		UseTicket:      req.UseTicket,
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrNFTPoolNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "pool not found")
+		case errors.Is(err, model.ErrInvalidDrawCount), errors.Is(err, model.ErrInvalidDrawSeed),
+			errors.Is(err, model.ErrTicketNotAccepted), errors.Is(err, model.ErrInsufficientPoints):
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "failed to draw cards")
+		case errors.Is(err, model.ErrIdempotencyConflict):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "idempotency key is already used")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to draw cards")
+		}
+		return
+	}
+	if !applied {
+		utils.GinMarkReplayed(c)
+	}
+
+	seeds, err := model.GetDrawSeeds(c, svr.db, seedIDs(draws)...)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get draw seeds")
+		return
+	}
+	result := &dto.DrawResult{}
+	for _, draw := range draws {
+		result.Draws = append(result.Draws, new(dto.NFTDraw).FromModel(draw, seeds[draw.SeedID]))
+	}
+	for _, nft := range nfts {
+		result.NFTs = append(result.NFTs, new(dto.NFT).FromModel(nft))
+	}
+	new(dto.RespDrawResult).With(result).Response(c, "cards drawn")
+}
+
+// GetDrawPools handles listing the pools with the pity progress of the current user
+// @Summary List draw pools
+// @Description 获取所有卡池的价格、各稀有度的权重、可以抽到的模板，以及当前用户的保底计数
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} dto.RespNFTPools "Successfully retrieved pools"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/pools [get]
+func (svr *Service) GetDrawPools(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "GetDrawPools").WithField("user_id", userID)
+
+	pools := model.NFTPools()
+	resp := make([]*dto.NFTPool, 0, len(pools))
+	for _, pool := range pools {
+		counters, err := model.GetPityCounters(c, svr.db, userID, pool.ID)
+		if err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get pity counters")
+			return
+		}
+		resp = append(resp, new(dto.NFTPool).FromModel(pool, counters))
+	}
+	new(dto.RespNFTPools).With(resp).Response(c, "pools found")
+}
+
+// GetDraws handles listing the draw records of the current user
+// @Summary List draw records
+// @Description 获取当前用户的抽卡记录，最新的在前。种子公开 (更换) 之后返回 server_seed，可以用 HMAC-SHA256(server_seed, client_seed:nonce) 复算结果
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param page query int false "Page number for pagination" default(1)
+// @Param limit query int false "Number of items per page" default(10)
+// @Success 200 {object} dto.RespNFTDraws "Successfully retrieved draws"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/draws [get]
+func (svr *Service) GetDraws(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	pager := utils.GinGetPagerFromQuery(c)
+	log := wlog.ByCtx(c, "GetDraws").WithField("user_id", userID).WithField("pager", pager)
+
+	draws, total, err := model.GetNFTDraws(c, svr.db, userID, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get draws")
+		return
+	}
+	pager.Total = total
+	seeds, err := model.GetDrawSeeds(c, svr.db, seedIDs(draws)...)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get draw seeds")
+		return
+	}
+
+	resp := new(dto.RespNFTDraws).WithPager(pager)
+	for _, draw := range draws {
+		resp.Append(new(dto.NFTDraw).FromModel(draw, seeds[draw.SeedID]))
+	}
+	resp.Response(c, "draws found")
+}
+
+// GetDrawSeed handles retrieving the hash of the active seed of the current user
+// @Summary Get draw seed
+// @Description 获取当前用户使用中的服务端种子的哈希和最后一次使用的 nonce，种子本身在更换后才会公开
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} dto.RespDrawSeed "Successfully retrieved the seed"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/draws/seed [get]
+func (svr *Service) GetDrawSeed(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "GetDrawSeed").WithField("user_id", userID)
+
+	seed, err := model.GetActiveDrawSeed(c, svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get draw seed")
+		return
+	}
+	new(dto.RespDrawSeed).With(new(dto.DrawSeed).FromModel(seed)).Response(c, "draw seed found")
+}
+
+// RotateDrawSeed handles revealing the active seed of the current user and replacing it
+// @Summary Rotate draw seed
+// @Description 公开当前用户使用中的服务端种子并换成新的种子。公开的种子可以用来校验之前的抽卡，之后的抽卡使用新的种子
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} dto.RespDrawSeedRotation "Successfully rotated the seed"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/draws/seed [post]
+func (svr *Service) RotateDrawSeed(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "RotateDrawSeed").WithField("user_id", userID)
+
+	revealed, active, err := model.RotateDrawSeed(c, svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to rotate draw seed")
+		return
+	}
+	new(dto.RespDrawSeedRotation).With(&dto.DrawSeedRotation{
+		Revealed: new(dto.DrawSeed).FromModel(revealed),
+		Active:   new(dto.DrawSeed).FromModel(active),
+	}).Response(c, "draw seed rotated")
+}
+
+func seedIDs(draws []*model.NFTDraw) []utils.UInt64 {
+	ids := make([]utils.UInt64, 0, len(draws))
+	for _, draw := range draws {
+		ids = append(ids, draw.SeedID)
+	}
+	return ids
+}
@@ -0,0 +1,153 @@
+package nft
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// GetNFTs handles listing the NFTs of the current user
+// @Summary List user NFTs
+// @Description 获取当前用户持有的 NFT 和它们的模板 (稀有度、特效)，最新的在前
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param page query int false "Page number for pagination" default(1)
+// @Param limit query int false "Number of items per page" default(10)
+// @Success 200 {object} dto.RespNFTs "Successfully retrieved NFTs"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/nfts [get]
+func (svr *Service) GetNFTs(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	pager := utils.GinGetPagerFromQuery(c)
+	log := wlog.ByCtx(c, "GetNFTs").WithField("user_id", userID).WithField("pager", pager)
+
+	nfts, total, err := model.GetUserNFTs(c, svr.db, userID, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get nfts")
+		return
+	}
+	pager.Total = total
+
+	resp := new(dto.RespNFTs).WithPager(pager)
+	for _, nft := range nfts {
+		resp.Append(new(dto.NFT).FromModel(nft))
+	}
+	resp.Response(c, "nfts found")
+}
+
+// GetNFTDetails handles retrieving an NFT of the current user
+// @Summary Get NFT details
+// @Description 获取当前用户持有的 NFT 的详情
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "NFT ID"
+// @Success 200 {object} dto.RespNFT "Successfully retrieved NFT"
+// @Failure 404 {object} utils.ErrorResponse "NFT not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/nfts/{id} [get]
+func (svr *Service) GetNFTDetails(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "GetNFTDetails").WithField("user_id", userID).WithField("nft_id", id)
+
+	nft, err := model.FindUserNFT(c, svr.db, userID, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "nft not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get nft")
+		}
+		return
+	}
+
+	new(dto.RespNFT).With(new(dto.NFT).FromModel(nft)).Response(c, "nft found")
+}
+
+// EquipNFT handles equipping an NFT of the current user
+// @Summary Equip NFT
+// @Description 装备当前用户持有的 NFT，追加类和通道类的特效只在装备中时生效。最多同时装备 3 个，已经装备时不做修改
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "NFT ID"
+// @Success 200 {object} dto.RespNFT "Successfully equipped NFT"
+// @Failure 404 {object} utils.ErrorResponse "NFT not found"
+// @Failure 409 {object} utils.ErrorResponse "Equip slots are full"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/nfts/{id}/equip [post]
+func (svr *Service) EquipNFT(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "EquipNFT").WithField("user_id", userID).WithField("nft_id", id)
+
+	nft, err := model.EquipNFT(c, svr.db, userID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "nft not found")
+		case errors.Is(err, model.ErrNFTEquipSlotsFull):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "equip slots are full")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to equip nft")
+		}
+		return
+	}
+
+	new(dto.RespNFT).With(new(dto.NFT).FromModel(nft)).Response(c, "nft equipped")
+}
+
+// UnequipNFT handles unequipping an NFT of the current user
+// @Summary Unequip NFT
+// @Description 卸下当前用户装备中的 NFT，没有装备时不做修改
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "NFT ID"
+// @Success 200 {object} dto.RespNFT "Successfully unequipped NFT"
+// @Failure 404 {object} utils.ErrorResponse "NFT not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/nfts/{id}/equip [delete]
+func (svr *Service) UnequipNFT(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "UnequipNFT").WithField("user_id", userID).WithField("nft_id", id)
+
+	nft, err := model.UnequipNFT(c, svr.db, userID, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "nft not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to unequip nft")
+		}
+		return
+	}
+
+	new(dto.RespNFT).With(new(dto.NFT).FromModel(nft)).Response(c, "nft unequipped")
+}
+
+// GetEffects handles retrieving the effects of the equipped NFTs of the current user
+// @Summary Get NFT effects
+// @Description 获取当前用户装备中的 NFT 合并后的特效: 作答积分加成、获得抽卡券的概率 (叠加后有上限) 和解锁的复习计划类型
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} dto.RespNFTModifiers "Successfully retrieved effects"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/effects [get]
+func (svr *Service) GetEffects(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "GetEffects").WithField("user_id", userID)
+
+	modifiers, err := model.GetNFTModifiers(c, svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get nft effects")
+		return
+	}
+	new(dto.RespNFTModifiers).With(modifiers).Response(c, "nft effects found")
+}
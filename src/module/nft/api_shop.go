@@ -0,0 +1,131 @@
+package nft
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// GetShops handles listing the shops
+// @Summary List shops
+// @Description 获取所有系统经营的商店和其中的商品: 当前的价格、价格的时间表、总库存和已经售出的数量
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Success 200 {object} dto.RespNFTShops "Successfully retrieved shops"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/shops [get]
+func (svr *Service) GetShops(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "GetShops").WithField("user_id", userID)
+
+	now := time.Now()
+	shops := model.NFTShops()
+	resp := make([]*dto.NFTShop, 0, len(shops))
+	for _, shop := range shops {
+		sold, err := model.GetNFTShopSold(c, svr.db, shop)
+		if err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get shop stocks")
+			return
+		}
+		resp = append(resp, new(dto.NFTShop).FromModel(shop, sold, now))
+	}
+	new(dto.RespNFTShops).With(resp).Response(c, "shops found")
+}
+
+// GetShop handles retrieving a shop
+// @Summary Get shop
+// @Description 获取商店和其中的商品: 当前的价格、价格的时间表、总库存和已经售出的数量
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "Shop ID"
+// @Success 200 {object} dto.RespNFTShop "Successfully retrieved shop"
+// @Failure 404 {object} utils.ErrorResponse "Shop not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/shops/{id} [get]
+func (svr *Service) GetShop(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "GetShop").WithField("user_id", userID).WithField("shop_id", id)
+
+	shop, err := model.GetNFTShop(id)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "shop not found")
+		return
+	}
+	sold, err := model.GetNFTShopSold(c, svr.db, shop)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get shop stocks")
+		return
+	}
+	new(dto.RespNFTShop).With(new(dto.NFTShop).FromModel(shop, sold, time.Now())).Response(c, "shop found")
+}
+
+// BuyFromShop handles buying an item from a shop
+// @Summary Buy from shop
+// @Description 按当前的价格在商店购买一个商品，通过积分流水支付并得到一个 NFT。限量的商品售罄后返回 409，并发购买时不会超卖。
+// @Description 相同的 Idempotency-Key 只会购买一次，重复的请求返回第一次的结果并带有 Idempotent-Replayed 头
+// @Tags nft
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param id path uint64 true "Shop ID"
+// @Param Idempotency-Key header string false "Client generated key of the purchase"
+// @Param order body ReqBuyFromShop true "Item to buy"
+// @Success 200 {object} dto.RespShopOrder "Successfully bought the item"
+// @Failure 400 {object} utils.ErrorResponse "Invalid request body or insufficient points"
+// @Failure 404 {object} utils.ErrorResponse "Shop or item not found"
+// @Failure 409 {object} utils.ErrorResponse "Item is off sale, sold out, or idempotency key is used by another purchase"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/shops/{id}/buy [post]
+func (svr *Service) BuyFromShop(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "BuyFromShop").WithField("user_id", userID).WithField("shop_id", id)
+
+	var req ReqBuyFromShop
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if req.ItemID == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("item_id is required"), "invalid request body")
+		return
+	}
+	key, ok := utils.GinIdempotencyKey(c, log, string(model.PointReasonNFTShopBuy), userID)
+	if !ok {
+		return
+	}
+
+	order, nft, applied, err := model.BuyFromNFTShop(c, svr.db, userID, id, req.ItemID, time.Now(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrNFTShopNotFound), errors.Is(err, model.ErrNFTShopItemNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "shop item not found")
+		case errors.Is(err, model.ErrInsufficientPoints):
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "failed to buy the item")
+		case errors.Is(err, model.ErrNFTShopItemOffSale), errors.Is(err, model.ErrNFTShopSoldOut):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "the item is not available")
+		case errors.Is(err, model.ErrIdempotencyConflict):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "idempotency key is already used")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to buy the item")
+		}
+		return
+	}
+	if !applied {
+		utils.GinMarkReplayed(c)
+	}
+
+	new(dto.RespShopOrder).With(&dto.ShopOrder{
+		Order: order,
+		NFT:   new(dto.NFT).FromModel(nft),
+	}).Response(c, "item bought")
+}
@@ -0,0 +1,276 @@
+package nft
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// Transfer handles giving an NFT of the current user to another user
+// @Summary Transfer NFT
+// @Description 把当前用户持有的 NFT 赠予另一个用户，装备中的 NFT 会被卸下，挂单中的 NFT 需要先撤单
+// @Tags nft
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param transfer body ReqTransfer true "NFT and recipient"
+// @Success 200 {object} dto.RespNFT "Successfully transferred NFT"
+// @Failure 400 {object} utils.ErrorResponse "Invalid request body or recipient"
+// @Failure 404 {object} utils.ErrorResponse "NFT or recipient not found"
+// @Failure 409 {object} utils.ErrorResponse "NFT is changed concurrently"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/transfer [post]
+func (svr *Service) Transfer(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "Transfer").WithField("user_id", userID)
+
+	var req ReqTransfer
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if req.NFTID == 0 || req.ToUserID == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("nft_id and to_user_id are required"), "invalid request body")
+		return
+	}
+
+	nft, err := model.TransferNFT(c, svr.db, userID, req.ToUserID, req.NFTID)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "nft not found")
+		case errors.Is(err, model.ErrRecipientNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "recipient not found")
+		case errors.Is(err, model.ErrInvalidRecipient):
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid recipient")
+		case errors.Is(err, model.ErrNFTConflict):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "nft is changed concurrently, please retry")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to transfer nft")
+		}
+		return
+	}
+
+	new(dto.RespNFT).With(new(dto.NFT).FromModel(nft)).Response(c, "nft transferred")
+}
+
+// GetTrades handles listing the trades on the market
+// @Summary List trades
+// @Description 获取市场中的挂单，最新的在前。默认只返回 open 的挂单，可以按卖家、模板和稀有度过滤
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param status query string false "open, sold or cancelled" default(open)
+// @Param seller_id query uint64 false "Seller ID"
+// @Param template_id query uint64 false "Template ID"
+// @Param rarity query string false "common, rare, epic or legendary"
+// @Param page query int false "Page number for pagination" default(1)
+// @Param limit query int false "Number of items per page" default(10)
+// @Success 200 {object} dto.RespNFTTrades "Successfully retrieved trades"
+// @Failure 400 {object} utils.ErrorResponse "Invalid query parameters"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/trades [get]
+func (svr *Service) GetTrades(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	pager := utils.GinGetPagerFromQuery(c)
+	log := wlog.ByCtx(c, "GetTrades").WithField("user_id", userID).WithField("pager", pager)
+
+	var req ReqGetTrades
+	if err := c.ShouldBindQuery(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid query parameters")
+		return
+	}
+	if req.Status == "" {
+		req.Status = model.NFTTradeOpen
+	}
+	if !req.Status.Valid() {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Wrap(model.ErrInvalidTradeStatus, "status %q", req.Status), "invalid query parameters")
+		return
+	}
+	if req.Rarity != "" && !req.Rarity.Valid() {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("unknown rarity %q", req.Rarity), "invalid query parameters")
+		return
+	}
+
+	trades, total, err := model.GetNFTTrades(c, svr.db, model.NFTTradeQuery{
+		Status:     req.Status,
+		SellerID:   req.SellerID,
+		TemplateID: req.TemplateID,
+		Rarity:     req.Rarity,
+	}, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get trades")
+		return
+	}
+	pager.Total = total
+
+	resp := new(dto.RespNFTTrades).WithPager(pager)
+	for _, trade := range trades {
+		resp.Append(new(dto.NFTTrade).FromModel(trade))
+	}
+	resp.Response(c, "trades found")
+}
+
+// CreateTrade handles listing an NFT of the current user on the market
+// @Summary Create trade
+// @Description 以 price 个 currency (cash 或 gem，默认为 cash) 挂单出售当前用户持有的 NFT。挂单中的 NFT 由市场托管，
+// @Description 不再属于用户、特效不生效，成交后转移给买家，撤单后归还
+// @Tags nft
+// @Security ApiKeyAuth
+// @Accept json
+// @Produce json
+// @Param trade body ReqCreateTrade true "NFT, currency and price"
+// @Success 200 {object} dto.RespNFTTrade "Successfully created trade"
+// @Failure 400 {object} utils.ErrorResponse "Invalid currency or price"
+// @Failure 404 {object} utils.ErrorResponse "NFT not found"
+// @Failure 409 {object} utils.ErrorResponse "NFT is changed concurrently"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/trades [post]
+func (svr *Service) CreateTrade(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "CreateTrade").WithField("user_id", userID)
+
+	var req ReqCreateTrade
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = model.CurrencyCash
+	}
+
+	trade, err := model.CreateNFTTrade(c, svr.db, userID, req.NFTID, req.Currency, req.Price)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "nft not found")
+		case errors.Is(err, model.ErrInvalidCurrency), errors.Is(err, model.ErrInvalidTradePrice):
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid currency or price")
+		case errors.Is(err, model.ErrNFTConflict):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "nft is changed concurrently, please retry")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to create trade")
+		}
+		return
+	}
+
+	new(dto.RespNFTTrade).With(new(dto.NFTTrade).FromModel(trade)).Response(c, "trade created")
+}
+
+// GetTradeDetails handles retrieving a trade
+// @Summary Get trade details
+// @Description 获取挂单的详情，所有用户可见
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "Trade ID"
+// @Success 200 {object} dto.RespNFTTrade "Successfully retrieved trade"
+// @Failure 404 {object} utils.ErrorResponse "Trade not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/trades/{id} [get]
+func (svr *Service) GetTradeDetails(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "GetTradeDetails").WithField("user_id", userID).WithField("trade_id", id)
+
+	trade, err := model.GetNFTTrade(c, svr.db, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "trade not found")
+		} else {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to get trade")
+		}
+		return
+	}
+
+	new(dto.RespNFTTrade).With(new(dto.NFTTrade).FromModel(trade)).Response(c, "trade found")
+}
+
+// CancelTrade handles cancelling a trade of the current user
+// @Summary Cancel trade
+// @Description 撤销当前用户的挂单，托管的 NFT 归还给用户 (不会重新装备)
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "Trade ID"
+// @Success 200 {object} dto.RespNFTTrade "Successfully cancelled trade"
+// @Failure 404 {object} utils.ErrorResponse "Trade not found"
+// @Failure 409 {object} utils.ErrorResponse "Trade is already sold or cancelled"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/trades/{id} [delete]
+func (svr *Service) CancelTrade(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "CancelTrade").WithField("user_id", userID).WithField("trade_id", id)
+
+	trade, err := model.CancelNFTTrade(c, svr.db, userID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "trade not found")
+		case errors.Is(err, model.ErrTradeNotOpen), errors.Is(err, model.ErrTradeConflict):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "trade is already closed")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to cancel trade")
+		}
+		return
+	}
+
+	new(dto.RespNFTTrade).With(new(dto.NFTTrade).FromModel(trade)).Response(c, "trade cancelled")
+}
+
+// BuyTrade handles buying a trade on the market
+// @Summary Buy trade
+// @Description 购买其他用户的挂单: 通过积分流水支付 price 个 currency 给卖家，NFT 转移给当前用户，两者在同一个事务中完成。
+// @Description 并发购买同一个挂单时只有一个成功，其余返回 409。相同的 Idempotency-Key 只会购买一次，重复的请求返回第一次的结果并带有 Idempotent-Replayed 头
+// @Tags nft
+// @Security ApiKeyAuth
+// @Produce json
+// @Param id path uint64 true "Trade ID"
+// @Param Idempotency-Key header string false "Client generated key of the purchase"
+// @Success 200 {object} dto.RespTradeResult "Successfully bought trade"
+// @Failure 400 {object} utils.ErrorResponse "Own trade or insufficient points"
+// @Failure 404 {object} utils.ErrorResponse "Trade not found"
+// @Failure 409 {object} utils.ErrorResponse "Trade is already closed or idempotency key is used by another purchase"
+// @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Router /nft/trades/{id}/buy [post]
+func (svr *Service) BuyTrade(c *gin.Context) {
+	userID, id := utils.GinMustGetUserID(c), utils.GinMustGetID(c)
+	log := wlog.ByCtx(c, "BuyTrade").WithField("user_id", userID).WithField("trade_id", id)
+
+	key, ok := utils.GinIdempotencyKey(c, log, string(model.PointReasonNFTTradeBuy), userID)
+	if !ok {
+		return
+	}
+
+	trade, nft, applied, err := model.BuyNFTTrade(c, svr.db, userID, id, key)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			utils.GinHandleError(c, log, http.StatusNotFound, err, "trade not found")
+		case errors.Is(err, model.ErrTradeOwnListing), errors.Is(err, model.ErrInsufficientPoints):
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "failed to buy trade")
+		case errors.Is(err, model.ErrTradeNotOpen), errors.Is(err, model.ErrTradeConflict), errors.Is(err, model.ErrNFTConflict):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "trade is already closed")
+		case errors.Is(err, model.ErrIdempotencyConflict):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "idempotency key is already used")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to buy trade")
+		}
+		return
+	}
+	if !applied {
+		utils.GinMarkReplayed(c)
+	}
+
+	new(dto.RespTradeResult).With(&dto.TradeResult{
+		Trade: new(dto.NFTTrade).FromModel(trade),
+		NFT:   new(dto.NFT).FromModel(nft),
+	}).Response(c, "trade bought")
+}
@@ -3,6 +3,8 @@ package nft
 import (
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
 )
 
 type Service struct {
@@ -23,16 +25,26 @@ func Init(db *gorm.DB) (*Service, error) {
 // NFT 查询
 //   - GET /api/v1/nft/nfts：获取用户 NFT
 //   - GET /api/v1/nft/nfts/:id：获取 NFT 详情
+//   - GET /api/v1/nft/effects：查看装备中的 NFT 合并后的特效
 //
 // NFT 操作
+//   - POST /api/v1/nft/nfts/:id/equip：装备，追加类和通道类的特效只在装备中时生效
+//   - DELETE /api/v1/nft/nfts/:id/equip：卸下
 //   - POST /api/v1/nft/draw_card：以抽卡的方式创建 nft
 //   - POST /api/v1/nft/transfer：赠予
 //
-// NFT 商店
+// 抽卡
+//   - GET /api/v1/nft/pools：查看所有卡池和保底进度
+//   - GET /api/v1/nft/draws：抽卡记录，用于校验抽卡结果
+//   - GET /api/v1/nft/draws/seed：查看使用中的种子的哈希
+//   - POST /api/v1/nft/draws/seed：公开使用中的种子并更换
+//
+// NFT 商店 (系统经营，限量、按时间表定价)
 //   - GET /api/v1/nft/shops：查看所有商店
 //   - GET /api/v1/nft/shops/:id：查看某个商店
+//   - POST /api/v1/nft/shops/:id/buy：购买商品
 //
-// NFT 交易管理
+// NFT 交易管理 (挂单中的 NFT 由市场托管)
 //   - GET /api/v1/nft/trades：获取市场交易对
 //   - POST /api/v1/nft/trades：创建交易对
 //   - GET /api/v1/nft/trades/:id：获取交易详情
@@ -40,50 +52,27 @@ func Init(db *gorm.DB) (*Service, error) {
 //   - POST /api/v1/nft/trades/:id/buy：创建购买订单 (会直接生效、因此就是购买)
 func (svr *Service) ApplyMux(group gin.IRouter) {
 	group.GET("/nfts", svr.GetNFTs)
-	group.GET("/nfts/:id", svr.GetNFTDetails)
+	group.GET("/nfts/:id", utils.GinMWParseID(), svr.GetNFTDetails)
+	group.GET("/effects", svr.GetEffects)
+
+	group.POST("/nfts/:id/equip", utils.GinMWParseID(), svr.EquipNFT)
+	group.DELETE("/nfts/:id/equip", utils.GinMWParseID(), svr.UnequipNFT)
 
 	group.POST("/draw_card", svr.DrawCard)
 	group.POST("/transfer", svr.Transfer)
 
+	group.GET("/pools", svr.GetDrawPools)
+	group.GET("/draws", svr.GetDraws)
+	group.GET("/draws/seed", svr.GetDrawSeed)
+	group.POST("/draws/seed", svr.RotateDrawSeed)
+
 	group.GET("/shops", svr.GetShops)
-	group.GET("/shops/:id", svr.GetShop)
+	group.GET("/shops/:id", utils.GinMWParseID(), svr.GetShop)
+	group.POST("/shops/:id/buy", utils.GinMWParseID(), svr.BuyFromShop)
 
 	group.GET("/trades", svr.GetTrades)
 	group.POST("/trades", svr.CreateTrade)
-	group.GET("/trades/:id", svr.GetTradeDetails)
-	group.DELETE("/trades/:id", svr.CancelTrade)
-	group.POST("/trades/:id/buy", svr.BuyTrade)
-}
-
-func (svr *Service) GetNFTs(c *gin.Context) {
-}
-
-func (svr *Service) GetNFTDetails(c *gin.Context) {
-}
-
-func (svr *Service) GetShops(c *gin.Context) {
-}
-
-func (svr *Service) GetShop(c *gin.Context) {
-}
-
-func (svr *Service) DrawCard(c *gin.Context) {
-}
-
-func (svr *Service) Transfer(c *gin.Context) {
-}
-
-func (svr *Service) GetTrades(c *gin.Context) {
-}
-
-func (svr *Service) CreateTrade(c *gin.Context) {
-}
-
-func (svr *Service) GetTradeDetails(c *gin.Context) {
-}
-
-func (svr *Service) CancelTrade(c *gin.Context) {
-}
-
-func (svr *Service) BuyTrade(c *gin.Context) {
+	group.GET("/trades/:id", utils.GinMWParseID(), svr.GetTradeDetails)
+	group.DELETE("/trades/:id", utils.GinMWParseID(), svr.CancelTrade)
+	group.POST("/trades/:id/buy", utils.GinMWParseID(), svr.BuyTrade)
 }
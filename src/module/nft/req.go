@@ -0,0 +1,40 @@
+package nft
+
+import (
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+)
+
+// ReqDrawCard defines the request to draw cards from a pool.
+type ReqDrawCard struct {
+	PoolID     utils.UInt64 `json:"pool_id"`     // 默认为 DefaultPoolID
+	Count      uint32       `json:"count"`       // 连续抽卡的次数，默认为 1
+	ClientSeed string       `json:"client_seed"` // 参与生成随机数的客户端种子，可以为空
+	UseTicket  bool         `json:"use_ticket"`  // 用抽卡券代替积分支付，一张抽一次
+}
+
+// ReqTransfer defines the request to give an NFT to another user.
+type ReqTransfer struct {
+	NFTID    utils.UInt64 `json:"nft_id"`
+	ToUserID utils.UInt64 `json:"to_user_id"`
+}
+
+// ReqCreateTrade defines the request to list an NFT on the market.
+type ReqCreateTrade struct {
+	NFTID    utils.UInt64   `json:"nft_id"`
+	Currency model.Currency `json:"currency"` // cash 或 gem，默认为 cash
+	Price    uint64         `json:"price"`
+}
+
+// ReqGetTrades defines the filters of listing trades, empty filters are ignored.
+type ReqGetTrades struct {
+	Status     model.NFTTradeStatus `form:"status"` // open、sold 或 cancelled，默认为 open
+	SellerID   utils.UInt64         `form:"seller_id"`
+	TemplateID utils.UInt64         `form:"template_id"`
+	Rarity     model.NFTRarity      `form:"rarity"`
+}
+
+// ReqBuyFromShop defines the request to buy an item from a shop.
+type ReqBuyFromShop struct {
+	ItemID utils.UInt64 `json:"item_id"`
+}
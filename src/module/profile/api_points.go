@@ -1,10 +1,13 @@
 package profile
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/bagaking/goulp/wlog"
 	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
 
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/src/model"
@@ -13,7 +16,8 @@ import (
 
 // GetUserPoints retrieves the points for the authenticated user.
 // @Summary Get user points
-// @Description Retrieves points information for the current user.
+// @Description Retrieves points information for the current user, with the idle income accrued until now.
+// @Description 挂机收益在查询时按经过的时间计算，第一次查询时开始挂机，通过 POST /profile/points/claim 领取
 // @Tags profile
 // @Produce  json
 // @Security ApiKeyAuth
@@ -26,15 +30,103 @@ func (svr *Service) GetUserPoints(c *gin.Context) {
 	userID := utils.GinMustGetUserID(c)
 	log := wlog.ByCtx(c, "GetUserPoints").WithField("user_id", userID)
 
-	// Assuming that the user points are a part of the Profile model, you would load the profile
-	// from the database or service and then extract the points part to respond.
-	// This is simulation, replace it with actual logic as needed.
 	points, err := model.EnsureLoadProfilePoints(svr.db, userID)
 	if err != nil {
 		utils.GinHandleError(c, log, http.StatusNotFound, err, "Profile not found")
 		return
 	}
+	now := time.Now()
+	income, err := model.GetIdleIncome(c, svr.db, userID, now)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get idle income")
+		return
+	}
+
+	resp := new(dto.Points).FromModel(points)
+	resp.Idle = new(dto.IdleIncome).FromModel(income.At(now))
+	new(dto.RespPoints).With(resp).Response(c)
+}
+
+// ClaimIdleIncome claims the idle income of the authenticated user.
+// @Summary Claim idle income
+// @Description 领取截止当前的挂机收益，通过积分流水 (reason 为 idle.claim) 发放 cash 后重新开始累积，没有可以领取的收益时 claimed 为 0。
+// @Description 客户端可以通过 Idempotency-Key header 保证重试时只领取一次，重复的请求返回第一次领取的数量 (带 Idempotent-Replayed: true header)
+// @Tags profile
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Idempotency-Key header string false "Client generated key of the claim"
+// @Success 200 {object} dto.RespIdleClaim "Successfully claimed idle income"
+// @Failure 400 {object} utils.ErrorResponse "Invalid idempotency key"
+// @Failure 409 {object} utils.ErrorResponse "Idempotency key is used by another change"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /profile/points/claim [post]
+func (svr *Service) ClaimIdleIncome(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "ClaimIdleIncome").WithField("user_id", userID)
+
+	key, ok := utils.GinIdempotencyKey(c, log, string(model.PointReasonIdleClaim), userID)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	income, record, applied, err := model.ClaimIdleIncome(c, svr.db, userID, now, key)
+	if err != nil {
+		if errors.Is(err, model.ErrIdempotencyConflict) {
+			utils.GinHandleError(c, log, http.StatusConflict, err, "Idempotency key is already used")
+			return
+		}
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to claim idle income")
+		return
+	}
+	result := &dto.IdleClaim{}
+	if record != nil {
+		result.Claimed = utils.UInt64(record.Delta)
+		if !applied {
+			utils.GinMarkReplayed(c)
+		}
+	}
+
+	points, err := model.EnsureLoadProfilePoints(svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get points")
+		return
+	}
+	result.Points = new(dto.Points).FromModel(points)
+	result.Points.Idle = new(dto.IdleIncome).FromModel(income.At(now))
+	new(dto.RespIdleClaim).With(result).Response(c, "idle income claimed")
+}
+
+// GetUserPointHistory retrieves the point transactions of the authenticated user.
+// @Summary Get user point history
+// @Description Retrieves the point ledger of the current user, newest first. Every change of a balance is recorded with its reason and the balance after the change.
+// @Tags profile
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param currency query string false "Only list transactions of this currency: cash, gem, vip_score or draw_ticket"
+// @Param page query int false "Page number for pagination" default(1)
+// @Param limit query int false "Number of items per page" default(10)
+// @Success 200 {object} dto.RespPointHistory "Successfully retrieved point history"
+// @Failure 400 {object} utils.ErrorResponse "Invalid currency"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /profile/points/history [get]
+func (svr *Service) GetUserPointHistory(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	pager := utils.GinGetPagerFromQuery(c)
+	log := wlog.ByCtx(c, "GetUserPointHistory").WithField("user_id", userID).WithField("pager", pager)
+
+	currency := model.Currency(c.Query("currency"))
+	if currency != "" && !currency.Valid() {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Wrap(model.ErrInvalidCurrency, "currency %q", currency), "Invalid currency")
+		return
+	}
+
+	records, total, err := model.GetPointTransactions(c, svr.db, userID, currency, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get point history")
+		return
+	}
+	pager.Total = total
 
-	// Assuming the points information is stored within profile structure.
-	new(dto.RespPoints).With(new(dto.Points).FromModel(points)).Response(c)
+	new(dto.RespPointHistory).WithPager(pager).Append(records...).Response(c, "point history found")
 }
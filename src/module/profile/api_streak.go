@@ -0,0 +1,123 @@
+package profile
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+const (
+	// StreakRecentDays 连续打卡接口返回最近多少天的统计 (包括今天)
+	StreakRecentDays = 7
+)
+
+// GetUserStreak retrieves the streak of the authenticated user.
+// @Summary Get user streak
+// @Description 获取连续打卡、每日目标、持有的补签卡和最近 7 天的统计。日期按用户设置的时区计算，到今天为止的日期变化 (使用补签卡或中断连续打卡) 会先被处理
+// @Tags profile
+// @Produce  json
+// @Security ApiKeyAuth
+// @Success 200 {object} dto.RespStreak "Successfully retrieved streak"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /profile/streak [get]
+func (svr *Service) GetUserStreak(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "GetUserStreak").WithField("user_id", userID)
+
+	now := time.Now()
+	streak, days, err := model.GetUserStreak(c, svr.db, userID, now, StreakRecentDays)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get streak")
+		return
+	}
+
+	new(dto.RespStreak).With(new(dto.Streak).FromModel(streak, days, streak.DateOf(now))).Response(c, "streak found")
+}
+
+// UpdateUserStreak updates the daily goal and timezone of the authenticated user.
+// @Summary Update user streak settings
+// @Description 修改每日目标 (goal_type 为 reviews 或 points) 和时区，没有提供的字段不修改。修改后的目标从当天开始生效
+// @Tags profile
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param settings body ReqUpdateStreak true "Streak settings"
+// @Success 200 {object} dto.RespStreak "Successfully updated streak settings"
+// @Failure 400 {object} utils.ErrorResponse "Invalid goal or timezone"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /profile/streak [put]
+func (svr *Service) UpdateUserStreak(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "UpdateUserStreak").WithField("user_id", userID)
+
+	var req ReqUpdateStreak
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid request body")
+		return
+	}
+
+	if _, err := model.UpdateStreakSettings(c, svr.db, userID, req.GoalType, req.GoalTarget, req.Timezone); err != nil {
+		if errors.Is(err, model.ErrInvalidGoal) || errors.Is(err, model.ErrInvalidTimezone) {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid streak settings")
+			return
+		}
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to update streak settings")
+		return
+	}
+
+	svr.GetUserStreak(c)
+}
+
+// BuyStreakFreezes buys streak freezes with gem for the authenticated user.
+// @Summary Buy streak freezes
+// @Description 用 Gem 购买补签卡，某天没有达成每日目标时自动使用一张以保持连续打卡。客户端可以通过 Idempotency-Key header 保证重试时只购买一次，
+// @Description 重复的请求不再扣费 (带 Idempotent-Replayed: true header)
+// @Tags profile
+// @Accept  json
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param Idempotency-Key header string false "Client generated key of the purchase"
+// @Param purchase body ReqBuyStreakFreezes false "Count of streak freezes, default 1"
+// @Success 200 {object} dto.RespStreak "Successfully bought streak freezes"
+// @Failure 400 {object} utils.ErrorResponse "Invalid count, too many freezes or insufficient gem"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /profile/streak/freezes [post]
+func (svr *Service) BuyStreakFreezes(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "BuyStreakFreezes").WithField("user_id", userID)
+
+	req := ReqBuyStreakFreezes{Count: 1}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid request body")
+			return
+		}
+	}
+
+	key, ok := utils.GinIdempotencyKey(c, log, string(model.PointReasonStreakFreeze), userID)
+	if !ok {
+		return
+	}
+
+	_, applied, err := model.BuyStreakFreezes(c, svr.db, userID, req.Count, key)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidFreezeCount) || errors.Is(err, model.ErrTooManyFreezes) || errors.Is(err, model.ErrInsufficientPoints) {
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "Failed to buy streak freezes")
+			return
+		}
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to buy streak freezes")
+		return
+	}
+	if !applied {
+		utils.GinMarkReplayed(c)
+	}
+
+	svr.GetUserStreak(c)
+}
@@ -26,6 +26,13 @@ func (svr *Service) ApplyMux(router gin.IRouter) {
 	router.GET("/settings/advance", svr.GetUserSettingsAdvance)
 	router.PUT("/settings/advance", svr.GetUserSettingsAdvance)
 
-	// todo: 严格来说这个不算是用户信息的部分。可以考虑分成系统级别的积分和游戏内的 -- 比如 get user points 时要触发挂机计算逻辑，应该只涉及游戏内的。
+	// todo: 严格来说这个不算是用户信息的部分。可以考虑分成系统级别的积分和游戏内的。
+	// get user points 时按经过的时间计算挂机收益 (见 model.IdleIncome)，通过 claim 领取
 	router.GET("/points", svr.GetUserPoints)
+	router.POST("/points/claim", svr.ClaimIdleIncome)
+	router.GET("/points/history", svr.GetUserPointHistory)
+
+	router.GET("/streak", svr.GetUserStreak)
+	router.PUT("/streak", svr.UpdateUserStreak)
+	router.POST("/streak/freezes", svr.BuyStreakFreezes)
 }
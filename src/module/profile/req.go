@@ -1,6 +1,7 @@
 package profile
 
 import (
+	"github.com/bagaking/memorianexus/src/model"
 	"github.com/bagaking/memorianexus/src/module/dto"
 )
 
@@ -24,3 +25,15 @@ type ReqUpdateProfile struct {
 	AvatarURL string `json:"avatar_url,omitempty"`
 	Bio       string `json:"bio,omitempty"`
 }
+
+// ReqUpdateStreak defines the request to update the daily goal and timezone of the streak.
+type ReqUpdateStreak struct {
+	GoalType   *model.GoalType `json:"goal_type"`
+	GoalTarget *uint32         `json:"goal_target"`
+	Timezone   *string         `json:"timezone"` // IANA 时区，如 Asia/Shanghai
+}
+
+// ReqBuyStreakFreezes defines the request to buy streak freezes with gem.
+type ReqBuyStreakFreezes struct {
+	Count uint32 `json:"count"`
+}
@@ -0,0 +1,51 @@
+package system
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// ReconcilePoints handles checking the point balances against the point ledger.
+// @Summary Reconcile point balances
+// @Description Recomputes every balance from the point ledger and lists the balances that differ. An empty list means all balances are consistent.
+// @Description Only operators (MEMORIA_NEXUS_OPERATORS) can access.
+// @Tags system
+// @Produce json
+// @Param user_ids query string false "Comma-separated user IDs to check, all users by default"
+// @Success 200 {object} dto.RespPointDiscrepancies "Balances that differ from the ledger"
+// @Failure 400 {object} utils.ErrorResponse "Invalid user_ids"
+// @Failure 403 {object} utils.ErrorResponse "Forbidden"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /system/points/reconcile [get]
+func (svr *Service) ReconcilePoints(c *gin.Context) {
+	log := wlog.ByCtx(c, "ReconcilePoints")
+
+	var userIDs []utils.UInt64
+	if str := c.Query("user_ids"); str != "" {
+		for _, s := range strings.Split(str, ",") {
+			var id utils.UInt64
+			if err := id.Scan(strings.TrimSpace(s)); err != nil {
+				utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid user_ids")
+				return
+			}
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	discrepancies, err := model.ReconcilePoints(c, svr.db, userIDs...)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to reconcile points")
+		return
+	}
+	if len(discrepancies) > 0 {
+		log.Warnf("found %d point balances differing from the ledger", len(discrepancies))
+	}
+	new(dto.RespPointDiscrepancies).With(discrepancies).Response(c, "points reconciled")
+}
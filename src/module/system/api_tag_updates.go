@@ -0,0 +1,93 @@
+package system
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/gin-gonic/gin"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// GetTagUpdateStats handles getting the status and counters of the tag update worker.
+// @Summary Get tag update worker stats
+// @Description Counters are accumulated since the process started, lag is the number of messages in the queue that are not acknowledged yet.
+// @Description Only operators (MEMORIA_NEXUS_OPERATORS) can access.
+// @Tags system
+// @Produce json
+// @Success 200 {object} dto.RespTagUpdateStats "Successfully retrieved stats"
+// @Failure 403 {object} utils.ErrorResponse "Forbidden"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /system/tag_updates/stats [get]
+func (svr *Service) GetTagUpdateStats(c *gin.Context) {
+	log := wlog.ByCtx(c, "GetTagUpdateStats")
+
+	stats, err := model.TagModel().UpdateMgr.Stats(c)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to get tag update stats")
+		return
+	}
+	new(dto.RespTagUpdateStats).With(stats).Response(c, "tag update stats")
+}
+
+// GetTagUpdateDeadLetters handles listing tag update messages that failed permanently.
+// @Summary List dead letters of tag updates
+// @Description Messages that exhausted their retry attempts or could not be parsed, in the order they failed.
+// @Description Only operators (MEMORIA_NEXUS_OPERATORS) can access.
+// @Tags system
+// @Produce json
+// @Param page query int false "Page number for pagination"
+// @Param limit query int false "Number of items per page"
+// @Success 200 {object} dto.RespDeadLetterList "Successfully retrieved dead letters"
+// @Failure 403 {object} utils.ErrorResponse "Forbidden"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /system/tag_updates/dead_letters [get]
+func (svr *Service) GetTagUpdateDeadLetters(c *gin.Context) {
+	pager := utils.GinGetPagerFromQuery(c)
+	log := wlog.ByCtx(c, "GetTagUpdateDeadLetters").WithField("pager", pager)
+
+	letters, total, err := model.TagModel().UpdateMgr.ListDeadLetters(c, pager.Offset, pager.Limit)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to list dead letters")
+		return
+	}
+	new(dto.RespDeadLetterList).Append(letters...).WithPager(pager.SetTotal(total)).Response(c, "dead letters found")
+}
+
+// ReplayTagUpdateDeadLetter handles re-enqueueing a dead letter.
+// @Summary Replay a dead letter of tag updates
+// @Description Re-enqueues the message with its attempts reset, and removes it from dead letters.
+// @Description Only operators (MEMORIA_NEXUS_OPERATORS) can access.
+// @Tags system
+// @Produce json
+// @Param id path string true "Dead letter ID"
+// @Success 200 {object} dto.RespDeadLetter "The replayed dead letter"
+// @Failure 400 {object} utils.ErrorResponse "The payload of dead letter is invalid"
+// @Failure 403 {object} utils.ErrorResponse "Forbidden"
+// @Failure 404 {object} utils.ErrorResponse "Dead letter not found"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /system/tag_updates/dead_letters/{id}/replay [post]
+func (svr *Service) ReplayTagUpdateDeadLetter(c *gin.Context) {
+	id := c.Param("id")
+	log := wlog.ByCtx(c, "ReplayTagUpdateDeadLetter").WithField("id", id)
+
+	mgr := model.TagModel().UpdateMgr
+	letter, err := mgr.ReplayDeadLetter(c, id)
+	if errors.Is(err, tags.ErrDeadLetterNotFound) {
+		utils.GinHandleError(c, log, http.StatusNotFound, err, "Dead letter not found")
+		return
+	}
+	if errors.Is(err, tags.ErrInvalidDeadLetter) {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Dead letter cannot be replayed")
+		return
+	}
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to replay dead letter")
+		return
+	}
+	new(dto.RespDeadLetter).With(letter).Response(c, "dead letter replayed")
+}
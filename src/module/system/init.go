@@ -1,19 +1,25 @@
 package system
 
 import (
+	"net/http"
+
+	"github.com/bagaking/goulp/wlog"
 	"github.com/gin-gonic/gin"
+	"github.com/khicago/irr"
 	"gorm.io/gorm"
+
+	"github.com/bagaking/memorianexus/internal/utils"
 )
 
 type Service struct {
-	// db *model.db
+	db *gorm.DB
 }
 
 var svr *Service
 
 func Init(db *gorm.DB) (*Service, error) {
 	svr = &Service{
-		// db: model.NewRepo(db),
+		db: db,
 	}
 	return svr, nil
 }
@@ -24,6 +30,31 @@ func (svr *Service) ApplyMux(group gin.IRouter) {
 	group.GET("/announcements", svr.GetAllAnnouncements)
 	group.POST("/announcements/markAsRead", svr.MarkAnnouncementsAsRead)
 	group.GET("/configs", svr.GetGlobalConfigs)
+
+	// 标签更新队列的运维接口
+	tagUpdatesGroup := group.Group("/tag_updates").Use(ginMWRequireOperator())
+	{
+		tagUpdatesGroup.GET("/stats", svr.GetTagUpdateStats)
+		tagUpdatesGroup.GET("/dead_letters", svr.GetTagUpdateDeadLetters)
+		tagUpdatesGroup.POST("/dead_letters/:id/replay", svr.ReplayTagUpdateDeadLetter)
+	}
+
+	// 积分流水的对账接口
+	group.GET("/points/reconcile", ginMWRequireOperator(), svr.ReconcilePoints)
+}
+
+// ginMWRequireOperator 只允许运维人员访问，见 utils.IsOperator
+func ginMWRequireOperator() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := utils.GinMustGetUserID(c)
+		if !utils.IsOperator(userID) {
+			log := wlog.ByCtx(c, "ginMWRequireOperator").WithField("user_id", userID)
+			utils.GinHandleError(c, log, http.StatusForbidden, irr.Error("user %d is not an operator", userID), "Operator permission required")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
 }
 
 func (svr *Service) GetAllNotifications(context *gin.Context) {
@@ -0,0 +1,236 @@
+package tag
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// RenameTag handles renaming a tag of current user.
+// @Summary Rename a tag
+// @Description Renames the tag on all entities of current user, descendants are moved together (e.g. lang/ja => jp moves lang/ja/kanji to jp/kanji).
+// @Description Fails with 409 when the new tag is already in use, use merge instead.
+// @Tags tag
+// @Accept json
+// @Produce json
+// @Param tag path string true "Tag name"
+// @Param body body ReqRenameTag true "New tag name"
+// @Success 200 {object} dto.RespTagChange "Successfully renamed the tag"
+// @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Failure 404 {object} utils.ErrorResponse "Tag not found"
+// @Failure 409 {object} utils.ErrorResponse "New tag already exists"
+// @Router /tags/{tag} [put]
+func (svr *Service) RenameTag(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	tag := utils.GinMustGetTAG(c)
+	log := wlog.ByCtx(c, "RenameTag").WithField("user_id", userID).WithField("tag", tag)
+
+	var req ReqRenameTag
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	to, err := tags.NormalizeTag(req.Tag)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid tag")
+		return
+	}
+
+	svr.moveTag(c, log, userID, tag, to, false, "tag renamed")
+}
+
+// MergeTag handles merging a tag of current user into another tag.
+// @Summary Merge a tag into another tag
+// @Description Moves the tag on all entities of current user to the target tag, descendants are moved together.
+// @Description Entities already tagged with the target are merged.
+// @Tags tag
+// @Accept json
+// @Produce json
+// @Param tag path string true "Tag name"
+// @Param body body ReqMergeTag true "Target tag"
+// @Success 200 {object} dto.RespTagChange "Successfully merged the tag"
+// @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Failure 404 {object} utils.ErrorResponse "Tag not found"
+// @Router /tags/{tag}/merge [post]
+func (svr *Service) MergeTag(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	tag := utils.GinMustGetTAG(c)
+	log := wlog.ByCtx(c, "MergeTag").WithField("user_id", userID).WithField("tag", tag)
+
+	var req ReqMergeTag
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	into, err := tags.NormalizeTag(req.Into)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid tag")
+		return
+	}
+
+	svr.moveTag(c, log, userID, tag, into, true, "tag merged")
+}
+
+// moveTag 把 from 移动到 to，merge 为 false 时 to 已经被使用则返回 409。检查和移动在同一个事务中，
+// 并发的重命名不会把两个标签合并到一起
+func (svr *Service) moveTag(c *gin.Context, log logrus.FieldLogger, userID utils.UInt64, from, to string, merge bool, msg string) {
+	if from == to || tags.InSubtree(to, from) {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("from= %s, to= %s", from, to), "cannot move a tag into itself")
+		return
+	}
+
+	affected := 0
+	if err := svr.db.Transaction(func(tx *gorm.DB) (err error) {
+		if !merge {
+			exists, err := model.UserTagExists(c, tx, userID, to)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return irr.Wrap(model.ErrTagExists, "tag= %s", to)
+			}
+		}
+		affected, err = model.RenameUserTag(c, tx, userID, from, to)
+		return err
+	}); err != nil {
+		switch {
+		case errors.Is(err, model.ErrTagExists):
+			utils.GinHandleError(c, log, http.StatusConflict, err, "tag already exists, merge it instead")
+		case errors.Is(err, tags.ErrInvalidTag):
+			utils.GinHandleError(c, log, http.StatusBadRequest, err, "failed to move tag")
+		default:
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to move tag")
+		}
+		return
+	}
+	if affected == 0 {
+		utils.GinHandleError(c, log, http.StatusNotFound, irr.Error("tag= %s", from), "tag not found")
+		return
+	}
+
+	new(dto.RespTagChange).With(&dto.TagChange{From: from, To: to, Affected: affected}).Response(c, msg)
+}
+
+// DeleteTag handles detaching a tag from all entities of current user.
+// @Summary Delete a tag
+// @Description Detaches the tag and its descendants from all entities of current user. The entities themselves are kept.
+// @Tags tag
+// @Produce json
+// @Param tag path string true "Tag name"
+// @Success 200 {object} dto.RespTagChange "Successfully deleted the tag"
+// @Failure 404 {object} utils.ErrorResponse "Tag not found"
+// @Router /tags/{tag} [delete]
+func (svr *Service) DeleteTag(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	tag := utils.GinMustGetTAG(c)
+	log := wlog.ByCtx(c, "DeleteTag").WithField("user_id", userID).WithField("tag", tag)
+
+	affected := 0
+	if err := svr.db.Transaction(func(tx *gorm.DB) (err error) {
+		affected, err = model.DeleteUserTag(c, tx, userID, tag)
+		return err
+	}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to delete tag")
+		return
+	}
+	if affected == 0 {
+		utils.GinHandleError(c, log, http.StatusNotFound, irr.Error("tag= %s", tag), "tag not found")
+		return
+	}
+
+	new(dto.RespTagChange).With(&dto.TagChange{From: tag, Affected: affected}).Response(c, "tag deleted")
+}
+
+// BulkUpdateTags handles adding and removing tags on a list of entities.
+// @Summary Add or remove tags on entities in bulk
+// @Description Adds and removes tags on items, books or dungeons of current user. When a tag is both added and removed, it is added.
+// @Tags tag
+// @Accept json
+// @Produce json
+// @Param body body ReqBulkTags true "Entities and tags"
+// @Success 200 {object} dto.RespTagBulkChange "Successfully updated tags"
+// @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Failure 404 {object} utils.ErrorResponse "Some entities are not found"
+// @Router /tags/bulk [post]
+func (svr *Service) BulkUpdateTags(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "BulkUpdateTags").WithField("user_id", userID)
+
+	var req ReqBulkTags
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid request body")
+		return
+	}
+	entityIDs := uniqueIDs(req.EntityIDs)
+	if len(entityIDs) == 0 || len(entityIDs) > MaxBulkEntities {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("count= %d, max= %d", len(entityIDs), MaxBulkEntities), "invalid entity count")
+		return
+	}
+	toAdd, err := tags.NormalizeTags(req.Add)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid tags to add")
+		return
+	}
+	toRemove, err := tags.NormalizeTags(req.Remove)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "invalid tags to remove")
+		return
+	}
+	_, toRemove = typer.SliceDiff(toRemove, toAdd)
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("nothing to change"), "no tags to add or remove")
+		return
+	}
+
+	entities, err := model.FindUserEntityTypes(c, svr.db, userID, entityIDs)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to find entities")
+		return
+	}
+	if len(entities) != len(entityIDs) {
+		missing := typer.SliceFilter(entityIDs, func(id utils.UInt64) bool {
+			_, ok := entities[id]
+			return !ok
+		})
+		utils.GinHandleError(c, log, http.StatusNotFound, irr.Error("entity_ids= %v", missing), "entities not found")
+		return
+	}
+
+	if err = svr.db.Transaction(func(tx *gorm.DB) error {
+		return model.BulkUpdateEntityTags(c, tx, userID, entities, toAdd, toRemove)
+	}); err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to update tags")
+		return
+	}
+
+	new(dto.RespTagBulkChange).With(&dto.TagBulkChange{
+		EntityIDs: entityIDs,
+		Added:     toAdd,
+		Removed:   toRemove,
+	}).Response(c, "tags updated")
+}
+
+func uniqueIDs(ids []utils.UInt64) []utils.UInt64 {
+	ret := make([]utils.UInt64, 0, len(ids))
+	seen := make(map[utils.UInt64]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ret = append(ret, id)
+	}
+	return ret
+}
@@ -0,0 +1,70 @@
+package tag
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// QueryTags handles evaluating a boolean tag expression.
+// @Summary Query entities by tag expression
+// @Description Evaluates a tag expression such as `(grammar OR vocab) AND NOT hard` against the tags of current user.
+// @Description Operators are AND, OR, NOT (or &&, ||, !) and parentheses, adjacent tags are joined by AND.
+// @Description Tags match their descendants, quote tags containing spaces. A query that is negated as a whole (e.g. `NOT hard`) is evaluated against all tagged entities.
+// @Tags tag
+// @Produce json
+// @Param q query string true "Tag expression"
+// @Param type query string false "Only query entities of the type (item, book, dungeon)"
+// @Param page query int false "Page number for pagination"
+// @Param limit query int false "Number of items per page"
+// @Success 200 {object} dto.RespIDList "Matched entity ids in ascending order, the normalized query is returned in extra"
+// @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Router /tags/query [get]
+func (svr *Service) QueryTags(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	pager := utils.GinGetPagerFromQuery(c)
+	log := wlog.ByCtx(c, "QueryTags").WithField("user_id", userID).WithField("pager", pager)
+
+	var req ReqQueryTags
+	if err := c.ShouldBindQuery(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid query parameters")
+		return
+	}
+	query, err := tags.ParseQuery(req.Q)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid tag query")
+		return
+	}
+	log = log.WithField("query", query.String())
+
+	var entityType *model.EntityType
+	if req.Type != "" {
+		et, ok := model.ParseEntityType(req.Type)
+		if !ok {
+			utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("type= %s", req.Type), "Invalid entity type")
+			return
+		}
+		entityType = &et
+	}
+
+	ids, err := model.TagModel().QueryEntities(c, userID, query, entityType)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to query tags")
+		return
+	}
+
+	resp := new(dto.RespIDList).WithPager(pager.SetTotal(int64(len(ids))))
+	if pager.Offset < len(ids) {
+		resp.Append(ids[pager.Offset:min(pager.Offset+pager.Limit, len(ids))]...)
+	}
+	resp.Extra = &dto.TagQuery{Query: query.String(), Tags: query.Tags(), Type: req.Type}
+	resp.Response(c, "found entities by tag query")
+}
@@ -0,0 +1,61 @@
+package tag
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/bagaking/goulp/wlog"
+	"github.com/khicago/irr"
+
+	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
+	"github.com/bagaking/memorianexus/src/model"
+	"github.com/bagaking/memorianexus/src/module/dto"
+)
+
+// SuggestTags handles suggesting tags for new content.
+// @Summary Suggest tags for content
+// @Description Ranks tags of current user for the content. The score combines token overlap with content already under each tag,
+// @Description co-occurrence with the chosen tags, and whether the tag name appears in the content. Everything is computed locally.
+// @Tags tag
+// @Accept json
+// @Produce json
+// @Param request body ReqSuggestTags true "Content and chosen tags"
+// @Success 200 {object} dto.RespTagSuggest "Suggested tags ordered by score"
+// @Failure 400 {object} utils.ErrorResponse "Bad Request"
+// @Failure 500 {object} utils.ErrorResponse "Internal Server Error"
+// @Router /tags/suggest [post]
+func (svr *Service) SuggestTags(c *gin.Context) {
+	userID := utils.GinMustGetUserID(c)
+	log := wlog.ByCtx(c, "SuggestTags").WithField("user_id", userID)
+
+	var req ReqSuggestTags
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid request data")
+		return
+	}
+	if len(req.Content) > MaxSuggestContentLength {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("content length %d exceeds %d", len(req.Content), MaxSuggestContentLength), "Content is too long")
+		return
+	}
+	if req.Limit < 0 || req.Limit > MaxSuggestLimit {
+		utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("limit= %d", req.Limit), "Invalid limit")
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = DefaultSuggestLimit
+	}
+	chosen, err := tags.NormalizeTags(req.Tags)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid tags")
+		return
+	}
+
+	profile, err := model.LoadTagProfile(c, svr.db, userID)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "Failed to load tag statistics")
+		return
+	}
+	new(dto.RespTagSuggest).With(profile.Suggest(req.Content, chosen, req.Limit)).Response(c, "tags suggested")
+}
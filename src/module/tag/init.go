@@ -2,6 +2,7 @@ package tag
 
 import (
 	"github.com/bagaking/memorianexus/internal/utils"
+	"github.com/bagaking/memorianexus/pkg/tags"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
@@ -21,8 +22,14 @@ func Init(db *gorm.DB) (*Service, error) {
 
 func (svr *Service) ApplyMux(group gin.IRouter) {
 	group.GET("", svr.GetTags)
-	tagGroup := group.Group("/:tag").Use(utils.GinMWParseTAG())
+	group.GET("/query", svr.QueryTags)
+	group.POST("/bulk", svr.BulkUpdateTags)
+	group.POST("/suggest", svr.SuggestTags)
+	tagGroup := group.Group("/:tag").Use(utils.GinMWParseTAG(tags.NormalizeTag))
 	{
+		tagGroup.PUT("", svr.RenameTag)
+		tagGroup.DELETE("", svr.DeleteTag)
+		tagGroup.POST("/merge", svr.MergeTag)
 		tagGroup.GET("/books", svr.GetBooksByTag)
 		tagGroup.GET("/items", svr.GetItemsByTag)
 	}
@@ -0,0 +1,47 @@
+package tag
+
+import "github.com/bagaking/memorianexus/internal/utils"
+
+const (
+	// MaxBulkEntities 单次批量修改标签的 entity 数量上限
+	MaxBulkEntities = 500
+
+	// DefaultSuggestLimit 默认推荐的标签数
+	DefaultSuggestLimit = 5
+	// MaxSuggestLimit 推荐的标签数上限
+	MaxSuggestLimit = 20
+	// MaxSuggestContentLength 用于推荐标签的内容的最大长度 (字节)
+	MaxSuggestContentLength = 64 * 1024
+)
+
+type (
+	ReqGetTags struct {
+		Flat bool   `form:"flat" json:"flat,omitempty"` // 为 true 时返回平铺的标签列表，否则返回标签树
+		Type string `form:"type" json:"type,omitempty"` // 只统计某一类 entity，如 item、book、dungeon
+	}
+
+	ReqQueryTags struct {
+		Q    string `form:"q" binding:"required"` // 标签表达式，如 (grammar OR vocab) AND NOT hard
+		Type string `form:"type"`                 // 只查询某一类 entity，如 item、book、dungeon
+	}
+
+	ReqRenameTag struct {
+		Tag string `json:"tag" binding:"required"` // 新的标签名，子标签会一起移动
+	}
+
+	ReqMergeTag struct {
+		Into string `json:"into" binding:"required"` // 合并到的目标标签，可以已经存在
+	}
+
+	ReqSuggestTags struct {
+		Content string   `json:"content" binding:"required"` // 新内容，如 item 的 content
+		Tags    []string `json:"tags,omitempty"`             // 已经选择的标签，用于推荐经常一起使用的标签，不会出现在结果中
+		Limit   int      `json:"limit,omitempty"`            // 推荐的标签数，默认 5，最多 20
+	}
+
+	ReqBulkTags struct {
+		EntityIDs []utils.UInt64 `json:"entity_ids" binding:"required"`
+		Add       []string       `json:"add,omitempty"`
+		Remove    []string       `json:"remove,omitempty"`
+	}
+)
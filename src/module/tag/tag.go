@@ -7,34 +7,66 @@ import (
 
 	"github.com/bagaking/goulp/wlog"
 	"github.com/khicago/got/util/typer"
+	"github.com/khicago/irr"
 
 	"github.com/bagaking/memorianexus/internal/utils"
 	"github.com/bagaking/memorianexus/src/model"
 	"github.com/bagaking/memorianexus/src/module/dto"
 )
 
-// GetTags handles retrieving a list of all tags.
+// GetTags handles retrieving all tags of current user.
 // @Summary Get all tags
-// @Description Retrieves a list of all tags.
+// @Description Retrieves the tags of current user as a tree, tags are separated by "/" (e.g. lang/ja/kanji).
+// @Description Each node contains the count of entities tagged directly and the total of distinct entities in the subtree.
+// @Description Use flat=true to get a flat list of tags.
 // @Tags tag
 // @Accept json
 // @Produce json
-// @Param page query int false "Page number for pagination"
-// @Param limit query int false "Number of items per page"
-// @Success 200 {array} dto.RespTagList "Successfully retrieved tags"
+// @Param flat query bool false "Return a flat list instead of a tree"
+// @Param type query string false "Only count entities of the type (item, book, dungeon)"
+// @Param page query int false "Page number for pagination (flat only)"
+// @Param limit query int false "Number of items per page (flat only)"
+// @Success 200 {object} dto.RespTagTree "Successfully retrieved tag tree"
+// @Success 200 {object} dto.RespTagList "Successfully retrieved tags (flat)"
+// @Failure 400 {object} utils.ErrorResponse "Bad Request"
 // @Router /tags [get]
 func (svr *Service) GetTags(c *gin.Context) {
 	pager := utils.GinGetPagerFromQuery(c)
 	userID := utils.GinMustGetUserID(c)
 	log := wlog.ByCtx(c, "GetTags").WithField("pager", pager).WithField("user_id", userID)
 
-	tags, err := model.TagModel().GetTagsByUser(c, userID)
-	if err != nil {
-		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to fetch tags")
+	var req ReqGetTags
+	if err := c.ShouldBindQuery(&req); err != nil {
+		utils.GinHandleError(c, log, http.StatusBadRequest, err, "Invalid query parameters")
+		return
+	}
+
+	if req.Flat {
+		tags, err := model.TagModel().GetTagsByUser(c, userID)
+		if err != nil {
+			utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to fetch tags")
+			return
+		}
+		new(dto.RespTagList).WithPager(pager).Append(tags...).Response(c, "found tags")
 		return
 	}
 
-	new(dto.RespTagList).WithPager(pager).Append(tags...).Response(c, "found tags")
+	var entityType *model.EntityType
+	if req.Type != "" {
+		et, ok := model.ParseEntityType(req.Type)
+		if !ok {
+			utils.GinHandleError(c, log, http.StatusBadRequest, irr.Error("type= %s", req.Type), "Invalid entity type")
+			return
+		}
+		entityType = &et
+	}
+
+	tree, err := model.TagModel().GetTagTree(c, userID, entityType)
+	if err != nil {
+		utils.GinHandleError(c, log, http.StatusInternalServerError, err, "failed to build tag tree")
+		return
+	}
+	new(dto.RespTagTree).With(tree).Response(c, "found tags")
 }
 
 // GetBooksByTag handles retrieving a list of books associated with a specific tag name.
@@ -43,7 +75,7 @@ func (svr *Service) GetTags(c *gin.Context) {
 // @Tags tag
 // @Accept json
 // @Produce json
-// @Param name path string true "Tag Name"
+// @Param tag path string true "Tag name, books tagged with its descendants are included"
 // @Param page query int false "Page number for pagination"
 // @Param limit query int false "Number of items per page"
 // @Success 200 {array} dto.RespBookList "Successfully retrieved books"
@@ -73,11 +105,11 @@ func (svr *Service) GetBooksByTag(c *gin.Context) {
 // @Tags tag
 // @Accept json
 // @Produce json
-// @Param id path uint64 true "Tag ID"
+// @Param tag path string true "Tag name, items tagged with its descendants are included"
 // @Param page query int false "Page number for pagination"
 // @Param limit query int false "Number of items per page"
 // @Success 200 {array} dto.RespItemList "Successfully retrieved items"
-// @Router /tags/{id}/items [get]
+// @Router /tags/{tag}/items [get]
 func (svr *Service) GetItemsByTag(c *gin.Context) {
 	userID := utils.GinMustGetUserID(c)
 	tag := utils.GinMustGetTAG(c)